@@ -0,0 +1,294 @@
+// Package game implements the game analyzer, which recognizes the protocols of common games and game platforms:
+// Steam (its client protocol & the queries of Source engine servers) and Minecraft (Java & Bedrock editions).
+package game
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var (
+	_ analyzer.TCPAnalyzer = (*Analyzer)(nil)
+	_ analyzer.UDPAnalyzer = (*Analyzer)(nil)
+)
+
+const (
+	AppSteam     = "steam"
+	AppMinecraft = "minecraft"
+
+	// tcpLimit is enough for the first message of the client, e.g. the Minecraft handshake.
+	tcpLimit = 512
+	// udpMaxPackets is the number of packets of a UDP stream looked at, at most.
+	udpMaxPackets = 8
+)
+
+var (
+	// steamMagicTCP & steamMagicUDP start the messages of the Steam client to its connection managers,
+	// after the length (TCP) or first (UDP).
+	steamMagicTCP = []byte("VT01")
+	steamMagicUDP = []byte("VS01")
+	// raknetMagic is in the offline (connection setup) messages of RakNet, used by Minecraft Bedrock.
+	raknetMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+)
+
+// Analyzer is the game analyzer. It sets app to the game or platform found, and has the details of the protocol
+// under its name. It has no state of its own, so it is safe for concurrent use.
+type Analyzer struct{}
+
+func (a *Analyzer) Name() string {
+	return "game"
+}
+
+func (a *Analyzer) Limit() int {
+	return tcpLimit
+}
+
+func (a *Analyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
+	return &tcpStream{}
+}
+
+func (a *Analyzer) NewUDP(info analyzer.UDPInfo, logger analyzer.Logger) analyzer.UDPStream {
+	return &udpStream{}
+}
+
+type tcpStream struct {
+	buf []byte // Client data so far
+}
+
+func (s *tcpStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyzer.PropUpdate, done bool) {
+	if skip != 0 {
+		return nil, true
+	}
+	if rev {
+		// Only the first message of the client is needed
+		return nil, false
+	}
+	s.buf = append(s.buf, data...)
+	m, more := parseTCP(s.buf)
+	if m != nil {
+		return &analyzer.PropUpdate{Type: analyzer.PropUpdateReplace, M: m}, true
+	}
+	return nil, !more || len(s.buf) >= tcpLimit
+}
+
+func (s *tcpStream) Close(limited bool) *analyzer.PropUpdate {
+	return nil
+}
+
+// parseTCP returns the properties of the first message of a client, or nil and whether more data could change that.
+func parseTCP(data []byte) (analyzer.PropMap, bool) {
+	if len(data) < 8 {
+		return nil, true
+	}
+	if bytes.Equal(data[4:8], steamMagicTCP) {
+		// Little-endian length of the message, then the magic
+		if n := binary.LittleEndian.Uint32(data); n > 0 && n < 1<<20 {
+			return analyzer.PropMap{
+				"app":    AppSteam,
+				AppSteam: analyzer.PropMap{"protocol": "steam"},
+			}, false
+		}
+	}
+	return parseMinecraftHandshake(data)
+}
+
+// parseMinecraftHandshake parses the handshake of the Java edition of Minecraft: the packet length, its ID (0),
+// then the protocol, the host & port of the server as the client sees them, and the next state
+// (1 for the server status, 2 to log in, 3 to transfer from another server), all VarInts but the port.
+func parseMinecraftHandshake(data []byte) (analyzer.PropMap, bool) {
+	length, n := varInt(data)
+	if n == 0 {
+		return nil, len(data) < 5
+	}
+	if length < 7 || length > 300 || data[n] != 0 {
+		// Not the ID of the handshake
+		return nil, false
+	}
+	if len(data) < n+length {
+		return nil, true
+	}
+	p := data[n+1 : n+length]
+	protocol, n := varInt(p)
+	if n == 0 {
+		return nil, false
+	}
+	p = p[n:]
+	hostLen, n := varInt(p)
+	if n == 0 || hostLen == 0 || hostLen > 255 || len(p) < n+hostLen+3 {
+		return nil, false
+	}
+	host := string(p[n : n+hostLen])
+	p = p[n+hostLen:]
+	port := binary.BigEndian.Uint16(p)
+	state, n := varInt(p[2:])
+	if n == 0 || state < 1 || state > 3 || len(p) != 2+n || !printable(host) {
+		return nil, false
+	}
+	// Forge & some proxies append data to the host after a NUL
+	host, _, _ = strings.Cut(host, "\x00")
+	return analyzer.PropMap{
+		"app": AppMinecraft,
+		AppMinecraft: analyzer.PropMap{
+			"edition":  "java",
+			"protocol": protocol,
+			"host":     host,
+			"port":     int(port),
+			"state":    [...]string{"", "status", "login", "transfer"}[state],
+		},
+	}, false
+}
+
+// varInt decodes a VarInt of up to 32 bits, returning its size, or 0 if it's invalid or truncated.
+func varInt(data []byte) (int, int) {
+	var v uint32
+	for i := 0; i < 5 && i < len(data); i++ {
+		v |= uint32(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return int(int32(v)), i + 1
+		}
+	}
+	return 0, 0
+}
+
+func printable(s string) bool {
+	for _, c := range []byte(s) {
+		if (c < 0x20 && c != 0) || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+type udpStream struct {
+	packets int
+}
+
+func (s *udpStream) Feed(rev bool, data []byte) (u *analyzer.PropUpdate, done bool) {
+	s.packets++
+	m := parseUDP(data)
+	if m == nil {
+		return nil, s.packets >= udpMaxPackets
+	}
+	// RakNet alone isn't necessarily Minecraft, the pong of the server can tell
+	app, _ := m["app"].(string)
+	return &analyzer.PropUpdate{Type: analyzer.PropUpdateReplace, M: m}, app != "" || s.packets >= udpMaxPackets
+}
+
+func (s *udpStream) Close(limited bool) *analyzer.PropUpdate {
+	return nil
+}
+
+// parseUDP returns the properties of a packet, or nil if it's of none of the protocols.
+func parseUDP(data []byte) analyzer.PropMap {
+	switch {
+	case len(data) >= 8 && bytes.Equal(data[:4], steamMagicUDP):
+		return analyzer.PropMap{
+			"app":    AppSteam,
+			AppSteam: analyzer.PropMap{"protocol": "steam"},
+		}
+	case len(data) >= 5 && bytes.Equal(data[:4], []byte{0xff, 0xff, 0xff, 0xff}):
+		return parseSourceQuery(data[4:])
+	default:
+		return parseRakNet(data)
+	}
+}
+
+// parseSourceQuery parses a query of the servers of the Source engine (A2S) or its reply, after the 0xffffffff
+// header of connectionless packets. Steam and its server browser query the servers of most Source & GoldSrc games.
+func parseSourceQuery(data []byte) analyzer.PropMap {
+	m := analyzer.PropMap{"protocol": "source"}
+	// The challenge of the queries & of its reply is 4 bytes
+	challenge := len(data) == 5
+	switch data[0] {
+	case 'T':
+		if !bytes.HasPrefix(data[1:], []byte("Source Engine Query\x00")) {
+			return nil
+		}
+		m["query"] = "info"
+	case 'U':
+		if !challenge {
+			return nil
+		}
+		m["query"] = "players"
+	case 'V':
+		if !challenge {
+			return nil
+		}
+		m["query"] = "rules"
+	case 'A':
+		if !challenge {
+			return nil
+		}
+		m["reply"] = "challenge"
+	case 'I':
+		m["reply"] = "info"
+		// Protocol version, then the NUL-terminated name of the server
+		if len(data) > 2 {
+			if name, _, ok := bytes.Cut(data[2:], []byte{0}); ok && printable(string(name)) {
+				m["server"] = string(name)
+			}
+		}
+	case 'D':
+		m["reply"] = "players"
+	case 'E':
+		m["reply"] = "rules"
+	default:
+		return nil
+	}
+	return analyzer.PropMap{
+		"app":    AppSteam,
+		AppSteam: m,
+	}
+}
+
+// parseRakNet parses the offline messages of RakNet, which set up connections: the unconnected pings (0x01, 0x02)
+// and pong (0x1c) servers are discovered with, and the open connection requests & replies (0x05 to 0x08).
+// The pong of Minecraft Bedrock servers has their name, protocol & release: MCPE;name;protocol;release;...
+func parseRakNet(data []byte) analyzer.PropMap {
+	if len(data) == 0 {
+		return nil
+	}
+	var magicAt int
+	switch data[0] {
+	case 0x01, 0x02:
+		magicAt = 9 // After the time
+	case 0x1c:
+		magicAt = 17 // After the time & the GUID of the server
+	case 0x05, 0x06, 0x07, 0x08:
+		magicAt = 1
+	default:
+		return nil
+	}
+	if len(data) < magicAt+len(raknetMagic) || !bytes.Equal(data[magicAt:magicAt+len(raknetMagic)], raknetMagic) {
+		return nil
+	}
+	m := analyzer.PropMap{
+		"raknet": analyzer.PropMap{"message": int(data[0])},
+	}
+	if data[0] != 0x1c {
+		return m
+	}
+	p := data[magicAt+len(raknetMagic):]
+	if len(p) < 2 || len(p) < 2+int(binary.BigEndian.Uint16(p)) {
+		return m
+	}
+	fields := strings.Split(string(p[2:2+int(binary.BigEndian.Uint16(p))]), ";")
+	if len(fields) < 4 || (fields[0] != "MCPE" && fields[0] != "MCEE") {
+		return m
+	}
+	mc := analyzer.PropMap{
+		"edition": "bedrock",
+		"server":  fields[1],
+		"release": fields[3],
+	}
+	if protocol, err := strconv.Atoi(fields[2]); err == nil {
+		mc["protocol"] = protocol
+	}
+	m["app"] = AppMinecraft
+	m[AppMinecraft] = mc
+	return m
+}
@@ -0,0 +1,113 @@
+// Package icmp implements the analyzers of ICMP & ICMPv6 streams.
+package icmp
+
+import (
+	"hash/fnv"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var (
+	_ analyzer.ICMPAnalyzer = (*ICMPAnalyzer)(nil)
+	_ analyzer.ICMPStream   = (*icmpStream)(nil)
+)
+
+const (
+	icmpMaxMessages = 64 // Messages looked at
+
+	icmpv4Echo = 8
+	icmpv6Echo = 128
+)
+
+// ICMPAnalyzer reports the types & codes of ICMP streams, and for echo (ping) sessions their identifier,
+// latest sequence number and number of requests & replies. Since the data of echo replies must be that of
+// their requests, replies whose data differs, like the data of large echo messages, hint at tunneling.
+type ICMPAnalyzer struct{}
+
+func (a *ICMPAnalyzer) Name() string {
+	return "icmp"
+}
+
+func (a *ICMPAnalyzer) Limit() int {
+	return 0
+}
+
+func (a *ICMPAnalyzer) NewICMP(info analyzer.ICMPInfo, logger analyzer.Logger) analyzer.ICMPStream {
+	version := 4
+	echo := info.Type == icmpv4Echo
+	if info.V6 {
+		version = 6
+		echo = info.Type == icmpv6Echo
+	}
+	return &icmpStream{
+		logger:   logger,
+		version:  version,
+		echo:     echo,
+		requests: make(map[uint16]uint64),
+	}
+}
+
+type icmpStream struct {
+	logger   analyzer.Logger
+	version  int
+	echo     bool
+	first    *analyzer.ICMPMessage
+	seq      uint16
+	messages int
+	replies  int
+	bytes    int
+	maxSize  int
+	mismatch int
+	requests map[uint16]uint64 // Hashes of the data of echo requests by sequence number
+}
+
+func (s *icmpStream) Feed(rev bool, msg analyzer.ICMPMessage) (u *analyzer.PropUpdate, done bool) {
+	if s.first == nil {
+		s.first = &analyzer.ICMPMessage{Type: msg.Type, Code: msg.Code, ID: msg.ID}
+	}
+	s.messages++
+	s.seq = msg.Seq
+	s.bytes += len(msg.Data)
+	s.maxSize = max(s.maxSize, len(msg.Data))
+	if s.echo {
+		h := fnv.New64a()
+		_, _ = h.Write(msg.Data)
+		sum := h.Sum64()
+		if !rev {
+			s.requests[msg.Seq] = sum
+		} else {
+			s.replies++
+			if req, ok := s.requests[msg.Seq]; ok && req != sum {
+				s.mismatch++
+			}
+		}
+	}
+	return &analyzer.PropUpdate{
+		Type: analyzer.PropUpdateReplace,
+		M:    s.props(),
+	}, s.messages >= icmpMaxMessages
+}
+
+func (s *icmpStream) Close(limited bool) *analyzer.PropUpdate {
+	return nil
+}
+
+func (s *icmpStream) props() analyzer.PropMap {
+	m := analyzer.PropMap{
+		"version":  s.version,
+		"type":     int(s.first.Type),
+		"code":     int(s.first.Code),
+		"echo":     s.echo,
+		"messages": s.messages,
+		"bytes":    s.bytes,
+		"max_size": s.maxSize,
+	}
+	if s.echo {
+		m["id"] = int(s.first.ID)
+		m["seq"] = int(s.seq)
+		m["requests"] = s.messages - s.replies
+		m["replies"] = s.replies
+		m["mismatched"] = s.mismatch
+	}
+	return m
+}
@@ -40,6 +40,24 @@ type TCPInfo struct {
 	SrcPort uint16
 	// DstPort is the destination port.
 	DstPort uint16
+	// SYN is the SYN packet that opened the stream,
+	// nil if it didn't start with one (e.g. it was picked up midway).
+	SYN *TCPSYN
+}
+
+// TCPSYN holds the characteristics of a SYN packet, which depend on the OS of its sender.
+type TCPSYN struct {
+	// TTL is the TTL (IPv4) or hop limit (IPv6) of the packet.
+	TTL uint8
+	// Window is the window size.
+	Window uint16
+	// MSS is the maximum segment size option, 0 if none.
+	MSS uint16
+	// WindowScale is the window scale option, -1 if none.
+	WindowScale int
+	// Options are the kinds of TCP options, in order: mss, nop, ws, sok (SACK permitted), sack, ts, eol,
+	// or ?<kind> for the others.
+	Options []string
 }
 
 type TCPStream interface {
@@ -81,6 +99,108 @@ type UDPStream interface {
 	Close(limited bool) *PropUpdate
 }
 
+type SCTPAnalyzer interface {
+	Analyzer
+	// NewSCTP returns a new SCTPStream.
+	NewSCTP(SCTPInfo, Logger) SCTPStream
+}
+
+type SCTPInfo struct {
+	// SrcIP is the (primary) source IP address.
+	SrcIP net.IP
+	// DstIP is the (primary) destination IP address.
+	DstIP net.IP
+	// SrcPort is the source port.
+	SrcPort uint16
+	// DstPort is the destination port.
+	DstPort uint16
+}
+
+// SCTPChunk is a chunk of an SCTP association. DATA chunks are reassembled into user messages first,
+// and duplicates are not fed again.
+type SCTPChunk struct {
+	// Type is the chunk type, e.g. SCTPChunkData or SCTPChunkInit.
+	Type uint8
+	// Flags are the chunk flags. For DATA, only the U (unordered) bit is kept.
+	Flags uint8
+	// StreamID is the SCTP stream a user message was sent on, only for DATA.
+	StreamID uint16
+	// PPID is the payload protocol identifier of a user message, only for DATA.
+	PPID uint32
+	// Data is the user message for DATA, and the chunk value (after the chunk header) for the others.
+	Data []byte
+}
+
+// SCTP chunk types, see RFC 9260.
+const (
+	SCTPChunkData             = 0
+	SCTPChunkInit             = 1
+	SCTPChunkInitAck          = 2
+	SCTPChunkSack             = 3
+	SCTPChunkHeartbeat        = 4
+	SCTPChunkHeartbeatAck     = 5
+	SCTPChunkAbort            = 6
+	SCTPChunkShutdown         = 7
+	SCTPChunkShutdownAck      = 8
+	SCTPChunkError            = 9
+	SCTPChunkCookieEcho       = 10
+	SCTPChunkCookieAck        = 11
+	SCTPChunkShutdownComplete = 14
+)
+
+type SCTPStream interface {
+	// Feed feeds a chunk of the association to the stream.
+	// It returns a prop update containing the information extracted from the stream (can be nil),
+	// and whether the analyzer is "done" with this stream (i.e. no more chunks should be fed).
+	Feed(rev bool, chunk SCTPChunk) (u *PropUpdate, done bool)
+	// Close indicates that the stream is closed.
+	// Either the association is shut down or aborted, or the stream has reached its byte limit.
+	// Like Feed, it optionally returns a prop update.
+	Close(limited bool) *PropUpdate
+}
+
+type ICMPAnalyzer interface {
+	Analyzer
+	// NewICMP returns a new ICMPStream.
+	NewICMP(ICMPInfo, Logger) ICMPStream
+}
+
+type ICMPInfo struct {
+	// SrcIP is the source IP address, of the requests for echo sessions.
+	SrcIP net.IP
+	// DstIP is the destination IP address.
+	DstIP net.IP
+	// V6 is whether the stream is ICMPv6, whose types differ from ICMPv4's.
+	V6 bool
+	// Type is the type of the requests for echo sessions, or of the messages for the others.
+	Type uint8
+	// ID is the identifier of echo sessions, 0 for the others.
+	ID uint16
+}
+
+// ICMPMessage is an ICMP message of a stream.
+type ICMPMessage struct {
+	Type uint8
+	Code uint8
+	// ID & Seq are the identifier & sequence number of echo messages, 0 for the others.
+	ID  uint16
+	Seq uint16
+	// Data is what follows the identifier & sequence number for echo messages,
+	// and the type-specific header for the others.
+	Data []byte
+}
+
+type ICMPStream interface {
+	// Feed feeds a message to the stream, rev being whether it's a reply of an echo session.
+	// It returns a prop update containing the information extracted from the stream (can be nil),
+	// and whether the analyzer is "done" with this stream (i.e. no more messages should be fed).
+	Feed(rev bool, msg ICMPMessage) (u *PropUpdate, done bool)
+	// Close indicates that the stream is closed.
+	// Either the stream has been idle or evicted, or it has reached its byte limit.
+	// Like Feed, it optionally returns a prop update.
+	Close(limited bool) *PropUpdate
+}
+
 type (
 	PropMap         map[string]interface{}
 	CombinedPropMap map[string]PropMap
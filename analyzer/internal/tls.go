@@ -1,24 +1,58 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/analyzer/utils"
 )
 
 // TLS record types.
 const (
-	RecordTypeHandshake = 0x16
+	RecordTypeChangeCipherSpec = 0x14
+	RecordTypeHandshake        = 0x16
+	RecordTypeApplicationData  = 0x17
 )
 
 // TLS handshake message types.
 const (
-	TypeClientHello = 0x01
-	TypeServerHello = 0x02
+	TypeClientHello        = 0x01
+	TypeServerHello        = 0x02
+	TypeCertificate        = 0x0b
+	TypeCertificateRequest = 0x0d
+	TypeServerHelloDone    = 0x0e
+)
+
+// TLS versions. TLS 1.3 is only in the supported_versions extension.
+const (
+	VersionTLS12 = 0x0303
+	VersionTLS13 = 0x0304
 )
 
+// MinRSAKeyBits is the size of the smallest RSA keys of certificates that aren't weak.
+const MinRSAKeyBits = 2048
+
+// helloRetryRandom is the random of the server hellos that are HelloRetryRequests in TLS 1.3 (RFC 8446, section 4.1.3).
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
 // TLS extension numbers.
 const (
 	extServerName           = 0x0000
+	extSupportedGroups      = 0x000a
+	extECPointFormats       = 0x000b
 	extALPN                 = 0x0010
 	extSupportedVersions    = 0x002b
 	extEncryptedClientHello = 0xfe0d
@@ -29,7 +63,8 @@ func ParseTLSClientHelloMsgData(chBuf *utils.ByteBuffer) analyzer.PropMap {
 	m := make(analyzer.PropMap)
 	// Version, random & session ID length combined are within 35 bytes,
 	// so no need for bounds checking
-	m["version"], _ = chBuf.GetUint16(false, true)
+	version, _ := chBuf.GetUint16(false, true)
+	m["version"] = version
 	m["random"], _ = chBuf.Get(32, true)
 	sessionIDLen, _ := chBuf.GetByte(true)
 	m["session"], ok = chBuf.Get(int(sessionIDLen), true)
@@ -68,6 +103,7 @@ func ParseTLSClientHelloMsgData(chBuf *utils.ByteBuffer) analyzer.PropMap {
 	extsLen, ok := chBuf.GetUint16(false, true)
 	if !ok {
 		// No extensions, I guess it's possible?
+		m["ja3"] = ja3(version, ciphers, nil, nil, nil)
 		return m
 	}
 	extBuf, ok := chBuf.GetSubBuffer(int(extsLen), true)
@@ -75,6 +111,10 @@ func ParseTLSClientHelloMsgData(chBuf *utils.ByteBuffer) analyzer.PropMap {
 		// Not enough data for extensions
 		return nil
 	}
+	var (
+		exts, groups []uint16
+		formats      []byte
+	)
 	for extBuf.Len() > 0 {
 		extType, ok := extBuf.GetUint16(false, true)
 		if !ok {
@@ -87,21 +127,83 @@ func ParseTLSClientHelloMsgData(chBuf *utils.ByteBuffer) analyzer.PropMap {
 			return nil
 		}
 		extDataBuf, ok := extBuf.GetSubBuffer(int(extLen), true)
-		if !ok || !parseTLSExtensions(extType, extDataBuf, m) {
-			// Not enough data for extension data, or invalid extension
+		if !ok {
+			// Not enough data for extension data
+			return nil
+		}
+		exts = append(exts, extType)
+		// Only needed for the fingerprint, read from a copy as parseTLSExtensions consumes the data
+		switch extType {
+		case extSupportedGroups:
+			groupsBuf := &utils.ByteBuffer{Buf: extDataBuf.Buf}
+			if groupsBuf.Skip(2) { // Ignore list length, as we read until the end
+				for groupsBuf.Len() >= 2 {
+					group, _ := groupsBuf.GetUint16(false, true)
+					groups = append(groups, group)
+				}
+			}
+		case extECPointFormats:
+			if len(extDataBuf.Buf) > 0 {
+				formats = extDataBuf.Buf[1:] // Without the list length
+			}
+		}
+		if !parseTLSExtensions(extType, extDataBuf, m) {
+			// Invalid extension
 			return nil
 		}
 	}
+	m["ja3"] = ja3(version, ciphers, exts, groups, formats)
 	return m
 }
 
+// isGREASE reports whether a value is one of the GREASE values of RFC 8701 (0x0a0a, 0x1a1a... 0xfafa),
+// which clients pick at random.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3 returns the JA3 fingerprint of a client hello: the MD5 (in hex) of its version, ciphers,
+// extensions, supported groups & point formats in decimal, without the GREASE values.
+func ja3(version uint16, ciphers, exts, groups []uint16, formats []byte) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.Itoa(int(version)))
+	for _, list := range [][]uint16{ciphers, exts, groups} {
+		sb.WriteByte(',')
+		first := true
+		for _, v := range list {
+			if isGREASE(v) {
+				continue
+			}
+			if !first {
+				sb.WriteByte('-')
+			}
+			sb.WriteString(strconv.Itoa(int(v)))
+			first = false
+		}
+	}
+	sb.WriteByte(',')
+	for i, f := range formats {
+		if i > 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteString(strconv.Itoa(int(f)))
+	}
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
 func ParseTLSServerHelloMsgData(shBuf *utils.ByteBuffer) analyzer.PropMap {
 	var ok bool
 	m := make(analyzer.PropMap)
 	// Version, random & session ID length combined are within 35 bytes,
 	// so no need for bounds checking
 	m["version"], _ = shBuf.GetUint16(false, true)
-	m["random"], _ = shBuf.Get(32, true)
+	random, _ := shBuf.Get(32, true)
+	m["random"] = random
+	if bytes.Equal(random, helloRetryRandom) {
+		// The server asks the client for another hello, e.g. with another key share
+		m["hello_retry"] = true
+	}
 	sessionIDLen, _ := shBuf.GetByte(true)
 	m["session"], ok = shBuf.Get(int(sessionIDLen), true)
 	if !ok {
@@ -222,3 +324,125 @@ func parseTLSExtensions(extType uint16, extDataBuf *utils.ByteBuffer, m analyzer
 	}
 	return true
 }
+
+// ParseTLSCertificateMsgData parses the first certificate (that of the peer) of a Certificate message
+// of TLS 1.2 and before, or returns nil if there's none or it's invalid.
+func ParseTLSCertificateMsgData(body []byte) *x509.Certificate {
+	// Length of the list, then of the certificate
+	if len(body) < 6 {
+		return nil
+	}
+	certLen := int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+	if len(body) < 6+certLen {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(body[6 : 6+certLen])
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// TLSCertToPropMap returns the properties of a certificate, whether it's expired being as of now
+// (not valid yet included, like the expired_cert weakness).
+func TLSCertToPropMap(cert *x509.Certificate, now time.Time) analyzer.PropMap {
+	key, bits := certKey(cert)
+	return analyzer.PropMap{
+		"subject":     cert.Subject.CommonName,
+		"issuer":      cert.Issuer.CommonName,
+		"dns_names":   cert.DNSNames,
+		"not_before":  cert.NotBefore.Unix(),
+		"not_after":   cert.NotAfter.Unix(),
+		"expired":     certExpired(cert, now),
+		"self_signed": bytes.Equal(cert.RawSubject, cert.RawIssuer),
+		"key":         key,
+		"key_bits":    bits,
+		"signature":   cert.SignatureAlgorithm.String(),
+	}
+}
+
+// certExpired returns whether a certificate is outside of its validity period.
+func certExpired(cert *x509.Certificate, now time.Time) bool {
+	return now.After(cert.NotAfter) || now.Before(cert.NotBefore)
+}
+
+// certKey returns the type & size of the public key of a certificate.
+func certKey(cert *x509.Certificate) (string, int) {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "rsa", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ecdsa", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "ed25519", 256
+	case *dsa.PublicKey:
+		return "dsa", k.P.BitLen()
+	default:
+		return "unknown", 0
+	}
+}
+
+// TLSWeaknesses returns the weaknesses of a connection, from the version & cipher suite selected by the server,
+// and its certificate if known (nil otherwise):
+//   - deprecated_version: SSL 3.0, TLS 1.0 or 1.1 (RFC 8996)
+//   - export_cipher: an export-grade cipher suite, of 40 or 56-bit keys
+//   - weak_cipher: a cipher suite without encryption or authentication, or with RC4, DES or 3DES
+//   - expired_cert: the certificate is expired, or not valid yet
+//   - short_rsa_key: the RSA key of the certificate has fewer than MinRSAKeyBits bits
+//   - weak_signature: the certificate is signed with MD5 or SHA-1
+func TLSWeaknesses(version, cipher uint16, cert *x509.Certificate, now time.Time) []string {
+	weak := []string{}
+	if version < VersionTLS12 {
+		weak = append(weak, "deprecated_version")
+	}
+	if exportCiphers[cipher] {
+		weak = append(weak, "export_cipher")
+	} else if weakCiphers[cipher] {
+		weak = append(weak, "weak_cipher")
+	}
+	if cert == nil {
+		return weak
+	}
+	if certExpired(cert, now) {
+		weak = append(weak, "expired_cert")
+	}
+	if key, bits := certKey(cert); key == "rsa" && bits < MinRSAKeyBits {
+		weak = append(weak, "short_rsa_key")
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		weak = append(weak, "weak_signature")
+	}
+	return weak
+}
+
+// exportCiphers are the export-grade cipher suites, whose keys are limited to 40 or 56 bits.
+var exportCiphers = cipherSet(
+	0x0003, 0x0006, 0x0008, 0x000b, 0x000e, 0x0011, 0x0014, 0x0017, 0x0019, // *_EXPORT_*
+	0x0026, 0x0027, 0x0028, 0x0029, 0x002a, 0x002b, // TLS_KRB5_EXPORT_*
+	0x0060, 0x0061, 0x0062, 0x0063, 0x0064, 0x0065, // *_EXPORT1024_*
+)
+
+// weakCiphers are the other weak cipher suites: without encryption (NULL) or authentication (anon),
+// or with RC4, DES or 3DES.
+var weakCiphers = cipherSet(
+	// NULL
+	0x0000, 0x0001, 0x0002, 0x002c, 0x002d, 0x002e, 0x003b, 0x00b0, 0x00b1, 0x00b4, 0x00b5, 0x00b8, 0x00b9,
+	0xc001, 0xc006, 0xc00b, 0xc010, 0xc015, 0xc039, 0xc03a, 0xc03b,
+	// anon
+	0x0018, 0x001a, 0x001b, 0x0034, 0x003a, 0x0046, 0x006c, 0x006d, 0x0089, 0x009b, 0x00a6, 0x00a7, 0x00bf, 0x00c5,
+	0xc016, 0xc017, 0xc018, 0xc019,
+	// RC4
+	0x0004, 0x0005, 0x0020, 0x0024, 0x0066, 0x008a, 0x008e, 0x0092, 0xc002, 0xc007, 0xc00c, 0xc011, 0xc033,
+	// DES & 3DES
+	0x0009, 0x000a, 0x000c, 0x000d, 0x000f, 0x0010, 0x0012, 0x0013, 0x0015, 0x0016, 0x001e, 0x001f, 0x0022, 0x0023,
+	0x008b, 0x008f, 0x0093, 0xc003, 0xc008, 0xc00d, 0xc012, 0xc01a, 0xc01b, 0xc01c, 0xc034,
+)
+
+func cipherSet(ciphers ...uint16) map[uint16]bool {
+	m := make(map[uint16]bool, len(ciphers))
+	for _, c := range ciphers {
+		m[c] = true
+	}
+	return m
+}
@@ -0,0 +1,211 @@
+package ml
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Features are computed over the first packets of a stream that carry a payload: UDP datagrams,
+// or chunks of reassembled data for TCP (usually one per segment). Forward is from the client to
+// the server, backward from the server to the client. Sizes are in bytes, times in seconds.
+const (
+	// FeatureSizes are the sizes of the first packets, negative for backward packets
+	// and 0 past the last packet. It counts as many features as there are packets.
+	FeatureSizes = "sizes"
+	// FeatureIATs are the inter-arrival times of the first packets (0 for the first one),
+	// and 0 past the last packet. It counts as many features as there are packets.
+	FeatureIATs = "iats"
+)
+
+// scalarFeatures are the features that are a single value, in their default order.
+var scalarFeatures = []string{
+	"proto", // 6 for TCP, 17 for UDP
+	"src_port",
+	"dst_port",
+	"duration",
+	"packets",
+	"fwd_packets",
+	"bwd_packets",
+	"bytes",
+	"fwd_bytes",
+	"bwd_bytes",
+	"size_min",
+	"size_max",
+	"size_mean",
+	"size_std",
+	"fwd_size_min",
+	"fwd_size_max",
+	"fwd_size_mean",
+	"fwd_size_std",
+	"bwd_size_min",
+	"bwd_size_max",
+	"bwd_size_mean",
+	"bwd_size_std",
+	"iat_min",
+	"iat_max",
+	"iat_mean",
+	"iat_std",
+}
+
+// DefaultFeatures returns the default features: all the scalar features.
+func DefaultFeatures() []string {
+	return append([]string{}, scalarFeatures...)
+}
+
+// featureCount returns the number of values of the features, for the number of packets,
+// or an error if one of them is unknown.
+func featureCount(features []string, packets int) (int, error) {
+	n := 0
+	for _, f := range features {
+		switch f {
+		case FeatureSizes, FeatureIATs:
+			n += packets
+		default:
+			if flowFeature(&flowStats{}, f) == nil {
+				return 0, fmt.Errorf("unknown feature %q", f)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// runningStats are the statistics of a series of values.
+type runningStats struct {
+	n             int
+	min, max, sum float64
+	sumSq         float64
+}
+
+func (s *runningStats) add(v float64) {
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
+	s.n++
+	s.sum += v
+	s.sumSq += v * v
+}
+
+func (s *runningStats) mean() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return s.sum / float64(s.n)
+}
+
+// std returns the population standard deviation.
+func (s *runningStats) std() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	m := s.mean()
+	return math.Sqrt(math.Max(s.sumSq/float64(s.n)-m*m, 0))
+}
+
+// flowStats are the statistics of the first packets of a stream.
+type flowStats struct {
+	proto            int
+	srcPort, dstPort uint16
+	start, last      time.Time
+	all, fwd, bwd    runningStats // Of the sizes
+	iat              runningStats
+	sizes, iats      []float64
+}
+
+// add records a packet of the stream.
+func (f *flowStats) add(rev bool, size int, now time.Time) {
+	var iat float64
+	if f.all.n == 0 {
+		f.start = now
+	} else {
+		iat = now.Sub(f.last).Seconds()
+		f.iat.add(iat)
+	}
+	f.last = now
+	f.all.add(float64(size))
+	if rev {
+		f.bwd.add(float64(size))
+		f.sizes = append(f.sizes, -float64(size))
+	} else {
+		f.fwd.add(float64(size))
+		f.sizes = append(f.sizes, float64(size))
+	}
+	f.iats = append(f.iats, iat)
+}
+
+// flowFeature returns a function returning the value of a scalar feature, or nil if it's unknown.
+func flowFeature(f *flowStats, name string) func() float64 {
+	switch name {
+	case "proto":
+		return func() float64 { return float64(f.proto) }
+	case "src_port":
+		return func() float64 { return float64(f.srcPort) }
+	case "dst_port":
+		return func() float64 { return float64(f.dstPort) }
+	case "duration":
+		return func() float64 { return f.last.Sub(f.start).Seconds() }
+	case "packets":
+		return func() float64 { return float64(f.all.n) }
+	case "fwd_packets":
+		return func() float64 { return float64(f.fwd.n) }
+	case "bwd_packets":
+		return func() float64 { return float64(f.bwd.n) }
+	case "bytes":
+		return func() float64 { return f.all.sum }
+	case "fwd_bytes":
+		return func() float64 { return f.fwd.sum }
+	case "bwd_bytes":
+		return func() float64 { return f.bwd.sum }
+	}
+	var s *runningStats
+	var stat string
+	for prefix, rs := range map[string]*runningStats{"size_": &f.all, "fwd_size_": &f.fwd, "bwd_size_": &f.bwd, "iat_": &f.iat} {
+		if rest, ok := strings.CutPrefix(name, prefix); ok {
+			s, stat = rs, rest
+		}
+	}
+	if s == nil {
+		return nil
+	}
+	switch stat {
+	case "min":
+		return func() float64 { return s.min }
+	case "max":
+		return func() float64 { return s.max }
+	case "mean":
+		return s.mean
+	case "std":
+		return s.std
+	default:
+		return nil
+	}
+}
+
+// vector returns the values of the features, for the number of packets.
+func (f *flowStats) vector(features []string, packets int) []float32 {
+	var v []float32
+	for _, name := range features {
+		switch name {
+		case FeatureSizes, FeatureIATs:
+			seq := f.sizes
+			if name == FeatureIATs {
+				seq = f.iats
+			}
+			for k := 0; k < packets; k++ {
+				if k < len(seq) {
+					v = append(v, float32(seq[k]))
+				} else {
+					v = append(v, 0)
+				}
+			}
+		default:
+			v = append(v, float32(flowFeature(f, name)()))
+		}
+	}
+	return v
+}
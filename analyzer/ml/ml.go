@@ -0,0 +1,229 @@
+// Package ml implements the ml analyzer, which classifies streams with a user-supplied ONNX model
+// fed the statistical features of their first packets, e.g. to detect encrypted applications.
+package ml
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var (
+	_ analyzer.TCPAnalyzer = (*Analyzer)(nil)
+	_ analyzer.UDPAnalyzer = (*Analyzer)(nil)
+)
+
+const DefaultPackets = 20
+
+// Config is the config of the ml analyzer.
+type Config struct {
+	Model    string   // File of the ONNX model
+	Features []string // Fed to the model in this order; default DefaultFeatures()
+	Packets  int      // Classified after this many packets (or when closed before); default DefaultPackets
+	Output   string   // Output of the model with the class scores; default its first float output
+	Labels   []string // Of the classes; default the class labels of the model, or their indexes
+	Softmax  bool     // Apply softmax to the scores, for models outputting logits
+}
+
+// Analyzer is the ml analyzer. It feeds the features of the first packets of streams into an ONNX model,
+// and sets the predicted label, its class index & confidence (its score, a probability for most models) as
+// the label, class & confidence properties, with the number of packets they're based on as packets.
+type Analyzer struct {
+	model    *Model
+	input    ValueInfo
+	shape    []int
+	features []string
+	packets  int
+	output   string
+	labels   []string
+	softmax  bool
+}
+
+// NewAnalyzer loads the model, and checks it classifies a stream with the features of the config.
+func NewAnalyzer(c Config) (*Analyzer, error) {
+	model, err := LoadModel(c.Model)
+	if err != nil {
+		return nil, err
+	}
+	if len(model.Inputs) != 1 {
+		return nil, fmt.Errorf("the model must have one input, it has %d", len(model.Inputs))
+	}
+	a := &Analyzer{
+		model:    model,
+		input:    model.Inputs[0],
+		features: c.Features,
+		packets:  c.Packets,
+		output:   c.Output,
+		labels:   c.Labels,
+		softmax:  c.Softmax,
+	}
+	if len(a.features) == 0 {
+		a.features = DefaultFeatures()
+	}
+	if a.packets <= 0 {
+		a.packets = DefaultPackets
+	}
+	n, err := featureCount(a.features, a.packets)
+	if err != nil {
+		return nil, err
+	}
+	// One row of n features, whatever the batch dimension
+	switch dims := a.input.Dims; {
+	case len(dims) == 1 && (dims[0] == n || dims[0] < 0):
+		a.shape = []int{n}
+	case len(dims) == 2 && (dims[1] == n || dims[1] < 0) && dims[0] <= 1:
+		a.shape = []int{1, n}
+	case len(dims) == 0:
+		a.shape = []int{1, n}
+	default:
+		return nil, fmt.Errorf("the input of the model has shape %v, but there are %d features", dims, n)
+	}
+	if a.output == "" {
+		for _, vi := range model.Outputs {
+			if vi.Type == onnxFloat || vi.Type == onnxDouble {
+				a.output = vi.Name
+				break
+			}
+		}
+		if a.output == "" {
+			return nil, errors.New("the model has no float output")
+		}
+	} else {
+		found := false
+		for _, vi := range model.Outputs {
+			found = found || vi.Name == a.output
+		}
+		if !found {
+			return nil, fmt.Errorf("the model has no output %q", a.output)
+		}
+	}
+	if len(a.labels) == 0 {
+		a.labels = model.ClassLabels
+	}
+	// Classify an empty stream, to check the model runs
+	if _, err := a.classify(&flowStats{}); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Analyzer) Name() string {
+	return "ml"
+}
+
+func (a *Analyzer) Limit() int {
+	return 0
+}
+
+func (a *Analyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
+	return &mlStream{
+		analyzer: a,
+		logger:   logger,
+		flow:     flowStats{proto: 6, srcPort: info.SrcPort, dstPort: info.DstPort},
+	}
+}
+
+func (a *Analyzer) NewUDP(info analyzer.UDPInfo, logger analyzer.Logger) analyzer.UDPStream {
+	return udpStream{&mlStream{
+		analyzer: a,
+		logger:   logger,
+		flow:     flowStats{proto: 17, srcPort: info.SrcPort, dstPort: info.DstPort},
+	}}
+}
+
+// classify runs the model on the features of a stream, and returns its prediction as properties.
+func (a *Analyzer) classify(f *flowStats) (analyzer.PropMap, error) {
+	x := newFloatTensor(a.shape, f.vector(a.features, a.packets))
+	outputs, err := a.model.run(map[string]*tensor{a.input.Name: x})
+	if err != nil {
+		return nil, err
+	}
+	scores, err := outputs[a.output].floats()
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) == 0 {
+		return nil, errors.New("no scores")
+	}
+	scores = append([]float32{}, scores...)
+	if a.softmax {
+		softmax(scores, 1, len(scores), 1)
+	}
+	var class int
+	var confidence float32
+	if len(scores) == 1 {
+		// A binary classifier, with the probability of the positive class
+		if scores[0] >= 0.5 {
+			class, confidence = 1, scores[0]
+		} else {
+			confidence = 1 - scores[0]
+		}
+	} else {
+		class = argMax(scores)
+		confidence = scores[class]
+	}
+	label := fmt.Sprint(class)
+	if class < len(a.labels) {
+		label = a.labels[class]
+	}
+	return analyzer.PropMap{
+		"label":      label,
+		"class":      class,
+		"confidence": float64(confidence),
+		"packets":    f.all.n,
+	}, nil
+}
+
+type mlStream struct {
+	analyzer *Analyzer
+	logger   analyzer.Logger
+	flow     flowStats
+	done     bool
+}
+
+func (s *mlStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyzer.PropUpdate, done bool) {
+	return s.feed(rev, data)
+}
+
+func (s *mlStream) feed(rev bool, data []byte) (u *analyzer.PropUpdate, done bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	s.flow.add(rev, len(data), time.Now())
+	if s.flow.all.n < s.analyzer.packets {
+		return nil, false
+	}
+	return s.classify(), true
+}
+
+func (s *mlStream) classify() *analyzer.PropUpdate {
+	s.done = true
+	m, err := s.analyzer.classify(&s.flow)
+	if err != nil {
+		s.logger.Errorf("failed to classify the stream: %v", err)
+		return nil
+	}
+	return &analyzer.PropUpdate{
+		Type: analyzer.PropUpdateReplace,
+		M:    m,
+	}
+}
+
+func (s *mlStream) Close(limited bool) *analyzer.PropUpdate {
+	if s.done || s.flow.all.n == 0 {
+		return nil
+	}
+	// Fewer packets than expected, classify what there is
+	return s.classify()
+}
+
+// udpStream adapts mlStream to UDP, whose Feed has another signature.
+type udpStream struct {
+	*mlStream
+}
+
+func (s udpStream) Feed(rev bool, data []byte) (u *analyzer.PropUpdate, done bool) {
+	return s.feed(rev, data)
+}
@@ -0,0 +1,106 @@
+package ml
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+func TestAnalyzer(t *testing.T) {
+	model := filepath.Join(t.TempDir(), "tree.onnx")
+	if err := os.WriteFile(model, onnxTestTree().model(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAnalyzer(Config{
+		Model:    model,
+		Features: []string{"packets", "bytes"},
+		Packets:  3,
+		Labels:   []string{"benign", "vpn"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name           string
+		sizes          []int
+		close          bool
+		wantLabel      string
+		wantConfidence float64
+		wantPackets    int
+	}{
+		{"small", []int{100, 200, 100}, false, "benign", 0.8, 3},
+		{"large", []int{1000, 1500, 1000}, false, "vpn", 0.9, 3},
+		{"closed early", []int{1500}, true, "vpn", 0.9, 1},
+		{"closed early small", []int{500}, true, "benign", 0.8, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := a.NewTCP(analyzer.TCPInfo{}, nil)
+			var u *analyzer.PropUpdate
+			var done bool
+			for k, size := range tc.sizes {
+				if done {
+					t.Fatalf("done after %d packets", k)
+				}
+				u, done = s.Feed(k%2 == 1, false, false, 0, make([]byte, size))
+			}
+			if tc.close {
+				if u != nil || done {
+					t.Fatalf("classified before being closed: %v", u)
+				}
+				u = s.Close(false)
+			} else if !done {
+				t.Fatal("not done")
+			}
+			if u == nil {
+				t.Fatal("no update")
+			}
+			if label := u.M["label"]; label != tc.wantLabel {
+				t.Errorf("label = %v, want %v", label, tc.wantLabel)
+			}
+			if c, _ := u.M["confidence"].(float64); math.Abs(c-tc.wantConfidence) > 1e-6 {
+				t.Errorf("confidence = %v, want %v", c, tc.wantConfidence)
+			}
+			if packets := u.M["packets"]; packets != tc.wantPackets {
+				t.Errorf("packets = %v, want %v", packets, tc.wantPackets)
+			}
+		})
+	}
+}
+
+func TestNewAnalyzer_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, model []byte) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, model, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	tree := write("tree.onnx", onnxTestTree().model())
+	linear := write("linear.onnx", onnxTestLinear().model())
+	testCases := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"missing file", Config{Model: filepath.Join(dir, "missing.onnx")}, "no such file"},
+		{"corrupt file", Config{Model: write("corrupt.onnx", []byte("not a model"))}, "invalid model"},
+		{"feature count", Config{Model: tree, Features: []string{"packets", "bytes", "duration"}}, "there are 3 features"},
+		{"unknown feature", Config{Model: tree, Features: []string{"packets", "colour"}}, `unknown feature "colour"`},
+		{"unknown output", Config{Model: tree, Features: []string{"packets", "bytes"}, Output: "scores"}, `no output "scores"`},
+		{"string output", Config{Model: linear, Features: []string{"packets", "bytes"}, Output: "label"}, "expected a numeric tensor"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAnalyzer(tc.config)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("NewAnalyzer() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package ml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// onnxMLOps are the supported operators of the ai.onnx.ml domain.
+var onnxMLOps = map[string]opFunc{
+	"LinearClassifier":       opLinearClassifier,
+	"Scaler":                 opScaler,
+	"TreeEnsembleClassifier": opTreeEnsembleClassifier,
+}
+
+// classLabels returns the class labels of a classifier node, as strings.
+func (n *node) classLabels() []string {
+	if labels := n.attrStrings("classlabels_strings"); len(labels) > 0 {
+		return labels
+	}
+	ints, _ := n.attrInts("classlabels_ints")
+	labels := make([]string, len(ints))
+	for k, v := range ints {
+		labels[k] = strconv.FormatInt(v, 10)
+	}
+	return labels
+}
+
+// labelTensor returns the tensor of the predicted labels of a classifier node, from their class indexes.
+func (n *node) labelTensor(classes []int) *tensor {
+	shape := []int{len(classes)}
+	if labels := n.attrStrings("classlabels_strings"); len(labels) > 0 {
+		s := make([]string, len(classes))
+		for k, c := range classes {
+			s[k] = labels[c]
+		}
+		return newStringTensor(shape, s)
+	}
+	ints, _ := n.attrInts("classlabels_ints")
+	i := make([]int64, len(classes))
+	for k, c := range classes {
+		i[k] = ints[c]
+	}
+	return newIntTensor(shape, i)
+}
+
+// features returns the input of a node as rows of features.
+func features(in []*tensor) (x []float32, rows, cols int, err error) {
+	t, err := input(in, 0)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if x, err = t.floats(); err != nil {
+		return nil, 0, 0, err
+	}
+	switch len(t.shape) {
+	case 1:
+		return x, 1, t.shape[0], nil
+	case 2:
+		return x, t.shape[0], t.shape[1], nil
+	default:
+		return nil, 0, 0, fmt.Errorf("invalid input %v", t.shape)
+	}
+}
+
+func opScaler(n *node, in []*tensor) ([]*tensor, error) {
+	x, rows, cols, err := features(in)
+	if err != nil {
+		return nil, err
+	}
+	offset, scale := n.attrFloats("offset"), n.attrFloats("scale")
+	param := func(p []float32, col int, def float32) float32 {
+		switch len(p) {
+		case 0:
+			return def
+		case 1:
+			return p[0]
+		default:
+			return p[col]
+		}
+	}
+	for _, p := range [][]float32{offset, scale} {
+		if len(p) > 1 && len(p) != cols {
+			return nil, fmt.Errorf("%d parameters for %d features", len(p), cols)
+		}
+	}
+	y := make([]float32, rows*cols)
+	for k, v := range x {
+		c := k % cols
+		y[k] = (v - param(offset, c, 0)) * param(scale, c, 1)
+	}
+	t, _ := input(in, 0)
+	return []*tensor{newFloatTensor(t.shape, y)}, nil
+}
+
+// postTransform applies the post transform of a classifier node to the scores of a row.
+func postTransform(transform string, scores []float32) error {
+	switch transform {
+	case "", "NONE":
+	case "SOFTMAX":
+		softmax(scores, 1, len(scores), 1)
+	case "SOFTMAX_ZERO":
+		// Like softmax, but zero scores stay zero
+		maxV := float32(math.Inf(-1))
+		for _, s := range scores {
+			maxV = max(maxV, s)
+		}
+		var sum float64
+		for k, s := range scores {
+			if s != 0 {
+				e := math.Exp(float64(s - maxV))
+				scores[k] = float32(e)
+				sum += e
+			}
+		}
+		for k, s := range scores {
+			if s != 0 {
+				scores[k] = float32(float64(s) / sum)
+			}
+		}
+	case "LOGISTIC":
+		for k, s := range scores {
+			scores[k] = sigmoid(s)
+		}
+	case "PROBIT":
+		for k, s := range scores {
+			scores[k] = float32(math.Sqrt2 * math.Erfinv(2*float64(s)-1))
+		}
+	default:
+		return fmt.Errorf("unsupported post transform %s", transform)
+	}
+	return nil
+}
+
+// argMax returns the index of the highest score.
+func argMax(scores []float32) int {
+	best := 0
+	for k, s := range scores {
+		if s > scores[best] {
+			best = k
+		}
+	}
+	return best
+}
+
+// classify computes the scores of the rows of a classifier node from their raw scores, and their labels.
+// Binary classifiers may score the positive class only: its score is then completed by the negative one's.
+func (n *node) classify(raw []float32, rows, targets int) ([]*tensor, error) {
+	labels := n.classLabels()
+	if len(labels) == 0 {
+		return nil, errors.New("no class labels")
+	}
+	transform := n.attrString("post_transform", "NONE")
+	binary := len(labels) == 2 && targets == 1
+	cols := targets
+	if binary {
+		cols = 2
+	}
+	scores := make([]float32, 0, rows*cols)
+	classes := make([]int, rows)
+	for r := 0; r < rows; r++ {
+		row := raw[r*targets : (r+1)*targets]
+		if binary {
+			s := row[0]
+			var positive bool
+			switch transform {
+			case "LOGISTIC":
+				s = sigmoid(s)
+				row = []float32{1 - s, s}
+				positive = s > 0.5
+			case "", "NONE":
+				positive = s > 0
+				row = []float32{-s, s}
+				if n.op == "TreeEnsembleClassifier" {
+					// The leaves of binary tree ensembles hold the probability of the positive class
+					positive = s > 0.5
+					row = []float32{1 - s, s}
+				}
+			default:
+				return nil, fmt.Errorf("unsupported post transform %s for a binary classifier", transform)
+			}
+			scores = append(scores, row...)
+			if positive {
+				classes[r] = 1
+			}
+			continue
+		}
+		if len(row) != len(labels) {
+			return nil, fmt.Errorf("%d scores for %d classes", len(row), len(labels))
+		}
+		row = append([]float32{}, row...)
+		if err := postTransform(transform, row); err != nil {
+			return nil, err
+		}
+		scores = append(scores, row...)
+		classes[r] = argMax(row)
+	}
+	return []*tensor{n.labelTensor(classes), newFloatTensor([]int{rows, cols}, scores)}, nil
+}
+
+func opLinearClassifier(n *node, in []*tensor) ([]*tensor, error) {
+	x, rows, cols, err := features(in)
+	if err != nil {
+		return nil, err
+	}
+	coefficients, intercepts := n.attrFloats("coefficients"), n.attrFloats("intercepts")
+	if cols == 0 || len(coefficients)%cols != 0 {
+		return nil, fmt.Errorf("%d coefficients for %d features", len(coefficients), cols)
+	}
+	targets := len(coefficients) / cols
+	if len(intercepts) != 0 && len(intercepts) != targets {
+		return nil, fmt.Errorf("%d intercepts for %d classes", len(intercepts), targets)
+	}
+	raw := matMul(x, transpose(coefficients, targets, cols), rows, cols, targets)
+	for k := range raw {
+		if len(intercepts) > 0 {
+			raw[k] += intercepts[k%targets]
+		}
+	}
+	return n.classify(raw, rows, targets)
+}
+
+// treeNode is a node of a tree of a TreeEnsembleClassifier.
+type treeNode struct {
+	mode         string
+	feature      int
+	value        float32
+	missingTrue  bool
+	ifTrue       int // Indexes of the children
+	ifFalse      int
+	classWeights map[int]float32
+}
+
+// treeEnsemble are the trees of a TreeEnsembleClassifier node, built when the model is loaded.
+type treeEnsemble struct {
+	roots   []int // Indexes of the roots of the trees
+	nodes   []treeNode
+	targets int // Number of scores
+}
+
+func opTreeEnsembleClassifier(n *node, in []*tensor) ([]*tensor, error) {
+	x, rows, cols, err := features(in)
+	if err != nil {
+		return nil, err
+	}
+	e := n.ensemble
+	base := n.attrFloats("base_values")
+	raw := make([]float32, rows*e.targets)
+	for r := 0; r < rows; r++ {
+		row := x[r*cols : (r+1)*cols]
+		scores := raw[r*e.targets : (r+1)*e.targets]
+		for k := range scores {
+			if k < len(base) {
+				scores[k] = base[k]
+			}
+		}
+		for _, root := range e.roots {
+			leaf, err := walkTree(e.nodes, root, row)
+			if err != nil {
+				return nil, err
+			}
+			for c, w := range e.nodes[leaf].classWeights {
+				if e.targets == 1 {
+					c = 0
+				}
+				scores[c] += w
+			}
+		}
+	}
+	return n.classify(raw, rows, e.targets)
+}
+
+// prepare checks the attributes of a node when the model is loaded, and builds what its operator needs.
+func (n *node) prepare() error {
+	if n.domain != onnxMLDomain || n.op != "TreeEnsembleClassifier" {
+		return nil
+	}
+	e, err := n.trees()
+	if err != nil {
+		return err
+	}
+	n.ensemble = e
+	return nil
+}
+
+// trees builds the trees of a TreeEnsembleClassifier node.
+func (n *node) trees() (*treeEnsemble, error) {
+	treeIDs, _ := n.attrInts("nodes_treeids")
+	nodeIDs, _ := n.attrInts("nodes_nodeids")
+	featureIDs, _ := n.attrInts("nodes_featureids")
+	values := n.attrFloats("nodes_values")
+	modes := n.attrStrings("nodes_modes")
+	trueIDs, _ := n.attrInts("nodes_truenodeids")
+	falseIDs, _ := n.attrInts("nodes_falsenodeids")
+	missing, _ := n.attrInts("nodes_missing_value_tracks_true")
+	count := len(nodeIDs)
+	for _, l := range []int{len(treeIDs), len(featureIDs), len(values), len(modes), len(trueIDs), len(falseIDs)} {
+		if l != count {
+			return nil, errors.New("inconsistent node attributes")
+		}
+	}
+	type key struct{ tree, node int64 }
+	index := make(map[key]int, count)
+	var roots []int
+	nodes := make([]treeNode, count)
+	for k := 0; k < count; k++ {
+		id := key{treeIDs[k], nodeIDs[k]}
+		if _, ok := index[id]; ok {
+			return nil, fmt.Errorf("duplicate node %d of tree %d", id.node, id.tree)
+		}
+		if len(roots) == 0 || treeIDs[roots[len(roots)-1]] != id.tree {
+			// The root of a tree is its first node
+			roots = append(roots, k)
+		}
+		index[id] = k
+		nodes[k] = treeNode{
+			mode:        modes[k],
+			feature:     int(featureIDs[k]),
+			value:       values[k],
+			missingTrue: k < len(missing) && missing[k] != 0,
+		}
+	}
+	for k := range nodes {
+		if nodes[k].mode == "LEAF" {
+			continue
+		}
+		t, ok1 := index[key{treeIDs[k], trueIDs[k]}]
+		f, ok2 := index[key{treeIDs[k], falseIDs[k]}]
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("missing child of node %d of tree %d", nodeIDs[k], treeIDs[k])
+		}
+		nodes[k].ifTrue, nodes[k].ifFalse = t, f
+	}
+	classTrees, _ := n.attrInts("class_treeids")
+	classNodes, _ := n.attrInts("class_nodeids")
+	classIDs, _ := n.attrInts("class_ids")
+	weights := n.attrFloats("class_weights")
+	if len(classNodes) != len(classTrees) || len(classIDs) != len(classTrees) || len(weights) != len(classTrees) {
+		return nil, errors.New("inconsistent class attributes")
+	}
+	labels := len(n.classLabels())
+	for k := range classTrees {
+		i, ok := index[key{classTrees[k], classNodes[k]}]
+		if !ok {
+			return nil, fmt.Errorf("weight of unknown node %d of tree %d", classNodes[k], classTrees[k])
+		}
+		if classIDs[k] < 0 || int(classIDs[k]) >= labels {
+			return nil, fmt.Errorf("unknown class %d", classIDs[k])
+		}
+		if nodes[i].classWeights == nil {
+			nodes[i].classWeights = make(map[int]float32)
+		}
+		nodes[i].classWeights[int(classIDs[k])] += weights[k]
+	}
+	e := &treeEnsemble{roots: roots, nodes: nodes, targets: labels}
+	if labels == 2 {
+		// Binary ensembles may only weigh the positive class
+		single := true
+		for _, c := range classIDs {
+			single = single && c == classIDs[0]
+		}
+		if single {
+			e.targets = 1
+		}
+	}
+	return e, nil
+}
+
+// walkTree returns the index of the leaf a row of features ends up in.
+func walkTree(nodes []treeNode, k int, row []float32) (int, error) {
+	for steps := 0; steps <= len(nodes); steps++ {
+		nd := &nodes[k]
+		if nd.mode == "LEAF" {
+			return k, nil
+		}
+		if nd.feature < 0 || nd.feature >= len(row) {
+			return 0, fmt.Errorf("feature %d out of range", nd.feature)
+		}
+		v := row[nd.feature]
+		var cond bool
+		switch {
+		case math.IsNaN(float64(v)):
+			cond = nd.missingTrue
+		case nd.mode == "BRANCH_LEQ":
+			cond = v <= nd.value
+		case nd.mode == "BRANCH_LT":
+			cond = v < nd.value
+		case nd.mode == "BRANCH_GTE":
+			cond = v >= nd.value
+		case nd.mode == "BRANCH_GT":
+			cond = v > nd.value
+		case nd.mode == "BRANCH_EQ":
+			cond = v == nd.value
+		case nd.mode == "BRANCH_NEQ":
+			cond = v != nd.value
+		default:
+			return 0, fmt.Errorf("unsupported node mode %s", nd.mode)
+		}
+		if cond {
+			k = nd.ifTrue
+		} else {
+			k = nd.ifFalse
+		}
+	}
+	return 0, errors.New("cycle in tree")
+}
@@ -0,0 +1,614 @@
+package ml
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The ONNX protobuf messages are decoded field by field, as only a few of their fields matter here:
+// https://github.com/onnx/onnx/blob/main/onnx/onnx.proto
+
+const (
+	onnxDomain   = ""
+	onnxMLDomain = "ai.onnx.ml"
+)
+
+// ONNX tensor element types
+const (
+	onnxFloat   = 1
+	onnxUint8   = 2
+	onnxInt8    = 3
+	onnxUint16  = 4
+	onnxInt16   = 5
+	onnxInt32   = 6
+	onnxInt64   = 7
+	onnxString  = 8
+	onnxBool    = 9
+	onnxFloat16 = 10
+	onnxDouble  = 11
+	onnxUint32  = 12
+	onnxUint64  = 13
+)
+
+// Model is an ONNX model, run by a small interpreter supporting the operators of common classifiers:
+// neural networks (Gemm, MatMul, Relu, Softmax...), and the TreeEnsembleClassifier, LinearClassifier &
+// Scaler operators of scikit-learn pipelines.
+// It is safe for concurrent use.
+type Model struct {
+	Inputs  []ValueInfo
+	Outputs []ValueInfo
+	// ClassLabels are the class labels of the classifier operator of the model, if any.
+	ClassLabels []string
+
+	opsets       map[string]int64
+	initializers map[string]*tensor
+	nodes        []*node
+}
+
+// ValueInfo is an input or output of a model.
+type ValueInfo struct {
+	Name string
+	Type int   // Element type, 0 if not a tensor
+	Dims []int // -1 for unknown dimensions
+}
+
+type node struct {
+	name    string
+	op      string
+	domain  string
+	inputs  []string
+	outputs []string
+	attrs   map[string]*attribute
+	opset   int64 // Of its domain
+	run     opFunc
+
+	ensemble *treeEnsemble // TreeEnsembleClassifier
+}
+
+type attribute struct {
+	f       float32
+	i       int64
+	s       []byte
+	t       *tensor
+	floats  []float32
+	ints    []int64
+	strings []string
+}
+
+type opFunc func(n *node, in []*tensor) ([]*tensor, error)
+
+// LoadModel loads an ONNX model from a file.
+func LoadModel(filename string) (*Model, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseModel(bs)
+}
+
+// ParseModel parses an ONNX model, and checks its operators are supported.
+func ParseModel(bs []byte) (*Model, error) {
+	m := &Model{
+		opsets:       make(map[string]int64),
+		initializers: make(map[string]*tensor),
+	}
+	var graph []byte
+	err := protoFields(bs, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 7: // graph
+			graph = data
+		case 8: // opset_import
+			var domain string
+			var version int64
+			err := protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					domain = string(data)
+				case 2:
+					version = int64(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if domain == "ai.onnx" {
+				domain = onnxDomain
+			}
+			m.opsets[domain] = version
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid model: %w", err)
+	}
+	if graph == nil {
+		return nil, errors.New("invalid model: no graph")
+	}
+	if err := m.parseGraph(graph); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Model) parseGraph(bs []byte) error {
+	var inputs []ValueInfo
+	err := protoFields(bs, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1: // node
+			n, err := parseNode(data)
+			if err != nil {
+				return err
+			}
+			m.nodes = append(m.nodes, n)
+		case 5: // initializer
+			name, t, err := parseTensor(data)
+			if err != nil {
+				return fmt.Errorf("initializer %s: %w", name, err)
+			}
+			m.initializers[name] = t
+		case 11: // input
+			vi, err := parseValueInfo(data)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, vi)
+		case 12: // output
+			vi, err := parseValueInfo(data)
+			if err != nil {
+				return err
+			}
+			m.Outputs = append(m.Outputs, vi)
+		case 15: // sparse_initializer
+			return errors.New("sparse initializers are not supported")
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("invalid model: %w", err)
+	}
+	// Older models list their initializers as inputs too
+	for _, vi := range inputs {
+		if _, ok := m.initializers[vi.Name]; !ok {
+			m.Inputs = append(m.Inputs, vi)
+		}
+	}
+	// Nodes are topologically sorted, so every input must be known by the time its node runs
+	known := make(map[string]bool)
+	for _, vi := range m.Inputs {
+		known[vi.Name] = true
+	}
+	for name := range m.initializers {
+		known[name] = true
+	}
+	for _, n := range m.nodes {
+		var ok bool
+		var ops map[string]opFunc
+		switch n.domain {
+		case onnxDomain, "ai.onnx":
+			n.domain, ops = onnxDomain, onnxOps
+		case onnxMLDomain:
+			ops = onnxMLOps
+		}
+		if n.run, ok = ops[n.op]; !ok {
+			if n.op == "ZipMap" {
+				return errors.New("unsupported operator ZipMap, export the model without it (e.g. options={'zipmap': False} with skl2onnx)")
+			}
+			return fmt.Errorf("unsupported operator %s", n.qualifiedOp())
+		}
+		n.opset = m.opsets[n.domain]
+		if err := n.prepare(); err != nil {
+			return fmt.Errorf("node %s (%s): %w", n.name, n.qualifiedOp(), err)
+		}
+		for _, in := range n.inputs {
+			if in != "" && !known[in] {
+				return fmt.Errorf("node %s: unknown input %s", n.name, in)
+			}
+		}
+		for _, out := range n.outputs {
+			known[out] = true
+		}
+		if m.ClassLabels == nil && (n.op == "TreeEnsembleClassifier" || n.op == "LinearClassifier") {
+			m.ClassLabels = n.classLabels()
+		}
+	}
+	for _, vi := range m.Outputs {
+		if !known[vi.Name] {
+			return fmt.Errorf("unknown output %s", vi.Name)
+		}
+	}
+	if len(m.Inputs) == 0 || len(m.Outputs) == 0 {
+		return errors.New("the model must have inputs and outputs")
+	}
+	return nil
+}
+
+func (n *node) qualifiedOp() string {
+	if n.domain == onnxDomain {
+		return n.op
+	}
+	return n.domain + "." + n.op
+}
+
+func parseNode(bs []byte) (*node, error) {
+	n := &node{attrs: make(map[string]*attribute)}
+	err := protoFields(bs, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			n.inputs = append(n.inputs, string(data))
+		case 2:
+			n.outputs = append(n.outputs, string(data))
+		case 3:
+			n.name = string(data)
+		case 4:
+			n.op = string(data)
+		case 5:
+			name, a, err := parseAttribute(data)
+			if err != nil {
+				return err
+			}
+			n.attrs[name] = a
+		case 7:
+			n.domain = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n.name == "" {
+		n.name = n.op
+	}
+	return n, nil
+}
+
+func parseAttribute(bs []byte) (string, *attribute, error) {
+	var name string
+	a := &attribute{}
+	err := protoFields(bs, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			name = string(data)
+		case 2:
+			a.f = math.Float32frombits(uint32(v))
+		case 3:
+			a.i = int64(v)
+		case 4:
+			a.s = data
+		case 5:
+			_, t, err := parseTensor(data)
+			if err != nil {
+				return err
+			}
+			a.t = t
+		case 7:
+			a.floats = appendFloats(a.floats, typ, v, data)
+		case 8:
+			a.ints = appendInts(a.ints, typ, v, data)
+		case 9:
+			a.strings = append(a.strings, string(data))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("attribute %s: %w", name, err)
+	}
+	return name, a, nil
+}
+
+func parseValueInfo(bs []byte) (ValueInfo, error) {
+	var vi ValueInfo
+	err := protoFields(bs, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			vi.Name = string(data)
+		case 2: // type
+			return protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+				if num != 1 { // tensor_type
+					return nil
+				}
+				vi.Dims = []int{}
+				return protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+					switch num {
+					case 1:
+						vi.Type = int(v)
+					case 2: // shape
+						return protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+							if num != 1 { // dim
+								return nil
+							}
+							d := -1
+							err := protoFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+								if num == 1 && int64(v) > 0 { // dim_value
+									d = int(v)
+								}
+								return nil
+							})
+							vi.Dims = append(vi.Dims, d)
+							return err
+						})
+					}
+					return nil
+				})
+			})
+		}
+		return nil
+	})
+	return vi, err
+}
+
+func parseTensor(bs []byte) (string, *tensor, error) {
+	var (
+		name     string
+		dims     []int64
+		dataType int
+		floats   []float32
+		ints     []int64
+		doubles  []float64
+		uints    []uint64
+		strs     []string
+		raw      []byte
+		hasRaw   bool
+		external bool
+	)
+	err := protoFields(bs, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			dims = appendInts(dims, typ, v, data)
+		case 2:
+			dataType = int(v)
+		case 4:
+			floats = appendFloats(floats, typ, v, data)
+		case 5, 7: // int32_data & int64_data
+			ints = appendInts(ints, typ, v, data)
+		case 6:
+			strs = append(strs, string(data))
+		case 8:
+			name = string(data)
+		case 9:
+			raw, hasRaw = data, true
+		case 10:
+			if typ == protowire.BytesType {
+				for len(data) >= 8 {
+					doubles = append(doubles, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+					data = data[8:]
+				}
+			} else {
+				doubles = append(doubles, math.Float64frombits(v))
+			}
+		case 11:
+			if typ == protowire.BytesType {
+				for len(data) > 0 {
+					u, n := protowire.ConsumeVarint(data)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					uints = append(uints, u)
+					data = data[n:]
+				}
+			} else {
+				uints = append(uints, v)
+			}
+		case 14:
+			external = v == 1
+		}
+		return nil
+	})
+	if err != nil {
+		return name, nil, err
+	}
+	if external {
+		return name, nil, errors.New("external data is not supported")
+	}
+	shape := make([]int, len(dims))
+	for k, d := range dims {
+		if d < 0 || d > maxTensorSize {
+			return name, nil, fmt.Errorf("invalid dimension %d", d)
+		}
+		shape[k] = int(d)
+	}
+	size := shapeSize(shape)
+	if size < 0 {
+		return name, nil, errTensorTooLarge
+	}
+	var t *tensor
+	switch dataType {
+	case onnxFloat, onnxDouble:
+		f := floats
+		switch {
+		case hasRaw && dataType == onnxFloat:
+			f = make([]float32, len(raw)/4)
+			for k := range f {
+				f[k] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*k:]))
+			}
+		case hasRaw:
+			f = make([]float32, len(raw)/8)
+			for k := range f {
+				f[k] = float32(math.Float64frombits(binary.LittleEndian.Uint64(raw[8*k:])))
+			}
+		case dataType == onnxDouble:
+			f = make([]float32, len(doubles))
+			for k, d := range doubles {
+				f[k] = float32(d)
+			}
+		}
+		t = newFloatTensor(shape, f)
+	case onnxUint8, onnxInt8, onnxUint16, onnxInt16, onnxInt32, onnxInt64, onnxBool, onnxUint32, onnxUint64:
+		i := ints
+		if dataType == onnxUint64 && !hasRaw {
+			i = make([]int64, len(uints))
+			for k, u := range uints {
+				i[k] = int64(u)
+			}
+		}
+		if hasRaw {
+			if i, err = rawInts(dataType, raw); err != nil {
+				return name, nil, err
+			}
+		}
+		t = newIntTensor(shape, i)
+	case onnxString:
+		t = newStringTensor(shape, strs)
+	case onnxFloat16:
+		return name, nil, errors.New("float16 tensors are not supported")
+	default:
+		return name, nil, fmt.Errorf("unsupported tensor type %d", dataType)
+	}
+	if t.len() != size {
+		return name, nil, fmt.Errorf("%d elements for shape %v", t.len(), shape)
+	}
+	return name, t, nil
+}
+
+// rawInts decodes the little-endian raw data of an integer tensor.
+func rawInts(dataType int, raw []byte) ([]int64, error) {
+	var width int
+	switch dataType {
+	case onnxUint8, onnxInt8, onnxBool:
+		width = 1
+	case onnxUint16, onnxInt16:
+		width = 2
+	case onnxInt32, onnxUint32:
+		width = 4
+	default:
+		width = 8
+	}
+	if len(raw)%width != 0 {
+		return nil, fmt.Errorf("invalid raw data length %d", len(raw))
+	}
+	i := make([]int64, len(raw)/width)
+	for k := range i {
+		b := raw[k*width:]
+		switch dataType {
+		case onnxUint8, onnxBool:
+			i[k] = int64(b[0])
+		case onnxInt8:
+			i[k] = int64(int8(b[0]))
+		case onnxUint16:
+			i[k] = int64(binary.LittleEndian.Uint16(b))
+		case onnxInt16:
+			i[k] = int64(int16(binary.LittleEndian.Uint16(b)))
+		case onnxInt32:
+			i[k] = int64(int32(binary.LittleEndian.Uint32(b)))
+		case onnxUint32:
+			i[k] = int64(binary.LittleEndian.Uint32(b))
+		default:
+			i[k] = int64(binary.LittleEndian.Uint64(b))
+		}
+	}
+	return i, nil
+}
+
+// protoFields calls f for every field of a protobuf message, with the value of varint & fixed fields,
+// or the data of length-delimited ones.
+func protoFields(bs []byte, f func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error) error {
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		bs = bs[n:]
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(bs)
+		case protowire.Fixed32Type:
+			var u uint32
+			u, n = protowire.ConsumeFixed32(bs)
+			v = uint64(u)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(bs)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(bs)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, bs)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		bs = bs[n:]
+		if err := f(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendInts appends the values of a repeated integer field, packed or not.
+func appendInts(dst []int64, typ protowire.Type, v uint64, data []byte) []int64 {
+	if typ != protowire.BytesType {
+		return append(dst, int64(v))
+	}
+	for len(data) > 0 {
+		u, n := protowire.ConsumeVarint(data)
+		if n < 0 {
+			break
+		}
+		dst = append(dst, int64(u))
+		data = data[n:]
+	}
+	return dst
+}
+
+// appendFloats appends the values of a repeated float field, packed or not.
+func appendFloats(dst []float32, typ protowire.Type, v uint64, data []byte) []float32 {
+	if typ != protowire.BytesType {
+		return append(dst, math.Float32frombits(uint32(v)))
+	}
+	for len(data) >= 4 {
+		dst = append(dst, math.Float32frombits(binary.LittleEndian.Uint32(data)))
+		data = data[4:]
+	}
+	return dst
+}
+
+// run runs the model on its inputs, and returns its outputs.
+func (m *Model) run(inputs map[string]*tensor) (map[string]*tensor, error) {
+	values := make(map[string]*tensor, len(inputs)+len(m.nodes))
+	for name, t := range inputs {
+		values[name] = t
+	}
+	get := func(name string) *tensor {
+		if t, ok := values[name]; ok {
+			return t
+		}
+		return m.initializers[name]
+	}
+	for _, vi := range m.Inputs {
+		if get(vi.Name) == nil {
+			return nil, fmt.Errorf("missing input %s", vi.Name)
+		}
+	}
+	for _, n := range m.nodes {
+		in := make([]*tensor, len(n.inputs))
+		for k, name := range n.inputs {
+			if name != "" {
+				in[k] = get(name)
+			}
+		}
+		out, err := n.run(n, in)
+		if err != nil {
+			return nil, fmt.Errorf("node %s (%s): %w", n.name, n.qualifiedOp(), err)
+		}
+		for k, name := range n.outputs {
+			if name != "" && k < len(out) {
+				values[name] = out[k]
+			}
+		}
+	}
+	outputs := make(map[string]*tensor, len(m.Outputs))
+	for _, vi := range m.Outputs {
+		t := get(vi.Name)
+		if t == nil {
+			return nil, fmt.Errorf("output %s not computed", vi.Name)
+		}
+		outputs[vi.Name] = t
+	}
+	return outputs, nil
+}
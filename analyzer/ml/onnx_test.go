@@ -0,0 +1,482 @@
+package ml
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// onnxTestMessage is a protobuf message, built field by field.
+type onnxTestMessage []byte
+
+func (m onnxTestMessage) bytes(num protowire.Number, b []byte) onnxTestMessage {
+	m = protowire.AppendTag(m, num, protowire.BytesType)
+	return protowire.AppendBytes(m, b)
+}
+
+func (m onnxTestMessage) str(num protowire.Number, s string) onnxTestMessage {
+	return m.bytes(num, []byte(s))
+}
+
+func (m onnxTestMessage) varint(num protowire.Number, v uint64) onnxTestMessage {
+	m = protowire.AppendTag(m, num, protowire.VarintType)
+	return protowire.AppendVarint(m, v)
+}
+
+func (m onnxTestMessage) float(num protowire.Number, f float32) onnxTestMessage {
+	m = protowire.AppendTag(m, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(m, math.Float32bits(f))
+}
+
+// floats appends a packed repeated float field.
+func (m onnxTestMessage) floats(num protowire.Number, f []float32) onnxTestMessage {
+	b := make([]byte, 4*len(f))
+	for k, v := range f {
+		binary.LittleEndian.PutUint32(b[4*k:], math.Float32bits(v))
+	}
+	return m.bytes(num, b)
+}
+
+// ints appends a packed repeated integer field.
+func (m onnxTestMessage) ints(num protowire.Number, i []int64) onnxTestMessage {
+	var b []byte
+	for _, v := range i {
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+	return m.bytes(num, b)
+}
+
+// onnxTestTensor returns a float tensor.
+func onnxTestTensor(name string, dims []int64, f []float32) onnxTestMessage {
+	return onnxTestMessage{}.ints(1, dims).varint(2, onnxFloat).floats(4, f).str(8, name)
+}
+
+func onnxTestAttrFloat(name string, f float32) onnxTestMessage {
+	return onnxTestMessage{}.str(1, name).float(2, f)
+}
+
+func onnxTestAttrInt(name string, i int64) onnxTestMessage {
+	return onnxTestMessage{}.str(1, name).varint(3, uint64(i))
+}
+
+func onnxTestAttrString(name, s string) onnxTestMessage {
+	return onnxTestMessage{}.str(1, name).str(4, s)
+}
+
+func onnxTestAttrFloats(name string, f ...float32) onnxTestMessage {
+	return onnxTestMessage{}.str(1, name).floats(7, f)
+}
+
+func onnxTestAttrInts(name string, i ...int64) onnxTestMessage {
+	return onnxTestMessage{}.str(1, name).ints(8, i)
+}
+
+func onnxTestAttrStrings(name string, s ...string) onnxTestMessage {
+	m := onnxTestMessage{}.str(1, name)
+	for _, v := range s {
+		m = m.str(9, v)
+	}
+	return m
+}
+
+// onnxTestNode returns a node of an operator of a domain, with its inputs, outputs & attributes.
+func onnxTestNode(op, domain string, inputs, outputs []string, attrs ...onnxTestMessage) onnxTestMessage {
+	m := onnxTestMessage{}.str(4, op)
+	if domain != "" {
+		m = m.str(7, domain)
+	}
+	for _, in := range inputs {
+		m = m.str(1, in)
+	}
+	for _, out := range outputs {
+		m = m.str(2, out)
+	}
+	for _, a := range attrs {
+		m = m.bytes(5, a)
+	}
+	return m
+}
+
+// onnxTestValueInfo returns a tensor input or output, with a named dimension for the -1 dims.
+func onnxTestValueInfo(name string, elemType int, dims ...int64) onnxTestMessage {
+	var shape onnxTestMessage
+	for _, d := range dims {
+		if d < 0 {
+			shape = shape.bytes(1, onnxTestMessage{}.str(2, "N"))
+		} else {
+			shape = shape.bytes(1, onnxTestMessage{}.varint(1, uint64(d)))
+		}
+	}
+	tensorType := onnxTestMessage{}.varint(1, uint64(elemType)).bytes(2, shape)
+	return onnxTestMessage{}.str(1, name).bytes(2, onnxTestMessage{}.bytes(1, tensorType))
+}
+
+type onnxTestGraph struct {
+	nodes, initializers, inputs, outputs []onnxTestMessage
+}
+
+// model returns a model of the graph, importing opset 13 of the default domain & opset 3 of ai.onnx.ml.
+func (g onnxTestGraph) model() []byte {
+	var graph onnxTestMessage
+	for _, fields := range []struct {
+		num      protowire.Number
+		messages []onnxTestMessage
+	}{{1, g.nodes}, {5, g.initializers}, {11, g.inputs}, {12, g.outputs}} {
+		for _, m := range fields.messages {
+			graph = graph.bytes(fields.num, m)
+		}
+	}
+	return onnxTestMessage{}.
+		varint(1, 8). // ir_version
+		bytes(7, graph).
+		bytes(8, onnxTestMessage{}.varint(2, 13)).
+		bytes(8, onnxTestMessage{}.str(1, onnxMLDomain).varint(2, 3))
+}
+
+// onnxTestMLP is a neural network with 2 inputs, a dense layer of 3 units & softmax.
+func onnxTestMLP() onnxTestGraph {
+	return onnxTestGraph{
+		nodes: []onnxTestMessage{
+			onnxTestNode("Gemm", "", []string{"x", "W", "b"}, []string{"h"}, onnxTestAttrFloat("beta", 1)),
+			onnxTestNode("Relu", "", []string{"h"}, []string{"r"}),
+			onnxTestNode("Softmax", "", []string{"r"}, []string{"probabilities"}, onnxTestAttrInt("axis", -1)),
+		},
+		initializers: []onnxTestMessage{
+			onnxTestTensor("W", []int64{2, 3}, []float32{1, 0, -1, 0, 1, 1}),
+			onnxTestTensor("b", []int64{3}, []float32{0, 0, 0.5}),
+		},
+		inputs:  []onnxTestMessage{onnxTestValueInfo("x", onnxFloat, -1, 2)},
+		outputs: []onnxTestMessage{onnxTestValueInfo("probabilities", onnxFloat, -1, 3)},
+	}
+}
+
+// onnxTestLinear is a scikit-learn pipeline of a scaler & a logistic regression of 2 classes.
+func onnxTestLinear() onnxTestGraph {
+	return onnxTestGraph{
+		nodes: []onnxTestMessage{
+			onnxTestNode("Scaler", onnxMLDomain, []string{"x"}, []string{"s"},
+				onnxTestAttrFloats("offset", 1, 1),
+				onnxTestAttrFloats("scale", 0.5, 2)),
+			onnxTestNode("LinearClassifier", onnxMLDomain, []string{"s"}, []string{"label", "probabilities"},
+				onnxTestAttrFloats("coefficients", 1, 0, 0, 1),
+				onnxTestAttrFloats("intercepts", 0, 0),
+				onnxTestAttrStrings("classlabels_strings", "a", "b"),
+				onnxTestAttrString("post_transform", "SOFTMAX")),
+		},
+		inputs: []onnxTestMessage{onnxTestValueInfo("x", onnxFloat, -1, 2)},
+		outputs: []onnxTestMessage{
+			onnxTestValueInfo("label", onnxString, -1),
+			onnxTestValueInfo("probabilities", onnxFloat, -1, 2),
+		},
+	}
+}
+
+// onnxTestTree is a binary tree ensemble of one tree, splitting on the second feature.
+func onnxTestTree(attrs ...onnxTestMessage) onnxTestGraph {
+	if attrs == nil {
+		attrs = []onnxTestMessage{
+			onnxTestAttrInts("nodes_treeids", 0, 0, 0),
+			onnxTestAttrInts("nodes_nodeids", 0, 1, 2),
+			onnxTestAttrInts("nodes_featureids", 1, 0, 0),
+			onnxTestAttrFloats("nodes_values", 1000, 0, 0),
+			onnxTestAttrStrings("nodes_modes", "BRANCH_LEQ", "LEAF", "LEAF"),
+			onnxTestAttrInts("nodes_truenodeids", 1, 0, 0),
+			onnxTestAttrInts("nodes_falsenodeids", 2, 0, 0),
+			onnxTestAttrInts("class_treeids", 0, 0),
+			onnxTestAttrInts("class_nodeids", 1, 2),
+			onnxTestAttrInts("class_ids", 1, 1),
+			onnxTestAttrFloats("class_weights", 0.2, 0.9),
+			onnxTestAttrInts("classlabels_ints", 0, 1),
+		}
+	}
+	return onnxTestGraph{
+		nodes: []onnxTestMessage{
+			onnxTestNode("TreeEnsembleClassifier", onnxMLDomain, []string{"x"}, []string{"label", "probabilities"}, attrs...),
+		},
+		inputs: []onnxTestMessage{onnxTestValueInfo("x", onnxFloat, -1, 2)},
+		outputs: []onnxTestMessage{
+			onnxTestValueInfo("label", onnxInt64, -1),
+			onnxTestValueInfo("probabilities", onnxFloat, -1, 2),
+		},
+	}
+}
+
+// floatsNear reports whether the floats are equal, within a tolerance for the rounding errors.
+func floatsNear(a, b []float32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if math.Abs(float64(a[k]-b[k])) > 1e-5 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseModel(t *testing.T) {
+	softmaxOf := func(x ...float64) []float32 {
+		var sum float64
+		for _, v := range x {
+			sum += math.Exp(v)
+		}
+		y := make([]float32, len(x))
+		for k, v := range x {
+			y[k] = float32(math.Exp(v) / sum)
+		}
+		return y
+	}
+	type run struct {
+		x          []float32
+		wantLabels []string // Of the label output, if any
+		wantScores []float32
+	}
+	testCases := []struct {
+		name        string
+		graph       onnxTestGraph
+		wantInputs  []ValueInfo
+		wantOutputs []string
+		wantLabels  []string
+		runs        []run
+	}{
+		{
+			name:        "mlp",
+			graph:       onnxTestMLP(),
+			wantInputs:  []ValueInfo{{Name: "x", Type: onnxFloat, Dims: []int{-1, 2}}},
+			wantOutputs: []string{"probabilities"},
+			runs: []run{
+				{x: []float32{2, 1}, wantScores: softmaxOf(2, 1, 0)},
+				{x: []float32{0, 0, -1, 0}, wantScores: append(softmaxOf(0, 0, 0.5), softmaxOf(0, 0, 1.5)...)},
+			},
+		},
+		{
+			name:        "linear",
+			graph:       onnxTestLinear(),
+			wantInputs:  []ValueInfo{{Name: "x", Type: onnxFloat, Dims: []int{-1, 2}}},
+			wantOutputs: []string{"label", "probabilities"},
+			wantLabels:  []string{"a", "b"},
+			runs: []run{
+				// Scaled to (1, 0) & (0, 2)
+				{x: []float32{3, 1, 1, 2}, wantLabels: []string{"a", "b"}, wantScores: append(softmaxOf(1, 0), softmaxOf(0, 2)...)},
+			},
+		},
+		{
+			name:        "tree",
+			graph:       onnxTestTree(),
+			wantInputs:  []ValueInfo{{Name: "x", Type: onnxFloat, Dims: []int{-1, 2}}},
+			wantOutputs: []string{"label", "probabilities"},
+			wantLabels:  []string{"0", "1"},
+			runs: []run{
+				{x: []float32{0, 500}, wantLabels: []string{"0"}, wantScores: []float32{0.8, 0.2}},
+				{x: []float32{0, 5000, 0, 1000}, wantLabels: []string{"1", "0"}, wantScores: []float32{0.1, 0.9, 0.8, 0.2}},
+				// Missing values take the false branch by default
+				{x: []float32{0, float32(math.NaN())}, wantLabels: []string{"1"}, wantScores: []float32{0.1, 0.9}},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := ParseModel(tc.graph.model())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.Inputs, tc.wantInputs) {
+				t.Errorf("Inputs = %v, want %v", m.Inputs, tc.wantInputs)
+			}
+			var outputs []string
+			for _, vi := range m.Outputs {
+				outputs = append(outputs, vi.Name)
+			}
+			if !reflect.DeepEqual(outputs, tc.wantOutputs) {
+				t.Errorf("Outputs = %v, want %v", outputs, tc.wantOutputs)
+			}
+			if !reflect.DeepEqual(m.ClassLabels, tc.wantLabels) {
+				t.Errorf("ClassLabels = %v, want %v", m.ClassLabels, tc.wantLabels)
+			}
+			for _, r := range tc.runs {
+				x := newFloatTensor([]int{len(r.x) / 2, 2}, r.x)
+				out, err := m.run(map[string]*tensor{"x": x})
+				if err != nil {
+					t.Fatalf("run(%v) error = %v", r.x, err)
+				}
+				if scores, _ := out["probabilities"].floats(); !floatsNear(scores, r.wantScores) {
+					t.Errorf("run(%v) scores = %v, want %v", r.x, scores, r.wantScores)
+				}
+				if r.wantLabels != nil {
+					if labels := out["label"].strings(); !reflect.DeepEqual(labels, r.wantLabels) {
+						t.Errorf("run(%v) labels = %v, want %v", r.x, labels, r.wantLabels)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseModel_Invalid(t *testing.T) {
+	mlp := onnxTestMLP()
+	withInitializer := func(tensor onnxTestMessage) []byte {
+		g := onnxTestMLP()
+		g.initializers = append(g.initializers, tensor)
+		return g.model()
+	}
+	withNode := func(node onnxTestMessage) []byte {
+		g := onnxTestMLP()
+		g.nodes = append(g.nodes, node)
+		return g.model()
+	}
+	testCases := []struct {
+		name    string
+		model   []byte
+		wantErr string
+	}{
+		{"not protobuf", []byte{0xff, 0xff, 0xff}, "invalid model"},
+		{"truncated", mlp.model()[:40], "invalid model"},
+		{"no graph", onnxTestMessage{}.varint(1, 8), "no graph"},
+		{"unsupported operator", withNode(onnxTestNode("Conv", "", []string{"x"}, []string{"y"})), "unsupported operator Conv"},
+		{"unknown domain", withNode(onnxTestNode("Relu", "com.example", []string{"x"}, []string{"y"})), "unsupported operator com.example.Relu"},
+		{"zipmap", withNode(onnxTestNode("ZipMap", onnxMLDomain, []string{"probabilities"}, []string{"y"})), "ZipMap"},
+		{"unknown input", withNode(onnxTestNode("Relu", "", []string{"z"}, []string{"y"})), "unknown input z"},
+		{"unknown output", onnxTestGraph{
+			inputs:  mlp.inputs,
+			outputs: mlp.outputs,
+		}.model(), "unknown output probabilities"},
+		{"no inputs", onnxTestGraph{
+			nodes:   []onnxTestMessage{onnxTestNode("Constant", "", nil, []string{"y"}, onnxTestAttrFloats("value_floats", 1))},
+			outputs: []onnxTestMessage{onnxTestValueInfo("y", onnxFloat, 1)},
+		}.model(), "inputs and outputs"},
+		{"external data", withInitializer(onnxTestTensor("e", []int64{1}, nil).varint(14, 1)), "external data"},
+		{"element count", withInitializer(onnxTestTensor("e", []int64{2, 3}, []float32{1, 2, 3, 4, 5})), "5 elements for shape [2 3]"},
+		{"float16", withInitializer(onnxTestMessage{}.ints(1, []int64{1}).varint(2, onnxFloat16).str(8, "e")), "float16"},
+		{"unsupported type", withInitializer(onnxTestMessage{}.ints(1, []int64{1}).varint(2, 16).str(8, "e")), "unsupported tensor type 16"},
+		{"raw data length", withInitializer(onnxTestMessage{}.ints(1, []int64{1}).varint(2, onnxInt32).bytes(9, []byte{1, 2, 3}).str(8, "e")), "raw data length"},
+		{"negative dimension", withInitializer(onnxTestTensor("e", []int64{-1}, nil)), "invalid dimension -1"},
+		{"huge dimension", withInitializer(onnxTestTensor("e", []int64{1 << 40}, nil)), "invalid dimension"},
+		// Empty, but too large to index
+		{"huge shape", withInitializer(onnxTestTensor("e", []int64{1 << 15, 1 << 15, 0}, nil)), errTensorTooLarge.Error()},
+		{"sparse initializer", onnxTestMessage{}.bytes(7, onnxTestMessage{}.bytes(15, nil)), "sparse initializers"},
+		{"inconsistent tree nodes", onnxTestTree(
+			onnxTestAttrInts("nodes_treeids", 0, 0),
+			onnxTestAttrInts("nodes_nodeids", 0, 1, 2),
+			onnxTestAttrInts("classlabels_ints", 0, 1),
+		).model(), "inconsistent node attributes"},
+		{"missing tree child", onnxTestTree(
+			onnxTestAttrInts("nodes_treeids", 0),
+			onnxTestAttrInts("nodes_nodeids", 0),
+			onnxTestAttrInts("nodes_featureids", 0),
+			onnxTestAttrFloats("nodes_values", 0),
+			onnxTestAttrStrings("nodes_modes", "BRANCH_LEQ"),
+			onnxTestAttrInts("nodes_truenodeids", 1),
+			onnxTestAttrInts("nodes_falsenodeids", 2),
+			onnxTestAttrInts("classlabels_ints", 0, 1),
+		).model(), "missing child of node 0"},
+		{"unknown tree class", onnxTestTree(
+			onnxTestAttrInts("nodes_treeids", 0),
+			onnxTestAttrInts("nodes_nodeids", 0),
+			onnxTestAttrInts("nodes_featureids", 0),
+			onnxTestAttrFloats("nodes_values", 0),
+			onnxTestAttrStrings("nodes_modes", "LEAF"),
+			onnxTestAttrInts("nodes_truenodeids", 0),
+			onnxTestAttrInts("nodes_falsenodeids", 0),
+			onnxTestAttrInts("class_treeids", 0),
+			onnxTestAttrInts("class_nodeids", 0),
+			onnxTestAttrInts("class_ids", 5),
+			onnxTestAttrFloats("class_weights", 1),
+			onnxTestAttrInts("classlabels_ints", 0, 1),
+		).model(), "unknown class 5"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseModel(tc.model)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ParseModel() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestModel_RunErrors(t *testing.T) {
+	cycle := onnxTestTree(
+		onnxTestAttrInts("nodes_treeids", 0, 0),
+		onnxTestAttrInts("nodes_nodeids", 0, 1),
+		onnxTestAttrInts("nodes_featureids", 0, 0),
+		onnxTestAttrFloats("nodes_values", 0, 0),
+		onnxTestAttrStrings("nodes_modes", "BRANCH_LEQ", "BRANCH_LEQ"),
+		onnxTestAttrInts("nodes_truenodeids", 1, 0),
+		onnxTestAttrInts("nodes_falsenodeids", 1, 0),
+		onnxTestAttrInts("classlabels_ints", 0, 1),
+	)
+	clip := onnxTestGraph{
+		nodes:   []onnxTestMessage{onnxTestNode("Clip", "", []string{""}, []string{"y"})},
+		inputs:  []onnxTestMessage{onnxTestValueInfo("x", onnxFloat, -1, 2)},
+		outputs: []onnxTestMessage{onnxTestValueInfo("y", onnxFloat, -1, 2)},
+	}
+	testCases := []struct {
+		name    string
+		model   []byte
+		inputs  map[string]*tensor
+		wantErr string
+	}{
+		{"missing input", onnxTestMLP().model(), map[string]*tensor{}, "missing input x"},
+		{"shape mismatch", onnxTestMLP().model(), map[string]*tensor{"x": newFloatTensor([]int{1, 3}, []float32{1, 2, 3})}, "can't multiply"},
+		{"string input", onnxTestMLP().model(), map[string]*tensor{"x": newStringTensor([]int{1, 2}, []string{"a", "b"})}, "expected a numeric tensor"},
+		{"clip without input", clip.model(), map[string]*tensor{"x": newFloatTensor([]int{1, 2}, []float32{1, 2})}, "missing input #0"},
+		{"tree cycle", cycle.model(), map[string]*tensor{"x": newFloatTensor([]int{1, 2}, []float32{1, 2})}, "cycle in tree"},
+		{"tree feature", onnxTestTree().model(), map[string]*tensor{"x": newFloatTensor([]int{1, 1}, []float32{1})}, "feature 1 out of range"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := ParseModel(tc.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = m.run(tc.inputs)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("run() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestParseModel_Corrupt checks truncated & corrupted models are rejected or run without panicking.
+func TestParseModel_Corrupt(t *testing.T) {
+	for _, g := range []onnxTestGraph{onnxTestMLP(), onnxTestLinear(), onnxTestTree()} {
+		model := g.model()
+		var variants [][]byte
+		for k := range model {
+			variants = append(variants, model[:k])
+			for _, mask := range []byte{0xff, 0x01, 0x80} {
+				bs := append([]byte{}, model...)
+				bs[k] ^= mask
+				variants = append(variants, bs)
+			}
+		}
+		for _, bs := range variants {
+			m, err := ParseModel(bs)
+			if err != nil {
+				continue
+			}
+			inputs := make(map[string]*tensor)
+			for _, vi := range m.Inputs {
+				shape := make([]int, len(vi.Dims))
+				for k, d := range vi.Dims {
+					shape[k] = max(d, 1)
+				}
+				size := shapeSize(shape)
+				if size < 0 || size > 1<<16 {
+					continue
+				}
+				if vi.Type == onnxFloat || vi.Type == onnxDouble {
+					inputs[vi.Name] = newFloatTensor(shape, make([]float32, size))
+				} else {
+					inputs[vi.Name] = newIntTensor(shape, make([]int64, size))
+				}
+			}
+			// Errors are fine, panics aren't
+			_, _ = m.run(inputs)
+		}
+	}
+}
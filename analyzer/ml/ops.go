@@ -0,0 +1,768 @@
+package ml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errMissingInput = errors.New("missing input")
+
+// onnxOps are the supported operators of the default domain.
+var onnxOps = map[string]opFunc{
+	"Abs":                unaryOp(func(x float32) float32 { return float32(math.Abs(float64(x))) }),
+	"Add":                binaryOp(func(x, y float32) float32 { return x + y }, func(x, y int64) int64 { return x + y }),
+	"ArgMax":             opArgMax,
+	"BatchNormalization": opBatchNormalization,
+	"Cast":               opCast,
+	"Clip":               opClip,
+	"Concat":             opConcat,
+	"Constant":           opConstant,
+	"Div": binaryOp(func(x, y float32) float32 { return x / y }, func(x, y int64) int64 {
+		if y == 0 {
+			return 0
+		}
+		return x / y
+	}),
+	"Dropout":   opIdentity,
+	"Exp":       unaryOp(func(x float32) float32 { return float32(math.Exp(float64(x))) }),
+	"Flatten":   opFlatten,
+	"Gather":    opGather,
+	"Gemm":      opGemm,
+	"Identity":  opIdentity,
+	"LeakyRelu": opLeakyRelu,
+	"Log":       unaryOp(func(x float32) float32 { return float32(math.Log(float64(x))) }),
+	"MatMul":    opMatMul,
+	"Mul":       binaryOp(func(x, y float32) float32 { return x * y }, func(x, y int64) int64 { return x * y }),
+	"Neg":       unaryOp(func(x float32) float32 { return -x }),
+	"Relu": unaryOp(func(x float32) float32 {
+		if x < 0 {
+			return 0
+		}
+		return x
+	}),
+	"Reshape":   opReshape,
+	"Shape":     opShape,
+	"Sigmoid":   unaryOp(sigmoid),
+	"Softmax":   opSoftmax,
+	"Sqrt":      unaryOp(func(x float32) float32 { return float32(math.Sqrt(float64(x))) }),
+	"Squeeze":   opSqueeze,
+	"Sub":       binaryOp(func(x, y float32) float32 { return x - y }, func(x, y int64) int64 { return x - y }),
+	"Tanh":      unaryOp(func(x float32) float32 { return float32(math.Tanh(float64(x))) }),
+	"Unsqueeze": opUnsqueeze,
+}
+
+func sigmoid(x float32) float32 {
+	return float32(1 / (1 + math.Exp(-float64(x))))
+}
+
+func (n *node) attrInt(name string, def int64) int64 {
+	if a, ok := n.attrs[name]; ok {
+		return a.i
+	}
+	return def
+}
+
+func (n *node) attrFloat(name string, def float32) float32 {
+	if a, ok := n.attrs[name]; ok {
+		return a.f
+	}
+	return def
+}
+
+func (n *node) attrString(name, def string) string {
+	if a, ok := n.attrs[name]; ok {
+		return string(a.s)
+	}
+	return def
+}
+
+func (n *node) attrInts(name string) ([]int64, bool) {
+	a, ok := n.attrs[name]
+	if !ok {
+		return nil, false
+	}
+	return a.ints, true
+}
+
+func (n *node) attrFloats(name string) []float32 {
+	if a, ok := n.attrs[name]; ok {
+		return a.floats
+	}
+	return nil
+}
+
+func (n *node) attrStrings(name string) []string {
+	if a, ok := n.attrs[name]; ok {
+		return a.strings
+	}
+	return nil
+}
+
+// input returns the k-th input, or an error if it's missing.
+func input(in []*tensor, k int) (*tensor, error) {
+	if k >= len(in) || in[k] == nil {
+		return nil, fmt.Errorf("%w #%d", errMissingInput, k)
+	}
+	return in[k], nil
+}
+
+// optionalInput returns the k-th input, or nil if it's missing.
+func optionalInput(in []*tensor, k int) *tensor {
+	if k >= len(in) {
+		return nil
+	}
+	return in[k]
+}
+
+// intsInputOrAttr returns the values of an input of newer opsets, or of the attribute of older ones.
+func intsInputOrAttr(n *node, in []*tensor, k int, name string) ([]int64, bool, error) {
+	if t := optionalInput(in, k); t != nil {
+		v, err := t.ints()
+		return v, true, err
+	}
+	v, ok := n.attrInts(name)
+	return v, ok, nil
+}
+
+func unaryOp(f func(x float32) float32) opFunc {
+	return func(n *node, in []*tensor) ([]*tensor, error) {
+		x, err := input(in, 0)
+		if err != nil {
+			return nil, err
+		}
+		xf, err := x.floats()
+		if err != nil {
+			return nil, err
+		}
+		y := make([]float32, len(xf))
+		for k, v := range xf {
+			y[k] = f(v)
+		}
+		return []*tensor{newFloatTensor(x.shape, y)}, nil
+	}
+}
+
+func binaryOp(f func(x, y float32) float32, fi func(x, y int64) int64) opFunc {
+	return func(n *node, in []*tensor) ([]*tensor, error) {
+		a, err := input(in, 0)
+		if err != nil {
+			return nil, err
+		}
+		b, err := input(in, 1)
+		if err != nil {
+			return nil, err
+		}
+		shape, err := broadcastShapes(a.shape, b.shape)
+		if err != nil {
+			return nil, err
+		}
+		ia, ib := broadcastIndexes(a.shape, shape), broadcastIndexes(b.shape, shape)
+		if a.kind == kindInt && b.kind == kindInt {
+			y := make([]int64, len(ia))
+			for k := range y {
+				y[k] = fi(a.i[ia[k]], b.i[ib[k]])
+			}
+			return []*tensor{newIntTensor(shape, y)}, nil
+		}
+		af, err := a.floats()
+		if err != nil {
+			return nil, err
+		}
+		bf, err := b.floats()
+		if err != nil {
+			return nil, err
+		}
+		y := make([]float32, len(ia))
+		for k := range y {
+			y[k] = f(af[ia[k]], bf[ib[k]])
+		}
+		return []*tensor{newFloatTensor(shape, y)}, nil
+	}
+}
+
+func opIdentity(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []*tensor{x}, nil
+}
+
+func opConstant(n *node, in []*tensor) ([]*tensor, error) {
+	if a, ok := n.attrs["value"]; ok && a.t != nil {
+		return []*tensor{a.t}, nil
+	}
+	if a, ok := n.attrs["value_float"]; ok {
+		return []*tensor{newFloatTensor([]int{}, []float32{a.f})}, nil
+	}
+	if a, ok := n.attrs["value_floats"]; ok {
+		return []*tensor{newFloatTensor([]int{len(a.floats)}, a.floats)}, nil
+	}
+	if a, ok := n.attrs["value_int"]; ok {
+		return []*tensor{newIntTensor([]int{}, []int64{a.i})}, nil
+	}
+	if a, ok := n.attrs["value_ints"]; ok {
+		return []*tensor{newIntTensor([]int{len(a.ints)}, a.ints)}, nil
+	}
+	return nil, errors.New("unsupported constant value")
+}
+
+func opCast(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch to := n.attrInt("to", 0); to {
+	case onnxFloat, onnxDouble:
+		f, err := x.floats()
+		if err != nil {
+			return nil, err
+		}
+		return []*tensor{newFloatTensor(x.shape, f)}, nil
+	case onnxBool:
+		f, err := x.floats()
+		if err != nil {
+			return nil, err
+		}
+		i := make([]int64, len(f))
+		for k, v := range f {
+			if v != 0 {
+				i[k] = 1
+			}
+		}
+		return []*tensor{newIntTensor(x.shape, i)}, nil
+	case onnxUint8, onnxInt8, onnxUint16, onnxInt16, onnxInt32, onnxInt64, onnxUint32, onnxUint64:
+		i, err := x.ints()
+		if err != nil {
+			return nil, err
+		}
+		return []*tensor{newIntTensor(x.shape, i)}, nil
+	case onnxString:
+		return []*tensor{newStringTensor(x.shape, x.strings())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %d", to)
+	}
+}
+
+func opShape(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	dims := make([]int64, len(x.shape))
+	for k, d := range x.shape {
+		dims[k] = int64(d)
+	}
+	return []*tensor{newIntTensor([]int{len(dims)}, dims)}, nil
+}
+
+func opFlatten(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	axis := n.attrInt("axis", 1)
+	if axis < 0 {
+		axis += int64(len(x.shape))
+	}
+	if axis < 0 || axis > int64(len(x.shape)) {
+		return nil, fmt.Errorf("axis %d out of range for rank %d", axis, len(x.shape))
+	}
+	outer := shapeSize(x.shape[:axis])
+	y, err := x.reshape([]int{outer, x.len() / max(outer, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return []*tensor{y}, nil
+}
+
+func opReshape(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	dims, ok, err := intsInputOrAttr(n, in, 1, "shape")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("missing shape")
+	}
+	allowZero := n.attrInt("allowzero", 0) != 0
+	shape := make([]int, len(dims))
+	infer := -1
+	for k, d := range dims {
+		switch {
+		case d == 0 && !allowZero:
+			if k >= len(x.shape) {
+				return nil, fmt.Errorf("invalid shape %v for %v", dims, x.shape)
+			}
+			shape[k] = x.shape[k]
+		case d == -1 && infer < 0:
+			infer = k
+			shape[k] = 1
+		case d < 0:
+			return nil, fmt.Errorf("invalid shape %v", dims)
+		default:
+			shape[k] = int(d)
+		}
+	}
+	if infer >= 0 {
+		if size := shapeSize(shape); size > 0 {
+			shape[infer] = x.len() / size
+		}
+	}
+	y, err := x.reshape(shape)
+	if err != nil {
+		return nil, err
+	}
+	return []*tensor{y}, nil
+}
+
+func opSqueeze(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	axes, _, err := intsInputOrAttr(n, in, 1, "axes")
+	if err != nil {
+		return nil, err
+	}
+	squeezed := make(map[int]bool)
+	for _, a := range axes {
+		axis, err := normalizeAxis(a, len(x.shape))
+		if err != nil {
+			return nil, err
+		}
+		if x.shape[axis] != 1 {
+			return nil, fmt.Errorf("can't squeeze axis %d of %v", axis, x.shape)
+		}
+		squeezed[axis] = true
+	}
+	shape := []int{}
+	for k, d := range x.shape {
+		if (len(axes) > 0 && !squeezed[k]) || (len(axes) == 0 && d != 1) {
+			shape = append(shape, d)
+		}
+	}
+	y, err := x.reshape(shape)
+	if err != nil {
+		return nil, err
+	}
+	return []*tensor{y}, nil
+}
+
+func opUnsqueeze(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	axes, _, err := intsInputOrAttr(n, in, 1, "axes")
+	if err != nil {
+		return nil, err
+	}
+	rank := len(x.shape) + len(axes)
+	inserted := make(map[int]bool)
+	for _, a := range axes {
+		axis, err := normalizeAxis(a, rank)
+		if err != nil {
+			return nil, err
+		}
+		inserted[axis] = true
+	}
+	shape := make([]int, 0, rank)
+	k := 0
+	for d := 0; d < rank; d++ {
+		if inserted[d] {
+			shape = append(shape, 1)
+		} else if k < len(x.shape) {
+			shape = append(shape, x.shape[k])
+			k++
+		}
+	}
+	y, err := x.reshape(shape)
+	if err != nil {
+		return nil, err
+	}
+	return []*tensor{y}, nil
+}
+
+func opConcat(n *node, in []*tensor) ([]*tensor, error) {
+	var ts []*tensor
+	for _, t := range in {
+		if t != nil {
+			ts = append(ts, t)
+		}
+	}
+	if len(ts) == 0 {
+		return nil, errMissingInput
+	}
+	first := ts[0]
+	axis, err := normalizeAxis(n.attrInt("axis", 0), len(first.shape))
+	if err != nil {
+		return nil, err
+	}
+	shape := append([]int{}, first.shape...)
+	shape[axis] = 0
+	for _, t := range ts {
+		if len(t.shape) != len(first.shape) || t.kind != first.kind {
+			return nil, fmt.Errorf("can't concatenate %v %s and %v %s", first.shape, first.kind, t.shape, t.kind)
+		}
+		for d := range t.shape {
+			if d != axis && t.shape[d] != first.shape[d] {
+				return nil, fmt.Errorf("can't concatenate %v and %v on axis %d", first.shape, t.shape, axis)
+			}
+		}
+		shape[axis] += t.shape[axis]
+	}
+	outer := shapeSize(shape[:axis])
+	y := &tensor{shape: shape, kind: first.kind}
+	for o := 0; o < outer; o++ {
+		for _, t := range ts {
+			chunk := shapeSize(t.shape[axis:])
+			switch t.kind {
+			case kindFloat:
+				y.f = append(y.f, t.f[o*chunk:(o+1)*chunk]...)
+			case kindInt:
+				y.i = append(y.i, t.i[o*chunk:(o+1)*chunk]...)
+			default:
+				y.s = append(y.s, t.s[o*chunk:(o+1)*chunk]...)
+			}
+		}
+	}
+	return []*tensor{y}, nil
+}
+
+func opGather(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := input(in, 1)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := idx.ints()
+	if err != nil {
+		return nil, err
+	}
+	axis, err := normalizeAxis(n.attrInt("axis", 0), len(x.shape))
+	if err != nil {
+		return nil, err
+	}
+	outer, dim, inner := shapeSize(x.shape[:axis]), x.shape[axis], shapeSize(x.shape[axis+1:])
+	shape := append(append(append([]int{}, x.shape[:axis]...), idx.shape...), x.shape[axis+1:]...)
+	if shapeSize(shape) < 0 {
+		return nil, errTensorTooLarge
+	}
+	positions := make([]int, 0, shapeSize(shape))
+	for o := 0; o < outer; o++ {
+		for _, i := range indexes {
+			if i < 0 {
+				i += int64(dim)
+			}
+			if i < 0 || i >= int64(dim) {
+				return nil, fmt.Errorf("index %d out of range for %v", i, x.shape)
+			}
+			for k := 0; k < inner; k++ {
+				positions = append(positions, (o*dim+int(i))*inner+k)
+			}
+		}
+	}
+	return []*tensor{x.gather(shape, positions)}, nil
+}
+
+// matMul multiplies the m×k matrix a by the k×n matrix b.
+func matMul(a, b []float32, m, k, n int) []float32 {
+	y := make([]float32, m*n)
+	for i := 0; i < m; i++ {
+		row := y[i*n : (i+1)*n]
+		for l := 0; l < k; l++ {
+			v := a[i*k+l]
+			if v == 0 {
+				continue
+			}
+			for j, w := range b[l*n : (l+1)*n] {
+				row[j] += v * w
+			}
+		}
+	}
+	return y
+}
+
+// transpose transposes the rows×cols matrix a.
+func transpose(a []float32, rows, cols int) []float32 {
+	y := make([]float32, len(a))
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			y[j*rows+i] = a[i*cols+j]
+		}
+	}
+	return y
+}
+
+func opMatMul(n *node, in []*tensor) ([]*tensor, error) {
+	a, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := input(in, 1)
+	if err != nil {
+		return nil, err
+	}
+	af, err := a.floats()
+	if err != nil {
+		return nil, err
+	}
+	bf, err := b.floats()
+	if err != nil {
+		return nil, err
+	}
+	aShape, bShape := a.shape, b.shape
+	if len(aShape) == 1 {
+		aShape = []int{1, aShape[0]}
+	}
+	if len(bShape) == 1 {
+		bShape = []int{bShape[0], 1}
+	}
+	if len(bShape) != 2 {
+		return nil, fmt.Errorf("unsupported batched right operand %v", b.shape)
+	}
+	if len(aShape) < 2 {
+		return nil, fmt.Errorf("invalid left operand %v", a.shape)
+	}
+	k := aShape[len(aShape)-1]
+	if k != bShape[0] {
+		return nil, fmt.Errorf("can't multiply %v by %v", a.shape, b.shape)
+	}
+	// The leading dimensions of a are rows too
+	m := len(af) / max(k, 1)
+	if shapeSize([]int{m, bShape[1]}) < 0 {
+		return nil, errTensorTooLarge
+	}
+	y := matMul(af, bf, m, k, bShape[1])
+	shape := append([]int{}, a.shape[:len(a.shape)-1]...)
+	if len(b.shape) == 2 {
+		shape = append(shape, bShape[1])
+	}
+	return []*tensor{newFloatTensor(shape, y)}, nil
+}
+
+func opGemm(n *node, in []*tensor) ([]*tensor, error) {
+	a, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := input(in, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.shape) != 2 || len(b.shape) != 2 {
+		return nil, fmt.Errorf("invalid operands %v and %v", a.shape, b.shape)
+	}
+	af, err := a.floats()
+	if err != nil {
+		return nil, err
+	}
+	bf, err := b.floats()
+	if err != nil {
+		return nil, err
+	}
+	m, k := a.shape[0], a.shape[1]
+	if n.attrInt("transA", 0) != 0 {
+		af = transpose(af, m, k)
+		m, k = k, m
+	}
+	kb, cols := b.shape[0], b.shape[1]
+	if n.attrInt("transB", 0) != 0 {
+		bf = transpose(bf, kb, cols)
+		kb, cols = cols, kb
+	}
+	if k != kb {
+		return nil, fmt.Errorf("can't multiply %v by %v", a.shape, b.shape)
+	}
+	shape := []int{m, cols}
+	if shapeSize(shape) < 0 {
+		return nil, errTensorTooLarge
+	}
+	y := matMul(af, bf, m, k, cols)
+	alpha, beta := n.attrFloat("alpha", 1), n.attrFloat("beta", 1)
+	if alpha != 1 {
+		for i := range y {
+			y[i] *= alpha
+		}
+	}
+	if c := optionalInput(in, 2); c != nil && beta != 0 {
+		cf, err := c.floats()
+		if err != nil {
+			return nil, err
+		}
+		// The bias is broadcast to the result, not the other way round
+		if bs, err := broadcastShapes(c.shape, shape); err != nil {
+			return nil, err
+		} else if len(bs) != len(shape) || bs[0] != shape[0] || bs[1] != shape[1] {
+			return nil, fmt.Errorf("can't broadcast %v to %v", c.shape, shape)
+		}
+		for i, ci := range broadcastIndexes(c.shape, shape) {
+			y[i] += beta * cf[ci]
+		}
+	}
+	return []*tensor{newFloatTensor(shape, y)}, nil
+}
+
+func opLeakyRelu(n *node, in []*tensor) ([]*tensor, error) {
+	alpha := n.attrFloat("alpha", 0.01)
+	return unaryOp(func(x float32) float32 {
+		if x < 0 {
+			return alpha * x
+		}
+		return x
+	})(n, in)
+}
+
+func opClip(n *node, in []*tensor) ([]*tensor, error) {
+	if _, err := input(in, 0); err != nil {
+		return nil, err
+	}
+	lo, hi := float32(math.Inf(-1)), float32(math.Inf(1))
+	if n.opset < 11 {
+		lo, hi = n.attrFloat("min", lo), n.attrFloat("max", hi)
+	} else {
+		for k, bound := range []*float32{&lo, &hi} {
+			if t := optionalInput(in, k+1); t != nil {
+				f, err := t.floats()
+				if err != nil {
+					return nil, err
+				}
+				if len(f) != 1 {
+					return nil, errors.New("bounds must be scalars")
+				}
+				*bound = f[0]
+			}
+		}
+	}
+	return unaryOp(func(x float32) float32 {
+		return min(max(x, lo), hi)
+	})(n, in[:1])
+}
+
+// softmax applies softmax in place to the groups of n elements of x, inner apart.
+func softmax(x []float32, outer, n, inner int) {
+	for o := 0; o < outer; o++ {
+		for i := 0; i < inner; i++ {
+			base := o*n*inner + i
+			maxV := float32(math.Inf(-1))
+			for k := 0; k < n; k++ {
+				maxV = max(maxV, x[base+k*inner])
+			}
+			var sum float64
+			for k := 0; k < n; k++ {
+				e := math.Exp(float64(x[base+k*inner] - maxV))
+				x[base+k*inner] = float32(e)
+				sum += e
+			}
+			for k := 0; k < n; k++ {
+				x[base+k*inner] = float32(float64(x[base+k*inner]) / sum)
+			}
+		}
+	}
+}
+
+func opSoftmax(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	xf, err := x.floats()
+	if err != nil {
+		return nil, err
+	}
+	def := int64(-1)
+	if n.opset < 13 {
+		def = 1
+	}
+	axis, err := normalizeAxis(n.attrInt("axis", def), len(x.shape))
+	if err != nil {
+		return nil, err
+	}
+	y := append([]float32{}, xf...)
+	if n.opset < 13 {
+		// Older opsets coerce the input to 2D, the softmax is over all the dimensions from the axis
+		softmax(y, shapeSize(x.shape[:axis]), shapeSize(x.shape[axis:]), 1)
+	} else {
+		softmax(y, shapeSize(x.shape[:axis]), x.shape[axis], shapeSize(x.shape[axis+1:]))
+	}
+	return []*tensor{newFloatTensor(x.shape, y)}, nil
+}
+
+func opBatchNormalization(n *node, in []*tensor) ([]*tensor, error) {
+	var params [5][]float32
+	var x *tensor
+	for k := range params {
+		t, err := input(in, k)
+		if err != nil {
+			return nil, err
+		}
+		if params[k], err = t.floats(); err != nil {
+			return nil, err
+		}
+		if k == 0 {
+			x = t
+		}
+	}
+	xf, scale, bias, mean, variance := params[0], params[1], params[2], params[3], params[4]
+	if len(x.shape) < 2 {
+		return nil, fmt.Errorf("invalid input %v", x.shape)
+	}
+	channels, inner := x.shape[1], shapeSize(x.shape[2:])
+	for _, p := range params[1:] {
+		if len(p) != channels {
+			return nil, fmt.Errorf("%d parameters for %d channels", len(p), channels)
+		}
+	}
+	eps := float64(n.attrFloat("epsilon", 1e-5))
+	y := make([]float32, len(xf))
+	for k, v := range xf {
+		c := (k / inner) % channels
+		y[k] = float32(float64(scale[c])*float64(v-mean[c])/math.Sqrt(float64(variance[c])+eps)) + bias[c]
+	}
+	return []*tensor{newFloatTensor(x.shape, y)}, nil
+}
+
+func opArgMax(n *node, in []*tensor) ([]*tensor, error) {
+	x, err := input(in, 0)
+	if err != nil {
+		return nil, err
+	}
+	xf, err := x.floats()
+	if err != nil {
+		return nil, err
+	}
+	axis, err := normalizeAxis(n.attrInt("axis", 0), len(x.shape))
+	if err != nil {
+		return nil, err
+	}
+	last := n.attrInt("select_last_index", 0) != 0
+	outer, dim, inner := shapeSize(x.shape[:axis]), x.shape[axis], shapeSize(x.shape[axis+1:])
+	y := make([]int64, outer*inner)
+	for o := 0; o < outer; o++ {
+		for i := 0; i < inner; i++ {
+			best := 0
+			for k := 1; k < dim; k++ {
+				v, b := xf[(o*dim+k)*inner+i], xf[(o*dim+best)*inner+i]
+				if v > b || (last && v == b) {
+					best = k
+				}
+			}
+			y[o*inner+i] = int64(best)
+		}
+	}
+	shape := append([]int{}, x.shape...)
+	if n.attrInt("keepdims", 1) != 0 {
+		shape[axis] = 1
+	} else {
+		shape = append(shape[:axis], shape[axis+1:]...)
+	}
+	return []*tensor{newIntTensor(shape, y)}, nil
+}
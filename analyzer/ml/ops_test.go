@@ -0,0 +1,510 @@
+package ml
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tensorsNear reports whether the tensors have the same shape, kind & elements, within a tolerance for floats.
+func tensorsNear(a, b *tensor) bool {
+	if len(a.shape) != len(b.shape) || (len(a.shape) > 0 && !reflect.DeepEqual(a.shape, b.shape)) || a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case kindFloat:
+		return floatsNear(a.f, b.f)
+	case kindInt:
+		return len(a.i) == len(b.i) && (len(a.i) == 0 || reflect.DeepEqual(a.i, b.i))
+	default:
+		return len(a.s) == len(b.s) && (len(a.s) == 0 || reflect.DeepEqual(a.s, b.s))
+	}
+}
+
+func TestShapeSize(t *testing.T) {
+	testCases := []struct {
+		shape []int
+		want  int
+	}{
+		{[]int{}, 1},
+		{[]int{2, 3}, 6},
+		{[]int{0, 1 << 20}, 0},
+		{[]int{1 << 14, 1 << 14}, 1 << 28},
+		{[]int{-1, 2}, -1},
+		{[]int{1 << 29}, -1},
+		{[]int{1 << 15, 1 << 15}, -1},
+		// Empty, but its indexes would overflow
+		{[]int{1 << 15, 1 << 15, 0}, -1},
+	}
+	for _, tc := range testCases {
+		if got := shapeSize(tc.shape); got != tc.want {
+			t.Errorf("shapeSize(%v) = %d, want %d", tc.shape, got, tc.want)
+		}
+	}
+}
+
+func TestOps(t *testing.T) {
+	f, i, s := newFloatTensor, newIntTensor, newStringTensor
+	floatAttr := func(v float32) *attribute { return &attribute{f: v} }
+	intAttr := func(v int64) *attribute { return &attribute{i: v} }
+	testCases := []struct {
+		name   string
+		op     string
+		domain string
+		opset  int64
+		attrs  map[string]*attribute
+		in     []*tensor
+		want   []*tensor
+	}{
+		{
+			name: "add broadcast",
+			op:   "Add",
+			in:   []*tensor{f([]int{2, 2}, []float32{1, 2, 3, 4}), f([]int{2}, []float32{10, 20})},
+			want: []*tensor{f([]int{2, 2}, []float32{11, 22, 13, 24})},
+		},
+		{
+			name: "add ints",
+			op:   "Add",
+			in:   []*tensor{i([]int{2}, []int64{1, 2}), i([]int{}, []int64{3})},
+			want: []*tensor{i([]int{2}, []int64{4, 5})},
+		},
+		{
+			name: "mul int by float",
+			op:   "Mul",
+			in:   []*tensor{i([]int{2}, []int64{1, 2}), f([]int{}, []float32{0.5})},
+			want: []*tensor{f([]int{2}, []float32{0.5, 1})},
+		},
+		{
+			name: "div int by zero",
+			op:   "Div",
+			in:   []*tensor{i([]int{2}, []int64{7, 7}), i([]int{2}, []int64{2, 0})},
+			want: []*tensor{i([]int{2}, []int64{3, 0})},
+		},
+		{
+			name: "sigmoid",
+			op:   "Sigmoid",
+			in:   []*tensor{f([]int{2}, []float32{0, float32(math.Inf(1))})},
+			want: []*tensor{f([]int{2}, []float32{0.5, 1})},
+		},
+		{
+			name:  "leaky relu",
+			op:    "LeakyRelu",
+			attrs: map[string]*attribute{"alpha": floatAttr(0.1)},
+			in:    []*tensor{f([]int{2}, []float32{-10, 2})},
+			want:  []*tensor{f([]int{2}, []float32{-1, 2})},
+		},
+		{
+			name:  "clip with inputs",
+			op:    "Clip",
+			opset: 13,
+			in:    []*tensor{f([]int{3}, []float32{-2, 0, 5}), f([]int{}, []float32{-1}), f([]int{}, []float32{1})},
+			want:  []*tensor{f([]int{3}, []float32{-1, 0, 1})},
+		},
+		{
+			name:  "clip with attributes",
+			op:    "Clip",
+			opset: 6,
+			attrs: map[string]*attribute{"max": floatAttr(1)},
+			in:    []*tensor{f([]int{3}, []float32{-2, 0, 5})},
+			want:  []*tensor{f([]int{3}, []float32{-2, 0, 1})},
+		},
+		{
+			name:  "gemm",
+			op:    "Gemm",
+			attrs: map[string]*attribute{"transB": intAttr(1), "alpha": floatAttr(2), "beta": floatAttr(0.5)},
+			in: []*tensor{
+				f([]int{1, 2}, []float32{1, 2}),
+				f([]int{3, 2}, []float32{1, 0, 0, 1, 1, 1}),
+				f([]int{3}, []float32{1, 1, 1}),
+			},
+			want: []*tensor{f([]int{1, 3}, []float32{2.5, 4.5, 6.5})},
+		},
+		{
+			name: "matmul by vector",
+			op:   "MatMul",
+			in:   []*tensor{f([]int{2, 2}, []float32{1, 2, 3, 4}), f([]int{2}, []float32{1, 1})},
+			want: []*tensor{f([]int{2}, []float32{3, 7})},
+		},
+		{
+			name: "matmul batched",
+			op:   "MatMul",
+			in:   []*tensor{f([]int{2, 1, 2}, []float32{1, 2, 3, 4}), f([]int{2, 1}, []float32{1, 1})},
+			want: []*tensor{f([]int{2, 1, 1}, []float32{3, 7})},
+		},
+		{
+			name:  "softmax",
+			op:    "Softmax",
+			opset: 13,
+			in:    []*tensor{f([]int{2, 2}, []float32{0, 0, 0, float32(math.Log(3))})},
+			want:  []*tensor{f([]int{2, 2}, []float32{0.5, 0.5, 0.25, 0.75})},
+		},
+		{
+			name:  "softmax coerced to 2D",
+			op:    "Softmax",
+			opset: 11,
+			in:    []*tensor{f([]int{1, 2, 2}, []float32{0, 0, 0, 0})},
+			want:  []*tensor{f([]int{1, 2, 2}, []float32{0.25, 0.25, 0.25, 0.25})},
+		},
+		{
+			name:  "reshape",
+			op:    "Reshape",
+			opset: 13,
+			in:    []*tensor{f([]int{4}, []float32{1, 2, 3, 4}), i([]int{2}, []int64{-1, 2})},
+			want:  []*tensor{f([]int{2, 2}, []float32{1, 2, 3, 4})},
+		},
+		{
+			name:  "reshape keeping a dimension",
+			op:    "Reshape",
+			opset: 13,
+			in:    []*tensor{f([]int{2, 2}, []float32{1, 2, 3, 4}), i([]int{3}, []int64{0, 1, 2})},
+			want:  []*tensor{f([]int{2, 1, 2}, []float32{1, 2, 3, 4})},
+		},
+		{
+			name: "flatten",
+			op:   "Flatten",
+			in:   []*tensor{f([]int{2, 1, 2}, []float32{1, 2, 3, 4})},
+			want: []*tensor{f([]int{2, 2}, []float32{1, 2, 3, 4})},
+		},
+		{
+			name:  "squeeze",
+			op:    "Squeeze",
+			opset: 11,
+			attrs: map[string]*attribute{"axes": {ints: []int64{1}}},
+			in:    []*tensor{f([]int{2, 1}, []float32{1, 2})},
+			want:  []*tensor{f([]int{2}, []float32{1, 2})},
+		},
+		{
+			name:  "unsqueeze",
+			op:    "Unsqueeze",
+			opset: 13,
+			in:    []*tensor{f([]int{2}, []float32{1, 2}), i([]int{1}, []int64{0})},
+			want:  []*tensor{f([]int{1, 2}, []float32{1, 2})},
+		},
+		{
+			name:  "concat",
+			op:    "Concat",
+			attrs: map[string]*attribute{"axis": intAttr(1)},
+			in:    []*tensor{f([]int{2, 1}, []float32{1, 2}), f([]int{2, 2}, []float32{3, 4, 5, 6})},
+			want:  []*tensor{f([]int{2, 3}, []float32{1, 3, 4, 2, 5, 6})},
+		},
+		{
+			name: "gather",
+			op:   "Gather",
+			in:   []*tensor{f([]int{3, 2}, []float32{1, 2, 3, 4, 5, 6}), i([]int{2}, []int64{2, -3})},
+			want: []*tensor{f([]int{2, 2}, []float32{5, 6, 1, 2})},
+		},
+		{
+			name:  "gather strings",
+			op:    "Gather",
+			attrs: map[string]*attribute{"axis": intAttr(1)},
+			in:    []*tensor{s([]int{1, 3}, []string{"a", "b", "c"}), i([]int{}, []int64{1})},
+			want:  []*tensor{s([]int{1}, []string{"b"})},
+		},
+		{
+			name:  "argmax",
+			op:    "ArgMax",
+			attrs: map[string]*attribute{"axis": intAttr(1), "keepdims": intAttr(0)},
+			in:    []*tensor{f([]int{2, 3}, []float32{1, 3, 2, 5, 4, 6})},
+			want:  []*tensor{i([]int{2}, []int64{1, 2})},
+		},
+		{
+			name:  "cast to int",
+			op:    "Cast",
+			attrs: map[string]*attribute{"to": intAttr(onnxInt64)},
+			in:    []*tensor{f([]int{2}, []float32{1.7, -1.7})},
+			want:  []*tensor{i([]int{2}, []int64{1, -1})},
+		},
+		{
+			name:  "cast to bool",
+			op:    "Cast",
+			attrs: map[string]*attribute{"to": intAttr(onnxBool)},
+			in:    []*tensor{f([]int{2}, []float32{0, 0.1})},
+			want:  []*tensor{i([]int{2}, []int64{0, 1})},
+		},
+		{
+			name: "shape",
+			op:   "Shape",
+			in:   []*tensor{f([]int{2, 0}, nil)},
+			want: []*tensor{i([]int{2}, []int64{2, 0})},
+		},
+		{
+			name:  "constant",
+			op:    "Constant",
+			attrs: map[string]*attribute{"value_ints": {ints: []int64{1, 2}}},
+			want:  []*tensor{i([]int{2}, []int64{1, 2})},
+		},
+		{
+			name:  "batch normalization",
+			op:    "BatchNormalization",
+			attrs: map[string]*attribute{"epsilon": floatAttr(0)},
+			in: []*tensor{
+				f([]int{1, 2}, []float32{1, 2}),
+				f([]int{2}, []float32{1, 2}), // Scale
+				f([]int{2}, []float32{0, 1}), // Bias
+				f([]int{2}, []float32{1, 0}), // Mean
+				f([]int{2}, []float32{1, 4}), // Variance
+			},
+			want: []*tensor{f([]int{1, 2}, []float32{0, 3})},
+		},
+		{
+			name:   "scaler",
+			op:     "Scaler",
+			domain: onnxMLDomain,
+			attrs:  map[string]*attribute{"offset": {floats: []float32{1}}, "scale": {floats: []float32{2, 3}}},
+			in:     []*tensor{f([]int{1, 2}, []float32{2, 3})},
+			want:   []*tensor{f([]int{1, 2}, []float32{2, 6})},
+		},
+		{
+			name:   "linear classifier",
+			op:     "LinearClassifier",
+			domain: onnxMLDomain,
+			attrs: map[string]*attribute{
+				"coefficients":     {floats: []float32{1, 0, 0, 1, -1, -1}},
+				"intercepts":       {floats: []float32{0, 0, 0}},
+				"classlabels_ints": {ints: []int64{7, 8, 9}},
+			},
+			in: []*tensor{f([]int{2, 2}, []float32{1, 2, -5, -5})},
+			want: []*tensor{
+				i([]int{2}, []int64{8, 9}),
+				f([]int{2, 3}, []float32{1, 2, -3, -5, -5, 10}),
+			},
+		},
+		{
+			name:   "binary linear classifier",
+			op:     "LinearClassifier",
+			domain: onnxMLDomain,
+			attrs: map[string]*attribute{
+				"coefficients":        {floats: []float32{1, -1}},
+				"classlabels_strings": {strings: []string{"no", "yes"}},
+				"post_transform":      {s: []byte("LOGISTIC")},
+			},
+			in: []*tensor{f([]int{2}, []float32{2, 2})},
+			want: []*tensor{
+				s([]int{1}, []string{"no"}),
+				f([]int{1, 2}, []float32{0.5, 0.5}),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := &node{op: tc.op, domain: tc.domain, opset: tc.opset, attrs: tc.attrs}
+			ops := onnxOps
+			if tc.domain == onnxMLDomain {
+				ops = onnxMLOps
+			}
+			out, err := ops[tc.op](n, tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(out) != len(tc.want) {
+				t.Fatalf("%d outputs, want %d", len(out), len(tc.want))
+			}
+			for k := range out {
+				if !tensorsNear(out[k], tc.want[k]) {
+					t.Errorf("output %d = %+v, want %+v", k, out[k], tc.want[k])
+				}
+			}
+		})
+	}
+}
+
+func TestOps_Errors(t *testing.T) {
+	f, i, s := newFloatTensor, newIntTensor, newStringTensor
+	testCases := []struct {
+		name    string
+		op      string
+		domain  string
+		opset   int64
+		attrs   map[string]*attribute
+		in      []*tensor
+		wantErr string
+	}{
+		{
+			name:    "add incompatible",
+			op:      "Add",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), f([]int{3}, []float32{1, 2, 3})},
+			wantErr: "can't be broadcast",
+		},
+		{
+			name:    "add too large",
+			op:      "Add",
+			in:      []*tensor{f([]int{1 << 15, 1}, make([]float32, 1<<15)), f([]int{1, 1 << 14}, make([]float32, 1<<14))},
+			wantErr: errTensorTooLarge.Error(),
+		},
+		{
+			name:    "add missing input",
+			op:      "Add",
+			in:      []*tensor{f([]int{1}, []float32{1}), nil},
+			wantErr: "missing input #1",
+		},
+		{
+			name:    "gemm rank",
+			op:      "Gemm",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), f([]int{2, 1}, []float32{1, 2})},
+			wantErr: "invalid operands",
+		},
+		{
+			name:    "gemm mismatch",
+			op:      "Gemm",
+			in:      []*tensor{f([]int{1, 2}, []float32{1, 2}), f([]int{3, 1}, []float32{1, 2, 3})},
+			wantErr: "can't multiply",
+		},
+		{
+			name: "gemm bias rank",
+			op:   "Gemm",
+			in: []*tensor{
+				f([]int{1, 1}, []float32{1}),
+				f([]int{1, 1}, []float32{1}),
+				f([]int{1, 1, 1}, []float32{1}),
+			},
+			wantErr: "can't broadcast",
+		},
+		{
+			name:    "matmul batched right",
+			op:      "MatMul",
+			in:      []*tensor{f([]int{1, 1}, []float32{1}), f([]int{1, 1, 1}, []float32{1})},
+			wantErr: "unsupported batched right operand",
+		},
+		{
+			name:    "clip without input",
+			op:      "Clip",
+			opset:   13,
+			wantErr: "missing input #0",
+		},
+		{
+			name:    "clip bounds",
+			op:      "Clip",
+			opset:   13,
+			in:      []*tensor{f([]int{1}, []float32{1}), f([]int{2}, []float32{0, 1})},
+			wantErr: "bounds must be scalars",
+		},
+		{
+			name:    "reshape invalid",
+			op:      "Reshape",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), i([]int{1}, []int64{-2})},
+			wantErr: "invalid shape",
+		},
+		{
+			name:    "reshape size",
+			op:      "Reshape",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), i([]int{1}, []int64{3})},
+			wantErr: "can't reshape",
+		},
+		{
+			name:    "squeeze",
+			op:      "Squeeze",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), i([]int{1}, []int64{0})},
+			wantErr: "can't squeeze",
+		},
+		{
+			name:    "unsqueeze axis",
+			op:      "Unsqueeze",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), i([]int{1}, []int64{5})},
+			wantErr: "out of range",
+		},
+		{
+			name:    "concat kinds",
+			op:      "Concat",
+			in:      []*tensor{f([]int{1}, []float32{1}), i([]int{1}, []int64{1})},
+			wantErr: "can't concatenate",
+		},
+		{
+			name:    "gather index",
+			op:      "Gather",
+			in:      []*tensor{f([]int{2}, []float32{1, 2}), i([]int{1}, []int64{2})},
+			wantErr: "index 2 out of range",
+		},
+		{
+			name:    "gather too large",
+			op:      "Gather",
+			in:      []*tensor{f([]int{2, 1 << 14}, make([]float32, 1<<15)), i([]int{1 << 15}, make([]int64, 1<<15))},
+			wantErr: errTensorTooLarge.Error(),
+		},
+		{
+			name:    "softmax strings",
+			op:      "Softmax",
+			in:      []*tensor{s([]int{1}, []string{"a"})},
+			wantErr: "expected a numeric tensor",
+		},
+		{
+			name:    "cast float16",
+			op:      "Cast",
+			attrs:   map[string]*attribute{"to": {i: onnxFloat16}},
+			in:      []*tensor{f([]int{1}, []float32{1})},
+			wantErr: "unsupported type 10",
+		},
+		{
+			name:    "constant without value",
+			op:      "Constant",
+			wantErr: "unsupported constant value",
+		},
+		{
+			name: "batch normalization parameters",
+			op:   "BatchNormalization",
+			in: []*tensor{
+				f([]int{1, 2}, []float32{1, 2}),
+				f([]int{1}, []float32{1}),
+				f([]int{1}, []float32{1}),
+				f([]int{1}, []float32{1}),
+				f([]int{1}, []float32{1}),
+			},
+			wantErr: "1 parameters for 2 channels",
+		},
+		{
+			name:    "scaler parameters",
+			op:      "Scaler",
+			domain:  onnxMLDomain,
+			attrs:   map[string]*attribute{"scale": {floats: []float32{1, 2, 3}}},
+			in:      []*tensor{f([]int{1, 2}, []float32{1, 2})},
+			wantErr: "3 parameters for 2 features",
+		},
+		{
+			name:   "linear classifier coefficients",
+			op:     "LinearClassifier",
+			domain: onnxMLDomain,
+			attrs: map[string]*attribute{
+				"coefficients":     {floats: []float32{1, 2, 3}},
+				"classlabels_ints": {ints: []int64{0, 1}},
+			},
+			in:      []*tensor{f([]int{1, 2}, []float32{1, 2})},
+			wantErr: "3 coefficients for 2 features",
+		},
+		{
+			name:   "linear classifier transform",
+			op:     "LinearClassifier",
+			domain: onnxMLDomain,
+			attrs: map[string]*attribute{
+				"coefficients":     {floats: []float32{1, 2}},
+				"classlabels_ints": {ints: []int64{0, 1}},
+				"post_transform":   {s: []byte("SOFTMAX")},
+			},
+			in:      []*tensor{f([]int{1, 2}, []float32{1, 2})},
+			wantErr: "unsupported post transform SOFTMAX for a binary classifier",
+		},
+		{
+			name:    "linear classifier rank",
+			op:      "LinearClassifier",
+			domain:  onnxMLDomain,
+			in:      []*tensor{f([]int{1, 1, 1}, []float32{1})},
+			wantErr: "invalid input",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := &node{op: tc.op, domain: tc.domain, opset: tc.opset, attrs: tc.attrs}
+			ops := onnxOps
+			if tc.domain == onnxMLDomain {
+				ops = onnxMLOps
+			}
+			_, err := ops[tc.op](n, tc.in)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error = %v, want %q", err, tc.wantErr)
+			}
+			if tc.wantErr == errTensorTooLarge.Error() && !errors.Is(err, errTensorTooLarge) {
+				t.Errorf("error = %v, want errTensorTooLarge", err)
+			}
+		})
+	}
+}
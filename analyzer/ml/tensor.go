@@ -0,0 +1,243 @@
+package ml
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxTensorSize is the maximum number of elements of a tensor, and of the product of its non-zero
+// dimensions, so that malformed models can't make the operators allocate without bounds.
+const maxTensorSize = 1 << 28
+
+var errTensorTooLarge = fmt.Errorf("tensors are limited to %d elements", maxTensorSize)
+
+// tensorKind is the kind of the elements of a tensor: all the floating point types are float32,
+// all the integer types (and bool) int64.
+type tensorKind int
+
+const (
+	kindFloat tensorKind = iota
+	kindInt
+	kindString
+)
+
+func (k tensorKind) String() string {
+	switch k {
+	case kindFloat:
+		return "float"
+	case kindInt:
+		return "int"
+	case kindString:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+// tensor is a dense tensor, in row-major order. Operators never modify their inputs, so that tensors
+// (like the initializers of a model) can be shared.
+type tensor struct {
+	shape []int
+	kind  tensorKind
+	f     []float32
+	i     []int64
+	s     []string
+}
+
+func newFloatTensor(shape []int, f []float32) *tensor {
+	return &tensor{shape: shape, kind: kindFloat, f: f}
+}
+
+func newIntTensor(shape []int, i []int64) *tensor {
+	return &tensor{shape: shape, kind: kindInt, i: i}
+}
+
+func newStringTensor(shape []int, s []string) *tensor {
+	return &tensor{shape: shape, kind: kindString, s: s}
+}
+
+func (t *tensor) len() int {
+	switch t.kind {
+	case kindFloat:
+		return len(t.f)
+	case kindInt:
+		return len(t.i)
+	default:
+		return len(t.s)
+	}
+}
+
+// floats returns the elements as float32, converting integers.
+func (t *tensor) floats() ([]float32, error) {
+	switch t.kind {
+	case kindFloat:
+		return t.f, nil
+	case kindInt:
+		f := make([]float32, len(t.i))
+		for k, v := range t.i {
+			f[k] = float32(v)
+		}
+		return f, nil
+	default:
+		return nil, fmt.Errorf("expected a numeric tensor, got %s", t.kind)
+	}
+}
+
+// ints returns the elements as int64, truncating floats.
+func (t *tensor) ints() ([]int64, error) {
+	switch t.kind {
+	case kindInt:
+		return t.i, nil
+	case kindFloat:
+		i := make([]int64, len(t.f))
+		for k, v := range t.f {
+			i[k] = int64(v)
+		}
+		return i, nil
+	default:
+		return nil, fmt.Errorf("expected a numeric tensor, got %s", t.kind)
+	}
+}
+
+// strings returns the elements as strings, formatting numbers.
+func (t *tensor) strings() []string {
+	switch t.kind {
+	case kindString:
+		return t.s
+	case kindInt:
+		s := make([]string, len(t.i))
+		for k, v := range t.i {
+			s[k] = strconv.FormatInt(v, 10)
+		}
+		return s
+	default:
+		s := make([]string, len(t.f))
+		for k, v := range t.f {
+			s[k] = strconv.FormatFloat(float64(v), 'g', -1, 32)
+		}
+		return s
+	}
+}
+
+// reshape returns a tensor sharing the elements of t with another shape.
+func (t *tensor) reshape(shape []int) (*tensor, error) {
+	if shapeSize(shape) != t.len() {
+		return nil, fmt.Errorf("can't reshape %v to %v", t.shape, shape)
+	}
+	r := *t
+	r.shape = shape
+	return &r, nil
+}
+
+// gather returns a tensor of the same kind with the elements of t at the indexes.
+func (t *tensor) gather(shape []int, indexes []int) *tensor {
+	r := &tensor{shape: shape, kind: t.kind}
+	switch t.kind {
+	case kindFloat:
+		r.f = make([]float32, len(indexes))
+		for k, i := range indexes {
+			r.f[k] = t.f[i]
+		}
+	case kindInt:
+		r.i = make([]int64, len(indexes))
+		for k, i := range indexes {
+			r.i[k] = t.i[i]
+		}
+	default:
+		r.s = make([]string, len(indexes))
+		for k, i := range indexes {
+			r.s[k] = t.s[i]
+		}
+	}
+	return r
+}
+
+// shapeSize returns the number of elements of a tensor of a shape,
+// or -1 if a dimension is negative or it's larger than maxTensorSize.
+func shapeSize(shape []int) int {
+	n, nonZero := 1, int64(1)
+	for _, d := range shape {
+		if d < 0 || d > maxTensorSize {
+			return -1
+		}
+		if d > 0 {
+			if nonZero *= int64(d); nonZero > maxTensorSize {
+				return -1
+			}
+		}
+		n *= d
+	}
+	return n
+}
+
+// normalizeAxis converts a negative axis to its positive equivalent, and checks it's within the rank.
+func normalizeAxis(axis int64, rank int) (int, error) {
+	if axis < 0 {
+		axis += int64(rank)
+	}
+	if axis < 0 || axis >= int64(rank) {
+		return 0, fmt.Errorf("axis %d out of range for rank %d", axis, rank)
+	}
+	return int(axis), nil
+}
+
+// broadcastShapes returns the shape of the result of an operation between tensors of shapes a & b,
+// with multidirectional (numpy) broadcasting.
+func broadcastShapes(a, b []int) ([]int, error) {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	out := make([]int, n)
+	for k := range out {
+		da, db := 1, 1
+		if j := k - n + len(a); j >= 0 {
+			da = a[j]
+		}
+		if j := k - n + len(b); j >= 0 {
+			db = b[j]
+		}
+		switch {
+		case da == db, db == 1:
+			out[k] = da
+		case da == 1:
+			out[k] = db
+		default:
+			return nil, fmt.Errorf("shapes %v and %v can't be broadcast", a, b)
+		}
+	}
+	if shapeSize(out) < 0 {
+		return nil, errTensorTooLarge
+	}
+	return out, nil
+}
+
+// broadcastIndexes returns, for every element of a tensor of the (broadcast) shape out,
+// the index of the element of a tensor of the shape it comes from.
+func broadcastIndexes(shape, out []int) []int {
+	strides := make([]int, len(out))
+	s := 1
+	for k := len(shape) - 1; k >= 0; k-- {
+		if shape[k] != 1 {
+			strides[k+len(out)-len(shape)] = s
+		}
+		s *= shape[k]
+	}
+	indexes := make([]int, shapeSize(out))
+	pos := make([]int, len(out))
+	for k := range indexes {
+		i := 0
+		for d, p := range pos {
+			i += p * strides[d]
+		}
+		indexes[k] = i
+		for d := len(pos) - 1; d >= 0; d-- {
+			pos[d]++
+			if pos[d] < out[d] {
+				break
+			}
+			pos[d] = 0
+		}
+	}
+	return indexes
+}
@@ -0,0 +1,249 @@
+// Package relay implements the relay analyzer, which correlates the streams of each host to find those relaying
+// the data of other streams, like SOCKS & HTTP proxies or port forwarders: the payload a host receives in a stream
+// reappears, with the same size, in the payload it sends in another stream within milliseconds.
+package relay
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var (
+	_ analyzer.TCPAnalyzer = (*Analyzer)(nil)
+	_ analyzer.UDPAnalyzer = (*Analyzer)(nil)
+)
+
+const (
+	DefaultWindow  = 50 * time.Millisecond
+	DefaultPackets = 16
+
+	// minSize is the size of the smallest payloads correlated, as smaller ones (e.g. keepalives) are too
+	// common to tell anything.
+	minSize = 16
+	// hostHistory is the number of payloads received by a host kept for correlation.
+	hostHistory = 64
+	shardCount  = 64
+)
+
+// Config is the config of the relay analyzer.
+type Config struct {
+	Window    time.Duration // Between receiving a payload and sending it again; default DefaultWindow
+	Tolerance int           // Bytes the sizes of the payloads can differ by, e.g. for re-encryption; default 0
+	Packets   int           // Scored after this many payloads (or when closed before); default DefaultPackets
+}
+
+// Analyzer is the relay analyzer. After the first payloads of a stream, it sets as score the ratio of the payloads
+// sent by one of its sides that repeat a payload this side just received in another stream, and as host that side.
+// The ratio of the other side, if any, is the peer_score. As the streams of a host are only correlated while
+// they're analyzed, both the streams of a relay must use the relay analyzer, i.e. be matched by rules using it.
+// It is safe for concurrent use, the streams of every worker sharing its state.
+type Analyzer struct {
+	window    time.Duration
+	tolerance int
+	packets   int
+
+	nextID atomic.Uint64
+	shards [shardCount]shard
+}
+
+// shard holds the hosts whose IP hashes to it.
+type shard struct {
+	mutex     sync.Mutex
+	hosts     map[string]*host
+	lastSweep time.Time
+}
+
+// host is the latest payloads received by a host.
+type host struct {
+	received [hostHistory]event // Ring buffer
+	next     int
+	last     time.Time
+}
+
+type event struct {
+	Stream uint64 // 0 for none
+	Size   int
+	Time   time.Time
+	Used   bool // Already matched by a payload sent
+}
+
+func NewAnalyzer(c Config) *Analyzer {
+	a := &Analyzer{
+		window:    c.Window,
+		tolerance: c.Tolerance,
+		packets:   c.Packets,
+	}
+	if a.window <= 0 {
+		a.window = DefaultWindow
+	}
+	if a.packets <= 0 {
+		a.packets = DefaultPackets
+	}
+	for i := range a.shards {
+		a.shards[i].hosts = make(map[string]*host)
+	}
+	return a
+}
+
+func (a *Analyzer) Name() string {
+	return "relay"
+}
+
+func (a *Analyzer) Limit() int {
+	return 0
+}
+
+func (a *Analyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
+	return a.newStream(info.SrcIP, info.DstIP)
+}
+
+func (a *Analyzer) NewUDP(info analyzer.UDPInfo, logger analyzer.Logger) analyzer.UDPStream {
+	return udpStream{a.newStream(info.SrcIP, info.DstIP)}
+}
+
+func (a *Analyzer) newStream(src, dst net.IP) *relayStream {
+	return &relayStream{
+		analyzer: a,
+		id:       a.nextID.Add(1),
+		ips:      [2]net.IP{src, dst},
+	}
+}
+
+func (a *Analyzer) shard(ip net.IP) *shard {
+	ip = ip.To16()
+	var h uint32
+	for _, b := range ip {
+		h = h*31 + uint32(b)
+	}
+	return &a.shards[h%shardCount]
+}
+
+// sent handles a payload sent by a host in a stream, and returns whether it repeats one
+// the host received in another stream within the window.
+func (a *Analyzer) sent(ip net.IP, stream uint64, size int, t time.Time) bool {
+	s := a.shard(ip)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	h := s.hosts[string(ip.To16())]
+	if h == nil {
+		return false
+	}
+	for i := range h.received {
+		e := &h.received[i]
+		if e.Stream == 0 || e.Stream == stream || e.Used || t.Sub(e.Time) > a.window {
+			continue
+		}
+		if diff := size - e.Size; diff <= a.tolerance && diff >= -a.tolerance {
+			e.Used = true
+			return true
+		}
+	}
+	return false
+}
+
+// received handles a payload received by a host in a stream.
+func (a *Analyzer) received(ip net.IP, stream uint64, size int, t time.Time) {
+	s := a.shard(ip)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if t.Sub(s.lastSweep) > a.window {
+		// Forget the hosts that can't match anymore
+		for k, h := range s.hosts {
+			if t.Sub(h.last) > a.window {
+				delete(s.hosts, k)
+			}
+		}
+		s.lastSweep = t
+	}
+	key := string(ip.To16())
+	h := s.hosts[key]
+	if h == nil {
+		h = &host{}
+		s.hosts[key] = h
+	}
+	h.received[h.next] = event{Stream: stream, Size: size, Time: t}
+	h.next = (h.next + 1) % hostHistory
+	h.last = t
+}
+
+type relayStream struct {
+	analyzer *Analyzer
+	id       uint64
+	ips      [2]net.IP // Source, destination
+	sent     [2]int    // Payloads sent by the source & destination
+	relayed  [2]int    // Of which repeat one received in another stream
+	done     bool
+}
+
+func (s *relayStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyzer.PropUpdate, done bool) {
+	return s.feed(rev, data)
+}
+
+func (s *relayStream) feed(rev bool, data []byte) (u *analyzer.PropUpdate, done bool) {
+	if len(data) < minSize {
+		return nil, false
+	}
+	from, to := 0, 1
+	if rev {
+		from, to = 1, 0
+	}
+	now := time.Now()
+	if s.analyzer.sent(s.ips[from], s.id, len(data), now) {
+		s.relayed[from]++
+	}
+	s.analyzer.received(s.ips[to], s.id, len(data), now)
+	s.sent[from]++
+	if s.sent[0]+s.sent[1] < s.analyzer.packets {
+		return nil, false
+	}
+	return s.score(), true
+}
+
+// score returns the properties of the stream, from the side relaying the most.
+func (s *relayStream) score() *analyzer.PropUpdate {
+	s.done = true
+	var scores [2]float64
+	for i := range scores {
+		if s.sent[i] > 0 {
+			scores[i] = float64(s.relayed[i]) / float64(s.sent[i])
+		}
+	}
+	side := 0
+	if scores[1] > scores[0] {
+		side = 1
+	}
+	var host string
+	if s.relayed[side] > 0 {
+		host = s.ips[side].String()
+	}
+	return &analyzer.PropUpdate{
+		Type: analyzer.PropUpdateReplace,
+		M: analyzer.PropMap{
+			"score":      scores[side],
+			"host":       host,
+			"peer_score": scores[1-side],
+			"packets":    s.sent[0] + s.sent[1],
+		},
+	}
+}
+
+func (s *relayStream) Close(limited bool) *analyzer.PropUpdate {
+	if s.done || s.sent[0]+s.sent[1] == 0 {
+		return nil
+	}
+	// Fewer payloads than expected, score what there is
+	return s.score()
+}
+
+// udpStream adapts relayStream to UDP, whose Feed has another signature.
+type udpStream struct {
+	*relayStream
+}
+
+func (s udpStream) Feed(rev bool, data []byte) (u *analyzer.PropUpdate, done bool) {
+	return s.feed(rev, data)
+}
@@ -0,0 +1,199 @@
+// Package sctp implements the analyzers of SCTP associations.
+package sctp
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var (
+	_ analyzer.SCTPAnalyzer = (*SCTPAnalyzer)(nil)
+	_ analyzer.SCTPStream   = (*sctpStream)(nil)
+)
+
+const (
+	sctpMaxMessages = 16 // Data messages looked at
+	sctpMaxPPIDs    = 8
+
+	sctpParamIPv4 = 5
+	sctpParamIPv6 = 6
+)
+
+// sctpProtocols are the names of the payload protocol identifiers of the common signaling protocols.
+var sctpProtocols = map[uint32]string{
+	1:  "iua",
+	2:  "m2ua",
+	3:  "m3ua",
+	4:  "sua",
+	5:  "m2pa",
+	6:  "v5ua",
+	7:  "h248",
+	18: "s1ap",
+	19: "rua",
+	20: "hnbap",
+	25: "nbap",
+	27: "x2ap",
+	43: "m2ap",
+	44: "m3ap",
+	46: "diameter",
+	47: "diameter",
+	50: "webrtc",
+	51: "webrtc",
+	53: "webrtc",
+	60: "ngap",
+	61: "xnap",
+	62: "f1ap",
+}
+
+// sctpPorts are the names of the protocols of the well-known ports, for payloads without PPID (0),
+// which is common for Diameter.
+var sctpPorts = map[uint16]string{
+	2904:  "m2ua",
+	2905:  "m3ua",
+	3565:  "m2pa",
+	3868:  "diameter",
+	5675:  "v5ua",
+	9900:  "iua",
+	14001: "sua",
+	36412: "s1ap",
+	36422: "x2ap",
+	38412: "ngap",
+	38422: "xnap",
+	38472: "f1ap",
+}
+
+// SCTPAnalyzer reports the parameters of SCTP associations: the addresses (several for multi-homed
+// endpoints) & number of streams of the client and server from their INIT & INIT ACK, and the payload
+// protocol identifiers of their first messages, with the protocol they stand for.
+type SCTPAnalyzer struct{}
+
+func (a *SCTPAnalyzer) Name() string {
+	return "sctp"
+}
+
+func (a *SCTPAnalyzer) Limit() int {
+	return 0
+}
+
+func (a *SCTPAnalyzer) NewSCTP(info analyzer.SCTPInfo, logger analyzer.Logger) analyzer.SCTPStream {
+	return &sctpStream{
+		logger:  logger,
+		dstPort: info.DstPort,
+		streams: make(map[uint16]bool),
+	}
+}
+
+type sctpStream struct {
+	logger   analyzer.Logger
+	dstPort  uint16
+	init     analyzer.PropMap // Of the client, from its INIT
+	initAck  analyzer.PropMap // Of the server, from its INIT ACK
+	messages int
+	ppids    []uint32
+	streams  map[uint16]bool // With messages
+}
+
+func (s *sctpStream) Feed(rev bool, chunk analyzer.SCTPChunk) (u *analyzer.PropUpdate, done bool) {
+	switch chunk.Type {
+	case analyzer.SCTPChunkInit, analyzer.SCTPChunkInitAck:
+		m := parseInit(chunk.Data)
+		if m == nil {
+			return nil, false
+		}
+		if chunk.Type == analyzer.SCTPChunkInit && !rev {
+			s.init = m
+		} else if chunk.Type == analyzer.SCTPChunkInitAck && rev {
+			s.initAck = m
+		} else {
+			return nil, false
+		}
+	case analyzer.SCTPChunkData:
+		s.messages++
+		s.streams[chunk.StreamID] = true
+		if !slices.Contains(s.ppids, chunk.PPID) && len(s.ppids) < sctpMaxPPIDs {
+			s.ppids = append(s.ppids, chunk.PPID)
+		}
+	default:
+		return nil, false
+	}
+	return &analyzer.PropUpdate{
+		Type: analyzer.PropUpdateReplace,
+		M:    s.props(),
+	}, s.messages >= sctpMaxMessages
+}
+
+func (s *sctpStream) Close(limited bool) *analyzer.PropUpdate {
+	return nil
+}
+
+func (s *sctpStream) props() analyzer.PropMap {
+	m := analyzer.PropMap{
+		"messages": s.messages,
+		"streams":  len(s.streams),
+	}
+	multihomed := false
+	if s.init != nil {
+		m["client"] = s.init
+		multihomed = multihomed || len(s.init["addrs"].([]string)) > 1
+	}
+	if s.initAck != nil {
+		m["server"] = s.initAck
+		multihomed = multihomed || len(s.initAck["addrs"].([]string)) > 1
+	}
+	m["multihomed"] = multihomed
+	if len(s.ppids) > 0 {
+		ppids := make([]int, len(s.ppids))
+		for i, ppid := range s.ppids {
+			ppids[i] = int(ppid)
+		}
+		m["ppid"] = ppids[0]
+		m["ppids"] = ppids
+	}
+	// The protocol of the first identified payload, or of the port
+	for _, ppid := range s.ppids {
+		if name, ok := sctpProtocols[ppid]; ok {
+			m["protocol"] = name
+			return m
+		}
+	}
+	if name, ok := sctpPorts[s.dstPort]; ok && s.messages > 0 {
+		m["protocol"] = name
+	}
+	return m
+}
+
+// parseInit returns the properties of an INIT or INIT ACK chunk (its value, after the chunk header),
+// or nil if it's invalid. Only the addresses listed in the chunk are reported: without any, the endpoint
+// only uses the source address of the packet.
+func parseInit(data []byte) analyzer.PropMap {
+	if len(data) < 16 {
+		return nil
+	}
+	addrs := []string{}
+	params := data[16:]
+	for len(params) >= 4 {
+		typ, length := binary.BigEndian.Uint16(params[0:2]), int(binary.BigEndian.Uint16(params[2:4]))
+		if length < 4 || length > len(params) {
+			break
+		}
+		switch {
+		case typ == sctpParamIPv4 && length == 8:
+			addrs = append(addrs, net.IP(params[4:8]).String())
+		case typ == sctpParamIPv6 && length == 20:
+			addrs = append(addrs, net.IP(params[4:20]).String())
+		}
+		length = (length + 3) &^ 3
+		if length > len(params) {
+			break
+		}
+		params = params[length:]
+	}
+	return analyzer.PropMap{
+		"out_streams": int(binary.BigEndian.Uint16(data[8:10])),
+		"in_streams":  int(binary.BigEndian.Uint16(data[10:12])),
+		"addrs":       addrs,
+	}
+}
@@ -2,6 +2,9 @@ package tcp
 
 import (
 	"bytes"
+	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -11,7 +14,31 @@ import (
 
 var _ analyzer.TCPAnalyzer = (*HTTPAnalyzer)(nil)
 
-type HTTPAnalyzer struct{}
+// httpSessionCookies are the substrings of the names of the cookies taken as session cookies by default,
+// e.g. PHPSESSID, JSESSIONID, connect.sid or auth_token.
+var httpSessionCookies = []string{"sess", "sid", "token", "auth", "jwt", "login", "remember"}
+
+// httpCredentialParams are the query parameters taken as credentials.
+var httpCredentialParams = map[string]bool{
+	"password": true, "passwd": true, "pwd": true, "pass": true, "secret": true, "client_secret": true,
+	"token": true, "access_token": true, "id_token": true, "refresh_token": true, "api_key": true, "apikey": true,
+	"auth": true, "session": true, "sessionid": true,
+}
+
+// httpCredentialHeaders are the request headers carrying credentials.
+var httpCredentialHeaders = []string{"authorization", "proxy-authorization", "x-api-key", "x-auth-token"}
+
+type HTTPAnalyzer struct {
+	// Credentials enables the credentials_plaintext & credentials properties: whether the request carries
+	// credentials to an external destination, and which.
+	Credentials bool
+	// Internal are the destinations whose credentials aren't flagged. If nil, the private, loopback &
+	// link-local addresses.
+	Internal []*net.IPNet
+	// SessionCookies are the substrings (lowercase) of the names of the cookies taken as session cookies.
+	// If nil, a built-in list.
+	SessionCookies []string
+}
 
 func (a *HTTPAnalyzer) Name() string {
 	return "http"
@@ -22,7 +49,27 @@ func (a *HTTPAnalyzer) Limit() int {
 }
 
 func (a *HTTPAnalyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
-	return newHTTPStream(logger)
+	s := newHTTPStream(logger)
+	if a.Credentials && a.external(info.DstIP) {
+		s.credentials = true
+		s.sessionCookies = a.SessionCookies
+		if s.sessionCookies == nil {
+			s.sessionCookies = httpSessionCookies
+		}
+	}
+	return s
+}
+
+func (a *HTTPAnalyzer) external(ip net.IP) bool {
+	if a.Internal == nil {
+		return !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+	}
+	for _, n := range a.Internal {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
 }
 
 type httpStream struct {
@@ -39,6 +86,9 @@ type httpStream struct {
 	respUpdated bool
 	respLSM     *utils.LinearStateMachine
 	respDone    bool
+
+	credentials    bool     // Whether to look for credentials in the request
+	sessionCookies []string // If credentials
 }
 
 func newHTTPStream(logger analyzer.Logger) *httpStream {
@@ -83,6 +133,11 @@ func (s *httpStream) Feed(rev, start, end bool, skip int, data []byte) (u *analy
 				Type: analyzer.PropUpdateMerge,
 				M:    analyzer.PropMap{"req": s.reqMap},
 			}
+			if s.credentials && s.reqMap["headers"] != nil {
+				found := s.findCredentials()
+				update.M["credentials_plaintext"] = len(found) > 0
+				update.M["credentials"] = found
+			}
 			s.reqUpdated = false
 		}
 	}
@@ -184,6 +239,49 @@ func (s *httpStream) parseResponseHeaders() utils.LSMAction {
 	return action
 }
 
+// findCredentials returns the credentials the request carries: credential headers, session cookies
+// (cookie:<name>), credentials in the URL (userinfo) and in its query (query:<name>).
+func (s *httpStream) findCredentials() []string {
+	found := []string{}
+	headers, _ := s.reqMap["headers"].(analyzer.PropMap)
+	for _, h := range httpCredentialHeaders {
+		if v, _ := headers[h].(string); v != "" {
+			found = append(found, h)
+		}
+	}
+	if cookies, _ := headers["cookie"].(string); cookies != "" {
+		for _, c := range strings.Split(cookies, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(c), "=")
+			if value == "" {
+				continue
+			}
+			lower := strings.ToLower(name)
+			for _, sub := range s.sessionCookies {
+				if strings.Contains(lower, sub) {
+					found = append(found, "cookie:"+name)
+					break
+				}
+			}
+		}
+	}
+	path, _ := s.reqMap["path"].(string)
+	if u, err := url.Parse(path); err == nil {
+		// Absolute in requests to proxies
+		if u.User != nil {
+			found = append(found, "userinfo")
+		}
+		var params []string
+		for name, values := range u.Query() {
+			if httpCredentialParams[strings.ToLower(name)] && len(values) > 0 && values[0] != "" {
+				params = append(params, "query:"+name)
+			}
+		}
+		sort.Strings(params)
+		found = append(found, params...)
+	}
+	return found
+}
+
 func (s *httpStream) Close(limited bool) *analyzer.PropUpdate {
 	s.reqBuf.Reset()
 	s.respBuf.Reset()
@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var _ analyzer.TCPAnalyzer = (*OSAnalyzer)(nil)
+
+const (
+	osConfidenceSignature = 0.9
+	osConfidenceTTL       = 0.3
+)
+
+// osSignature is the SYN of an OS, in the style of p0f: its initial TTL, the order of its TCP options,
+// and optionally its window sizes.
+type osSignature struct {
+	Name       string
+	InitialTTL uint8
+	Options    string   // Up to the first eol
+	Windows    []uint16 // Any if empty
+}
+
+// osSignatures are the SYNs of common OSes & tools, the first matching one winning.
+var osSignatures = []osSignature{
+	{Name: "nmap", InitialTTL: 64, Options: "mss", Windows: []uint16{1024, 2048, 3072, 4096}},
+	{Name: "Linux", InitialTTL: 64, Options: "mss,sok,ts,nop,ws"},
+	{Name: "Linux", InitialTTL: 64, Options: "mss,nop,nop,sok,nop,ws"},
+	{Name: "Windows", InitialTTL: 128, Options: "mss,nop,ws,nop,nop,sok"},
+	{Name: "Windows", InitialTTL: 128, Options: "mss,nop,ws,sok,ts"},
+	{Name: "Windows XP", InitialTTL: 128, Options: "mss,nop,nop,sok"},
+	{Name: "macOS/iOS", InitialTTL: 64, Options: "mss,nop,ws,nop,nop,ts,sok"},
+	{Name: "FreeBSD", InitialTTL: 64, Options: "mss,nop,ws,sok,ts"},
+	{Name: "OpenBSD", InitialTTL: 64, Options: "mss,nop,nop,sok,nop,ws,nop,nop,ts"},
+	{Name: "Cisco IOS", InitialTTL: 255, Options: "mss", Windows: []uint16{4128}},
+}
+
+// OSAnalyzer guesses the OS of the client of a stream from its SYN, like p0f: the TTL (rounded up to the usual
+// initial TTLs), the order of the TCP options and the window size. It needs the SYN, so streams picked up midway
+// have no guess.
+type OSAnalyzer struct{}
+
+func (a *OSAnalyzer) Name() string {
+	return "os"
+}
+
+func (a *OSAnalyzer) Limit() int {
+	return 0
+}
+
+func (a *OSAnalyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
+	return &osStream{syn: info.SYN}
+}
+
+type osStream struct {
+	syn  *analyzer.TCPSYN
+	done bool
+}
+
+func (s *osStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyzer.PropUpdate, done bool) {
+	// Everything is known from the start
+	return s.guess(), true
+}
+
+func (s *osStream) Close(limited bool) *analyzer.PropUpdate {
+	return s.guess()
+}
+
+func (s *osStream) guess() *analyzer.PropUpdate {
+	if s.done || s.syn == nil {
+		return nil
+	}
+	s.done = true
+	syn := s.syn
+	initialTTL := osInitialTTL(syn.TTL)
+	options := syn.Options
+	if i := slices.Index(options, "eol"); i >= 0 {
+		// Padding
+		options = options[:i]
+	}
+	layout := strings.Join(options, ",")
+	guess, confidence := "", 0.0
+	for _, sig := range osSignatures {
+		if sig.InitialTTL == initialTTL && sig.Options == layout &&
+			(len(sig.Windows) == 0 || slices.Contains(sig.Windows, syn.Window)) {
+			guess, confidence = sig.Name, osConfidenceSignature
+			break
+		}
+	}
+	if guess == "" && initialTTL == 128 {
+		// Only Windows uses it
+		guess, confidence = "Windows", osConfidenceTTL
+	}
+	return &analyzer.PropUpdate{
+		Type: analyzer.PropUpdateReplace,
+		M: analyzer.PropMap{
+			"guess":       guess,
+			"confidence":  confidence,
+			"ttl":         int(syn.TTL),
+			"initial_ttl": int(initialTTL),
+			"distance":    int(initialTTL - syn.TTL),
+			"window":      int(syn.Window),
+			"mss":         int(syn.MSS),
+			"wscale":      syn.WindowScale,
+			"options":     layout,
+		},
+	}
+}
+
+// osInitialTTL returns the initial TTL a packet most likely had: the smallest usual one not below its TTL.
+func osInitialTTL(ttl uint8) uint8 {
+	for _, t := range []uint8{32, 64, 128} {
+		if ttl <= t {
+			return t
+		}
+	}
+	return 255
+}
@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+func TestOSInitialTTL(t *testing.T) {
+	testCases := map[uint8]uint8{
+		0:   32,
+		1:   32,
+		32:  32,
+		33:  64,
+		57:  64,
+		64:  64,
+		65:  128,
+		113: 128,
+		128: 128,
+		129: 255,
+		250: 255,
+		255: 255,
+	}
+	for ttl, want := range testCases {
+		if got := osInitialTTL(ttl); got != want {
+			t.Errorf("osInitialTTL(%d) = %d, want %d", ttl, got, want)
+		}
+	}
+}
+
+func TestOSStreamParsing(t *testing.T) {
+	testCases := []struct {
+		name           string
+		ttl            uint8
+		window         uint16
+		options        string
+		wantGuess      string
+		wantConfidence float64
+		wantOptions    string
+	}{
+		{"Linux", 57, 64240, "mss,sok,ts,nop,ws", "Linux", osConfidenceSignature, ""},
+		{"Linux without timestamps", 64, 64240, "mss,nop,nop,sok,nop,ws", "Linux", osConfidenceSignature, ""},
+		{"Windows", 117, 64240, "mss,nop,ws,nop,nop,sok", "Windows", osConfidenceSignature, ""},
+		{"Windows with timestamps", 128, 65535, "mss,nop,ws,sok,ts", "Windows", osConfidenceSignature, ""},
+		{"Windows XP", 110, 65535, "mss,nop,nop,sok", "Windows XP", osConfidenceSignature, ""},
+		{"Windows, TTL only", 113, 8192, "mss,nop,nop,ts", "Windows", osConfidenceTTL, ""},
+		{"Windows, TTL only without options", 128, 8192, "", "Windows", osConfidenceTTL, ""},
+		{"macOS", 52, 65535, "mss,nop,ws,nop,nop,ts,sok,eol,eol", "macOS/iOS", osConfidenceSignature, "mss,nop,ws,nop,nop,ts,sok"},
+		{"FreeBSD", 64, 65535, "mss,nop,ws,sok,ts", "FreeBSD", osConfidenceSignature, ""},
+		{"OpenBSD", 60, 16384, "mss,nop,nop,sok,nop,ws,nop,nop,ts", "OpenBSD", osConfidenceSignature, ""},
+		{"eol in the middle", 64, 29200, "mss,sok,ts,nop,ws,eol,nop,ws", "Linux", osConfidenceSignature, "mss,sok,ts,nop,ws"},
+		{"nmap", 41, 1024, "mss", "nmap", osConfidenceSignature, ""},
+		{"mss only, other window", 41, 1025, "mss", "", 0, ""},
+		{"Cisco IOS", 250, 4128, "mss", "Cisco IOS", osConfidenceSignature, ""},
+		{"Linux options, TTL of Windows", 120, 64240, "mss,sok,ts,nop,ws", "Windows", osConfidenceTTL, ""},
+		{"Windows options, TTL of Linux", 64, 64240, "mss,nop,ws,nop,nop,sok", "", 0, ""},
+		{"unknown option", 64, 64240, "mss,sok,ts,nop,ws,?30", "", 0, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var options []string
+			if tc.options != "" {
+				options = strings.Split(tc.options, ",")
+			}
+			syn := &analyzer.TCPSYN{TTL: tc.ttl, Window: tc.window, MSS: 1460, WindowScale: 7, Options: options}
+			s := (&OSAnalyzer{}).NewTCP(analyzer.TCPInfo{SYN: syn}, nil)
+			u, done := s.Feed(false, true, false, 0, nil)
+			if !done {
+				t.Error("Feed() not done")
+			}
+			if u == nil {
+				t.Fatal("Feed() = nil")
+			}
+			if got := u.M["guess"]; got != tc.wantGuess {
+				t.Errorf("guess = %v, want %q", got, tc.wantGuess)
+			}
+			if got := u.M["confidence"]; got != tc.wantConfidence {
+				t.Errorf("confidence = %v, want %v", got, tc.wantConfidence)
+			}
+			wantOptions := tc.wantOptions
+			if wantOptions == "" {
+				wantOptions = tc.options
+			}
+			initialTTL := int(osInitialTTL(tc.ttl))
+			want := analyzer.PropMap{
+				"ttl":         int(tc.ttl),
+				"initial_ttl": initialTTL,
+				"distance":    initialTTL - int(tc.ttl),
+				"window":      int(tc.window),
+				"mss":         1460,
+				"wscale":      7,
+				"options":     wantOptions,
+			}
+			for k, v := range want {
+				if !reflect.DeepEqual(u.M[k], v) {
+					t.Errorf("%s = %v, want %v", k, u.M[k], v)
+				}
+			}
+			if u := s.Close(false); u != nil {
+				t.Errorf("Close() after Feed() = %v, want nil", u)
+			}
+		})
+	}
+}
+
+func TestOSStreamParsing_NoSYN(t *testing.T) {
+	s := (&OSAnalyzer{}).NewTCP(analyzer.TCPInfo{}, nil)
+	if u, done := s.Feed(false, false, false, 0, []byte("data")); u != nil || !done {
+		t.Errorf("Feed() = %v, %v, want nil, true", u, done)
+	}
+	if u := s.Close(false); u != nil {
+		t.Errorf("Close() = %v, want nil", u)
+	}
+}
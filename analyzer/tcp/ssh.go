@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"strings"
+	"time"
 
 	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/analyzer/utils"
@@ -9,18 +10,47 @@ import (
 
 var _ analyzer.TCPAnalyzer = (*SSHAnalyzer)(nil)
 
-type SSHAnalyzer struct{}
+const (
+	sshDefaultTunnelPackets = 256
+
+	sshMsgNewKeys     = 21
+	sshMaxPacketSize  = 35000 // RFC 4253, section 6.1
+	sshSmallChunk     = 64    // At most, e.g. a keystroke or its echo
+	sshLargeChunk     = 1000  // At least, e.g. a file or a web page
+	sshTunnelRequests = 16    // Requests for the score to be highest
+)
+
+type SSHAnalyzer struct {
+	// Tunnel enables the tunnel heuristics: after the key exchange, the sizes & order of the encrypted
+	// chunks of data are analyzed to score how likely the connection tunnels others (SOCKS proxy,
+	// port forwarding) or bulk transfers, rather than being an interactive session.
+	Tunnel bool
+	// TunnelPackets is the number of chunks of encrypted data the score is based on, default 256.
+	TunnelPackets int
+}
 
 func (a *SSHAnalyzer) Name() string {
 	return "ssh"
 }
 
 func (a *SSHAnalyzer) Limit() int {
+	if a.Tunnel {
+		return 0
+	}
 	return 1024
 }
 
 func (a *SSHAnalyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
-	return newSSHStream(logger)
+	s := newSSHStream(logger)
+	if a.Tunnel {
+		s.tunnel = &sshTunnel{packets: a.TunnelPackets}
+		if s.tunnel.packets <= 0 {
+			s.tunnel.packets = sshDefaultTunnelPackets
+		}
+		s.clientLSM.AppendSteps(func() utils.LSMAction { return s.parseKex(s.clientBuf) })
+		s.serverLSM.AppendSteps(func() utils.LSMAction { return s.parseKex(s.serverBuf) })
+	}
+	return s
 }
 
 type sshStream struct {
@@ -37,6 +67,23 @@ type sshStream struct {
 	serverUpdated bool
 	serverLSM     *utils.LinearStateMachine
 	serverDone    bool
+
+	tunnel *sshTunnel // nil if the tunnel heuristics are disabled
+}
+
+// sshTunnel is the state of the tunnel heuristics, from the encrypted data after the key exchange.
+type sshTunnel struct {
+	packets int // To score after
+
+	start, last time.Time
+	lastRev     bool   // Direction of the latest chunk
+	chunks      [2]int // Client, server
+	bytes       [2]int
+	small       [2]int // Chunks of at most sshSmallChunk bytes
+	large       [2]int // Chunks of at least sshLargeChunk bytes
+	largeBytes  int
+	requests    int // Chunks of the client, neither small nor large, after one of the server
+	scored      bool
 }
 
 func newSSHStream(logger analyzer.Logger) *sshStream {
@@ -57,6 +104,13 @@ func (s *sshStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyz
 	if len(data) == 0 {
 		return nil, false
 	}
+	if s.tunnel != nil && ((rev && s.serverDone) || (!rev && s.clientDone)) {
+		// Encrypted
+		if u := s.tunnel.feed(rev, len(data)); u != nil {
+			return u, true
+		}
+		return nil, false
+	}
 	var update *analyzer.PropUpdate
 	var cancelled bool
 	if rev {
@@ -82,9 +136,38 @@ func (s *sshStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyz
 			s.clientUpdated = false
 		}
 	}
+	if s.tunnel != nil {
+		if !cancelled {
+			if u := s.feedTunnelRest(rev); u != nil {
+				if update != nil {
+					for k, v := range u.M {
+						update.M[k] = v
+					}
+					return update, true
+				}
+				return u, true
+			}
+		}
+		return update, cancelled
+	}
 	return update, cancelled || (s.clientDone && s.serverDone)
 }
 
+// feedTunnelRest feeds the data left after SSH_MSG_NEWKEYS, which is already encrypted,
+// to the tunnel heuristics once the key exchange of the direction is done.
+func (s *sshStream) feedTunnelRest(rev bool) *analyzer.PropUpdate {
+	buf, done := s.clientBuf, s.clientDone
+	if rev {
+		buf, done = s.serverBuf, s.serverDone
+	}
+	n := buf.Len()
+	if !done || n == 0 {
+		return nil
+	}
+	buf.Reset()
+	return s.tunnel.feed(rev, n)
+}
+
 // parseExchangeLine parses the SSH Protocol Version Exchange string.
 // See RFC 4253, section 4.2.
 // "SSH-protoversion-softwareversion SP comments CR LF"
@@ -138,10 +221,109 @@ func (s *sshStream) parseServerExchangeLine() utils.LSMAction {
 	return action
 }
 
+// parseKex skips the binary packets of the key exchange, which aren't encrypted yet,
+// until SSH_MSG_NEWKEYS, after which everything is. See RFC 4253, section 6.
+func (s *sshStream) parseKex(buf *utils.ByteBuffer) utils.LSMAction {
+	for {
+		length, ok := buf.GetUint32(false, false)
+		if !ok {
+			return utils.LSMActionPause
+		}
+		if length < 5 || length > sshMaxPacketSize {
+			// Not a binary packet
+			return utils.LSMActionCancel
+		}
+		packet, ok := buf.Get(4+int(length), true)
+		if !ok {
+			return utils.LSMActionPause
+		}
+		if packet[5] == sshMsgNewKeys {
+			return utils.LSMActionNext
+		}
+	}
+}
+
 func (s *sshStream) Close(limited bool) *analyzer.PropUpdate {
 	s.clientBuf.Reset()
 	s.serverBuf.Reset()
 	s.clientMap = nil
 	s.serverMap = nil
+	if s.tunnel != nil && !s.tunnel.scored && s.tunnel.chunks[0]+s.tunnel.chunks[1] > 0 {
+		// Fewer chunks than expected, score what there is
+		return s.tunnel.score()
+	}
 	return nil
 }
+
+// feed handles a chunk of encrypted data, and returns the score once there are enough chunks.
+func (t *sshTunnel) feed(rev bool, size int) *analyzer.PropUpdate {
+	now := time.Now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	dir := 0
+	if rev {
+		dir = 1
+	}
+	switch {
+	case size <= sshSmallChunk:
+		t.small[dir]++
+	case size >= sshLargeChunk:
+		t.large[dir]++
+		t.largeBytes += size
+	case !rev && (t.lastRev || t.chunks[0]+t.chunks[1] == 0):
+		// Likely a new channel (e.g. a connection through a SOCKS proxy) or a request in one
+		t.requests++
+	}
+	t.chunks[dir]++
+	t.bytes[dir] += size
+	t.last, t.lastRev = now, rev
+	if t.chunks[0]+t.chunks[1] < t.packets {
+		return nil
+	}
+	return t.score()
+}
+
+// score returns the tunnel properties. Interactive sessions, made of keystrokes & their echoes, score low.
+// Many requests (channels opened for tunneled connections) and bulk transfers score high.
+func (t *sshTunnel) score() *analyzer.PropUpdate {
+	t.scored = true
+	chunks := t.chunks[0] + t.chunks[1]
+	bytes := t.bytes[0] + t.bytes[1]
+	duration := t.last.Sub(t.start).Seconds()
+	var keystrokes, bulk, upload, rate float64
+	if t.chunks[0] > 0 {
+		keystrokes = float64(t.small[0]) / float64(t.chunks[0])
+	}
+	if bytes > 0 {
+		bulk = float64(t.largeBytes) / float64(bytes)
+		upload = float64(t.bytes[0]) / float64(bytes)
+	}
+	if duration > 0 {
+		rate = float64(t.requests) / duration
+	}
+	requests := float64(min(t.requests, sshTunnelRequests)) / sshTunnelRequests
+	score := (1 - keystrokes) * min(1, 0.6*requests+0.4*bulk)
+	return &analyzer.PropUpdate{
+		Type: analyzer.PropUpdateMerge,
+		M: analyzer.PropMap{
+			"tunnel": analyzer.PropMap{
+				"score":        score,
+				"packets":      chunks,
+				"duration":     duration,
+				"requests":     t.requests,
+				"request_rate": rate,
+				"sizes": analyzer.PropMap{
+					"small":  t.small[0] + t.small[1],
+					"medium": chunks - t.small[0] - t.small[1] - t.large[0] - t.large[1],
+					"large":  t.large[0] + t.large[1],
+				},
+				"keystroke_ratio": keystrokes,
+				"bulk_ratio":      bulk,
+				"upload_ratio":    upload,
+				"client_bytes":    t.bytes[0],
+				"server_bytes":    t.bytes[1],
+			},
+		},
+	}
+}
@@ -0,0 +1,172 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+// sshTestPacket returns an unencrypted binary packet with the message type and payload.
+func sshTestPacket(msg byte, payload []byte) []byte {
+	const padding = 4
+	b := binary.BigEndian.AppendUint32(nil, uint32(1+1+len(payload)+padding))
+	b = append(b, padding, msg)
+	b = append(b, payload...)
+	return append(b, make([]byte, padding)...)
+}
+
+// sshTestHandshake returns the version exchange & key exchange of one side, up to SSH_MSG_NEWKEYS.
+func sshTestHandshake(version string) []byte {
+	b := []byte(version + "\r\n")
+	b = append(b, sshTestPacket(20, bytes.Repeat([]byte{0xaa}, 300))...) // SSH_MSG_KEXINIT
+	b = append(b, sshTestPacket(30, bytes.Repeat([]byte{0xbb}, 32))...)  // SSH_MSG_KEX_ECDH_INIT
+	return append(b, sshTestPacket(sshMsgNewKeys, nil)...)
+}
+
+type sshTestChunk struct {
+	rev  bool
+	size int
+}
+
+func sshTestChunks(n int, pattern ...sshTestChunk) []sshTestChunk {
+	var chunks []sshTestChunk
+	for i := 0; i < n; i++ {
+		chunks = append(chunks, pattern...)
+	}
+	return chunks
+}
+
+func TestSSHStreamParsing_Exchange(t *testing.T) {
+	s := (&SSHAnalyzer{}).NewTCP(analyzer.TCPInfo{}, nil)
+	u, done := s.Feed(false, false, false, 0, []byte("SSH-2.0-OpenSSH_9.6 Ubuntu-3\r\n"))
+	want := analyzer.PropMap{"protocol": "2.0", "software": "OpenSSH_9.6", "comments": "Ubuntu-3"}
+	if got := u.M.Get("client"); !reflect.DeepEqual(got, want) || done {
+		t.Errorf("client parsed = %v, done %v, want %v", got, done, want)
+	}
+	u, done = s.Feed(true, false, false, 0, []byte("SSH-2.0-dropbear_2022.83\r\n"))
+	want = analyzer.PropMap{"protocol": "2.0", "software": "dropbear_2022.83"}
+	if got := u.M.Get("server"); !reflect.DeepEqual(got, want) || !done {
+		t.Errorf("server parsed = %v, done %v, want %v", got, done, want)
+	}
+}
+
+func TestSSHTunnel_NewKeysRest(t *testing.T) {
+	s := (&SSHAnalyzer{Tunnel: true}).NewTCP(analyzer.TCPInfo{}, nil).(*sshStream)
+	// The first encrypted packet in the same segment as SSH_MSG_NEWKEYS
+	data := append(sshTestHandshake("SSH-2.0-OpenSSH_9.6"), make([]byte, 36)...)
+	if _, done := s.Feed(false, false, false, 0, data); done {
+		t.Fatal("Feed() done after the key exchange")
+	}
+	if !s.clientDone {
+		t.Fatal("key exchange of the client not done")
+	}
+	if s.tunnel.chunks[0] != 1 || s.tunnel.bytes[0] != 36 || s.tunnel.small[0] != 1 {
+		t.Errorf("tunnel chunks = %d, bytes = %d, small = %d, want 1, 36, 1",
+			s.tunnel.chunks[0], s.tunnel.bytes[0], s.tunnel.small[0])
+	}
+	if n := s.clientBuf.Len(); n != 0 {
+		t.Errorf("client buffer has %d bytes left, want 0", n)
+	}
+	// Split across segments
+	kex := sshTestHandshake("SSH-2.0-OpenSSH_9.6")
+	s.Feed(true, false, false, 0, kex[:len(kex)-3])
+	if s.serverDone {
+		t.Fatal("key exchange of the server done before SSH_MSG_NEWKEYS")
+	}
+	s.Feed(true, false, false, 0, append(kex[len(kex)-3:], make([]byte, 1200)...))
+	if s.tunnel.chunks[1] != 1 || s.tunnel.bytes[1] != 1200 || s.tunnel.large[1] != 1 {
+		t.Errorf("tunnel chunks = %d, bytes = %d, large = %d, want 1, 1200, 1",
+			s.tunnel.chunks[1], s.tunnel.bytes[1], s.tunnel.large[1])
+	}
+}
+
+func TestSSHTunnel_Score(t *testing.T) {
+	testCases := []struct {
+		name         string
+		chunks       []sshTestChunk
+		minScore     float64
+		maxScore     float64
+		wantRequests int
+	}{
+		{
+			name: "interactive",
+			// Keystrokes & their echoes, with some output now and then
+			chunks: sshTestChunks(20,
+				sshTestChunk{false, 36}, sshTestChunk{true, 36},
+				sshTestChunk{false, 36}, sshTestChunk{true, 36},
+				sshTestChunk{false, 36}, sshTestChunk{true, 500},
+			),
+			maxScore: 0.1,
+		},
+		{
+			name: "upload",
+			// scp of a file, acknowledged with window adjustments
+			chunks: sshTestChunks(20,
+				sshTestChunk{false, 1400}, sshTestChunk{false, 1400},
+				sshTestChunk{false, 1400}, sshTestChunk{true, 52},
+			),
+			minScore: 0.35,
+			maxScore: 0.45,
+		},
+		{
+			name: "socks",
+			// Requests through the tunnel, each answered with a page
+			chunks: sshTestChunks(20,
+				sshTestChunk{false, 400}, sshTestChunk{true, 1400},
+				sshTestChunk{true, 1400}, sshTestChunk{true, 300},
+			),
+			minScore:     0.9,
+			maxScore:     1,
+			wantRequests: 20,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := (&SSHAnalyzer{Tunnel: true, TunnelPackets: len(tc.chunks)}).NewTCP(analyzer.TCPInfo{}, nil)
+			s.Feed(false, false, false, 0, sshTestHandshake("SSH-2.0-OpenSSH_9.6"))
+			s.Feed(true, false, false, 0, sshTestHandshake("SSH-2.0-OpenSSH_9.6"))
+			var u *analyzer.PropUpdate
+			for i, c := range tc.chunks {
+				var done bool
+				u, done = s.Feed(c.rev, false, false, 0, make([]byte, c.size))
+				if last := i == len(tc.chunks)-1; done != last {
+					t.Fatalf("chunk %d: done = %v, want %v", i, done, last)
+				}
+			}
+			tunnel, ok := u.M.Get("tunnel").(analyzer.PropMap)
+			if !ok {
+				t.Fatalf("no tunnel properties in %v", u.M)
+			}
+			score := tunnel["score"].(float64)
+			if score < tc.minScore || score > tc.maxScore {
+				t.Errorf("score = %.2f, want %.2f-%.2f (%v)", score, tc.minScore, tc.maxScore, tunnel)
+			}
+			if got := tunnel["packets"]; got != len(tc.chunks) {
+				t.Errorf("packets = %v, want %d", got, len(tc.chunks))
+			}
+			if got := tunnel["requests"]; got != tc.wantRequests {
+				t.Errorf("requests = %v, want %d", got, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestSSHTunnel_ScoreOnClose(t *testing.T) {
+	s := (&SSHAnalyzer{Tunnel: true}).NewTCP(analyzer.TCPInfo{}, nil)
+	if u := s.Close(false); u != nil {
+		t.Errorf("Close() before any encrypted data = %v, want nil", u)
+	}
+	s = (&SSHAnalyzer{Tunnel: true}).NewTCP(analyzer.TCPInfo{}, nil)
+	s.Feed(false, false, false, 0, sshTestHandshake("SSH-2.0-OpenSSH_9.6"))
+	s.Feed(false, false, false, 0, make([]byte, 36))
+	u := s.Close(false)
+	if u == nil {
+		t.Fatal("Close() = nil, want the tunnel properties")
+	}
+	if got := u.M.Get("tunnel").(analyzer.PropMap)["packets"]; got != 1 {
+		t.Errorf("packets = %v, want 1", got)
+	}
+}
@@ -1,6 +1,10 @@
 package tcp
 
 import (
+	"crypto/x509"
+	"encoding/binary"
+	"time"
+
 	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/analyzer/internal"
 	"github.com/apernet/OpenGFW/analyzer/utils"
@@ -15,7 +19,8 @@ func (a *TLSAnalyzer) Name() string {
 }
 
 func (a *TLSAnalyzer) Limit() int {
-	return 8192
+	// For the certificates before the certificate request of the server
+	return 16384
 }
 
 func (a *TLSAnalyzer) NewTCP(info analyzer.TCPInfo, logger analyzer.Logger) analyzer.TCPStream {
@@ -39,17 +44,37 @@ type tlsStream struct {
 
 	clientHelloLen int
 	serverHelloLen int
+
+	// Bytes of the records of the hellos after them, and the handshake messages after the hellos
+	clientHelloRest int
+	serverHelloRest int
+	reqHS           *utils.ByteBuffer
+	respHS          *utils.ByteBuffer
+
+	clientCertMap analyzer.PropMap
+	cert          *x509.Certificate // Of the server, up to TLS 1.2
+
+	// Other properties than req & resp, merged into the next update
+	updates analyzer.PropMap
 }
 
 func newTLSStream(logger analyzer.Logger) *tlsStream {
-	s := &tlsStream{logger: logger, reqBuf: &utils.ByteBuffer{}, respBuf: &utils.ByteBuffer{}}
+	s := &tlsStream{
+		logger:  logger,
+		reqBuf:  &utils.ByteBuffer{},
+		respBuf: &utils.ByteBuffer{},
+		reqHS:   &utils.ByteBuffer{},
+		respHS:  &utils.ByteBuffer{},
+	}
 	s.reqLSM = utils.NewLinearStateMachine(
 		s.tlsClientHelloPreprocess,
 		s.parseClientHelloData,
+		s.parseClientFlight,
 	)
 	s.respLSM = utils.NewLinearStateMachine(
 		s.tlsServerHelloPreprocess,
 		s.parseServerHelloData,
+		s.parseServerFlight,
 	)
 	return s
 }
@@ -86,6 +111,18 @@ func (s *tlsStream) Feed(rev, start, end bool, skip int, data []byte) (u *analyz
 			s.reqUpdated = false
 		}
 	}
+	if len(s.updates) > 0 {
+		if update == nil {
+			update = &analyzer.PropUpdate{
+				Type: analyzer.PropUpdateMerge,
+				M:    analyzer.PropMap{},
+			}
+		}
+		for k, v := range s.updates {
+			update.M[k] = v
+		}
+		s.updates = nil
+	}
 	return update, cancelled || (s.reqDone && s.respDone)
 }
 
@@ -118,6 +155,7 @@ func (s *tlsStream) tlsClientHelloPreprocess() utils.LSMAction {
 	if s.clientHelloLen < minDataSize {
 		return utils.LSMActionCancel
 	}
+	s.clientHelloRest = max(0, int(header[3])<<8|int(header[4])-4-s.clientHelloLen)
 
 	// TODO: something is missing. See:
 	//   const messageHeaderSize = 4
@@ -162,6 +200,7 @@ func (s *tlsStream) tlsServerHelloPreprocess() utils.LSMAction {
 	if s.serverHelloLen < minDataSize {
 		return utils.LSMActionCancel
 	}
+	s.serverHelloRest = max(0, int(header[3])<<8|int(header[4])-4-s.serverHelloLen)
 
 	// TODO: something is missing. See example:
 	//   const messageHeaderSize = 4
@@ -213,14 +252,230 @@ func (s *tlsStream) parseServerHelloData() utils.LSMAction {
 	} else {
 		s.respUpdated = true
 		s.respMap = m
+		s.updateWeak()
 		return utils.LSMActionNext
 	}
 }
 
+// parseServerFlight looks for a certificate request in the handshake messages of the server after its hello,
+// until the end of its hello (ServerHelloDone) or the handshake being encrypted. See RFC 5246, section 7.4.
+// In TLS 1.3, everything after the server hello is encrypted, see parseClientFlight.
+func (s *tlsStream) parseServerFlight() utils.LSMAction {
+	if s.tls13() {
+		return utils.LSMActionNext
+	}
+	if action, ok := moveHelloRest(s.respBuf, s.respHS, &s.serverHelloRest); !ok {
+		return action
+	}
+	for {
+		for {
+			msgType, body, ok := nextHandshakeMessage(s.respHS)
+			if !ok {
+				break
+			}
+			switch msgType {
+			case internal.TypeCertificate:
+				if cert := internal.ParseTLSCertificateMsgData(body); cert != nil {
+					s.cert = cert
+					s.update("cert", internal.TLSCertToPropMap(cert, time.Now()))
+					s.updateWeak()
+				}
+			case internal.TypeCertificateRequest:
+				version, _ := s.respMap["version"].(uint16)
+				s.clientCertMap = parseCertificateRequest(body, version == internal.VersionTLS12)
+				s.update("client_cert", s.clientCertMap)
+			case internal.TypeServerHelloDone:
+				if s.clientCertMap == nil {
+					s.clientCertMap = analyzer.PropMap{"requested": false}
+					s.update("client_cert", s.clientCertMap)
+				}
+				return utils.LSMActionNext
+			}
+		}
+		recordType, ok := nextRecord(s.respBuf, s.respHS)
+		if !ok {
+			return utils.LSMActionPause
+		}
+		if recordType != internal.RecordTypeHandshake {
+			// e.g. ChangeCipherSpec of an abbreviated handshake, resuming a session
+			return utils.LSMActionNext
+		}
+	}
+}
+
+// parseClientFlight looks for the certificate of the client in its handshake messages after its hello.
+// In TLS 1.3, where they're encrypted, that the server requested a certificate is inferred from the first
+// encrypted record of the client: if it's larger than a Finished message alone, it has a Certificate message
+// (empty if the client has none) and usually a CertificateVerify one.
+func (s *tlsStream) parseClientFlight() utils.LSMAction {
+	if action, ok := moveHelloRest(s.reqBuf, s.reqHS, &s.clientHelloRest); !ok {
+		return action
+	}
+	for {
+		for {
+			msgType, body, ok := nextHandshakeMessage(s.reqHS)
+			if !ok {
+				break
+			}
+			if msgType == internal.TypeCertificate && s.clientCertMap != nil {
+				// Certificate list length, then the length of each certificate
+				certs := 0
+				for p := body[min(3, len(body)):]; len(p) >= 3; certs++ {
+					p = p[min(len(p), 3+(int(p[0])<<16|int(p[1])<<8|int(p[2]))):]
+				}
+				s.clientCertMap["sent"] = certs
+				s.update("client_cert", s.clientCertMap)
+			}
+		}
+		header, ok := s.reqBuf.Get(5, false)
+		if !ok {
+			return utils.LSMActionPause
+		}
+		if header[0] == internal.RecordTypeApplicationData {
+			if s.tls13() {
+				s.inferClientCert(int(binary.BigEndian.Uint16(header[3:5])))
+			}
+			return utils.LSMActionNext
+		}
+		recordType, ok := nextRecord(s.reqBuf, s.reqHS)
+		if !ok {
+			return utils.LSMActionPause
+		}
+		if recordType == internal.RecordTypeChangeCipherSpec && !s.tls13() {
+			// The rest is encrypted
+			return utils.LSMActionNext
+		}
+		// TLS 1.3 has a ChangeCipherSpec for middleboxes, and a second client hello after a HelloRetryRequest
+	}
+}
+
+// inferClientCert sets whether the server requested a certificate in TLS 1.3,
+// from the length of the first encrypted record of the client.
+func (s *tlsStream) inferClientCert(length int) {
+	if s.respMap == nil {
+		// 0-RTT data, sent before the server hello
+		return
+	}
+	cipher, _ := s.respMap["cipher"].(uint16)
+	hash, tag := 32, 16
+	switch cipher {
+	case 0x1302: // TLS_AES_256_GCM_SHA384
+		hash = 48
+	case 0x1305: // TLS_AES_128_CCM_8_SHA256
+		tag = 8
+	}
+	// Finished message (header & verify data), then the content type & the AEAD tag
+	finished := 4 + hash + 1 + tag
+	s.clientCertMap = analyzer.PropMap{
+		"requested": length != finished,
+		"inferred":  true,
+	}
+	s.update("client_cert", s.clientCertMap)
+}
+
+// update sets a property other than req & resp in the next update.
+func (s *tlsStream) update(key string, value interface{}) {
+	if s.updates == nil {
+		s.updates = make(analyzer.PropMap)
+	}
+	s.updates[key] = value
+}
+
+// updateWeak sets the weaknesses of the connection found so far, see internal.TLSWeaknesses.
+func (s *tlsStream) updateWeak() {
+	version, _ := s.respMap["version"].(uint16)
+	if v, ok := s.respMap["supported_versions"].(uint16); ok {
+		version = v
+	}
+	cipher, _ := s.respMap["cipher"].(uint16)
+	s.update("weak", internal.TLSWeaknesses(version, cipher, s.cert, time.Now()))
+}
+
+// tls13 returns whether the server hello selected TLS 1.3.
+func (s *tlsStream) tls13() bool {
+	v, _ := s.respMap["supported_versions"].(uint16)
+	return v == internal.VersionTLS13
+}
+
+// moveHelloRest moves the handshake messages after a hello in its record to hs.
+func moveHelloRest(buf, hs *utils.ByteBuffer, rest *int) (utils.LSMAction, bool) {
+	if *rest == 0 {
+		return utils.LSMActionNext, true
+	}
+	data, ok := buf.Get(*rest, true)
+	if !ok {
+		return utils.LSMActionPause, false
+	}
+	hs.Append(data)
+	*rest = 0
+	return utils.LSMActionNext, true
+}
+
+// nextRecord consumes the next record, appending its data to hs if it's a handshake record,
+// and returns its type, or false if it's not complete yet.
+func nextRecord(buf, hs *utils.ByteBuffer) (byte, bool) {
+	header, ok := buf.Get(5, false)
+	if !ok {
+		return 0, false
+	}
+	data, ok := buf.Get(5+int(binary.BigEndian.Uint16(header[3:5])), true)
+	if !ok {
+		return 0, false
+	}
+	if data[0] == internal.RecordTypeHandshake {
+		hs.Append(data[5:])
+	}
+	return data[0], true
+}
+
+// nextHandshakeMessage consumes the next handshake message, and returns its type & body,
+// or false if it's not complete yet.
+func nextHandshakeMessage(hs *utils.ByteBuffer) (byte, []byte, bool) {
+	header, ok := hs.Get(4, false)
+	if !ok {
+		return 0, nil, false
+	}
+	data, ok := hs.Get(4+(int(header[1])<<16|int(header[2])<<8|int(header[3])), true)
+	if !ok {
+		return 0, nil, false
+	}
+	return data[0], data[4:], true
+}
+
+// parseCertificateRequest parses a CertificateRequest message of TLS 1.2 and before: the types of certificates
+// the server accepts, the signature algorithms (TLS 1.2), and the names of the CAs it accepts certificates of.
+func parseCertificateRequest(body []byte, tls12 bool) analyzer.PropMap {
+	m := analyzer.PropMap{"requested": true}
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return m
+	}
+	var types []uint8
+	types = append(types, body[1:1+int(body[0])]...)
+	m["types"] = types
+	// Signature algorithms (TLS 1.2 only), then the CAs; both prefixed by their length
+	rest := body[1+int(body[0]):]
+	if tls12 && len(rest) >= 2 {
+		rest = rest[min(len(rest), 2+int(binary.BigEndian.Uint16(rest))):]
+	}
+	if len(rest) >= 2 {
+		cas := 0
+		for p := rest[2:]; len(p) >= 2; cas++ {
+			p = p[min(len(p), 2+int(binary.BigEndian.Uint16(p))):]
+		}
+		m["cas"] = cas
+	}
+	return m
+}
+
 func (s *tlsStream) Close(limited bool) *analyzer.PropUpdate {
 	s.reqBuf.Reset()
 	s.respBuf.Reset()
+	s.reqHS.Reset()
+	s.respHS.Reset()
 	s.reqMap = nil
 	s.respMap = nil
+	s.clientCertMap = nil
+	s.cert = nil
+	s.updates = nil
 	return nil
 }
@@ -1,10 +1,17 @@
 package tcp
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/analyzer/internal"
 )
 
 func TestTlsStreamParsing_ClientHello(t *testing.T) {
@@ -29,6 +36,7 @@ func TestTlsStreamParsing_ClientHello(t *testing.T) {
 	want := analyzer.PropMap{
 		"ciphers":     []uint16{52392, 52393, 49199, 49200, 49195, 49196, 49171, 49161, 49172, 49162, 156, 157, 47, 53, 49170, 10},
 		"compression": []uint8{0},
+		"ja3":         "36d715579d31b7f031149c4560b5914f",
 		"random":      []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31},
 		"session":     []uint8{},
 		"sni":         "example.ulfheim.net",
@@ -67,3 +75,130 @@ func TestTlsStreamParsing_ServerHello(t *testing.T) {
 		t.Errorf("%d B parsed = %v, want %v", len(serverHello), got, want)
 	}
 }
+
+func tlsTestRecord(recordType byte, data []byte) []byte {
+	return append([]byte{recordType, 0x03, 0x03, byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func tlsTestHandshake(msgType byte, body []byte) []byte {
+	return append([]byte{msgType, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func TestTlsStreamParsing_ClientCert(t *testing.T) {
+	// Minimal TLS 1.2 hellos: no session ID, a cipher suite, no compression & no extensions
+	clientHello := tlsTestRecord(0x16, tlsTestHandshake(0x01, append(append([]byte{0x03, 0x03}, make([]byte, 32)...),
+		0x00, 0x00, 0x02, 0x00, 0x2f, 0x01, 0x00, 0x00, 0x00)))
+	serverHello := tlsTestRecord(0x16, tlsTestHandshake(0x02, append(append([]byte{0x03, 0x03}, make([]byte, 32)...),
+		0x00, 0xc0, 0x13, 0x00)))
+
+	// TLS 1.2: certificate, certificate request with 2 CAs & server hello done in a record
+	var flight []byte
+	flight = append(flight, tlsTestHandshake(0x0b, []byte{0x00, 0x00, 0x00})...)
+	flight = append(flight, tlsTestHandshake(0x0d, []byte{
+		0x02, 0x01, 0x40, // RSA & ECDSA
+		0x00, 0x02, 0x04, 0x01, // rsa_pkcs1_sha256
+		0x00, 0x0a, 0x00, 0x03, 0x30, 0x01, 0x00, 0x00, 0x03, 0x30, 0x01, 0x01,
+	})...)
+	flight = append(flight, tlsTestHandshake(0x0e, nil)...)
+	s := newTLSStream(nil)
+	s.Feed(false, false, false, 0, clientHello)
+	s.Feed(true, false, false, 0, serverHello)
+	u, _ := s.Feed(true, false, false, 0, tlsTestRecord(0x16, flight))
+	want := analyzer.PropMap{"requested": true, "types": []uint8{1, 64}, "cas": 2}
+	if got := u.M.Get("client_cert"); !reflect.DeepEqual(got, want) {
+		t.Errorf("certificate request parsed = %v, want %v", got, want)
+	}
+	// The client sends a certificate, then ChangeCipherSpec
+	u, done := s.Feed(false, false, false, 0, append(
+		tlsTestRecord(0x16, tlsTestHandshake(0x0b, []byte{0x00, 0x00, 0x06, 0x00, 0x00, 0x03, 0xaa, 0xbb, 0xcc})),
+		tlsTestRecord(0x14, []byte{0x01})...))
+	want["sent"] = 1
+	if got := u.M.Get("client_cert"); !reflect.DeepEqual(got, want) || !done {
+		t.Errorf("client certificate parsed = %v (done %v), want %v", got, done, want)
+	}
+
+	// TLS 1.3: inferred from the size of the first encrypted record of the client
+	serverHello13 := tlsTestRecord(0x16, tlsTestHandshake(0x02, append(append([]byte{0x03, 0x03}, make([]byte, 32)...),
+		0x00, 0x13, 0x01, 0x00, 0x00, 0x06, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04)))
+	for _, tc := range []struct {
+		length    int
+		requested bool
+	}{
+		{53, false}, // Finished alone
+		{1200, true},
+	} {
+		s := newTLSStream(nil)
+		s.Feed(false, false, false, 0, clientHello)
+		s.Feed(true, false, false, 0, serverHello13)
+		s.Feed(false, false, false, 0, tlsTestRecord(0x14, []byte{0x01}))
+		u, _ := s.Feed(false, false, false, 0, tlsTestRecord(0x17, make([]byte, tc.length)))
+		want := analyzer.PropMap{"requested": tc.requested, "inferred": true}
+		if u == nil || !reflect.DeepEqual(u.M.Get("client_cert"), want) {
+			t.Errorf("%d B record: got %v, want %v", tc.length, u, want)
+		}
+	}
+}
+
+func TestTlsStreamParsing_Weak(t *testing.T) {
+	// An expired certificate with a 1024-bit RSA key
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "legacy.example.com"},
+		DNSNames:     []string{"legacy.example.com"},
+		NotBefore:    time.Now().AddDate(-2, 0, 0),
+		NotAfter:     time.Now().AddDate(-1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := append([]byte{byte(len(der) >> 16), byte(len(der) >> 8), byte(len(der))}, der...)
+	certs = append([]byte{byte(len(certs) >> 16), byte(len(certs) >> 8), byte(len(certs))}, certs...)
+
+	// TLS 1.0 with TLS_RSA_EXPORT_WITH_RC4_40_MD5
+	serverHello := tlsTestRecord(0x16, tlsTestHandshake(0x02, append(append([]byte{0x03, 0x01}, make([]byte, 32)...),
+		0x00, 0x00, 0x03, 0x00)))
+	s := newTLSStream(nil)
+	u, _ := s.Feed(true, false, false, 0, serverHello)
+	if got, want := u.M.Get("weak"), []string{"deprecated_version", "export_cipher"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("weak after server hello = %v, want %v", got, want)
+	}
+	u, _ = s.Feed(true, false, false, 0, tlsTestRecord(0x16, tlsTestHandshake(0x0b, certs)))
+	want := []string{"deprecated_version", "export_cipher", "expired_cert", "short_rsa_key"}
+	if got := u.M.Get("weak"); !reflect.DeepEqual(got, want) {
+		t.Errorf("weak after certificate = %v, want %v", got, want)
+	}
+	cert, _ := u.M["cert"].(analyzer.PropMap)
+	if cert["subject"] != "legacy.example.com" || cert["expired"] != true || cert["key"] != "rsa" || cert["key_bits"] != 1024 {
+		t.Errorf("cert = %v", cert)
+	}
+}
+
+func TestTlsCertValidity(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		notBefore, notAfter time.Time
+		want                bool
+	}{
+		"valid":         {now.AddDate(0, -1, 0), now.AddDate(0, 1, 0), false},
+		"expired":       {now.AddDate(-1, 0, 0), now.Add(-time.Second), true},
+		"not valid yet": {now.Add(time.Second), now.AddDate(1, 0, 0), true},
+		"boundaries":    {now, now, false},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cert := &x509.Certificate{NotBefore: tc.notBefore, NotAfter: tc.notAfter, SignatureAlgorithm: x509.SHA256WithRSA}
+			if got := internal.TLSCertToPropMap(cert, now)["expired"]; got != tc.want {
+				t.Errorf("expired = %v, want %v", got, tc.want)
+			}
+			weak := internal.TLSWeaknesses(internal.VersionTLS12, 0xc02f, cert, now)
+			if got := len(weak) == 1 && weak[0] == "expired_cert"; got != tc.want {
+				t.Errorf("weak = %v, want expired_cert %v", weak, tc.want)
+			}
+		})
+	}
+}
@@ -42,6 +42,7 @@ func TestQuicStreamParsing_ClientHello(t *testing.T) {
 		"alpn":               []string{"ping/1.0"},
 		"ciphers":            []uint16{4865, 4866, 4867},
 		"compression":        []uint8{0},
+		"ja3":                "f75253b5e2b4dcb3fdae9b78ce8c6e49",
 		"random":             []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31},
 		"session":            []uint8{},
 		"sni":                "example.ulfheim.net",
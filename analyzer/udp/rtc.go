@@ -0,0 +1,212 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+var (
+	_ analyzer.UDPAnalyzer = (*RTCAnalyzer)(nil)
+	_ analyzer.UDPStream   = (*rtcStream)(nil)
+)
+
+const (
+	rtcMaxPackets = 16
+
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112a442
+
+	stunAttrSoftware = 0x8022
+
+	discordIPDiscoverySize = 74
+
+	// The first byte of the packets between Zoom clients & its servers (SFU encapsulation), which add 8 bytes.
+	zoomSFUType = 0x05
+	zoomSFUSize = 8
+)
+
+// The attributes of the Microsoft extensions of STUN & TURN (MS-TURN & MS-ICE2), used by Teams & Skype for Business.
+var stunMicrosoftAttrs = map[uint16]bool{
+	0x8008: true, // MS-Version
+	0x8050: true, // MS-Sequence-Number
+	0x8054: true, // Candidate-Identifier
+	0x8055: true, // MS-Service-Quality
+	0x8070: true, // MS-Implementation-Version
+}
+
+// The media types of Zoom, after the SFU encapsulation, and the offset of the RTP (or RTCP) header from them.
+var zoomMediaTypes = map[byte]struct {
+	Name   string
+	Offset int
+}{
+	0x0f: {"audio", 19},
+	0x10: {"video", 24},
+	0x0d: {"screen_share", 27},
+	0x21: {"rtcp", 16},
+	0x22: {"rtcp", 16},
+	0x23: {"rtcp", 16},
+}
+
+var stunClasses = [...]string{"request", "indication", "success", "error"}
+
+// RTCAnalyzer recognizes the realtime media of voice & video calls: STUN (& TURN), which sets up their connections,
+// and RTP, which carries their media, and the apps whose variants of them are known: Teams (Microsoft's STUN
+// attributes), Discord (the IP discovery of its voice connections) and Zoom (its encapsulation of RTP).
+// The app property is set when one of them is found.
+type RTCAnalyzer struct{}
+
+func (a *RTCAnalyzer) Name() string {
+	return "rtc"
+}
+
+func (a *RTCAnalyzer) Limit() int {
+	return 0
+}
+
+func (a *RTCAnalyzer) NewUDP(info analyzer.UDPInfo, logger analyzer.Logger) analyzer.UDPStream {
+	return &rtcStream{}
+}
+
+type rtcStream struct {
+	packets int
+	ssrc    [2]uint32 // Of the last RTP packet in each direction
+	seen    [2]bool   // Whether there was one
+	rtp     bool      // Found, the SSRC of RTP packets in a direction being the same
+}
+
+func (s *rtcStream) Feed(rev bool, data []byte) (u *analyzer.PropUpdate, done bool) {
+	s.packets++
+	m := analyzer.PropMap{}
+	if stun := parseSTUN(data); stun != nil {
+		m["stun"] = stun
+		if microsoft, _ := stun["microsoft"].(bool); microsoft {
+			m["app"] = "teams"
+		}
+	} else if discord := parseDiscordIPDiscovery(data); discord != nil {
+		m["discord"] = discord
+		m["app"] = "discord"
+	} else if zoom := parseZoomMedia(data); zoom != nil {
+		m["zoom"] = zoom
+		m["app"] = "zoom"
+	} else if rtp := s.parseRTP(rev, data); rtp != nil {
+		m["rtp"] = rtp
+	}
+	_, found := m["app"]
+	done = found || s.packets >= rtcMaxPackets
+	if len(m) == 0 {
+		return nil, done
+	}
+	return &analyzer.PropUpdate{Type: analyzer.PropUpdateMerge, M: m}, done
+}
+
+func (s *rtcStream) Close(limited bool) *analyzer.PropUpdate {
+	return nil
+}
+
+// parseSTUN parses a STUN message (RFC 5389), returning nil if it isn't one.
+func parseSTUN(data []byte) analyzer.PropMap {
+	if len(data) < stunHeaderSize || data[0]&0xc0 != 0 ||
+		binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length%4 != 0 || stunHeaderSize+length != len(data) {
+		return nil
+	}
+	t := binary.BigEndian.Uint16(data[0:2])
+	m := analyzer.PropMap{
+		"method": int(t&0xf | (t>>1)&0x70 | (t>>2)&0xf80),
+		"class":  stunClasses[(t>>4)&1|(t>>7)&2],
+	}
+	microsoft := false
+	for attrs := data[stunHeaderSize:]; len(attrs) >= 4; {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return nil
+		}
+		value := attrs[4 : 4+attrLen]
+		if attrType == stunAttrSoftware {
+			m["software"] = string(value)
+		}
+		microsoft = microsoft || stunMicrosoftAttrs[attrType]
+		// Padded to 4 bytes
+		attrs = attrs[min(len(attrs), 4+(attrLen+3)&^3):]
+	}
+	m["microsoft"] = microsoft
+	return m
+}
+
+// parseDiscordIPDiscovery parses the IP discovery of Discord voice connections, returning nil if it isn't one:
+// a request (1) or response (2) of 74 bytes, with the SSRC of the client and the IP & port it is seen from
+// (in the response).
+func parseDiscordIPDiscovery(data []byte) analyzer.PropMap {
+	if len(data) != discordIPDiscoverySize || binary.BigEndian.Uint16(data[2:4]) != discordIPDiscoverySize-4 {
+		return nil
+	}
+	t := binary.BigEndian.Uint16(data[0:2])
+	if t != 1 && t != 2 {
+		return nil
+	}
+	m := analyzer.PropMap{
+		"response": t == 2,
+		"ssrc":     binary.BigEndian.Uint32(data[4:8]),
+	}
+	if t == 2 {
+		address, _, _ := bytes.Cut(data[8:72], []byte{0})
+		if ip := net.ParseIP(string(address)); ip != nil {
+			m["ip"] = ip.String()
+			m["port"] = int(binary.BigEndian.Uint16(data[72:74]))
+		}
+	}
+	return m
+}
+
+// parseZoomMedia parses the media packets between Zoom clients & its servers, returning nil if it isn't one:
+// the SFU encapsulation, the media encapsulation starting with its type, then RTP or RTCP.
+// The packets of calls between two clients directly have no SFU encapsulation and aren't recognized.
+func parseZoomMedia(data []byte) analyzer.PropMap {
+	if len(data) < zoomSFUSize+1 || data[0] != zoomSFUType {
+		return nil
+	}
+	media, ok := zoomMediaTypes[data[zoomSFUSize]]
+	if !ok {
+		return nil
+	}
+	rtp := zoomSFUSize + media.Offset
+	if len(data) < rtp+8 || data[rtp]>>6 != 2 {
+		return nil
+	}
+	return analyzer.PropMap{"media": media.Name}
+}
+
+// parseRTP parses an RTP packet (RFC 3550), returning nil if it isn't one, or its SSRC isn't that of the previous
+// packet in the same direction. Being of version 2 is too likely for random data, unlike a constant SSRC.
+func (s *rtcStream) parseRTP(rev bool, data []byte) analyzer.PropMap {
+	if len(data) < 12 || data[0]>>6 != 2 {
+		return nil
+	}
+	pt := data[1] & 0x7f
+	if pt >= 72 && pt <= 79 {
+		// RTCP (200 to 207 without the marker bit) multiplexed with RTP
+		return nil
+	}
+	dir := 0
+	if rev {
+		dir = 1
+	}
+	ssrc := binary.BigEndian.Uint32(data[8:12])
+	matched := s.seen[dir] && ssrc == s.ssrc[dir]
+	s.ssrc[dir], s.seen[dir] = ssrc, true
+	if !matched || s.rtp {
+		return nil
+	}
+	s.rtp = true
+	return analyzer.PropMap{
+		"payload_type": int(pt),
+		"ssrc":         ssrc,
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+const (
+	accountingDefaultInterval = time.Minute
+	// accountingOtherApp is the application of the streams no analyzer has classified.
+	accountingOtherApp = "other"
+)
+
+var _ engine.Accounting = (*usageAccounting)(nil)
+
+// usageAccounting counts the traffic of the streams per client (source IP), and per application
+// (the protocol detected by the analyzers) if Apps is set.
+type usageAccounting struct {
+	Usage *builtins.Usage
+	Apps  bool
+}
+
+func (a *usageAccounting) Account(info ruleset.StreamInfo, bytes uint64) {
+	var app string
+	if a.Apps {
+		if app = eveAppProto(info.Props); app == "" {
+			app = accountingOtherApp
+		}
+	}
+	a.Usage.Add(info.SrcIP.String(), app, bytes, time.Now())
+}
+
+// usageStore keeps the counters of a Usage in a file (if set) across restarts: they're loaded at start,
+// and saved every interval while they change, and at shutdown. Expired days are removed daily.
+type usageStore struct {
+	Usage    *builtins.Usage
+	File     string // Optional
+	Interval time.Duration
+
+	mutex   sync.Mutex
+	lastErr error
+}
+
+// Load loads the counters from the file, if it exists.
+func (s *usageStore) Load() error {
+	if s.File == "" {
+		return nil
+	}
+	f, err := os.Open(s.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.Usage.Load(f); err != nil {
+		return fmt.Errorf("failed to load %s: %w", s.File, err)
+	}
+	s.Usage.Expire(time.Now())
+	return nil
+}
+
+// Save atomically replaces the file with the counters.
+func (s *usageStore) Save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.File), filepath.Base(s.File)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = s.Usage.Save(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.File)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Run saves the counters every interval until the context is cancelled.
+func (s *usageStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	lastExpire := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Sub(lastExpire) >= 24*time.Hour {
+				s.Usage.Expire(now)
+				lastExpire = now
+			}
+			if s.File != "" && s.Usage.Dirty() {
+				s.Flush()
+			}
+		}
+	}
+}
+
+// Flush saves the counters, logging the error if it's a new one.
+func (s *usageStore) Flush() {
+	if s.File == "" {
+		return
+	}
+	err := s.Save()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil && (s.lastErr == nil || s.lastErr.Error() != err.Error()) {
+		logger.Error("failed to save usage counters", zap.String("file", s.File), zap.Error(err))
+	}
+	s.lastErr = err
+}
+
+// Check returns the error of the latest save, for readiness: the counters may not survive a restart.
+func (s *usageStore) Check() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lastErr != nil {
+		return fmt.Errorf("failed to save %s: %w", s.File, s.lastErr)
+	}
+	return nil
+}
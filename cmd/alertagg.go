@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"sync"
+	"time"
+)
+
+// alertAggregator groups identical alerts (same rule & action, same source & destination address)
+// within a window, to keep the event log readable during scans and floods. The first alert of a group
+// is sent right away; the following ones are only counted, and sent as a single alert with their count
+// when the window ends. A nil *alertAggregator lets every alert through.
+type alertAggregator struct {
+	window time.Duration
+	send   func(r *eveRecord) // Sends an aggregated alert
+
+	mutex  sync.Mutex
+	groups map[alertGroupKey]*alertGroup
+}
+
+type alertGroupKey struct {
+	Rule     string
+	Category string
+	SrcIP    string
+	DestIP   string
+}
+
+type alertGroup struct {
+	Count int       // Alerts held back since the first one
+	First time.Time // Time of the first alert held back
+	Last  eveRecord // Latest alert held back, sent with the count
+}
+
+func newAlertAggregator(window time.Duration, send func(r *eveRecord)) *alertAggregator {
+	return &alertAggregator{
+		window: window,
+		send:   send,
+		groups: make(map[alertGroupKey]*alertGroup),
+	}
+}
+
+// Add records an alert, and returns whether it should be sent now,
+// which is only the case for the first alert of its group.
+func (a *alertAggregator) Add(r *eveRecord, now time.Time) bool {
+	if a == nil {
+		return true
+	}
+	key := alertGroupKey{
+		Rule:     r.Alert.Signature,
+		Category: r.Alert.Category,
+		SrcIP:    r.SrcIP,
+		DestIP:   r.DestIP,
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	g := a.groups[key]
+	if g == nil {
+		a.groups[key] = &alertGroup{}
+		time.AfterFunc(a.window, func() { a.flush(key) })
+		return true
+	}
+	if g.Count == 0 {
+		g.First = now
+	}
+	g.Count++
+	g.Last = *r
+	return false
+}
+
+// flush ends the window of a group, sending its aggregated alert if any alert has been held back.
+func (a *alertAggregator) flush(key alertGroupKey) {
+	a.mutex.Lock()
+	g := a.groups[key]
+	delete(a.groups, key)
+	a.mutex.Unlock()
+	if g != nil && g.Count > 0 {
+		a.send(g.aggregated())
+	}
+}
+
+// Close sends the aggregated alerts of all the groups, without waiting for their windows to end.
+func (a *alertAggregator) Close() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	groups := a.groups
+	a.groups = make(map[alertGroupKey]*alertGroup)
+	a.mutex.Unlock()
+	for _, g := range groups {
+		if g.Count > 0 {
+			a.send(g.aggregated())
+		}
+	}
+}
+
+func (g *alertGroup) aggregated() *eveRecord {
+	r := g.Last
+	alert := *r.Alert
+	alert.Count = g.Count
+	alert.FirstTimestamp = g.First.Format(eveTimeFormat)
+	r.Alert = &alert
+	return &r
+}
@@ -0,0 +1,1025 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	apiStreamsTimeout    = 10 * time.Second
+	apiPacketRingTimeout = 30 * time.Second
+)
+
+// apiServer is the HTTP management API for controlling a running instance.
+// Clients are authenticated with a bearer token and/or client certificates, if configured.
+type apiServer struct {
+	Sets     *builtins.SetStore
+	Rulesets *rulesetManager
+	Engine   engine.Engine
+	Token    string      // Optional
+	TLS      *tls.Config // Optional, with ClientCAs for mTLS
+	Alerts   *eventRing  // Recent alerts, only if the dashboard is enabled
+	Health   *healthChecker
+	Blocked  *blockFeed
+	Debug    *debugFilter
+	Audit    *auditLog      // Optional
+	Sinkhole *sinkhole      // Optional
+	Portal   *captivePortal // Optional
+	Usage    *builtins.Usage
+}
+
+type apiSetInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+type apiSetEntriesRequest struct {
+	Entries []string `json:"entries"`
+	TTL     string   `json:"ttl,omitempty"` // Only for adding, e.g. "1h". Empty means never expire.
+}
+
+type apiSetEntriesResponse struct {
+	Count int `json:"count"` // Number of entries added or removed
+}
+
+type apiRulesetVersion struct {
+	ID      int       `json:"id"`
+	Hash    string    `json:"hash"`
+	Time    time.Time `json:"time"`
+	Current bool      `json:"current"`
+}
+
+// apiSimulation is the result of POST /ruleset/simulate, whose request is a test case
+// in the format of "opengfw test --cases".
+type apiSimulation struct {
+	Selector string              `json:"selector,omitempty"`
+	Rules    []apiRuleEvaluation `json:"rules"`
+	Action   string              `json:"action"`
+	Rule     string              `json:"rule,omitempty"` // Empty if no rule matched
+}
+
+type apiRuleEvaluation struct {
+	Name     string `json:"name"`
+	Group    string `json:"group,omitempty"`
+	Inactive bool   `json:"inactive,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Matched  bool   `json:"matched"`
+	Action   string `json:"action,omitempty"`
+	DryRun   bool   `json:"dryRun,omitempty"`
+	Jump     string `json:"jump,omitempty"`
+	Return   bool   `json:"return,omitempty"`
+	Decisive bool   `json:"decisive,omitempty"`
+}
+
+func newAPISimulation(sim ruleset.Simulation) apiSimulation {
+	s := apiSimulation{
+		Selector: sim.Selector,
+		Rules:    make([]apiRuleEvaluation, len(sim.Rules)),
+		Action:   sim.Result.Action.String(),
+		Rule:     sim.Result.RuleName,
+	}
+	for i, ev := range sim.Rules {
+		s.Rules[i] = apiRuleEvaluation(ev)
+	}
+	return s
+}
+
+type apiRollbackRequest struct {
+	Version int `json:"version"` // 0 = the version before the current one
+}
+
+type apiStream struct {
+	ID           int64                    `json:"id"`
+	UUID         string                   `json:"uuid"`
+	WorkerID     int                      `json:"workerID"`
+	Protocol     string                   `json:"protocol"`
+	AppProto     string                   `json:"appProto,omitempty"`
+	Src          string                   `json:"src"`
+	Dst          string                   `json:"dst"`
+	InInterface  string                   `json:"inInterface,omitempty"`
+	OutInterface string                   `json:"outInterface,omitempty"`
+	Direction    string                   `json:"direction,omitempty"`
+	Asymmetric   bool                     `json:"asymmetric,omitempty"`
+	IO           string                   `json:"io,omitempty"`
+	StartTime    time.Time                `json:"startTime"`
+	SrcPackets   uint64                   `json:"srcPackets"`
+	DstPackets   uint64                   `json:"dstPackets"`
+	SrcBytes     uint64                   `json:"srcBytes"`
+	DstBytes     uint64                   `json:"dstBytes"`
+	Verdict      string                   `json:"verdict"`
+	Mark         uint32                   `json:"mark,omitempty"`
+	Rule         string                   `json:"rule,omitempty"`
+	Analyzers    []string                 `json:"analyzers"`
+	Props        analyzer.CombinedPropMap `json:"props"`
+}
+
+type apiStreamsResponse struct {
+	Streams []apiStream `json:"streams"` // Oldest first
+	Total   int         `json:"total"`   // Number of streams matching the filter, including those over the limit
+}
+
+type apiIDSOnly struct {
+	Enabled bool `json:"enabled"`
+}
+
+type apiPacketRingDump struct {
+	Files []string `json:"files"` // One per worker
+}
+
+type apiAnalyzerStats struct {
+	Name         string  `json:"name"`
+	Streams      uint64  `json:"streams"`
+	Bytes        uint64  `json:"bytes"`
+	Time         float64 `json:"time"` // Seconds
+	Classified   uint64  `json:"classified"`
+	Unclassified uint64  `json:"unclassified"`
+	Errors       uint64  `json:"errors"`
+}
+
+type apiLogLevel struct {
+	Level    string `json:"level"`
+	Previous string `json:"previous,omitempty"` // Only in the response of a change
+}
+
+type apiDebugTargets struct {
+	IPs       []string   `json:"ips,omitempty"` // IPs or CIDRs, matching the source or destination
+	Streams   []int64    `json:"streams,omitempty"`
+	Analyzers []string   `json:"analyzers,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`     // Only in requests, e.g. "10m". Empty means never expire.
+	Expires   *time.Time `json:"expires,omitempty"` // Only in responses
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// ListenAndServe serves the API on addr until the context is cancelled.
+func (s *apiServer) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           s.handler(),
+		TLSConfig:         s.TLS,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	if s.TLS != nil {
+		// The certificates are already in the TLS config
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sets", s.handleSets)
+	mux.HandleFunc("/sets/", s.handleSet)
+	mux.HandleFunc("/ruleset/versions", s.handleRulesetVersions)
+	mux.HandleFunc("/ruleset/rollback", s.handleRulesetRollback)
+	mux.HandleFunc("/ruleset/reload", s.handleRulesetReload)
+	mux.HandleFunc("/ruleset/stats", s.handleRulesetStats)
+	mux.HandleFunc("/ruleset/simulate", s.handleRulesetSimulate)
+	mux.HandleFunc("/streams", s.handleStreams)
+	mux.HandleFunc("/analyzers/stats", s.handleAnalyzerStats)
+	mux.HandleFunc("/ids-only", s.handleIDSOnly)
+	mux.HandleFunc("/packet-ring/dump", s.handlePacketRingDump)
+	mux.HandleFunc("/blocked", s.handleBlocked)
+	mux.HandleFunc("/log-level", s.handleLogLevel)
+	mux.HandleFunc("/debug-targets", s.handleDebugTargets)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { s.handleHealth(w, r, true) })
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) { s.handleHealth(w, r, true) })
+	if s.Alerts != nil {
+		mux.HandleFunc("/alerts", s.handleAlerts)
+	}
+	if s.Usage != nil {
+		mux.HandleFunc("/usage", s.handleUsage)
+	}
+	if s.Sinkhole != nil {
+		mux.HandleFunc("/sinkhole", s.handleSinkhole)
+	}
+	if s.Portal != nil {
+		mux.HandleFunc("/portal/clients", s.handlePortalClients)
+	}
+	if s.Token == "" && s.Alerts == nil {
+		return mux
+	}
+	var dashboard http.Handler
+	if s.Alerts != nil {
+		dashboard = dashboardHandler()
+	}
+	token := []byte("Bearer " + s.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dashboard != nil && (r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, dashboardPath)) {
+			// Static files, the dashboard asks for the token itself
+			dashboard.ServeHTTP(w, r)
+			return
+		}
+		authorized := s.Token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) == 1
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			// Open to probes, which often can't authenticate, but without the details
+			s.handleHealth(w, r, authorized)
+			return
+		}
+		if !authorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// GET /sets
+func (s *apiServer) handleSets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	infos := []apiSetInfo{}
+	for _, set := range s.Sets.Sets() {
+		infos = append(infos, apiSetInfo{
+			Name: set.Name(),
+			Type: set.Type().String(),
+			Size: set.Len(),
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, infos)
+}
+
+// GET /sets/{name} lists the entries,
+// POST /sets/{name} adds entries, DELETE /sets/{name} removes entries.
+func (s *apiServer) handleSet(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/sets/")
+	set := s.Sets.Get(name)
+	if set == nil {
+		writeAPIError(w, http.StatusNotFound, "set not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		entries := set.List()
+		if entries == nil {
+			entries = []builtins.SetEntry{}
+		}
+		writeAPIJSON(w, http.StatusOK, entries)
+	case http.MethodPost, http.MethodDelete:
+		var req apiSetEntriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if r.Method == http.MethodPost {
+			var ttl time.Duration
+			if req.TTL != "" {
+				var err error
+				ttl, err = time.ParseDuration(req.TTL)
+				if err != nil || ttl < 0 {
+					writeAPIError(w, http.StatusBadRequest, "invalid ttl")
+					return
+				}
+			}
+			record := auditRecord{
+				Who:     apiClientName(r),
+				Action:  "set.add",
+				Target:  name,
+				Summary: fmt.Sprintf("%d entries added", len(req.Entries)),
+				Details: newAuditSetDetails(req.Entries, ttl),
+			}
+			if err := set.Add(req.Entries, ttl); err != nil {
+				record.Summary, record.Error = "failed, set unchanged", err.Error()
+				s.Audit.Record(record)
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			s.Audit.Record(record)
+			logger.Info("set entries added", zap.String("set", name), zap.Strings("entries", req.Entries))
+			writeAPIJSON(w, http.StatusOK, apiSetEntriesResponse{Count: len(req.Entries)})
+		} else {
+			record := auditRecord{
+				Who:     apiClientName(r),
+				Action:  "set.remove",
+				Target:  name,
+				Details: newAuditSetDetails(req.Entries, 0),
+			}
+			n, err := set.Remove(req.Entries)
+			if err != nil {
+				record.Summary, record.Error = "failed, set unchanged", err.Error()
+				s.Audit.Record(record)
+				writeAPIError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			record.Summary = fmt.Sprintf("%d entries removed", n)
+			s.Audit.Record(record)
+			logger.Info("set entries removed", zap.String("set", name), zap.Strings("entries", req.Entries))
+			writeAPIJSON(w, http.StatusOK, apiSetEntriesResponse{Count: n})
+		}
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET /ruleset/versions
+func (s *apiServer) handleRulesetVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	versions, current := s.Rulesets.Versions()
+	infos := []apiRulesetVersion{}
+	for _, v := range versions {
+		infos = append(infos, apiRulesetVersion{
+			ID:      v.ID,
+			Hash:    v.Hash,
+			Time:    v.Time,
+			Current: v.ID == current,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, infos)
+}
+
+// POST /ruleset/simulate
+func (s *apiServer) handleRulesetSimulate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// YAML, which JSON is a subset of, for the props & durations of test cases
+	var c testCase
+	if err := yaml.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	info, err := c.streamInfo(0)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newAPISimulation(ruleset.Simulate(s.Rulesets.Current(), info)))
+}
+
+// POST /ruleset/rollback
+func (s *apiServer) handleRulesetRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req apiRollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	v, err := s.Rulesets.Rollback(req.Version, apiClientName(r))
+	if errors.Is(err, errRulesetVersionNotFound) {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	logger.Info("ruleset rolled back", zap.Int("version", v.ID), zap.String("hash", v.Hash))
+	writeAPIJSON(w, http.StatusOK, apiRulesetVersion{
+		ID:      v.ID,
+		Hash:    v.Hash,
+		Time:    v.Time,
+		Current: true,
+	})
+}
+
+// streamFilter selects streams by their addresses & protocol. The zero value matches everything.
+type streamFilter struct {
+	Nets     []*net.IPNet
+	Ports    map[uint16]bool
+	Protocol string
+}
+
+func parseStreamFilterNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q", s)
+	}
+	return n, nil
+}
+
+// Match returns whether a stream matches the filter.
+func (f *streamFilter) Match(srcIP, dstIP net.IP, srcPort, dstPort uint16, protocol string) bool {
+	if f.Protocol != "" && !strings.EqualFold(f.Protocol, protocol) {
+		return false
+	}
+	if len(f.Ports) > 0 && !f.Ports[srcPort] && !f.Ports[dstPort] {
+		return false
+	}
+	if len(f.Nets) == 0 {
+		return true
+	}
+	for _, n := range f.Nets {
+		if n.Contains(srcIP) || n.Contains(dstIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverTLSConfig loads the certificate of a server, and the CA that client certificates must be
+// signed by if clientCAFile is set.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		caPEM, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// POST /ruleset/reload
+func (s *apiServer) handleRulesetReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	logger.Info("reloading rules")
+	if err := s.Rulesets.Reload(false, apiClientName(r)); err != nil {
+		logger.Error("failed to reload rules, using old rules", zap.Error(err))
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	logger.Info("rules reloaded")
+	versions, current := s.Rulesets.Versions()
+	for _, v := range versions {
+		if v.ID == current {
+			writeAPIJSON(w, http.StatusOK, apiRulesetVersion{
+				ID:      v.ID,
+				Hash:    v.Hash,
+				Time:    v.Time,
+				Current: true,
+			})
+			return
+		}
+	}
+	writeAPIError(w, http.StatusInternalServerError, "current version not found")
+}
+
+// GET /ruleset/stats
+func (s *apiServer) handleRulesetStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	stats := s.Rulesets.Current().Stats()
+	if stats == nil {
+		stats = []ruleset.RuleStatsSnapshot{}
+	}
+	writeAPIJSON(w, http.StatusOK, stats)
+}
+
+// GET /analyzers/stats
+func (s *apiServer) handleAnalyzerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	resp := []apiAnalyzerStats{}
+	for _, st := range s.Engine.AnalyzerStats() {
+		resp = append(resp, apiAnalyzerStats{
+			Name:         st.Name,
+			Streams:      st.Streams,
+			Bytes:        st.Bytes,
+			Time:         st.Time.Seconds(),
+			Classified:   st.Classified,
+			Unclassified: st.Unclassified,
+			Errors:       st.Errors,
+		})
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+// GET /blocked?format=json|plain|dnsmasq|nft&type=ip|domain lists the recently blocked IPs & domains.
+func (s *apiServer) handleBlocked(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := blockFeedFormats[format]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, "invalid format")
+		return
+	}
+	typ := r.URL.Query().Get("type")
+	if typ != "" && typ != blockFeedTypeIP && typ != blockFeedTypeDomain {
+		writeAPIError(w, http.StatusBadRequest, "invalid type")
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.Blocked.Write(&buf, format, typ); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// GET /usage?client=<ip>&period=day|week|month returns the bytes counted per client & label (application,
+// or per client quota rule) over the current period (default day), for a single client if given.
+func (s *apiServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	client := q.Get("client")
+	if client != "" {
+		ip := net.ParseIP(client)
+		if ip == nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid client")
+			return
+		}
+		client = ip.String()
+	}
+	period := builtins.UsagePeriodDay
+	if p := q.Get("period"); p != "" {
+		var err error
+		if period, err = builtins.ParseUsagePeriod(p); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, s.Usage.Report(client, period, time.Now()))
+}
+
+// GET /sinkhole?client=<ip> returns the queries sinkholed per client, for a single client if given.
+func (s *apiServer) handleSinkhole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	client := r.URL.Query().Get("client")
+	if client != "" {
+		ip := net.ParseIP(client)
+		if ip == nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid client")
+			return
+		}
+		client = ip.String()
+	}
+	writeAPIJSON(w, http.StatusOK, s.Sinkhole.Stats(client))
+}
+
+// GET /portal/clients lists the clients with access through the captive portal.
+// POST /portal/clients?client=<ip> grants access to a client, DELETE revokes it.
+func (s *apiServer) handlePortalClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeAPIJSON(w, http.StatusOK, s.Portal.List())
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ip := net.ParseIP(r.URL.Query().Get("client"))
+	if ip == nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid client")
+		return
+	}
+	if r.Method == http.MethodPost {
+		c, err := s.Portal.Accept(ip.String())
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, c)
+		return
+	}
+	found, err := s.Portal.Revoke(ip.String())
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		writeAPIError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /healthz (liveness) & GET /readyz (readiness), 503 if a required check fails.
+// Without details, only the status is returned.
+func (s *apiServer) handleHealth(w http.ResponseWriter, r *http.Request, details bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	var report *healthReport
+	if r.URL.Path == "/healthz" {
+		report = s.Health.Liveness(ctx)
+	} else {
+		report = s.Health.Readiness(ctx)
+	}
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	if !details {
+		report.Checks = nil
+	}
+	writeAPIJSON(w, status, report)
+}
+
+// GET /streams?cidr=10.0.0.0/8&port=443&protocol=tcp&limit=100
+// cidr & port can be repeated, a stream matches if it has any of them.
+func (s *apiServer) handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	var filter streamFilter
+	for _, c := range q["cidr"] {
+		n, err := parseStreamFilterNet(c)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter.Nets = append(filter.Nets, n)
+	}
+	for _, p := range q["port"] {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid port")
+			return
+		}
+		if filter.Ports == nil {
+			filter.Ports = make(map[uint16]bool)
+		}
+		filter.Ports[uint16(port)] = true
+	}
+	filter.Protocol = q.Get("protocol")
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), apiStreamsTimeout)
+	defer cancel()
+	entries, err := s.Engine.Streams(ctx)
+	if err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	resp := apiStreamsResponse{Streams: []apiStream{}}
+	for _, e := range entries {
+		info := e.Info
+		if !filter.Match(info.SrcIP, info.DstIP, info.SrcPort, info.DstPort, info.Protocol.String()) {
+			continue
+		}
+		analyzers := e.Analyzers
+		if analyzers == nil {
+			analyzers = []string{}
+		}
+		resp.Streams = append(resp.Streams, apiStream{
+			ID:           info.ID,
+			UUID:         info.UUID,
+			WorkerID:     e.WorkerID,
+			Protocol:     info.Protocol.String(),
+			AppProto:     eveAppProto(info.Props),
+			Src:          info.SrcString(),
+			Dst:          info.DstString(),
+			InInterface:  info.InInterface,
+			OutInterface: info.OutInterface,
+			Direction:    string(info.Direction),
+			Asymmetric:   info.Asymmetric,
+			IO:           info.IO,
+			StartTime:    info.Counters.StartTime,
+			SrcPackets:   info.Counters.SrcPackets,
+			DstPackets:   info.Counters.DstPackets,
+			SrcBytes:     info.Counters.SrcBytes,
+			DstBytes:     info.Counters.DstBytes,
+			Verdict:      otlpVerdictNames[e.Verdict],
+			Mark:         e.Mark,
+			Rule:         e.Rule,
+			Analyzers:    analyzers,
+			Props:        info.Props,
+		})
+	}
+	sort.Slice(resp.Streams, func(i, j int) bool {
+		return resp.Streams[i].StartTime.Before(resp.Streams[j].StartTime)
+	})
+	resp.Total = len(resp.Streams)
+	if limit > 0 && len(resp.Streams) > limit {
+		resp.Streams = resp.Streams[:limit]
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+// GET /ids-only, PUT /ids-only to enable or disable IDS-only mode.
+func (s *apiServer) handleIDSOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIJSON(w, http.StatusOK, apiIDSOnly{Enabled: s.Engine.IDSOnly()})
+	case http.MethodPut:
+		var req apiIDSOnly
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		previous := s.Engine.IDSOnly()
+		s.Engine.SetIDSOnly(req.Enabled)
+		summary := "IDS-only mode disabled"
+		if req.Enabled {
+			summary = "IDS-only mode enabled"
+		}
+		s.Audit.Record(auditRecord{
+			Who:     apiClientName(r),
+			Action:  "ids_only",
+			Summary: summary,
+			Details: auditChange{From: previous, To: req.Enabled},
+		})
+		logger.Info("IDS-only mode changed", zap.Bool("enabled", req.Enabled))
+		writeAPIJSON(w, http.StatusOK, req)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET /log-level, PUT /log-level to change it.
+func (s *apiServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIJSON(w, http.StatusOK, apiLogLevel{Level: atomicLogLevel.Level().String()})
+	case http.MethodPut:
+		var req apiLogLevel
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		level, ok := logLevelMap[strings.ToLower(req.Level)]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "unsupported log level")
+			return
+		}
+		previous := setLogLevel(level, "API")
+		s.Audit.Record(auditRecord{
+			Who:     apiClientName(r),
+			Action:  "log_level",
+			Summary: "log level set to " + level.String(),
+			Details: auditChange{From: previous.String(), To: level.String()},
+		})
+		writeAPIJSON(w, http.StatusOK, apiLogLevel{Level: level.String(), Previous: previous.String()})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET /debug-targets, PUT /debug-targets to replace them, DELETE /debug-targets to clear them.
+// The current targets are returned in all cases.
+func (s *apiServer) handleDebugTargets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req apiDebugTargets
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl < 0 {
+				writeAPIError(w, http.StatusBadRequest, "invalid ttl")
+				return
+			}
+		}
+		t, err := parseDebugTargets(req.IPs, req.Streams, req.Analyzers, ttl)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.Debug.SetTargets(t)
+		s.Audit.Record(auditRecord{
+			Who:     apiClientName(r),
+			Action:  "debug_targets",
+			Summary: "debug targets changed",
+			Details: req,
+		})
+		logger.Info("debug targets changed",
+			zap.Strings("ips", req.IPs),
+			zap.Int64s("streams", req.Streams),
+			zap.Strings("analyzers", req.Analyzers),
+			zap.Duration("ttl", ttl))
+	case http.MethodDelete:
+		s.Debug.SetTargets(nil)
+		s.Audit.Record(auditRecord{
+			Who:     apiClientName(r),
+			Action:  "debug_targets",
+			Summary: "debug targets cleared",
+		})
+		logger.Info("debug targets cleared")
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	resp := apiDebugTargets{}
+	if t := s.Debug.Targets(); t != nil {
+		for _, n := range t.IPs {
+			resp.IPs = append(resp.IPs, n.String())
+		}
+		for id := range t.Streams {
+			resp.Streams = append(resp.Streams, id)
+		}
+		for name := range t.Analyzers {
+			resp.Analyzers = append(resp.Analyzers, name)
+		}
+		sort.Slice(resp.Streams, func(i, j int) bool { return resp.Streams[i] < resp.Streams[j] })
+		sort.Strings(resp.Analyzers)
+		if !t.Expires.IsZero() {
+			resp.Expires = &t.Expires
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+// POST /packet-ring/dump
+func (s *apiServer) handlePacketRingDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), apiPacketRingTimeout)
+	defer cancel()
+	files, err := s.Engine.DumpPacketRings(ctx, "API request")
+	if errors.Is(err, engine.ErrPacketRingDisabled) {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiPacketRingDump{Files: files})
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIJSON(w, status, apiError{Error: msg})
+}
+
+// apiAddr & apiToken are the address and the token of the API of a running instance,
+// for the commands that call it.
+var (
+	apiAddr  string
+	apiToken string
+)
+
+func apiURL(path string) string {
+	addr := apiAddr
+	if addr == "" {
+		if err := readConfig(); err != nil {
+			logger.Fatal("failed to read config, use --api to specify the API address", zap.Error(err))
+		}
+		addr = viper.GetString("api.listen")
+		if addr == "" {
+			logger.Fatal("API is not enabled in the config (api.listen)")
+		}
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+// apiAuthToken returns the token to call the API with, empty if none.
+func apiAuthToken() string {
+	if apiToken != "" {
+		return apiToken
+	}
+	_ = readConfig() // No config file is fine, it's only needed if the API has a token
+	return viper.GetString("api.token")
+}
+
+// callAPI calls the API and decodes the response into out, exiting on any error.
+func callAPI(method, path string, in, out interface{}) {
+	err := requestAPI(method, path, in, out)
+	var statusErr apiStatusError
+	if errors.As(err, &statusErr) {
+		fmt.Fprintf(os.Stderr, "error: %s (%s)\n", statusErr.Message, statusErr.Status)
+		os.Exit(1)
+	} else if err != nil {
+		logger.Fatal("failed to call API", zap.Error(err))
+	}
+}
+
+// apiStatusError is the error returned by the API for a non-200 response.
+type apiStatusError struct {
+	Status  string
+	Message string
+}
+
+func (e apiStatusError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Status)
+}
+
+// requestAPI calls the API and decodes the response into out.
+// in is sent as is if it's a []byte, or encoded to JSON otherwise.
+func requestAPI(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if raw, ok := in.([]byte); ok {
+		body.Write(raw)
+	} else if in != nil {
+		_ = json.NewEncoder(&body).Encode(in)
+	}
+	req, err := http.NewRequest(method, apiURL(path), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := apiAuthToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return apiStatusError{Status: resp.Status, Message: apiErr.Error}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode API response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+func TestAPIServer_Sets(t *testing.T) {
+	logger = zap.NewNop()
+	blocked := builtins.NewSet("blocked", builtins.SetTypeIP)
+	if err := blocked.Add([]string{"10.0.0.1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	s := &apiServer{
+		Sets:  builtins.NewSetStore(blocked, builtins.NewSet("ads", builtins.SetTypeDomain)),
+		Token: "secret",
+	}
+	handler := s.handler()
+
+	testCases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		noToken    bool
+		wantStatus int
+		wantBody   string // JSON
+	}{
+		{
+			name:       "unauthorized",
+			method:     http.MethodGet,
+			path:       "/sets",
+			noToken:    true,
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   `{"error":"unauthorized"}`,
+		},
+		{
+			name:       "list sets",
+			method:     http.MethodGet,
+			path:       "/sets",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"name":"ads","type":"domain","size":0},{"name":"blocked","type":"ip","size":1}]`,
+		},
+		{
+			name:       "list empty set",
+			method:     http.MethodGet,
+			path:       "/sets/ads",
+			wantStatus: http.StatusOK,
+			wantBody:   `[]`,
+		},
+		{
+			name:       "unknown set",
+			method:     http.MethodGet,
+			path:       "/sets/nope",
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":"set not found"}`,
+		},
+		{
+			name:       "add",
+			method:     http.MethodPost,
+			path:       "/sets/blocked",
+			body:       `{"entries":["10.0.0.2","192.168.1.0/24"]}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"count":2}`,
+		},
+		{
+			name:       "add invalid",
+			method:     http.MethodPost,
+			path:       "/sets/blocked",
+			body:       `{"entries":["10.0.0.3","nope"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"invalid entry \"nope\""}`,
+		},
+		{
+			name:       "add invalid ttl",
+			method:     http.MethodPost,
+			path:       "/sets/blocked",
+			body:       `{"entries":["10.0.0.3"],"ttl":"-1h"}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"invalid ttl"}`,
+		},
+		{
+			name:       "remove invalid",
+			method:     http.MethodDelete,
+			path:       "/sets/blocked",
+			body:       `{"entries":["10.0.0.1","nope"]}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":"invalid entry \"nope\""}`,
+		},
+		{
+			name:       "remove",
+			method:     http.MethodDelete,
+			path:       "/sets/blocked",
+			body:       `{"entries":["10.0.0.2","10.0.0.9"]}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `{"count":1}`,
+		},
+		{
+			name:       "list entries",
+			method:     http.MethodGet,
+			path:       "/sets/blocked",
+			wantStatus: http.StatusOK,
+			wantBody:   `[{"value":"10.0.0.1","expiry":"0001-01-01T00:00:00Z"},{"value":"192.168.1.0/24","expiry":"0001-01-01T00:00:00Z"}]`,
+		},
+		{
+			name:       "invalid body",
+			method:     http.MethodPost,
+			path:       "/sets/blocked",
+			body:       `[`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "method not allowed",
+			method:     http.MethodPut,
+			path:       "/sets/blocked",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   `{"error":"method not allowed"}`,
+		},
+	}
+	// In order, each case sees the changes of the previous ones
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if !tc.noToken {
+			req.Header.Set("Authorization", "Bearer secret")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.wantStatus)
+		}
+		if tc.wantBody == "" {
+			continue
+		}
+		var got, want interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Errorf("%s: invalid response %q: %v", tc.name, rec.Body.String(), err)
+			continue
+		}
+		_ = json.Unmarshal([]byte(tc.wantBody), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: body = %s, want %s", tc.name, strings.TrimSpace(rec.Body.String()), tc.wantBody)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	auditHashSuffixLength = len(`,"hash":"`) + sha256.Size*2 + len(`"}`)
+	auditMaxLineLength    = 1024 * 1024
+	auditMaxEntries       = 100 // Set entries listed in a record, the others are only counted
+)
+
+// auditLog records the changes made to a running instance: ruleset reloads & rollbacks,
+// set changes made through the API, and runtime toggles (IDS-only mode, log level, debug targets),
+// with who made them, when, a summary of the change and the hash of the resulting ruleset.
+//
+// It's an append-only file of JSON lines, each with the hash of the previous one, and its own hash
+// of everything else (HMAC-SHA256 if a key is set, so that the chain can't be recomputed without it).
+// Modifying, inserting or deleting a record breaks the chain, which "opengfw audit verify" checks.
+// Truncating the latest records doesn't, which is why the hash of every record is logged too.
+// Failed changes are recorded as well. A nil *auditLog records nothing.
+type auditLog struct {
+	key []byte // nil for plain SHA-256
+
+	mutex sync.Mutex
+	file  *os.File
+	seq   uint64
+	prev  string // Hash of the latest record
+}
+
+type auditRecord struct {
+	Seq     uint64      `json:"seq"`
+	Time    time.Time   `json:"time"`
+	Who     string      `json:"who"`              // e.g. api:10.0.0.1:41234, grpc:<client CN>, signal:SIGHUP
+	Action  string      `json:"action"`           // e.g. ruleset.reload, set.add, ids_only
+	Target  string      `json:"target,omitempty"` // e.g. the set changed
+	Summary string      `json:"summary"`
+	Details interface{} `json:"details,omitempty"`
+	Version string      `json:"version,omitempty"` // Hash of the ruleset in use after the change
+	Error   string      `json:"error,omitempty"`   // Set if the change failed
+	Prev    string      `json:"prev"`              // Hash of the previous record, empty for the first
+}
+
+// auditSetDetails are the details of a set change.
+type auditSetDetails struct {
+	Count   int      `json:"count"`
+	Entries []string `json:"entries"` // Up to auditMaxEntries
+	TTL     string   `json:"ttl,omitempty"`
+}
+
+// auditChange are the details of a toggle.
+type auditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// newAuditLog opens an audit log, continuing its chain. A broken chain is only reported,
+// as refusing to start would let anyone able to write the file stop the firewall.
+func newAuditLog(name string, key []byte) (*auditLog, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &auditLog{key: key, file: f}
+	l.seq, l.prev, err = scanAuditLog(f, key)
+	if err != nil {
+		logger.Warn("audit log chain is broken, continuing from its latest record", zap.String("file", name), zap.Error(err))
+	}
+	return l, nil
+}
+
+// Record appends a record. Seq, Time & Prev are filled in.
+func (l *auditLog) Record(r auditRecord) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	r.Seq, r.Time, r.Prev = l.seq+1, time.Now(), l.prev
+	body, err := json.Marshal(r)
+	if err != nil {
+		logger.Error("failed to encode audit record", zap.String("action", r.Action), zap.Error(err))
+		return
+	}
+	sum := auditHash(l.key, body)
+	line := append(body[:len(body)-1], `,"hash":"`+sum+`"}`+"\n"...)
+	if _, err := l.file.Write(line); err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		logger.Error("failed to write audit record", zap.String("action", r.Action), zap.Error(err))
+		return
+	}
+	l.seq, l.prev = r.Seq, sum
+	logger.Info("audit record written",
+		zap.Uint64("seq", r.Seq),
+		zap.String("action", r.Action),
+		zap.String("who", r.Who),
+		zap.String("hash", sum))
+}
+
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// auditHash returns the hex hash of a record without its hash.
+func auditHash(key, body []byte) string {
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// scanAuditLog checks the chain of an audit log, and returns the sequence number & hash of its latest record.
+// The error is about the first record that doesn't match; the following ones are still read.
+func scanAuditLog(r io.Reader, key []byte) (uint64, string, error) {
+	var (
+		seq      uint64
+		prev     string
+		firstErr error
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), auditMaxLineLength)
+	for line := 1; scanner.Scan(); line++ {
+		err := func() error {
+			b := scanner.Bytes()
+			suffix := len(b) - auditHashSuffixLength
+			if suffix < 1 || !bytes.HasPrefix(b[suffix:], []byte(`,"hash":"`)) {
+				return errors.New("no hash")
+			}
+			body := append(b[:suffix:suffix], '}')
+			sum := string(b[suffix+len(`,"hash":"`) : len(b)-len(`"}`)])
+			var rec auditRecord
+			if err := json.Unmarshal(body, &rec); err != nil {
+				return err
+			}
+			defer func() {
+				seq, prev = rec.Seq, sum
+			}()
+			if !hmac.Equal([]byte(sum), []byte(auditHash(key, body))) {
+				return errors.New("hash mismatch (modified, or wrong key)")
+			}
+			if rec.Prev != prev {
+				return errors.New("previous hash mismatch (a record before was removed or inserted)")
+			}
+			if rec.Seq != seq+1 {
+				return fmt.Errorf("sequence number %d, expected %d", rec.Seq, seq+1)
+			}
+			return nil
+		}()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return seq, prev, firstErr
+}
+
+// apiClientName returns who made an API request: the common name of its client certificate,
+// or its address.
+func apiClientName(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return "api:" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return "api:" + r.RemoteAddr
+}
+
+// newAuditSetDetails returns the details of a change of set entries.
+func newAuditSetDetails(entries []string, ttl time.Duration) auditSetDetails {
+	d := auditSetDetails{Count: len(entries), Entries: entries}
+	if len(entries) > auditMaxEntries {
+		d.Entries = entries[:auditMaxEntries]
+	}
+	if ttl > 0 {
+		d.TTL = ttl.String()
+	}
+	return d
+}
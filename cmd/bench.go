@@ -0,0 +1,433 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdio "io"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+const benchSNI = "bench.example.com"
+
+// Flags
+var (
+	benchPcapFile    string
+	benchProfile     []string
+	benchFlows       int
+	benchConcurrency int
+	benchWorkers     int
+	benchJSON        bool
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench [flags] rule_file",
+	Short: "Measure the performance of the engine with a ruleset, on a pcap file or synthetic traffic",
+	Long: "Replay a pcap file (--pcap) or synthetic flows (--profile) through the engine with a ruleset, " +
+		"as fast as possible, and report packets/s, flows/s, the time spent in each analyzer and the allocations. " +
+		"The packets are loaded in memory first, so that reading them is not measured. " +
+		"Use --json to compare the results across releases.",
+	Args: cobra.ExactArgs(1),
+	Run:  runBench,
+}
+
+func init() {
+	benchCmd.Flags().StringVar(&benchPcapFile, "pcap", "", "pcap/pcapng file to replay")
+	benchCmd.Flags().StringSliceVar(&benchProfile, "profile", []string{"dns", "http", "tls"}, "synthetic flows, mixed: "+strings.Join(benchProfileNames(), ", "))
+	benchCmd.Flags().IntVar(&benchFlows, "flows", 10000, "number of synthetic flows")
+	benchCmd.Flags().IntVar(&benchConcurrency, "concurrency", 100, "synthetic flows whose packets are interleaved")
+	benchCmd.Flags().IntVar(&benchWorkers, "workers", 0, "engine workers (default: number of CPUs)")
+	benchCmd.Flags().BoolVar(&benchJSON, "json", false, "print the results as JSON")
+	rootCmd.AddCommand(benchCmd)
+}
+
+type benchResult struct {
+	Source          string                `json:"source"`
+	Workers         int                   `json:"workers"`
+	Packets         uint64                `json:"packets"`   // Replayed
+	Bytes           uint64                `json:"bytes"`     // Replayed
+	Processed       uint64                `json:"processed"` // Packets given a verdict, without those of streams given a stream verdict before
+	Flows           uint64                `json:"flows"`
+	Seconds         float64               `json:"seconds"`
+	PacketsPerSec   float64               `json:"packets_per_sec"`
+	FlowsPerSec     float64               `json:"flows_per_sec"`
+	BitsPerSec      float64               `json:"bits_per_sec"`
+	AllocsPerPacket float64               `json:"allocs_per_packet"`
+	BytesPerPacket  float64               `json:"alloc_bytes_per_packet"`
+	GCs             uint32                `json:"gcs"`
+	GCPause         float64               `json:"gc_pause_sec"`
+	Analyzers       []benchAnalyzerResult `json:"analyzers"`
+}
+
+type benchAnalyzerResult struct {
+	Name         string  `json:"name"`
+	Streams      uint64  `json:"streams"`
+	Bytes        uint64  `json:"bytes"`
+	Seconds      float64 `json:"seconds"`
+	NsPerStream  float64 `json:"ns_per_stream"`
+	NsPerByte    float64 `json:"ns_per_byte"`
+	Classified   uint64  `json:"classified"`
+	Unclassified uint64  `json:"unclassified"`
+	Errors       uint64  `json:"errors"`
+}
+
+func runBench(cmd *cobra.Command, args []string) {
+	rs := testRuleset(args[0], benchRulesetLogger{}, benchRulesetLogger{})
+	var (
+		packets [][]byte
+		source  string
+		err     error
+	)
+	if benchPcapFile != "" {
+		packets, err = io.LoadPcapPackets(benchPcapFile)
+		if err != nil {
+			logger.Fatal("failed to load pcap file", zap.Error(err))
+		}
+		source = benchPcapFile
+	} else {
+		packets, err = benchSyntheticPackets(benchProfile, benchFlows, benchConcurrency)
+		if err != nil {
+			logger.Fatal("failed to generate packets", zap.Error(err))
+		}
+		source = fmt.Sprintf("%d flows of %s", benchFlows, strings.Join(benchProfile, ", "))
+	}
+	var bytes uint64
+	for _, p := range packets {
+		bytes += uint64(len(p))
+	}
+
+	pcapIO, _ := io.NewPcapPacketIO(io.PcapPacketIOConfig{Packets: packets})
+	defer pcapIO.Close()
+	en, err := engine.NewEngine(engine.Config{
+		Logger:  &benchEngineLogger{},
+		IOs:     []io.PacketIO{pcapIO},
+		Ruleset: rs,
+		Workers: benchWorkers,
+	})
+	if err != nil {
+		logger.Fatal("failed to initialize engine", zap.Error(err))
+	}
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	err = en.Run(context.Background())
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if err != nil && !errors.Is(err, io.ErrEndOfInput) {
+		logger.Fatal("failed to replay packets", zap.Error(err))
+	}
+
+	st := en.Stats()
+	r := benchResult{
+		Source:    source,
+		Workers:   st.Workers,
+		Packets:   uint64(len(packets)),
+		Bytes:     bytes,
+		Processed: st.Packets,
+		Flows:     st.TCPStreams + st.UDPStreams,
+		Seconds:   elapsed.Seconds(),
+		GCs:       after.NumGC - before.NumGC,
+		GCPause:   time.Duration(after.PauseTotalNs - before.PauseTotalNs).Seconds(),
+	}
+	r.PacketsPerSec = float64(r.Packets) / r.Seconds
+	r.FlowsPerSec = float64(r.Flows) / r.Seconds
+	r.BitsPerSec = float64(r.Bytes) * 8 / r.Seconds
+	if r.Processed > 0 {
+		r.AllocsPerPacket = float64(after.Mallocs-before.Mallocs) / float64(r.Processed)
+		r.BytesPerPacket = float64(after.TotalAlloc-before.TotalAlloc) / float64(r.Processed)
+	}
+	for _, as := range en.AnalyzerStats() {
+		if as.Streams == 0 {
+			continue
+		}
+		a := benchAnalyzerResult{
+			Name:         as.Name,
+			Streams:      as.Streams,
+			Bytes:        as.Bytes,
+			Seconds:      as.Time.Seconds(),
+			NsPerStream:  float64(as.Time.Nanoseconds()) / float64(as.Streams),
+			Classified:   as.Classified,
+			Unclassified: as.Unclassified,
+			Errors:       as.Errors,
+		}
+		if as.Bytes > 0 {
+			a.NsPerByte = float64(as.Time.Nanoseconds()) / float64(as.Bytes)
+		}
+		r.Analyzers = append(r.Analyzers, a)
+	}
+	sort.Slice(r.Analyzers, func(i, j int) bool { return r.Analyzers[i].Seconds > r.Analyzers[j].Seconds })
+
+	if benchJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(r)
+		return
+	}
+	fmt.Printf("source:      %s, %d workers\n", r.Source, r.Workers)
+	fmt.Printf("packets:     %d in %.3fs (%d processed), %.0f packets/s, %.1f Mbit/s\n",
+		r.Packets, r.Seconds, r.Processed, r.PacketsPerSec, r.BitsPerSec/1e6)
+	fmt.Printf("flows:       %d, %.0f flows/s\n", r.Flows, r.FlowsPerSec)
+	fmt.Printf("allocations: %.1f allocs & %.0f bytes per processed packet, %d GCs (%.1fms pause)\n",
+		r.AllocsPerPacket, r.BytesPerPacket, r.GCs, r.GCPause*1000)
+	if len(r.Analyzers) > 0 {
+		fmt.Printf("%-12s %10s %12s %10s %12s %10s\n", "analyzer", "streams", "bytes", "time", "per stream", "per byte")
+		for _, a := range r.Analyzers {
+			fmt.Printf("%-12s %10d %12d %9.3fs %10.0fns %8.1fns\n",
+				a.Name, a.Streams, a.Bytes, a.Seconds, a.NsPerStream, a.NsPerByte)
+		}
+	}
+}
+
+// benchEngineLogger drops the per-stream logs, so that logging is not measured.
+// Errors are still logged.
+type benchEngineLogger struct {
+	engineLogger
+}
+
+func (l *benchEngineLogger) TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+}
+
+func (l *benchEngineLogger) UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+}
+
+func (l *benchEngineLogger) SCTPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+}
+
+func (l *benchEngineLogger) ICMPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+}
+
+func (l *benchEngineLogger) StreamNoMatch(info ruleset.StreamInfo, classified bool) {}
+
+func (l *benchEngineLogger) AnalyzerInfof(streamID int64, name string, format string, args ...interface{}) {
+}
+
+// benchRulesetLogger drops the rule logs & notifications.
+type benchRulesetLogger struct{}
+
+func (benchRulesetLogger) Log(level ruleset.LogLevel, info ruleset.StreamInfo, name string) {}
+
+func (benchRulesetLogger) DryRun(info ruleset.StreamInfo, name string, action ruleset.Action) {}
+
+func (benchRulesetLogger) MatchError(info ruleset.StreamInfo, name string, err error) {}
+
+func (benchRulesetLogger) Notify(ev ruleset.NotifyEvent) {}
+
+// benchProfiles generate the packets of synthetic flows, by flow index.
+var benchProfiles = map[string]func(b *benchFlowBuilder){
+	"dns": func(b *benchFlowBuilder) {
+		query := &layers.DNS{
+			ID: uint16(b.index), RD: true,
+			Questions: []layers.DNSQuestion{{Name: []byte(benchSNI), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		}
+		answer := *query
+		answer.QR, answer.RA, answer.ANCount = true, true, 1
+		answer.Answers = []layers.DNSResourceRecord{{
+			Name: []byte(benchSNI), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.IP{192, 0, 2, 1},
+		}}
+		b.UDP(53, query, &answer)
+	},
+	"http": func(b *benchFlowBuilder) {
+		req := "GET /" + fmt.Sprint(b.index) + " HTTP/1.1\r\nHost: " + benchSNI + "\r\nUser-Agent: OpenGFW-bench\r\n\r\n"
+		resp := "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 4000\r\n\r\n" + strings.Repeat("x", 4000)
+		b.TCP(80, []byte(req), []byte(resp))
+	},
+	"tls": func(b *benchFlowBuilder) {
+		// Only the ClientHello is real, the rest of the handshake & the data are random
+		b.TCP(443, benchClientHello, b.Random(1400), b.Random(100), b.Random(4000))
+	},
+	"tcp": func(b *benchFlowBuilder) {
+		b.TCP(8000, b.Random(200), b.Random(4000))
+	},
+	"udp": func(b *benchFlowBuilder) {
+		b.UDP(9000, gopacket.Payload(b.Random(200)), gopacket.Payload(b.Random(1200)))
+	},
+}
+
+// benchClientHello is the first TLS record of a crypto/tls client, with benchSNI.
+var benchClientHello []byte
+
+func benchProfileNames() []string {
+	names := make([]string, 0, len(benchProfiles))
+	for name := range benchProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// benchSyntheticPackets generates the packets of flows of the profiles in turn.
+// The packets of each group of concurrency flows are interleaved.
+func benchSyntheticPackets(profiles []string, flows, concurrency int) ([][]byte, error) {
+	for _, name := range profiles {
+		if benchProfiles[name] == nil {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+		if name == "tls" && benchClientHello == nil {
+			var err error
+			if benchClientHello, err = newBenchClientHello(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(profiles) == 0 || flows <= 0 {
+		return nil, errors.New("no flows to generate")
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	rng := rand.New(rand.NewSource(1)) // Same packets every time
+	var packets [][]byte
+	for first := 0; first < flows; first += concurrency {
+		var group [][][]byte
+		for i := first; i < flows && i < first+concurrency; i++ {
+			b := &benchFlowBuilder{index: i, rng: rng, clientPort: uint16(1024 + rng.Intn(64512))}
+			benchProfiles[profiles[i%len(profiles)]](b)
+			group = append(group, b.packets)
+		}
+		for k := 0; ; k++ {
+			more := false
+			for _, flow := range group {
+				if k < len(flow) {
+					packets = append(packets, flow[k])
+					more = true
+				}
+			}
+			if !more {
+				break
+			}
+		}
+	}
+	return packets, nil
+}
+
+// newBenchClientHello captures the ClientHello of a crypto/tls client.
+func newBenchClientHello() ([]byte, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: benchSNI, InsecureSkipVerify: true}).Handshake()
+		_ = client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := stdio.ReadFull(server, header); err != nil {
+		return nil, err
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := stdio.ReadFull(server, record[5:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// benchFlowBuilder builds the raw IP packets of a synthetic flow between a client,
+// whose address & port depend on the flow index, and a server.
+type benchFlowBuilder struct {
+	index      int
+	rng        *rand.Rand
+	clientPort uint16 // Random, like ephemeral ports, as the pcap IO hashes the addresses & ports into stream IDs
+	packets    [][]byte
+}
+
+func (b *benchFlowBuilder) Random(n int) []byte {
+	bs := make([]byte, n)
+	_, _ = b.rng.Read(bs)
+	return bs
+}
+
+func (b *benchFlowBuilder) addresses() (client, server net.IP) {
+	return net.IP{10, byte(b.index >> 16), byte(b.index >> 8), byte(b.index)}, net.IP{192, 0, 2, 1}
+}
+
+func (b *benchFlowBuilder) add(fromClient bool, transport gopacket.SerializableLayer, payload gopacket.SerializableLayer) {
+	client, server := b.addresses()
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: client, DstIP: server}
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = server, client
+	}
+	switch t := transport.(type) {
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		_ = t.SetNetworkLayerForChecksum(ip)
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		_ = t.SetNetworkLayerForChecksum(ip)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	ls := []gopacket.SerializableLayer{ip, transport}
+	if payload != nil {
+		ls = append(ls, payload)
+	}
+	_ = gopacket.SerializeLayers(buf, opts, ls...)
+	b.packets = append(b.packets, append([]byte(nil), buf.Bytes()...))
+}
+
+// UDP adds a datagram from the client and one from the server.
+func (b *benchFlowBuilder) UDP(port uint16, request, response gopacket.SerializableLayer) {
+	clientPort := b.clientPort
+	b.add(true, &layers.UDP{SrcPort: layers.UDPPort(clientPort), DstPort: layers.UDPPort(port)}, request)
+	b.add(false, &layers.UDP{SrcPort: layers.UDPPort(port), DstPort: layers.UDPPort(clientPort)}, response)
+}
+
+// TCP adds a connection with the handshake, the data sent alternately by the client & the server,
+// in segments of up to 1400 bytes, and the close.
+func (b *benchFlowBuilder) TCP(port uint16, data ...[]byte) {
+	clientPort := b.clientPort
+	seq := [2]uint32{1000, 5000} // Client, server
+	segment := func(fromClient bool, flags func(t *layers.TCP), payload []byte) {
+		from, to := 0, 1
+		t := &layers.TCP{SrcPort: layers.TCPPort(clientPort), DstPort: layers.TCPPort(port), Window: 65535}
+		if !fromClient {
+			from, to = 1, 0
+			t.SrcPort, t.DstPort = t.DstPort, t.SrcPort
+		}
+		t.Seq, t.Ack = seq[from], seq[to]
+		flags(t)
+		var p gopacket.SerializableLayer
+		if len(payload) > 0 {
+			p = gopacket.Payload(payload)
+		}
+		b.add(fromClient, t, p)
+		seq[from] += uint32(len(payload))
+		if t.SYN || t.FIN {
+			seq[from]++
+		}
+	}
+	segment(true, func(t *layers.TCP) { t.SYN, t.Ack = true, 0 }, nil)
+	segment(false, func(t *layers.TCP) { t.SYN, t.ACK = true, true }, nil)
+	segment(true, func(t *layers.TCP) { t.ACK = true }, nil)
+	for i, d := range data {
+		fromClient := i%2 == 0
+		for len(d) > 0 {
+			n := len(d)
+			if n > 1400 {
+				n = 1400
+			}
+			segment(fromClient, func(t *layers.TCP) { t.ACK, t.PSH = true, true }, d[:n])
+			d = d[n:]
+		}
+		segment(!fromClient, func(t *layers.TCP) { t.ACK = true }, nil)
+	}
+	segment(true, func(t *layers.TCP) { t.FIN, t.ACK = true, true }, nil)
+	segment(false, func(t *layers.TCP) { t.FIN, t.ACK = true, true }, nil)
+}
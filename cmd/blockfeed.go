@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+const (
+	blockFeedDefaultTTL        = time.Hour
+	blockFeedDefaultMaxEntries = 100000
+	blockFeedDefaultInterval   = time.Minute
+	blockFeedDefaultNFTTable   = "inet filter"
+
+	blockFeedTypeIP     = "ip"
+	blockFeedTypeDomain = "domain"
+)
+
+// blockFeedFormats are the formats the feed can be exported in:
+// plain (one IP or domain per line), json, dnsmasq (address=/domain/ lines, domains only),
+// and nft (commands for nft -f, filling the opengfw_blocked_ipv4 & opengfw_blocked_ipv6 sets, IPs only).
+var blockFeedFormats = map[string]string{
+	"plain":   "text/plain; charset=utf-8",
+	"json":    "application/json",
+	"dnsmasq": "text/plain; charset=utf-8",
+	"nft":     "text/plain; charset=utf-8",
+}
+
+// blockFeed keeps the IPs & domains of the streams recently blocked, with the rule that blocked them,
+// so other devices on the network (resolvers, routers...) can apply the same decisions.
+// It's served by the /blocked endpoint of the API, and can be exported to a file periodically.
+//
+// The destination IP of a blocked stream is listed, and its domain if known (DNS question,
+// TLS/QUIC SNI or HTTP host); for DNS streams, only the domain, as the destination is the resolver.
+// Entries expire TTL after the latest time they were blocked. The entries of the configured
+// sets (e.g. a set of blocked IPs managed through the API) are listed too, with their own expiry.
+// A nil *blockFeed records nothing.
+type blockFeed struct {
+	TTL        time.Duration
+	MaxEntries int
+	Sets       []*builtins.Set // IP or domain sets
+	NFTTable   string          // Family & name of the table of the nft sets, e.g. "inet filter"
+
+	mutex   sync.Mutex
+	entries map[blockFeedKey]*blockFeedEntry
+}
+
+type blockFeedKey struct {
+	Type  string
+	Value string
+}
+
+type blockFeedEntry struct {
+	Type        string     `json:"type"` // ip or domain
+	Value       string     `json:"value"`
+	Reason      string     `json:"reason"`                // Rule that blocked it, or set:<name>
+	Hits        uint64     `json:"hits,omitempty"`        // Streams blocked
+	LastBlocked *time.Time `json:"lastBlocked,omitempty"` // Nil for set entries
+	Expires     *time.Time `json:"expires,omitempty"`     // Nil if it never expires
+}
+
+func newBlockFeed(ttl time.Duration, maxEntries int, sets []*builtins.Set, nftTable string) *blockFeed {
+	if ttl <= 0 {
+		ttl = blockFeedDefaultTTL
+	}
+	if maxEntries <= 0 {
+		maxEntries = blockFeedDefaultMaxEntries
+	}
+	if nftTable == "" {
+		nftTable = blockFeedDefaultNFTTable
+	}
+	return &blockFeed{
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		Sets:       sets,
+		NFTTable:   nftTable,
+		entries:    make(map[blockFeedKey]*blockFeedEntry),
+	}
+}
+
+// StreamAction records the IP & domain of a stream if the action blocks it.
+// Streams that didn't match any rule are ignored, as there's no reason to report.
+func (f *blockFeed) StreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	if f == nil || noMatch {
+		return
+	}
+	if action != ruleset.ActionBlock && action != ruleset.ActionDrop {
+		return
+	}
+	now := time.Now()
+	domain, isDNS := streamDomain(info.Props)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !isDNS && info.DstIP != nil {
+		f.add(blockFeedKey{Type: blockFeedTypeIP, Value: info.DstIP.String()}, rule, now)
+	}
+	if domain != "" {
+		f.add(blockFeedKey{Type: blockFeedTypeDomain, Value: domain}, rule, now)
+	}
+}
+
+// add records a block of an entity. The mutex must be held.
+func (f *blockFeed) add(key blockFeedKey, rule string, now time.Time) {
+	e := f.entries[key]
+	if e == nil {
+		if len(f.entries) >= f.MaxEntries {
+			f.prune(now)
+			if len(f.entries) >= f.MaxEntries {
+				return
+			}
+		}
+		e = &blockFeedEntry{Type: key.Type, Value: key.Value}
+		f.entries[key] = e
+	}
+	expires := now.Add(f.TTL)
+	e.Reason = rule
+	e.Hits++
+	e.LastBlocked, e.Expires = &now, &expires
+}
+
+// prune deletes the expired entries. The mutex must be held.
+func (f *blockFeed) prune(now time.Time) {
+	for key, e := range f.entries {
+		if !now.Before(*e.Expires) {
+			delete(f.entries, key)
+		}
+	}
+}
+
+// List returns the unexpired entries of a type (all if empty), sorted by type and value.
+// An entity both blocked by a rule and in a set is only listed once, for the rule.
+func (f *blockFeed) List(typ string) []blockFeedEntry {
+	now := time.Now()
+	f.mutex.Lock()
+	f.prune(now)
+	list := make([]blockFeedEntry, 0, len(f.entries))
+	seen := make(map[blockFeedKey]bool, len(f.entries))
+	for key, e := range f.entries {
+		seen[key] = true
+		if typ == "" || e.Type == typ {
+			list = append(list, *e)
+		}
+	}
+	f.mutex.Unlock()
+	for _, set := range f.Sets {
+		setType := blockFeedTypeIP
+		if set.Type() == builtins.SetTypeDomain {
+			setType = blockFeedTypeDomain
+		}
+		if typ != "" && typ != setType {
+			continue
+		}
+		for _, se := range set.List() {
+			key := blockFeedKey{Type: setType, Value: se.Value}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			e := blockFeedEntry{Type: setType, Value: se.Value, Reason: "set:" + set.Name()}
+			if !se.Expiry.IsZero() {
+				expiry := se.Expiry
+				e.Expires = &expiry
+			}
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Type != list[j].Type {
+			return list[i].Type < list[j].Type
+		}
+		return list[i].Value < list[j].Value
+	})
+	return list
+}
+
+// Write writes the entries of a type (all if empty) in a format of blockFeedFormats.
+func (f *blockFeed) Write(w io.Writer, format, typ string) error {
+	list := f.List(typ)
+	if format == "json" {
+		return json.NewEncoder(w).Encode(list)
+	}
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "plain":
+		for _, e := range list {
+			fmt.Fprintln(bw, e.Value)
+		}
+	case "dnsmasq":
+		for _, e := range list {
+			if e.Type == blockFeedTypeDomain {
+				// Answers NXDOMAIN for the domain and its subdomains
+				fmt.Fprintf(bw, "address=/%s/\n", e.Value)
+			}
+		}
+	case "nft":
+		// Replaces the content of the sets, which must exist with the interval flag
+		// (for the CIDRs of IP sets), e.g.:
+		// nft add set inet filter opengfw_blocked_ipv4 '{ type ipv4_addr; flags interval; }'
+		for _, set := range []string{"opengfw_blocked_ipv4", "opengfw_blocked_ipv6"} {
+			fmt.Fprintf(bw, "flush set %s %s\n", f.NFTTable, set)
+		}
+		for _, e := range list {
+			if e.Type != blockFeedTypeIP {
+				continue
+			}
+			set := "opengfw_blocked_ipv4"
+			if strings.Contains(e.Value, ":") {
+				set = "opengfw_blocked_ipv6"
+			}
+			fmt.Fprintf(bw, "add element %s %s { %s }\n", f.NFTTable, set, e.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+	return bw.Flush()
+}
+
+// WriteFile atomically replaces a file with the entries in a format of blockFeedFormats.
+func (f *blockFeed) WriteFile(name, format string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = f.Write(tmp, format, "")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// RunExport writes the feed to a file every interval, until the context is cancelled.
+func (f *blockFeed) RunExport(ctx context.Context, name, format string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := f.WriteFile(name, format); err != nil {
+			logger.Error("failed to export blocked feed", zap.String("file", name), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamDomain returns the domain of a stream from its analyzer properties, empty if unknown,
+// and whether it's a DNS stream.
+func streamDomain(props analyzer.CombinedPropMap) (string, bool) {
+	if questions, ok := props["dns"]["questions"].([]analyzer.PropMap); ok {
+		if len(questions) == 0 {
+			return "", true
+		}
+		name, _ := questions[0]["name"].(string)
+		return normalizeDomain(name), true
+	}
+	for _, name := range []string{"tls", "quic"} {
+		if req, ok := props[name]["req"].(analyzer.PropMap); ok {
+			if sni, ok := req["sni"].(string); ok && sni != "" {
+				return normalizeDomain(sni), false
+			}
+		}
+	}
+	if req, ok := props["http"]["req"].(analyzer.PropMap); ok {
+		if headers, ok := req["headers"].(analyzer.PropMap); ok {
+			host, _ := headers["host"].(string)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return normalizeDomain(host), false
+		}
+	}
+	return "", false
+}
+
+// normalizeDomain lowercases a domain and removes its trailing dot.
+// IP addresses aren't domains, and return an empty string.
+func normalizeDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if net.ParseIP(strings.Trim(domain, "[]")) != nil {
+		return ""
+	}
+	return domain
+}
@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check [flags] rule_file",
+	Short: "Check the config and the ruleset without starting",
+	Long: "Parse the config (rejecting unknown keys), check the files it refers to, and compile every rule " +
+		"of the ruleset and of the ruleset selectors, with the analyzers, modifiers, sets & shaping classes they use. " +
+		"Every problem is printed with its location. Nothing is started, connected to or written. " +
+		"Exits with a non-zero status if anything is wrong, e.g. for ExecStartPre= or CI. " +
+		"See \"ruleset lint\" for the warnings about rules.",
+	Args: cobra.ExactArgs(1),
+	Run:  runCheck,
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
+
+func runCheck(cmd *cobra.Command, args []string) {
+	var problems int
+	report := func(location string, err error) {
+		fmt.Printf("%s: %s\n", location, err)
+		problems++
+	}
+	if err := readConfig(); err != nil {
+		report(cfgFile, err)
+		os.Exit(1)
+	}
+	configFile := viper.ConfigFileUsed()
+	var config cliConfig
+	if err := viper.UnmarshalExact(&config); err != nil {
+		// Unknown keys are ignored when running, but are likely typos
+		report(configFile, err)
+		if err := viper.Unmarshal(&config); err != nil {
+			os.Exit(1)
+		}
+	}
+	errs, sets, shapingClasses := config.check()
+	for _, err := range errs {
+		report(configFile, err)
+	}
+	nat64, _ := config.nat64() // Reported by check
+
+	rsConfig := &ruleset.BuiltinConfig{
+		Logger:             &rulesetLogger{},
+		GeoSiteFilename:    config.Ruleset.GeoSite,
+		GeoIpFilename:      config.Ruleset.GeoIp,
+		AppsFilename:       config.Ruleset.Apps,
+		AppsAnalyzers:      len(config.QoS.Classes) > 0,
+		ShapingClasses:     shapingClasses,
+		Sets:               sets,
+		Functions:          config.Ruleset.Functions,
+		CaptureEnabled:     config.Capture.Dir != "",
+		MirrorEnabled:      config.Mirror.Type != "",
+		DivertEnabled:      config.divertEnabled(),
+		CaptureHTTPEnabled: config.HAR.Dir != "",
+		HoneypotEnabled:    config.honeypotEnabled(),
+		Notifier:           config.testNotifier(),
+		Workloads:          config.testWorkloads(),
+		Containers:         config.testContainers(),
+		Processes:          config.testProcesses(),
+		NAT64:              nat64,
+	}
+	sources := []string{args[0]}
+	for _, cs := range config.Ruleset.Selectors {
+		if cs.Rules != "" {
+			sources = append(sources, cs.Rules)
+		}
+	}
+	rules := 0
+	for _, source := range sources {
+		n, errs := config.checkRules(source, rsConfig)
+		for _, err := range errs {
+			report(source, err)
+		}
+		rules += n
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d problems\n", problems)
+		os.Exit(1)
+	}
+	fmt.Printf("config OK, %d rules OK\n", rules)
+}
+
+// check validates the config like runMain does, without creating anything that has side effects:
+// no IO, sink, exporter or server is created. It also returns the sets & shaping classes for the ruleset.
+func (c *cliConfig) check() ([]error, *builtins.SetStore, map[string]uint32) {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	add(c.fillVerdict(&engine.Config{}))
+	add(c.fillIPv6(&engine.Config{}))
+	add(c.fillEvasion(&engine.Config{}))
+	add(c.fillRouting(&engine.Config{}))
+	add(c.fillHAR(&engine.Config{}))
+	add(c.fillQoS(&engine.Config{}))
+	ios, fields, err := c.ioInstances()
+	add(err)
+	for i, ci := range ios {
+		if err := ci.check(); err != nil {
+			add(configError{Field: fields[i], Err: err})
+		}
+	}
+	shapingClasses, err := c.shapingClasses()
+	add(err)
+	sets, err := c.sets()
+	add(err)
+	if sets != nil {
+		_, err = c.blockFeed(sets)
+		add(err)
+		_, _, err = c.crowdSec(sets)
+		add(err)
+		_, err = c.fail2banTailer(sets)
+		add(err)
+		_, err = c.intelFeeds(sets)
+		add(err)
+		_, err = c.captivePortal(sets)
+		add(err)
+		_, err = c.strictMode(sets)
+		add(err)
+		if c.Sinkhole.Log == "" {
+			// Not to create the log
+			_, err = c.sinkhole(sets)
+			add(err)
+		}
+	}
+	_, err = c.rulesetSelectors()
+	add(err)
+	_, err = c.nat64()
+	add(err)
+	_, err = c.usageStore()
+	add(err)
+	_, err = c.researchMode()
+	add(err)
+	if a, err := c.mlAnalyzer(); err != nil {
+		add(err)
+	} else if a != nil {
+		// So that the rules using its properties compile
+		analyzers = append(analyzers, a)
+	}
+	add(c.httpAnalyzer())
+	add(c.sshAnalyzer())
+	if a, err := c.relayAnalyzer(); err != nil {
+		add(err)
+	} else if a != nil {
+		analyzers = append(analyzers, a)
+	}
+	for _, f := range []struct{ field, file string }{
+		{"ruleset.geosite", c.Ruleset.GeoSite},
+		{"ruleset.geoip", c.Ruleset.GeoIp},
+	} {
+		if f.file != "" {
+			if _, err := os.Stat(f.file); err != nil {
+				add(configError{Field: f.field, Err: err})
+			}
+		}
+	}
+	_, err = c.geoIP()
+	add(err)
+	_, err = newPrivilegeDrop(c.Security)
+	add(err)
+	if c.Controller.URL != "" {
+		_, err = c.Controller.tlsConfig()
+		add(err)
+	}
+	if c.API.Listen != "" {
+		add(c.API.checkAuth())
+	}
+	_, err = c.degradeMonitor(nil)
+	add(err)
+	if c.Kubernetes.APIServer != "" {
+		// The in-cluster defaults can only be checked in the pod
+		_, err = c.k8sWatcher()
+		add(err)
+	}
+	_, err = c.dockerWatcher()
+	add(err)
+	_, err = c.haSync()
+	add(err)
+
+	// Event log
+	if c.Eve.File != "" {
+		if _, err := newEventOutput(nil, c.Eve.cliConfigEventRoute, "none"); err != nil {
+			add(configError{Field: "eve", Err: err})
+		}
+	}
+	for i, cs := range c.Sinks {
+		field := fmt.Sprintf("sinks[%d]", i)
+		if err := cs.check(); err != nil {
+			add(configError{Field: field, Err: err})
+		} else if _, err := newEventOutput(nil, cs.cliConfigEventRoute, cs.Key); err != nil {
+			add(configError{Field: field, Err: err})
+		} else if _, err := cs.TLS.config(); err != nil {
+			add(configError{Field: field + ".tls", Err: err})
+		}
+	}
+	if c.Alerts.Window < 0 {
+		add(configError{Field: "alerts.window", Err: errors.New("must not be negative")})
+	}
+
+	// Packet capture & mirroring
+	if c.Ring.Size > 0 && c.Ring.Dir == "" {
+		add(configError{Field: "packetRing.dir", Err: errors.New("required")})
+	}
+	if c.Mirror.DstMAC != "" {
+		if _, err := net.ParseMAC(c.Mirror.DstMAC); err != nil {
+			add(configError{Field: "mirror.dstMAC", Err: err})
+		}
+	}
+	if c.OTLP.Endpoint != "" && (c.OTLP.SampleRatio < 0 || c.OTLP.SampleRatio > 1) {
+		add(configError{Field: "otlp.sampleRatio", Err: errors.New("must be between 0 and 1")})
+	}
+
+	// Servers
+	if c.API.Listen != "" {
+		if c.API.Cert != "" || c.API.Key != "" {
+			if _, err := serverTLSConfig(c.API.Cert, c.API.Key, c.API.ClientCA); err != nil {
+				add(configError{Field: "api", Err: err})
+			}
+		} else if c.API.ClientCA != "" {
+			add(configError{Field: "api.clientCA", Err: errors.New("requires cert and key")})
+		}
+	}
+	if c.GRPC.Listen != "" {
+		if _, err := grpcTLSConfig(c.GRPC.Cert, c.GRPC.Key, c.GRPC.ClientCA); err != nil {
+			add(configError{Field: "grpc", Err: err})
+		}
+	}
+	if c.SNMP.Enabled {
+		if _, err := newSNMPAgent(c.SNMP.AgentX, c.SNMP.OID, nil); err != nil {
+			add(configError{Field: "snmp", Err: err})
+		}
+	}
+	return errs, sets, shapingClasses
+}
+
+// checkRules loads & compiles the rules of a source, and returns their number and their errors,
+// located by rule (and line, for local files).
+func (c *cliConfig) checkRules(source string, rsConfig *ruleset.BuiltinConfig) (int, []error) {
+	rules, _, err := c.loadRules(source)
+	if err != nil {
+		return 0, []error{err}
+	}
+	var lines []int
+	if !ruleset.IsRemoteSource(source) {
+		lines = ruleLines(source)
+	}
+	locate := func(i int, name string) string {
+		if i < len(lines) {
+			return fmt.Sprintf("line %d: rule #%d (%s)", lines[i], i+1, name)
+		}
+		return fmt.Sprintf("rule #%d (%s)", i+1, name)
+	}
+	result, err := ruleset.LintExprRules(rules, analyzers, modifiers, rsConfig)
+	if err != nil {
+		return len(rules), []error{err}
+	}
+	var errs []error
+	for _, issue := range result.Issues {
+		// Every analyzer is enabled, so an unknown one is a typo
+		if issue.Severity == ruleset.LintError || issue.Analyzer != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", locate(issue.Index, issue.Rule), issue.Message))
+		}
+	}
+	if len(errs) == 0 {
+		// What linting doesn't do, like loading the geo databases
+		if _, err := ruleset.CompileExprRules(rules, analyzers, modifiers, rsConfig); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return len(rules), errs
+}
+
+// ruleLines returns the line of each rule of a rule file, nil if it can't be parsed.
+func ruleLines(file string) []int {
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	var nodes []yaml.Node
+	if err := yaml.Unmarshal(bs, &nodes); err != nil {
+		return nil
+	}
+	lines := make([]int, len(nodes))
+	for i, n := range nodes {
+		lines[i] = n.Line
+	}
+	return lines
+}
@@ -0,0 +1,388 @@
+package cmd
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// The config types are all in root.go, whose doc comments are the descriptions of the generated config & schema
+//
+//go:embed root.go
+var configSource []byte
+
+const (
+	jsonSchemaDraft = "http://json-schema.org/draft-07/schema#"
+	// Go durations (as parsed by time.ParseDuration), integers are nanoseconds
+	durationPattern = `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+	// Values of the config can be references to environment variables & files, see readConfig
+	configRefPattern = `\$\{`
+)
+
+// Flags
+var schemaRuleset bool
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "config-schema [flags]",
+	Short: "Print the JSON Schema of the config file, or of the rule files",
+	Long: "Print the JSON Schema (draft-07) of the config file, or with --ruleset of the rule files, " +
+		"so that editors can validate and autocomplete them. It is generated from the types the files are read into.",
+	Args: cobra.NoArgs,
+	Run:  runConfigSchema,
+}
+
+var generateConfigCmd = &cobra.Command{
+	Use:   "generate-config",
+	Short: "Print a config file with every option, commented out and described",
+	Long: "Print a config file with every option, commented out and described. As is, it's the default config: " +
+		"remove the \"# \" in front of an option (and of the sections it's in) to set it.",
+	Args: cobra.NoArgs,
+	Run:  runGenerateConfig,
+}
+
+func init() {
+	configSchemaCmd.Flags().BoolVar(&schemaRuleset, "ruleset", false, "print the schema of the rule files instead")
+	rootCmd.AddCommand(configSchemaCmd, generateConfigCmd)
+}
+
+func runConfigSchema(cmd *cobra.Command, args []string) {
+	docs, err := loadConfigDocs()
+	if err != nil {
+		logger.Fatal("failed to parse the config types", zap.Error(err))
+	}
+	var schema map[string]interface{}
+	if schemaRuleset {
+		g := &schemaGenerator{Tag: "yaml", Docs: docs}
+		schema = g.Schema(reflect.TypeOf([]ruleset.ExprRule(nil)))
+		schema["title"] = "OpenGFW rules"
+	} else {
+		g := &schemaGenerator{Tag: "mapstructure", Docs: docs, Refs: true}
+		schema = g.Schema(reflect.TypeOf(cliConfig{}))
+		schema["title"] = "OpenGFW config"
+	}
+	schema["$schema"] = jsonSchemaDraft
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(schema)
+}
+
+func runGenerateConfig(cmd *cobra.Command, args []string) {
+	docs, err := loadConfigDocs()
+	if err != nil {
+		logger.Fatal("failed to parse the config types", zap.Error(err))
+	}
+	var b strings.Builder
+	b.WriteString("## OpenGFW config, generated by \"opengfw generate-config\".\n")
+	b.WriteString("## Every option is commented out with its zero value, which for most of them means the default.\n")
+	b.WriteString("## Remove the \"# \" in front of an option, and of the sections it's in, to set it.\n\n")
+	g := &configGenerator{Docs: docs}
+	g.writeFields(&b, reflect.TypeOf(cliConfig{}), "", false)
+	fmt.Print(b.String())
+}
+
+// typeDocs are the doc comments of the types of a package, by type name.
+type typeDocs map[string]*typeDoc
+
+type typeDoc struct {
+	Doc    string
+	Fields map[string]fieldDoc // By field name
+}
+
+type fieldDoc struct {
+	Doc     string
+	Section string // Comment above the field that isn't about it, e.g. "// Kafka"
+}
+
+// configDocs are the doc comments of the config & rule file types, by package path.
+type configDocs map[string]typeDocs
+
+func loadConfigDocs() (configDocs, error) {
+	docs := configDocs{}
+	cmdDocs, err := parseTypeDocs(map[string][]byte{"root.go": configSource})
+	if err != nil {
+		return nil, err
+	}
+	docs[reflect.TypeOf(cliConfig{}).PkgPath()] = cmdDocs
+	files := make(map[string][]byte)
+	err = fs.WalkDir(ruleset.Sources, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		files[path], err = fs.ReadFile(ruleset.Sources, path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rulesetDocs, err := parseTypeDocs(files)
+	if err != nil {
+		return nil, err
+	}
+	docs[reflect.TypeOf(ruleset.ExprRule{}).PkgPath()] = rulesetDocs
+	return docs, nil
+}
+
+// parseTypeDocs returns the doc comments of the struct types in the source files of a package.
+func parseTypeDocs(files map[string][]byte) (typeDocs, error) {
+	docs := typeDocs{}
+	fset := token.NewFileSet()
+	for name, src := range files {
+		f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				doc := ts.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				td := &typeDoc{Doc: typeDocText(ts.Name.Name, doc.Text()), Fields: make(map[string]fieldDoc)}
+				for _, field := range st.Fields.List {
+					for _, fieldName := range fieldNames(field) {
+						fd := fieldDoc{Doc: strings.TrimSpace(field.Comment.Text())}
+						if text := strings.TrimSpace(field.Doc.Text()); strings.HasPrefix(text, fieldName+" ") || strings.HasPrefix(text, fieldName+",") {
+							fd.Doc = typeDocText(fieldName, text)
+						} else if text != "" {
+							fd.Section = text
+						}
+						td.Fields[fieldName] = fd
+					}
+				}
+				docs[ts.Name.Name] = td
+			}
+		}
+	}
+	return docs, nil
+}
+
+func fieldNames(field *ast.Field) []string {
+	if len(field.Names) == 0 {
+		// Embedded
+		if ident, ok := field.Type.(*ast.Ident); ok {
+			return []string{ident.Name}
+		}
+		return nil
+	}
+	names := make([]string, len(field.Names))
+	for i, name := range field.Names {
+		names[i] = name.Name
+	}
+	return names
+}
+
+// typeDocText turns "cliConfigX is the thing." into "The thing.", and "cliConfigX does it." into "Does it."
+// Field docs are only turned into a sentence without their name if it's followed by "is".
+func typeDocText(name, doc string) string {
+	doc = strings.TrimSpace(doc)
+	if rest, ok := strings.CutPrefix(doc, name+" is "); ok {
+		return sentence(rest)
+	}
+	if rest, ok := strings.CutPrefix(doc, name+" "); ok && unicode.IsLower([]rune(name)[0]) {
+		return sentence(rest)
+	}
+	return doc
+}
+
+func sentence(s string) string {
+	for i, r := range s {
+		return string(unicode.ToUpper(r)) + s[i+len(string(r)):]
+	}
+	return s
+}
+
+// Get returns the doc comments of a type, or nil if there are none.
+func (d configDocs) Get(t reflect.Type) *typeDoc {
+	return d[t.PkgPath()][t.Name()]
+}
+
+// configField is a key of a config or rule file, read into a field of a struct.
+type configField struct {
+	Key     string
+	Type    reflect.Type
+	Doc     string
+	Section string
+}
+
+// configFields returns the keys of a struct type, by the given tag, with the fields of the embedded structs
+// that are squashed (mapstructure) or inlined (yaml) into it.
+func configFields(t reflect.Type, tag string, docs configDocs) []configField {
+	var fields []configField
+	td := docs.Get(t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && (opts == "squash" || opts == "inline") {
+			fields = append(fields, configFields(f.Type, tag, docs)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		field := configField{Key: name, Type: f.Type}
+		if td != nil {
+			field.Doc, field.Section = td.Fields[f.Name].Doc, td.Fields[f.Name].Section
+		}
+		if field.Doc == "" {
+			if ftd := docs.Get(indirectType(f.Type)); ftd != nil {
+				field.Doc = ftd.Doc
+			}
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// schemaGenerator generates the JSON Schema of the type a file is read into.
+type schemaGenerator struct {
+	Tag  string // Of the struct fields with the keys, mapstructure or yaml
+	Docs configDocs
+	Refs bool // Whether values of any type can be references, which are strings
+}
+
+func (g *schemaGenerator) Schema(t reflect.Type) map[string]interface{} {
+	t = indirectType(t)
+	var s map[string]interface{}
+	switch {
+	case t == durationType:
+		s = map[string]interface{}{"type": []string{"string", "integer"}, "pattern": durationPattern}
+	case t == timeType:
+		s = map[string]interface{}{"type": "string", "format": "date-time"}
+	default:
+		s = g.kindSchema(t)
+	}
+	if g.Refs && s["type"] != nil && s["type"] != "string" && s["type"] != "object" && s["type"] != "array" {
+		return map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "string", "pattern": configRefPattern}}}
+	}
+	return s
+}
+
+func (g *schemaGenerator) kindSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s := map[string]interface{}{"type": "integer"}
+		if bits := t.Bits(); bits < 64 {
+			s["minimum"], s["maximum"] = -(int64(1) << (bits - 1)), int64(1)<<(bits-1)-1
+		}
+		return s
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s := map[string]interface{}{"type": "integer", "minimum": 0}
+		if bits := t.Bits(); bits < 64 {
+			s["maximum"] = uint64(1)<<bits - 1
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.Schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.Schema(t.Elem())}
+	case reflect.Struct:
+		props := make(map[string]interface{})
+		for _, f := range configFields(t, g.Tag, g.Docs) {
+			ps := g.Schema(f.Type)
+			if f.Doc != "" {
+				ps["description"] = strings.ReplaceAll(f.Doc, "\n", " ")
+			}
+			props[f.Key] = ps
+		}
+		s := map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+		if td := g.Docs.Get(t); td != nil && td.Doc != "" {
+			s["description"] = strings.ReplaceAll(td.Doc, "\n", " ")
+		}
+		return s
+	default:
+		// interface{}, anything
+		return map[string]interface{}{}
+	}
+}
+
+// configGenerator generates a config file with every key of a type commented out.
+// Descriptions start with "## ", keys with "# " after the indentation.
+type configGenerator struct {
+	Docs configDocs
+}
+
+// writeFields writes the keys of a struct type. If item is true, they are an item of a list,
+// and the first key is prefixed with "- ".
+func (g *configGenerator) writeFields(b *strings.Builder, t reflect.Type, indent string, item bool) {
+	for i, f := range configFields(t, "mapstructure", g.Docs) {
+		if f.Section != "" {
+			fmt.Fprintf(b, "%s## --- %s ---\n", indent, f.Section)
+		}
+		for _, line := range strings.Split(f.Doc, "\n") {
+			if line != "" {
+				fmt.Fprintf(b, "%s## %s\n", indent, line)
+			}
+		}
+		prefix := indent + "# "
+		if item && i == 0 {
+			prefix = indent[:len(indent)-2] + "# - "
+		}
+		ft := indirectType(f.Type)
+		switch {
+		case ft == durationType:
+			fmt.Fprintf(b, "%s%s: 0s\n", prefix, f.Key)
+		case ft.Kind() == reflect.Struct:
+			fmt.Fprintf(b, "%s%s:\n", prefix, f.Key)
+			g.writeFields(b, ft, indent+"  ", false)
+		case ft.Kind() == reflect.Slice && indirectType(ft.Elem()).Kind() == reflect.Struct:
+			fmt.Fprintf(b, "%s%s:\n", prefix, f.Key)
+			g.writeFields(b, indirectType(ft.Elem()), indent+"    ", true)
+		case ft.Kind() == reflect.Slice:
+			fmt.Fprintf(b, "%s%s: []\n", prefix, f.Key)
+		case ft.Kind() == reflect.Map, ft.Kind() == reflect.Interface:
+			fmt.Fprintf(b, "%s%s: {}\n", prefix, f.Key)
+		case ft.Kind() == reflect.String:
+			fmt.Fprintf(b, "%s%s: \"\"\n", prefix, f.Key)
+		default:
+			fmt.Fprintf(b, "%s%s: %v\n", prefix, f.Key, reflect.Zero(ft).Interface())
+		}
+		if indent == "" {
+			b.WriteString("\n")
+		}
+	}
+}
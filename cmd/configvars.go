@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	configRefRegexp     = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+	configEnvNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// readConfig reads the config file, and expands the references in its values, so that it can be
+// committed without secrets:
+//   - ${VAR} is the environment variable VAR, which must be set
+//   - ${VAR:-default} is default if VAR is unset or empty
+//   - ${file:/run/secrets/token} is the content of the file, without trailing newlines
+//   - $${ is a literal ${
+func readConfig() error {
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	settings := viper.AllSettings()
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expanded, err := expandConfigValue(key, settings[key])
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(expanded, settings[key]) {
+			viper.Set(key, expanded)
+		}
+	}
+	return nil
+}
+
+// expandConfigValue expands the references in the strings of a value from the config,
+// at path (e.g. sinks[0].token) for errors.
+func expandConfigValue(path string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		s, err := expandConfigString(v)
+		if err != nil {
+			return nil, configError{Field: path, Err: err}
+		}
+		return s, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			expanded, err := expandConfigValue(path+"."+key, item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = expanded
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded, err := expandConfigValue(fmt.Sprintf("%s[%d]", path, i), item)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = expanded
+		}
+		return l, nil
+	default:
+		return value, nil
+	}
+}
+
+func expandConfigString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	s = configRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" || err != nil {
+			return "${"
+		}
+		var value string
+		value, err = resolveConfigRef(ref[2 : len(ref)-1])
+		return value
+	})
+	return s, err
+}
+
+func resolveConfigRef(ref string) (string, error) {
+	if file, ok := strings.CutPrefix(ref, "file:"); ok {
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(bs), "\r\n"), nil
+	}
+	name, def, hasDef := strings.Cut(ref, ":-")
+	if !configEnvNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid reference ${%s}", ref)
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDef && value == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", errors.New("environment variable " + name + " is not set")
+	}
+	return value, nil
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/sink"
+)
+
+// defaultConnLogIdleTimeout is the stream idle timeout used when the conn log is enabled
+// and workers.idleTimeout isn't set. Accepted streams are offloaded to the kernel,
+// so without it they would never end.
+const defaultConnLogIdleTimeout = 5 * time.Minute
+
+// connLog writes one record per ended stream, in the spirit of Zeek's conn.log: its addresses,
+// duration, byte & packet counts, detected service, and the actions issued for it.
+// Unlike the event log, every stream gets exactly one record, whether a rule matched it or not,
+// for network accounting. A nil *connLog does nothing.
+type connLog struct {
+	File  *sink.File
+	GeoIP *geoIP // Optional
+}
+
+type connRecord struct {
+	TS          float64        `json:"ts"` // Start, seconds since the epoch
+	UID         int64          `json:"uid"`
+	FlowUUID    string         `json:"flow_uuid,omitempty"`
+	OrigH       string         `json:"id.orig_h"`
+	OrigP       uint16         `json:"id.orig_p"`
+	RespH       string         `json:"id.resp_h"`
+	RespP       uint16         `json:"id.resp_p"`
+	Proto       string         `json:"proto"`
+	Service     string         `json:"service,omitempty"`
+	Duration    float64        `json:"duration"` // Seconds, until the latest packet
+	OrigPkts    uint64         `json:"orig_pkts"`
+	OrigIPBytes uint64         `json:"orig_ip_bytes"`
+	RespPkts    uint64         `json:"resp_pkts"`
+	RespIPBytes uint64         `json:"resp_ip_bytes"`
+	InIface     string         `json:"in_iface,omitempty"`
+	OutIface    string         `json:"out_iface,omitempty"`
+	Direction   string         `json:"direction,omitempty"`
+	IO          string         `json:"io,omitempty"`
+	OrigGeo     *geoInfo       `json:"orig_geo,omitempty"`
+	RespGeo     *geoInfo       `json:"resp_geo,omitempty"`
+	EndReason   string         `json:"end_reason"`
+	Verdict     string         `json:"verdict"` // Of the latest packet
+	Rules       []string       `json:"rules,omitempty"`
+	History     []connHistItem `json:"verdict_history,omitempty"`
+}
+
+type connHistItem struct {
+	TS     float64 `json:"ts"`
+	Action string  `json:"action"`
+	Rule   string  `json:"rule,omitempty"`
+}
+
+func newConnLog(config sink.FileConfig) (*connLog, error) {
+	f, err := sink.NewFile(config)
+	if err != nil {
+		return nil, err
+	}
+	return &connLog{File: f}, nil
+}
+
+// Reopen reopens the file, for log rotation.
+func (l *connLog) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	return l.File.Reopen()
+}
+
+// Check returns the error of the latest write.
+func (l *connLog) Check() error {
+	if l == nil {
+		return nil
+	}
+	return l.File.Check()
+}
+
+func (l *connLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.File.Close()
+}
+
+func (l *connLog) StreamEnd(end engine.StreamEnd) {
+	if l == nil {
+		return
+	}
+	info := end.Info
+	r := connRecord{
+		TS:          epochSeconds(info.Counters.StartTime),
+		UID:         info.ID,
+		FlowUUID:    info.UUID,
+		OrigH:       info.SrcIP.String(),
+		OrigP:       info.SrcPort,
+		RespH:       info.DstIP.String(),
+		RespP:       info.DstPort,
+		Proto:       info.Protocol.String(),
+		Service:     eveAppProto(info.Props),
+		OrigPkts:    info.Counters.SrcPackets,
+		OrigIPBytes: info.Counters.SrcBytes,
+		RespPkts:    info.Counters.DstPackets,
+		RespIPBytes: info.Counters.DstBytes,
+		InIface:     info.InInterface,
+		OutIface:    info.OutInterface,
+		Direction:   string(info.Direction),
+		IO:          info.IO,
+		OrigGeo:     l.GeoIP.Lookup(info.SrcIP),
+		RespGeo:     l.GeoIP.Lookup(info.DstIP),
+		EndReason:   end.Reason.String(),
+		Verdict:     otlpVerdictNames[end.Verdict],
+	}
+	if end.LastSeen.After(info.Counters.StartTime) {
+		r.Duration = end.LastSeen.Sub(info.Counters.StartTime).Seconds()
+	}
+	for _, a := range end.Actions {
+		r.History = append(r.History, connHistItem{
+			TS:     epochSeconds(a.Time),
+			Action: a.Action.String(),
+			Rule:   a.Rule,
+		})
+		if a.Rule != "" && !slices.Contains(r.Rules, a.Rule) {
+			r.Rules = append(r.Rules, a.Rule)
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	l.File.Send(sink.Event{Type: "conn", Time: end.LastSeen, Data: data})
+}
+
+func epochSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
@@ -0,0 +1,360 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	controllerConnectPath           = "/opengfw.v1.Controller/Connect"
+	controllerDefaultStatusInterval = 30 * time.Second
+	controllerMinBackoff            = time.Second
+	controllerMaxBackoff            = time.Minute
+)
+
+// controllerClient connects out to a central controller, for fleets of instances managed from one place,
+// see docs/controller.proto for the protocol. The controller pushes rulesets & set contents, which must be
+// signed with its ed25519 key on top of the mTLS connection, and receives the health & statistics
+// of the instance. The connection is reopened, with a backoff, until the context is cancelled.
+type controllerClient struct {
+	URL            string      // https://host:port
+	ID             string      // Of this instance
+	TLS            *tls.Config // With the client certificate
+	PublicKey      string      // Base64 ed25519 key the updates are signed with
+	StatusInterval time.Duration
+	Rulesets       *rulesetManager
+	Sets           *builtins.SetStore
+	Engine         engine.Engine
+	Health         *healthChecker
+	Audit          *auditLog // Optional
+}
+
+func (c *controllerClient) Run(ctx context.Context) {
+	transport := &http2.Transport{TLSClientConfig: c.TLS}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	backoff := controllerMinBackoff
+	for {
+		start := time.Now()
+		err := c.connect(ctx, client)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > controllerMaxBackoff {
+			// Was connected for a while, not a persistent failure
+			backoff = controllerMinBackoff
+		}
+		logger.Warn("controller connection lost, reconnecting", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, controllerMaxBackoff)
+	}
+}
+
+// connect runs a Connect call, until it fails or the context is cancelled.
+func (c *controllerClient) connect(ctx context.Context, client *http.Client) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+controllerConnectPath, pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	var sendMutex sync.Mutex
+	send := func(msg []byte) error {
+		sendMutex.Lock()
+		defer sendMutex.Unlock()
+		return writeGRPCFrame(pw, msg)
+	}
+	// The request is streamed while waiting for the response headers, which the controller
+	// may only send with its first update
+	go func() {
+		err := send(c.hello())
+		ticker := time.NewTicker(c.StatusInterval)
+		defer ticker.Stop()
+		for err == nil {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-ticker.C:
+				err = send(c.status(ctx))
+			}
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if err := grpcStatusError(resp.Header); err != nil {
+		// Trailers-only response
+		return err
+	}
+	logger.Info("connected to controller", zap.String("url", c.URL))
+	for {
+		msg, err := readGRPCFrame(resp.Body)
+		if err == io.EOF {
+			if err := grpcStatusError(resp.Trailer); err != nil {
+				return err
+			}
+			return errors.New("closed by the controller")
+		} else if err != nil {
+			return err
+		}
+		if err := send(c.handle(msg)); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcStatusError returns the error in the gRPC status of a response, nil if there is none or it's OK.
+func grpcStatusError(h http.Header) error {
+	code := h.Get("Grpc-Status")
+	if code == "" || code == "0" {
+		return nil
+	}
+	return fmt.Errorf("grpc status %s: %s", code, h.Get("Grpc-Message"))
+}
+
+// hello encodes the first AgentMessage of a connection.
+func (c *controllerClient) hello() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, c.ID)
+	if v := c.currentVersion(); v.Hash != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, v.Hash)
+	}
+	for _, set := range c.Sets.Sets() {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, set.Name())
+	}
+	return controllerAgentMessage(1, b)
+}
+
+// status encodes a Status AgentMessage, with the readiness checks and the engine statistics.
+func (c *controllerClient) status(ctx context.Context) []byte {
+	checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	report := c.Health.Readiness(checkCtx)
+	cancel()
+	stats := c.Engine.Stats()
+	v := c.currentVersion()
+
+	var b []byte
+	appendVarint := func(num protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+	appendString := func(num protowire.Number, s string) {
+		if s != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	appendVarint(1, uint64(time.Now().UnixNano()))
+	appendString(2, report.Status)
+	for _, check := range report.Checks {
+		var cb []byte
+		cb = protowire.AppendTag(cb, 1, protowire.BytesType)
+		cb = protowire.AppendString(cb, check.Name)
+		cb = protowire.AppendTag(cb, 2, protowire.VarintType)
+		cb = protowire.AppendVarint(cb, protowire.EncodeBool(check.OK))
+		cb = protowire.AppendTag(cb, 3, protowire.VarintType)
+		cb = protowire.AppendVarint(cb, protowire.EncodeBool(check.Optional))
+		if check.Error != "" {
+			cb = protowire.AppendTag(cb, 4, protowire.BytesType)
+			cb = protowire.AppendString(cb, check.Error)
+		}
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, cb)
+	}
+	appendVarint(4, uint64(v.ID))
+	appendString(5, v.Hash)
+	appendVarint(6, stats.Packets)
+	appendVarint(7, stats.TCPStreams)
+	appendVarint(8, stats.UDPStreams)
+	appendVarint(9, stats.ActiveTCPStreams)
+	appendVarint(10, stats.ActiveUDPStreams)
+	appendVarint(11, stats.QueueLength)
+	appendVarint(12, stats.QueueFull)
+	return controllerAgentMessage(2, b)
+}
+
+func (c *controllerClient) currentVersion() rulesetVersion {
+	versions, current := c.Rulesets.Versions()
+	for _, v := range versions {
+		if v.ID == current {
+			return v
+		}
+	}
+	return rulesetVersion{}
+}
+
+// handle applies a ControllerMessage, and returns the UpdateResult AgentMessage to send back.
+func (c *controllerClient) handle(msg []byte) []byte {
+	var id uint64
+	var err error
+	decodeErr := decodeProto(msg, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			id, err = c.applyRuleset(v)
+		case 2:
+			id, err = c.applySet(v)
+		}
+		return nil
+	})
+	if decodeErr != nil {
+		err = decodeErr
+	}
+	var b []byte
+	if id != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, id)
+	}
+	if err != nil {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, err.Error())
+	}
+	if v := c.currentVersion(); v.Hash != "" {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, v.Hash)
+	}
+	return controllerAgentMessage(3, b)
+}
+
+// applyRuleset verifies and applies a RulesetUpdate, and returns its ID.
+func (c *controllerClient) applyRuleset(msg []byte) (uint64, error) {
+	var id uint64
+	var rules, sig []byte
+	err := decodeProto(msg, func(num protowire.Number, _ protowire.Type, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			id = x
+		case 2:
+			rules = v
+		case 3:
+			sig = v
+		}
+		return nil
+	})
+	if err != nil {
+		return id, err
+	}
+	if err := ruleset.VerifySignature(rules, sig, c.PublicKey); err != nil {
+		logger.Error("rejected ruleset from controller", zap.Uint64("id", id), zap.Error(err))
+		return id, err
+	}
+	err = c.Rulesets.Push(rules, "controller")
+	if errors.Is(err, errRulesetUnchanged) {
+		logger.Debug("ruleset from controller unchanged", zap.Uint64("id", id))
+		return id, nil
+	} else if err != nil {
+		logger.Error("failed to apply ruleset from controller, using old rules", zap.Uint64("id", id), zap.Error(err))
+		return id, err
+	}
+	logger.Info("ruleset from controller applied", zap.Uint64("id", id))
+	return id, nil
+}
+
+// applySet verifies and applies a SetUpdate, and returns its ID.
+func (c *controllerClient) applySet(msg []byte) (uint64, error) {
+	var id uint64
+	var name string
+	var entries, sig []byte
+	err := decodeProto(msg, func(num protowire.Number, _ protowire.Type, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			id = x
+		case 2:
+			name = string(v)
+		case 3:
+			entries = v
+		case 4:
+			sig = v
+		}
+		return nil
+	})
+	if err != nil {
+		return id, err
+	}
+	// The name is signed too, so that the entries of a set can't be replayed to another
+	signed := append(append([]byte(name), '\n'), entries...)
+	if err := ruleset.VerifySignature(signed, sig, c.PublicKey); err != nil {
+		logger.Error("rejected set from controller", zap.Uint64("id", id), zap.String("set", name), zap.Error(err))
+		return id, err
+	}
+	set := c.Sets.Get(name)
+	if set == nil {
+		return id, fmt.Errorf("set %q not found", name)
+	}
+	var values []string
+	for _, line := range bytes.Split(entries, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			values = append(values, string(line))
+		}
+	}
+	record := auditRecord{
+		Who:     "controller",
+		Action:  "set.replace",
+		Target:  name,
+		Summary: fmt.Sprintf("%d entries", len(values)),
+	}
+	if err := set.Replace(values); err != nil {
+		record.Summary, record.Error = "failed, set unchanged", err.Error()
+		c.Audit.Record(record)
+		logger.Error("failed to apply set from controller", zap.Uint64("id", id), zap.String("set", name), zap.Error(err))
+		return id, err
+	}
+	c.Audit.Record(record)
+	logger.Info("set from controller applied", zap.Uint64("id", id), zap.String("set", name), zap.Int("entries", len(values)))
+	return id, nil
+}
+
+func controllerAgentMessage(num protowire.Number, msg []byte) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// controllerID returns the ID of this instance for the controller: the configured one, or the hostname.
+func controllerID(id string) string {
+	if id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
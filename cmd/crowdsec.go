@@ -0,0 +1,492 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+const (
+	crowdSecDefaultInterval       = 10 * time.Second
+	crowdSecDefaultReportInterval = 30 * time.Second
+	crowdSecDefaultDuration       = 4 * time.Hour
+	crowdSecRequestTimeout        = 30 * time.Second
+	crowdSecMaxQueue              = 10000 // IPs & rules pending
+	crowdSecMaxEvents             = 10    // Sent per alert
+	crowdSecScenarioPrefix        = "opengfw/"
+)
+
+// crowdSecDecision is a decision of the stream of the local API.
+type crowdSecDecision struct {
+	ID       int64  `json:"id"`
+	Origin   string `json:"origin"`
+	Type     string `json:"type"`
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	Duration string `json:"duration"`
+	Scenario string `json:"scenario"`
+}
+
+// crowdSecBouncer pulls the decisions of the CrowdSec local API, like a bouncer, into an IP set,
+// so that the rules can block the IPs the community (or the local agents) reported.
+// The first pull gets all the active decisions, the following ones the changes since the previous one.
+// Only the decisions on IPs & ranges of the configured types (ban by default) are added,
+// each entry expiring with the latest of its decisions, and removed when none is left.
+// The set should be dedicated to it, as the entries added by other means may be removed with the decisions.
+type crowdSecBouncer struct {
+	URL      string
+	Client   *http.Client
+	APIKey   string
+	Set      *builtins.Set
+	Types    map[string]bool
+	Interval time.Duration
+
+	mutex     sync.Mutex
+	decisions map[string]map[int64]time.Time // Value -> decision ID -> expiry
+	synced    bool                           // The active decisions have been pulled
+	lastErr   error
+}
+
+func newCrowdSecBouncer(u string, client *http.Client, apiKey string, set *builtins.Set, types []string, interval time.Duration) *crowdSecBouncer {
+	b := &crowdSecBouncer{
+		URL:       strings.TrimSuffix(u, "/"),
+		Client:    client,
+		APIKey:    apiKey,
+		Set:       set,
+		Types:     make(map[string]bool, len(types)),
+		Interval:  interval,
+		decisions: make(map[string]map[int64]time.Time),
+	}
+	for _, t := range types {
+		b.Types[strings.ToLower(t)] = true
+	}
+	return b
+}
+
+// Run pulls the decisions every Interval until the context is cancelled.
+func (b *crowdSecBouncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+	for {
+		if err := b.Pull(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to pull crowdsec decisions", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pull gets the new & deleted decisions from the local API, and applies them to the set.
+func (b *crowdSecBouncer) Pull(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, crowdSecRequestTimeout)
+	defer cancel()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	query := url.Values{
+		"startup": {fmt.Sprint(!b.synced)},
+		"scopes":  {"ip,range"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL+"/v1/decisions/stream?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", b.APIKey)
+	var stream struct {
+		New     []crowdSecDecision `json:"new"`
+		Deleted []crowdSecDecision `json:"deleted"`
+	}
+	b.lastErr = crowdSecDo(b.Client, req, &stream)
+	if b.lastErr != nil {
+		return b.lastErr
+	}
+	b.synced = true
+	now := time.Now()
+	changed := make(map[string]bool)
+	for _, d := range stream.Deleted {
+		if ids := b.decisions[d.Value]; ids != nil {
+			delete(ids, d.ID)
+			changed[d.Value] = true
+		}
+	}
+	for _, d := range stream.New {
+		if !b.Types[strings.ToLower(d.Type)] {
+			continue
+		}
+		duration, err := time.ParseDuration(d.Duration)
+		if err != nil || duration <= 0 {
+			continue
+		}
+		ids := b.decisions[d.Value]
+		if ids == nil {
+			ids = make(map[int64]time.Time)
+			b.decisions[d.Value] = ids
+		}
+		ids[d.ID] = now.Add(duration)
+		changed[d.Value] = true
+	}
+	added, removed := 0, 0
+	for value := range changed {
+		var expiry time.Time
+		for id, exp := range b.decisions[value] {
+			if !exp.After(now) {
+				delete(b.decisions[value], id)
+			} else if exp.After(expiry) {
+				expiry = exp
+			}
+		}
+		if expiry.IsZero() {
+			delete(b.decisions, value)
+			if n, _ := b.Set.Remove([]string{value}); n > 0 {
+				removed++
+			}
+			continue
+		}
+		if err := b.Set.Add([]string{value}, expiry.Sub(now)); err != nil {
+			logger.Warn("invalid crowdsec decision", zap.String("value", value), zap.Error(err))
+			delete(b.decisions, value)
+			continue
+		}
+		added++
+	}
+	if added > 0 || removed > 0 {
+		logger.Info("crowdsec decisions pulled", zap.String("set", b.Set.Name()),
+			zap.Int("added", added), zap.Int("removed", removed))
+	}
+	return nil
+}
+
+// Check returns the error of the latest pull, for readiness: the set may be out of date.
+func (b *crowdSecBouncer) Check() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.lastErr != nil {
+		return fmt.Errorf("failed to pull decisions: %w", b.lastErr)
+	}
+	return nil
+}
+
+// crowdSecReporter reports the streams blocked by the rules to the CrowdSec local API as alerts,
+// with a decision banning the destination (or source) IP, so that the other bouncers of
+// the installation (and the community, if it's enrolled) benefit from them.
+// The blocks are batched, one alert per IP & rule, with the scenario "opengfw/<rule>".
+// An IP isn't reported again until its decision expires, nor if it's already in the set
+// of the bouncer, as it's a decision of CrowdSec itself. Non-public IPs are never reported.
+// A nil *crowdSecReporter reports nothing.
+type crowdSecReporter struct {
+	URL       string
+	Client    *http.Client
+	MachineID string
+	Password  string
+	Rules     map[string]bool // Empty = all
+	Source    bool            // Report the source IP instead of the destination
+	Duration  time.Duration
+	Interval  time.Duration
+	Decisions *builtins.Set // Of the bouncer, optional
+
+	mutex    sync.Mutex
+	pending  map[crowdSecReportKey]*crowdSecReport
+	reported map[string]time.Time // IP -> expiry of its decision
+	token    string
+	expire   time.Time
+	lastErr  error
+}
+
+type crowdSecReportKey struct {
+	IP   string
+	Rule string
+}
+
+type crowdSecReport struct {
+	Start, Stop time.Time
+	Events      []crowdSecEvent // The first few
+	Count       int
+}
+
+type crowdSecEvent struct {
+	Time time.Time
+	Meta map[string]string
+}
+
+func newCrowdSecReporter(u string, client *http.Client, machineID, password string, rules []string,
+	source bool, duration, interval time.Duration, decisions *builtins.Set,
+) *crowdSecReporter {
+	r := &crowdSecReporter{
+		URL:       strings.TrimSuffix(u, "/"),
+		Client:    client,
+		MachineID: machineID,
+		Password:  password,
+		Rules:     make(map[string]bool, len(rules)),
+		Source:    source,
+		Duration:  duration,
+		Interval:  interval,
+		Decisions: decisions,
+		pending:   make(map[crowdSecReportKey]*crowdSecReport),
+		reported:  make(map[string]time.Time),
+	}
+	for _, rule := range rules {
+		r.Rules[rule] = true
+	}
+	return r
+}
+
+// StreamAction queues a report if the action blocks the stream.
+func (r *crowdSecReporter) StreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	if r == nil || noMatch {
+		return
+	}
+	if action != ruleset.ActionBlock && action != ruleset.ActionDrop {
+		return
+	}
+	if len(r.Rules) > 0 && !r.Rules[rule] {
+		return
+	}
+	ip := info.DstIP
+	if r.Source {
+		ip = info.SrcIP
+	} else if _, isDNS := streamDomain(info.Props); isDNS {
+		// The destination is the resolver
+		return
+	}
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return
+	}
+	value := ip.String()
+	if r.Decisions != nil && r.Decisions.Contains(value) {
+		return
+	}
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if exp, ok := r.reported[value]; ok && now.Before(exp) {
+		return
+	}
+	key := crowdSecReportKey{IP: value, Rule: rule}
+	rep := r.pending[key]
+	if rep == nil {
+		if len(r.pending) >= crowdSecMaxQueue {
+			return
+		}
+		rep = &crowdSecReport{Start: now}
+		r.pending[key] = rep
+	}
+	rep.Stop = now
+	rep.Count++
+	if len(rep.Events) < crowdSecMaxEvents {
+		meta := map[string]string{
+			"proto": info.Protocol.String(),
+			"src":   info.SrcString(),
+			"dst":   info.DstString(),
+		}
+		if domain, _ := streamDomain(info.Props); domain != "" {
+			meta["domain"] = domain
+		}
+		rep.Events = append(rep.Events, crowdSecEvent{Time: now, Meta: meta})
+	}
+}
+
+// Run sends the queued reports every Interval until the context is cancelled.
+func (r *crowdSecReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.Flush(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to report blocks to crowdsec", zap.Error(err))
+		}
+	}
+}
+
+// Flush sends the queued reports as alerts. They're dropped if the local API rejects them,
+// but the IPs can be queued again by the next blocks.
+func (r *crowdSecReporter) Flush(ctx context.Context) error {
+	now := time.Now()
+	r.mutex.Lock()
+	pending := r.pending
+	r.pending = make(map[crowdSecReportKey]*crowdSecReport)
+	for ip, exp := range r.reported {
+		if !now.Before(exp) {
+			delete(r.reported, ip)
+		}
+	}
+	for key := range pending {
+		r.reported[key.IP] = now.Add(r.Duration)
+	}
+	r.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	alerts := make([]map[string]any, 0, len(pending))
+	for key, rep := range pending {
+		scenario := crowdSecScenarioPrefix + key.Rule
+		events := make([]map[string]any, len(rep.Events))
+		for i, ev := range rep.Events {
+			var meta []map[string]string
+			for k, v := range ev.Meta {
+				meta = append(meta, map[string]string{"key": k, "value": v})
+			}
+			events[i] = map[string]any{"timestamp": ev.Time.Format(time.RFC3339), "meta": meta}
+		}
+		alerts = append(alerts, map[string]any{
+			"scenario":         scenario,
+			"scenario_hash":    "",
+			"scenario_version": "",
+			"message":          fmt.Sprintf("Ip %s blocked %d times by OpenGFW rule %s", key.IP, rep.Count, key.Rule),
+			"events_count":     rep.Count,
+			"start_at":         rep.Start.Format(time.RFC3339),
+			"stop_at":          rep.Stop.Format(time.RFC3339),
+			"capacity":         0,
+			"leakspeed":        "0",
+			"simulated":        false,
+			"events":           events,
+			"source": map[string]string{
+				"scope": "Ip",
+				"value": key.IP,
+				"ip":    key.IP,
+			},
+			"decisions": []map[string]any{{
+				"origin":   "crowdsec",
+				"type":     "ban",
+				"scope":    "Ip",
+				"value":    key.IP,
+				"duration": r.Duration.String(),
+				"scenario": scenario,
+			}},
+		})
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, crowdSecRequestTimeout)
+	defer cancel()
+	err = r.post(ctx, "/v1/alerts", body)
+	if err == errCrowdSecUnauthorized {
+		// The token was revoked or the local API restarted
+		r.mutex.Lock()
+		r.token = ""
+		r.mutex.Unlock()
+		err = r.post(ctx, "/v1/alerts", body)
+	}
+	r.mutex.Lock()
+	r.lastErr = err
+	if err != nil {
+		for key := range pending {
+			delete(r.reported, key.IP)
+		}
+	}
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	logger.Debug("blocks reported to crowdsec", zap.Int("alerts", len(alerts)))
+	return nil
+}
+
+// post sends an authenticated request to the local API, logging in first if needed.
+func (r *crowdSecReporter) post(ctx context.Context, path string, body []byte) error {
+	token, err := r.login(ctx)
+	if err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return crowdSecDo(r.Client, req, nil)
+}
+
+// login returns the token of the machine, logging in if there's none or it's about to expire.
+func (r *crowdSecReporter) login(ctx context.Context) (string, error) {
+	r.mutex.Lock()
+	token, expire := r.token, r.expire
+	r.mutex.Unlock()
+	if token != "" && time.Until(expire) > time.Minute {
+		return token, nil
+	}
+	body, _ := json.Marshal(map[string]string{
+		"machine_id": r.MachineID,
+		"password":   r.Password,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL+"/v1/watchers/login", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Token  string    `json:"token"`
+		Expire time.Time `json:"expire"`
+	}
+	if err := crowdSecDo(r.Client, req, &resp); err != nil {
+		return "", err
+	}
+	if resp.Token == "" {
+		return "", errors.New("no token in the response")
+	}
+	r.mutex.Lock()
+	r.token, r.expire = resp.Token, resp.Expire
+	r.mutex.Unlock()
+	return resp.Token, nil
+}
+
+// Check returns the error of the latest report, for readiness.
+func (r *crowdSecReporter) Check() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.lastErr != nil {
+		return fmt.Errorf("failed to report blocks: %w", r.lastErr)
+	}
+	return nil
+}
+
+var errCrowdSecUnauthorized = errors.New("unauthorized")
+
+// crowdSecDo sends a request to the local API, and decodes the JSON body of the response into v if it's not nil.
+func crowdSecDo(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return errCrowdSecUnauthorized
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(bs, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(bs))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, msg.Message)
+	}
+	if v == nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/apernet/OpenGFW/sink"
+)
+
+const (
+	dashboardPath   = "/ui/"
+	dashboardAlerts = 500 // Number of recent alerts kept
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardHandler serves the static files of the web dashboard, which gets its data from the API.
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	fileServer := http.StripPrefix(dashboardPath, http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, dashboardPath, http.StatusFound)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// GET /alerts?limit=50 returns the most recent alerts (eve records), newest first.
+func (s *apiServer) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	events := s.Alerts.Recent(limit)
+	records := make([]json.RawMessage, len(events))
+	for i, ev := range events {
+		records[i] = ev.Data
+	}
+	writeAPIJSON(w, http.StatusOK, records)
+}
+
+var _ sink.Sink = (*eventRing)(nil)
+
+// eventRing is an event sink that keeps the most recent events in memory.
+type eventRing struct {
+	mutex  sync.Mutex
+	events []sink.Event
+	next   int // Where the next event goes
+	full   bool
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]sink.Event, size)}
+}
+
+func (r *eventRing) Send(ev sink.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events[r.next] = ev
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns up to limit events (all if limit is 0), newest first.
+func (r *eventRing) Recent(limit int) []sink.Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.events)
+	}
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	events := make([]sink.Event, n)
+	for i := range events {
+		events[i] = r.events[(r.next-1-i+len(r.events))%len(r.events)]
+	}
+	return events
+}
+
+func (r *eventRing) Close() error {
+	return nil
+}
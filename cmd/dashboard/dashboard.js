@@ -0,0 +1,212 @@
+"use strict";
+
+// The dashboard polls the management API. If the API requires a token, it is asked for once
+// and kept in the browser's local storage.
+
+const refreshInterval = 3000;
+const topCount = 10;
+const tokenKey = "opengfw-token";
+
+async function api(path, options = {}) {
+  const headers = Object.assign({"Content-Type": "application/json"}, options.headers);
+  const token = localStorage.getItem(tokenKey);
+  if (token) {
+    headers["Authorization"] = "Bearer " + token;
+  }
+  const resp = await fetch(path, Object.assign({}, options, {headers}));
+  if (resp.status === 401) {
+    const t = prompt("API token");
+    if (t === null) {
+      throw new Error("unauthorized");
+    }
+    localStorage.setItem(tokenKey, t);
+    return api(path, options);
+  }
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return body;
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function row(cells) {
+  const tr = el("tr");
+  for (const c of cells) {
+    tr.appendChild(c instanceof Node ? c : el("td", c));
+  }
+  return tr;
+}
+
+function num(text) {
+  return el("td", text, "num");
+}
+
+function bar(value, max) {
+  const td = el("td", undefined, "bar");
+  const div = el("div");
+  div.style.width = (max > 0 ? (100 * value) / max : 0) + "%";
+  td.appendChild(div);
+  return td;
+}
+
+function fill(id, rows) {
+  const tbody = document.querySelector("#" + id + " tbody");
+  tbody.replaceChildren(...rows);
+}
+
+function formatBytes(n) {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function formatTime(t) {
+  const d = new Date(t);
+  return isNaN(d) || d.getFullYear() < 2000 ? "" : d.toLocaleString();
+}
+
+function streamBytes(s) {
+  return s.srcBytes + s.dstBytes;
+}
+
+function hostOf(addr) {
+  // "1.2.3.4:80" or "[2001:db8::1]:80"
+  const i = addr.lastIndexOf(":");
+  return addr.slice(0, i).replace(/^\[|\]$/g, "");
+}
+
+// top groups the streams by key, and returns the groups with the most bytes.
+function top(streams, keys) {
+  const groups = new Map();
+  for (const s of streams) {
+    for (const k of keys(s)) {
+      const g = groups.get(k) || {key: k, streams: 0, bytes: 0};
+      g.streams++;
+      g.bytes += streamBytes(s);
+      groups.set(k, g);
+    }
+  }
+  return [...groups.values()].sort((a, b) => b.bytes - a.bytes || b.streams - a.streams).slice(0, topCount);
+}
+
+function groupRows(groups) {
+  const max = groups.length > 0 ? groups[0].bytes : 0;
+  return groups.map((g) => row([g.key, num(g.streams), num(formatBytes(g.bytes)), bar(g.bytes, max)]));
+}
+
+function streamRows(streams) {
+  return streams.map((s) => {
+    const props = el("td");
+    if (Object.keys(s.props).length > 0) {
+      const details = el("details");
+      details.appendChild(el("summary", Object.keys(s.props).join(", ")));
+      details.appendChild(el("pre", JSON.stringify(s.props, null, 2)));
+      props.appendChild(details);
+    }
+    const verdict = el("td", s.verdict, s.verdict.startsWith("drop") || s.verdict.startsWith("divert") || s.verdict.startsWith("honeypot") ? "blocked" : "");
+    return row([
+      formatTime(s.startTime), s.src, s.dst, s.appProto || s.protocol,
+      num(formatBytes(streamBytes(s))), verdict, s.rule || "", props,
+    ]);
+  });
+}
+
+async function refreshStreams() {
+  const resp = await api("/streams");
+  const streams = resp.streams;
+  document.getElementById("summary").textContent = resp.total + " streams";
+  fill("classes", groupRows(top(streams, (s) => [s.appProto || s.protocol + " (unknown)"])));
+  fill("talkers", groupRows(top(streams, (s) => [hostOf(s.src), hostOf(s.dst)])));
+}
+
+async function refreshAlerts() {
+  const alerts = await api("/alerts?limit=100");
+  const blocks = alerts.filter((a) => a.alert && a.alert.action === "blocked").slice(0, 25);
+  fill("blocks", blocks.map((a) => row([
+    formatTime(a.timestamp), a.alert.signature + (a.alert.count ? ` (+${a.alert.count} similar)` : ""),
+    el("td", a.alert.category, "blocked"),
+    a.src_ip + ":" + a.src_port, a.dest_ip + ":" + a.dest_port, a.app_proto || a.proto,
+  ])));
+}
+
+async function refreshRules() {
+  const stats = await api("/ruleset/stats");
+  fill("rules", stats.map((st) => row([st.name, num(st.hits), num(formatBytes(st.bytes)), formatTime(st.lastHit)])));
+}
+
+async function refreshIDSOnly() {
+  const mode = await api("/ids-only");
+  document.getElementById("ids-only").checked = mode.enabled;
+}
+
+async function search(event) {
+  if (event) {
+    event.preventDefault();
+  }
+  const form = new FormData(document.getElementById("search"));
+  const params = new URLSearchParams({limit: "200"});
+  for (const [k, v] of form) {
+    if (v) {
+      params.set(k, v.trim());
+    }
+  }
+  try {
+    const resp = await api("/streams?" + params);
+    fill("streams", streamRows(resp.streams));
+    document.getElementById("search-total").textContent =
+      resp.total > resp.streams.length ? `${resp.streams.length} of ${resp.total}` : `${resp.total}`;
+    showError(null);
+  } catch (e) {
+    showError(e);
+  }
+}
+
+function showError(e) {
+  document.getElementById("error").textContent = e ? e.message : "";
+}
+
+async function refresh() {
+  try {
+    await Promise.all([refreshStreams(), refreshAlerts(), refreshRules()]);
+    showError(null);
+  } catch (e) {
+    showError(e);
+  }
+}
+
+document.getElementById("search").addEventListener("submit", search);
+document.getElementById("ids-only").addEventListener("change", async (event) => {
+  const enabled = event.target.checked;
+  if (!confirm((enabled ? "Enable" : "Disable") + " IDS-only mode?")) {
+    event.target.checked = !enabled;
+    return;
+  }
+  try {
+    await api("/ids-only", {method: "PUT", body: JSON.stringify({enabled})});
+  } catch (e) {
+    event.target.checked = !enabled;
+    showError(e);
+  }
+});
+
+// The first call asks for the token if needed, before the others start
+refreshIDSOnly().then(() => {
+  refresh();
+  search();
+  setInterval(refresh, refreshInterval);
+}).catch(showError);
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+
+	"go.uber.org/zap"
+)
+
+const (
+	degradeDefaultInterval = time.Second
+	degradeDefaultRecover  = 30 * time.Second
+	degradeDefaultSample   = 0.1
+)
+
+// degradeMonitor protects the engine under overload. While the average verdict latency or the backlog
+// of the worker queues is over its threshold, the engine is degraded (expensive analyzers skipped for
+// new streams, unclassified streams accepted, see engine.Degradation), the events other than alerts and
+// the traces are sampled more aggressively, and readiness reports it, so that the engine keeps up
+// instead of its queues overflowing and packets being dropped indiscriminately.
+// Degraded mode is left once both have been under their thresholds for Recover.
+type degradeMonitor struct {
+	Engine        engine.Engine
+	Latency       time.Duration // 0 = not checked
+	Backlog       float64       // Fraction of the queue capacity, 0 = not checked
+	Interval      time.Duration
+	Recover       time.Duration
+	SkipAnalyzers []string // Empty = the most expensive ones
+	Sample        float64  // Fraction of the sampled events & traces still sent while degraded
+
+	state atomic.Pointer[degradeState] // nil when not degraded
+}
+
+type degradeState struct {
+	Since  time.Time
+	Reason string
+}
+
+func (m *degradeMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	prev := m.Engine.Stats()
+	var calm time.Time // Since when the thresholds haven't been exceeded, while degraded
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st := m.Engine.Stats()
+		reason := m.overload(prev, st)
+		prev = st
+		state := m.state.Load()
+		switch {
+		case reason != "" && state == nil:
+			m.enter(reason)
+		case reason != "":
+			calm = time.Time{}
+		case state != nil && calm.IsZero():
+			calm = time.Now()
+		case state != nil && time.Since(calm) >= m.Recover:
+			m.state.Store(nil)
+			m.Engine.SetDegraded(nil)
+			calm = time.Time{}
+			logger.Info("engine load back to normal, left degraded mode", zap.Duration("duration", time.Since(state.Since)))
+		}
+	}
+}
+
+// overload returns why the engine is overloaded between two snapshots of its statistics,
+// empty if it isn't.
+func (m *degradeMonitor) overload(prev, cur engine.Stats) string {
+	if m.Latency > 0 && cur.Packets > prev.Packets {
+		latency := (cur.Latency - prev.Latency) / time.Duration(cur.Packets-prev.Packets)
+		if latency > m.Latency {
+			return fmt.Sprintf("average verdict latency %s over %s", latency.Round(time.Microsecond), m.Latency)
+		}
+	}
+	if m.Backlog > 0 && cur.QueueCapacity > 0 {
+		if cur.QueueFull > prev.QueueFull {
+			return fmt.Sprintf("%d packets waited for room in a full worker queue", cur.QueueFull-prev.QueueFull)
+		}
+		if backlog := float64(cur.QueueLength) / float64(cur.QueueCapacity); backlog > m.Backlog {
+			return fmt.Sprintf("worker queues %.0f%% full, over %.0f%%", backlog*100, m.Backlog*100)
+		}
+	}
+	return ""
+}
+
+func (m *degradeMonitor) enter(reason string) {
+	skipped := m.SkipAnalyzers
+	if len(skipped) == 0 {
+		skipped = expensiveAnalyzers(m.Engine.AnalyzerStats())
+	}
+	d := &engine.Degradation{SkipAnalyzers: make(map[string]bool, len(skipped))}
+	for _, name := range skipped {
+		d.SkipAnalyzers[name] = true
+	}
+	m.state.Store(&degradeState{Since: time.Now(), Reason: reason})
+	m.Engine.SetDegraded(d)
+	logger.Warn("engine overloaded, entered degraded mode",
+		zap.String("reason", reason),
+		zap.Strings("skippedAnalyzers", skipped),
+		zap.Float64("sample", m.Sample))
+}
+
+// expensiveAnalyzers returns the analyzers whose average time per stream is over the average of all analyzers.
+func expensiveAnalyzers(stats []engine.AnalyzerStats) []string {
+	perStream := make(map[string]float64, len(stats))
+	var total float64
+	for _, st := range stats {
+		if st.Streams > 0 {
+			perStream[st.Name] = float64(st.Time) / float64(st.Streams)
+			total += perStream[st.Name]
+		}
+	}
+	var names []string
+	for name, t := range perStream {
+		if t > total/float64(len(perStream)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SampleScale returns the factor to apply to the fraction of sampled events & traces:
+// 1, or Sample while degraded. A nil *degradeMonitor always returns 1.
+func (m *degradeMonitor) SampleScale() float64 {
+	if m == nil || m.state.Load() == nil {
+		return 1
+	}
+	return m.Sample
+}
+
+// Check returns an error while degraded, for readiness.
+func (m *degradeMonitor) Check() error {
+	state := m.state.Load()
+	if state == nil {
+		return nil
+	}
+	return fmt.Errorf("degraded since %s (%s ago): %s", state.Since.Format(time.RFC3339),
+		time.Since(state.Since).Round(time.Second), state.Reason)
+}
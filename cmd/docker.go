@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"go.uber.org/zap"
+)
+
+const (
+	dockerDefaultHost     = "unix:///var/run/docker.sock"
+	dockerDefaultInterval = time.Minute
+	dockerRequestTimeout  = 30 * time.Second
+	dockerMinBackoff      = time.Second
+	dockerMaxBackoff      = time.Minute
+)
+
+// dockerWatcher keeps track of the IPs of the running containers of the local Docker daemon,
+// so that the rules can match streams on the containers they come from & go to (the container variable).
+// The containers are listed again whenever the event stream of the daemon reports one started, stopped,
+// or connected to or disconnected from a network, and every Interval in case an event was missed.
+// Containers sharing the host's network have no IP of their own, and are left out.
+// It's safe for concurrent use.
+type dockerWatcher struct {
+	URL      string       // http://docker for a unix socket, see Client
+	Client   *http.Client // No timeout, the event stream is a long request
+	Interval time.Duration
+
+	ips     atomic.Pointer[map[string]*ruleset.Container] // IP -> container, replaced as a whole
+	mutex   sync.Mutex
+	lastErr error // Of the latest listing
+}
+
+// dockerContainer is the part of GET /containers/json that matters here.
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func newDockerWatcher(host string, client *http.Client, interval time.Duration) (*dockerWatcher, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	w := &dockerWatcher{Client: client, Interval: interval}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		w.URL = "http://docker"
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		w.Client = &http.Client{Transport: transport}
+	case "tcp":
+		if client.Transport.(*http.Transport).TLSClientConfig != nil {
+			w.URL = "https://" + u.Host
+		} else {
+			w.URL = "http://" + u.Host
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, must be unix:// or tcp://", u.Scheme)
+	}
+	empty := make(map[string]*ruleset.Container)
+	w.ips.Store(&empty)
+	return w, nil
+}
+
+// Run keeps the containers up to date until the context is cancelled.
+func (w *dockerWatcher) Run(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+	go w.watchEvents(ctx, changed)
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+		if err := w.Refresh(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to list docker containers", zap.Error(err))
+		}
+	}
+}
+
+// Refresh lists the running containers, and replaces those known with them.
+func (w *dockerWatcher) Refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dockerRequestTimeout)
+	defer cancel()
+	var containers []dockerContainer
+	err := w.get(ctx, "/containers/json", nil, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&containers)
+	})
+	w.mutex.Lock()
+	w.lastErr = err
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	ips := make(map[string]*ruleset.Container)
+	for _, dc := range containers {
+		c := &ruleset.Container{
+			ID:     dc.ID,
+			Image:  dc.Image,
+			Labels: dc.Labels,
+		}
+		if len(dc.Names) > 0 {
+			c.Name = strings.TrimPrefix(dc.Names[0], "/")
+		}
+		for _, n := range dc.NetworkSettings.Networks {
+			for _, s := range []string{n.IPAddress, n.GlobalIPv6Address} {
+				if ip := net.ParseIP(s); ip != nil {
+					ips[ip.String()] = c
+				}
+			}
+		}
+	}
+	w.ips.Store(&ips)
+	logger.Debug("docker containers listed", zap.Int("count", len(containers)), zap.Int("ips", len(ips)))
+	return nil
+}
+
+// watchEvents signals changed for the events that change the IPs of containers, and reconnects
+// to the event stream with a backoff until the context is cancelled.
+func (w *dockerWatcher) watchEvents(ctx context.Context, changed chan<- struct{}) {
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container", "network"},
+		"event": {"start", "die", "connect", "disconnect"},
+	})
+	backoff := dockerMinBackoff
+	for {
+		start := time.Now()
+		err := w.get(ctx, "/events", url.Values{"filters": {string(filters)}}, func(r io.Reader) error {
+			// Events may have been missed while disconnected
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			dec := json.NewDecoder(r)
+			for {
+				var ev struct {
+					Type   string `json:"Type"`
+					Action string `json:"Action"`
+				}
+				if err := dec.Decode(&ev); err != nil {
+					return err
+				}
+				logger.Debug("docker event", zap.String("type", ev.Type), zap.String("action", ev.Action))
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > dockerMaxBackoff {
+			// Was connected for a while, not a persistent failure
+			backoff = dockerMinBackoff
+		}
+		logger.Warn("docker event stream lost, reconnecting", zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, dockerMaxBackoff)
+	}
+}
+
+// get sends a GET request to the daemon, and passes the body of the response to f if it's a success.
+func (w *dockerWatcher) get(ctx context.Context, path string, query url.Values, f func(io.Reader) error) error {
+	u := w.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(bs, &msg) != nil || msg.Message == "" {
+			msg.Message = strings.TrimSpace(string(bs))
+		}
+		return fmt.Errorf("%s: %s", resp.Status, msg.Message)
+	}
+	return f(resp.Body)
+}
+
+// Container returns the container an IP belongs to, or nil if it's unknown.
+func (w *dockerWatcher) Container(ip net.IP) *ruleset.Container {
+	return (*w.ips.Load())[ip.String()]
+}
+
+// Check returns the error of the latest listing of the containers, for readiness:
+// the containers of the rules may be out of date.
+func (w *dockerWatcher) Check() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.lastErr != nil {
+		return fmt.Errorf("failed to list containers: %w", w.lastErr)
+	}
+	return nil
+}
+
+// testContainers is the container resolver of the commands that don't query the daemon,
+// like testWorkloads: the containers of the source & destination of the test case being run.
+type testContainers map[string]*ruleset.Container
+
+func (c testContainers) Container(ip net.IP) *ruleset.Container {
+	return c[ip.String()]
+}
+
+// testCaseContainers are the containers of the current test case, when docker is configured.
+var testCaseContainers = make(testContainers)
+
+// set replaces the containers with those of a test case.
+func (c testContainers) set(tc *testCase) {
+	for ip := range c {
+		delete(c, ip)
+	}
+	for _, side := range []struct {
+		IP        string
+		Container *testCaseContainer
+	}{{tc.IP.Src, tc.Container.Src}, {tc.IP.Dst, tc.Container.Dst}} {
+		ip := net.ParseIP(side.IP)
+		if ip != nil && side.Container != nil {
+			c[ip.String()] = &ruleset.Container{
+				ID:     side.Container.ID,
+				Name:   side.Container.Name,
+				Image:  side.Container.Image,
+				Labels: side.Container.Labels,
+			}
+		}
+	}
+}
+
+// testContainers returns the container resolver of the test cases, or nil if docker isn't configured.
+func (c *cliConfig) testContainers() ruleset.ContainerResolver {
+	if !c.Docker.Enabled {
+		return nil
+	}
+	return testCaseContainers
+}
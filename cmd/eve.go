@@ -0,0 +1,597 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/sink"
+
+	"github.com/google/gopacket/layers"
+)
+
+const eveTimeFormat = "2006-01-02T15:04:05.000000-0700"
+
+var eveEventTypes = map[string]bool{
+	"alert": true,
+	"flow":  true,
+	"dns":   true,
+	"tls":   true,
+	"http":  true,
+}
+
+// eveAppProtos are the analyzers reported as the app_proto of a stream, by priority.
+var eveAppProtos = []string{"http", "tls", "dns", "ssh", "quic", "socks", "wireguard"}
+
+var eveTLSVersions = map[uint16]string{
+	0x0300: "SSLv3",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+var eveDNSRCodes = map[layers.DNSResponseCode]string{
+	layers.DNSResponseCodeNoErr:    "NOERROR",
+	layers.DNSResponseCodeFormErr:  "FORMERR",
+	layers.DNSResponseCodeServFail: "SERVFAIL",
+	layers.DNSResponseCodeNXDomain: "NXDOMAIN",
+	layers.DNSResponseCodeNotImp:   "NOTIMP",
+	layers.DNSResponseCodeRefused:  "REFUSED",
+}
+
+// eveClickHouseColumns are the columns of the ClickHouse table of eve records,
+// for the fields that are commonly searched or aggregated on.
+var eveClickHouseColumns = []sink.ClickHouseColumn{
+	{Name: "timestamp", Type: "DateTime64(6)"},
+	{Name: "event_type", Type: "LowCardinality(String)"},
+	{Name: "flow_id", Type: "Int64"},
+	{Name: "flow_uuid", Type: "String"},
+	{Name: "in_iface", Type: "LowCardinality(String)"},
+	{Name: "io", Type: "LowCardinality(String)"},
+	{Name: "src_ip", Type: "String"},
+	{Name: "src_port", Type: "UInt16"},
+	{Name: "dest_ip", Type: "String"},
+	{Name: "dest_port", Type: "UInt16"},
+	{Name: "proto", Type: "LowCardinality(String)"},
+	{Name: "app_proto", Type: "LowCardinality(String)"},
+	{Name: "src_geo.country_code", Type: "LowCardinality(String)"},
+	{Name: "src_geo.asn", Type: "UInt32"},
+	{Name: "dest_geo.country_code", Type: "LowCardinality(String)"},
+	{Name: "dest_geo.asn", Type: "UInt32"},
+	{Name: "alert.action", Type: "LowCardinality(String)"},
+	{Name: "alert.signature_id", Type: "UInt32"},
+	{Name: "alert.signature", Type: "String"},
+	{Name: "alert.category", Type: "LowCardinality(String)"},
+	{Name: "alert.severity", Type: "UInt8"},
+	{Name: "flow.pkts_toserver", Type: "UInt64"},
+	{Name: "flow.pkts_toclient", Type: "UInt64"},
+	{Name: "flow.bytes_toserver", Type: "UInt64"},
+	{Name: "flow.bytes_toclient", Type: "UInt64"},
+	{Name: "flow.start", Type: "DateTime64(6)"},
+	{Name: "flow.age", Type: "Int64"},
+	{Name: "flow.state", Type: "LowCardinality(String)"},
+	{Name: "flow.alerted", Type: "Bool"},
+	{Name: "dns.type", Type: "LowCardinality(String)"},
+	{Name: "dns.rrname", Type: "String"},
+	{Name: "dns.rrtype", Type: "LowCardinality(String)"},
+	{Name: "dns.rcode", Type: "LowCardinality(String)"},
+	{Name: "tls.sni", Type: "String"},
+	{Name: "tls.version", Type: "LowCardinality(String)"},
+	{Name: "http.hostname", Type: "String"},
+	{Name: "http.url", Type: "String"},
+	{Name: "http.http_method", Type: "LowCardinality(String)"},
+	{Name: "http.http_user_agent", Type: "String"},
+	{Name: "http.status", Type: "UInt16"},
+}
+
+const eveClickHouseEngine = "MergeTree PARTITION BY toDate(timestamp) ORDER BY (event_type, timestamp)"
+
+// eveElasticsearchMappings are the mappings of the Elasticsearch indices of eve records.
+// Strings are keywords unless mapped otherwise, as they're mostly names & identifiers.
+var eveElasticsearchMappings = map[string]interface{}{
+	"dynamic_templates": []interface{}{
+		map[string]interface{}{
+			"strings_as_keywords": map[string]interface{}{
+				"match_mapping_type": "string",
+				"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+			},
+		},
+	},
+	"properties": map[string]interface{}{
+		"timestamp": eveElasticsearchDate,
+		"flow_id":   map[string]interface{}{"type": "long"},
+		"src_ip":    map[string]interface{}{"type": "ip"},
+		"src_port":  map[string]interface{}{"type": "integer"},
+		"dest_ip":   map[string]interface{}{"type": "ip"},
+		"dest_port": map[string]interface{}{"type": "integer"},
+		"flow": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"start": eveElasticsearchDate,
+				"end":   eveElasticsearchDate,
+			},
+		},
+		"http": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"http_user_agent": map[string]interface{}{"type": "text", "fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 1024}}},
+			},
+		},
+	},
+}
+
+var eveElasticsearchDate = map[string]interface{}{
+	"type":   "date_nanos",
+	"format": "yyyy-MM-dd'T'HH:mm:ss.SSSSSSZ||strict_date_optional_time_nanos",
+}
+
+// eveRecord is an event in the format of Suricata's eve.json, with the fields that
+// have an equivalent in OpenGFW.
+type eveRecord struct {
+	Timestamp string    `json:"timestamp"`
+	FlowID    int64     `json:"flow_id"`
+	FlowUUID  string    `json:"flow_uuid,omitempty"`
+	InIface   string    `json:"in_iface,omitempty"`
+	IO        string    `json:"io,omitempty"` // Not in Suricata: name of the IO instance
+	EventType string    `json:"event_type"`
+	SrcIP     string    `json:"src_ip"`
+	SrcPort   uint16    `json:"src_port"`
+	DestIP    string    `json:"dest_ip"`
+	DestPort  uint16    `json:"dest_port"`
+	Proto     string    `json:"proto"`
+	AppProto  string    `json:"app_proto,omitempty"`
+	SrcGeo    *geoInfo  `json:"src_geo,omitempty"`
+	DestGeo   *geoInfo  `json:"dest_geo,omitempty"`
+	Alert     *eveAlert `json:"alert,omitempty"`
+	Flow      *eveFlow  `json:"flow,omitempty"`
+	DNS       *eveDNS   `json:"dns,omitempty"`
+	TLS       *eveTLS   `json:"tls,omitempty"`
+	HTTP      *eveHTTP  `json:"http,omitempty"`
+}
+
+type eveAlert struct {
+	Action      string `json:"action"` // allowed or blocked
+	GID         int    `json:"gid"`
+	SignatureID uint32 `json:"signature_id"` // CRC32 of the rule name, so that it doesn't change when rules are reordered
+	Rev         int    `json:"rev"`
+	Signature   string `json:"signature"` // Rule name
+	Category    string `json:"category"`  // Action of the rule
+	Severity    int    `json:"severity"`
+	// Set on alerts standing for several identical ones, see alertAggregator
+	Count          int    `json:"count,omitempty"`
+	FirstTimestamp string `json:"first_timestamp,omitempty"`
+}
+
+type eveFlow struct {
+	PktsToServer  uint64 `json:"pkts_toserver"`
+	PktsToClient  uint64 `json:"pkts_toclient"`
+	BytesToServer uint64 `json:"bytes_toserver"`
+	BytesToClient uint64 `json:"bytes_toclient"`
+	Start         string `json:"start"`
+	End           string `json:"end"`
+	Age           int64  `json:"age"`
+	State         string `json:"state"`
+	Reason        string `json:"reason"`
+	Alerted       bool   `json:"alerted"`
+}
+
+type eveDNS struct {
+	Version int            `json:"version"`
+	Type    string         `json:"type"` // query or answer
+	ID      uint16         `json:"id"`
+	RD      bool           `json:"rd,omitempty"`
+	RA      bool           `json:"ra,omitempty"`
+	AA      bool           `json:"aa,omitempty"`
+	TC      bool           `json:"tc,omitempty"`
+	RRName  string         `json:"rrname"`
+	RRType  string         `json:"rrtype"`
+	RCode   string         `json:"rcode,omitempty"`
+	Answers []eveDNSAnswer `json:"answers,omitempty"`
+}
+
+type eveDNSAnswer struct {
+	RRName string `json:"rrname"`
+	RRType string `json:"rrtype"`
+	TTL    uint32 `json:"ttl"`
+	RData  string `json:"rdata,omitempty"`
+}
+
+type eveTLS struct {
+	SNI         string   `json:"sni,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	ClientALPNs []string `json:"client_alpns,omitempty"`
+	ServerALPNs []string `json:"server_alpns,omitempty"`
+}
+
+type eveHTTP struct {
+	Hostname        string `json:"hostname,omitempty"`
+	URL             string `json:"url,omitempty"`
+	HTTPUserAgent   string `json:"http_user_agent,omitempty"`
+	HTTPContentType string `json:"http_content_type,omitempty"`
+	HTTPRefer       string `json:"http_refer,omitempty"`
+	HTTPMethod      string `json:"http_method,omitempty"`
+	Protocol        string `json:"protocol,omitempty"`
+	Status          int    `json:"status,omitempty"`
+	Length          int    `json:"length,omitempty"`
+}
+
+// eveKeys are the record fields that can be used as the partitioning key of events.
+var eveKeys = map[string]func(r *eveRecord) []byte{
+	"flow_id":   func(r *eveRecord) []byte { return strconv.AppendInt(nil, r.FlowID, 10) },
+	"flow_uuid": func(r *eveRecord) []byte { return []byte(r.FlowUUID) },
+	"src_ip":    func(r *eveRecord) []byte { return []byte(r.SrcIP) },
+	"dest_ip":   func(r *eveRecord) []byte { return []byte(r.DestIP) },
+	"none":      func(r *eveRecord) []byte { return nil },
+}
+
+// eventOutput is a sink of the event log, with the events it gets.
+type eventOutput struct {
+	Name        string // Config field, for health checks
+	Sink        sink.Sink
+	Types       map[string]bool
+	MaxSeverity int                // Of the alerts, all if 0
+	Sample      map[string]float64 // Fraction of the streams whose events are sent, by event type
+	Key         func(r *eveRecord) []byte
+}
+
+func newEventOutput(s sink.Sink, route cliConfigEventRoute, key string) (eventOutput, error) {
+	o := eventOutput{Sink: s, Types: eveEventTypes, Key: eveKeys["flow_id"]}
+	if len(route.Types) > 0 {
+		o.Types = make(map[string]bool, len(route.Types))
+		for _, t := range route.Types {
+			if !eveEventTypes[t] {
+				return o, fmt.Errorf("unknown event type %q", t)
+			}
+			o.Types[t] = true
+		}
+	}
+	if route.Severity < 0 || route.Severity > 3 {
+		return o, fmt.Errorf("invalid severity %d, must be 1 to 3", route.Severity)
+	}
+	o.MaxSeverity = route.Severity
+	for t, fraction := range route.Sample {
+		if !eveEventTypes[t] {
+			return o, fmt.Errorf("unknown event type %q to sample", t)
+		}
+		if fraction < 0 || fraction > 1 {
+			return o, fmt.Errorf("invalid sample fraction %v for %s, must be 0 to 1", fraction, t)
+		}
+	}
+	o.Sample = route.Sample
+	if key != "" {
+		if o.Key = eveKeys[key]; o.Key == nil {
+			return o, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return o, nil
+}
+
+// Wants returns whether the output gets a record. Sampling is by stream, so that
+// the events of a sampled stream are all sent, in every output with the same fraction.
+// The fraction is multiplied by scale, see degradeMonitor.
+func (o *eventOutput) Wants(r *eveRecord, scale float64) bool {
+	if !o.Types[r.EventType] {
+		return false
+	}
+	if o.MaxSeverity > 0 && r.Alert != nil && r.Alert.Severity > o.MaxSeverity {
+		return false
+	}
+	fraction, ok := o.Sample[r.EventType]
+	if !ok {
+		fraction = 1
+	}
+	if fraction *= scale; fraction < 1 {
+		return eveStreamSample(r.FlowID) < fraction
+	}
+	return true
+}
+
+// eveStreamSample maps a stream ID to [0, 1), uniformly even for sequential IDs (Fibonacci hashing).
+func eveStreamSample(id int64) float64 {
+	return float64((uint64(id)*0x9e3779b97f4a7c15)>>11) / (1 << 53)
+}
+
+// eventLog sends stream events to sinks (eve.json file, Kafka, NATS...) as records in the format
+// of Suricata's eve.json, so that existing SIEM parsers & dashboards can be used.
+// Events are generated when the engine issues an action for a stream: an alert if a rule
+// matched, the flow with its counters so far (accepted streams are offloaded to the kernel,
+// so their end is never seen), and the dns, tls & http records from the analyzer properties.
+// A nil *eventLog does nothing.
+type eventLog struct {
+	Outputs []eventOutput
+	Alerts  *alertAggregator // Optional
+	GeoIP   *geoIP           // Optional
+	// SampleScale is the factor applied to the sampled fraction of the events other than alerts,
+	// see degradeMonitor. Optional.
+	SampleScale func() float64
+}
+
+// Reopen reopens the file sinks, for log rotation.
+func (l *eventLog) Reopen() error {
+	if l == nil {
+		return nil
+	}
+	var firstErr error
+	for _, o := range l.Outputs {
+		if f, ok := o.Sink.(*sink.File); ok {
+			if err := f.Reopen(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// findEventSink returns the first sink of type T of the event log, if any.
+// Check returns the state of the sinks that can tell, by name, see sink.Checker.
+func (l *eventLog) Check() map[string]error {
+	if l == nil {
+		return nil
+	}
+	states := make(map[string]error)
+	for _, o := range l.Outputs {
+		if c, ok := o.Sink.(sink.Checker); ok && o.Name != "" {
+			states[o.Name] = c.Check()
+		}
+	}
+	return states
+}
+
+func findEventSink[T sink.Sink](l *eventLog) (T, bool) {
+	var zero T
+	if l == nil {
+		return zero, false
+	}
+	for _, o := range l.Outputs {
+		if s, ok := o.Sink.(T); ok {
+			return s, true
+		}
+	}
+	return zero, false
+}
+
+// Close flushes & closes the sinks.
+func (l *eventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.Alerts.Close()
+	for _, o := range l.Outputs {
+		_ = o.Sink.Close()
+	}
+	return nil
+}
+
+// StreamAction sends the events of a stream the engine has issued an action for.
+func (l *eventLog) StreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	srcGeo, destGeo := l.GeoIP.Lookup(info.SrcIP), l.GeoIP.Lookup(info.DstIP)
+	send := func(eventType string, fill func(r *eveRecord) bool) {
+		if !l.wants(eventType) {
+			return
+		}
+		r := newEveRecord(info, eventType, now)
+		r.SrcGeo, r.DestGeo = srcGeo, destGeo
+		if fill(&r) {
+			l.send(&r, now)
+		}
+	}
+	if rule != "" {
+		send("alert", func(r *eveRecord) bool {
+			r.Alert = newEveAlert(action, rule)
+			return l.Alerts.Add(r, now)
+		})
+	}
+	send("dns", func(r *eveRecord) bool {
+		r.DNS = newEveDNS(info.Props["dns"])
+		return r.DNS != nil
+	})
+	send("tls", func(r *eveRecord) bool {
+		r.TLS = newEveTLS(info.Props["tls"])
+		return r.TLS != nil
+	})
+	send("http", func(r *eveRecord) bool {
+		r.HTTP = newEveHTTP(info.Props["http"])
+		return r.HTTP != nil
+	})
+	send("flow", func(r *eveRecord) bool {
+		r.Flow = newEveFlow(info, action, rule != "", now)
+		return true
+	})
+}
+
+// wants returns whether any sink gets the events of a type.
+func (l *eventLog) wants(eventType string) bool {
+	for _, o := range l.Outputs {
+		if o.Types[eventType] {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends a record to the sinks that get it.
+func (l *eventLog) send(r *eveRecord, now time.Time) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	scale := 1.0
+	if l.SampleScale != nil && r.EventType != "alert" {
+		scale = l.SampleScale()
+	}
+	for i := range l.Outputs {
+		if o := &l.Outputs[i]; o.Wants(r, scale) {
+			o.Sink.Send(sink.Event{Type: r.EventType, Key: o.Key(r), Time: now, Data: data})
+		}
+	}
+}
+
+func newEveRecord(info ruleset.StreamInfo, eventType string, now time.Time) eveRecord {
+	r := eveRecord{
+		Timestamp: now.Format(eveTimeFormat),
+		FlowID:    info.ID,
+		FlowUUID:  info.UUID,
+		InIface:   info.InInterface,
+		IO:        info.IO,
+		EventType: eventType,
+		SrcIP:     info.SrcIP.String(),
+		SrcPort:   info.SrcPort,
+		DestIP:    info.DstIP.String(),
+		DestPort:  info.DstPort,
+		Proto:     strings.ToUpper(info.Protocol.String()),
+	}
+	r.AppProto = eveAppProto(info.Props)
+	return r
+}
+
+// eveAppProto returns the application protocol of a stream from its analyzer properties,
+// empty if unknown.
+func eveAppProto(props analyzer.CombinedPropMap) string {
+	for _, name := range eveAppProtos {
+		if len(props[name]) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+func newEveAlert(action ruleset.Action, rule string) *eveAlert {
+	a := &eveAlert{
+		Action:      "allowed",
+		GID:         1,
+		SignatureID: crc32.ChecksumIEEE([]byte(rule)),
+		Rev:         1,
+		Signature:   rule,
+		Category:    action.String(),
+		Severity:    2,
+	}
+	switch action {
+	case ruleset.ActionBlock, ruleset.ActionDrop, ruleset.ActionDivert, ruleset.ActionHoneypot:
+		a.Action = "blocked"
+		a.Severity = 1
+	case ruleset.ActionAllow:
+		a.Severity = 3
+	}
+	return a
+}
+
+func newEveFlow(info ruleset.StreamInfo, action ruleset.Action, alerted bool, now time.Time) *eveFlow {
+	c := info.Counters
+	f := &eveFlow{
+		PktsToServer:  c.SrcPackets,
+		PktsToClient:  c.DstPackets,
+		BytesToServer: c.SrcBytes,
+		BytesToClient: c.DstBytes,
+		Start:         c.StartTime.Format(eveTimeFormat),
+		End:           now.Format(eveTimeFormat),
+		Age:           int64(now.Sub(c.StartTime).Seconds()),
+		State:         "established",
+		Reason:        "verdict",
+		Alerted:       alerted,
+	}
+	if c.DstPackets == 0 {
+		f.State = "new"
+	}
+	switch action {
+	case ruleset.ActionBlock, ruleset.ActionDrop, ruleset.ActionDivert, ruleset.ActionHoneypot:
+		f.State = "closed"
+	}
+	return f
+}
+
+func newEveDNS(m analyzer.PropMap) *eveDNS {
+	questions, _ := m["questions"].([]analyzer.PropMap)
+	if len(questions) == 0 {
+		return nil
+	}
+	d := &eveDNS{Version: 2, Type: "query"}
+	d.ID, _ = m["id"].(uint16)
+	d.RD, _ = m["rd"].(bool)
+	d.RA, _ = m["ra"].(bool)
+	d.AA, _ = m["aa"].(bool)
+	d.TC, _ = m["tc"].(bool)
+	d.RRName, _ = questions[0]["name"].(string)
+	qType, _ := questions[0]["type"].(layers.DNSType)
+	d.RRType = qType.String()
+	if qr, _ := m["qr"].(bool); !qr {
+		return d
+	}
+	d.Type = "answer"
+	rcode, _ := m["rcode"].(layers.DNSResponseCode)
+	if d.RCode = eveDNSRCodes[rcode]; d.RCode == "" {
+		d.RCode = strconv.Itoa(int(rcode))
+	}
+	answers, _ := m["answers"].([]analyzer.PropMap)
+	for _, rr := range answers {
+		a := eveDNSAnswer{}
+		a.RRName, _ = rr["name"].(string)
+		rrType, _ := rr["type"].(layers.DNSType)
+		a.RRType = rrType.String()
+		a.TTL, _ = rr["ttl"].(uint32)
+		for _, k := range []string{"a", "aaaa", "cname", "ns", "ptr", "mx"} {
+			if s, ok := rr[k].(string); ok {
+				a.RData = s
+				break
+			}
+		}
+		if txts, ok := rr["txt"].([]string); ok {
+			a.RData = strings.Join(txts, "")
+		}
+		d.Answers = append(d.Answers, a)
+	}
+	return d
+}
+
+func newEveTLS(m analyzer.PropMap) *eveTLS {
+	req, _ := m["req"].(analyzer.PropMap)
+	resp, _ := m["resp"].(analyzer.PropMap)
+	if req == nil && resp == nil {
+		return nil
+	}
+	t := &eveTLS{}
+	t.SNI, _ = req["sni"].(string)
+	t.ClientALPNs, _ = req["alpn"].([]string)
+	t.ServerALPNs, _ = resp["alpn"].([]string)
+	// The negotiated version is only known from the server,
+	// TLS 1.3 is in the supported_versions extension
+	version, ok := resp["supported_versions"].(uint16)
+	if !ok {
+		version, _ = resp["version"].(uint16)
+	}
+	t.Version = eveTLSVersions[version]
+	return t
+}
+
+func newEveHTTP(m analyzer.PropMap) *eveHTTP {
+	req, _ := m["req"].(analyzer.PropMap)
+	if req == nil {
+		return nil
+	}
+	h := &eveHTTP{}
+	h.HTTPMethod, _ = req["method"].(string)
+	h.URL, _ = req["path"].(string)
+	h.Protocol, _ = req["version"].(string)
+	if headers, ok := req["headers"].(analyzer.PropMap); ok {
+		h.Hostname, _ = headers["host"].(string)
+		h.HTTPUserAgent, _ = headers["user-agent"].(string)
+		h.HTTPRefer, _ = headers["referer"].(string)
+	}
+	if resp, ok := m["resp"].(analyzer.PropMap); ok {
+		h.Status, _ = resp["status"].(int)
+		if headers, ok := resp["headers"].(analyzer.PropMap); ok {
+			h.HTTPContentType, _ = headers["content-type"].(string)
+			if length, ok := headers["content-length"].(string); ok {
+				h.Length, _ = strconv.Atoi(length)
+			}
+		}
+	}
+	return h
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+const fail2banPollInterval = time.Second
+
+// fail2banActionRegexp matches the bans & unbans of the log of fail2ban, e.g.
+// 2024-01-02 03:04:05,678 fail2ban.actions [123]: NOTICE  [sshd] Ban 192.0.2.1
+var fail2banActionRegexp = regexp.MustCompile(
+	`^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})\S*\s+fail2ban\.actions\s.*\[([^\]]+)\]\s+(?:Restore )?(Ban|Unban)\s+(\S+)`)
+
+// fail2banTailer follows the log of fail2ban, and adds the IPs it bans to an IP set,
+// removing them when they're unbanned from every jail that banned them.
+// The log is read from its start first, to pick up the bans still in effect,
+// and is reopened when it's rotated or truncated.
+// With a TTL, the entries expire TTL after their ban was logged even if no unban is.
+type fail2banTailer struct {
+	File  string
+	Set   *builtins.Set
+	Jails map[string]bool // Empty = all
+	TTL   time.Duration   // 0 = until unbanned
+
+	mutex   sync.Mutex
+	banned  map[string]map[string]bool // IP -> jails
+	lastErr error
+}
+
+func newFail2banTailer(file string, set *builtins.Set, jails []string, ttl time.Duration) *fail2banTailer {
+	t := &fail2banTailer{
+		File:   file,
+		Set:    set,
+		Jails:  make(map[string]bool, len(jails)),
+		TTL:    ttl,
+		banned: make(map[string]map[string]bool),
+	}
+	for _, jail := range jails {
+		t.Jails[jail] = true
+	}
+	return t
+}
+
+// Run follows the log until the context is cancelled.
+func (t *fail2banTailer) Run(ctx context.Context) {
+	var (
+		f      *os.File
+		r      *bufio.Reader
+		offset int64
+	)
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+	ticker := time.NewTicker(fail2banPollInterval)
+	defer ticker.Stop()
+	for {
+		err := func() error {
+			if f == nil {
+				var err error
+				if f, err = os.Open(t.File); err != nil {
+					return err
+				}
+				r, offset = bufio.NewReader(f), 0
+			}
+			for {
+				line, err := r.ReadString('\n')
+				if err == io.EOF {
+					// Partial line, read again once complete
+					if _, err := f.Seek(offset, io.SeekStart); err != nil {
+						return err
+					}
+					r.Reset(f)
+					break
+				} else if err != nil {
+					return err
+				}
+				offset += int64(len(line))
+				t.handleLine(line)
+			}
+			// Rotated or truncated?
+			st, err := os.Stat(t.File)
+			if err != nil {
+				return err
+			}
+			fst, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			if !os.SameFile(st, fst) || fst.Size() < offset {
+				logger.Info("fail2ban log rotated, reopening", zap.String("file", t.File))
+				_ = f.Close()
+				f = nil
+			}
+			return nil
+		}()
+		t.mutex.Lock()
+		if err != nil && (t.lastErr == nil || t.lastErr.Error() != err.Error()) {
+			logger.Warn("failed to read fail2ban log", zap.String("file", t.File), zap.Error(err))
+		}
+		t.lastErr = err
+		t.mutex.Unlock()
+		if err != nil && f != nil {
+			_ = f.Close()
+			f = nil
+		}
+		if f == nil && err == nil {
+			// Rotated, the new file is read right away
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleLine applies a line of the log to the set, if it's a ban or unban.
+func (t *fail2banTailer) handleLine(line string) {
+	m := fail2banActionRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+	jail, action, ip := m[2], m[3], m[4]
+	if len(t.Jails) > 0 && !t.Jails[jail] {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	jails := t.banned[ip]
+	if action == "Unban" {
+		if jails == nil {
+			return
+		}
+		delete(jails, jail)
+		if len(jails) == 0 {
+			delete(t.banned, ip)
+			_, _ = t.Set.Remove([]string{ip})
+			logger.Debug("fail2ban unban", zap.String("jail", jail), zap.String("ip", ip))
+		}
+		return
+	}
+	var ttl time.Duration
+	if t.TTL > 0 {
+		logged, err := time.ParseInLocation("2006-01-02 15:04:05", m[1], time.Local)
+		if err != nil {
+			logged = time.Now()
+		}
+		if ttl = t.TTL - time.Since(logged); ttl <= 0 {
+			// Expired already, as read from the start of the log
+			return
+		}
+	}
+	if err := t.Set.Add([]string{ip}, ttl); err != nil {
+		logger.Warn("invalid fail2ban ban", zap.String("jail", jail), zap.String("ip", ip), zap.Error(err))
+		return
+	}
+	if jails == nil {
+		jails = make(map[string]bool)
+		t.banned[ip] = jails
+	}
+	jails[jail] = true
+	logger.Debug("fail2ban ban", zap.String("jail", jail), zap.String("ip", ip))
+}
+
+// Check returns the error of the latest read of the log, for readiness: the set may be out of date.
+func (t *fail2banTailer) Check() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.lastErr != nil {
+		return fmt.Errorf("failed to read %s: %w", t.File, t.lastErr)
+	}
+	return nil
+}
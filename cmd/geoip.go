@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"net"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins/geo/mmdb"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const geoIPDefaultCacheSize = 65536
+
+// geoIP enriches the events with the country & AS of their addresses, from local MaxMind DB files
+// (GeoLite2 & GeoIP2, or compatible ones like DB-IP's), so dashboards don't need their own
+// enrichment pipeline. The country database can be a country or city one, the ASN database an ASN one.
+// A nil *geoIP enriches nothing.
+type geoIP struct {
+	Country *mmdb.Reader // Optional
+	ASN     *mmdb.Reader // Optional
+
+	cache *lru.Cache[string, *geoInfo] // By IP, nil values for IPs without information
+}
+
+type geoInfo struct {
+	CountryCode string `json:"country_code,omitempty"` // ISO 3166-1 alpha-2
+	ASN         uint64 `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+}
+
+func newGeoIP(countryFile, asnFile string, cacheSize int) (*geoIP, error) {
+	if cacheSize <= 0 {
+		cacheSize = geoIPDefaultCacheSize
+	}
+	g := &geoIP{}
+	var err error
+	if countryFile != "" {
+		if g.Country, err = mmdb.Open(countryFile); err != nil {
+			return nil, err
+		}
+	}
+	if asnFile != "" {
+		if g.ASN, err = mmdb.Open(asnFile); err != nil {
+			return nil, err
+		}
+	}
+	g.cache, _ = lru.New[string, *geoInfo](cacheSize)
+	return g, nil
+}
+
+// Lookup returns the information about an IP, nil if there's none (e.g. private addresses).
+func (g *geoIP) Lookup(ip net.IP) *geoInfo {
+	if g == nil || ip == nil {
+		return nil
+	}
+	key := string(ip.To16())
+	if info, ok := g.cache.Get(key); ok {
+		return info
+	}
+	info := &geoInfo{}
+	if g.Country != nil {
+		if v, err := g.Country.Lookup(ip); err == nil {
+			info.CountryCode, _ = mmdbValue(v, "country", "iso_code").(string)
+			if info.CountryCode == "" {
+				// Anycast & satellite networks have no location, but a registered country
+				info.CountryCode, _ = mmdbValue(v, "registered_country", "iso_code").(string)
+			}
+		}
+	}
+	if g.ASN != nil {
+		if v, err := g.ASN.Lookup(ip); err == nil {
+			info.ASN, _ = mmdbValue(v, "autonomous_system_number").(uint64)
+			info.ASOrg, _ = mmdbValue(v, "autonomous_system_organization").(string)
+		}
+	}
+	if *info == (geoInfo{}) {
+		info = nil
+	}
+	g.cache.Add(key, info)
+	return info
+}
+
+// mmdbValue returns the value at a path of maps of a database record, nil if absent.
+func mmdbValue(v interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
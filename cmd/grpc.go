@@ -0,0 +1,621 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/sink"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The gRPC API is served with net/http's HTTP/2 support and hand-encoded messages,
+// see docs/control.proto for the service definition.
+
+const (
+	grpcServiceName        = "/opengfw.v1.Control/"
+	grpcMaxMessageSize     = 4 * 1024 * 1024
+	grpcSubscriberQueue    = 1024
+	grpcListStreamsTimeout = 10 * time.Second
+)
+
+// gRPC status codes
+const (
+	grpcStatusOK                 = 0
+	grpcStatusInvalidArgument    = 3
+	grpcStatusDeadlineExceeded   = 4
+	grpcStatusFailedPrecondition = 9
+	grpcStatusUnimplemented      = 12
+	grpcStatusInternal           = 13
+	grpcStatusUnavailable        = 14
+)
+
+// grpcError is an error returned to the client with its status code.
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (e grpcError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", e.Code, e.Message)
+}
+
+// grpcServer is the gRPC API for subscribing to events and controlling a running instance.
+// Clients are authenticated with mTLS.
+type grpcServer struct {
+	Events   *eventHub
+	Rulesets *rulesetManager
+	Engine   engine.Engine
+	TLS      *tls.Config // Must require client certificates
+	Audit    *auditLog   // Optional
+}
+
+// ListenAndServe serves the API on addr until the context is cancelled.
+func (s *grpcServer) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           s,
+		TLSConfig:         s.TLS,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          zap.NewStdLog(logger.Named("grpc")),
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	// ServeTLS enables HTTP/2, the certificates are already in the TLS config
+	err = server.ServeTLS(listener, "", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Accept-Encoding", "identity")
+	if enc := r.Header.Get("Grpc-Encoding"); enc != "" && enc != "identity" {
+		writeGRPCStatus(w, grpcError{Code: grpcStatusUnimplemented, Message: "unsupported encoding " + enc})
+		return
+	}
+	ctx := r.Context()
+	if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, err)
+		return
+	}
+	client := grpcClientName(r)
+	method := strings.TrimPrefix(r.URL.Path, grpcServiceName)
+	if method == "Subscribe" {
+		writeGRPCStatus(w, s.subscribe(ctx, w, req))
+		return
+	}
+	var resp []byte
+	switch method {
+	case "ReloadRuleset":
+		resp, err = s.reloadRuleset(client)
+	case "ListStreams":
+		resp, err = s.listStreams(ctx, req)
+	case "SetLogLevel":
+		resp, err = s.setLogLevel(client, req)
+	default:
+		err = grpcError{Code: grpcStatusUnimplemented, Message: "unknown method " + r.URL.Path}
+	}
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		err = writeGRPCMessage(w, resp)
+	}
+	writeGRPCStatus(w, err)
+}
+
+// grpcClientName returns the common name of the client's certificate, for logging.
+func grpcClientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func (s *grpcServer) subscribe(ctx context.Context, w http.ResponseWriter, req []byte) error {
+	var types []string
+	var filter streamFilter
+	err := decodeProto(req, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			types = append(types, string(v))
+		case 2:
+			return filter.decode(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range types {
+		if !eveEventTypes[t] {
+			return grpcError{Code: grpcStatusInvalidArgument, Message: "unknown event type " + t}
+		}
+	}
+	sub := s.Events.Subscribe(types, filter)
+	defer s.Events.Unsubscribe(sub)
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return grpcError{Code: grpcStatusDeadlineExceeded, Message: "deadline exceeded"}
+			}
+			return nil
+		case <-s.Events.done:
+			return grpcError{Code: grpcStatusUnavailable, Message: "shutting down"}
+		case ev := <-sub.events:
+			var b []byte
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendString(b, ev.Type)
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(ev.Time.UnixNano()))
+			b = protowire.AppendTag(b, 3, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(ev.FlowID))
+			b = protowire.AppendTag(b, 4, protowire.BytesType)
+			b = protowire.AppendBytes(b, ev.Data)
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				b = protowire.AppendTag(b, 5, protowire.VarintType)
+				b = protowire.AppendVarint(b, dropped)
+			}
+			if ev.FlowUUID != "" {
+				b = protowire.AppendTag(b, 6, protowire.BytesType)
+				b = protowire.AppendString(b, ev.FlowUUID)
+			}
+			if err := writeGRPCMessage(w, b); err != nil {
+				// Client gone
+				return nil
+			}
+		}
+	}
+}
+
+func (s *grpcServer) reloadRuleset(client string) ([]byte, error) {
+	logger.Info("reloading rules", zap.String("client", client))
+	if err := s.Rulesets.Reload(false, "grpc:"+client); err != nil {
+		logger.Error("failed to reload rules, using old rules", zap.Error(err))
+		return nil, grpcError{Code: grpcStatusFailedPrecondition, Message: err.Error()}
+	}
+	logger.Info("rules reloaded")
+	versions, current := s.Rulesets.Versions()
+	var b []byte
+	for _, v := range versions {
+		if v.ID == current {
+			b = protowire.AppendTag(b, 1, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v.ID))
+			b = protowire.AppendTag(b, 2, protowire.BytesType)
+			b = protowire.AppendString(b, v.Hash)
+		}
+	}
+	return b, nil
+}
+
+func (s *grpcServer) listStreams(ctx context.Context, req []byte) ([]byte, error) {
+	var filter streamFilter
+	var limit uint64
+	err := decodeProto(req, func(num protowire.Number, _ protowire.Type, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			return filter.decode(v)
+		case 2:
+			limit = x
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, grpcListStreamsTimeout)
+	defer cancel()
+	entries, err := s.Engine.Streams(ctx)
+	if err != nil {
+		return nil, grpcError{Code: grpcStatusDeadlineExceeded, Message: err.Error()}
+	}
+	matched := entries[:0]
+	for _, e := range entries {
+		if filter.Match(e.Info.SrcIP, e.Info.DstIP, e.Info.SrcPort, e.Info.DstPort, e.Info.Protocol.String()) {
+			matched = append(matched, e)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Info.Counters.StartTime.Before(matched[j].Info.Counters.StartTime)
+	})
+	total := len(matched)
+	if limit > 0 && uint64(len(matched)) > limit {
+		matched = matched[:limit]
+	}
+	var b []byte
+	for _, e := range matched {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeGRPCStream(e))
+	}
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(total))
+	return b, nil
+}
+
+func encodeGRPCStream(e engine.StreamEntry) []byte {
+	var b []byte
+	appendVarint := func(num protowire.Number, v uint64) {
+		if v != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, v)
+		}
+	}
+	appendString := func(num protowire.Number, s string) {
+		if s != "" {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, s)
+		}
+	}
+	info := e.Info
+	appendVarint(1, uint64(info.ID))
+	appendVarint(2, uint64(e.WorkerID))
+	appendString(3, info.Protocol.String())
+	appendString(4, info.SrcIP.String())
+	appendVarint(5, uint64(info.SrcPort))
+	appendString(6, info.DstIP.String())
+	appendVarint(7, uint64(info.DstPort))
+	appendString(8, info.InInterface)
+	appendVarint(9, uint64(info.Counters.StartTime.UnixNano()))
+	appendVarint(10, info.Counters.SrcPackets)
+	appendVarint(11, info.Counters.DstPackets)
+	appendVarint(12, info.Counters.SrcBytes)
+	appendVarint(13, info.Counters.DstBytes)
+	appendString(14, otlpVerdictNames[e.Verdict])
+	appendVarint(15, uint64(e.Mark))
+	appendString(16, e.Rule)
+	for _, name := range e.Analyzers {
+		b = protowire.AppendTag(b, 17, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+	}
+	if props, err := json.Marshal(info.Props); err == nil {
+		b = protowire.AppendTag(b, 18, protowire.BytesType)
+		b = protowire.AppendBytes(b, props)
+	}
+	appendString(19, info.UUID)
+	appendString(20, info.IO)
+	return b
+}
+
+func (s *grpcServer) setLogLevel(client string, req []byte) ([]byte, error) {
+	var name string
+	err := decodeProto(req, func(num protowire.Number, _ protowire.Type, v []byte, _ uint64) error {
+		if num == 1 {
+			name = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	level, ok := logLevelMap[strings.ToLower(name)]
+	if !ok {
+		return nil, grpcError{Code: grpcStatusInvalidArgument, Message: "unsupported log level " + name}
+	}
+	previous := setLogLevel(level, "gRPC "+client)
+	s.Audit.Record(auditRecord{
+		Who:     "grpc:" + client,
+		Action:  "log_level",
+		Summary: "log level set to " + level.String(),
+		Details: auditChange{From: previous.String(), To: level.String()},
+	})
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, previous.String())
+	return b, nil
+}
+
+// decode decodes a StreamFilter message.
+func (f *streamFilter) decode(b []byte) error {
+	return decodeProto(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch num {
+		case 1:
+			n, err := parseStreamFilterNet(string(v))
+			if err != nil {
+				return grpcError{Code: grpcStatusInvalidArgument, Message: err.Error()}
+			}
+			f.Nets = append(f.Nets, n)
+		case 2:
+			if f.Ports == nil {
+				f.Ports = make(map[uint16]bool)
+			}
+			if typ == protowire.VarintType {
+				f.Ports[uint16(x)] = true
+				return nil
+			}
+			// Packed
+			for len(v) > 0 {
+				p, n := protowire.ConsumeVarint(v)
+				if n < 0 {
+					return grpcError{Code: grpcStatusInvalidArgument, Message: "invalid ports"}
+				}
+				f.Ports[uint16(p)] = true
+				v = v[n:]
+			}
+		case 3:
+			f.Protocol = strings.ToLower(string(v))
+		}
+		return nil
+	})
+}
+
+// decodeProto calls f for each field of a protobuf message, with the value for length-delimited
+// fields, or the integer for varint & fixed fields.
+func decodeProto(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return grpcError{Code: grpcStatusInvalidArgument, Message: "invalid message"}
+		}
+		b = b[n:]
+		var v []byte
+		var x uint64
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x32 uint32
+			x32, n = protowire.ConsumeFixed32(b)
+			x = uint64(x32)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return grpcError{Code: grpcStatusInvalidArgument, Message: "invalid message"}
+		}
+		b = b[n:]
+		if err := f(num, typ, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readGRPCMessage reads the (single) message of a request.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	msg, err := readGRPCFrame(r)
+	if err == io.EOF {
+		return nil, grpcError{Code: grpcStatusInvalidArgument, Message: "missing request message"}
+	}
+	return msg, err
+}
+
+// readGRPCFrame reads a length-prefixed message, or returns io.EOF if there are no more.
+func readGRPCFrame(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, grpcError{Code: grpcStatusInvalidArgument, Message: "truncated message"}
+	}
+	if prefix[0] != 0 {
+		return nil, grpcError{Code: grpcStatusUnimplemented, Message: "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessageSize {
+		return nil, grpcError{Code: grpcStatusInvalidArgument, Message: "message too large"}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, grpcError{Code: grpcStatusInvalidArgument, Message: "truncated message"}
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	if err := writeGRPCFrame(w, msg); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// writeGRPCFrame writes a length-prefixed message, with a single write.
+func writeGRPCFrame(w io.Writer, msg []byte) error {
+	b := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+// writeGRPCStatus sends the status of the call in the trailers.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, msg := grpcStatusOK, ""
+	if err != nil {
+		var gErr grpcError
+		if errors.As(err, &gErr) {
+			code, msg = gErr.Code, gErr.Message
+		} else {
+			code, msg = grpcStatusInternal, err.Error()
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+	}
+}
+
+// grpcPercentEncode encodes the status message as required by the gRPC protocol.
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses the grpc-timeout header, e.g. "10S".
+func parseGRPCTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// grpcTLSConfig loads the server certificate and the CA that client certificates must be signed by.
+func grpcTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, errors.New("cert, key and clientCA are required")
+	}
+	config, err := serverTLSConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.NextProtos = []string{"h2"}
+	return config, nil
+}
+
+var _ sink.Sink = (*eventHub)(nil)
+
+// eventHub is an event sink that broadcasts the events to the gRPC subscribers.
+type eventHub struct {
+	mutex       sync.RWMutex
+	subscribers map[*eventSubscriber]struct{}
+	done        chan struct{} // Closed when the hub is closed
+	closeOnce   sync.Once
+}
+
+type eventSubscriber struct {
+	types   map[string]bool // nil for all
+	filter  streamFilter
+	events  chan eventHubEvent
+	dropped atomic.Uint64 // Since the last event delivered
+}
+
+type eventHubEvent struct {
+	sink.Event
+	FlowID   int64
+	FlowUUID string
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[*eventSubscriber]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (h *eventHub) Subscribe(types []string, filter streamFilter) *eventSubscriber {
+	sub := &eventSubscriber{
+		filter: filter,
+		events: make(chan eventHubEvent, grpcSubscriberQueue),
+	}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	h.mutex.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mutex.Unlock()
+	return sub
+}
+
+func (h *eventHub) Unsubscribe(sub *eventSubscriber) {
+	h.mutex.Lock()
+	delete(h.subscribers, sub)
+	h.mutex.Unlock()
+}
+
+// Send never blocks: events are dropped for the subscribers whose queue is full.
+func (h *eventHub) Send(ev sink.Event) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+	var r struct {
+		FlowID   int64  `json:"flow_id"`
+		FlowUUID string `json:"flow_uuid"`
+		SrcIP    string `json:"src_ip"`
+		SrcPort  uint16 `json:"src_port"`
+		DestIP   string `json:"dest_ip"`
+		DestPort uint16 `json:"dest_port"`
+		Proto    string `json:"proto"`
+	}
+	if err := json.Unmarshal(ev.Data, &r); err != nil {
+		return
+	}
+	srcIP, dstIP := net.ParseIP(r.SrcIP), net.ParseIP(r.DestIP)
+	hev := eventHubEvent{Event: ev, FlowID: r.FlowID, FlowUUID: r.FlowUUID}
+	for sub := range h.subscribers {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		if !sub.filter.Match(srcIP, dstIP, r.SrcPort, r.DestPort, r.Proto) {
+			continue
+		}
+		select {
+		case sub.events <- hev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Close ends the subscriptions.
+func (h *eventHub) Close() error {
+	h.closeOnce.Do(func() { close(h.done) })
+	return nil
+}
@@ -0,0 +1,387 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/sink"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestGRPCFrame(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     []byte
+		want     []byte
+		wantCode int // -1 for io.EOF
+	}{
+		{"message", []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}, []byte("abc"), grpcStatusOK},
+		{"empty message", []byte{0, 0, 0, 0, 0}, []byte{}, grpcStatusOK},
+		{"no message", nil, nil, -1},
+		{"truncated prefix", []byte{0, 0, 0}, nil, grpcStatusInvalidArgument},
+		{"truncated message", []byte{0, 0, 0, 0, 3, 'a'}, nil, grpcStatusInvalidArgument},
+		{"compressed", []byte{1, 0, 0, 0, 1, 'a'}, nil, grpcStatusUnimplemented},
+		{"too large", []byte{0, 0x7f, 0, 0, 0}, nil, grpcStatusInvalidArgument},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readGRPCFrame(bytes.NewReader(tc.data))
+			switch {
+			case tc.wantCode == -1:
+				if err != io.EOF {
+					t.Errorf("readGRPCFrame() error = %v, want EOF", err)
+				}
+			case tc.wantCode != grpcStatusOK:
+				var gErr grpcError
+				if !errors.As(err, &gErr) || gErr.Code != tc.wantCode {
+					t.Errorf("readGRPCFrame() error = %v, want status %d", err, tc.wantCode)
+				}
+			case err != nil:
+				t.Errorf("readGRPCFrame() error = %v", err)
+			case !bytes.Equal(got, tc.want):
+				t.Errorf("readGRPCFrame() = %q, want %q", got, tc.want)
+			default:
+				// Round trip
+				var buf bytes.Buffer
+				if err := writeGRPCFrame(&buf, got); err != nil || !bytes.Equal(buf.Bytes(), tc.data) {
+					t.Errorf("writeGRPCFrame() = %v, %v, want %v", buf.Bytes(), err, tc.data)
+				}
+			}
+		})
+	}
+	// A missing request message is an error of its own
+	var gErr grpcError
+	if _, err := readGRPCMessage(bytes.NewReader(nil)); !errors.As(err, &gErr) || gErr.Code != grpcStatusInvalidArgument {
+		t.Errorf("readGRPCMessage() error = %v, want invalid argument", err)
+	}
+}
+
+func TestStreamFilter_Decode(t *testing.T) {
+	var packed []byte
+	packed = protowire.AppendVarint(packed, 53)
+	packed = protowire.AppendVarint(packed, 443)
+	testCases := []struct {
+		name     string
+		fields   func(b []byte) []byte
+		want     streamFilter
+		wantCode int
+	}{
+		{
+			name: "all",
+			fields: func(b []byte) []byte {
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				b = protowire.AppendString(b, "10.0.0.0/8")
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				b = protowire.AppendString(b, "2001:db8::1")
+				b = protowire.AppendTag(b, 2, protowire.VarintType)
+				b = protowire.AppendVarint(b, 80)
+				b = protowire.AppendTag(b, 2, protowire.BytesType)
+				b = protowire.AppendBytes(b, packed)
+				b = protowire.AppendTag(b, 3, protowire.BytesType)
+				b = protowire.AppendString(b, "TCP")
+				return b
+			},
+			want: streamFilter{
+				Nets: []*net.IPNet{
+					{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+					{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)},
+				},
+				Ports:    map[uint16]bool{53: true, 80: true, 443: true},
+				Protocol: "tcp",
+			},
+		},
+		{
+			name: "unknown fields",
+			fields: func(b []byte) []byte {
+				b = protowire.AppendTag(b, 9, protowire.Fixed32Type)
+				b = protowire.AppendFixed32(b, 1)
+				b = protowire.AppendTag(b, 10, protowire.Fixed64Type)
+				b = protowire.AppendFixed64(b, 1)
+				return b
+			},
+		},
+		{
+			name: "invalid net",
+			fields: func(b []byte) []byte {
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				return protowire.AppendString(b, "10.0.0.0/33")
+			},
+			wantCode: grpcStatusInvalidArgument,
+		},
+		{
+			name: "invalid packed ports",
+			fields: func(b []byte) []byte {
+				b = protowire.AppendTag(b, 2, protowire.BytesType)
+				return protowire.AppendBytes(b, []byte{0x80})
+			},
+			wantCode: grpcStatusInvalidArgument,
+		},
+		{
+			name: "truncated",
+			fields: func(b []byte) []byte {
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				return append(b, 5, 'a')
+			},
+			wantCode: grpcStatusInvalidArgument,
+		},
+		{
+			name:     "invalid tag",
+			fields:   func(b []byte) []byte { return append(b, 0x80) },
+			wantCode: grpcStatusInvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var f streamFilter
+			err := f.decode(tc.fields(nil))
+			if tc.wantCode != grpcStatusOK {
+				var gErr grpcError
+				if !errors.As(err, &gErr) || gErr.Code != tc.wantCode {
+					t.Errorf("decode() error = %v, want status %d", err, tc.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(f, tc.want) {
+				t.Errorf("decode() = %+v, want %+v", f, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	testCases := []struct {
+		s      string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"10S", 10 * time.Second, true},
+		{"1H", time.Hour, true},
+		{"500m", 500 * time.Millisecond, true},
+		{"3u", 3 * time.Microsecond, true},
+		{"0n", 0, true},
+		{"", 0, false},
+		{"S", 0, false},
+		{"10", 0, false},
+		{"10s", 0, false},
+		{"-1S", 0, false},
+	}
+	for _, tc := range testCases {
+		got, ok := parseGRPCTimeout(tc.s)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v, want %v, %v", tc.s, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestGRPCPercentEncode(t *testing.T) {
+	testCases := []struct {
+		s, want string
+	}{
+		{"unknown method /x", "unknown method /x"},
+		{"100% done", "100%25 done"},
+		{"line\nbreak", "line%0Abreak"},
+		{"café", "caf%C3%A9"},
+	}
+	for _, tc := range testCases {
+		if got := grpcPercentEncode(tc.s); got != tc.want {
+			t.Errorf("grpcPercentEncode(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+// grpcTestCall calls a method of the server, and returns the messages of the response and its status.
+func grpcTestCall(t *testing.T, srv *httptest.Server, method string, header http.Header, body []byte) ([][]byte, string, string) {
+	req, err := http.NewRequest(http.MethodPost, srv.URL+grpcServiceName+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("protocol = %s, want HTTP/2", resp.Proto)
+	}
+	var msgs [][]byte
+	for {
+		msg, err := readGRPCFrame(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("readGRPCFrame() error = %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+func grpcTestMessage(msg []byte) []byte {
+	var buf bytes.Buffer
+	_ = writeGRPCFrame(&buf, msg)
+	return buf.Bytes()
+}
+
+func TestGRPCServer_ServeHTTP(t *testing.T) {
+	logger = zap.NewNop()
+	atomicLogLevel = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	srv := httptest.NewUnstartedServer(&grpcServer{Events: newEventHub()})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	levelRequest := func(level string) []byte {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return grpcTestMessage(protowire.AppendString(b, level))
+	}
+	levelResponse := func(level string) [][]byte {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		return [][]byte{protowire.AppendString(b, level)}
+	}
+	testCases := []struct {
+		name        string
+		method      string
+		header      http.Header
+		body        []byte
+		wantMsgs    [][]byte
+		wantStatus  int
+		wantMessage string
+	}{
+		{
+			name:       "set log level",
+			method:     "SetLogLevel",
+			body:       levelRequest("debug"),
+			wantMsgs:   levelResponse("info"),
+			wantStatus: grpcStatusOK,
+		},
+		{
+			name:       "set log level again",
+			method:     "SetLogLevel",
+			body:       levelRequest("INFO"),
+			wantMsgs:   levelResponse("debug"),
+			wantStatus: grpcStatusOK,
+		},
+		{
+			name:        "invalid log level",
+			method:      "SetLogLevel",
+			body:        levelRequest("loud"),
+			wantStatus:  grpcStatusInvalidArgument,
+			wantMessage: "unsupported log level loud",
+		},
+		{
+			name:        "unknown method",
+			method:      "Nope",
+			body:        grpcTestMessage(nil),
+			wantStatus:  grpcStatusUnimplemented,
+			wantMessage: "unknown method " + grpcServiceName + "Nope",
+		},
+		{
+			name:        "missing message",
+			method:      "SetLogLevel",
+			wantStatus:  grpcStatusInvalidArgument,
+			wantMessage: "missing request message",
+		},
+		{
+			name:        "compressed",
+			method:      "SetLogLevel",
+			header:      http.Header{"Grpc-Encoding": {"gzip"}},
+			body:        levelRequest("info"),
+			wantStatus:  grpcStatusUnimplemented,
+			wantMessage: "unsupported encoding gzip",
+		},
+		{
+			name:        "unknown event type",
+			method:      "Subscribe",
+			body:        grpcTestMessage(protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "nope")),
+			wantStatus:  grpcStatusInvalidArgument,
+			wantMessage: "unknown event type nope",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msgs, status, message := grpcTestCall(t, srv, tc.method, tc.header, tc.body)
+			if !reflect.DeepEqual(msgs, tc.wantMsgs) {
+				t.Errorf("messages = %q, want %q", msgs, tc.wantMsgs)
+			}
+			if status != strconv.Itoa(tc.wantStatus) || message != tc.wantMessage {
+				t.Errorf("status = %s %q, want %d %q", status, message, tc.wantStatus, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestGRPCServer_Subscribe(t *testing.T) {
+	logger = zap.NewNop()
+	hub := newEventHub()
+	srv := httptest.NewUnstartedServer(&grpcServer{Events: hub})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendString(req, "alert")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+grpcServiceName+"Subscribe", bytes.NewReader(grpcTestMessage(req)))
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Grpc-Timeout", "500m")
+	resp, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Subscribed once the headers are sent
+	data := []byte(`{"flow_id":7,"flow_uuid":"u1","src_ip":"10.0.0.1","dest_ip":"10.0.0.2","proto":"TCP"}`)
+	hub.Send(sink.Event{Type: "flow", Data: []byte(`{"flow_id":1}`)}) // Not subscribed to
+	hub.Send(sink.Event{Type: "alert", Time: time.Unix(0, 42), Data: data})
+	msg, err := readGRPCFrame(resp.Body)
+	if err != nil {
+		t.Fatalf("readGRPCFrame() error = %v", err)
+	}
+	var want []byte
+	want = protowire.AppendTag(want, 1, protowire.BytesType)
+	want = protowire.AppendString(want, "alert")
+	want = protowire.AppendTag(want, 2, protowire.VarintType)
+	want = protowire.AppendVarint(want, 42)
+	want = protowire.AppendTag(want, 3, protowire.VarintType)
+	want = protowire.AppendVarint(want, 7)
+	want = protowire.AppendTag(want, 4, protowire.BytesType)
+	want = protowire.AppendBytes(want, data)
+	want = protowire.AppendTag(want, 6, protowire.BytesType)
+	want = protowire.AppendString(want, "u1")
+	if !bytes.Equal(msg, want) {
+		t.Errorf("event = %x, want %x", msg, want)
+	}
+
+	// Ended by the deadline
+	if _, err := readGRPCFrame(resp.Body); err != io.EOF {
+		t.Fatalf("readGRPCFrame() error = %v, want EOF", err)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != strconv.Itoa(grpcStatusDeadlineExceeded) {
+		t.Errorf("status = %s, want %d", status, grpcStatusDeadlineExceeded)
+	}
+}
@@ -0,0 +1,758 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"go.uber.org/zap"
+
+	"github.com/apernet/OpenGFW/engine"
+	gfwio "github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+const (
+	harDefaultPrefix     = "opengfw"
+	harDefaultMaxBody    = 1024 * 1024
+	harDefaultMaxEntries = 100
+	harDefaultLookback   = 64
+	harMaxHeaderBytes    = 64 * 1024 // Of a message, recording stops over it
+	harMaxOutOfOrder     = 64        // Segments kept per direction until the missing data arrives
+)
+
+var (
+	_ engine.PacketSink = (*harRecorder)(nil)
+
+	errHARHeaderTooLarge = errors.New("headers too large")
+)
+
+// harRecorder reconstructs the HTTP/1.x requests & responses of the TCP streams matched by capture-http
+// rules from their packets, and writes each stream as a HAR file, which browser devtools & HAR viewers open.
+// The files are written when the streams end, or every MaxEntries requests for long ones.
+// Streams are only recorded from their match on, plus the packets of the capture lookback.
+type harRecorder struct {
+	Dir        string
+	Prefix     string
+	MaxBody    int // Bytes of a body recorded, the rest of the stream isn't after a larger one
+	MaxEntries int // Per file
+	MaxFiles   int // 0 = unlimited
+
+	mutex   sync.Mutex
+	streams map[string]*harStream // By UUID
+}
+
+// harStream is a stream being recorded. Its packets come from the worker of the stream,
+// but it's also finished by Close.
+type harStream struct {
+	mutex    sync.Mutex
+	uuid     string
+	rule     string
+	clientIP net.IP
+	client   uint16
+	server   net.IP
+	port     uint16
+	dirs     [2]harDirection // Client, server
+	requests []*harEntry     // Waiting for their responses
+	entries  []*harEntry     // Complete
+	part     int             // Files written
+	stopped  string          // Why recording stopped, if it did
+}
+
+// harDirection is the data sent by a side, reassembled.
+type harDirection struct {
+	started bool
+	next    uint32
+	fin     bool
+	ahead   map[uint32]harSegment // Out of order, by sequence number
+	buf     []byte                // Not parsed yet
+	times   []harSegment          // Arrival of the data in buf: offsets & times, Data unused
+}
+
+type harSegment struct {
+	Offset int
+	Time   time.Time
+	Data   []byte
+	FIN    bool
+}
+
+// The HAR 1.2 format, http://www.softwareishard.com/blog/har-12-spec/
+// Custom fields start with an underscore.
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+	Comment string      `json:"comment,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"` // ms
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress"`
+	Connection      string      `json:"connection"` // Client port
+	Comment         string      `json:"comment,omitempty"`
+	FlowUUID        string      `json:"_flowUUID"`
+	Rule            string      `json:"_rule"`
+
+	start, sent time.Time // First & last byte of the request
+	method      string
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"` // 0 if there was none
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"` // base64 for binary data
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size        int    `json:"size"` // Decoded
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // base64 for binary data
+	Comment     string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// StreamAction starts recording a stream when a capture-http rule matches it.
+func (r *harRecorder) StreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	if r == nil || noMatch || action != ruleset.ActionCaptureHTTP || info.Protocol != ruleset.ProtocolTCP {
+		return
+	}
+	s := &harStream{
+		uuid:     info.UUID,
+		rule:     rule,
+		clientIP: info.SrcIP,
+		client:   info.SrcPort,
+		server:   info.DstIP,
+		port:     info.DstPort,
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.streams[info.UUID]; !ok {
+		r.streams[info.UUID] = s
+	}
+}
+
+// StreamEnd writes the file of a stream.
+func (r *harRecorder) StreamEnd(end engine.StreamEnd) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	s := r.streams[end.Info.UUID]
+	delete(r.streams, end.Info.UUID)
+	r.mutex.Unlock()
+	if s != nil {
+		r.finish(s)
+	}
+}
+
+// WritePacket records a packet of a stream.
+func (r *harRecorder) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	var uuid string
+	for _, v := range ci.AncillaryData {
+		if c, ok := v.(gfwio.PacketComment); ok {
+			uuid = strings.TrimPrefix(string(c), "flow_uuid=")
+		}
+	}
+	r.mutex.Lock()
+	s := r.streams[uuid]
+	r.mutex.Unlock()
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	s.add(ci.Timestamp, data, r.MaxBody)
+	var entries []*harEntry
+	if len(s.entries) >= r.MaxEntries {
+		entries, s.entries = s.entries, nil
+		s.part++
+	}
+	part := s.part
+	s.mutex.Unlock()
+	if entries == nil {
+		return nil
+	}
+	return r.write(s, part, entries, "")
+}
+
+// finish completes the entries of a stream, and writes them.
+func (r *harRecorder) finish(s *harStream) {
+	s.mutex.Lock()
+	s.parse(true, r.MaxBody)
+	for _, e := range s.requests {
+		e.Comment = "no response"
+	}
+	entries := append(s.entries, s.requests...)
+	s.entries, s.requests = nil, nil
+	part := s.part
+	if part > 0 {
+		part++
+	}
+	stopped := s.stopped
+	s.mutex.Unlock()
+	if len(entries) == 0 && part == 0 && stopped == "" {
+		// Not HTTP, or nothing was sent
+		return
+	}
+	if err := r.write(s, part, entries, stopped); err != nil {
+		logger.Error("failed to write HAR file", zap.String("uuid", s.uuid), zap.Error(err))
+	}
+}
+
+// write writes entries of a stream to a new file, part being its number for long streams, 0 for the only one.
+func (r *harRecorder) write(s *harStream, part int, entries []*harEntry, comment string) error {
+	if err := os.MkdirAll(r.Dir, 0o750); err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []*harEntry{}
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "OpenGFW", Version: harVersion()},
+		Entries: entries,
+		Comment: comment,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The timestamp goes first so that the files sort chronologically
+	name := fmt.Sprintf("%s-%s-%s", r.Prefix, time.Now().Format("20060102-150405.000000"), s.uuid)
+	if part > 0 {
+		name += fmt.Sprintf("-%d", part)
+	}
+	name = filepath.Join(r.Dir, name+".har")
+	if err := os.WriteFile(name, data, 0o640); err != nil {
+		_ = os.Remove(name)
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune deletes the oldest files over the limit.
+func (r *harRecorder) prune() {
+	if r.MaxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(r.Dir, r.Prefix+"-*.har"))
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+	for len(files) > r.MaxFiles {
+		_ = os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// Close writes the files of the streams still being recorded.
+func (r *harRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	streams := r.streams
+	r.streams = make(map[string]*harStream)
+	r.mutex.Unlock()
+	for _, s := range streams {
+		r.finish(s)
+	}
+	return nil
+}
+
+func harVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "(devel)"
+}
+
+// add records a packet (starting with the IP header) of the stream.
+func (s *harStream) add(ts time.Time, data []byte, maxBody int) {
+	if s.stopped != "" {
+		return
+	}
+	var src net.IP
+	var ipPayload []byte
+	var next layers.IPProtocol
+	if len(data) > 0 && data[0]>>4 == 4 {
+		var ip layers.IPv4
+		if ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil {
+			return
+		}
+		src, ipPayload, next = ip.SrcIP, ip.Payload, ip.Protocol
+	} else {
+		var ip layers.IPv6
+		if ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil {
+			return
+		}
+		src, ipPayload, next = ip.SrcIP, ip.Payload, ip.NextHeader
+	}
+	var tcp layers.TCP
+	if next != layers.IPProtocolTCP || tcp.DecodeFromBytes(ipPayload, gopacket.NilDecodeFeedback) != nil {
+		return
+	}
+	dir := 1
+	if src.Equal(s.clientIP) && uint16(tcp.SrcPort) == s.client {
+		dir = 0
+	}
+	d := &s.dirs[dir]
+	if tcp.SYN {
+		d.started, d.next = true, tcp.Seq+1
+		return
+	}
+	if len(tcp.Payload) == 0 && !tcp.FIN {
+		return
+	}
+	if !d.started {
+		d.started, d.next = true, tcp.Seq
+	}
+	if d.ahead == nil {
+		d.ahead = make(map[uint32]harSegment)
+	}
+	d.ahead[tcp.Seq] = harSegment{Time: ts, Data: append([]byte(nil), tcp.Payload...), FIN: tcp.FIN}
+	if !d.reassemble() {
+		s.stop("missing TCP data")
+		return
+	}
+	s.parse(false, maxBody)
+}
+
+// reassemble appends the segments that follow the data so far to it,
+// and returns false if too many segments wait for missing data.
+func (d *harDirection) reassemble() bool {
+	for progress := true; progress; {
+		progress = false
+		for seq, seg := range d.ahead {
+			off := int32(seq - d.next)
+			if off > 0 {
+				continue
+			}
+			delete(d.ahead, seq)
+			progress = true
+			if int(-off) < len(seg.Data) {
+				d.times = append(d.times, harSegment{Offset: len(d.buf), Time: seg.Time})
+				d.buf = append(d.buf, seg.Data[-off:]...)
+				d.next += uint32(len(seg.Data) + int(off))
+			}
+			if seg.FIN && int(-off) <= len(seg.Data) {
+				d.fin = true
+			}
+		}
+	}
+	return len(d.ahead) <= harMaxOutOfOrder
+}
+
+// timeAt returns when the byte at an offset of the buffer arrived.
+func (d *harDirection) timeAt(off int) time.Time {
+	i := sort.Search(len(d.times), func(i int) bool { return d.times[i].Offset > off })
+	if i == 0 {
+		return time.Time{}
+	}
+	return d.times[i-1].Time
+}
+
+// consume removes the first n bytes of the buffer.
+func (d *harDirection) consume(n int) {
+	d.buf = d.buf[n:]
+	i := sort.Search(len(d.times), func(i int) bool { return d.times[i].Offset > n })
+	if i > 0 {
+		// The segment the next byte is in stays
+		i--
+	}
+	d.times = d.times[i:]
+	for j := range d.times {
+		d.times[j].Offset = max(d.times[j].Offset-n, 0)
+	}
+	if len(d.buf) == 0 {
+		d.buf, d.times = nil, nil
+	}
+}
+
+func (s *harStream) stop(reason string) {
+	if s.stopped == "" {
+		s.stopped = "recording stopped: " + reason
+	}
+	s.dirs = [2]harDirection{}
+}
+
+// parse parses the requests & responses of the data received so far. end is whether the stream has ended,
+// for responses whose body lasts until the server closes the connection.
+func (s *harStream) parse(end bool, maxBody int) {
+	for s.stopped == "" && len(s.dirs[0].buf) > 0 {
+		if !s.parseRequest(maxBody) {
+			break
+		}
+	}
+	for s.stopped == "" && len(s.dirs[1].buf) > 0 {
+		if !s.parseResponse(end || s.dirs[1].fin, maxBody) {
+			break
+		}
+	}
+}
+
+// parseRequest parses the request at the start of the client's data, and returns false if it's incomplete.
+func (s *harStream) parseRequest(maxBody int) bool {
+	d := &s.dirs[0]
+	msg, err := harReadMessage(d.buf, false, maxBody, func(br *bufio.Reader) (*http.Request, *http.Response, error) {
+		req, err := http.ReadRequest(br)
+		return req, nil, err
+	})
+	if err != nil {
+		s.stop("invalid HTTP request: " + err.Error())
+		return false
+	}
+	if msg.N == 0 {
+		return false
+	}
+	req := msg.Request
+	e := &harEntry{
+		start:           d.timeAt(0),
+		sent:            d.timeAt(msg.N - 1),
+		method:          req.Method,
+		ServerIPAddress: s.server.String(),
+		Connection:      strconv.Itoa(int(s.client)),
+		FlowUUID:        s.uuid,
+		Rule:            s.rule,
+	}
+	host := req.Host
+	if host == "" {
+		host = net.JoinHostPort(s.server.String(), strconv.Itoa(int(s.port)))
+	}
+	u := *req.URL
+	if u.Host == "" {
+		u.Scheme, u.Host = "http", host
+	}
+	e.Request = harRequest{
+		Method:      req.Method,
+		URL:         u.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     harCookies(req.Cookies()),
+		Headers:     msg.Headers,
+		QueryString: []harNameValue{},
+		HeadersSize: msg.HeadersSize,
+		BodySize:    msg.BodySize,
+	}
+	// Until its response, if any, arrives
+	e.Response = harResponse{
+		Cookies: []harCookie{},
+		Headers: []harNameValue{},
+		Content: harContent{MimeType: "x-unknown"},
+	}
+	e.StartedDateTime = e.start.Format(time.RFC3339Nano)
+	e.Timings = harTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+		Send:    harMillis(e.sent.Sub(e.start)),
+	}
+	e.Time = e.Timings.Send
+	for name, values := range u.Query() {
+		for _, v := range values {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(e.Request.QueryString, func(i, j int) bool {
+		return e.Request.QueryString[i].Name < e.Request.QueryString[j].Name
+	})
+	if msg.BodySize > 0 || msg.Comment != "" {
+		text, encoding := harText(msg.Body)
+		e.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     text,
+			Encoding: encoding,
+			Comment:  msg.Comment,
+		}
+	}
+	s.requests = append(s.requests, e)
+	d.consume(msg.N)
+	if msg.Comment != "" {
+		s.stop("body over the limit")
+	}
+	return true
+}
+
+// parseResponse parses the response at the start of the server's data, and returns false if it's incomplete.
+func (s *harStream) parseResponse(eof bool, maxBody int) bool {
+	if len(s.requests) == 0 {
+		// Its request came before the lookback
+		s.stop("response without request")
+		return false
+	}
+	e := s.requests[0]
+	d := &s.dirs[1]
+	msg, err := harReadMessage(d.buf, eof, maxBody, func(br *bufio.Reader) (*http.Request, *http.Response, error) {
+		resp, err := http.ReadResponse(br, &http.Request{Method: e.method})
+		return nil, resp, err
+	})
+	if err != nil {
+		s.stop("invalid HTTP response: " + err.Error())
+		return false
+	}
+	if msg.N == 0 {
+		return false
+	}
+	resp := msg.Response
+	start, end := d.timeAt(0), d.timeAt(msg.N-1)
+	d.consume(msg.N)
+	if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		// Interim, the final response follows
+		return true
+	}
+	s.requests = s.requests[1:]
+	text, encoding, size := harDecode(msg.Body, resp.Header.Get("Content-Encoding"), maxBody)
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "x-unknown"
+	}
+	e.Response = harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     harCookies(resp.Cookies()),
+		Headers:     msg.Headers,
+		Content: harContent{
+			Size:        size,
+			Compression: size - len(msg.Body),
+			MimeType:    mimeType,
+			Text:        text,
+			Encoding:    encoding,
+			Comment:     msg.Comment,
+		},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: msg.HeadersSize,
+		BodySize:    msg.BodySize,
+	}
+	if e.Response.Content.Compression < 0 || msg.Comment != "" {
+		e.Response.Content.Compression = 0
+	}
+	e.Timings.Wait = harMillis(start.Sub(e.sent))
+	e.Timings.Receive = harMillis(end.Sub(start))
+	e.Time = e.Timings.Send + e.Timings.Wait + e.Timings.Receive
+	s.entries = append(s.entries, e)
+	switch {
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		s.stop("switched protocols")
+	case msg.Comment != "":
+		s.stop("body over the limit")
+	}
+	return true
+}
+
+// harMessage is an HTTP message read by harReadMessage.
+type harMessage struct {
+	Request  *http.Request
+	Response *http.Response
+
+	N           int            // Bytes of the message, 0 if it's incomplete
+	Headers     []harNameValue // As sent
+	HeadersSize int
+	BodySize    int    // On the wire
+	Body        []byte // Without the transfer encoding
+	Comment     string // Why the body wasn't recorded, the rest of the stream isn't either
+}
+
+// harReadMessage reads the message at the start of data with read (http.ReadRequest or http.ReadResponse).
+// eof is whether data can't grow, for bodies lasting until the end of the stream. Bodies larger than
+// maxBody aren't read: the message is then only its headers.
+func harReadMessage(data []byte, eof bool, maxBody int, read func(*bufio.Reader) (*http.Request, *http.Response, error)) (harMessage, error) {
+	var msg harMessage
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		if len(data) > harMaxHeaderBytes {
+			return msg, errHARHeaderTooLarge
+		}
+		return msg, nil
+	}
+	headerEnd += 4
+	r := bytes.NewReader(data)
+	br := bufio.NewReaderSize(r, len(data))
+	req, resp, err := read(br)
+	if err != nil {
+		return msg, err
+	}
+	body, contentLength := io.ReadCloser(nil), int64(0)
+	untilClose := false
+	if req != nil {
+		body, contentLength = req.Body, req.ContentLength
+	} else {
+		body, contentLength = resp.Body, resp.ContentLength
+		untilClose = contentLength < 0 && len(resp.TransferEncoding) == 0 && body != http.NoBody
+	}
+	defer func() { _ = body.Close() }()
+	msg.Request, msg.Response = req, resp
+	msg.Headers = harHeaders(data[:headerEnd])
+	msg.HeadersSize = headerEnd
+	if body != http.NoBody && (contentLength > int64(maxBody) || len(data)-headerEnd > maxBody+harMaxHeaderBytes) {
+		// Too large to be recorded, and kept until complete
+		msg.N = headerEnd
+		msg.Comment = fmt.Sprintf("body over %d bytes, not recorded", maxBody)
+		return msg, nil
+	}
+	msg.Body, err = io.ReadAll(body)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// Incomplete
+			return harMessage{}, nil
+		}
+		return harMessage{}, err
+	}
+	if untilClose && !eof {
+		return harMessage{}, nil
+	}
+	msg.N = len(data) - r.Len() - br.Buffered()
+	msg.BodySize = msg.N - headerEnd
+	return msg, nil
+}
+
+// harHeaders returns the header fields of a message as sent, in order.
+func harHeaders(data []byte) []harNameValue {
+	headers := []harNameValue{}
+	lines := strings.Split(string(data), "\r\n")
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		headers = append(headers, harNameValue{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	hc := make([]harCookie, 0, len(cookies))
+	for _, c := range cookies {
+		k := harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			k.Expires = c.Expires.Format(time.RFC3339)
+		}
+		hc = append(hc, k)
+	}
+	return hc
+}
+
+// harDecode removes the content encoding (gzip or deflate) of a body if it can, and returns it
+// as HAR text with its encoding, and its decoded size.
+func harDecode(body []byte, contentEncoding string, maxBody int) (text, encoding string, size int) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip":
+		if gr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			r = gr
+		}
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(body))
+	}
+	if r != nil {
+		if decoded, err := io.ReadAll(io.LimitReader(r, int64(maxBody)+1)); err == nil && len(decoded) <= maxBody {
+			body = decoded
+		}
+	}
+	text, encoding = harText(body)
+	return text, encoding, len(body)
+}
+
+// harText returns data as HAR text, base64 encoded if it's not UTF-8.
+func harText(data []byte) (text, encoding string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func harMillis(d time.Duration) float64 {
+	return float64(max(d, 0).Microseconds()) / 1000
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	gfwio "github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var harTestUpdate = flag.Bool("update", false, "update the golden files of the tests")
+
+// harTestGzip is `{"items":["a","a","a","a","a","a","a","a"]}` compressed with gzip.
+var harTestGzip = []byte{
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xaa, 0x56, 0xca, 0x2c, 0x49, 0xcd,
+	0x2d, 0x56, 0xb2, 0x8a, 0x56, 0x4a, 0x54, 0xd2, 0xc1, 0x83, 0x63, 0x6b, 0x01, 0x03, 0x00, 0x70,
+	0x89, 0xeb, 0xa4, 0x2b, 0x00, 0x00, 0x00,
+}
+
+// harTestSegment is a packet of a test stream, sent at an offset from its start. Its sequence number is
+// relative to the sender's ISN, the client's being 1000 & the server's 5000.
+type harTestSegment struct {
+	at   time.Duration
+	rev  bool // Server to client
+	syn  bool
+	fin  bool
+	seq  uint32
+	data string
+}
+
+// harTestPacket returns a segment between 10.0.0.1:40000 and 93.184.216.34:80, starting with the IP header.
+func harTestPacket(t *testing.T, g harTestSegment) []byte {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(93, 184, 216, 34)}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 1000 + g.seq, SYN: g.syn, FIN: g.fin, ACK: !g.syn, Window: 65535}
+	if g.rev {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		tcp.Seq, tcp.ACK = 5000+g.seq, true
+	}
+	if g.syn {
+		tcp.Seq--
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(g.data)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// harTestStream returns the segments of a stream, with their sequence numbers computed from their data,
+// sent in order but for those listed in swap, which are swapped with the next one.
+func harTestStream(segments []harTestSegment, swap ...int) []harTestSegment {
+	var next [2]uint32
+	out := make([]harTestSegment, len(segments))
+	for i, g := range segments {
+		d := 0
+		if g.rev {
+			d = 1
+		}
+		g.seq = next[d]
+		next[d] += uint32(len(g.data))
+		out[i] = g
+	}
+	for _, i := range swap {
+		out[i], out[i+1] = out[i+1], out[i]
+	}
+	return out
+}
+
+func TestHARRecorder_Golden(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Duration { return time.Duration(ms) * time.Millisecond }
+	segments := harTestStream([]harTestSegment{
+		{at: at(0), syn: true},
+		{at: at(1), rev: true, syn: true},
+		// A request in 2 segments, with a query & a cookie
+		{at: at(2), data: "GET /index.html?b=2&a=1 HTTP/1.1\r\nHost: example.com\r\nCookie: session=abc\r\n"},
+		{at: at(7), data: "Accept-Encoding: gzip\r\n\r\n"},
+		// Pipelined before the first response
+		{at: at(10), data: "POST /api HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/json\r\nContent-Length: 11\r\n\r\n{\"ok\":true}"},
+		// The compressed response to the first request, its body in 2 segments
+		{at: at(40), rev: true, data: "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Encoding: gzip\r\n" +
+			"Set-Cookie: id=1; Path=/; HttpOnly\r\nContent-Length: 39\r\n\r\n" + string(harTestGzip[:20])},
+		{at: at(45), rev: true, data: string(harTestGzip[20:])},
+		// An interim response, then the chunked response to the second request, its last chunk first
+		{at: at(60), rev: true, data: "HTTP/1.1 100 Continue\r\n\r\n"},
+		{at: at(70), rev: true, data: "HTTP/1.1 201 Created\r\nLocation: /api/1\r\nTransfer-Encoding: chunked\r\n\r\n"},
+		{at: at(85), rev: true, data: "5\r\nhello\r\n"},
+		{at: at(80), rev: true, data: "0\r\n\r\n"},
+		// A request left without response
+		{at: at(100), data: "GET /slow HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{at: at(150), fin: true},
+	}, 9)
+
+	dir := t.TempDir()
+	r := &harRecorder{Dir: dir, Prefix: "test", MaxBody: 1024, MaxEntries: 10, streams: make(map[string]*harStream)}
+	info := ruleset.StreamInfo{
+		UUID:     "0123456789abcdef",
+		Protocol: ruleset.ProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(93, 184, 216, 34),
+		SrcPort:  40000,
+		DstPort:  80,
+	}
+	r.StreamAction(info, ruleset.ActionCaptureHTTP, "capture", false)
+	for _, g := range segments {
+		data := harTestPacket(t, g)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     start.Add(g.at),
+			CaptureLength: len(data),
+			Length:        len(data),
+			AncillaryData: []interface{}{gfwio.PacketComment("flow_uuid=" + info.UUID)},
+		}
+		if err := r.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.StreamEnd(engine.StreamEnd{Info: info, Reason: engine.StreamEndClosed})
+
+	files, err := filepath.Glob(filepath.Join(dir, "test-*-"+info.UUID+".har"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files = %v, %v, want 1", files, err)
+	}
+	got, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The version depends on the build
+	var f harFile
+	if err := json.Unmarshal(got, &f); err != nil {
+		t.Fatalf("invalid HAR file: %v", err)
+	}
+	got = bytes.Replace(got, []byte(`"version": "`+f.Log.Creator.Version+`"`), []byte(`"version": "test"`), 1)
+
+	golden := filepath.Join("testdata", "har", "stream.har")
+	if *harTestUpdate {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("HAR file differs from %s, run the test with -update to see how:\n%s", golden, got)
+	}
+}
@@ -0,0 +1,444 @@
+package cmd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"go.uber.org/zap"
+)
+
+const (
+	haDefaultTTL   = time.Hour
+	haQueueSize    = 65536
+	haNonceSize    = 16
+	haMaxFrameSize = 16 << 20
+	haDialTimeout  = 10 * time.Second
+	haMinBackoff   = time.Second
+	haMaxBackoff   = 30 * time.Second
+
+	haMessageReset      = "reset" // Forget the states previously sent, a snapshot follows
+	haMessageClassified = "classified"
+	haMessageEnded      = "ended"
+)
+
+// haSync replicates the classification of streams between the two instances of an HA pair
+// (engine.StateSync), e.g. redundant gateways failing over with keepalived, so that long-lived streams
+// keep the verdict of their rules on the instance they fail over to, instead of being joined midway
+// and left unclassified. Each instance connects to the listener of the other one to send its states:
+// a snapshot of those of its live streams on connection and every TTL/2, and the changes in between.
+// The states received expire after TTL without being sent again.
+//
+// Connections start with a random nonce sent by the listener; every message is then authenticated
+// with an HMAC-SHA256 of the nonce & message with the shared key, so that states can't be injected
+// or replayed. Messages are not encrypted.
+type haSync struct {
+	Listen string
+	Peer   string
+	Key    []byte
+	TTL    time.Duration
+
+	queue chan haMessage // To send, dropped while not connected as a snapshot follows the connection
+
+	ownMutex sync.Mutex
+	own      map[haKey]*engine.StreamState // States of the streams of this instance
+
+	peerMutex sync.RWMutex
+	peer      map[haKey]haPeerState // States received from the peer
+
+	errMutex sync.Mutex
+	err      error // Why the peer isn't connected to, nil if it is
+}
+
+type haKey struct {
+	Protocol ruleset.Protocol
+	SrcIP    [16]byte
+	DstIP    [16]byte
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+func newHAKey(proto ruleset.Protocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) haKey {
+	k := haKey{Protocol: proto, SrcPort: srcPort, DstPort: dstPort}
+	copy(k.SrcIP[:], srcIP.To16())
+	copy(k.DstIP[:], dstIP.To16())
+	return k
+}
+
+type haPeerState struct {
+	State   *engine.StreamState
+	Expires time.Time
+}
+
+// haMessage is the JSON payload of a frame.
+type haMessage struct {
+	Type   string         `json:"type"`
+	Stream *haStreamState `json:"stream,omitempty"`
+}
+
+type haStreamState struct {
+	Protocol  string                   `json:"proto"`
+	SrcIP     net.IP                   `json:"srcIP"`
+	DstIP     net.IP                   `json:"dstIP"`
+	SrcPort   uint16                   `json:"srcPort"`
+	DstPort   uint16                   `json:"dstPort"`
+	StartTime time.Time                `json:"startTime"`
+	Props     analyzer.CombinedPropMap `json:"props,omitempty"`
+}
+
+func newHASync(listen, peer string, key []byte, ttl time.Duration) *haSync {
+	return &haSync{
+		Listen: listen,
+		Peer:   peer,
+		Key:    key,
+		TTL:    ttl,
+		queue:  make(chan haMessage, haQueueSize),
+		own:    make(map[haKey]*engine.StreamState),
+		peer:   make(map[haKey]haPeerState),
+		err:    errors.New("not connected yet"),
+	}
+}
+
+var _ engine.StateSync = (*haSync)(nil)
+
+func (h *haSync) Classified(st *engine.StreamState) {
+	h.ownMutex.Lock()
+	h.own[newHAKey(st.Protocol, st.SrcIP, st.DstIP, st.SrcPort, st.DstPort)] = st
+	h.ownMutex.Unlock()
+	h.send(haMessage{Type: haMessageClassified, Stream: toHAStreamState(st, true)})
+}
+
+func (h *haSync) Ended(st *engine.StreamState) {
+	h.ownMutex.Lock()
+	delete(h.own, newHAKey(st.Protocol, st.SrcIP, st.DstIP, st.SrcPort, st.DstPort))
+	h.ownMutex.Unlock()
+	h.send(haMessage{Type: haMessageEnded, Stream: toHAStreamState(st, false)})
+}
+
+// send queues a message without blocking. It's dropped if the queue is full,
+// the peer gets every state again with the next snapshot.
+func (h *haSync) send(m haMessage) {
+	select {
+	case h.queue <- m:
+	default:
+	}
+}
+
+func (h *haSync) Lookup(proto ruleset.Protocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) *engine.StreamState {
+	h.peerMutex.RLock()
+	defer h.peerMutex.RUnlock()
+	ps, ok := h.peer[newHAKey(proto, srcIP, dstIP, srcPort, dstPort)]
+	if !ok || time.Now().After(ps.Expires) {
+		return nil
+	}
+	return ps.State
+}
+
+func toHAStreamState(st *engine.StreamState, props bool) *haStreamState {
+	hs := &haStreamState{
+		Protocol:  st.Protocol.String(),
+		SrcIP:     st.SrcIP,
+		DstIP:     st.DstIP,
+		SrcPort:   st.SrcPort,
+		DstPort:   st.DstPort,
+		StartTime: st.StartTime,
+	}
+	if props {
+		hs.Props = st.Props
+	}
+	return hs
+}
+
+func (hs *haStreamState) streamState() (*engine.StreamState, error) {
+	st := &engine.StreamState{
+		SrcIP:     hs.SrcIP,
+		DstIP:     hs.DstIP,
+		SrcPort:   hs.SrcPort,
+		DstPort:   hs.DstPort,
+		StartTime: hs.StartTime,
+		Props:     hs.Props,
+	}
+	switch hs.Protocol {
+	case ruleset.ProtocolTCP.String():
+		st.Protocol = ruleset.ProtocolTCP
+	case ruleset.ProtocolUDP.String():
+		st.Protocol = ruleset.ProtocolUDP
+	case ruleset.ProtocolSCTP.String():
+		st.Protocol = ruleset.ProtocolSCTP
+	default:
+		return nil, fmt.Errorf("invalid protocol %q", hs.Protocol)
+	}
+	if st.SrcIP == nil || st.DstIP == nil {
+		return nil, errors.New("missing IP address")
+	}
+	if st.Props == nil {
+		st.Props = make(analyzer.CombinedPropMap)
+	}
+	return st, nil
+}
+
+// Run receives the states of the peer, and sends it those of this instance, until the context is cancelled.
+func (h *haSync) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", h.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	go h.runSender(ctx)
+	go h.expire(ctx)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go h.receive(ctx, conn)
+	}
+}
+
+// receive applies the messages of a connection from the peer until it's closed.
+func (h *haSync) receive(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	nonce := make([]byte, haNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		logger.Error("failed to generate HA nonce", zap.Error(err))
+		return
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return
+	}
+	logger.Info("HA peer connected", zap.String("addr", conn.RemoteAddr().String()))
+	err := h.receiveMessages(conn, nonce)
+	if ctx.Err() == nil {
+		logger.Warn("HA peer disconnected", zap.String("addr", conn.RemoteAddr().String()), zap.Error(err))
+	}
+}
+
+func (h *haSync) receiveMessages(r io.Reader, nonce []byte) error {
+	for {
+		payload, err := h.readFrame(r, nonce)
+		if err != nil {
+			return err
+		}
+		var m haMessage
+		if err := json.Unmarshal(payload, &m); err != nil {
+			return fmt.Errorf("invalid message: %w", err)
+		}
+		if m.Type == haMessageReset {
+			h.peerMutex.Lock()
+			h.peer = make(map[haKey]haPeerState)
+			h.peerMutex.Unlock()
+			continue
+		}
+		if m.Stream == nil {
+			return fmt.Errorf("invalid %s message: no stream", m.Type)
+		}
+		st, err := m.Stream.streamState()
+		if err != nil {
+			return fmt.Errorf("invalid %s message: %w", m.Type, err)
+		}
+		key := newHAKey(st.Protocol, st.SrcIP, st.DstIP, st.SrcPort, st.DstPort)
+		h.peerMutex.Lock()
+		switch m.Type {
+		case haMessageClassified:
+			h.peer[key] = haPeerState{State: st, Expires: time.Now().Add(h.TTL)}
+		case haMessageEnded:
+			delete(h.peer, key)
+		}
+		h.peerMutex.Unlock()
+	}
+}
+
+// runSender connects to the peer and sends it the states of this instance,
+// reconnecting with a backoff until the context is cancelled.
+func (h *haSync) runSender(ctx context.Context) {
+	backoff := haMinBackoff
+	for {
+		start := time.Now()
+		err := h.sendStates(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		h.setError(err)
+		if time.Since(start) > haMaxBackoff {
+			// Was connected for a while, not a persistent failure
+			backoff = haMinBackoff
+		}
+		logger.Warn("HA peer connection lost, reconnecting", zap.String("peer", h.Peer),
+			zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, haMaxBackoff)
+	}
+}
+
+// sendStates sends the states of this instance to the peer, until the connection fails or the context is cancelled.
+func (h *haSync) sendStates(ctx context.Context) error {
+	d := net.Dialer{Timeout: haDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", h.Peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	nonce := make([]byte, haNonceSize)
+	if _, err := io.ReadFull(conn, nonce); err != nil {
+		return err
+	}
+	// The changes queued until now are in the snapshot
+	for len(h.queue) > 0 {
+		<-h.queue
+	}
+	if err := h.sendSnapshot(conn, nonce, true); err != nil {
+		return err
+	}
+	h.setError(nil)
+	logger.Info("connected to HA peer", zap.String("peer", h.Peer))
+	ticker := time.NewTicker(h.TTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-h.queue:
+			if err := h.writeFrame(conn, nonce, m); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := h.sendSnapshot(conn, nonce, false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot sends the states of all the live streams of this instance, preceded by a reset if reset.
+func (h *haSync) sendSnapshot(w io.Writer, nonce []byte, reset bool) error {
+	if reset {
+		if err := h.writeFrame(w, nonce, haMessage{Type: haMessageReset}); err != nil {
+			return err
+		}
+	}
+	h.ownMutex.Lock()
+	states := make([]*engine.StreamState, 0, len(h.own))
+	for _, st := range h.own {
+		states = append(states, st)
+	}
+	h.ownMutex.Unlock()
+	for _, st := range states {
+		if err := h.writeFrame(w, nonce, haMessage{Type: haMessageClassified, Stream: toHAStreamState(st, true)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFrame writes a message as its length, HMAC & JSON payload.
+func (h *haSync) writeFrame(w io.Writer, nonce []byte, m haMessage) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		// Not the connection's fault, e.g. a property that can't be encoded
+		logger.Warn("failed to encode HA message", zap.String("type", m.Type), zap.Error(err))
+		return nil
+	}
+	frame := make([]byte, 4, 4+sha256.Size+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(sha256.Size+len(payload)))
+	frame = append(frame, h.mac(nonce, payload)...)
+	frame = append(frame, payload...)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrame reads a frame and returns its payload, once its HMAC has been verified.
+func (h *haSync) readFrame(r io.Reader, nonce []byte) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < sha256.Size || n > haMaxFrameSize {
+		return nil, fmt.Errorf("invalid frame size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	payload := frame[sha256.Size:]
+	if !hmac.Equal(frame[:sha256.Size], h.mac(nonce, payload)) {
+		return nil, errors.New("invalid HMAC, check that both instances have the same key")
+	}
+	return payload, nil
+}
+
+func (h *haSync) mac(nonce, payload []byte) []byte {
+	m := hmac.New(sha256.New, h.Key)
+	m.Write(nonce)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// expire removes the states of the peer that have expired, until the context is cancelled.
+func (h *haSync) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		h.peerMutex.Lock()
+		for k, ps := range h.peer {
+			if now.After(ps.Expires) {
+				delete(h.peer, k)
+			}
+		}
+		h.peerMutex.Unlock()
+	}
+}
+
+func (h *haSync) setError(err error) {
+	h.errMutex.Lock()
+	defer h.errMutex.Unlock()
+	h.err = err
+}
+
+// Check returns an error if the peer isn't connected to, for readiness:
+// the streams of this instance wouldn't keep their classification if it failed over.
+func (h *haSync) Check() error {
+	h.errMutex.Lock()
+	defer h.errMutex.Unlock()
+	if h.err != nil {
+		return fmt.Errorf("peer %s not connected: %w", h.Peer, h.err)
+	}
+	return nil
+}
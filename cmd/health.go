@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+
+	"go.uber.org/zap"
+)
+
+const (
+	healthCheckTimeout  = 5 * time.Second
+	healthReadyInterval = time.Second // How often the engine is checked until it's ready
+)
+
+// healthChecker reports the state of a running instance, for the /healthz & /readyz endpoints
+// of the API, and the systemd watchdog.
+//
+// Liveness only covers the engine: it's running and its workers are picking up packets.
+// Readiness also covers the IOs (attached to their queue, with their firewall rules in place),
+// and the ruleset (the latest reload didn't fail). The event sinks are reported too,
+// but don't affect readiness, as losing events is no reason to stop filtering traffic.
+type healthChecker struct {
+	Engine         engine.Engine
+	Rulesets       *rulesetManager
+	Events         *eventLog         // Optional
+	Conns          *connLog          // Optional
+	Degrade        *degradeMonitor   // Optional
+	Kubernetes     *k8sWatcher       // Optional
+	Docker         *dockerWatcher    // Optional
+	HA             *haSync           // Optional
+	CrowdSec       *crowdSecBouncer  // Optional
+	CrowdSecReport *crowdSecReporter // Optional
+	Fail2ban       *fail2banTailer   // Optional
+	Feeds          []*intelFeed
+	Sinkhole       *sinkhole // Optional
+	Usage          *usageStore
+	Research       *researchMode // Optional
+}
+
+type healthReport struct {
+	Status string        `json:"status"` // ok, degraded (an optional check failed) or failing
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Optional bool   `json:"optional,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (r *healthReport) add(name string, optional bool, err error) {
+	c := healthCheck{Name: name, OK: err == nil, Optional: optional}
+	if err != nil {
+		c.Error = err.Error()
+		if !optional {
+			r.Status = "failing"
+		} else if r.Status == "ok" {
+			r.Status = "degraded"
+		}
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// OK returns whether all the required checks have passed.
+func (r *healthReport) OK() bool {
+	return r.Status != "failing"
+}
+
+// Liveness checks whether the engine is running, with its workers picking up packets.
+func (h *healthChecker) Liveness(ctx context.Context) *healthReport {
+	r := &healthReport{Status: "ok"}
+	r.add("engine", false, h.Engine.Health(ctx).Workers)
+	return r
+}
+
+// Readiness checks the engine, its IOs, the ruleset and the sinks.
+func (h *healthChecker) Readiness(ctx context.Context) *healthReport {
+	r := &healthReport{Status: "ok"}
+	eh := h.Engine.Health(ctx)
+	r.add("engine", false, eh.Workers)
+	for i, err := range eh.IOs {
+		r.add(fmt.Sprintf("io[%d]", i), false, err)
+	}
+	r.add("ruleset", false, h.Rulesets.LastError())
+	sinks := h.Events.Check()
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.add(name, true, sinks[name])
+	}
+	if h.Conns != nil {
+		r.add("connLog.file", true, h.Conns.Check())
+	}
+	if h.Degrade != nil {
+		r.add("degrade", true, h.Degrade.Check())
+	}
+	if h.Kubernetes != nil {
+		r.add("kubernetes", true, h.Kubernetes.Check())
+	}
+	if h.Docker != nil {
+		r.add("docker", true, h.Docker.Check())
+	}
+	if h.HA != nil {
+		r.add("ha", true, h.HA.Check())
+	}
+	if h.CrowdSec != nil {
+		r.add("crowdsec", true, h.CrowdSec.Check())
+	}
+	if h.CrowdSecReport != nil {
+		r.add("crowdsec.report", true, h.CrowdSecReport.Check())
+	}
+	if h.Fail2ban != nil {
+		r.add("fail2ban", true, h.Fail2ban.Check())
+	}
+	for _, f := range h.Feeds {
+		r.add("feeds."+f.Name, true, f.Check())
+	}
+	if h.Usage != nil && h.Usage.File != "" {
+		r.add("accounting.file", true, h.Usage.Check())
+	}
+	if h.Sinkhole != nil && h.Sinkhole.Log != nil {
+		r.add("sinkhole.log", true, h.Sinkhole.Check())
+	}
+	if h.Research != nil {
+		r.add("research.file", true, h.Research.Check())
+	}
+	return r
+}
+
+// RunSystemdNotify tells systemd when the engine is ready (its IOs attached to their queue,
+// with their firewall rules in place), and then keeps pinging its watchdog as long as every worker
+// answers, until the context is cancelled. It does nothing if the service isn't of Type=notify
+// (NOTIFY_SOCKET isn't set). STOPPING=1 is up to the shutdown, see runMain.
+func (h *healthChecker) RunSystemdNotify(ctx context.Context) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog := systemdWatchdogInterval()
+	ticker := time.NewTicker(healthReadyInterval)
+	defer ticker.Stop()
+	ready := false
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		var r *healthReport
+		if ready {
+			r = h.Liveness(checkCtx)
+		} else {
+			r = h.Readiness(checkCtx)
+		}
+		cancel()
+		if r.OK() {
+			if !ready {
+				ready = true
+				if err := systemdNotify("READY=1"); err != nil {
+					logger.Warn("failed to notify systemd", zap.Error(err))
+				}
+				if watchdog > 0 {
+					// As recommended by sd_watchdog_enabled(3)
+					ticker.Reset(watchdog / 2)
+				}
+			}
+			if watchdog > 0 {
+				_ = systemdNotify("WATCHDOG=1")
+			}
+		} else if ready {
+			logger.Warn("engine not alive, not pinging the watchdog", zap.String("error", r.Checks[0].Error))
+		}
+		if ready && watchdog <= 0 {
+			// Nothing left to do
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// systemdWatchdogInterval returns the watchdog timeout set by systemd for this process, 0 if none.
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// systemdNotify sends a state to systemd, see sd_notify(3). It does nothing if NOTIFY_SOCKET isn't set.
+func systemdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// Abstract socket
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,498 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"go.uber.org/zap"
+)
+
+const (
+	k8sServiceAccountDir     = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sDefaultSyncTimeout    = 30 * time.Second
+	k8sListPageSize          = 500
+	k8sListTimeout           = time.Minute
+	k8sWatchTimeout          = 5 * time.Minute // Asked to the API server, which then ends the watch cleanly
+	k8sMinBackoff            = time.Second
+	k8sMaxBackoff            = time.Minute
+	k8sResponseHeaderTimeout = 30 * time.Second
+
+	k8sKindPod     = "Pod"
+	k8sKindService = "Service"
+)
+
+// errK8sExpired is returned by a watch when its resource version is too old (410 Gone), so it must list again.
+var errK8sExpired = errors.New("resource version expired")
+
+// k8sWatcher keeps track of the IPs of the pods & services of a Kubernetes cluster, by listing
+// and then watching them through the API server, so that the rules can match streams on the workloads
+// they come from & go to (the k8s variable). Host network pods are left out, as their IP is the node's,
+// and so are the pods that are done (succeeded or failed) and headless services.
+// It's safe for concurrent use.
+type k8sWatcher struct {
+	APIServer  string       // https://host:port
+	TokenFile  string       // Re-read for every request, as service account tokens are rotated
+	Client     *http.Client // Without a timeout, watches are long requests
+	Namespaces []string     // All if empty
+
+	mutex   sync.RWMutex
+	objects map[string]*k8sEntry // By UID
+	ips     map[string]string    // IP -> UID of the object it belongs to
+	errs    map[string]error     // Latest error of each resource, nil once listed & watched without error
+	synced  chan struct{}        // Closed once every resource has been listed
+}
+
+func newK8sWatcher(apiServer, tokenFile string, client *http.Client, namespaces []string) *k8sWatcher {
+	w := &k8sWatcher{
+		APIServer:  apiServer,
+		TokenFile:  tokenFile,
+		Client:     client,
+		Namespaces: namespaces,
+		objects:    make(map[string]*k8sEntry),
+		ips:        make(map[string]string),
+		errs:       make(map[string]error),
+		synced:     make(chan struct{}),
+	}
+	for _, r := range w.resources() {
+		w.errs[r.String()] = errors.New("not listed yet")
+	}
+	return w
+}
+
+// k8sResource is a kind of objects, in a namespace or all of them.
+type k8sResource struct {
+	Kind      string
+	Namespace string // Empty for all namespaces
+}
+
+func (r k8sResource) String() string {
+	name := strings.ToLower(r.Kind) + "s"
+	if r.Namespace != "" {
+		return r.Namespace + "/" + name
+	}
+	return name
+}
+
+func (r k8sResource) path() string {
+	name := strings.ToLower(r.Kind) + "s"
+	if r.Namespace != "" {
+		return "/api/v1/namespaces/" + url.PathEscape(r.Namespace) + "/" + name
+	}
+	return "/api/v1/" + name
+}
+
+type k8sEntry struct {
+	Resource k8sResource
+	IPs      []string
+	Workload *ruleset.Workload // Shared with the rules, never modified
+}
+
+// k8sObject is the part of pods & services that matters here.
+type k8sObject struct {
+	Metadata struct {
+		UID             string            `json:"uid"`
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		Labels          map[string]string `json:"labels"`
+		ResourceVersion string            `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec struct {
+		HostNetwork bool     `json:"hostNetwork"` // Pod
+		ClusterIP   string   `json:"clusterIP"`   // Service
+		ClusterIPs  []string `json:"clusterIPs"`  // Service, dual-stack
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"` // Pod
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"` // Dual-stack
+	} `json:"status"`
+}
+
+// IPs returns the IPs of the object, none if it's left out.
+func (o *k8sObject) IPs(kind string) []string {
+	var ips []string
+	switch kind {
+	case k8sKindPod:
+		if o.Spec.HostNetwork || o.Status.Phase == "Succeeded" || o.Status.Phase == "Failed" {
+			return nil
+		}
+		for _, ip := range o.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		if len(ips) == 0 && o.Status.PodIP != "" {
+			ips = append(ips, o.Status.PodIP)
+		}
+	case k8sKindService:
+		ips = o.Spec.ClusterIPs
+		if len(ips) == 0 && o.Spec.ClusterIP != "" {
+			ips = []string{o.Spec.ClusterIP}
+		}
+	}
+	// Normalized as net.IP.String() would, to be found by Workload
+	normalized := make([]string, 0, len(ips))
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil {
+			normalized = append(normalized, ip.String())
+		}
+	}
+	return normalized
+}
+
+type k8sList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+		Continue        string `json:"continue"`
+	} `json:"metadata"`
+	Items []k8sObject `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"` // ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Object json.RawMessage `json:"object"`
+}
+
+// k8sStatus is the object of ERROR watch events, and the body of failed requests.
+type k8sStatus struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (w *k8sWatcher) resources() []k8sResource {
+	namespaces := w.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	var rs []k8sResource
+	for _, ns := range namespaces {
+		rs = append(rs, k8sResource{Kind: k8sKindPod, Namespace: ns}, k8sResource{Kind: k8sKindService, Namespace: ns})
+	}
+	return rs
+}
+
+// Run keeps the objects up to date until the context is cancelled.
+func (w *k8sWatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, r := range w.resources() {
+		wg.Add(1)
+		go func(r k8sResource) {
+			defer wg.Done()
+			w.watchResource(ctx, r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// watchResource lists the objects of a resource, then watches them from there, and lists them again
+// when the watch can't be resumed. Errors are retried with a backoff, until the context is cancelled.
+func (w *k8sWatcher) watchResource(ctx context.Context, r k8sResource) {
+	backoff := k8sMinBackoff
+	for {
+		version, err := w.list(ctx, r)
+		if err == nil {
+			w.setError(r, nil)
+			backoff = k8sMinBackoff
+			for err == nil {
+				version, err = w.watch(ctx, r, version)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errK8sExpired) {
+			// Not a failure, the watch was just too far behind
+			logger.Debug("kubernetes watch expired, listing again", zap.Stringer("resource", r))
+			continue
+		}
+		w.setError(r, err)
+		logger.Warn("failed to watch kubernetes objects, retrying", zap.Stringer("resource", r),
+			zap.Error(err), zap.Duration("backoff", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, k8sMaxBackoff)
+	}
+}
+
+// list replaces the objects of a resource with those listed, and returns the resource version to watch from.
+func (w *k8sWatcher) list(ctx context.Context, r k8sResource) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, k8sListTimeout)
+	defer cancel()
+	var objects []k8sObject
+	var list k8sList
+	for {
+		query := url.Values{"limit": {fmt.Sprint(k8sListPageSize)}}
+		if list.Metadata.Continue != "" {
+			query.Set("continue", list.Metadata.Continue)
+		}
+		resp, err := w.get(ctx, r.path(), query)
+		if err != nil {
+			return "", err
+		}
+		list = k8sList{}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		_ = resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("invalid list of %s: %w", r, err)
+		}
+		objects = append(objects, list.Items...)
+		if list.Metadata.Continue == "" {
+			break
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	listed := make(map[string]bool, len(objects))
+	for i := range objects {
+		listed[objects[i].Metadata.UID] = true
+		w.set(r, &objects[i])
+	}
+	for uid, e := range w.objects {
+		if e.Resource == r && !listed[uid] {
+			w.delete(uid)
+		}
+	}
+	logger.Debug("kubernetes objects listed", zap.Stringer("resource", r), zap.Int("count", len(objects)))
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the changes to the objects of a resource since a resource version, until the API server
+// ends the watch, and returns the resource version to resume from.
+func (w *k8sWatcher) watch(ctx context.Context, r k8sResource, version string) (string, error) {
+	resp, err := w.get(ctx, r.path(), url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(k8sWatchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev k8sWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				return version, nil
+			}
+			return version, err
+		}
+		if ev.Type == "ERROR" {
+			var status k8sStatus
+			_ = json.Unmarshal(ev.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errK8sExpired
+			}
+			return version, fmt.Errorf("watch error %d: %s", status.Code, status.Message)
+		}
+		var o k8sObject
+		if err := json.Unmarshal(ev.Object, &o); err != nil {
+			return version, fmt.Errorf("invalid %s event: %w", ev.Type, err)
+		}
+		version = o.Metadata.ResourceVersion
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			w.mutex.Lock()
+			w.set(r, &o)
+			w.mutex.Unlock()
+		case "DELETED":
+			w.mutex.Lock()
+			w.delete(o.Metadata.UID)
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// get sends a GET request to the API server, and returns the response if it's a success.
+func (w *k8sWatcher) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(w.APIServer, "/")+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if w.TokenFile != "" {
+		token, err := os.ReadFile(w.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var status k8sStatus
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(bs, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(bs))
+		}
+		if resp.StatusCode == http.StatusGone {
+			return nil, errK8sExpired
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, status.Message)
+	}
+	return resp, nil
+}
+
+// set adds or updates an object. The mutex must be held.
+func (w *k8sWatcher) set(r k8sResource, o *k8sObject) {
+	uid := o.Metadata.UID
+	if old := w.objects[uid]; old != nil {
+		w.unindex(uid, old)
+	}
+	ips := o.IPs(r.Kind)
+	if len(ips) == 0 {
+		delete(w.objects, uid)
+		return
+	}
+	e := &k8sEntry{
+		Resource: r,
+		IPs:      ips,
+		Workload: &ruleset.Workload{
+			Kind:      r.Kind,
+			Namespace: o.Metadata.Namespace,
+			Name:      o.Metadata.Name,
+			Labels:    o.Metadata.Labels,
+		},
+	}
+	w.objects[uid] = e
+	for _, ip := range ips {
+		// The latest object to claim an IP gets it, e.g. a new pod while the previous one is terminating
+		w.ips[ip] = uid
+	}
+}
+
+// delete removes an object. The mutex must be held.
+func (w *k8sWatcher) delete(uid string) {
+	if e := w.objects[uid]; e != nil {
+		w.unindex(uid, e)
+		delete(w.objects, uid)
+	}
+}
+
+// unindex removes the IPs of an object from the index, unless they have been claimed by another one since.
+func (w *k8sWatcher) unindex(uid string, e *k8sEntry) {
+	for _, ip := range e.IPs {
+		if w.ips[ip] == uid {
+			delete(w.ips, ip)
+		}
+	}
+}
+
+func (w *k8sWatcher) setError(r k8sResource, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.errs[r.String()] = err
+	if err != nil {
+		return
+	}
+	select {
+	case <-w.synced:
+		return
+	default:
+	}
+	for _, err := range w.errs {
+		if err != nil {
+			return
+		}
+	}
+	close(w.synced)
+}
+
+// WaitSynced waits until every resource has been listed once, and returns false if it took over timeout.
+func (w *k8sWatcher) WaitSynced(timeout time.Duration) bool {
+	select {
+	case <-w.synced:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Workload returns the pod or service an IP belongs to, or nil if it's unknown.
+func (w *k8sWatcher) Workload(ip net.IP) *ruleset.Workload {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if e := w.objects[w.ips[ip.String()]]; e != nil {
+		return e.Workload
+	}
+	return nil
+}
+
+// Check returns an error if a resource has failed to be listed or watched since it last succeeded,
+// for readiness: the workloads of the rules may be out of date.
+func (w *k8sWatcher) Check() error {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	var errs []string
+	for name, err := range w.errs {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// testWorkloads is the workload resolver of the commands that don't watch the cluster:
+// the workloads of the source & destination of the test case being run, see testCase.K8s.
+type testWorkloads map[string]*ruleset.Workload
+
+func (w testWorkloads) Workload(ip net.IP) *ruleset.Workload {
+	return w[ip.String()]
+}
+
+// testCaseWorkloads are the workloads of the current test case, when kubernetes is configured.
+var testCaseWorkloads = make(testWorkloads)
+
+// set replaces the workloads with those of a test case.
+func (w testWorkloads) set(c *testCase) {
+	for ip := range w {
+		delete(w, ip)
+	}
+	for _, side := range []struct {
+		IP       string
+		Workload *testCaseWorkload
+	}{{c.IP.Src, c.K8s.Src}, {c.IP.Dst, c.K8s.Dst}} {
+		ip := net.ParseIP(side.IP)
+		if ip != nil && side.Workload != nil {
+			w[ip.String()] = &ruleset.Workload{
+				Kind:      side.Workload.Kind,
+				Namespace: side.Workload.Namespace,
+				Name:      side.Workload.Name,
+				Labels:    side.Workload.Labels,
+			}
+		}
+	}
+}
+
+// testWorkloads returns the workload resolver of the test cases, or nil if kubernetes isn't configured.
+func (c *cliConfig) testWorkloads() ruleset.WorkloadResolver {
+	if !c.Kubernetes.Enabled {
+		return nil
+	}
+	return testCaseWorkloads
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Flags
+var (
+	debugIPs       []string
+	debugStreams   []int64
+	debugAnalyzers []string
+	debugTTL       time.Duration
+	debugClear     bool
+)
+
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Control the logging of a running instance through its API",
+}
+
+var logLevelCmd = &cobra.Command{
+	Use:   "level [debug|info|warn|error]",
+	Short: "Show or change the log level",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   runLogLevel,
+}
+
+var logDebugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Show or set the streams whose debug messages are logged whatever the log level",
+	Args:  cobra.NoArgs,
+	Run:   runLogDebug,
+}
+
+func init() {
+	logCmd.PersistentFlags().StringVar(&apiAddr, "api", "", "API address (default: api.listen from the config file)")
+	logCmd.PersistentFlags().StringVar(&apiToken, "api-token", "", "API token (default: api.token from the config file)")
+	logDebugCmd.Flags().StringSliceVar(&debugIPs, "ip", nil, "streams from or to these IPs or CIDRs")
+	logDebugCmd.Flags().Int64SliceVar(&debugStreams, "stream", nil, "streams with these IDs")
+	logDebugCmd.Flags().StringSliceVar(&debugAnalyzers, "analyzer", nil, "messages of these analyzers")
+	logDebugCmd.Flags().DurationVar(&debugTTL, "ttl", 0, "stop after this duration (0 = never)")
+	logDebugCmd.Flags().BoolVar(&debugClear, "clear", false, "clear the targets")
+	logCmd.AddCommand(logLevelCmd, logDebugCmd)
+	rootCmd.AddCommand(logCmd)
+}
+
+func runLogLevel(cmd *cobra.Command, args []string) {
+	var resp apiLogLevel
+	if len(args) == 0 {
+		callAPI(http.MethodGet, "/log-level", nil, &resp)
+		fmt.Println(resp.Level)
+		return
+	}
+	callAPI(http.MethodPut, "/log-level", apiLogLevel{Level: args[0]}, &resp)
+	fmt.Printf("log level changed from %s to %s\n", resp.Previous, resp.Level)
+}
+
+func runLogDebug(cmd *cobra.Command, args []string) {
+	var resp apiDebugTargets
+	switch {
+	case debugClear:
+		callAPI(http.MethodDelete, "/debug-targets", nil, &resp)
+	case len(debugIPs) > 0 || len(debugStreams) > 0 || len(debugAnalyzers) > 0:
+		req := apiDebugTargets{IPs: debugIPs, Streams: debugStreams, Analyzers: debugAnalyzers}
+		if debugTTL > 0 {
+			req.TTL = debugTTL.String()
+		}
+		callAPI(http.MethodPut, "/debug-targets", req, &resp)
+	default:
+		callAPI(http.MethodGet, "/debug-targets", nil, &resp)
+	}
+	if len(resp.IPs) == 0 && len(resp.Streams) == 0 && len(resp.Analyzers) == 0 {
+		fmt.Println("no debug targets")
+		return
+	}
+	if len(resp.IPs) > 0 {
+		fmt.Printf("ips:\t%s\n", strings.Join(resp.IPs, ", "))
+	}
+	if len(resp.Streams) > 0 {
+		fmt.Printf("streams:\t%s\n", strings.Trim(fmt.Sprint(resp.Streams), "[]"))
+	}
+	if len(resp.Analyzers) > 0 {
+		fmt.Printf("analyzers:\t%s\n", strings.Join(resp.Analyzers, ", "))
+	}
+	if resp.Expires != nil {
+		fmt.Printf("expires:\t%s\n", resp.Expires.Format(time.RFC3339))
+	}
+}
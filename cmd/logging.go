@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// debugLogger is like logger, but always at debug level, for the debug messages of the debug targets.
+// nil until the logger is initialized.
+var debugLogger *zap.Logger
+
+// logLevelOrder is the order the log level is cycled through by SIGTTIN (more verbose) and SIGTTOU (less verbose).
+var logLevelOrder = []zapcore.Level{zapcore.ErrorLevel, zapcore.WarnLevel, zapcore.InfoLevel, zapcore.DebugLevel}
+
+// setLogLevel changes the log level, and returns the previous one.
+// source is who asked for it, for the log.
+func setLogLevel(level zapcore.Level, source string) zapcore.Level {
+	previous := atomicLogLevel.Level()
+	atomicLogLevel.SetLevel(level)
+	logger.Info("log level changed",
+		zap.String("source", source),
+		zap.Stringer("previous", previous),
+		zap.Stringer("level", level))
+	return previous
+}
+
+// stepLogLevel makes the logs more (verbose) or less verbose by one level, within logLevelOrder.
+// It returns the previous and the new level, the same if it was already at the end.
+func stepLogLevel(verbose bool, source string) (zapcore.Level, zapcore.Level) {
+	current := atomicLogLevel.Level()
+	i := 0
+	for i < len(logLevelOrder)-1 && logLevelOrder[i] > current {
+		i++
+	}
+	if verbose && i < len(logLevelOrder)-1 {
+		i++
+	} else if !verbose && i > 0 {
+		i--
+	}
+	if logLevelOrder[i] != current {
+		setLogLevel(logLevelOrder[i], source)
+	}
+	return current, logLevelOrder[i]
+}
+
+// debugTargets are the streams whose debug messages are logged whatever the log level:
+// those from or to IPs, by ID, or the messages of analyzers (and the property updates of the streams
+// they have found properties for). Zero Expires means they never expire.
+type debugTargets struct {
+	IPs       []*net.IPNet
+	Streams   map[int64]bool
+	Analyzers map[string]bool
+	Expires   time.Time
+}
+
+// parseDebugTargets parses IPs or CIDRs, and returns the targets expiring after ttl (0 = never).
+func parseDebugTargets(ips []string, streams []int64, analyzers []string, ttl time.Duration) (*debugTargets, error) {
+	t := &debugTargets{
+		Streams:   make(map[int64]bool, len(streams)),
+		Analyzers: make(map[string]bool, len(analyzers)),
+	}
+	for _, s := range ips {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid IP " + s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			t.IPs = append(t.IPs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		t.IPs = append(t.IPs, n)
+	}
+	for _, id := range streams {
+		t.Streams[id] = true
+	}
+	for _, name := range analyzers {
+		t.Analyzers[name] = true
+	}
+	if ttl > 0 {
+		t.Expires = time.Now().Add(ttl)
+	}
+	return t, nil
+}
+
+// matchIP returns whether any of the IPs is targeted.
+func (t *debugTargets) matchIP(ips ...net.IP) bool {
+	for _, n := range t.IPs {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchProps returns whether any targeted analyzer has found properties.
+func (t *debugTargets) matchProps(props analyzer.CombinedPropMap) bool {
+	for name := range t.Analyzers {
+		if len(props[name]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// debugFilter decides which debug messages of streams are logged: all of them at debug level,
+// and only those of the debug targets above it, to debug an issue in production without
+// the debug messages of every stream. A nil *debugFilter only follows the log level.
+type debugFilter struct {
+	targets atomic.Pointer[debugTargets] // nil if none
+	streams sync.Map                     // int64 -> struct{}, the open streams targeted by IP
+}
+
+// Targets returns the current targets, nil if none or they have expired.
+func (f *debugFilter) Targets() *debugTargets {
+	if f == nil {
+		return nil
+	}
+	t := f.targets.Load()
+	if t == nil || (!t.Expires.IsZero() && time.Now().After(t.Expires)) {
+		return nil
+	}
+	return t
+}
+
+// SetTargets replaces the targets, nil to clear them.
+func (f *debugFilter) SetTargets(t *debugTargets) {
+	f.targets.Store(t)
+	f.streams.Range(func(k, _ interface{}) bool {
+		f.streams.Delete(k)
+		return true
+	})
+}
+
+// logger returns the logger for a debug message if it should be logged, nil otherwise.
+func (f *debugFilter) logger(match func(t *debugTargets) bool) *zap.Logger {
+	if logger.Core().Enabled(zapcore.DebugLevel) {
+		return logger
+	}
+	if t := f.Targets(); t != nil && debugLogger != nil && match(t) {
+		return debugLogger
+	}
+	return nil
+}
+
+// StreamNew returns the logger for the debug messages of a new stream, nil if they shouldn't be logged,
+// and remembers the streams targeted by IP, for the messages that only have their ID.
+func (f *debugFilter) StreamNew(info ruleset.StreamInfo) *zap.Logger {
+	return f.logger(func(t *debugTargets) bool {
+		if t.matchIP(info.SrcIP, info.DstIP) {
+			f.streams.Store(info.ID, struct{}{})
+			return true
+		}
+		return t.Streams[info.ID]
+	})
+}
+
+// Stream returns the logger for the debug messages of a stream, nil if they shouldn't be logged.
+func (f *debugFilter) Stream(info ruleset.StreamInfo) *zap.Logger {
+	return f.logger(func(t *debugTargets) bool {
+		return t.Streams[info.ID] || t.matchIP(info.SrcIP, info.DstIP) || t.matchProps(info.Props)
+	})
+}
+
+// Analyzer returns the logger for the debug messages of an analyzer on a stream, nil if they shouldn't be logged.
+func (f *debugFilter) Analyzer(streamID int64, name string) *zap.Logger {
+	return f.logger(func(t *debugTargets) bool {
+		if t.Streams[streamID] || t.Analyzers[name] {
+			return true
+		}
+		_, ok := f.streams.Load(streamID)
+		return ok
+	})
+}
+
+// StreamEnd forgets a stream targeted by IP.
+func (f *debugFilter) StreamEnd(streamID int64) {
+	if f != nil {
+		f.streams.Delete(streamID)
+	}
+}
@@ -0,0 +1,624 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"go.uber.org/zap"
+)
+
+const (
+	otlpDefaultInterval    = 10 * time.Second
+	otlpDefaultTimeout     = 10 * time.Second
+	otlpDefaultQueueSize   = 4096
+	otlpDefaultServiceName = "OpenGFW"
+
+	otlpScopeName = "github.com/apernet/OpenGFW"
+
+	otlpTemporalityCumulative = 2
+	otlpSpanKindInternal      = 1
+)
+
+// otlpDurationBounds are the histogram bucket bounds of processing durations, in seconds.
+var otlpDurationBounds = [...]float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5,
+}
+
+var otlpVerdictNames = map[io.Verdict]string{
+	io.VerdictAccept:         "accept",
+	io.VerdictAcceptModify:   "accept_modify",
+	io.VerdictAcceptStream:   "accept_stream",
+	io.VerdictDrop:           "drop",
+	io.VerdictDropStream:     "drop_stream",
+	io.VerdictDivertStream:   "divert_stream",
+	io.VerdictHoneypotStream: "honeypot_stream",
+}
+
+type otlpExporterConfig struct {
+	Endpoint    string // Base URL, e.g. http://localhost:4318
+	Headers     map[string]string
+	Interval    time.Duration // Export interval, zero means the default (10s)
+	Timeout     time.Duration // Timeout of each request, zero means the default (10s)
+	SampleRatio float64       // Ratio of streams traced, 0-1
+	ServiceName string
+	QueueSize   int // Number of sampled packets waiting to be exported, zero means the default (4096)
+}
+
+// otlpExporter is an engine.Tracer that exports packet metrics and the spans of sampled
+// streams to an OpenTelemetry collector, with OTLP/HTTP in its JSON encoding.
+// All the packets of a stream share the same trace ID, the stream's UUID, and the packet latency
+// histograms have exemplars linking to the traces of sampled packets.
+type otlpExporter struct {
+	config   otlpExporterConfig
+	client   *http.Client
+	resource otlpResource
+	start    time.Time // Start of the cumulative metrics
+
+	counters   sync.Map // otlpMetricKey -> *otlpCounter
+	histograms sync.Map // otlpMetricKey -> *otlpHistogram
+
+	analyzerStats atomic.Pointer[func() []engine.AnalyzerStats] // Set once the engine is created
+	sampleScale   atomic.Pointer[func() float64]                // Optional, see degradeMonitor
+
+	spans   chan []otlpSpan // Spans of a packet each
+	dropped atomic.Uint64   // Packets whose spans were dropped as the queue was full
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newOTLPExporter(config otlpExporterConfig) (*otlpExporter, error) {
+	if !ruleset.IsRemoteSource(config.Endpoint) {
+		return nil, fmt.Errorf("invalid endpoint %q", config.Endpoint)
+	}
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, errors.New("sample ratio must be between 0 and 1")
+	}
+	if config.Interval < 0 || config.Timeout < 0 || config.QueueSize < 0 {
+		return nil, errors.New("interval, timeout and queue size must not be negative")
+	}
+	if config.Interval == 0 {
+		config.Interval = otlpDefaultInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = otlpDefaultTimeout
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = otlpDefaultQueueSize
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = otlpDefaultServiceName
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	e := &otlpExporter{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpString("service.name", config.ServiceName),
+		}},
+		start: time.Now(),
+		spans: make(chan []otlpSpan, config.QueueSize),
+		done:  make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.worker()
+	return e, nil
+}
+
+func (e *otlpExporter) SampleStream(info ruleset.StreamInfo) bool {
+	e.counter("opengfw.streams", info.Protocol.String(), "").Add(1)
+	ratio := e.config.SampleRatio
+	if f := e.sampleScale.Load(); f != nil {
+		ratio *= (*f)()
+	}
+	return ratio > 0 && rand.Float64() < ratio
+}
+
+func (e *otlpExporter) PacketDone(t *engine.PacketTrace) {
+	proto := "other"
+	if t.StreamID != 0 {
+		proto = t.Protocol.String()
+	}
+	verdict := otlpVerdictNames[t.Verdict]
+	e.counter("opengfw.packets", proto, verdict).Add(1)
+	e.histogram("opengfw.packet.queue.duration", "", "").Record(t.Handled.Sub(t.Received))
+	e.histogram("opengfw.packet.processing.duration", "", "").Record(t.Processed.Sub(t.Handled))
+	e.histogram("opengfw.verdict.duration", "", "").Record(t.Done.Sub(t.VerdictStart))
+	// Without the time the packet was held on purpose by a delay modifier
+	latency := t.Processed.Sub(t.Received) + t.Done.Sub(t.VerdictStart)
+	latencyHistogram := e.histogram("opengfw.packet.latency", proto, strconv.FormatBool(t.Analyzed))
+	latencyHistogram.Record(latency)
+	if !t.Sampled {
+		return
+	}
+	for _, s := range t.Stages {
+		switch s.Kind {
+		case engine.TraceStageAnalyzer:
+			e.histogram("opengfw.analyzer.duration", s.Name, "").Record(s.End.Sub(s.Start))
+		case engine.TraceStageRuleset:
+			e.histogram("opengfw.ruleset.duration", "", "").Record(s.End.Sub(s.Start))
+		}
+	}
+	spans := e.packetSpans(t, proto, verdict)
+	select {
+	case e.spans <- spans:
+		latencyHistogram.Exemplar(latency, t.Done, spans[0].TraceID, spans[0].SpanID)
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// SetAnalyzerStats sets where the per-analyzer metrics are taken from.
+func (e *otlpExporter) SetAnalyzerStats(f func() []engine.AnalyzerStats) {
+	e.analyzerStats.Store(&f)
+}
+
+// SetSampleScale sets the factor applied to the sample ratio, see degradeMonitor.
+func (e *otlpExporter) SetSampleScale(f func() float64) {
+	e.sampleScale.Store(&f)
+}
+
+// updateAnalyzerCounters copies the statistics of the analyzers to their counters.
+func (e *otlpExporter) updateAnalyzerCounters() {
+	f := e.analyzerStats.Load()
+	if f == nil {
+		return
+	}
+	for _, st := range (*f)() {
+		e.counter("opengfw.analyzer.streams", st.Name, "").Store(st.Streams)
+		e.counter("opengfw.analyzer.results", st.Name, "classified").Store(st.Classified)
+		e.counter("opengfw.analyzer.results", st.Name, "unclassified").Store(st.Unclassified)
+		e.counter("opengfw.analyzer.bytes", st.Name, "").Store(st.Bytes)
+		e.counter("opengfw.analyzer.time", st.Name, "").Store(uint64(st.Time.Microseconds()))
+		e.counter("opengfw.analyzer.errors", st.Name, "").Store(st.Errors)
+	}
+}
+
+// packetSpans returns the spans of a packet: a root one covering its whole processing,
+// with a child for the wait in the worker's queue, each stage, and the verdict submission.
+func (e *otlpExporter) packetSpans(t *engine.PacketTrace, proto, verdict string) []otlpSpan {
+	tid := strings.ReplaceAll(t.StreamUUID, "-", "")
+	root := otlpSpan{
+		TraceID: tid,
+		SpanID:  otlpSpanID(),
+		Name:    "packet",
+		Kind:    otlpSpanKindInternal,
+		Start:   otlpTime(t.Received),
+		End:     otlpTime(t.Done),
+		Attributes: []otlpKeyValue{
+			otlpInt("opengfw.stream.id", t.StreamID),
+			otlpString("opengfw.stream.uuid", t.StreamUUID),
+			otlpString("network.transport", proto),
+			otlpString("opengfw.verdict", verdict),
+			otlpInt("opengfw.worker.id", int64(t.WorkerID)),
+		},
+	}
+	if t.Delay > 0 {
+		root.Attributes = append(root.Attributes, otlpString("opengfw.delay", t.Delay.String()))
+	}
+	child := func(name string, start, end time.Time, attrs ...otlpKeyValue) otlpSpan {
+		return otlpSpan{
+			TraceID:      tid,
+			SpanID:       otlpSpanID(),
+			ParentSpanID: root.SpanID,
+			Name:         name,
+			Kind:         otlpSpanKindInternal,
+			Start:        otlpTime(start),
+			End:          otlpTime(end),
+			Attributes:   attrs,
+		}
+	}
+	spans := make([]otlpSpan, 0, len(t.Stages)+3)
+	spans = append(spans, root, child("queue", t.Received, t.Handled))
+	for _, s := range t.Stages {
+		switch s.Kind {
+		case engine.TraceStageAnalyzer:
+			spans = append(spans, child("analyzer", s.Start, s.End, otlpString("opengfw.analyzer", s.Name)))
+		case engine.TraceStageRuleset:
+			if s.Name != "" {
+				spans = append(spans, child("ruleset.match", s.Start, s.End, otlpString("opengfw.rule", s.Name)))
+			} else {
+				spans = append(spans, child("ruleset.match", s.Start, s.End))
+			}
+		}
+	}
+	spans = append(spans, child("verdict", t.VerdictStart, t.Done))
+	return spans
+}
+
+func (e *otlpExporter) worker() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			e.export()
+		}
+	}
+}
+
+// export sends the current metrics and the queued spans.
+func (e *otlpExporter) export() {
+	if err := e.post("/v1/metrics", e.metricsRequest()); err != nil {
+		logger.Warn("failed to export metrics", zap.Error(err))
+	}
+	var spans []otlpSpan
+	for n := len(e.spans); n > 0; n-- {
+		spans = append(spans, <-e.spans...)
+	}
+	if dropped := e.dropped.Swap(0); dropped > 0 {
+		logger.Warn("trace queue full, spans dropped", zap.Uint64("packets", dropped))
+	}
+	if len(spans) == 0 {
+		return
+	}
+	if err := e.post("/v1/traces", e.tracesRequest(spans)); err != nil {
+		logger.Warn("failed to export traces", zap.Error(err))
+	}
+}
+
+func (e *otlpExporter) post(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.config.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops the exporter, after a last export.
+func (e *otlpExporter) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	e.export()
+	return nil
+}
+
+// Metrics
+
+// otlpMetricKey identifies a data point. Attr1 & Attr2 are the values of the
+// metric's attributes, see otlpMetricInfos.
+type otlpMetricKey struct {
+	Name         string
+	Attr1, Attr2 string
+}
+
+type otlpMetricInfo struct {
+	Description string
+	Unit        string
+	AttrKeys    []string
+}
+
+var otlpMetricInfos = map[string]otlpMetricInfo{
+	"opengfw.streams": {
+		"Streams created", "{stream}", []string{"network.transport"},
+	},
+	"opengfw.packets": {
+		"Packets processed", "{packet}", []string{"network.transport", "opengfw.verdict"},
+	},
+	"opengfw.packet.queue.duration": {
+		"Time packets spent waiting in the worker queues", "s", nil,
+	},
+	"opengfw.packet.processing.duration": {
+		"Time spent deciding the verdict of packets", "s", nil,
+	},
+	"opengfw.verdict.duration": {
+		"Time spent submitting the verdict of packets", "s", nil,
+	},
+	"opengfw.packet.latency": {
+		"Time from the receipt of packets to the submission of their verdict, excluding delays from delay modifiers",
+		"s", []string{"network.transport", "opengfw.analyzed"},
+	},
+	"opengfw.analyzer.duration": {
+		"Time spent in analyzers per packet, for sampled streams only", "s", []string{"opengfw.analyzer"},
+	},
+	"opengfw.analyzer.streams": {
+		"Streams analyzers have been run on", "{stream}", []string{"opengfw.analyzer"},
+	},
+	"opengfw.analyzer.results": {
+		"Streams analyzers are done with, by whether they found properties", "{stream}", []string{"opengfw.analyzer", "opengfw.analyzer.result"},
+	},
+	"opengfw.analyzer.bytes": {
+		"Bytes fed to analyzers", "By", []string{"opengfw.analyzer"},
+	},
+	"opengfw.analyzer.time": {
+		"Time spent in analyzers, for all streams", "us", []string{"opengfw.analyzer"},
+	},
+	"opengfw.analyzer.errors": {
+		"Errors reported by analyzers", "{error}", []string{"opengfw.analyzer"},
+	},
+	"opengfw.ruleset.duration": {
+		"Time spent evaluating the ruleset per packet, for sampled streams only", "s", nil,
+	},
+}
+
+func (k otlpMetricKey) attributes() []otlpKeyValue {
+	keys := otlpMetricInfos[k.Name].AttrKeys
+	attrs := make([]otlpKeyValue, 0, len(keys))
+	for i, v := range []string{k.Attr1, k.Attr2}[:len(keys)] {
+		attrs = append(attrs, otlpString(keys[i], v))
+	}
+	return attrs
+}
+
+type otlpCounter struct {
+	atomic.Uint64
+}
+
+type otlpHistogram struct {
+	counts    [len(otlpDurationBounds) + 1]atomic.Uint64
+	sum       atomic.Int64                                              // Nanoseconds
+	exemplars [len(otlpDurationBounds) + 1]atomic.Pointer[otlpExemplar] // Latest of each bucket
+}
+
+func (h *otlpHistogram) Record(d time.Duration) {
+	h.counts[otlpBucket(d)].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Exemplar records the latest measurement of its bucket at time t,
+// with the trace & span it was measured for.
+func (h *otlpHistogram) Exemplar(d time.Duration, t time.Time, traceID, spanID string) {
+	h.exemplars[otlpBucket(d)].Store(&otlpExemplar{
+		Time:    otlpTime(t),
+		Value:   d.Seconds(),
+		TraceID: traceID,
+		SpanID:  spanID,
+	})
+}
+
+// otlpBucket returns the index of the histogram bucket of a duration.
+func otlpBucket(d time.Duration) int {
+	secs := d.Seconds()
+	i := 0
+	for i < len(otlpDurationBounds) && secs > otlpDurationBounds[i] {
+		i++
+	}
+	return i
+}
+
+func (e *otlpExporter) counter(name, attr1, attr2 string) *otlpCounter {
+	key := otlpMetricKey{name, attr1, attr2}
+	if c, ok := e.counters.Load(key); ok {
+		return c.(*otlpCounter)
+	}
+	c, _ := e.counters.LoadOrStore(key, &otlpCounter{})
+	return c.(*otlpCounter)
+}
+
+func (e *otlpExporter) histogram(name, attr1, attr2 string) *otlpHistogram {
+	key := otlpMetricKey{name, attr1, attr2}
+	if h, ok := e.histograms.Load(key); ok {
+		return h.(*otlpHistogram)
+	}
+	h, _ := e.histograms.LoadOrStore(key, &otlpHistogram{})
+	return h.(*otlpHistogram)
+}
+
+func (e *otlpExporter) metricsRequest() otlpMetricsRequest {
+	e.updateAnalyzerCounters()
+	start, now := otlpTime(e.start), otlpTime(time.Now())
+	metrics := make(map[string]*otlpMetric)
+	metric := func(name string) *otlpMetric {
+		m, ok := metrics[name]
+		if !ok {
+			info := otlpMetricInfos[name]
+			m = &otlpMetric{Name: name, Description: info.Description, Unit: info.Unit}
+			metrics[name] = m
+		}
+		return m
+	}
+	e.counters.Range(func(k, v interface{}) bool {
+		key := k.(otlpMetricKey)
+		m := metric(key.Name)
+		if m.Sum == nil {
+			m.Sum = &otlpSum{AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+		}
+		m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{
+			Attributes: key.attributes(),
+			Start:      start,
+			Time:       now,
+			AsInt:      int64(v.(*otlpCounter).Load()),
+		})
+		return true
+	})
+	e.histograms.Range(func(k, v interface{}) bool {
+		key, h := k.(otlpMetricKey), v.(*otlpHistogram)
+		m := metric(key.Name)
+		if m.Histogram == nil {
+			m.Histogram = &otlpHistogramData{AggregationTemporality: otlpTemporalityCumulative}
+		}
+		dp := otlpHistogramDataPoint{
+			Attributes:     key.attributes(),
+			Start:          start,
+			Time:           now,
+			Sum:            time.Duration(h.sum.Load()).Seconds(),
+			BucketCounts:   make([]uint64, len(h.counts)),
+			ExplicitBounds: otlpDurationBounds[:],
+		}
+		for i := range h.counts {
+			dp.BucketCounts[i] = h.counts[i].Load()
+			dp.Count += dp.BucketCounts[i]
+			if ex := h.exemplars[i].Load(); ex != nil {
+				dp.Exemplars = append(dp.Exemplars, *ex)
+			}
+		}
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, dp)
+		return true
+	})
+	scope := otlpScopeMetrics{Scope: otlpScope{Name: otlpScopeName}, Metrics: []otlpMetric{}}
+	for _, m := range metrics {
+		scope.Metrics = append(scope.Metrics, *m)
+	}
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     e.resource,
+		ScopeMetrics: []otlpScopeMetrics{scope},
+	}}}
+}
+
+func (e *otlpExporter) tracesRequest(spans []otlpSpan) otlpTracesRequest {
+	return otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: e.resource,
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otlpScopeName},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func otlpSpanID() string {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	return hex.EncodeToString(id[:])
+}
+
+func otlpTime(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+// OTLP JSON encoding, only the parts we need.
+// 64-bit integers are encoded as strings like in the protobuf JSON mapping,
+// except for the bucket counts, as collectors accept both.
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *int64  `json:"intValue,omitempty,string"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &value}}
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Unit        string             `json:"unit,omitempty"`
+	Sum         *otlpSum           `json:"sum,omitempty"`
+	Histogram   *otlpHistogramData `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Start      uint64         `json:"startTimeUnixNano,string"`
+	Time       uint64         `json:"timeUnixNano,string"`
+	AsInt      int64          `json:"asInt,string"`
+}
+
+type otlpHistogramData struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+	Start          uint64         `json:"startTimeUnixNano,string"`
+	Time           uint64         `json:"timeUnixNano,string"`
+	Count          uint64         `json:"count,string"`
+	Sum            float64        `json:"sum"`
+	BucketCounts   []uint64       `json:"bucketCounts"`
+	ExplicitBounds []float64      `json:"explicitBounds"`
+	Exemplars      []otlpExemplar `json:"exemplars,omitempty"`
+}
+
+type otlpExemplar struct {
+	Time    uint64  `json:"timeUnixNano,string"`
+	Value   float64 `json:"asDouble"`
+	TraceID string  `json:"traceId"`
+	SpanID  string  `json:"spanId"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        uint64         `json:"startTimeUnixNano,string"`
+	End          uint64         `json:"endTimeUnixNano,string"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
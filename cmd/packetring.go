@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	defaultPacketRingMaxFiles = 10
+	packetRingFilePrefix      = "ring-"
+)
+
+var _ engine.PacketRingDumper = (*pcapRingDumper)(nil)
+
+// pcapRingDumper writes every packet ring dump to its own pcapng file, with the reason of the dump
+// as the file's comment, and deletes the oldest dumps over the limit.
+// The files can be replayed with the "test" command to reproduce analyzer bugs.
+type pcapRingDumper struct {
+	Dir      string
+	MaxFiles int // 0 = unlimited
+}
+
+func newPcapRingDumper(dir string, maxFiles int) (*pcapRingDumper, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &pcapRingDumper{Dir: dir, MaxFiles: maxFiles}, nil
+}
+
+func (d *pcapRingDumper) DumpPacketRing(workerID int, reason string, packets []engine.RingPacket) (string, error) {
+	// The timestamp goes first so that the dumps of all workers sort chronologically
+	name := filepath.Join(d.Dir, fmt.Sprintf("%s%s-w%d.pcapng",
+		packetRingFilePrefix, time.Now().Format("20060102-150405.000000"), workerID))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return "", err
+	}
+	if err := writeRingPcap(f, workerID, reason, packets); err != nil {
+		_ = f.Close()
+		_ = os.Remove(name)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(name)
+		return "", err
+	}
+	d.prune()
+	return name, nil
+}
+
+func writeRingPcap(f *os.File, workerID int, reason string, packets []engine.RingPacket) error {
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = fmt.Sprintf("worker%d", workerID)
+	intf.LinkType = layers.LinkTypeRaw
+	options := pcapgo.DefaultNgWriterOptions
+	options.SectionInfo.Application = "OpenGFW"
+	options.SectionInfo.Comment = reason
+	w, err := pcapgo.NewNgWriterInterface(f, intf, options)
+	if err != nil {
+		return err
+	}
+	for _, p := range packets {
+		ci := p.CI
+		ci.InterfaceIndex = 0 // The only interface in the file, not the one the packet came from
+		ci.CaptureLength = len(p.Data)
+		if ci.Length < len(p.Data) {
+			ci.Length = len(p.Data)
+		}
+		if err := w.WritePacket(ci, p.Data); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// prune deletes the oldest dumps over the limit.
+func (d *pcapRingDumper) prune() {
+	if d.MaxFiles <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(d.Dir, packetRingFilePrefix+"*.pcapng"))
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+	for len(files) > d.MaxFiles {
+		_ = os.Remove(files[0])
+		files = files[1:]
+	}
+}
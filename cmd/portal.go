@@ -0,0 +1,371 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+const (
+	portalDefaultTTL         = 24 * time.Hour
+	portalDefaultARPInterval = 10 * time.Second
+	portalARPFile            = "/proc/net/arp"
+	// portalMaxPackets is the number of packets after which the streams to ports 80 & 443 of the clients
+	// that are neither HTTP nor TLS are blocked too.
+	portalMaxPackets = 10
+)
+
+const portalDefaultPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Network access</title>
+</head>
+<body>
+{{if .Accepted}}
+<h1>You're connected</h1>
+<p>Your device ({{.Client}}) has access to the network until {{.Until.Format "2006-01-02 15:04"}}.</p>
+{{else}}
+<h1>Network access</h1>
+{{if .Terms}}<pre style="white-space: pre-wrap">{{.Terms}}</pre>{{end}}
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+<form method="post" action="/accept">
+{{if .Password}}<p><label>Password <input type="password" name="password" required></label></p>{{end}}
+{{if .Terms}}<p><label><input type="checkbox" name="accept" value="1" required> I accept the terms of use</label></p>{{end}}
+<p><button type="submit">Connect</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`
+
+// portalPageData is the data available to portal page templates.
+type portalPageData struct {
+	Client   string
+	Terms    string
+	Password bool // Whether a password is required
+	Error    string
+	Accepted bool
+	Until    time.Time
+}
+
+// captivePortal holds the streams of the clients of its networks back until they accept its terms
+// (and enter its password, if it has one) on its built-in web server: their HTTP requests are redirected
+// to it, their TLS handshakes answered with an alert, and the rest of their traffic blocked, except DNS & DHCP
+// and the destinations allowed (the portal itself, or a walled garden).
+// Once accepted, clients are added to an IP set for TTL, which the rules it generates skip.
+// The MACs of accepted clients (and known MACs, always allowed) are resolved to IPs from the ARP table
+// periodically, so that clients keep access when their IP changes.
+type captivePortal struct {
+	Listen    string
+	URL       string   // Where HTTP requests are redirected to
+	Clients   []string // CIDRs
+	Allow     []string // CIDRs
+	Set       *builtins.Set
+	TTL       time.Duration
+	Password  string
+	Terms     string
+	Template  *template.Template
+	KnownMACs map[string]bool
+	ARPFile   string
+	Interval  time.Duration
+
+	mutex    sync.Mutex
+	accepted map[string]*portalClient // IP -> client
+}
+
+type portalClient struct {
+	IP       string    `json:"ip"`
+	MAC      string    `json:"mac,omitempty"`
+	Accepted time.Time `json:"accepted"`
+	Until    time.Time `json:"until"`
+}
+
+// Rules returns the rules of the portal, to be evaluated before the others.
+func (p *captivePortal) Rules() []ruleset.ExprRule {
+	var clients, allowed []string
+	for _, cidr := range p.Clients {
+		clients = append(clients, fmt.Sprintf("cidr(ip.src, %s)", strconv.Quote(cidr)))
+	}
+	for _, cidr := range p.Allow {
+		allowed = append(allowed, fmt.Sprintf("cidr(ip.dst, %s)", strconv.Quote(cidr)))
+	}
+	base := "(" + strings.Join(clients, " || ") + fmt.Sprintf(") && !in_set(%s, ip.src)", strconv.Quote(p.Set.Name()))
+	if len(allowed) > 0 {
+		base += " && !(" + strings.Join(allowed, " || ") + ")"
+	}
+	return []ruleset.ExprRule{
+		{
+			Name:   "portal-http",
+			Action: ruleset.ActionModify.String(),
+			Modifier: ruleset.ModifierEntry{
+				Name: "http_blockpage",
+				Args: map[string]interface{}{"status": http.StatusFound, "location": p.URL},
+			},
+			Expr: base + " && http?.req != nil",
+		},
+		{
+			// Without the certificates of the sites, the best that can be done is to fail fast
+			Name:   "portal-https",
+			Action: ruleset.ActionModify.String(),
+			Modifier: ruleset.ModifierEntry{
+				Name: "tls_alert",
+				Args: map[string]interface{}{"alert": "access_denied"},
+			},
+			Expr: base + " && proto == \"tcp\" && tls?.req != nil",
+		},
+		{
+			Name:   "portal-block",
+			Action: ruleset.ActionBlock.String(),
+			Expr: base + " && port.dst != 53 && (proto == \"udp\" ? port.dst != 67 : " +
+				fmt.Sprintf("(port.dst != 80 && port.dst != 443) || flow.src.packets > %d)", portalMaxPackets),
+		},
+	}
+}
+
+// ListenAndServe serves the portal until the context is cancelled.
+func (p *captivePortal) ListenAndServe(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           p.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	err = server.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (p *captivePortal) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.handlePage)
+	mux.HandleFunc("/accept", p.handleAccept)
+	return mux
+}
+
+// GET / shows the terms, or the access of the client if it has accepted them already.
+func (p *captivePortal) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d := portalPageData{Client: remoteIP(r), Terms: p.Terms, Password: p.Password != ""}
+	p.mutex.Lock()
+	if c := p.accepted[d.Client]; c != nil && time.Now().Before(c.Until) {
+		d.Accepted, d.Until = true, c.Until
+	}
+	p.mutex.Unlock()
+	p.render(w, http.StatusOK, d)
+}
+
+// POST /accept grants access to the client.
+func (p *captivePortal) handleAccept(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d := portalPageData{Client: remoteIP(r), Terms: p.Terms, Password: p.Password != ""}
+	switch {
+	case p.Password != "" && subtle.ConstantTimeCompare([]byte(r.PostFormValue("password")), []byte(p.Password)) != 1:
+		d.Error = "Wrong password."
+		p.render(w, http.StatusForbidden, d)
+		return
+	case p.Terms != "" && r.PostFormValue("accept") == "":
+		d.Error = "You must accept the terms of use."
+		p.render(w, http.StatusBadRequest, d)
+		return
+	}
+	c, err := p.Accept(d.Client)
+	if err != nil {
+		logger.Error("failed to accept portal client", zap.String("client", d.Client), zap.Error(err))
+		d.Error = "Internal error, please try again."
+		p.render(w, http.StatusInternalServerError, d)
+		return
+	}
+	d.Accepted, d.Until = true, c.Until
+	p.render(w, http.StatusOK, d)
+}
+
+func (p *captivePortal) render(w http.ResponseWriter, status int, d portalPageData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := p.Template.Execute(w, d); err != nil {
+		logger.Warn("failed to render portal page", zap.Error(err))
+	}
+}
+
+// Accept grants access to a client for TTL.
+func (p *captivePortal) Accept(ip string) (*portalClient, error) {
+	now := time.Now()
+	c := &portalClient{IP: ip, MAC: p.arpTable()[ip], Accepted: now, Until: now.Add(p.TTL)}
+	if err := p.Set.Add([]string{ip}, p.TTL); err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.accepted[ip] = c
+	p.mutex.Unlock()
+	logger.Info("portal client accepted", zap.String("client", ip), zap.String("mac", c.MAC), zap.Time("until", c.Until))
+	return c, nil
+}
+
+// Revoke removes the access of a client, and of the other IPs of its MAC. It returns false if the client had none.
+func (p *captivePortal) Revoke(ip string) (bool, error) {
+	p.mutex.Lock()
+	c := p.accepted[ip]
+	if c == nil {
+		p.mutex.Unlock()
+		return false, nil
+	}
+	ips := []string{ip}
+	delete(p.accepted, ip)
+	for oip, oc := range p.accepted {
+		if c.MAC != "" && oc.MAC == c.MAC {
+			ips = append(ips, oip)
+			delete(p.accepted, oip)
+		}
+	}
+	p.mutex.Unlock()
+	if _, err := p.Set.Remove(ips); err != nil {
+		return true, err
+	}
+	logger.Info("portal client revoked", zap.Strings("ips", ips), zap.String("mac", c.MAC))
+	return true, nil
+}
+
+// List returns the clients with access, sorted by IP.
+func (p *captivePortal) List() []portalClient {
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	list := []portalClient{}
+	for _, c := range p.accepted {
+		if now.Before(c.Until) {
+			list = append(list, *c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// Run follows the ARP table until the context is cancelled, adding the new IPs of accepted
+// & known MACs to the set, and forgets the clients whose access has expired.
+func (p *captivePortal) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		p.refresh()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *captivePortal) refresh() {
+	now := time.Now()
+	arp := p.arpTable()
+	var add []*portalClient
+	p.mutex.Lock()
+	macs := make(map[string]*portalClient)
+	for ip, c := range p.accepted {
+		if !now.Before(c.Until) {
+			delete(p.accepted, ip)
+		} else if c.MAC != "" {
+			macs[c.MAC] = c
+		}
+	}
+	for ip, mac := range arp {
+		if p.KnownMACs[mac] {
+			// Until the next refresh, with some slack
+			add = append(add, &portalClient{IP: ip, MAC: mac, Accepted: now, Until: now.Add(3 * p.Interval)})
+		} else if c := macs[mac]; c != nil && p.accepted[ip] == nil {
+			nc := &portalClient{IP: ip, MAC: mac, Accepted: c.Accepted, Until: c.Until}
+			p.accepted[ip] = nc
+			add = append(add, nc)
+			logger.Info("portal client moved", zap.String("mac", mac), zap.String("from", c.IP), zap.String("to", ip))
+		}
+	}
+	p.mutex.Unlock()
+	for _, c := range add {
+		if err := p.Set.Add([]string{c.IP}, c.Until.Sub(now)); err != nil {
+			logger.Warn("failed to add portal client", zap.String("client", c.IP), zap.Error(err))
+		}
+	}
+}
+
+// arpTable returns the MACs of the IPs of the ARP table, empty if it can't be read.
+func (p *captivePortal) arpTable() map[string]string {
+	table := make(map[string]string)
+	f, err := os.Open(p.ARPFile)
+	if err != nil {
+		return table
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan() // Header
+	for s.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			// Incomplete
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil || mac.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		table[fields[0]] = mac.String()
+	}
+	return table
+}
+
+// portalTemplate parses the template of the page from a file, or returns the default one if file is empty.
+func portalTemplate(file string) (*template.Template, error) {
+	text := portalDefaultPage
+	if file != "" {
+		bs, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(bs)
+	}
+	return template.New("portal").Parse(text)
+}
+
+// remoteIP returns the IP of the client of a request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	processProcRoot  = "/proc"
+	processCacheSize = 16384
+)
+
+var _ ruleset.ProcessResolver = (*procProcesses)(nil)
+
+// procProcesses finds the local processes owning the sockets of streams in /proc: the socket by its
+// addresses in /proc/net/{tcp,udp}{,6}, then the process having a file descriptor on it.
+// The owner of the socket reported by the IO (nfqueue in local mode) is preferred to that of /proc/net,
+// and is all that's known if the socket isn't found, e.g. already closed.
+// Processes are looked up once per stream, the first time the rules are matched against it,
+// and the file descriptors of all processes are scanned again for every socket not seen in the latest scan.
+// Reading the file descriptors of other processes requires root or CAP_SYS_PTRACE.
+// It's safe for concurrent use.
+type procProcesses struct {
+	Root string // Usually processProcRoot
+
+	cache  *lru.Cache[int64, *ruleset.Process] // By stream ID, nil values for streams without a process
+	mutex  sync.Mutex
+	inodes map[uint64]int // Socket inode -> PID, of the latest scan
+}
+
+// procSocket is a socket of /proc/net.
+type procSocket struct {
+	Local, Remote net.TCPAddr // Unspecified IP or port 0 for any
+	UID           int
+	Inode         uint64
+}
+
+func newProcProcesses(root string) *procProcesses {
+	p := &procProcesses{Root: root}
+	p.cache, _ = lru.New[int64, *ruleset.Process](processCacheSize)
+	return p
+}
+
+func (p *procProcesses) Process(info ruleset.StreamInfo) *ruleset.Process {
+	if proc, ok := p.cache.Get(info.ID); ok {
+		return proc
+	}
+	proc := p.lookup(info)
+	p.cache.Add(info.ID, proc)
+	return proc
+}
+
+func (p *procProcesses) lookup(info ruleset.StreamInfo) *ruleset.Process {
+	proc := &ruleset.Process{UID: -1, GID: -1}
+	if info.Owner != nil {
+		proc.UID, proc.GID = int(info.Owner.UID), int(info.Owner.GID)
+	}
+	if s := p.socket(info); s != nil {
+		if proc.UID < 0 {
+			proc.UID = s.UID
+		}
+		if pid := p.pid(s.Inode); pid > 0 {
+			proc.PID = pid
+			dir := filepath.Join(p.Root, strconv.Itoa(pid))
+			if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+				proc.Name = strings.TrimSpace(string(comm))
+			}
+			proc.Exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+			if proc.GID < 0 {
+				proc.GID = procStatusGID(filepath.Join(dir, "status"))
+			}
+		}
+	}
+	if proc.PID == 0 && proc.UID < 0 {
+		return nil
+	}
+	return proc
+}
+
+// socket returns the local socket of a stream, nil if not found. Either side can be the local one.
+// Connected sockets are preferred to listening or unconnected ones, then the source side (the client)
+// for streams between local sockets.
+func (p *procProcesses) socket(info ruleset.StreamInfo) *procSocket {
+	var files []string
+	switch info.Protocol {
+	case ruleset.ProtocolTCP:
+		files = []string{"tcp", "tcp6"}
+	case ruleset.ProtocolUDP:
+		files = []string{"udp", "udp6"}
+	default:
+		return nil
+	}
+	if info.SrcIP.To4() == nil {
+		files = files[1:]
+	}
+	src := net.TCPAddr{IP: info.SrcIP, Port: int(info.SrcPort)}
+	dst := net.TCPAddr{IP: info.DstIP, Port: int(info.DstPort)}
+	var best *procSocket
+	bestScore := 0
+	for _, name := range files {
+		for _, s := range readProcSockets(filepath.Join(p.Root, "net", name)) {
+			s := s
+			for i, side := range [][2]*net.TCPAddr{{&src, &dst}, {&dst, &src}} {
+				score := 2 * procAddrScore(s.Local, *side[0]) * procAddrScore(s.Remote, *side[1])
+				if score > 0 && i == 0 {
+					score++
+				}
+				if score > bestScore {
+					best, bestScore = &s, score
+				}
+			}
+		}
+	}
+	return best
+}
+
+// procAddrScore returns how well a socket address matches an address: 0 if it doesn't,
+// 1 for a wildcard, 2 for the same address.
+func procAddrScore(s, a net.TCPAddr) int {
+	if s.Port != 0 && s.Port != a.Port {
+		return 0
+	}
+	if s.IP.IsUnspecified() {
+		return 1
+	}
+	if !s.IP.Equal(a.IP) {
+		return 0
+	}
+	if s.Port == 0 {
+		return 1
+	}
+	return 2
+}
+
+// readProcSockets parses a socket table of /proc/net, returning nil if it can't be read.
+func readProcSockets(file string) []procSocket {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var sockets []procSocket
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, ok1 := parseProcAddr(fields[1])
+		remote, ok2 := parseProcAddr(fields[2])
+		uid, err1 := strconv.Atoi(fields[7])
+		inode, err2 := strconv.ParseUint(fields[9], 10, 64)
+		if !ok1 || !ok2 || err1 != nil || err2 != nil || inode == 0 {
+			continue
+		}
+		sockets = append(sockets, procSocket{Local: local, Remote: remote, UID: uid, Inode: inode})
+	}
+	return sockets
+}
+
+// parseProcAddr parses an address of /proc/net, e.g. 0100007F:0050: the IP as 32-bit words
+// in host byte order, and the port.
+func parseProcAddr(s string) (net.TCPAddr, bool) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return net.TCPAddr{}, false
+	}
+	b, err := hex.DecodeString(ipHex)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return net.TCPAddr{}, false
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return net.TCPAddr{}, false
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(b[i:]))
+	}
+	return net.TCPAddr{IP: ip, Port: int(port)}, true
+}
+
+// pid returns the PID of the process having a file descriptor on a socket, 0 if not found.
+func (p *procProcesses) pid(inode uint64) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if pid, ok := p.inodes[inode]; ok {
+		return pid
+	}
+	p.inodes = p.scanSockets()
+	return p.inodes[inode]
+}
+
+// scanSockets returns the inodes of the sockets of all processes, and their PIDs.
+// Sockets shared by several processes (e.g. after fork) are attributed to the lowest PID.
+func (p *procProcesses) scanSockets() map[uint64]int {
+	inodes := make(map[uint64]int)
+	entries, _ := os.ReadDir(p.Root)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(p.Root, e.Name(), "fd")
+		fds, _ := os.ReadDir(fdDir)
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if old, ok := inodes[inode]; !ok || pid < old {
+				inodes[inode] = pid
+			}
+		}
+	}
+	return inodes
+}
+
+// procStatusGID returns the real GID of a /proc/<pid>/status file, -1 if it can't be read.
+func procStatusGID(file string) int {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, "Gid:"); ok {
+			if fields := strings.Fields(rest); len(fields) > 0 {
+				if gid, err := strconv.Atoi(fields[0]); err == nil {
+					return gid
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// testProcesses is the process resolver of the commands that don't look up processes,
+// like testContainers: the process of the test case being run, see testCase.Process.
+type testProcesses struct {
+	process *ruleset.Process
+}
+
+func (p *testProcesses) Process(ruleset.StreamInfo) *ruleset.Process {
+	return p.process
+}
+
+// testCaseProcesses is the process of the current test case, when local mode is enabled.
+var testCaseProcesses = &testProcesses{}
+
+// set replaces the process with that of a test case.
+func (p *testProcesses) set(tc *testCase) {
+	p.process = nil
+	if tp := tc.Process; tp != nil {
+		p.process = &ruleset.Process{
+			PID:  tp.PID,
+			Name: tp.Name,
+			Exe:  tp.Exe,
+			UID:  -1,
+			GID:  -1,
+		}
+		if tp.UID != nil {
+			p.process.UID = *tp.UID
+		}
+		if tp.GID != nil {
+			p.process.GID = *tp.GID
+		}
+	}
+}
+
+// testProcesses returns the process resolver of the test cases, or nil if local mode isn't enabled.
+func (c *cliConfig) testProcesses() ruleset.ProcessResolver {
+	if !c.localEnabled() {
+		return nil
+	}
+	return testCaseProcesses
+}
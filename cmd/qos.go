@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+)
+
+const (
+	qosDefaultMinConfidence = 0.5
+	// qosOtherApp is the application of the streams that aren't classified, or not confidently enough.
+	qosOtherApp = "other"
+)
+
+// qosDSCPNames are the names of the DSCP values (RFC 2474, 2597, 3246, 5865 & 8622).
+var qosDSCPNames = map[string]uint8{
+	"df": 0, "le": 1, "ef": 46, "va": 44,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+}
+
+// parseDSCP parses a DSCP name or number.
+func parseDSCP(s string) (uint8, error) {
+	if v, ok := qosDSCPNames[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q, must be a name like ef or af41, or between 0 and 63", s)
+	}
+	return uint8(v), nil
+}
+
+var _ engine.QoSMarker = (*qosMarker)(nil)
+
+// qosMarker marks the streams by application, classified like the app variable of the rules.
+type qosMarker struct {
+	Apps          *builtins.AppClassifier
+	Marks         map[string]uint32 // Application -> mark
+	MinConfidence float64
+}
+
+func (m *qosMarker) QoSMark(info ruleset.StreamInfo) uint32 {
+	app, confidence := m.Apps.Classify(info.Props, info.Protocol.String(), info.DstPort)
+	if app == "" || confidence < m.MinConfidence {
+		app = qosOtherApp
+	}
+	return m.Marks[app]
+}
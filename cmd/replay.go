@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// Flags
+var (
+	replayProps  bool
+	replayOutput string
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [flags] rule_file pcap_file",
+	Short: "Replay a pcap file through a ruleset and report the verdict of every flow as JSON",
+	Long: "Replay a pcap/pcapng file through a ruleset offline, and print a JSON report of every flow: " +
+		"the protocols detected, the rules matched (dry-run rules and notifications included), the actions issued " +
+		"and the final verdict, followed by a summary by action & rule. " +
+		"Meant for evaluating rulesets against captured traffic in scripts & CI. Nothing is blocked or sent.",
+	Args: cobra.ExactArgs(2),
+	Run:  runReplay,
+}
+
+func init() {
+	replayCmd.Flags().BoolVar(&replayProps, "props", false, "include the analyzer properties of every flow")
+	replayCmd.Flags().StringVarP(&replayOutput, "output", "o", "", "write the report to this file instead of stdout")
+	rootCmd.AddCommand(replayCmd)
+}
+
+type replayReport struct {
+	Ruleset string        `json:"ruleset"`
+	Pcap    string        `json:"pcap"`
+	Flows   []*replayFlow `json:"flows"`
+	Summary replaySummary `json:"summary"`
+}
+
+type replayFlow struct {
+	ID            int64                    `json:"id"`
+	UUID          string                   `json:"uuid"`
+	Proto         string                   `json:"proto"`
+	Src           string                   `json:"src"`
+	Dst           string                   `json:"dst"`
+	AppProto      string                   `json:"app_proto,omitempty"`
+	Protocols     []string                 `json:"protocols"` // Analyzers that found properties
+	Packets       [2]uint64                `json:"packets"`   // From the source, from the destination
+	Bytes         [2]uint64                `json:"bytes"`
+	Rules         []string                 `json:"rules"` // Matched rules, in order
+	Actions       []replayAction           `json:"actions"`
+	DryRun        []replayAction           `json:"dry_run,omitempty"` // Matches of rules that are not enforced
+	Notified      []string                 `json:"notified,omitempty"`
+	Errors        []string                 `json:"errors,omitempty"`
+	Verdict       string                   `json:"verdict"`                  // Latest action, none if no action was issued before the end
+	End           string                   `json:"end,omitempty"`            // Why the stream ended, empty if it was still tracked at the end
+	PacketVerdict string                   `json:"packet_verdict,omitempty"` // Of the latest packet, for ended streams
+	Props         analyzer.CombinedPropMap `json:"props,omitempty"`          // With --props
+}
+
+type replayAction struct {
+	Action string `json:"action"`
+	Rule   string `json:"rule,omitempty"` // Empty for the default verdict
+}
+
+type replaySummary struct {
+	Flows    int            `json:"flows"`
+	Verdicts map[string]int `json:"verdicts"` // Flows by verdict
+	Rules    map[string]int `json:"rules"`    // Flows by matched rule
+}
+
+// replayRecorder builds the report from the engine & ruleset callbacks.
+type replayRecorder struct {
+	engineLogger
+
+	mutex sync.Mutex
+	flows map[int64]*replayFlow
+}
+
+func runReplay(cmd *cobra.Command, args []string) {
+	r := &replayRecorder{flows: make(map[int64]*replayFlow)}
+	rs := testRuleset(args[0], r, r)
+	pcapIO, err := io.NewPcapPacketIO(io.PcapPacketIOConfig{PcapFile: args[1]})
+	if err != nil {
+		logger.Fatal("failed to open pcap file", zap.Error(err))
+	}
+	defer pcapIO.Close()
+	en, err := engine.NewEngine(engine.Config{
+		Logger:  r,
+		IOs:     []io.PacketIO{pcapIO},
+		Ruleset: rs,
+		Workers: 1, // Keep the report deterministic
+	})
+	if err != nil {
+		logger.Fatal("failed to initialize engine", zap.Error(err))
+	}
+	err = en.Run(context.Background())
+	if err != nil && !errors.Is(err, io.ErrEndOfInput) {
+		logger.Fatal("failed to replay pcap file", zap.Error(err))
+	}
+
+	report := r.Report()
+	report.Ruleset, report.Pcap = args[0], args[1]
+	out := os.Stdout
+	if replayOutput != "" {
+		out, err = os.Create(replayOutput)
+		if err != nil {
+			logger.Fatal("failed to create report file", zap.Error(err))
+		}
+		defer out.Close()
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		logger.Fatal("failed to write report", zap.Error(err))
+	}
+}
+
+// Report returns the flows by ID, with the summary.
+func (r *replayRecorder) Report() replayReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	report := replayReport{
+		Flows: make([]*replayFlow, 0, len(r.flows)),
+		Summary: replaySummary{
+			Verdicts: make(map[string]int),
+			Rules:    make(map[string]int),
+		},
+	}
+	for _, f := range r.flows {
+		report.Flows = append(report.Flows, f)
+	}
+	sort.Slice(report.Flows, func(i, j int) bool { return report.Flows[i].ID < report.Flows[j].ID })
+	for _, f := range report.Flows {
+		f.Verdict = "none"
+		if len(f.Actions) > 0 {
+			f.Verdict = f.Actions[len(f.Actions)-1].Action
+		}
+		report.Summary.Verdicts[f.Verdict]++
+		for _, rule := range f.Rules {
+			report.Summary.Rules[rule]++
+		}
+	}
+	report.Summary.Flows = len(report.Flows)
+	return report
+}
+
+// flow returns the flow of a stream, updated with its latest information. The mutex must be held.
+func (r *replayRecorder) flow(info ruleset.StreamInfo) *replayFlow {
+	f := r.flows[info.ID]
+	if f == nil {
+		f = &replayFlow{
+			ID:        info.ID,
+			UUID:      info.UUID,
+			Proto:     info.Protocol.String(),
+			Src:       info.SrcString(),
+			Dst:       info.DstString(),
+			Protocols: []string{},
+			Rules:     []string{},
+			Actions:   []replayAction{},
+		}
+		r.flows[info.ID] = f
+	}
+	f.Packets = [2]uint64{info.Counters.SrcPackets, info.Counters.DstPackets}
+	f.Bytes = [2]uint64{info.Counters.SrcBytes, info.Counters.DstBytes}
+	if len(info.Props) > 0 {
+		f.AppProto = eveAppProto(info.Props)
+		f.Protocols = f.Protocols[:0]
+		for name, props := range info.Props {
+			if len(props) > 0 {
+				f.Protocols = append(f.Protocols, name)
+			}
+		}
+		sort.Strings(f.Protocols)
+		if replayProps {
+			f.Props = info.Props
+		}
+	}
+	return f
+}
+
+func (r *replayRecorder) update(info ruleset.StreamInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.flow(info)
+}
+
+func (r *replayRecorder) action(info ruleset.StreamInfo, action ruleset.Action, rule string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f := r.flow(info)
+	f.Actions = append(f.Actions, replayAction{Action: action.String(), Rule: rule})
+	if rule != "" && !slices.Contains(f.Rules, rule) {
+		f.Rules = append(f.Rules, rule)
+	}
+}
+
+func (r *replayRecorder) TCPStreamNew(workerID int, info ruleset.StreamInfo) {
+	r.update(info)
+}
+
+func (r *replayRecorder) TCPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	r.update(info)
+}
+
+func (r *replayRecorder) TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	r.action(info, action, rule)
+}
+
+func (r *replayRecorder) UDPStreamNew(workerID int, info ruleset.StreamInfo) {
+	r.update(info)
+}
+
+func (r *replayRecorder) UDPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	r.update(info)
+}
+
+func (r *replayRecorder) UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	r.action(info, action, rule)
+}
+
+func (r *replayRecorder) SCTPStreamNew(workerID int, info ruleset.StreamInfo) {
+	r.update(info)
+}
+
+func (r *replayRecorder) SCTPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	r.update(info)
+}
+
+func (r *replayRecorder) SCTPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	r.action(info, action, rule)
+}
+
+func (r *replayRecorder) ICMPStreamNew(workerID int, info ruleset.StreamInfo) {
+	r.update(info)
+}
+
+func (r *replayRecorder) ICMPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	r.update(info)
+}
+
+func (r *replayRecorder) ICMPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	r.action(info, action, rule)
+}
+
+func (r *replayRecorder) StreamEnd(end engine.StreamEnd) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f := r.flow(end.Info)
+	f.End = end.Reason.String()
+	f.PacketVerdict = otlpVerdictNames[end.Verdict]
+}
+
+// Log is for the ruleset: the matches of rules with logging enabled are reported like the others.
+func (r *replayRecorder) Log(level ruleset.LogLevel, info ruleset.StreamInfo, name string) {}
+
+func (r *replayRecorder) DryRun(info ruleset.StreamInfo, name string, action ruleset.Action) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f := r.flow(info)
+	f.DryRun = append(f.DryRun, replayAction{Action: action.String(), Rule: name})
+}
+
+func (r *replayRecorder) MatchError(info ruleset.StreamInfo, name string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f := r.flow(info)
+	f.Errors = append(f.Errors, name+": "+err.Error())
+}
+
+func (r *replayRecorder) Notify(ev ruleset.NotifyEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if f := r.flows[ev.ID]; f != nil {
+		f.Notified = append(f.Notified, ev.Rule)
+	}
+}
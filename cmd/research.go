@@ -0,0 +1,553 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/apernet/OpenGFW/engine"
+	gfwio "github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/sink"
+)
+
+const (
+	researchDefaultHandshakeBytes = 4096
+	researchDefaultWindow         = 10 * time.Second
+	researchDefaultTimeout        = 10 * time.Second
+	researchDefaultCooldown       = 10 * time.Minute
+	researchDefaultMaxConcurrent  = 16
+	researchMaxMessages           = 32
+	researchResponseBytes         = 4096 // Kept per probe, the others are only counted
+
+	researchProbeReplay  = "replay"
+	researchProbeRandom  = "random"
+	researchProbePayload = "payload"
+)
+
+var errResearchNoReplay = errors.New("no client payload to replay")
+
+// researchMode is for studies of the detectability of proxies: it records the handshakes of the streams
+// matched by its capture rules (the first bytes of each side, and the sizes & timing of their messages),
+// then optionally probes their servers from its own source address with its probes, like a censor would:
+// replays of the first message of the client (with some bytes changed or not), random data or given payloads.
+// The handshakes & the responses to the probes are written as JSON lines, with the stream UUID of the packets
+// in the capture files. It's the capturer of the engine, and passes the packets on to the capture files.
+type researchMode struct {
+	Next           engine.PacketSink // The capture files
+	Rules          map[string]bool   // Empty for all capture rules
+	HandshakeBytes int
+	Window         time.Duration
+	Probes         []researchProbe
+	Source         net.IP // Optional
+	Mark           int    // Of the packets of the probes, 0 for none
+	Delay          time.Duration
+	Timeout        time.Duration
+	Cooldown       time.Duration
+	MaxConcurrent  int
+	Log            *sink.File
+
+	mutex   sync.Mutex
+	streams map[string]*researchStream // By UUID, while recorded
+	probed  map[string]time.Time       // Servers, for the cooldown
+	local   map[string]bool            // Local addresses of the probes in progress
+	sem     chan struct{}
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// researchProbe is a probe sent to the servers of the recorded streams.
+type researchProbe struct {
+	Name    string
+	Type    string // replay, random or payload
+	Flip    []int  // replay: offsets of the bytes inverted
+	Size    int    // random: number of bytes
+	Payload []byte // payload
+}
+
+// data returns the data the probe sends, replay being the first message of the client.
+func (p researchProbe) data(replay []byte) ([]byte, error) {
+	switch p.Type {
+	case researchProbeReplay:
+		if len(replay) == 0 {
+			return nil, errResearchNoReplay
+		}
+		data := append([]byte(nil), replay...)
+		for _, i := range p.Flip {
+			if i >= 0 && i < len(data) {
+				data[i] ^= 0xff
+			}
+		}
+		return data, nil
+	case researchProbeRandom:
+		data := make([]byte, p.Size)
+		_, err := rand.Read(data)
+		return data, err
+	default:
+		return p.Payload, nil
+	}
+}
+
+// researchRecord is a line of the results: the handshake of a stream, and the responses to the probes.
+type researchRecord struct {
+	Timestamp    string                `json:"timestamp"`
+	UUID         string                `json:"uuid"`
+	Rule         string                `json:"rule"`
+	Proto        string                `json:"proto"`
+	Src          string                `json:"src"`
+	Dst          string                `json:"dst"`
+	Props        json.RawMessage       `json:"props,omitempty"`
+	Complete     bool                  `json:"complete"` // TCP: the SYN was seen, and no data is missing
+	Messages     []researchMessage     `json:"messages"`
+	Client       []byte                `json:"client"` // First bytes sent by the client
+	Server       []byte                `json:"server"` // First bytes sent by the server
+	Probes       []researchProbeResult `json:"probes,omitempty"`
+	ProbeSkipped string                `json:"probeSkipped,omitempty"` // cooldown or busy
+}
+
+// researchMessage is a run of consecutive packets sent by the same side.
+type researchMessage struct {
+	From  string  `json:"from"` // client or server
+	Bytes int     `json:"bytes"`
+	Time  float64 `json:"time"` // Seconds since the first packet
+}
+
+type researchProbeResult struct {
+	Name      string  `json:"name"`
+	Sent      int     `json:"sent"`
+	Received  int     `json:"received"`
+	Response  []byte  `json:"response,omitempty"`  // First bytes
+	End       string  `json:"end"`                 // closed, reset, timeout, refused or error
+	FirstByte float64 `json:"firstByte,omitempty"` // Seconds after sending
+	Elapsed   float64 `json:"elapsed"`             // Seconds after sending, until the end
+	Error     string  `json:"error,omitempty"`
+}
+
+// researchStream is a stream whose handshake is being recorded.
+type researchStream struct {
+	record     researchRecord
+	clientIP   net.IP
+	clientPort uint16
+	start      time.Time // Of the first packet
+	matched    time.Time
+	syn        bool
+	started    [2]bool // Client, server
+	next       [2]uint32
+	gap        [2]bool
+	data       [2][]byte
+	replay     int // Length of the first message of the client
+}
+
+// Run finishes the recordings that have lasted the window, until the context is cancelled.
+func (r *researchMode) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var done []*researchStream
+			r.mutex.Lock()
+			for uuid, s := range r.streams {
+				if now.Sub(s.matched) >= r.Window {
+					delete(r.streams, uuid)
+					done = append(done, s)
+				}
+			}
+			for dst, t := range r.probed {
+				if now.Sub(t) >= r.Cooldown {
+					delete(r.probed, dst)
+				}
+			}
+			r.mutex.Unlock()
+			for _, s := range done {
+				r.finish(s)
+			}
+		}
+	}
+}
+
+// StreamAction starts recording a stream when one of the rules captures it.
+func (r *researchMode) StreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	if r == nil || noMatch || action != ruleset.ActionCapture || (len(r.Rules) > 0 && !r.Rules[rule]) {
+		return
+	}
+	if r.Source != nil && info.SrcIP.Equal(r.Source) {
+		// Our own probes
+		return
+	}
+	now := time.Now()
+	s := &researchStream{
+		record: researchRecord{
+			Timestamp: now.Format(time.RFC3339Nano),
+			UUID:      info.UUID,
+			Rule:      rule,
+			Proto:     info.Protocol.String(),
+			Src:       info.SrcString(),
+			Dst:       info.DstString(),
+		},
+		clientIP:   info.SrcIP,
+		clientPort: info.SrcPort,
+		matched:    now,
+	}
+	// The props may change once we return
+	if props, err := json.Marshal(info.Props); err == nil && info.Props != nil {
+		s.record.Props = props
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.local[info.SrcString()] {
+		return
+	}
+	if _, ok := r.streams[info.UUID]; !ok {
+		r.streams[info.UUID] = s
+	}
+}
+
+// StreamEnd finishes the recording of a stream.
+func (r *researchMode) StreamEnd(end engine.StreamEnd) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	s := r.streams[end.Info.UUID]
+	delete(r.streams, end.Info.UUID)
+	r.mutex.Unlock()
+	if s != nil {
+		r.finish(s)
+	}
+}
+
+// WritePacket passes a captured packet on to the capture files, and records it if its stream is studied.
+func (r *researchMode) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	err := r.Next.WritePacket(ci, data)
+	var uuid string
+	for _, v := range ci.AncillaryData {
+		if c, ok := v.(gfwio.PacketComment); ok {
+			uuid = strings.TrimPrefix(string(c), "flow_uuid=")
+		}
+	}
+	if uuid == "" {
+		return err
+	}
+	r.mutex.Lock()
+	s := r.streams[uuid]
+	if s != nil && s.add(ci.Timestamp, data, r.HandshakeBytes) {
+		delete(r.streams, uuid)
+	} else {
+		s = nil
+	}
+	r.mutex.Unlock()
+	if s != nil {
+		r.finish(s)
+	}
+	return err
+}
+
+// add records a packet (starting with the IP header) of the stream,
+// and returns whether the handshake is recorded.
+func (s *researchStream) add(ts time.Time, data []byte, maxBytes int) bool {
+	var src net.IP
+	var payload []byte
+	var ipPayload []byte
+	var next layers.IPProtocol
+	if len(data) > 0 && data[0]>>4 == 4 {
+		var ip layers.IPv4
+		if ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil {
+			return false
+		}
+		src, ipPayload, next = ip.SrcIP, ip.Payload, ip.Protocol
+	} else {
+		var ip layers.IPv6
+		if ip.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil {
+			return false
+		}
+		src, ipPayload, next = ip.SrcIP, ip.Payload, ip.NextHeader
+	}
+	dir := 1
+	switch next {
+	case layers.IPProtocolTCP:
+		var tcp layers.TCP
+		if tcp.DecodeFromBytes(ipPayload, gopacket.NilDecodeFeedback) != nil {
+			return false
+		}
+		if src.Equal(s.clientIP) && uint16(tcp.SrcPort) == s.clientPort {
+			dir = 0
+		}
+		if s.start.IsZero() {
+			s.start = ts
+		}
+		if tcp.SYN {
+			s.syn = s.syn || dir == 0
+			s.started[dir], s.next[dir] = true, tcp.Seq+1
+			return false
+		}
+		if payload = tcp.Payload; len(payload) == 0 {
+			return false
+		}
+		if !s.started[dir] {
+			s.started[dir], s.next[dir] = true, tcp.Seq
+		}
+		off := int32(tcp.Seq - s.next[dir])
+		if off > 0 {
+			// Missing data, the rest of this side can't be recorded
+			s.gap[dir] = true
+			return false
+		}
+		if s.gap[dir] || int(-off) >= len(payload) {
+			// Retransmitted
+			return false
+		}
+		payload = payload[-off:]
+		s.next[dir] += uint32(len(payload))
+	case layers.IPProtocolUDP:
+		var udp layers.UDP
+		if udp.DecodeFromBytes(ipPayload, gopacket.NilDecodeFeedback) != nil {
+			return false
+		}
+		if src.Equal(s.clientIP) && uint16(udp.SrcPort) == s.clientPort {
+			dir = 0
+		}
+		if s.start.IsZero() {
+			s.start = ts
+		}
+		if payload = udp.Payload; len(payload) == 0 {
+			return false
+		}
+	default:
+		return false
+	}
+	msgs := s.record.Messages
+	if dir == 0 && (len(msgs) == 0 || (len(msgs) == 1 && s.record.Proto == "tcp" && msgs[0].From == "client")) {
+		// The first message of the client, a single datagram for UDP
+		s.replay += len(payload)
+	}
+	from := "client"
+	if dir == 1 {
+		from = "server"
+	}
+	if len(msgs) > 0 && msgs[len(msgs)-1].From == from {
+		msgs[len(msgs)-1].Bytes += len(payload)
+	} else {
+		s.record.Messages = append(msgs, researchMessage{From: from, Bytes: len(payload), Time: ts.Sub(s.start).Seconds()})
+	}
+	if room := maxBytes - len(s.data[dir]); room > 0 {
+		s.data[dir] = append(s.data[dir], payload[:min(room, len(payload))]...)
+	}
+	return (len(s.data[0]) >= maxBytes && len(s.data[1]) >= maxBytes) || len(s.record.Messages) >= researchMaxMessages
+}
+
+// finish completes the record of a stream, probing its server if there are probes, and writes it.
+func (r *researchMode) finish(s *researchStream) {
+	rec := s.record
+	rec.Complete = rec.Proto == "udp" || (s.syn && !s.gap[0] && !s.gap[1])
+	rec.Client, rec.Server = s.data[0], s.data[1]
+	if rec.Messages == nil {
+		rec.Messages = []researchMessage{}
+	}
+	if len(r.Probes) == 0 {
+		r.write(&rec)
+		return
+	}
+	r.mutex.Lock()
+	_, cooling := r.probed[rec.Dst]
+	if !cooling {
+		r.probed[rec.Dst] = time.Now()
+	}
+	r.mutex.Unlock()
+	if cooling {
+		rec.ProbeSkipped = "cooldown"
+		r.write(&rec)
+		return
+	}
+	select {
+	case r.sem <- struct{}{}:
+	default:
+		rec.ProbeSkipped = "busy"
+		r.write(&rec)
+		return
+	}
+	replay := s.data[0][:min(s.replay, len(s.data[0]))]
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer func() { <-r.sem }()
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(r.Delay):
+		}
+		for _, p := range r.Probes {
+			rec.Probes = append(rec.Probes, r.probe(p, rec.Proto, rec.Dst, replay))
+		}
+		r.write(&rec)
+	}()
+}
+
+// probe sends a probe to a server, and returns how it responded.
+func (r *researchMode) probe(p researchProbe, proto, dst string, replay []byte) researchProbeResult {
+	res := researchProbeResult{Name: p.Name}
+	data, err := p.data(replay)
+	if err != nil {
+		res.End, res.Error = "error", err.Error()
+		return res
+	}
+	dialer := net.Dialer{Timeout: r.Timeout, Control: r.control}
+	if r.Source != nil {
+		if proto == "tcp" {
+			dialer.LocalAddr = &net.TCPAddr{IP: r.Source}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: r.Source}
+		}
+	}
+	conn, err := dialer.DialContext(r.ctx, proto, dst)
+	if err != nil {
+		res.End, res.Error = researchProbeEnd(err), err.Error()
+		return res
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().String()
+	r.mutex.Lock()
+	r.local[local] = true
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.local, local)
+		r.mutex.Unlock()
+	}()
+	sent := time.Now()
+	_ = conn.SetDeadline(sent.Add(r.Timeout))
+	if len(data) > 0 {
+		if res.Sent, err = conn.Write(data); err != nil {
+			res.End, res.Error = researchProbeEnd(err), err.Error()
+			return res
+		}
+	}
+	buf := make([]byte, researchResponseBytes)
+	for {
+		n, err := conn.Read(buf[min(res.Received, len(buf)-1):])
+		if n > 0 && res.Received == 0 {
+			res.FirstByte = time.Since(sent).Seconds()
+		}
+		if kept := min(res.Received+n, len(buf)); kept > len(res.Response) {
+			res.Response = buf[:kept]
+		}
+		res.Received += n
+		if err != nil {
+			res.End = researchProbeEnd(err)
+			if res.End == "error" {
+				res.Error = err.Error()
+			}
+			break
+		}
+	}
+	res.Elapsed = time.Since(sent).Seconds()
+	return res
+}
+
+// control sets the mark of the sockets of the probes.
+func (r *researchMode) control(network, address string, c syscall.RawConn) error {
+	if r.Mark == 0 {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = researchSetMark(fd, r.Mark)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// researchProbeEnd returns how a probe ended from the error that ended it.
+func researchProbeEnd(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		return "closed"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+func (r *researchMode) write(rec *researchRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	r.Log.Send(sink.Event{Type: "research", Time: time.Now(), Data: data})
+}
+
+// Reopen reopens the results file, for log rotation.
+func (r *researchMode) Reopen() error {
+	if r == nil {
+		return nil
+	}
+	return r.Log.Reopen()
+}
+
+// Check returns the error of the latest write to the results file.
+func (r *researchMode) Check() error {
+	return r.Log.Check()
+}
+
+// Close stops the probes in progress, and closes the results file.
+func (r *researchMode) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.cancel()
+	r.wg.Wait()
+	return r.Log.Close()
+}
+
+// parseResearchProbe checks a probe of the config.
+func parseResearchProbe(cp cliConfigResearchProbe) (researchProbe, error) {
+	p := researchProbe{Name: cp.Name, Type: strings.ToLower(cp.Type), Flip: cp.Flip, Size: cp.Size}
+	if p.Name == "" {
+		return p, errors.New("name is required")
+	}
+	switch p.Type {
+	case "", researchProbeReplay:
+		p.Type = researchProbeReplay
+	case researchProbeRandom:
+		if p.Size <= 0 {
+			return p, errors.New("size must be positive")
+		}
+	case researchProbePayload:
+		if cp.Payload != "" && cp.Hex != "" {
+			return p, errors.New("payload and hex are mutually exclusive")
+		}
+		p.Payload = []byte(cp.Payload)
+		if cp.Hex != "" {
+			var err error
+			if p.Payload, err = hex.DecodeString(cp.Hex); err != nil {
+				return p, fmt.Errorf("invalid hex: %w", err)
+			}
+		}
+	default:
+		return p, fmt.Errorf("invalid type %q, must be replay, random or payload", cp.Type)
+	}
+	return p, nil
+}
@@ -0,0 +1,7 @@
+package cmd
+
+import "golang.org/x/sys/unix"
+
+func researchSetMark(fd uintptr, mark int) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+}
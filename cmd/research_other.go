@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cmd
+
+import "errors"
+
+var errResearchMarkUnsupported = errors.New("socket marks are only supported on Linux")
+
+func researchSetMark(fd uintptr, mark int) error {
+	return errResearchMarkUnsupported
+}
@@ -1,21 +1,41 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/analyzer/game"
+	"github.com/apernet/OpenGFW/analyzer/icmp"
+	"github.com/apernet/OpenGFW/analyzer/ml"
+	"github.com/apernet/OpenGFW/analyzer/relay"
+	"github.com/apernet/OpenGFW/analyzer/sctp"
 	"github.com/apernet/OpenGFW/analyzer/tcp"
 	"github.com/apernet/OpenGFW/analyzer/udp"
 	"github.com/apernet/OpenGFW/engine"
 	"github.com/apernet/OpenGFW/io"
 	"github.com/apernet/OpenGFW/modifier"
+	modTCP "github.com/apernet/OpenGFW/modifier/tcp"
 	modUDP "github.com/apernet/OpenGFW/modifier/udp"
 	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+	"github.com/apernet/OpenGFW/sink"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -35,9 +55,14 @@ const (
 	appConfigEnv    = "OPENGFW_CONFIG_FILE"
 	appLogLevelEnv  = "OPENGFW_LOG_LEVEL"
 	appLogFormatEnv = "OPENGFW_LOG_FORMAT"
+
+	routingDefaultPackets = 8
 )
 
-var logger *zap.Logger
+var (
+	logger         *zap.Logger
+	atomicLogLevel zap.AtomicLevel // Can be changed at runtime
+)
 
 // Flags
 var (
@@ -88,6 +113,7 @@ var logFormatMap = map[string]zapcore.EncoderConfig{
 var analyzers = []analyzer.Analyzer{
 	&tcp.FETAnalyzer{},
 	&tcp.HTTPAnalyzer{},
+	&tcp.OSAnalyzer{},
 	&tcp.SocksAnalyzer{},
 	&tcp.SSHAnalyzer{},
 	&tcp.TLSAnalyzer{},
@@ -95,10 +121,22 @@ var analyzers = []analyzer.Analyzer{
 	&udp.DNSAnalyzer{},
 	&udp.QUICAnalyzer{},
 	&udp.WireGuardAnalyzer{},
+	&udp.RTCAnalyzer{},
+	&game.Analyzer{},
+	&sctp.SCTPAnalyzer{},
+	&icmp.ICMPAnalyzer{},
 }
 
 var modifiers = []modifier.Modifier{
+	&modifier.DelayModifier{},
+	&modifier.IPModifier{},
+	&modTCP.HTTPBlockPageModifier{},
+	&modTCP.HTTPHeadersModifier{},
+	&modTCP.ReplaceModifier{},
+	&modTCP.TLSAlertModifier{},
 	&modUDP.DNSModifier{},
+	&modUDP.ICMPModifier{},
+	&modUDP.RewriteModifier{},
 }
 
 func Execute() {
@@ -144,8 +182,9 @@ func initLogger() {
 		fmt.Printf("unsupported log format: %s\n", logFormat)
 		os.Exit(1)
 	}
+	atomicLogLevel = zap.NewAtomicLevelAt(level)
 	c := zap.Config{
-		Level:             zap.NewAtomicLevelAt(level),
+		Level:             atomicLogLevel,
 		DisableCaller:     true,
 		DisableStacktrace: true,
 		Encoding:          strings.ToLower(logFormat),
@@ -159,269 +198,3436 @@ func initLogger() {
 		fmt.Printf("failed to initialize logger: %s\n", err)
 		os.Exit(1)
 	}
+	c.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	debugLogger, err = c.Build()
+	if err != nil {
+		fmt.Printf("failed to initialize logger: %s\n", err)
+		os.Exit(1)
+	}
 }
 
+// cliConfig is the config file.
 type cliConfig struct {
-	IO      cliConfigIO      `mapstructure:"io"`
-	Workers cliConfigWorkers `mapstructure:"workers"`
-	Ruleset cliConfigRuleset `mapstructure:"ruleset"`
+	IO         cliConfigIO         `mapstructure:"io"`
+	IOs        []cliConfigIO       `mapstructure:"ios"` // Instead of io, for several IOs feeding the engine
+	Workers    cliConfigWorkers    `mapstructure:"workers"`
+	Ruleset    cliConfigRuleset    `mapstructure:"ruleset"`
+	Shaping    cliConfigShaping    `mapstructure:"shaping"`
+	Sets       []cliConfigSet      `mapstructure:"sets"`
+	API        cliConfigAPI        `mapstructure:"api"`
+	GRPC       cliConfigGRPC       `mapstructure:"grpc"`
+	SNMP       cliConfigSNMP       `mapstructure:"snmp"`
+	Verdict    cliConfigVerdict    `mapstructure:"verdict"`
+	Degrade    cliConfigDegrade    `mapstructure:"degrade"`
+	Capture    cliConfigCapture    `mapstructure:"capture"`
+	Mirror     cliConfigMirror     `mapstructure:"mirror"`
+	Ring       cliConfigRing       `mapstructure:"packetRing"`
+	Webhook    cliConfigWebhook    `mapstructure:"webhook"`
+	OTLP       cliConfigOTLP       `mapstructure:"otlp"`
+	Eve        cliConfigEve        `mapstructure:"eve"`
+	ConnLog    cliConfigConnLog    `mapstructure:"connLog"`
+	GeoIP      cliConfigGeoIP      `mapstructure:"geoip"`
+	Alerts     cliConfigAlerts     `mapstructure:"alerts"`
+	Sinks      []cliConfigSink     `mapstructure:"sinks"`
+	Blocked    cliConfigBlocked    `mapstructure:"blocked"`
+	Audit      cliConfigAudit      `mapstructure:"audit"`
+	Security   cliConfigSecurity   `mapstructure:"security"`
+	Controller cliConfigController `mapstructure:"controller"`
+	Kubernetes cliConfigKubernetes `mapstructure:"kubernetes"`
+	Docker     cliConfigDocker     `mapstructure:"docker"`
+	HA         cliConfigHA         `mapstructure:"ha"`
+	CrowdSec   cliConfigCrowdSec   `mapstructure:"crowdsec"`
+	Fail2ban   cliConfigFail2ban   `mapstructure:"fail2ban"`
+	Feeds      []cliConfigFeed     `mapstructure:"feeds"`
+	Sinkhole   cliConfigSinkhole   `mapstructure:"sinkhole"`
+	Portal     cliConfigPortal     `mapstructure:"portal"`
+	Accounting cliConfigAccounting `mapstructure:"accounting"`
+	Strict     cliConfigStrict     `mapstructure:"strict"`
+	ML         cliConfigML         `mapstructure:"ml"`
+	Relay      cliConfigRelay      `mapstructure:"relay"`
+	Research   cliConfigResearch   `mapstructure:"research"`
+	IPv6       cliConfigIPv6       `mapstructure:"ipv6"`
+	Evasion    cliConfigEvasion    `mapstructure:"evasion"`
+	HAR        cliConfigHAR        `mapstructure:"har"`
+	HTTP       cliConfigHTTP       `mapstructure:"http"`
+	SSH        cliConfigSSH        `mapstructure:"ssh"`
+	QoS        cliConfigQoS        `mapstructure:"qos"`
+	Routing    cliConfigRouting    `mapstructure:"routing"`
+	NAT64      cliConfigNAT64      `mapstructure:"nat64"`
 }
 
+// cliConfigIO is an IO instance: where the packets come from, and their verdicts go.
 type cliConfigIO struct {
-	QueueSize   uint32 `mapstructure:"queueSize"`
-	ReadBuffer  int    `mapstructure:"rcvBuf"`
-	WriteBuffer int    `mapstructure:"sndBuf"`
-	Local       bool   `mapstructure:"local"`
-	RST         bool   `mapstructure:"rst"`
+	Name string `mapstructure:"name"` // Required in ios, seen by rules as "io"
+	Type string `mapstructure:"type"` // nfqueue (default) or pcap
+	// nfqueue
+	QueueNum    uint16              `mapstructure:"queueNum"`
+	Table       string              `mapstructure:"table"`
+	QueueSize   uint32              `mapstructure:"queueSize"`
+	FailOpen    bool                `mapstructure:"failOpen"`
+	ReadBuffer  int                 `mapstructure:"rcvBuf"`
+	WriteBuffer int                 `mapstructure:"sndBuf"`
+	Local       bool                `mapstructure:"local"`
+	RST         bool                `mapstructure:"rst"`
+	Divert      cliConfigIODivert   `mapstructure:"divert"`
+	Honeypot    cliConfigIOHoneypot `mapstructure:"honeypot"`
+	// pcap
+	File      string `mapstructure:"file"`      // Replayed once, the engine stops at its end
+	Realtime  bool   `mapstructure:"realtime"`  // Replay the file with its original timing
+	Interface string `mapstructure:"interface"` // Captured live instead of a file, as a passive sensor
+}
+
+// cliConfigIODivert is the local port the "divert" action redirects connections to, e.g. a transparent proxy.
+type cliConfigIODivert struct {
+	Port    uint16        `mapstructure:"port"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// cliConfigIOHoneypot is the honeypot the "honeypot" action DNATs connections to.
+type cliConfigIOHoneypot struct {
+	Address string        `mapstructure:"address"` // IP, or IP:port to change the port too
+	Timeout time.Duration `mapstructure:"timeout"`
 }
 
+// cliConfigWorkers are the workers processing the packets, each one a share of the streams.
 type cliConfigWorkers struct {
-	Count                      int `mapstructure:"count"`
-	QueueSize                  int `mapstructure:"queueSize"`
-	TCPMaxBufferedPagesTotal   int `mapstructure:"tcpMaxBufferedPagesTotal"`
-	TCPMaxBufferedPagesPerConn int `mapstructure:"tcpMaxBufferedPagesPerConn"`
-	UDPMaxStreams              int `mapstructure:"udpMaxStreams"`
+	Count                      int           `mapstructure:"count"`
+	QueueSize                  int           `mapstructure:"queueSize"`
+	TCPMaxBufferedPagesTotal   int           `mapstructure:"tcpMaxBufferedPagesTotal"`
+	TCPMaxBufferedPagesPerConn int           `mapstructure:"tcpMaxBufferedPagesPerConn"`
+	UDPMaxStreams              int           `mapstructure:"udpMaxStreams"`
+	SCTPMaxStreams             int           `mapstructure:"sctpMaxStreams"`
+	ICMPMaxStreams             int           `mapstructure:"icmpMaxStreams"`
+	MaxHeldPackets             int           `mapstructure:"maxHeldPackets"`
+	MaxHeldPacketsPerStream    int           `mapstructure:"maxHeldPacketsPerStream"`
+	IdleTimeout                time.Duration `mapstructure:"idleTimeout"`
+	DrainTimeout               time.Duration `mapstructure:"drainTimeout"`
 }
 
+// cliConfigRuleset configures the rules, beyond the rule file given on the command line.
 type cliConfigRuleset struct {
-	GeoIp   string `mapstructure:"geoip"`
-	GeoSite string `mapstructure:"geosite"`
+	GeoIp          string                     `mapstructure:"geoip"`
+	GeoSite        string                     `mapstructure:"geosite"`
+	Apps           string                     `mapstructure:"apps"` // Adds to the bundled applications of the app variable
+	Remote         cliConfigRulesetRemote     `mapstructure:"remote"`
+	TrackerMaxKeys int                        `mapstructure:"trackerMaxKeys"`
+	Functions      []ruleset.FunctionEntry    `mapstructure:"functions"`
+	Selectors      []cliConfigRulesetSelector `mapstructure:"selectors"`
+	History        int                        `mapstructure:"history"` // Number of versions kept for rollback
 }
 
-func (c *cliConfig) fillLogger(config *engine.Config) error {
-	config.Logger = &engineLogger{}
-	return nil
+// cliConfigRulesetSelector selects a different rule file for some clients.
+type cliConfigRulesetSelector struct {
+	Name       string   `mapstructure:"name"`
+	Rules      string   `mapstructure:"rules"` // Local file or remote URL, like the main rule file
+	Subnets    []string `mapstructure:"subnets"`
+	Interfaces []string `mapstructure:"interfaces"`
+	IOs        []string `mapstructure:"ios"` // Names of IO instances
 }
 
-func (c *cliConfig) fillIO(config *engine.Config) error {
-	nfio, err := io.NewNFQueuePacketIO(io.NFQueuePacketIOConfig{
-		QueueSize:   c.IO.QueueSize,
-		ReadBuffer:  c.IO.ReadBuffer,
-		WriteBuffer: c.IO.WriteBuffer,
-		Local:       c.IO.Local,
-		RST:         c.IO.RST,
-	})
-	if err != nil {
-		return configError{Field: "io", Err: err}
-	}
-	config.IOs = []io.PacketIO{nfio}
-	return nil
+// cliConfigRulesetRemote is the refresh of the rule file when it's an http(s):// URL.
+type cliConfigRulesetRemote struct {
+	Interval     time.Duration `mapstructure:"interval"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+	ChecksumURL  string        `mapstructure:"checksumURL"`
+	SignatureURL string        `mapstructure:"signatureURL"`
+	PublicKey    string        `mapstructure:"publicKey"`
 }
 
-func (c *cliConfig) fillWorkers(config *engine.Config) error {
-	config.Workers = c.Workers.Count
-	config.WorkerQueueSize = c.Workers.QueueSize
-	config.WorkerTCPMaxBufferedPagesTotal = c.Workers.TCPMaxBufferedPagesTotal
-	config.WorkerTCPMaxBufferedPagesPerConn = c.Workers.TCPMaxBufferedPagesPerConn
-	config.WorkerUDPMaxStreams = c.Workers.UDPMaxStreams
-	return nil
+// cliConfigShaping are the bandwidth classes for the "shape" action.
+type cliConfigShaping struct {
+	Device  string                  `mapstructure:"device"`
+	Rate    string                  `mapstructure:"rate"`
+	Classes []cliConfigShapingClass `mapstructure:"classes"`
 }
 
-// Config validates the fields and returns a ready-to-use engine config.
-// This does not include the ruleset.
-func (c *cliConfig) Config() (*engine.Config, error) {
-	engineConfig := &engine.Config{}
-	fillers := []func(*engine.Config) error{
-		c.fillLogger,
-		c.fillIO,
-		c.fillWorkers,
-	}
-	for _, f := range fillers {
-		if err := f(engineConfig); err != nil {
-			return nil, err
-		}
-	}
-	return engineConfig, nil
+// cliConfigShapingClass is a bandwidth class, whose streams are marked with fwmark = mark << 16.
+type cliConfigShapingClass struct {
+	Name string `mapstructure:"name"`
+	Mark uint32 `mapstructure:"mark"`
+	Rate string `mapstructure:"rate"`
+	Ceil string `mapstructure:"ceil"`
 }
 
-func runMain(cmd *cobra.Command, args []string) {
-	// Config
-	if err := viper.ReadInConfig(); err != nil {
-		logger.Fatal("failed to read config", zap.Error(err))
+// cliConfigQoS marks the streams accepted without a mark by application (see the app variable of the rules),
+// for QoS by tc (fwmark = mark << 16, like shaping classes) or, with DSCP, by the routers after this one.
+type cliConfigQoS struct {
+	Classes       []cliConfigQoSClass `mapstructure:"classes"`
+	MinConfidence float64             `mapstructure:"minConfidence"` // Of the application, default 0.5
+}
+
+// cliConfigQoSClass is the mark, and optionally the DSCP, of the streams of some applications.
+type cliConfigQoSClass struct {
+	Apps []string `mapstructure:"apps"` // "other" for the streams of no application
+	Mark uint32   `mapstructure:"mark"`
+	DSCP string   `mapstructure:"dscp"` // Name (ef, af41, cs1, le...) or 0-63, set by the nfqueue IO
+}
+
+// cliConfigSet is a named set for in_set(), whose entries can be changed at runtime.
+type cliConfigSet struct {
+	Name    string   `mapstructure:"name"`
+	Type    string   `mapstructure:"type"`
+	File    string   `mapstructure:"file"` // Local file or remote URL
+	Format  string   `mapstructure:"format"`
+	Entries []string `mapstructure:"entries"`
+	// Validation of a remote file, like for the rule file
+	ChecksumURL  string `mapstructure:"checksumURL"`
+	SignatureURL string `mapstructure:"signatureURL"`
+	PublicKey    string `mapstructure:"publicKey"`
+}
+
+// cliConfigAPI is the management API (HTTP/JSON).
+type cliConfigAPI struct {
+	Listen    string `mapstructure:"listen"`
+	Token     string `mapstructure:"token"`
+	Cert      string `mapstructure:"cert"`
+	Key       string `mapstructure:"key"`
+	ClientCA  string `mapstructure:"clientCA"`
+	Dashboard bool   `mapstructure:"dashboard"`
+	Insecure  bool   `mapstructure:"insecure"` // Allow listening on non-loopback addresses without a token or clientCA
+}
+
+// checkAuth refuses to serve the API without authentication on an address other hosts can reach,
+// as anyone there could then change the sets and rules, unless insecure is set.
+func (a *cliConfigAPI) checkAuth() error {
+	if a.Token != "" || a.ClientCA != "" || isLoopbackAddr(a.Listen) {
+		return nil
 	}
-	var config cliConfig
-	if err := viper.Unmarshal(&config); err != nil {
-		logger.Fatal("failed to parse config", zap.Error(err))
+	if !a.Insecure {
+		return configError{Field: "api", Err: fmt.Errorf("listening on %s without a token or clientCA, set insecure to allow it", a.Listen)}
 	}
-	engineConfig, err := config.Config()
+	logger.Warn("API server listening on a non-loopback address WITHOUT AUTHENTICATION, anyone who can reach it can change the sets and rules",
+		zap.String("addr", a.Listen))
+	return nil
+}
+
+// isLoopbackAddr returns whether the host of a listen address is a loopback one.
+// An empty host (all interfaces) isn't.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		logger.Fatal("failed to parse config", zap.Error(err))
+		return false
 	}
-	defer func() {
-		// Make sure to close all IOs on exit
-		for _, i := range engineConfig.IOs {
-			_ = i.Close()
-		}
-	}()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	// Ruleset
-	rawRs, err := ruleset.ExprRulesFromYAML(args[0])
-	if err != nil {
-		logger.Fatal("failed to load rules", zap.Error(err))
+// cliConfigGRPC is the gRPC API (docs/control.proto), which requires client certificates.
+type cliConfigGRPC struct {
+	Listen   string `mapstructure:"listen"`
+	Cert     string `mapstructure:"cert"`
+	Key      string `mapstructure:"key"`
+	ClientCA string `mapstructure:"clientCA"`
+}
+
+// cliConfigController connects to a central controller, which pushes rulesets & set contents.
+type cliConfigController struct {
+	URL            string             `mapstructure:"url"`            // https://host:port
+	ID             string             `mapstructure:"id"`             // Of this instance, the hostname by default
+	TLS            cliConfigClientTLS `mapstructure:"tls"`            // Always enabled, cert & key are required
+	PublicKey      string             `mapstructure:"publicKey"`      // Base64 ed25519 key the updates must be signed with
+	StatusInterval time.Duration      `mapstructure:"statusInterval"` // Default 30s
+}
+
+// cliConfigKubernetes is the API server of the Kubernetes cluster whose pods & services are watched,
+// to expose the workloads of the IPs of streams to the rules as k8s. In a pod, it's the cluster
+// the pod runs in by default, with its service account.
+type cliConfigKubernetes struct {
+	Enabled     bool               `mapstructure:"enabled"`
+	APIServer   string             `mapstructure:"apiServer"`   // https://host:port, or http:// e.g. for kubectl proxy
+	TokenFile   string             `mapstructure:"tokenFile"`   // Bearer token, the service account's by default
+	TLS         cliConfigClientTLS `mapstructure:"tls"`         // Enabled for https, the service account's CA by default
+	Namespaces  []string           `mapstructure:"namespaces"`  // Watched, all by default
+	SyncTimeout time.Duration      `mapstructure:"syncTimeout"` // Wait for the pods & services to be listed at startup, default 30s
+}
+
+// cliConfigDocker is the Docker daemon whose running containers are watched,
+// to expose the containers of the IPs of streams to the rules as container.
+type cliConfigDocker struct {
+	Enabled  bool               `mapstructure:"enabled"`
+	Host     string             `mapstructure:"host"`     // unix:///path or tcp://host:port, $DOCKER_HOST or the local socket by default
+	TLS      cliConfigClientTLS `mapstructure:"tls"`      // For tcp://
+	Interval time.Duration      `mapstructure:"interval"` // Containers listed again, on top of the events, default 1m
+}
+
+// cliConfigHA is the other instance of an HA pair, which the classification of streams is replicated with.
+type cliConfigHA struct {
+	Listen string        `mapstructure:"listen"` // Where the peer connects to
+	Peer   string        `mapstructure:"peer"`   // Listen address of the peer, enables HA
+	Key    string        `mapstructure:"key"`    // Shared by both instances, authenticates the messages
+	TTL    time.Duration `mapstructure:"ttl"`    // States of the peer kept without it sending them again, default 1h
+}
+
+// cliConfigCrowdSec is the local API of CrowdSec: its decisions are pulled into an IP set like a bouncer,
+// and the streams blocked by the rules can be reported back to it.
+type cliConfigCrowdSec struct {
+	URL      string                  `mapstructure:"url"` // e.g. http://127.0.0.1:8080
+	TLS      cliConfigClientTLS      `mapstructure:"tls"`
+	APIKey   string                  `mapstructure:"apiKey"`   // Of a bouncer (cscli bouncers add), enables the pull
+	Set      string                  `mapstructure:"set"`      // IP set the decisions are added to
+	Types    []string                `mapstructure:"types"`    // Of the decisions pulled, default ban
+	Interval time.Duration           `mapstructure:"interval"` // Of the pull, default 10s
+	Report   cliConfigCrowdSecReport `mapstructure:"report"`
+}
+
+// cliConfigCrowdSecReport is the reporting of the blocked streams to CrowdSec as alerts, as a machine.
+type cliConfigCrowdSecReport struct {
+	MachineID string        `mapstructure:"machineID"` // cscli machines add, enables the reports
+	Password  string        `mapstructure:"password"`
+	Rules     []string      `mapstructure:"rules"`    // Reported, all by default
+	IP        string        `mapstructure:"ip"`       // dst (default) or src
+	Duration  time.Duration `mapstructure:"duration"` // Of the bans, default 4h
+	Interval  time.Duration `mapstructure:"interval"` // Of the batches, default 30s
+}
+
+// cliConfigFail2ban is the log of fail2ban, whose bans are added to an IP set.
+type cliConfigFail2ban struct {
+	Log   string        `mapstructure:"log"` // e.g. /var/log/fail2ban.log, enables it
+	Set   string        `mapstructure:"set"`
+	Jails []string      `mapstructure:"jails"` // All by default
+	TTL   time.Duration `mapstructure:"ttl"`   // Since the ban, until the unban by default
+}
+
+// cliConfigFeed is a threat intelligence feed (MISP or TAXII), whose indicators are pulled periodically into sets.
+type cliConfigFeed struct {
+	Name          string             `mapstructure:"name"`
+	Type          string             `mapstructure:"type"`     // misp or taxii
+	URL           string             `mapstructure:"url"`      // MISP: of the instance, TAXII: of the collection
+	APIKey        string             `mapstructure:"apiKey"`   // MISP
+	Tags          []string           `mapstructure:"tags"`     // MISP: only the attributes with one of them
+	Username      string             `mapstructure:"username"` // TAXII
+	Password      string             `mapstructure:"password"`
+	Token         string             `mapstructure:"token"` // TAXII: bearer, instead of the username & password
+	TLS           cliConfigClientTLS `mapstructure:"tls"`
+	Interval      time.Duration      `mapstructure:"interval"`      // Default 1h
+	MinConfidence int                `mapstructure:"minConfidence"` // 0-100, indicators without one are kept
+	MaxAge        time.Duration      `mapstructure:"maxAge"`        // Since an indicator last changed, no limit by default
+	TTL           time.Duration      `mapstructure:"ttl"`           // Since the latest pull that had an indicator, no limit by default
+	Sets          cliConfigFeedSets  `mapstructure:"sets"`
+}
+
+// cliConfigFeedSets are the sets the indicators of a feed are added to, by type. Types without one are ignored.
+type cliConfigFeedSets struct {
+	IP     string `mapstructure:"ip"`     // ip set, of IPs & CIDRs
+	Domain string `mapstructure:"domain"` // domain set
+	JA3    string `mapstructure:"ja3"`    // string set, of hashes in lowercase hex
+	URL    string `mapstructure:"url"`    // string set
+}
+
+// cliConfigSinkhole is the DNS sinkhole: the queries for the domains of its lists are answered
+// with its own addresses (or NXDOMAIN) before any rule is evaluated, like Pi-hole but inline.
+type cliConfigSinkhole struct {
+	Lists          []string        `mapstructure:"lists"`          // Domain sets, enables the sinkhole
+	Exclude        []string        `mapstructure:"exclude"`        // Domain sets never sinkholed
+	ExcludeClients []string        `mapstructure:"excludeClients"` // IPs & CIDRs never sinkholed
+	Mode           string          `mapstructure:"mode"`           // ip (default) or nxdomain
+	A              string          `mapstructure:"a"`              // Default 0.0.0.0
+	AAAA           string          `mapstructure:"aaaa"`           // Default ::
+	TTL            *int            `mapstructure:"ttl"`            // Of the answers in seconds, default 60
+	MaxClients     int             `mapstructure:"maxClients"`     // With statistics, default 10000
+	Log            string          `mapstructure:"log"`            // File of the sinkholed queries, JSON lines
+	Rotate         cliConfigRotate `mapstructure:"rotate"`
+}
+
+// cliConfigPortal is the captive portal, which the clients of its networks must accept the terms of
+// (or enter the password of) before they get access.
+type cliConfigPortal struct {
+	Listen      string        `mapstructure:"listen"`    // Enables the portal
+	URL         string        `mapstructure:"url"`       // Where HTTP requests are redirected to, default http://<listen>/
+	Clients     []string      `mapstructure:"clients"`   // Networks held back by the portal
+	Allow       []string      `mapstructure:"allow"`     // Destinations allowed anyway (walled garden)
+	Set         string        `mapstructure:"set"`       // IP set of the clients with access
+	TTL         time.Duration `mapstructure:"ttl"`       // Of the access, default 24h
+	Password    string        `mapstructure:"password"`  // Optional
+	Terms       string        `mapstructure:"terms"`     // Terms of use to accept, optional
+	TermsFile   string        `mapstructure:"termsFile"` // Or from a file
+	Template    string        `mapstructure:"template"`  // File of the HTML template of the page, optional
+	KnownMACs   []string      `mapstructure:"knownMACs"` // Always have access
+	ARPInterval time.Duration `mapstructure:"arpInterval"`
+}
+
+// cliConfigAccounting is the accounting of the traffic of clients (source IPs), and where the counters of
+// usage() & per client quotas are kept across restarts.
+type cliConfigAccounting struct {
+	Enabled   bool          `mapstructure:"enabled"`   // Count the bytes of every stream; streams are no longer offloaded
+	Apps      bool          `mapstructure:"apps"`      // Per detected application too
+	File      string        `mapstructure:"file"`      // Where the counters are saved, optional
+	Interval  time.Duration `mapstructure:"interval"`  // Between saves, default 1m
+	Retention int           `mapstructure:"retention"` // Days of counters kept, default 62
+}
+
+// cliConfigStrict is strict mode, which denies the streams not to the domains of its allowlist or its ports.
+type cliConfigStrict struct {
+	Allow  []string `mapstructure:"allow"`  // Domain sets, matched against TLS & QUIC SNI and HTTP Host; enables strict mode
+	Ports  []string `mapstructure:"ports"`  // Destination ports allowed anyway, e.g. 53/udp, 22, 1000-2000/tcp
+	Exempt []string `mapstructure:"exempt"` // Clients not subject to strict mode
+	Grace  int      `mapstructure:"grace"`  // Bytes of the streams not allowed yet before they're dropped, default 16384
+}
+
+// cliConfigIPv6 limits the extension headers of IPv6 packets, dropping the packets breaking the limits.
+type cliConfigIPv6 struct {
+	MaxExtHeaders    int      `mapstructure:"maxExtHeaders"`    // Per packet, 0 for no limit
+	ForbidExtHeaders []string `mapstructure:"forbidExtHeaders"` // e.g. routing, hopbyhop, destination, fragment
+	Strict           bool     `mapstructure:"strict"`           // Also drop the chains breaking RFC 8200 & 7112
+	LogOnly          bool     `mapstructure:"logOnly"`          // Only log the packets breaking the limits
+}
+
+// cliConfigEvasion handles the TCP segments of classic IDS evasion: none (default), log, ignore (let through
+// without analyzing them) or drop.
+type cliConfigEvasion struct {
+	BadChecksum string `mapstructure:"badChecksum"` // Invalid TCP checksum
+	LowTTL      string `mapstructure:"lowTTL"`      // TTL lower than that of the first packet of the same direction
+	TTLDelta    uint8  `mapstructure:"ttlDelta"`    // How much lower is tolerated, default 0
+	Overlap     string `mapstructure:"overlap"`     // Data already acknowledged by the receiver
+}
+
+// cliConfigRouting describes how the traffic crosses the host: the interfaces facing the outside, from which
+// the direction of the streams is derived, and what to do with the TCP streams only one direction of which is seen.
+type cliConfigRouting struct {
+	External   []string `mapstructure:"external"`   // Interface names, e.g. the WAN or uplink
+	Asymmetric string   `mapstructure:"asymmetric"` // none (default, not detected), analyze, accept or drop
+	Packets    int      `mapstructure:"packets"`    // One-way segments before a stream is asymmetric, default 8
+}
+
+// cliConfigNAT64 makes the rules see the streams to addresses synthesized by NAT64/DNS64 as going to
+// the IPv4 addresses they embed, with the domains DNS64 answered them for.
+type cliConfigNAT64 struct {
+	Enabled    bool     `mapstructure:"enabled"`
+	Prefixes   []string `mapstructure:"prefixes"`   // Default 64:ff9b::/96
+	MaxDomains int      `mapstructure:"maxDomains"` // Synthesized addresses whose domain is remembered, default 65536
+}
+
+// cliConfigML is the ml analyzer, which classifies streams with an ONNX model fed the statistical features
+// of their first packets.
+type cliConfigML struct {
+	Model    string   `mapstructure:"model"`    // ONNX model file; enables the analyzer
+	Features []string `mapstructure:"features"` // Input of the model, in order; default all the scalar features
+	Packets  int      `mapstructure:"packets"`  // Classified after this many packets, default 20
+	Output   string   `mapstructure:"output"`   // Output with the class scores, default the first float output
+	Labels   []string `mapstructure:"labels"`   // Of the classes, default the class labels of the model
+	Softmax  bool     `mapstructure:"softmax"`  // For models outputting logits
+}
+
+// cliConfigRelay is the relay analyzer, which correlates the streams of each host to find those relaying
+// the data of other streams, like proxies.
+type cliConfigRelay struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Window    time.Duration `mapstructure:"window"`    // Between receiving a payload and sending it again, default 50ms
+	Tolerance int           `mapstructure:"tolerance"` // Bytes the sizes of the payloads can differ by, default 0
+	Packets   int           `mapstructure:"packets"`   // Scored after this many payloads, default 16
+}
+
+// cliConfigResearch is research mode, which records the handshakes of the streams captured by its rules,
+// and probes their servers like a censor would, to study the detectability of proxies.
+type cliConfigResearch struct {
+	File           string                   `mapstructure:"file"`           // Results, JSON lines; enables research mode
+	Rules          []string                 `mapstructure:"rules"`          // Capture rules whose streams are recorded, default all
+	HandshakeBytes int                      `mapstructure:"handshakeBytes"` // Recorded per side, default 4096
+	Window         time.Duration            `mapstructure:"window"`         // Longest recording, default 10s
+	Probes         []cliConfigResearchProbe `mapstructure:"probes"`         // Sent to the servers, in order; none to only record
+	Source         string                   `mapstructure:"source"`         // Local address the probes are sent from
+	Delay          time.Duration            `mapstructure:"delay"`          // Before probing, after the recording
+	Timeout        time.Duration            `mapstructure:"timeout"`        // Of each probe, default 10s
+	Cooldown       time.Duration            `mapstructure:"cooldown"`       // Before a server is probed again, default 10m
+	MaxConcurrent  int                      `mapstructure:"maxConcurrent"`  // Servers probed at once, default 16
+	Rotate         cliConfigRotate          `mapstructure:"rotate"`
+}
+
+// cliConfigResearchProbe is a probe of research mode.
+type cliConfigResearchProbe struct {
+	Name    string `mapstructure:"name"`
+	Type    string `mapstructure:"type"`    // replay (default), random or payload
+	Flip    []int  `mapstructure:"flip"`    // replay: offsets of the bytes to invert in the first message of the client
+	Size    int    `mapstructure:"size"`    // random: number of bytes
+	Payload string `mapstructure:"payload"` // payload: as text
+	Hex     string `mapstructure:"hex"`     // payload: or as hex
+}
+
+// tlsConfig returns the TLS config to connect to the controller, which requires a client certificate.
+func (c *cliConfigController) tlsConfig() (*tls.Config, error) {
+	if !strings.HasPrefix(c.URL, "https://") {
+		return nil, configError{Field: "controller.url", Err: errors.New("must be an https:// URL")}
 	}
-	rsConfig := &ruleset.BuiltinConfig{
-		Logger:          &rulesetLogger{},
-		GeoSiteFilename: config.Ruleset.GeoSite,
-		GeoIpFilename:   config.Ruleset.GeoIp,
+	if c.TLS.Cert == "" || c.TLS.Key == "" {
+		return nil, configError{Field: "controller.tls", Err: errors.New("cert and key are required")}
 	}
-	rs, err := ruleset.CompileExprRules(rawRs, analyzers, modifiers, rsConfig)
-	if err != nil {
-		logger.Fatal("failed to compile rules", zap.Error(err))
+	if key, err := base64.StdEncoding.DecodeString(c.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, configError{Field: "controller.publicKey", Err: errors.New("missing or invalid ed25519 key")}
 	}
-	engineConfig.Ruleset = rs
-
-	// Engine
-	en, err := engine.NewEngine(*engineConfig)
+	t := c.TLS
+	t.Enabled = true
+	config, err := t.config()
 	if err != nil {
-		logger.Fatal("failed to initialize engine", zap.Error(err))
+		return nil, configError{Field: "controller.tls", Err: err}
 	}
+	config.NextProtos = []string{"h2"}
+	return config, nil
+}
 
-	// Signal handling
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	go func() {
-		// Graceful shutdown
-		shutdownChan := make(chan os.Signal, 1)
-		signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
-		<-shutdownChan
-		logger.Info("shutting down gracefully...")
-		cancelFunc()
-	}()
-	go func() {
-		// Rule reload
-		reloadChan := make(chan os.Signal, 1)
-		signal.Notify(reloadChan, syscall.SIGHUP)
-		for {
-			<-reloadChan
-			logger.Info("reloading rules")
-			rawRs, err := ruleset.ExprRulesFromYAML(args[0])
-			if err != nil {
-				logger.Error("failed to load rules, using old rules", zap.Error(err))
-				continue
-			}
-			rs, err := ruleset.CompileExprRules(rawRs, analyzers, modifiers, rsConfig)
-			if err != nil {
-				logger.Error("failed to compile rules, using old rules", zap.Error(err))
-				continue
-			}
-			err = en.UpdateRuleset(rs)
-			if err != nil {
-				logger.Error("failed to update ruleset", zap.Error(err))
-			} else {
-				logger.Info("rules reloaded")
-			}
-		}
-	}()
+// cliConfigSNMP is the AgentX subagent exposing the engine statistics through the SNMP agent of the host.
+type cliConfigSNMP struct {
+	Enabled bool   `mapstructure:"enabled"`
+	AgentX  string `mapstructure:"agentx"` // Master agent, unix socket path (default /var/agentx/master) or tcp:host:port
+	OID     string `mapstructure:"oid"`    // Base OID, default 1.3.6.1.4.1.8072.9999.9999.1
+}
 
-	logger.Info("engine started")
-	logger.Info("engine exited", zap.Error(en.Run(ctx)))
+// cliConfigCapture is where the "capture" action writes matched streams, as pcap files.
+type cliConfigCapture struct {
+	Dir      string        `mapstructure:"dir"`
+	Prefix   string        `mapstructure:"prefix"`
+	MaxSize  int64         `mapstructure:"maxSize"` // MiB
+	Interval time.Duration `mapstructure:"interval"`
+	MaxFiles int           `mapstructure:"maxFiles"`
+	MaxAge   time.Duration `mapstructure:"maxAge"`
+	Compress string        `mapstructure:"compress"`
+	Format   string        `mapstructure:"format"` // pcap (default) or pcapng
+	Lookback int           `mapstructure:"lookback"`
 }
 
-type engineLogger struct{}
+// cliConfigHTTP are the options of the http analyzer.
+type cliConfigHTTP struct {
+	Credentials    bool     `mapstructure:"credentials"`    // Flag the requests carrying credentials to external destinations
+	Internal       []string `mapstructure:"internal"`       // IPs & CIDRs, default the private, loopback & link-local ones
+	SessionCookies []string `mapstructure:"sessionCookies"` // Substrings of the names of session cookies, default built-in
+}
 
-func (l *engineLogger) WorkerStart(id int) {
-	logger.Debug("worker started", zap.Int("id", id))
+// cliConfigSSH are the options of the ssh analyzer.
+type cliConfigSSH struct {
+	Tunnel  bool `mapstructure:"tunnel"`  // Score how likely connections tunnel others, after their key exchange
+	Packets int  `mapstructure:"packets"` // Chunks of encrypted data the score is based on, default 256
 }
 
-func (l *engineLogger) WorkerStop(id int) {
-	logger.Debug("worker stopped", zap.Int("id", id))
+// cliConfigHAR is where the "capture-http" action writes the HTTP sessions of matched streams, as HAR files.
+type cliConfigHAR struct {
+	Dir        string `mapstructure:"dir"`
+	Prefix     string `mapstructure:"prefix"`
+	MaxBody    int    `mapstructure:"maxBody"`    // Bytes, default 1 MiB
+	MaxEntries int    `mapstructure:"maxEntries"` // Per file, default 100
+	MaxFiles   int    `mapstructure:"maxFiles"`
+	Lookback   int    `mapstructure:"lookback"` // Packets kept per stream, default 64
 }
 
-func (l *engineLogger) TCPStreamNew(workerID int, info ruleset.StreamInfo) {
-	logger.Debug("new TCP stream",
-		zap.Int("workerID", workerID),
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()))
+// cliConfigMirror is where the "mirror" action sends matched streams.
+type cliConfigMirror struct {
+	Type      string `mapstructure:"type"`
+	Interface string `mapstructure:"interface"`
+	DstMAC    string `mapstructure:"dstMAC"`
+	Remote    string `mapstructure:"remote"`
+	VNI       uint32 `mapstructure:"vni"`
 }
 
-func (l *engineLogger) TCPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
-	logger.Debug("TCP stream property update",
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()),
-		zap.Any("props", info.Props),
-		zap.Bool("close", close))
+// cliConfigRing keeps the latest packets of every worker, dumped for debugging when an analyzer fails.
+type cliConfigRing struct {
+	Size     int    `mapstructure:"size"` // Packets per worker
+	Dir      string `mapstructure:"dir"`
+	MaxFiles int    `mapstructure:"maxFiles"`
 }
 
-func (l *engineLogger) TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, noMatch bool) {
-	logger.Info("TCP stream action",
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()),
-		zap.String("action", action.String()),
-		zap.Bool("noMatch", noMatch))
+// cliConfigWebhook is where rules with "notify: true" send their matches.
+type cliConfigWebhook struct {
+	URL        string            `mapstructure:"url"`
+	Headers    map[string]string `mapstructure:"headers"`
+	Timeout    time.Duration     `mapstructure:"timeout"`
+	Retries    int               `mapstructure:"retries"`
+	RetryDelay time.Duration     `mapstructure:"retryDelay"`
+	RateLimit  float64           `mapstructure:"rateLimit"` // events per second
+	Burst      int               `mapstructure:"burst"`
+	QueueSize  int               `mapstructure:"queueSize"`
 }
 
-func (l *engineLogger) UDPStreamNew(workerID int, info ruleset.StreamInfo) {
-	logger.Debug("new UDP stream",
-		zap.Int("workerID", workerID),
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()))
+// cliConfigOTLP is the OpenTelemetry export of metrics & traces, with OTLP/HTTP.
+type cliConfigOTLP struct {
+	Endpoint    string            `mapstructure:"endpoint"`
+	Headers     map[string]string `mapstructure:"headers"`
+	Interval    time.Duration     `mapstructure:"interval"`
+	Timeout     time.Duration     `mapstructure:"timeout"`
+	SampleRatio float64           `mapstructure:"sampleRatio"`
+	ServiceName string            `mapstructure:"serviceName"`
+	QueueSize   int               `mapstructure:"queueSize"`
 }
 
-func (l *engineLogger) UDPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
-	logger.Debug("UDP stream property update",
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()),
-		zap.Any("props", info.Props),
-		zap.Bool("close", close))
+// cliConfigEve is the event log in the format of Suricata's eve.json.
+type cliConfigEve struct {
+	File                string          `mapstructure:"file"`
+	Rotate              cliConfigRotate `mapstructure:"rotate"`
+	cliConfigEventRoute `mapstructure:",squash"`
 }
 
-func (l *engineLogger) UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, noMatch bool) {
-	logger.Info("UDP stream action",
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()),
-		zap.String("action", action.String()),
-		zap.Bool("noMatch", noMatch))
+// cliConfigEventRoute selects the events an output of the event log gets.
+type cliConfigEventRoute struct {
+	Types    []string           `mapstructure:"types"`    // Event types, all if empty
+	Severity int                `mapstructure:"severity"` // Only alerts of this severity or higher (1 is the highest), all if 0
+	Sample   map[string]float64 `mapstructure:"sample"`   // Fraction of the streams whose events are sent, by event type, all if absent
 }
 
-func (l *engineLogger) ModifyError(info ruleset.StreamInfo, err error) {
-	logger.Error("modify error",
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()),
-		zap.Error(err))
+// cliConfigRotate is the built-in rotation of a log file.
+type cliConfigRotate struct {
+	MaxSize  int64         `mapstructure:"maxSize"`  // MiB, 0 = never
+	Interval time.Duration `mapstructure:"interval"` // 0 = never
+	MaxFiles int           `mapstructure:"maxFiles"` // Rotated files to keep, 0 = unlimited
+	MaxAge   time.Duration `mapstructure:"maxAge"`   // 0 = forever
+	Compress string        `mapstructure:"compress"` // gzip, or empty for none
 }
 
-func (l *engineLogger) AnalyzerDebugf(streamID int64, name string, format string, args ...interface{}) {
-	logger.Debug("analyzer debug message",
-		zap.Int64("id", streamID),
-		zap.String("name", name),
-		zap.String("msg", fmt.Sprintf(format, args...)))
+func (c *cliConfigRotate) fileConfig(path string) sink.FileConfig {
+	return sink.FileConfig{
+		Path:     path,
+		MaxSize:  c.MaxSize * 1024 * 1024,
+		Interval: c.Interval,
+		MaxFiles: c.MaxFiles,
+		MaxAge:   c.MaxAge,
+		Compress: c.Compress,
+	}
 }
 
-func (l *engineLogger) AnalyzerInfof(streamID int64, name string, format string, args ...interface{}) {
-	logger.Info("analyzer info message",
-		zap.Int64("id", streamID),
-		zap.String("name", name),
-		zap.String("msg", fmt.Sprintf(format, args...)))
+// cliConfigAlerts is the aggregation of identical alerts, for every output of the event log.
+type cliConfigAlerts struct {
+	Window time.Duration `mapstructure:"window"` // Identical alerts within it are aggregated, 0 = disabled
 }
 
-func (l *engineLogger) AnalyzerErrorf(streamID int64, name string, format string, args ...interface{}) {
-	logger.Error("analyzer error message",
-		zap.Int64("id", streamID),
-		zap.String("name", name),
-		zap.String("msg", fmt.Sprintf(format, args...)))
+// cliConfigBlocked is the feed of the recently blocked IPs & domains,
+// served by the API and/or exported to a file.
+type cliConfigBlocked struct {
+	TTL        time.Duration `mapstructure:"ttl"`        // Since the latest block, default 1h
+	MaxEntries int           `mapstructure:"maxEntries"` // Default 100000
+	Sets       []string      `mapstructure:"sets"`       // IP or domain sets to list too
+	NFTTable   string        `mapstructure:"nftTable"`   // Table of the sets in the nft format, default "inet filter"
+	File       string        `mapstructure:"file"`
+	Format     string        `mapstructure:"format"`   // plain (default), json, dnsmasq or nft
+	Interval   time.Duration `mapstructure:"interval"` // Of the file export, default 1m
 }
 
-type rulesetLogger struct{}
+// cliConfigConnLog is the connection log, with a record per stream when it ends.
+type cliConfigConnLog struct {
+	File   string          `mapstructure:"file"`
+	Rotate cliConfigRotate `mapstructure:"rotate"`
+}
 
-func (l *rulesetLogger) Log(info ruleset.StreamInfo, name string) {
-	logger.Info("ruleset log",
-		zap.String("name", name),
-		zap.Int64("id", info.ID),
-		zap.String("src", info.SrcString()),
-		zap.String("dst", info.DstString()),
-		zap.Any("props", info.Props))
+// cliConfigGeoIP is the enrichment of the events with the country & AS of their addresses.
+type cliConfigGeoIP struct {
+	Country   string `mapstructure:"country"`   // MaxMind DB file with countries (country or city database)
+	ASN       string `mapstructure:"asn"`       // MaxMind DB file with ASNs
+	CacheSize int    `mapstructure:"cacheSize"` // IPs, default 65536
+}
+
+// geoIP loads the databases, or returns nil if none is configured.
+func (c *cliConfig) geoIP() (*geoIP, error) {
+	if c.GeoIP.Country == "" && c.GeoIP.ASN == "" {
+		return nil, nil
+	}
+	g, err := newGeoIP(c.GeoIP.Country, c.GeoIP.ASN, c.GeoIP.CacheSize)
+	if err != nil {
+		return nil, configError{Field: "geoip", Err: err}
+	}
+	return g, nil
+}
+
+// cliConfigAudit is the log of the changes made at runtime.
+type cliConfigAudit struct {
+	File string `mapstructure:"file"`
+	Key  string `mapstructure:"key"` // HMAC key of the hash chain, plain SHA-256 if empty
+}
+
+// cliConfigSecurity drops the privileges once the queue is attached and the firewall rules are in place.
+type cliConfigSecurity struct {
+	User         string   `mapstructure:"user"`         // Empty to keep running as root
+	Group        string   `mapstructure:"group"`        // Default: the user's primary group
+	Capabilities []string `mapstructure:"capabilities"` // Kept, default: net_admin, net_raw
+	Seccomp      bool     `mapstructure:"seccomp"`
+}
+
+// auditLog opens the audit log, or returns nil if it's not enabled.
+func (c *cliConfig) auditLog() (*auditLog, error) {
+	if c.Audit.File == "" {
+		return nil, nil
+	}
+	var key []byte
+	if c.Audit.Key != "" {
+		key = []byte(c.Audit.Key)
+	}
+	l, err := newAuditLog(c.Audit.File, key)
+	if err != nil {
+		return nil, configError{Field: "audit.file", Err: err}
+	}
+	return l, nil
+}
+
+// cliConfigSink is an output of the event log, other than the eve file.
+type cliConfigSink struct {
+	Type                string `mapstructure:"type"` // kafka, nats, syslog, elasticsearch or clickhouse
+	Key                 string `mapstructure:"key"`  // Partitioning key: flow_id (default), flow_uuid, src_ip, dest_ip or none
+	cliConfigEventRoute `mapstructure:",squash"`
+	// Kafka
+	Brokers []string `mapstructure:"brokers"`
+	Topic   string   `mapstructure:"topic"`
+	Acks    string   `mapstructure:"acks"` // none, leader or all (default)
+	// NATS
+	Servers []string `mapstructure:"servers"`
+	Subject string   `mapstructure:"subject"`
+	Token   string   `mapstructure:"token"`
+	// Syslog
+	Addr     string `mapstructure:"addr"`
+	Network  string `mapstructure:"network"`  // udp or tcp, tcp if TLS is enabled and udp otherwise by default
+	Framing  string `mapstructure:"framing"`  // octet (default) or newline, for tcp
+	Facility string `mapstructure:"facility"` // Default local0
+	Hostname string `mapstructure:"hostname"`
+	AppName  string `mapstructure:"appName"`
+	// Elasticsearch & ClickHouse
+	URL      string        `mapstructure:"url"`
+	Index    string        `mapstructure:"index"` // Elasticsearch
+	APIKey   string        `mapstructure:"apiKey"`
+	Database string        `mapstructure:"database"` // ClickHouse
+	Table    string        `mapstructure:"table"`
+	TTL      time.Duration `mapstructure:"ttl"` // Retention of the created ClickHouse table, forever if zero
+	// Common
+	Username     string             `mapstructure:"username"`
+	Password     string             `mapstructure:"password"`
+	TLS          cliConfigClientTLS `mapstructure:"tls"`
+	Timeout      time.Duration      `mapstructure:"timeout"`
+	BatchSize    int                `mapstructure:"batchSize"`
+	BatchTimeout time.Duration      `mapstructure:"batchTimeout"`
+	QueueSize    int                `mapstructure:"queueSize"`
+	Block        bool               `mapstructure:"block"` // Slow down the engine instead of dropping events when the queue is full
+	Retries      int                `mapstructure:"retries"`
+	RetryDelay   time.Duration      `mapstructure:"retryDelay"`
+}
+
+// cliConfigClientTLS is the TLS configuration to connect to a server.
+type cliConfigClientTLS struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	CA       string `mapstructure:"ca"`       // PEM file, the system roots if empty
+	Cert     string `mapstructure:"cert"`     // Client certificate, PEM file
+	Key      string `mapstructure:"key"`      // Client key, PEM file
+	Insecure bool   `mapstructure:"insecure"` // Don't verify the server's certificate
+}
+
+// config returns the TLS config, or nil if TLS is disabled.
+func (c *cliConfigClientTLS) config() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CA != "" {
+		bs, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificate found in %q", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// cliConfigVerdict sets the default verdicts for streams no rule matched.
+type cliConfigVerdict struct {
+	Unmatched    string `mapstructure:"unmatched"`
+	Unclassified string `mapstructure:"unclassified"`
+	IDSOnly      bool   `mapstructure:"idsOnly"`
+}
+
+// cliConfigDegrade is the degraded mode of the engine under overload, see degradeMonitor.
+type cliConfigDegrade struct {
+	Latency       time.Duration `mapstructure:"latency"`       // Average from receipt to verdict, 0 = not checked
+	Backlog       float64       `mapstructure:"backlog"`       // Fraction of the worker queues in use, 0 = not checked
+	Interval      time.Duration `mapstructure:"interval"`      // Of the checks, default 1s
+	Recover       time.Duration `mapstructure:"recover"`       // Under the thresholds before leaving degraded mode, default 30s
+	SkipAnalyzers []string      `mapstructure:"skipAnalyzers"` // Default: those over the average time per stream
+	Sample        float64       `mapstructure:"sample"`        // Fraction of the sampled events & traces still sent, default 0.1
+}
+
+// k8sWatcher creates the watcher of the Kubernetes cluster, or returns nil if it's not enabled.
+func (c *cliConfig) k8sWatcher() (*k8sWatcher, error) {
+	k := c.Kubernetes
+	if !k.Enabled {
+		return nil, nil
+	}
+	if k.APIServer == "" {
+		// In-cluster
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, configError{Field: "kubernetes.apiServer", Err: errors.New("required when not running in a pod")}
+		}
+		k.APIServer = "https://" + net.JoinHostPort(host, port)
+		if k.TokenFile == "" {
+			k.TokenFile = filepath.Join(k8sServiceAccountDir, "token")
+		}
+		if k.TLS.CA == "" {
+			k.TLS.CA = filepath.Join(k8sServiceAccountDir, "ca.crt")
+		}
+	}
+	u, err := url.Parse(k.APIServer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, configError{Field: "kubernetes.apiServer", Err: errors.New("must be an http:// or https:// URL")}
+	}
+	if k.SyncTimeout < 0 {
+		return nil, configError{Field: "kubernetes.syncTimeout", Err: errors.New("must not be negative")}
+	}
+	k.TLS.Enabled = u.Scheme == "https"
+	tlsConfig, err := k.TLS.config()
+	if err != nil {
+		return nil, configError{Field: "kubernetes.tls", Err: err}
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: k8sResponseHeaderTimeout,
+	}}
+	return newK8sWatcher(k.APIServer, k.TokenFile, client, k.Namespaces), nil
+}
+
+// dockerWatcher creates the watcher of the Docker containers, or returns nil if it's not enabled.
+func (c *cliConfig) dockerWatcher() (*dockerWatcher, error) {
+	d := c.Docker
+	if !d.Enabled {
+		return nil, nil
+	}
+	if d.Host == "" {
+		d.Host = os.Getenv("DOCKER_HOST")
+	}
+	if d.Host == "" {
+		d.Host = dockerDefaultHost
+	}
+	if d.Interval < 0 {
+		return nil, configError{Field: "docker.interval", Err: errors.New("must not be negative")}
+	}
+	if d.Interval == 0 {
+		d.Interval = dockerDefaultInterval
+	}
+	tlsConfig, err := d.TLS.config()
+	if err != nil {
+		return nil, configError{Field: "docker.tls", Err: err}
+	}
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: dockerRequestTimeout,
+	}}
+	w, err := newDockerWatcher(d.Host, client, d.Interval)
+	if err != nil {
+		return nil, configError{Field: "docker.host", Err: err}
+	}
+	return w, nil
+}
+
+// haSync creates the replication of stream states with the HA peer, or returns nil if it's not enabled.
+func (c *cliConfig) haSync() (*haSync, error) {
+	h := c.HA
+	if h.Peer == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(h.Peer); err != nil {
+		return nil, configError{Field: "ha.peer", Err: err}
+	}
+	if _, _, err := net.SplitHostPort(h.Listen); err != nil {
+		return nil, configError{Field: "ha.listen", Err: err}
+	}
+	if h.Key == "" {
+		return nil, configError{Field: "ha.key", Err: errors.New("required")}
+	}
+	if h.TTL < 0 {
+		return nil, configError{Field: "ha.ttl", Err: errors.New("must not be negative")}
+	}
+	if h.TTL == 0 {
+		h.TTL = haDefaultTTL
+	}
+	return newHASync(h.Listen, h.Peer, []byte(h.Key), h.TTL), nil
+}
+
+// crowdSec creates the pull of the decisions of CrowdSec and the reporting of the blocks to it,
+// either of them nil if it's not enabled.
+func (c *cliConfig) crowdSec(sets *builtins.SetStore) (*crowdSecBouncer, *crowdSecReporter, error) {
+	cs := c.CrowdSec
+	if cs.APIKey == "" && cs.Report.MachineID == "" {
+		return nil, nil, nil
+	}
+	u, err := url.Parse(cs.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, nil, configError{Field: "crowdsec.url", Err: errors.New("must be an http:// or https:// URL")}
+	}
+	cs.TLS.Enabled = u.Scheme == "https"
+	tlsConfig, err := cs.TLS.config()
+	if err != nil {
+		return nil, nil, configError{Field: "crowdsec.tls", Err: err}
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		Timeout:   crowdSecRequestTimeout,
+	}
+	var bouncer *crowdSecBouncer
+	if cs.APIKey != "" {
+		set, err := ipSet(sets, cs.Set)
+		if err != nil {
+			return nil, nil, configError{Field: "crowdsec.set", Err: err}
+		}
+		if cs.Interval < 0 {
+			return nil, nil, configError{Field: "crowdsec.interval", Err: errors.New("must not be negative")}
+		}
+		if cs.Interval == 0 {
+			cs.Interval = crowdSecDefaultInterval
+		}
+		if len(cs.Types) == 0 {
+			cs.Types = []string{"ban"}
+		}
+		bouncer = newCrowdSecBouncer(cs.URL, client, cs.APIKey, set, cs.Types, cs.Interval)
+	}
+	var reporter *crowdSecReporter
+	if r := cs.Report; r.MachineID != "" {
+		if r.IP != "" && r.IP != "dst" && r.IP != "src" {
+			return nil, nil, configError{Field: "crowdsec.report.ip", Err: fmt.Errorf("must be dst or src, not %q", r.IP)}
+		}
+		if r.Duration < 0 || r.Interval < 0 {
+			return nil, nil, configError{Field: "crowdsec.report", Err: errors.New("duration and interval must not be negative")}
+		}
+		if r.Duration == 0 {
+			r.Duration = crowdSecDefaultDuration
+		}
+		if r.Interval == 0 {
+			r.Interval = crowdSecDefaultReportInterval
+		}
+		var decisions *builtins.Set
+		if bouncer != nil {
+			decisions = bouncer.Set
+		}
+		reporter = newCrowdSecReporter(cs.URL, client, r.MachineID, r.Password, r.Rules,
+			r.IP == "src", r.Duration, r.Interval, decisions)
+	}
+	return bouncer, reporter, nil
+}
+
+// fail2banTailer creates the follower of the log of fail2ban, or returns nil if it's not enabled.
+func (c *cliConfig) fail2banTailer(sets *builtins.SetStore) (*fail2banTailer, error) {
+	f := c.Fail2ban
+	if f.Log == "" {
+		return nil, nil
+	}
+	set, err := ipSet(sets, f.Set)
+	if err != nil {
+		return nil, configError{Field: "fail2ban.set", Err: err}
+	}
+	if f.TTL < 0 {
+		return nil, configError{Field: "fail2ban.ttl", Err: errors.New("must not be negative")}
+	}
+	return newFail2banTailer(f.Log, set, f.Jails, f.TTL), nil
+}
+
+// intelFeeds creates the threat intelligence feeds, none if there's none configured.
+// Sets can be shared by feeds.
+func (c *cliConfig) intelFeeds(sets *builtins.SetStore) ([]*intelFeed, error) {
+	var feeds []*intelFeed
+	intelSets := make(map[*builtins.Set]*intelSet)
+	seen := make(map[string]bool)
+	for i, cf := range c.Feeds {
+		field := fmt.Sprintf("feeds[%d]", i)
+		if cf.Name == "" || seen[cf.Name] {
+			return nil, configError{Field: field + ".name", Err: fmt.Errorf("missing or duplicate feed name %q", cf.Name)}
+		}
+		seen[cf.Name] = true
+		u, err := url.Parse(cf.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, configError{Field: field + ".url", Err: errors.New("must be an http:// or https:// URL")}
+		}
+		f := &intelFeed{
+			Name:          cf.Name,
+			Sets:          make(map[string]*intelSet),
+			Interval:      cf.Interval,
+			MinConfidence: cf.MinConfidence,
+			MaxAge:        cf.MaxAge,
+			TTL:           cf.TTL,
+		}
+		switch cf.Type {
+		case "misp":
+			if cf.APIKey == "" {
+				return nil, configError{Field: field + ".apiKey", Err: errors.New("required")}
+			}
+			f.Source = &mispSource{URL: strings.TrimSuffix(cf.URL, "/"), APIKey: cf.APIKey, Tags: cf.Tags}
+		case "taxii":
+			f.Source = &taxiiSource{URL: cf.URL, Username: cf.Username, Password: cf.Password, Token: cf.Token}
+		default:
+			return nil, configError{Field: field + ".type", Err: fmt.Errorf("unsupported feed type %q, must be misp or taxii", cf.Type)}
+		}
+		if cf.Interval < 0 || cf.MaxAge < 0 || cf.TTL < 0 {
+			return nil, configError{Field: field, Err: errors.New("interval, maxAge and ttl must not be negative")}
+		}
+		if f.Interval == 0 {
+			f.Interval = intelDefaultInterval
+		}
+		if cf.MinConfidence < 0 || cf.MinConfidence > 100 {
+			return nil, configError{Field: field + ".minConfidence", Err: errors.New("must be between 0 and 100")}
+		}
+		for _, s := range []struct {
+			typ, name string
+			setType   builtins.SetType
+		}{
+			{intelTypeIP, cf.Sets.IP, builtins.SetTypeIP},
+			{intelTypeDomain, cf.Sets.Domain, builtins.SetTypeDomain},
+			{intelTypeJA3, cf.Sets.JA3, builtins.SetTypeString},
+			{intelTypeURL, cf.Sets.URL, builtins.SetTypeString},
+		} {
+			if s.name == "" {
+				continue
+			}
+			set := sets.Get(s.name)
+			if set == nil {
+				return nil, configError{Field: field + ".sets." + s.typ, Err: fmt.Errorf("set %q not found", s.name)}
+			}
+			if set.Type() != s.setType {
+				return nil, configError{Field: field + ".sets." + s.typ, Err: fmt.Errorf("set %q is not a %s set", s.name, s.setType)}
+			}
+			if intelSets[set] == nil {
+				intelSets[set] = newIntelSet(set)
+			}
+			f.Sets[s.typ] = intelSets[set]
+		}
+		if len(f.Sets) == 0 {
+			return nil, configError{Field: field + ".sets", Err: errors.New("at least one set is required")}
+		}
+		cf.TLS.Enabled = u.Scheme == "https"
+		tlsConfig, err := cf.TLS.config()
+		if err != nil {
+			return nil, configError{Field: field + ".tls", Err: err}
+		}
+		f.Client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+		feeds = append(feeds, f)
+	}
+	return feeds, nil
+}
+
+// sinkhole creates the DNS sinkhole, or returns nil if it's not enabled.
+func (c *cliConfig) sinkhole(sets *builtins.SetStore) (*sinkhole, error) {
+	cs := c.Sinkhole
+	if len(cs.Lists) == 0 {
+		return nil, nil
+	}
+	s := &sinkhole{
+		Lists:      cs.Lists,
+		Exclude:    cs.Exclude,
+		A:          cs.A,
+		AAAA:       cs.AAAA,
+		TTL:        sinkholeDefaultTTL,
+		MaxClients: cs.MaxClients,
+		clients:    make(map[string]*sinkholeClient),
+	}
+	for _, f := range []struct {
+		field string
+		names []string
+	}{{"sinkhole.lists", cs.Lists}, {"sinkhole.exclude", cs.Exclude}} {
+		for _, name := range f.names {
+			set := sets.Get(name)
+			if set == nil {
+				return nil, configError{Field: f.field, Err: fmt.Errorf("set %q not found", name)}
+			}
+			if set.Type() != builtins.SetTypeDomain {
+				return nil, configError{Field: f.field, Err: fmt.Errorf("set %q is not a domain set", name)}
+			}
+		}
+	}
+	var err error
+	if s.ExcludeClients, err = cidrList(cs.ExcludeClients); err != nil {
+		return nil, configError{Field: "sinkhole.excludeClients", Err: err}
+	}
+	switch cs.Mode {
+	case "", "ip":
+		if s.A == "" {
+			s.A = sinkholeDefaultA
+		}
+		if s.AAAA == "" {
+			s.AAAA = sinkholeDefaultAAAA
+		}
+		if net.ParseIP(s.A).To4() == nil {
+			return nil, configError{Field: "sinkhole.a", Err: fmt.Errorf("invalid IPv4 address %q", s.A)}
+		}
+		if ip := net.ParseIP(s.AAAA); ip == nil || ip.To4() != nil {
+			return nil, configError{Field: "sinkhole.aaaa", Err: fmt.Errorf("invalid IPv6 address %q", s.AAAA)}
+		}
+	case "nxdomain":
+		if s.A != "" || s.AAAA != "" {
+			return nil, configError{Field: "sinkhole.mode", Err: errors.New("nxdomain can't have a or aaaa")}
+		}
+		s.NXDomain = true
+	default:
+		return nil, configError{Field: "sinkhole.mode", Err: fmt.Errorf("unsupported mode %q, must be ip or nxdomain", cs.Mode)}
+	}
+	if cs.TTL != nil {
+		if *cs.TTL < 0 {
+			return nil, configError{Field: "sinkhole.ttl", Err: errors.New("must not be negative")}
+		}
+		s.TTL = *cs.TTL
+	}
+	if s.MaxClients < 0 {
+		return nil, configError{Field: "sinkhole.maxClients", Err: errors.New("must not be negative")}
+	}
+	if s.MaxClients == 0 {
+		s.MaxClients = sinkholeDefaultMaxClients
+	}
+	if cs.Log != "" {
+		f, err := sink.NewFile(cs.Rotate.fileConfig(cs.Log))
+		if err != nil {
+			return nil, configError{Field: "sinkhole.log", Err: err}
+		}
+		s.Log = f
+	}
+	return s, nil
+}
+
+// captivePortal creates the captive portal, or returns nil if it's not enabled.
+func (c *cliConfig) captivePortal(sets *builtins.SetStore) (*captivePortal, error) {
+	cp := c.Portal
+	if cp.Listen == "" {
+		return nil, nil
+	}
+	host, port, err := net.SplitHostPort(cp.Listen)
+	if err != nil {
+		return nil, configError{Field: "portal.listen", Err: err}
+	}
+	p := &captivePortal{
+		Listen:    cp.Listen,
+		URL:       cp.URL,
+		TTL:       cp.TTL,
+		Password:  cp.Password,
+		Terms:     cp.Terms,
+		KnownMACs: make(map[string]bool, len(cp.KnownMACs)),
+		ARPFile:   portalARPFile,
+		Interval:  cp.ARPInterval,
+		accepted:  make(map[string]*portalClient),
+	}
+	if p.URL == "" {
+		if host == "" || net.ParseIP(host).IsUnspecified() {
+			return nil, configError{Field: "portal.url", Err: errors.New("required when listening on all addresses")}
+		}
+		p.URL = "http://" + net.JoinHostPort(host, port) + "/"
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, configError{Field: "portal.url", Err: fmt.Errorf("invalid URL %q", p.URL)}
+	}
+	if len(cp.Clients) == 0 {
+		return nil, configError{Field: "portal.clients", Err: errors.New("required")}
+	}
+	if p.Clients, err = cidrList(cp.Clients); err != nil {
+		return nil, configError{Field: "portal.clients", Err: err}
+	}
+	allow := cp.Allow
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		// The portal itself is always allowed
+		allow = append(allow[:len(allow):len(allow)], ip.String())
+	}
+	if p.Allow, err = cidrList(allow); err != nil {
+		return nil, configError{Field: "portal.allow", Err: err}
+	}
+	if p.Set, err = ipSet(sets, cp.Set); err != nil {
+		return nil, configError{Field: "portal.set", Err: err}
+	}
+	if p.TTL < 0 {
+		return nil, configError{Field: "portal.ttl", Err: errors.New("must not be negative")}
+	}
+	if p.TTL == 0 {
+		p.TTL = portalDefaultTTL
+	}
+	if cp.TermsFile != "" {
+		if p.Terms != "" {
+			return nil, configError{Field: "portal.termsFile", Err: errors.New("only one of terms and termsFile can be set")}
+		}
+		bs, err := os.ReadFile(cp.TermsFile)
+		if err != nil {
+			return nil, configError{Field: "portal.termsFile", Err: err}
+		}
+		p.Terms = string(bs)
+	}
+	if p.Template, err = portalTemplate(cp.Template); err != nil {
+		return nil, configError{Field: "portal.template", Err: err}
+	}
+	for _, e := range cp.KnownMACs {
+		mac, err := net.ParseMAC(e)
+		if err != nil {
+			return nil, configError{Field: "portal.knownMACs", Err: err}
+		}
+		p.KnownMACs[mac.String()] = true
+	}
+	if p.Interval < 0 {
+		return nil, configError{Field: "portal.arpInterval", Err: errors.New("must not be negative")}
+	}
+	if p.Interval == 0 {
+		p.Interval = portalDefaultARPInterval
+	}
+	return p, nil
+}
+
+// strictMode creates strict mode, or returns nil if it's not enabled.
+func (c *cliConfig) strictMode(sets *builtins.SetStore) (*strictMode, error) {
+	cs := c.Strict
+	if len(cs.Allow) == 0 {
+		return nil, nil
+	}
+	s := &strictMode{Allow: cs.Allow, Grace: cs.Grace}
+	for _, name := range cs.Allow {
+		set := sets.Get(name)
+		if set == nil {
+			return nil, configError{Field: "strict.allow", Err: fmt.Errorf("set %q not found", name)}
+		}
+		if set.Type() != builtins.SetTypeDomain {
+			return nil, configError{Field: "strict.allow", Err: fmt.Errorf("set %q is not a domain set", name)}
+		}
+	}
+	for _, e := range cs.Ports {
+		p, err := parseStrictPort(e)
+		if err != nil {
+			return nil, configError{Field: "strict.ports", Err: err}
+		}
+		s.Ports = append(s.Ports, p)
+	}
+	var err error
+	if s.Exempt, err = cidrList(cs.Exempt); err != nil {
+		return nil, configError{Field: "strict.exempt", Err: err}
+	}
+	if s.Grace < 0 {
+		return nil, configError{Field: "strict.grace", Err: errors.New("must not be negative")}
+	}
+	if s.Grace == 0 {
+		s.Grace = strictDefaultGrace
+	}
+	return s, nil
+}
+
+// mlAnalyzer creates the ml analyzer, or returns nil if no model is configured.
+func (c *cliConfig) mlAnalyzer() (*ml.Analyzer, error) {
+	cm := c.ML
+	if cm.Model == "" {
+		return nil, nil
+	}
+	if cm.Packets < 0 {
+		return nil, configError{Field: "ml.packets", Err: errors.New("must not be negative")}
+	}
+	a, err := ml.NewAnalyzer(ml.Config{
+		Model:    cm.Model,
+		Features: cm.Features,
+		Packets:  cm.Packets,
+		Output:   cm.Output,
+		Labels:   cm.Labels,
+		Softmax:  cm.Softmax,
+	})
+	if err != nil {
+		return nil, configError{Field: "ml", Err: err}
+	}
+	return a, nil
+}
+
+func (c *cliConfig) relayAnalyzer() (*relay.Analyzer, error) {
+	cr := c.Relay
+	if !cr.Enabled {
+		return nil, nil
+	}
+	for _, f := range []struct {
+		Field string
+		Value int64
+	}{
+		{"relay.window", int64(cr.Window)},
+		{"relay.tolerance", int64(cr.Tolerance)},
+		{"relay.packets", int64(cr.Packets)},
+	} {
+		if f.Value < 0 {
+			return nil, configError{Field: f.Field, Err: errors.New("must not be negative")}
+		}
+	}
+	return relay.NewAnalyzer(relay.Config{
+		Window:    cr.Window,
+		Tolerance: cr.Tolerance,
+		Packets:   cr.Packets,
+	}), nil
+}
+
+// httpAnalyzer applies the options of the http analyzer to that of analyzers.
+func (c *cliConfig) httpAnalyzer() error {
+	ch := c.HTTP
+	var internal []*net.IPNet
+	if len(ch.Internal) > 0 {
+		cidrs, err := cidrList(ch.Internal)
+		if err != nil {
+			return configError{Field: "http.internal", Err: err}
+		}
+		for _, cidr := range cidrs {
+			_, n, _ := net.ParseCIDR(cidr)
+			internal = append(internal, n)
+		}
+	}
+	var cookies []string
+	for _, s := range ch.SessionCookies {
+		cookies = append(cookies, strings.ToLower(s))
+	}
+	for _, a := range analyzers {
+		if ha, ok := a.(*tcp.HTTPAnalyzer); ok {
+			ha.Credentials = ch.Credentials
+			ha.Internal = internal
+			ha.SessionCookies = cookies
+		}
+	}
+	return nil
+}
+
+// sshAnalyzer applies the options of the ssh analyzer to that of analyzers.
+func (c *cliConfig) sshAnalyzer() error {
+	cs := c.SSH
+	if cs.Packets < 0 {
+		return configError{Field: "ssh.packets", Err: errors.New("must not be negative")}
+	}
+	for _, a := range analyzers {
+		if sa, ok := a.(*tcp.SSHAnalyzer); ok {
+			sa.Tunnel = cs.Tunnel
+			sa.TunnelPackets = cs.Packets
+		}
+	}
+	return nil
+}
+
+// researchMode creates research mode without its results file, or returns nil if it's not enabled.
+func (c *cliConfig) researchMode() (*researchMode, error) {
+	cr := c.Research
+	if cr.File == "" {
+		return nil, nil
+	}
+	if c.Capture.Dir == "" {
+		return nil, configError{Field: "research", Err: errors.New("requires capture.dir, its rules use the capture action")}
+	}
+	r := &researchMode{
+		Rules:          make(map[string]bool),
+		HandshakeBytes: cr.HandshakeBytes,
+		Window:         cr.Window,
+		Delay:          cr.Delay,
+		Timeout:        cr.Timeout,
+		Cooldown:       cr.Cooldown,
+		MaxConcurrent:  cr.MaxConcurrent,
+		streams:        make(map[string]*researchStream),
+		probed:         make(map[string]time.Time),
+		local:          make(map[string]bool),
+	}
+	for _, name := range cr.Rules {
+		r.Rules[name] = true
+	}
+	for _, f := range []struct {
+		field string
+		value int64
+	}{
+		{"research.handshakeBytes", int64(cr.HandshakeBytes)},
+		{"research.window", int64(cr.Window)},
+		{"research.delay", int64(cr.Delay)},
+		{"research.timeout", int64(cr.Timeout)},
+		{"research.cooldown", int64(cr.Cooldown)},
+		{"research.maxConcurrent", int64(cr.MaxConcurrent)},
+	} {
+		if f.value < 0 {
+			return nil, configError{Field: f.field, Err: errors.New("must not be negative")}
+		}
+	}
+	if r.HandshakeBytes == 0 {
+		r.HandshakeBytes = researchDefaultHandshakeBytes
+	}
+	if r.Window == 0 {
+		r.Window = researchDefaultWindow
+	}
+	if r.Timeout == 0 {
+		r.Timeout = researchDefaultTimeout
+	}
+	if r.Cooldown == 0 {
+		r.Cooldown = researchDefaultCooldown
+	}
+	if r.MaxConcurrent == 0 {
+		r.MaxConcurrent = researchDefaultMaxConcurrent
+	}
+	names := make(map[string]bool)
+	for i, cp := range cr.Probes {
+		p, err := parseResearchProbe(cp)
+		if err != nil {
+			return nil, configError{Field: fmt.Sprintf("research.probes[%d]", i), Err: err}
+		}
+		if names[p.Name] {
+			return nil, configError{Field: fmt.Sprintf("research.probes[%d].name", i), Err: fmt.Errorf("duplicate name %q", p.Name)}
+		}
+		names[p.Name] = true
+		r.Probes = append(r.Probes, p)
+	}
+	if cr.Source != "" {
+		if r.Source = net.ParseIP(cr.Source); r.Source == nil {
+			return nil, configError{Field: "research.source", Err: fmt.Errorf("invalid IP address %q", cr.Source)}
+		}
+	}
+	ios, _, err := c.ioInstances()
+	if err != nil {
+		return nil, err
+	}
+	for _, ci := range ios {
+		if ci.Local && ci.Type != "pcap" {
+			// Not to queue the packets of the probes
+			r.Mark = io.BypassMark
+		}
+	}
+	r.sem = make(chan struct{}, r.MaxConcurrent)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	return r, nil
+}
+
+// usageStore creates the store of the usage counters, loaded from their file if set.
+func (c *cliConfig) usageStore() (*usageStore, error) {
+	ca := c.Accounting
+	if ca.Retention < 0 {
+		return nil, configError{Field: "accounting.retention", Err: errors.New("must not be negative")}
+	}
+	if ca.Interval < 0 {
+		return nil, configError{Field: "accounting.interval", Err: errors.New("must not be negative")}
+	}
+	if ca.Apps && !ca.Enabled {
+		return nil, configError{Field: "accounting.apps", Err: errors.New("requires enabled")}
+	}
+	s := &usageStore{
+		Usage:    builtins.NewUsage(ca.Retention),
+		File:     ca.File,
+		Interval: ca.Interval,
+	}
+	if s.Interval == 0 {
+		s.Interval = accountingDefaultInterval
+	}
+	if err := s.Load(); err != nil {
+		return nil, configError{Field: "accounting.file", Err: err}
+	}
+	return s, nil
+}
+
+// cidrList normalizes a list of IPs & CIDRs to CIDRs, IPs becoming /32 or /128.
+func cidrList(entries []string) ([]string, error) {
+	var cidrs []string
+	for _, e := range entries {
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidrs = append(cidrs, fmt.Sprintf("%s/%d", ip, bits))
+		} else if _, n, err := net.ParseCIDR(e); err == nil {
+			cidrs = append(cidrs, n.String())
+		} else {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", e)
+		}
+	}
+	return cidrs, nil
+}
+
+// ipSet returns the named IP set.
+func ipSet(sets *builtins.SetStore, name string) (*builtins.Set, error) {
+	if name == "" {
+		return nil, errors.New("required")
+	}
+	set := sets.Get(name)
+	if set == nil {
+		return nil, fmt.Errorf("set %q not found", name)
+	}
+	if set.Type() != builtins.SetTypeIP {
+		return nil, fmt.Errorf("set %q is not an ip set", name)
+	}
+	return set, nil
+}
+
+// degradeMonitor creates the monitor of the engine's load, or returns nil if it's not enabled.
+func (c *cliConfig) degradeMonitor(en engine.Engine) (*degradeMonitor, error) {
+	d := c.Degrade
+	if d.Latency == 0 && d.Backlog == 0 {
+		return nil, nil
+	}
+	if d.Latency < 0 {
+		return nil, configError{Field: "degrade.latency", Err: errors.New("must not be negative")}
+	}
+	if d.Backlog < 0 || d.Backlog > 1 {
+		return nil, configError{Field: "degrade.backlog", Err: errors.New("must be between 0 and 1")}
+	}
+	if d.Interval < 0 || d.Recover < 0 {
+		return nil, configError{Field: "degrade", Err: errors.New("interval and recover must not be negative")}
+	}
+	if d.Sample < 0 || d.Sample > 1 {
+		return nil, configError{Field: "degrade.sample", Err: errors.New("must be between 0 and 1")}
+	}
+	for _, name := range d.SkipAnalyzers {
+		found := false
+		for _, a := range analyzers {
+			found = found || a.Name() == name
+		}
+		if !found {
+			return nil, configError{Field: "degrade.skipAnalyzers", Err: fmt.Errorf("unknown analyzer %q", name)}
+		}
+	}
+	m := &degradeMonitor{
+		Engine:        en,
+		Latency:       d.Latency,
+		Backlog:       d.Backlog,
+		Interval:      d.Interval,
+		Recover:       d.Recover,
+		SkipAnalyzers: d.SkipAnalyzers,
+		Sample:        d.Sample,
+	}
+	if m.Interval == 0 {
+		m.Interval = degradeDefaultInterval
+	}
+	if m.Recover == 0 {
+		m.Recover = degradeDefaultRecover
+	}
+	if m.Sample == 0 {
+		m.Sample = degradeDefaultSample
+	}
+	return m, nil
+}
+
+// webhook creates the webhook for notify rules, or returns nil if it's not configured.
+func (c *cliConfig) webhook() (*ruleset.Webhook, error) {
+	if c.Webhook.URL == "" {
+		return nil, nil
+	}
+	w, err := ruleset.NewWebhook(ruleset.WebhookConfig{
+		URL:        c.Webhook.URL,
+		Headers:    c.Webhook.Headers,
+		Timeout:    c.Webhook.Timeout,
+		Retries:    c.Webhook.Retries,
+		RetryDelay: c.Webhook.RetryDelay,
+		RateLimit:  c.Webhook.RateLimit,
+		Burst:      c.Webhook.Burst,
+		QueueSize:  c.Webhook.QueueSize,
+		ErrorFunc: func(ev ruleset.NotifyEvent, err error) {
+			logger.Error("webhook error",
+				zap.String("name", ev.Rule),
+				zap.Int64("id", ev.ID),
+				zap.String("uuid", ev.UUID),
+				zap.Error(err))
+		},
+	})
+	if err != nil {
+		return nil, configError{Field: "webhook", Err: err}
+	}
+	return w, nil
+}
+
+// eventLog creates the event log with the eve file & sinks, or returns nil if none is configured.
+func (c *cliConfig) eventLog() (*eventLog, error) {
+	l := &eventLog{}
+	closeAll := func() {
+		_ = l.Close()
+	}
+	if c.Eve.File != "" {
+		f, err := sink.NewFile(c.Eve.Rotate.fileConfig(c.Eve.File))
+		if err != nil {
+			return nil, configError{Field: "eve", Err: err}
+		}
+		o, err := newEventOutput(f, c.Eve.cliConfigEventRoute, "none")
+		if err != nil {
+			_ = f.Close()
+			return nil, configError{Field: "eve", Err: err}
+		}
+		o.Name = "eve.file"
+		l.Outputs = append(l.Outputs, o)
+	}
+	for i, cs := range c.Sinks {
+		field := fmt.Sprintf("sinks[%d]", i)
+		s, err := cs.sink(field)
+		if err != nil {
+			closeAll()
+			return nil, configError{Field: field, Err: err}
+		}
+		o, err := newEventOutput(s, cs.cliConfigEventRoute, cs.Key)
+		if err != nil {
+			_ = s.Close()
+			closeAll()
+			return nil, configError{Field: field, Err: err}
+		}
+		o.Name = field
+		l.Outputs = append(l.Outputs, o)
+	}
+	if c.API.Listen != "" && c.API.Dashboard {
+		// Recent alerts for the dashboard
+		o, _ := newEventOutput(newEventRing(dashboardAlerts), cliConfigEventRoute{Types: []string{"alert"}}, "none")
+		l.Outputs = append(l.Outputs, o)
+	}
+	if c.GRPC.Listen != "" {
+		// For the gRPC subscribers
+		o, _ := newEventOutput(newEventHub(), cliConfigEventRoute{}, "none")
+		l.Outputs = append(l.Outputs, o)
+	}
+	if len(l.Outputs) == 0 {
+		return nil, nil
+	}
+	if c.Alerts.Window < 0 {
+		closeAll()
+		return nil, configError{Field: "alerts.window", Err: errors.New("must not be negative")}
+	} else if c.Alerts.Window > 0 {
+		l.Alerts = newAlertAggregator(c.Alerts.Window, func(r *eveRecord) {
+			l.send(r, time.Now())
+		})
+	}
+	return l, nil
+}
+
+var kafkaAcksMap = map[string]int16{
+	"":       sink.KafkaAcksAll,
+	"all":    sink.KafkaAcksAll,
+	"leader": sink.KafkaAcksLeader,
+	"none":   sink.KafkaAcksNone,
+}
+
+// check validates the fields that are not checked by the sink itself, without creating it.
+func (c *cliConfigSink) check() error {
+	switch c.Type {
+	case "kafka":
+		if _, ok := kafkaAcksMap[c.Acks]; !ok {
+			return fmt.Errorf("invalid acks %q", c.Acks)
+		}
+	case "syslog":
+		if c.Facility != "" {
+			if _, ok := sink.ParseSyslogFacility(c.Facility); !ok {
+				return fmt.Errorf("invalid facility %q", c.Facility)
+			}
+		}
+		if c.Framing != "" && c.Framing != "octet" && c.Framing != "newline" {
+			return fmt.Errorf("invalid framing %q", c.Framing)
+		}
+	case "nats", "elasticsearch", "clickhouse":
+	default:
+		return fmt.Errorf("unsupported sink type %q", c.Type)
+	}
+	return nil
+}
+
+func (c *cliConfigSink) sink(name string) (sink.Sink, error) {
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := c.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	typ := c.Type
+	batch := sink.BatchConfig{
+		Size:       c.BatchSize,
+		Timeout:    c.BatchTimeout,
+		QueueSize:  c.QueueSize,
+		Block:      c.Block,
+		Retries:    c.Retries,
+		RetryDelay: c.RetryDelay,
+		ErrorFunc: func(err error) {
+			logger.Error("event sink error",
+				zap.String("sink", name),
+				zap.String("type", typ),
+				zap.Error(err))
+		},
+	}
+	switch c.Type {
+	case "kafka":
+		return sink.NewKafka(sink.KafkaConfig{
+			Brokers:  c.Brokers,
+			Topic:    c.Topic,
+			Acks:     kafkaAcksMap[c.Acks],
+			Timeout:  c.Timeout,
+			TLS:      tlsConfig,
+			Username: c.Username,
+			Password: c.Password,
+			Batch:    batch,
+		})
+	case "nats":
+		return sink.NewNATS(sink.NATSConfig{
+			Servers:  c.Servers,
+			Subject:  c.Subject,
+			Token:    c.Token,
+			Username: c.Username,
+			Password: c.Password,
+			TLS:      tlsConfig,
+			Timeout:  c.Timeout,
+			Batch:    batch,
+		})
+	case "syslog":
+		network := c.Network
+		if network == "" {
+			network = "udp"
+			if tlsConfig != nil {
+				network = "tcp"
+			}
+		}
+		facility := 16 // local0
+		if c.Facility != "" {
+			facility, _ = sink.ParseSyslogFacility(c.Facility)
+		}
+		return sink.NewSyslog(sink.SyslogConfig{
+			Network:        network,
+			Addr:           c.Addr,
+			TLS:            tlsConfig,
+			NewlineFraming: c.Framing == "newline",
+			Facility:       facility,
+			Hostname:       c.Hostname,
+			AppName:        c.AppName,
+			Timeout:        c.Timeout,
+			Batch:          batch,
+		})
+	case "elasticsearch":
+		return sink.NewElasticsearch(sink.ElasticsearchConfig{
+			URL:      c.URL,
+			Index:    c.Index,
+			Username: c.Username,
+			Password: c.Password,
+			APIKey:   c.APIKey,
+			TLS:      tlsConfig,
+			Timeout:  c.Timeout,
+			Mappings: eveElasticsearchMappings,
+			Batch:    batch,
+		})
+	case "clickhouse":
+		engine := eveClickHouseEngine
+		if c.TTL > 0 {
+			engine += fmt.Sprintf(" TTL toDateTime(timestamp) + INTERVAL %d SECOND", int64(c.TTL.Seconds()))
+		}
+		return sink.NewClickHouse(sink.ClickHouseConfig{
+			URL:      c.URL,
+			Database: c.Database,
+			Table:    c.Table,
+			Username: c.Username,
+			Password: c.Password,
+			TLS:      tlsConfig,
+			Timeout:  c.Timeout,
+			Columns:  eveClickHouseColumns,
+			Engine:   engine,
+			Batch:    batch,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported sink type %q", c.Type)
+	}
+}
+
+// sets creates the named sets with their initial entries.
+func (c *cliConfig) sets() (*builtins.SetStore, error) {
+	store, _, err := c.loadSets()
+	return store, err
+}
+
+// loadSets is sets, also returning the digests of the files fetched from http(s):// URLs, by set name.
+func (c *cliConfig) loadSets() (*builtins.SetStore, map[string][32]byte, error) {
+	var sets []*builtins.Set
+	seen := make(map[string]bool)
+	digests := make(map[string][32]byte)
+	for _, cs := range c.Sets {
+		if cs.Name == "" || seen[cs.Name] {
+			return nil, nil, configError{Field: "sets", Err: fmt.Errorf("missing or duplicate set name %q", cs.Name)}
+		}
+		seen[cs.Name] = true
+		typ, ok := builtins.ParseSetType(cs.Type)
+		if !ok {
+			return nil, nil, configError{Field: "sets", Err: fmt.Errorf("set %q has invalid type %q", cs.Name, cs.Type)}
+		}
+		set := builtins.NewSet(cs.Name, typ)
+		entries := cs.Entries
+		if cs.File != "" {
+			fileEntries, digest, err := c.readSetFile(cs)
+			if err != nil {
+				return nil, nil, configError{Field: "sets", Err: err}
+			}
+			if ruleset.IsRemoteSource(cs.File) {
+				digests[cs.Name] = digest
+			}
+			entries = append(entries, fileEntries...)
+		}
+		if err := set.Add(entries, 0); err != nil {
+			return nil, nil, configError{Field: "sets", Err: fmt.Errorf("set %q: %w", cs.Name, err)}
+		}
+		sets = append(sets, set)
+	}
+	return builtins.NewSetStore(sets...), digests, nil
+}
+
+// readSetFile reads the entries of the file of a set, fetching it if it's an http(s):// URL.
+// The digest is only set for fetched files.
+func (c *cliConfig) readSetFile(cs cliConfigSet) ([]string, [32]byte, error) {
+	var digest [32]byte
+	if !ruleset.IsRemoteSource(cs.File) {
+		entries, err := builtins.ReadListFile(cs.File, cs.Format)
+		return entries, digest, err
+	}
+	data, digest, err := ruleset.FetchRemote(cs.File, ruleset.RemoteConfig{
+		ChecksumURL:  cs.ChecksumURL,
+		PublicKey:    cs.PublicKey,
+		SignatureURL: cs.SignatureURL,
+		Timeout:      c.Ruleset.Remote.Timeout,
+	})
+	if err != nil {
+		return nil, digest, fmt.Errorf("%s: %w", cs.File, err)
+	}
+	entries, err := builtins.ParseList(bytes.NewReader(data), cs.Format)
+	if err != nil {
+		return nil, digest, fmt.Errorf("%s: %w", cs.File, err)
+	}
+	return entries, digest, nil
+}
+
+// refreshSets fetches the files of the sets from http(s):// URLs again, replacing the entries of
+// the sets whose file changed (including those added at runtime). digests is updated in place.
+func (c *cliConfig) refreshSets(sets *builtins.SetStore, digests map[string][32]byte) {
+	for _, cs := range c.Sets {
+		if !ruleset.IsRemoteSource(cs.File) {
+			continue
+		}
+		set := sets.Get(cs.Name)
+		fileEntries, digest, err := c.readSetFile(cs)
+		if err != nil {
+			logger.Error("failed to update remote set, using old entries", zap.String("set", cs.Name), zap.Error(err))
+			continue
+		}
+		if digest == digests[cs.Name] {
+			logger.Debug("remote set unchanged", zap.String("set", cs.Name))
+			continue
+		}
+		entries := append(append([]string(nil), cs.Entries...), fileEntries...)
+		if err := set.Replace(entries); err != nil {
+			logger.Error("failed to update remote set, using old entries", zap.String("set", cs.Name), zap.Error(err))
+			continue
+		}
+		digests[cs.Name] = digest
+		logger.Info("remote set updated", zap.String("set", cs.Name), zap.Int("entries", set.Len()))
+	}
+}
+
+// blockFeed returns the feed of the blocked IPs & domains, nil if neither the API nor the file export is enabled.
+func (c *cliConfig) blockFeed(sets *builtins.SetStore) (*blockFeed, error) {
+	if c.API.Listen == "" && c.Blocked.File == "" {
+		return nil, nil
+	}
+	if c.Blocked.TTL < 0 || c.Blocked.MaxEntries < 0 || c.Blocked.Interval < 0 {
+		return nil, configError{Field: "blocked", Err: errors.New("ttl, maxEntries and interval must not be negative")}
+	}
+	if c.Blocked.Format == "" {
+		c.Blocked.Format = "plain"
+	}
+	if _, ok := blockFeedFormats[c.Blocked.Format]; !ok {
+		return nil, configError{Field: "blocked.format", Err: fmt.Errorf("unsupported format %q", c.Blocked.Format)}
+	}
+	if c.Blocked.Interval == 0 {
+		c.Blocked.Interval = blockFeedDefaultInterval
+	}
+	var feedSets []*builtins.Set
+	for _, name := range c.Blocked.Sets {
+		set := sets.Get(name)
+		if set == nil {
+			return nil, configError{Field: "blocked.sets", Err: fmt.Errorf("set %q not found", name)}
+		}
+		if set.Type() != builtins.SetTypeIP && set.Type() != builtins.SetTypeDomain {
+			return nil, configError{Field: "blocked.sets", Err: fmt.Errorf("set %q is not an ip or domain set", name)}
+		}
+		feedSets = append(feedSets, set)
+	}
+	return newBlockFeed(c.Blocked.TTL, c.Blocked.MaxEntries, feedSets, c.Blocked.NFTTable), nil
+}
+
+// shapingClasses returns the class name -> mark map for the ruleset.
+func (c *cliConfig) shapingClasses() (map[string]uint32, error) {
+	classes := make(map[string]uint32, len(c.Shaping.Classes))
+	for _, cls := range c.Shaping.Classes {
+		if cls.Mark == 0 || cls.Mark > io.MaxMark {
+			return nil, configError{Field: "shaping.classes", Err: fmt.Errorf("class %q has invalid mark %d", cls.Name, cls.Mark)}
+		}
+		classes[cls.Name] = cls.Mark
+	}
+	return classes, nil
+}
+
+// setupShaping programs the tc classes if a shaping device is configured.
+func (c *cliConfig) setupShaping() error {
+	if c.Shaping.Device == "" {
+		return nil
+	}
+	tcConfig := io.TCShapingConfig{
+		Device: c.Shaping.Device,
+		Rate:   c.Shaping.Rate,
+	}
+	for _, cls := range c.Shaping.Classes {
+		tcConfig.Classes = append(tcConfig.Classes, io.TCShapingClass{
+			Mark: cls.Mark,
+			Rate: cls.Rate,
+			Ceil: cls.Ceil,
+		})
+	}
+	if err := io.SetupTCShaping(tcConfig); err != nil {
+		return configError{Field: "shaping", Err: err}
+	}
+	return nil
+}
+
+func (c *cliConfig) remoteConfig() ruleset.RemoteConfig {
+	return ruleset.RemoteConfig{
+		ChecksumURL:  c.Ruleset.Remote.ChecksumURL,
+		PublicKey:    c.Ruleset.Remote.PublicKey,
+		SignatureURL: c.Ruleset.Remote.SignatureURL,
+		Timeout:      c.Ruleset.Remote.Timeout,
+	}
+}
+
+// rulesetSelectors validates the ruleset selectors and parses their subnets.
+// The Ruleset fields of the returned selectors are left for the caller to fill.
+func (c *cliConfig) rulesetSelectors() ([]ruleset.RulesetSelector, error) {
+	var selectors []ruleset.RulesetSelector
+	seen := make(map[string]bool)
+	for _, cs := range c.Ruleset.Selectors {
+		if cs.Name == "" || seen[cs.Name] {
+			return nil, configError{Field: "ruleset.selectors", Err: fmt.Errorf("missing or duplicate selector name %q", cs.Name)}
+		}
+		seen[cs.Name] = true
+		if cs.Rules == "" {
+			return nil, configError{Field: "ruleset.selectors", Err: fmt.Errorf("selector %q has no rules", cs.Name)}
+		}
+		if len(cs.Subnets) == 0 && len(cs.Interfaces) == 0 && len(cs.IOs) == 0 {
+			return nil, configError{Field: "ruleset.selectors", Err: fmt.Errorf("selector %q must have at least one of subnets, interfaces or ios", cs.Name)}
+		}
+		s := ruleset.RulesetSelector{
+			Name:       cs.Name,
+			Interfaces: cs.Interfaces,
+			IOs:        cs.IOs,
+		}
+		for _, subnet := range cs.Subnets {
+			_, ipNet, err := net.ParseCIDR(subnet)
+			if err != nil {
+				ip := net.ParseIP(subnet)
+				if ip == nil {
+					return nil, configError{Field: "ruleset.selectors", Err: fmt.Errorf("selector %q has invalid subnet %q", cs.Name, subnet)}
+				}
+				bits := 8 * len(ip.To16())
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 32
+				}
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			}
+			s.Subnets = append(s.Subnets, ipNet)
+		}
+		selectors = append(selectors, s)
+	}
+	return selectors, nil
+}
+
+// loadRules loads the raw rules from either a local file or a remote URL.
+// For local files, the returned digest is always zero.
+func (c *cliConfig) loadRules(source string) ([]ruleset.ExprRule, [32]byte, error) {
+	if ruleset.IsRemoteSource(source) {
+		return ruleset.ExprRulesFromURL(source, c.remoteConfig())
+	}
+	rules, err := ruleset.ExprRulesFromYAML(source)
+	return rules, [32]byte{}, err
+}
+
+func (c *cliConfig) fillLogger(config *engine.Config) error {
+	geo, err := c.geoIP()
+	if err != nil {
+		return err
+	}
+	events, err := c.eventLog()
+	if err != nil {
+		return err
+	}
+	if events != nil {
+		events.GeoIP = geo
+	}
+	var conns *connLog
+	if c.ConnLog.File != "" {
+		conns, err = newConnLog(c.ConnLog.Rotate.fileConfig(c.ConnLog.File))
+		if err != nil {
+			_ = events.Close()
+			return configError{Field: "connLog", Err: err}
+		}
+		conns.GeoIP = geo
+	}
+	config.Logger = &engineLogger{Events: events, Conns: conns}
+	return nil
+}
+
+func (c *cliConfig) fillIO(config *engine.Config) error {
+	ios, fields, err := c.ioInstances()
+	if err != nil {
+		return err
+	}
+	_, dscp, err := c.qosClasses()
+	if err != nil {
+		return err
+	}
+	for i, ci := range ios {
+		pio, err := ci.packetIO(dscp)
+		if err != nil {
+			for _, created := range config.IOs {
+				_ = created.Close()
+			}
+			config.IOs, config.IONames = nil, nil
+			return configError{Field: fields[i], Err: err}
+		}
+		config.IOs = append(config.IOs, pio)
+		config.IONames = append(config.IONames, ci.Name)
+	}
+	return nil
+}
+
+// ioInstances validates the IO instances, from io or ios, and returns them with their config fields.
+func (c *cliConfig) ioInstances() ([]cliConfigIO, []string, error) {
+	if len(c.IOs) == 0 {
+		return []cliConfigIO{c.IO}, []string{"io"}, nil
+	}
+	if c.IO != (cliConfigIO{}) {
+		return nil, nil, configError{Field: "io", Err: errors.New("must not be set with ios")}
+	}
+	fields := make([]string, len(c.IOs))
+	names := make(map[string]bool)
+	queueNums := make(map[uint16]bool)
+	tables := make(map[string]bool)
+	for i, ci := range c.IOs {
+		fields[i] = fmt.Sprintf("ios[%d]", i)
+		if ci.Name == "" || names[ci.Name] {
+			return nil, nil, configError{Field: fields[i] + ".name", Err: fmt.Errorf("missing or duplicate name %q", ci.Name)}
+		}
+		names[ci.Name] = true
+		if ci.Type != "" && ci.Type != "nfqueue" {
+			continue
+		}
+		// Same defaults as the nfqueue IO
+		queueNum, table := ci.QueueNum, ci.Table
+		if queueNum == 0 {
+			queueNum = 100
+		}
+		if table == "" {
+			table = "opengfw"
+		}
+		if queueNums[queueNum] {
+			return nil, nil, configError{Field: fields[i] + ".queueNum", Err: fmt.Errorf("queue %d used by another instance", queueNum)}
+		}
+		if tables[table] {
+			return nil, nil, configError{Field: fields[i] + ".table", Err: fmt.Errorf("table %q used by another instance", table)}
+		}
+		queueNums[queueNum], tables[table] = true, true
+	}
+	return c.IOs, fields, nil
+}
+
+// honeypotEnabled returns whether any IO instance redirects streams to a honeypot.
+func (c *cliConfig) honeypotEnabled() bool {
+	ios, _, _ := c.ioInstances()
+	for _, ci := range ios {
+		if ci.Honeypot.Address != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// nat64 creates the NAT64 address mapping of the rules, or returns nil if it's not enabled.
+func (c *cliConfig) nat64() (*builtins.NAT64, error) {
+	if !c.NAT64.Enabled {
+		return nil, nil
+	}
+	if c.NAT64.MaxDomains < 0 {
+		return nil, configError{Field: "nat64.maxDomains", Err: errors.New("must not be negative")}
+	}
+	n, err := builtins.NewNAT64(c.NAT64.Prefixes, c.NAT64.MaxDomains)
+	if err != nil {
+		return nil, configError{Field: "nat64.prefixes", Err: err}
+	}
+	return n, nil
+}
+
+// localEnabled returns whether any IO instance is in local mode, filtering the traffic of this host.
+func (c *cliConfig) localEnabled() bool {
+	ios, _, _ := c.ioInstances()
+	for _, ci := range ios {
+		if ci.Local {
+			return true
+		}
+	}
+	return false
+}
+
+// divertEnabled returns whether any IO instance diverts streams.
+func (c *cliConfig) divertEnabled() bool {
+	ios, _, _ := c.ioInstances()
+	for _, ci := range ios {
+		if ci.Divert.Port != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (ci *cliConfigIO) check() error {
+	switch ci.Type {
+	case "", "nfqueue":
+		_, err := ci.honeypot()
+		return err
+	case "pcap":
+		if (ci.File == "") == (ci.Interface == "") {
+			return errors.New("exactly one of file or interface is required")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %q", ci.Type)
+	}
+}
+
+// honeypot parses the honeypot address, if any.
+func (ci *cliConfigIO) honeypot() (io.HoneypotConfig, error) {
+	h := io.HoneypotConfig{Timeout: ci.Honeypot.Timeout}
+	if ci.Honeypot.Address == "" {
+		return h, nil
+	}
+	host, port, err := net.SplitHostPort(ci.Honeypot.Address)
+	if err != nil {
+		// No port
+		host, port = ci.Honeypot.Address, ""
+	}
+	h.Addr = net.ParseIP(strings.Trim(host, "[]"))
+	if h.Addr == nil {
+		return h, fmt.Errorf("invalid honeypot address %q, must be an IP", ci.Honeypot.Address)
+	}
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return h, fmt.Errorf("invalid honeypot port %q", port)
+		}
+		h.Port = uint16(p)
+	}
+	return h, nil
+}
+
+func (ci *cliConfigIO) packetIO(dscp []io.DSCPMark) (io.PacketIO, error) {
+	if err := ci.check(); err != nil {
+		return nil, err
+	}
+	if ci.Type == "pcap" {
+		return io.NewPcapPacketIO(io.PcapPacketIOConfig{
+			PcapFile:  ci.File,
+			Realtime:  ci.Realtime,
+			Interface: ci.Interface,
+		})
+	}
+	honeypot, err := ci.honeypot()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewNFQueuePacketIO(io.NFQueuePacketIOConfig{
+		QueueNum:    ci.QueueNum,
+		Table:       ci.Table,
+		QueueSize:   ci.QueueSize,
+		FailOpen:    ci.FailOpen,
+		ReadBuffer:  ci.ReadBuffer,
+		WriteBuffer: ci.WriteBuffer,
+		Local:       ci.Local,
+		RST:         ci.RST,
+		Divert: io.DivertConfig{
+			Port:    ci.Divert.Port,
+			Timeout: ci.Divert.Timeout,
+		},
+		Honeypot: honeypot,
+		DSCP:     dscp,
+	})
+}
+
+func (c *cliConfig) fillWorkers(config *engine.Config) error {
+	config.Workers = c.Workers.Count
+	config.WorkerQueueSize = c.Workers.QueueSize
+	config.WorkerTCPMaxBufferedPagesTotal = c.Workers.TCPMaxBufferedPagesTotal
+	config.WorkerTCPMaxBufferedPagesPerConn = c.Workers.TCPMaxBufferedPagesPerConn
+	config.WorkerUDPMaxStreams = c.Workers.UDPMaxStreams
+	config.WorkerSCTPMaxStreams = c.Workers.SCTPMaxStreams
+	config.WorkerICMPMaxStreams = c.Workers.ICMPMaxStreams
+	config.MaxHeldPackets = c.Workers.MaxHeldPackets
+	config.MaxHeldPacketsPerStream = c.Workers.MaxHeldPacketsPerStream
+	config.StreamIdleTimeout = c.Workers.IdleTimeout
+	config.DrainTimeout = c.Workers.DrainTimeout
+	if config.StreamIdleTimeout == 0 && c.ConnLog.File != "" {
+		config.StreamIdleTimeout = defaultConnLogIdleTimeout
+	}
+	return nil
+}
+
+// Config validates the fields and returns a ready-to-use engine config.
+// This does not include the ruleset.
+func (c *cliConfig) fillVerdict(config *engine.Config) error {
+	var ok bool
+	config.UnmatchedVerdict, ok = defaultVerdictStringToVerdict(c.Verdict.Unmatched)
+	if !ok {
+		return configError{Field: "verdict.unmatched", Err: fmt.Errorf("invalid verdict %q", c.Verdict.Unmatched)}
+	}
+	config.UnclassifiedVerdict, ok = defaultVerdictStringToVerdict(c.Verdict.Unclassified)
+	if !ok {
+		return configError{Field: "verdict.unclassified", Err: fmt.Errorf("invalid verdict %q", c.Verdict.Unclassified)}
+	}
+	if len(c.Strict.Allow) > 0 {
+		// Otherwise the streams no rule matches once analyzed would escape strict mode
+		if c.Verdict.Unmatched == "" {
+			config.UnmatchedVerdict = engine.DefaultVerdictDrop
+		} else if config.UnmatchedVerdict != engine.DefaultVerdictDrop {
+			return configError{Field: "verdict.unmatched", Err: errors.New("must be drop in strict mode")}
+		}
+		if c.Verdict.Unclassified == "" {
+			config.UnclassifiedVerdict = engine.DefaultVerdictDrop
+		} else if config.UnclassifiedVerdict != engine.DefaultVerdictDrop {
+			return configError{Field: "verdict.unclassified", Err: errors.New("must be drop in strict mode")}
+		}
+	}
+	config.IDSOnly = c.Verdict.IDSOnly
+	return nil
+}
+
+func (c *cliConfig) fillIPv6(config *engine.Config) error {
+	if c.IPv6.MaxExtHeaders == 0 && len(c.IPv6.ForbidExtHeaders) == 0 && !c.IPv6.Strict {
+		return nil
+	}
+	if c.IPv6.MaxExtHeaders < 0 {
+		return configError{Field: "ipv6.maxExtHeaders", Err: errors.New("must not be negative")}
+	}
+	policy := &engine.IPv6ExtPolicy{
+		MaxHeaders: c.IPv6.MaxExtHeaders,
+		Strict:     c.IPv6.Strict,
+		LogOnly:    c.IPv6.LogOnly,
+	}
+	for _, name := range c.IPv6.ForbidExtHeaders {
+		types, err := engine.IPv6ExtHeaderTypes(strings.ToLower(name))
+		if err != nil {
+			return configError{Field: "ipv6.forbidExtHeaders", Err: err}
+		}
+		policy.Forbidden = append(policy.Forbidden, types...)
+	}
+	config.IPv6Ext = policy
+	return nil
+}
+
+func (c *cliConfig) fillEvasion(config *engine.Config) error {
+	policy := &engine.TCPEvasionPolicy{TTLDelta: c.Evasion.TTLDelta}
+	for _, a := range []struct {
+		Field  string
+		Value  string
+		Action *engine.EvasionAction
+	}{
+		{"evasion.badChecksum", c.Evasion.BadChecksum, &policy.BadChecksum},
+		{"evasion.lowTTL", c.Evasion.LowTTL, &policy.LowTTL},
+		{"evasion.overlap", c.Evasion.Overlap, &policy.Overlap},
+	} {
+		var ok bool
+		*a.Action, ok = evasionActionStringToAction(a.Value)
+		if !ok {
+			return configError{Field: a.Field, Err: fmt.Errorf("invalid action %q", a.Value)}
+		}
+	}
+	if policy.BadChecksum != engine.EvasionActionNone || policy.LowTTL != engine.EvasionActionNone ||
+		policy.Overlap != engine.EvasionActionNone {
+		config.TCPEvasion = policy
+	}
+	return nil
+}
+
+func (c *cliConfig) fillRouting(config *engine.Config) error {
+	config.ExternalInterfaces = c.Routing.External
+	if c.Routing.Packets < 0 {
+		return configError{Field: "routing.packets", Err: errors.New("must not be negative")}
+	}
+	policy := &engine.AsymmetricPolicy{Packets: c.Routing.Packets}
+	switch strings.ToLower(c.Routing.Asymmetric) {
+	case "", "none":
+		return nil
+	case "analyze":
+		policy.Verdict = engine.AsymmetricVerdictAnalyze
+	case "accept":
+		policy.Verdict = engine.AsymmetricVerdictAccept
+	case "drop":
+		policy.Verdict = engine.AsymmetricVerdictDrop
+	default:
+		return configError{Field: "routing.asymmetric", Err: fmt.Errorf("invalid verdict %q", c.Routing.Asymmetric)}
+	}
+	if policy.Packets == 0 {
+		policy.Packets = routingDefaultPackets
+	}
+	config.Asymmetric = policy
+	return nil
+}
+
+func evasionActionStringToAction(s string) (engine.EvasionAction, bool) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return engine.EvasionActionNone, true
+	case "log":
+		return engine.EvasionActionLog, true
+	case "ignore":
+		return engine.EvasionActionIgnore, true
+	case "drop":
+		return engine.EvasionActionDrop, true
+	default:
+		return 0, false
+	}
+}
+
+func (c *cliConfig) fillCapture(config *engine.Config) error {
+	if c.Capture.Dir == "" {
+		return nil
+	}
+	w, err := io.NewPcapWriter(io.PcapWriterConfig{
+		Dir:      c.Capture.Dir,
+		Prefix:   c.Capture.Prefix,
+		MaxSize:  c.Capture.MaxSize * 1024 * 1024,
+		Interval: c.Capture.Interval,
+		MaxFiles: c.Capture.MaxFiles,
+		MaxAge:   c.Capture.MaxAge,
+		Compress: c.Capture.Compress,
+		Format:   c.Capture.Format,
+	})
+	if err != nil {
+		return configError{Field: "capture", Err: err}
+	}
+	config.Capturer = w
+	config.CaptureLookback = c.Capture.Lookback
+	return nil
+}
+
+func (c *cliConfig) fillMirror(config *engine.Config) error {
+	if c.Mirror.Type == "" {
+		return nil
+	}
+	mConfig := io.PacketMirrorConfig{
+		Type:      c.Mirror.Type,
+		Interface: c.Mirror.Interface,
+		Remote:    c.Mirror.Remote,
+		VNI:       c.Mirror.VNI,
+	}
+	if c.Mirror.DstMAC != "" {
+		mac, err := net.ParseMAC(c.Mirror.DstMAC)
+		if err != nil {
+			return configError{Field: "mirror.dstMAC", Err: err}
+		}
+		mConfig.DstMAC = mac
+	}
+	m, err := io.NewPacketMirror(mConfig)
+	if err != nil {
+		return configError{Field: "mirror", Err: err}
+	}
+	config.Mirror = m
+	return nil
+}
+
+func (c *cliConfig) fillHAR(config *engine.Config) error {
+	if c.HAR.Dir == "" {
+		return nil
+	}
+	for _, f := range []struct {
+		field string
+		value int
+	}{
+		{"har.maxBody", c.HAR.MaxBody},
+		{"har.maxEntries", c.HAR.MaxEntries},
+		{"har.maxFiles", c.HAR.MaxFiles},
+		{"har.lookback", c.HAR.Lookback},
+	} {
+		if f.value < 0 {
+			return configError{Field: f.field, Err: errors.New("must not be negative")}
+		}
+	}
+	r := &harRecorder{
+		Dir:        c.HAR.Dir,
+		Prefix:     c.HAR.Prefix,
+		MaxBody:    c.HAR.MaxBody,
+		MaxEntries: c.HAR.MaxEntries,
+		MaxFiles:   c.HAR.MaxFiles,
+		streams:    make(map[string]*harStream),
+	}
+	if r.Prefix == "" {
+		r.Prefix = harDefaultPrefix
+	}
+	if r.MaxBody == 0 {
+		r.MaxBody = harDefaultMaxBody
+	}
+	if r.MaxEntries == 0 {
+		r.MaxEntries = harDefaultMaxEntries
+	}
+	lookback := c.HAR.Lookback
+	if lookback == 0 {
+		lookback = harDefaultLookback
+	}
+	config.HTTPCapturer = r
+	// Shared with capture & mirror, the requests before the match are needed
+	config.CaptureLookback = max(config.CaptureLookback, lookback)
+	return nil
+}
+
+func (c *cliConfig) fillQoS(config *engine.Config) error {
+	marks, _, err := c.qosClasses()
+	if err != nil || len(marks) == 0 {
+		return err
+	}
+	minConfidence := c.QoS.MinConfidence
+	if minConfidence < 0 || minConfidence > 1 {
+		return configError{Field: "qos.minConfidence", Err: errors.New("must be between 0 and 1")}
+	}
+	if minConfidence == 0 {
+		minConfidence = qosDefaultMinConfidence
+	}
+	apps, err := builtins.NewAppClassifier(c.Ruleset.Apps)
+	if err != nil {
+		return configError{Field: "ruleset.apps", Err: err}
+	}
+	config.QoS = &qosMarker{
+		Apps:          apps,
+		Marks:         marks,
+		MinConfidence: minConfidence,
+	}
+	return nil
+}
+
+// qosClasses validates the QoS classes, and returns the mark of each application
+// and the DSCP of the marks that have one.
+func (c *cliConfig) qosClasses() (map[string]uint32, []io.DSCPMark, error) {
+	marks := make(map[string]uint32)
+	classes := make(map[uint32]bool)
+	var dscp []io.DSCPMark
+	for i, cc := range c.QoS.Classes {
+		field := fmt.Sprintf("qos.classes[%d]", i)
+		if cc.Mark == 0 || cc.Mark > io.MaxMark || classes[cc.Mark] {
+			return nil, nil, configError{Field: field + ".mark", Err: fmt.Errorf("invalid or duplicate mark %d, must be between 1 and %d", cc.Mark, io.MaxMark)}
+		}
+		classes[cc.Mark] = true
+		if len(cc.Apps) == 0 {
+			return nil, nil, configError{Field: field + ".apps", Err: errors.New("required")}
+		}
+		for _, app := range cc.Apps {
+			if _, ok := marks[app]; ok {
+				return nil, nil, configError{Field: field + ".apps", Err: fmt.Errorf("%q is in another class", app)}
+			}
+			marks[app] = cc.Mark
+		}
+		if cc.DSCP != "" {
+			v, err := parseDSCP(cc.DSCP)
+			if err != nil {
+				return nil, nil, configError{Field: field + ".dscp", Err: err}
+			}
+			dscp = append(dscp, io.DSCPMark{Mark: cc.Mark, DSCP: v})
+		}
+	}
+	return marks, dscp, nil
+}
+
+func (c *cliConfig) fillPacketRing(config *engine.Config) error {
+	if c.Ring.Size <= 0 {
+		return nil
+	}
+	if c.Ring.Dir == "" {
+		return configError{Field: "packetRing.dir", Err: errors.New("required")}
+	}
+	maxFiles := c.Ring.MaxFiles
+	if maxFiles == 0 {
+		maxFiles = defaultPacketRingMaxFiles
+	}
+	d, err := newPcapRingDumper(c.Ring.Dir, maxFiles)
+	if err != nil {
+		return configError{Field: "packetRing.dir", Err: err}
+	}
+	config.PacketRing = c.Ring.Size
+	config.PacketRingDumper = d
+	return nil
+}
+
+func (c *cliConfig) fillTracer(config *engine.Config) error {
+	if c.OTLP.Endpoint == "" {
+		return nil
+	}
+	e, err := newOTLPExporter(otlpExporterConfig{
+		Endpoint:    c.OTLP.Endpoint,
+		Headers:     c.OTLP.Headers,
+		Interval:    c.OTLP.Interval,
+		Timeout:     c.OTLP.Timeout,
+		SampleRatio: c.OTLP.SampleRatio,
+		ServiceName: c.OTLP.ServiceName,
+		QueueSize:   c.OTLP.QueueSize,
+	})
+	if err != nil {
+		return configError{Field: "otlp", Err: err}
+	}
+	config.Tracer = e
+	return nil
+}
+
+func defaultVerdictStringToVerdict(s string) (engine.DefaultVerdict, bool) {
+	switch strings.ToLower(s) {
+	case "", "accept-stream":
+		return engine.DefaultVerdictAcceptStream, true
+	case "accept":
+		return engine.DefaultVerdictAccept, true
+	case "drop":
+		return engine.DefaultVerdictDrop, true
+	case "log":
+		return engine.DefaultVerdictLog, true
+	default:
+		return 0, false
+	}
+}
+
+func (c *cliConfig) fillSecurity(config *engine.Config) error {
+	d, err := newPrivilegeDrop(c.Security)
+	if err != nil {
+		return err
+	}
+	if d.UID >= 0 || d.Seccomp {
+		config.Started = d.Apply
+	}
+	return nil
+}
+
+func (c *cliConfig) Config() (*engine.Config, error) {
+	engineConfig := &engine.Config{}
+	fillers := []func(*engine.Config) error{
+		c.fillLogger,
+		c.fillIO,
+		c.fillWorkers,
+		c.fillVerdict,
+		c.fillIPv6,
+		c.fillEvasion,
+		c.fillRouting,
+		c.fillCapture,
+		c.fillMirror,
+		c.fillHAR,
+		c.fillQoS,
+		c.fillPacketRing,
+		c.fillTracer,
+		c.fillSecurity,
+	}
+	for _, f := range fillers {
+		if err := f(engineConfig); err != nil {
+			return nil, err
+		}
+	}
+	return engineConfig, nil
+}
+
+func runMain(cmd *cobra.Command, args []string) {
+	// Config
+	if err := readConfig(); err != nil {
+		logger.Fatal("failed to read config", zap.Error(err))
+	}
+	var config cliConfig
+	if err := viper.Unmarshal(&config); err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	engineConfig, err := config.Config()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	defer func() {
+		// Make sure to close all IOs on exit
+		for _, i := range engineConfig.IOs {
+			_ = i.Close()
+		}
+		capturer := engineConfig.Capturer
+		if r, ok := capturer.(*researchMode); ok {
+			capturer = r.Next
+		}
+		if w, ok := capturer.(*io.PcapWriter); ok {
+			_ = w.Close()
+		}
+		if m, ok := engineConfig.Mirror.(*io.PacketMirror); ok {
+			_ = m.Close()
+		}
+		if e, ok := engineConfig.Tracer.(*otlpExporter); ok {
+			_ = e.Close()
+		}
+		if l, ok := engineConfig.Logger.(*engineLogger); ok {
+			_ = l.Events.Close()
+			_ = l.Conns.Close()
+		}
+	}()
+
+	// Shaping
+	shapingClasses, err := config.shapingClasses()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if err := config.setupShaping(); err != nil {
+		logger.Fatal("failed to set up traffic shaping", zap.Error(err))
+	}
+	defer func() {
+		if config.Shaping.Device != "" {
+			_ = io.TeardownTCShaping(config.Shaping.Device)
+		}
+	}()
+
+	// Sets
+	sets, setDigests, err := config.loadSets()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// Blocked feed
+	blocked, err := config.blockFeed(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if l, ok := engineConfig.Logger.(*engineLogger); ok {
+		l.Blocked = blocked
+	}
+
+	// CrowdSec & fail2ban
+	crowdSec, crowdSecReport, err := config.crowdSec(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if l, ok := engineConfig.Logger.(*engineLogger); ok {
+		l.CrowdSec = crowdSecReport
+	}
+	fail2ban, err := config.fail2banTailer(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// Threat intel feeds
+	feeds, err := config.intelFeeds(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// DNS sinkhole
+	sinkhole, err := config.sinkhole(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if l, ok := engineConfig.Logger.(*engineLogger); ok {
+		l.Sinkhole = sinkhole
+	}
+	defer func() { _ = sinkhole.Close() }()
+
+	// Captive portal
+	portal, err := config.captivePortal(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// Strict mode
+	strict, err := config.strictMode(sets)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// Debug targets
+	debug := &debugFilter{}
+	if l, ok := engineConfig.Logger.(*engineLogger); ok {
+		l.Debug = debug
+	}
+
+	// Webhook
+	webhook, err := config.webhook()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	var notifier ruleset.Notifier
+	if webhook != nil {
+		notifier = webhook
+		defer webhook.Close()
+	}
+
+	// Audit log
+	audit, err := config.auditLog()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	defer audit.Close()
+
+	// Kubernetes
+	k8s, err := config.k8sWatcher()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	var workloads ruleset.WorkloadResolver
+	if k8s != nil {
+		workloads = k8s
+		k8sCtx, k8sCancel := context.WithCancel(context.Background())
+		defer k8sCancel()
+		go k8s.Run(k8sCtx)
+		timeout := config.Kubernetes.SyncTimeout
+		if timeout == 0 {
+			timeout = k8sDefaultSyncTimeout
+		}
+		// So that the first streams are matched with the workloads already known
+		if !k8s.WaitSynced(timeout) {
+			logger.Warn("kubernetes objects not listed in time, starting anyway", zap.Error(k8s.Check()))
+		} else {
+			logger.Info("kubernetes objects listed", zap.String("apiServer", k8s.APIServer))
+		}
+	}
+
+	// Docker
+	docker, err := config.dockerWatcher()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	var containers ruleset.ContainerResolver
+	if docker != nil {
+		containers = docker
+		dockerCtx, dockerCancel := context.WithCancel(context.Background())
+		defer dockerCancel()
+		// So that the first streams are matched with the containers already running
+		if err := docker.Refresh(dockerCtx); err != nil {
+			logger.Warn("failed to list docker containers, starting anyway", zap.Error(err))
+		}
+		go docker.Run(dockerCtx)
+	}
+
+	// NAT64
+	nat64, err := config.nat64()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// Processes
+	var processes ruleset.ProcessResolver
+	if config.localEnabled() {
+		processes = newProcProcesses(processProcRoot)
+	}
+
+	// HA
+	ha, err := config.haSync()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if ha != nil {
+		engineConfig.StateSync = ha
+	}
+
+	// Accounting
+	usage, err := config.usageStore()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if config.Accounting.Enabled {
+		engineConfig.Accounting = &usageAccounting{Usage: usage.Usage, Apps: config.Accounting.Apps}
+	}
+
+	// ML analyzer
+	mlAnalyzer, err := config.mlAnalyzer()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if mlAnalyzer != nil {
+		analyzers = append(analyzers, mlAnalyzer)
+	}
+
+	// HTTP & SSH analyzers
+	if err := config.httpAnalyzer(); err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if err := config.sshAnalyzer(); err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+
+	// Relay analyzer
+	relayAnalyzer, err := config.relayAnalyzer()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if relayAnalyzer != nil {
+		analyzers = append(analyzers, relayAnalyzer)
+	}
+
+	// Research mode
+	research, err := config.researchMode()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if research != nil {
+		if research.Log, err = sink.NewFile(config.Research.Rotate.fileConfig(config.Research.File)); err != nil {
+			logger.Fatal("failed to parse config", zap.Error(configError{Field: "research.file", Err: err}))
+		}
+		research.Next = engineConfig.Capturer
+		engineConfig.Capturer = research
+		if l, ok := engineConfig.Logger.(*engineLogger); ok {
+			l.Research = research
+		}
+	}
+	defer func() { _ = research.Close() }()
+
+	// HAR
+	har, _ := engineConfig.HTTPCapturer.(*harRecorder)
+	if l, ok := engineConfig.Logger.(*engineLogger); ok {
+		l.HAR = har
+	}
+	defer func() { _ = har.Close() }()
+
+	// Ruleset
+	tracker, err := builtins.NewTracker(config.Ruleset.TrackerMaxKeys)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(configError{Field: "ruleset.trackerMaxKeys", Err: err}))
+	}
+	rsConfig := &ruleset.BuiltinConfig{
+		Logger:             &rulesetLogger{Debug: debug},
+		GeoSiteFilename:    config.Ruleset.GeoSite,
+		GeoIpFilename:      config.Ruleset.GeoIp,
+		AppsFilename:       config.Ruleset.Apps,
+		AppsAnalyzers:      len(config.QoS.Classes) > 0,
+		ShapingClasses:     shapingClasses,
+		Tracker:            tracker, // Shared across reloads
+		Usage:              usage.Usage,
+		Sets:               sets,
+		Functions:          config.Ruleset.Functions,
+		CaptureEnabled:     engineConfig.Capturer != nil,
+		MirrorEnabled:      engineConfig.Mirror != nil,
+		DivertEnabled:      config.divertEnabled(),
+		CaptureHTTPEnabled: engineConfig.HTTPCapturer != nil,
+		HoneypotEnabled:    config.honeypotEnabled(),
+		Notifier:           notifier,
+		Workloads:          workloads,
+		Containers:         containers,
+		Processes:          processes,
+		NAT64:              nat64,
+	}
+	rsManager := &rulesetManager{
+		Source:   args[0],
+		Config:   &config,
+		RSConfig: rsConfig,
+		Audit:    audit,
+	}
+	if sinkhole != nil {
+		rsManager.Prepend = append(rsManager.Prepend, sinkhole.Rules()...)
+	}
+	if portal != nil {
+		rsManager.Prepend = append(rsManager.Prepend, portal.Rules()...)
+	}
+	if strict != nil {
+		rsManager.Append = strict.Rules()
+	}
+	rs, err := rsManager.Init()
+	if err != nil {
+		logger.Fatal("failed to load rules", zap.Error(err))
+	}
+	engineConfig.Ruleset = rs
+
+	// Engine
+	en, err := engine.NewEngine(*engineConfig)
+	if err != nil {
+		logger.Fatal("failed to initialize engine", zap.Error(err))
+	}
+	rsManager.Engine = en
+	if e, ok := engineConfig.Tracer.(*otlpExporter); ok {
+		e.SetAnalyzerStats(en.AnalyzerStats)
+	}
+
+	// Signal handling
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	go func() {
+		// Graceful shutdown
+		shutdownChan := make(chan os.Signal, 1)
+		signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
+		<-shutdownChan
+		logger.Info("shutting down gracefully...")
+		// Before the rules are removed & the queued packets drained, which may take a while
+		if err := systemdNotify("STOPPING=1"); err != nil {
+			logger.Warn("failed to notify systemd", zap.Error(err))
+		}
+		cancelFunc()
+	}()
+	go func() {
+		// Rule reload
+		reloadChan := make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
+		for {
+			<-reloadChan
+			// Also reopen the eve log, for logrotate
+			if l, ok := engineConfig.Logger.(*engineLogger); ok {
+				if err := l.Events.Reopen(); err != nil {
+					logger.Error("failed to reopen eve log", zap.Error(err))
+				}
+				if err := l.Conns.Reopen(); err != nil {
+					logger.Error("failed to reopen conn log", zap.Error(err))
+				}
+				if err := l.Sinkhole.Reopen(); err != nil {
+					logger.Error("failed to reopen sinkhole log", zap.Error(err))
+				}
+				if err := l.Research.Reopen(); err != nil {
+					logger.Error("failed to reopen research file", zap.Error(err))
+				}
+			}
+			logger.Info("reloading rules")
+			if err := rsManager.Reload(false, "signal:SIGHUP"); err != nil {
+				logger.Error("failed to reload rules, using old rules", zap.Error(err))
+			} else {
+				logger.Info("rules reloaded")
+			}
+		}
+	}()
+	go func() {
+		// Rule & analyzer stats
+		statsChan := make(chan os.Signal, 1)
+		signal.Notify(statsChan, syscall.SIGUSR1)
+		for {
+			<-statsChan
+			for _, st := range rsManager.Current().Stats() {
+				logger.Info("rule stats",
+					zap.String("name", st.Name),
+					zap.Uint64("hits", st.Hits),
+					zap.Uint64("bytes", st.Bytes),
+					zap.Time("lastHit", st.LastHit),
+					zap.Bool("expired", st.Expired))
+			}
+			for _, st := range en.AnalyzerStats() {
+				logger.Info("analyzer stats",
+					zap.String("name", st.Name),
+					zap.Uint64("streams", st.Streams),
+					zap.Uint64("bytes", st.Bytes),
+					zap.Duration("time", st.Time),
+					zap.Uint64("classified", st.Classified),
+					zap.Uint64("unclassified", st.Unclassified),
+					zap.Uint64("errors", st.Errors))
+			}
+		}
+	}()
+
+	go func() {
+		// Log verbosity
+		levelChan := make(chan os.Signal, 1)
+		signal.Notify(levelChan, syscall.SIGTTIN, syscall.SIGTTOU)
+		for sig := range levelChan {
+			who := "signal:SIGTTOU"
+			if sig == syscall.SIGTTIN {
+				who = "signal:SIGTTIN"
+			}
+			previous, level := stepLogLevel(sig == syscall.SIGTTIN, sig.String())
+			if level != previous {
+				audit.Record(auditRecord{
+					Who:     who,
+					Action:  "log_level",
+					Summary: "log level set to " + level.String(),
+					Details: auditChange{From: previous.String(), To: level.String()},
+				})
+			}
+		}
+	}()
+
+	go func() {
+		// Packet ring dump
+		ringChan := make(chan os.Signal, 1)
+		signal.Notify(ringChan, syscall.SIGUSR2)
+		for {
+			<-ringChan
+			if engineConfig.PacketRing <= 0 {
+				logger.Warn("packet ring is not enabled, ignoring SIGUSR2")
+				continue
+			}
+			// Errors are logged by the engine logger
+			_, _ = en.DumpPacketRings(ctx, "SIGUSR2")
+		}
+	}()
+
+	// Degraded mode
+	degrade, err := config.degradeMonitor(en)
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if degrade != nil {
+		if l, ok := engineConfig.Logger.(*engineLogger); ok && l.Events != nil {
+			l.Events.SampleScale = degrade.SampleScale
+		}
+		if e, ok := engineConfig.Tracer.(*otlpExporter); ok {
+			e.SetSampleScale(degrade.SampleScale)
+		}
+		go degrade.Run(ctx)
+	}
+	if ha != nil {
+		go func() {
+			logger.Info("HA state sync listening", zap.String("addr", ha.Listen), zap.String("peer", ha.Peer))
+			if err := ha.Run(ctx); err != nil {
+				logger.Error("HA state sync failed", zap.Error(err))
+			}
+		}()
+	}
+
+	var events *eventLog
+	if crowdSec != nil {
+		go crowdSec.Run(ctx)
+	}
+	if crowdSecReport != nil {
+		go crowdSecReport.Run(ctx)
+	}
+	if fail2ban != nil {
+		go fail2ban.Run(ctx)
+	}
+	for _, feed := range feeds {
+		go feed.Run(ctx)
+	}
+	go usage.Run(ctx)
+	if research != nil {
+		go research.Run(ctx)
+	}
+	if portal != nil {
+		go portal.Run(ctx)
+		go func() {
+			logger.Info("captive portal listening", zap.String("addr", portal.Listen), zap.String("url", portal.URL))
+			if err := portal.ListenAndServe(ctx); err != nil {
+				logger.Error("captive portal failed", zap.Error(err))
+			}
+		}()
+	}
+
+	health := &healthChecker{
+		Engine: en, Rulesets: rsManager, Degrade: degrade, Kubernetes: k8s, Docker: docker, HA: ha,
+		CrowdSec: crowdSec, CrowdSecReport: crowdSecReport, Fail2ban: fail2ban, Feeds: feeds, Sinkhole: sinkhole,
+		Usage: usage, Research: research,
+	}
+	if l, ok := engineConfig.Logger.(*engineLogger); ok {
+		events = l.Events
+		health.Events, health.Conns = l.Events, l.Conns
+	}
+	go health.RunSystemdNotify(ctx)
+
+	if config.API.Listen != "" {
+		if err := config.API.checkAuth(); err != nil {
+			logger.Fatal("failed to parse config", zap.Error(err))
+		}
+		api := &apiServer{Sets: sets, Rulesets: rsManager, Engine: en, Token: config.API.Token, Health: health, Blocked: blocked, Debug: debug, Audit: audit, Sinkhole: sinkhole, Portal: portal, Usage: usage.Usage}
+		api.Alerts, _ = findEventSink[*eventRing](events)
+		if config.API.Cert != "" || config.API.Key != "" {
+			api.TLS, err = serverTLSConfig(config.API.Cert, config.API.Key, config.API.ClientCA)
+			if err != nil {
+				logger.Fatal("failed to parse config", zap.Error(configError{Field: "api", Err: err}))
+			}
+		} else if config.API.ClientCA != "" {
+			logger.Fatal("failed to parse config", zap.Error(configError{Field: "api.clientCA", Err: errors.New("requires cert and key")}))
+		}
+		go func() {
+			logger.Info("API server listening", zap.String("addr", config.API.Listen))
+			if err := api.ListenAndServe(ctx, config.API.Listen); err != nil {
+				logger.Error("API server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	if config.GRPC.Listen != "" {
+		tlsConfig, err := grpcTLSConfig(config.GRPC.Cert, config.GRPC.Key, config.GRPC.ClientCA)
+		if err != nil {
+			logger.Fatal("failed to parse config", zap.Error(configError{Field: "grpc", Err: err}))
+		}
+		hub, _ := findEventSink[*eventHub](events)
+		server := &grpcServer{Events: hub, Rulesets: rsManager, Engine: en, TLS: tlsConfig, Audit: audit}
+		go func() {
+			logger.Info("gRPC server listening", zap.String("addr", config.GRPC.Listen))
+			if err := server.ListenAndServe(ctx, config.GRPC.Listen); err != nil {
+				logger.Error("gRPC server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	if config.SNMP.Enabled {
+		agent, err := newSNMPAgent(config.SNMP.AgentX, config.SNMP.OID, en.Stats)
+		if err != nil {
+			logger.Fatal("failed to parse config", zap.Error(configError{Field: "snmp", Err: err}))
+		}
+		go agent.Run(ctx)
+	}
+
+	if config.Controller.URL != "" {
+		tlsConfig, err := config.Controller.tlsConfig()
+		if err != nil {
+			logger.Fatal("failed to parse config", zap.Error(err))
+		}
+		statusInterval := config.Controller.StatusInterval
+		if statusInterval <= 0 {
+			statusInterval = controllerDefaultStatusInterval
+		}
+		client := &controllerClient{
+			URL:            config.Controller.URL,
+			ID:             controllerID(config.Controller.ID),
+			TLS:            tlsConfig,
+			PublicKey:      config.Controller.PublicKey,
+			StatusInterval: statusInterval,
+			Rulesets:       rsManager,
+			Sets:           sets,
+			Engine:         en,
+			Health:         health,
+			Audit:          audit,
+		}
+		go client.Run(ctx)
+	}
+
+	if config.Blocked.File != "" {
+		go blocked.RunExport(ctx, config.Blocked.File, config.Blocked.Format, config.Blocked.Interval)
+	}
+
+	if ruleset.IsRemoteSource(args[0]) && config.Ruleset.Remote.Interval > 0 {
+		go func() {
+			// Periodic remote refresh
+			ticker := time.NewTicker(config.Ruleset.Remote.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				err := rsManager.Reload(true, "remote-refresh")
+				if errors.Is(err, errRulesetUnchanged) {
+					logger.Debug("remote rules unchanged")
+				} else if err != nil {
+					logger.Error("failed to update remote rules, using old rules", zap.Error(err))
+				} else {
+					logger.Info("remote rules updated")
+				}
+			}
+		}()
+	}
+	if len(setDigests) > 0 && config.Ruleset.Remote.Interval > 0 {
+		go func() {
+			// Periodic remote set refresh
+			ticker := time.NewTicker(config.Ruleset.Remote.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				config.refreshSets(sets, setDigests)
+			}
+		}()
+	}
+
+	logger.Info("engine started")
+	logger.Info("engine exited", zap.Error(en.Run(ctx)))
+	usage.Flush()
+}
+
+type engineLogger struct {
+	Events   *eventLog         // Optional
+	Conns    *connLog          // Optional
+	Blocked  *blockFeed        // Optional
+	CrowdSec *crowdSecReporter // Optional
+	Sinkhole *sinkhole         // Optional
+	Research *researchMode     // Optional
+	HAR      *harRecorder      // Optional
+	Debug    *debugFilter
+}
+
+func (l *engineLogger) WorkerStart(id int) {
+	logger.Debug("worker started", zap.Int("id", id))
+}
+
+func (l *engineLogger) WorkerStop(id int) {
+	logger.Debug("worker stopped", zap.Int("id", id))
+}
+
+func (l *engineLogger) TCPStreamNew(workerID int, info ruleset.StreamInfo) {
+	dl := l.Debug.StreamNew(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("new TCP stream",
+		zap.Int("workerID", workerID),
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()))
+}
+
+func (l *engineLogger) TCPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	dl := l.Debug.Stream(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("TCP stream property update",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Any("props", info.Props),
+		zap.Bool("close", close))
+}
+
+func (l *engineLogger) TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	logger.Info("TCP stream action",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.String("action", action.String()),
+		zap.String("rule", rule),
+		zap.Bool("noMatch", noMatch))
+	l.Events.StreamAction(info, action, rule)
+	l.Blocked.StreamAction(info, action, rule, noMatch)
+	l.CrowdSec.StreamAction(info, action, rule, noMatch)
+	l.Sinkhole.StreamAction(info, action, rule, noMatch)
+	l.Research.StreamAction(info, action, rule, noMatch)
+	l.HAR.StreamAction(info, action, rule, noMatch)
+}
+
+func (l *engineLogger) UDPStreamNew(workerID int, info ruleset.StreamInfo) {
+	dl := l.Debug.StreamNew(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("new UDP stream",
+		zap.Int("workerID", workerID),
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()))
+}
+
+func (l *engineLogger) UDPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	dl := l.Debug.Stream(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("UDP stream property update",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Any("props", info.Props),
+		zap.Bool("close", close))
+}
+
+func (l *engineLogger) UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	logger.Info("UDP stream action",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.String("action", action.String()),
+		zap.String("rule", rule),
+		zap.Bool("noMatch", noMatch))
+	l.Events.StreamAction(info, action, rule)
+	l.Blocked.StreamAction(info, action, rule, noMatch)
+	l.CrowdSec.StreamAction(info, action, rule, noMatch)
+	l.Sinkhole.StreamAction(info, action, rule, noMatch)
+	l.Research.StreamAction(info, action, rule, noMatch)
+}
+
+func (l *engineLogger) SCTPStreamNew(workerID int, info ruleset.StreamInfo) {
+	dl := l.Debug.StreamNew(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("new SCTP stream",
+		zap.Int("workerID", workerID),
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()))
+}
+
+func (l *engineLogger) SCTPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	dl := l.Debug.Stream(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("SCTP stream property update",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Any("props", info.Props),
+		zap.Bool("close", close))
+}
+
+func (l *engineLogger) SCTPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	logger.Info("SCTP stream action",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.String("action", action.String()),
+		zap.String("rule", rule),
+		zap.Bool("noMatch", noMatch))
+	l.Events.StreamAction(info, action, rule)
+	l.Blocked.StreamAction(info, action, rule, noMatch)
+	l.CrowdSec.StreamAction(info, action, rule, noMatch)
+}
+
+func (l *engineLogger) ICMPStreamNew(workerID int, info ruleset.StreamInfo) {
+	dl := l.Debug.StreamNew(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("new ICMP stream",
+		zap.Int("workerID", workerID),
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()))
+}
+
+func (l *engineLogger) ICMPStreamPropUpdate(info ruleset.StreamInfo, close bool) {
+	dl := l.Debug.Stream(info)
+	if dl == nil {
+		return
+	}
+	dl.Debug("ICMP stream property update",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Any("props", info.Props),
+		zap.Bool("close", close))
+}
+
+func (l *engineLogger) ICMPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	logger.Info("ICMP stream action",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.String("action", action.String()),
+		zap.String("rule", rule),
+		zap.Bool("noMatch", noMatch))
+	l.Events.StreamAction(info, action, rule)
+	l.Blocked.StreamAction(info, action, rule, noMatch)
+	l.CrowdSec.StreamAction(info, action, rule, noMatch)
+}
+
+func (l *engineLogger) StreamEnd(end engine.StreamEnd) {
+	if dl := l.Debug.Stream(end.Info); dl != nil {
+		dl.Debug("stream ended",
+			zap.Int("workerID", end.WorkerID),
+			zap.Int64("id", end.Info.ID),
+			zap.String("uuid", end.Info.UUID),
+			zap.String("proto", end.Info.Protocol.String()),
+			zap.String("src", end.Info.SrcString()),
+			zap.String("dst", end.Info.DstString()),
+			zap.String("reason", end.Reason.String()))
+	}
+	l.Debug.StreamEnd(end.Info.ID)
+	l.Conns.StreamEnd(end)
+	l.Research.StreamEnd(end)
+	l.HAR.StreamEnd(end)
+}
+
+func (l *engineLogger) StreamNoMatch(info ruleset.StreamInfo, classified bool) {
+	logger.Warn("stream matched no rule",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("proto", info.Protocol.String()),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Bool("classified", classified),
+		zap.Any("props", info.Props))
+}
+
+func (l *engineLogger) CaptureError(info ruleset.StreamInfo, err error) {
+	logger.Error("capture error",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Error(err))
+}
+
+func (l *engineLogger) PacketRingDump(workerID int, reason string, name string, packets int, err error) {
+	if err != nil {
+		logger.Error("failed to dump packet ring",
+			zap.Int("workerID", workerID),
+			zap.String("reason", reason),
+			zap.Error(err))
+		return
+	}
+	logger.Info("packet ring dumped",
+		zap.Int("workerID", workerID),
+		zap.String("reason", reason),
+		zap.String("file", name),
+		zap.Int("packets", packets))
+}
+
+func (l *engineLogger) PacketAnomaly(a engine.PacketAnomaly) {
+	// Debug only, as anyone can send them by the thousands
+	logger.Debug("anomalous packet",
+		zap.Int("workerID", a.WorkerID),
+		zap.Int64("id", a.StreamID),
+		zap.String("src", a.SrcIP.String()),
+		zap.String("dst", a.DstIP.String()),
+		zap.String("reason", a.Reason),
+		zap.Bool("dropped", a.Dropped))
+}
+
+func (l *engineLogger) ModifyError(info ruleset.StreamInfo, err error) {
+	logger.Error("modify error",
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Error(err))
+}
+
+func (l *engineLogger) AnalyzerDebugf(streamID int64, name string, format string, args ...interface{}) {
+	dl := l.Debug.Analyzer(streamID, name)
+	if dl == nil {
+		return
+	}
+	dl.Debug("analyzer debug message",
+		zap.Int64("id", streamID),
+		zap.String("uuid", engine.StreamUUID(streamID)),
+		zap.String("name", name),
+		zap.String("msg", fmt.Sprintf(format, args...)))
+}
+
+func (l *engineLogger) AnalyzerInfof(streamID int64, name string, format string, args ...interface{}) {
+	logger.Info("analyzer info message",
+		zap.Int64("id", streamID),
+		zap.String("uuid", engine.StreamUUID(streamID)),
+		zap.String("name", name),
+		zap.String("msg", fmt.Sprintf(format, args...)))
+}
+
+func (l *engineLogger) AnalyzerErrorf(streamID int64, name string, format string, args ...interface{}) {
+	logger.Error("analyzer error message",
+		zap.Int64("id", streamID),
+		zap.String("uuid", engine.StreamUUID(streamID)),
+		zap.String("name", name),
+		zap.String("msg", fmt.Sprintf(format, args...)))
+}
+
+type rulesetLogger struct {
+	Debug *debugFilter
+}
+
+var rulesetLogLevelMap = map[ruleset.LogLevel]zapcore.Level{
+	ruleset.LogLevelDebug: zapcore.DebugLevel,
+	ruleset.LogLevelInfo:  zapcore.InfoLevel,
+	ruleset.LogLevelWarn:  zapcore.WarnLevel,
+	ruleset.LogLevelError: zapcore.ErrorLevel,
+}
+
+func (l *rulesetLogger) Log(level ruleset.LogLevel, info ruleset.StreamInfo, name string) {
+	fields := []zap.Field{
+		zap.String("name", name),
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+	}
+	if info.Props != nil {
+		fields = append(fields, zap.Any("props", info.Props))
+	}
+	if level == ruleset.LogLevelDebug {
+		if dl := l.Debug.Stream(info); dl != nil {
+			dl.Debug("ruleset log", fields...)
+		}
+		return
+	}
+	logger.Log(rulesetLogLevelMap[level], "ruleset log", fields...)
+}
+
+func (l *rulesetLogger) DryRun(info ruleset.StreamInfo, name string, action ruleset.Action) {
+	logger.Info("ruleset dry run",
+		zap.String("name", name),
+		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.String("action", action.String()))
 }
 
 func (l *rulesetLogger) MatchError(info ruleset.StreamInfo, name string, err error) {
 	logger.Error("ruleset match error",
 		zap.String("name", name),
 		zap.Int64("id", info.ID),
+		zap.String("uuid", info.UUID),
 		zap.String("src", info.SrcString()),
 		zap.String("dst", info.DstString()),
 		zap.Error(err))
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCLIConfig_RefreshSets(t *testing.T) {
+	logger = zap.NewNop()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	content := []byte("example.com\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ads.txt":
+			_, _ = w.Write(content)
+		case "/ads.txt.sig":
+			_, _ = w.Write(ed25519.Sign(priv, content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	config := &cliConfig{Sets: []cliConfigSet{{
+		Name:      "ads",
+		Type:      "domain",
+		File:      srv.URL + "/ads.txt",
+		Entries:   []string{"static.example"},
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+	}}}
+	sets, digests, err := config.loadSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := sets.Get("ads")
+	entries := func() []string {
+		var values []string
+		for _, e := range set.List() {
+			values = append(values, e.Value)
+		}
+		return values
+	}
+
+	// Unchanged, the entries added at runtime are kept
+	if err := set.Add([]string{"runtime.example"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	config.refreshSets(sets, digests)
+	if got, want := entries(), []string{"example.com", "runtime.example", "static.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+
+	// Changed, swapped in
+	content = []byte("example.org\n")
+	config.refreshSets(sets, digests)
+	if got, want := entries(), []string{"example.org", "static.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+
+	// Failed, the old entries are kept
+	srv.Close()
+	config.refreshSets(sets, digests)
+	if got, want := entries(), []string{"example.org", "static.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestCLIConfigAPI_CheckAuth(t *testing.T) {
+	logger = zap.NewNop()
+	testCases := []struct {
+		name    string
+		config  cliConfigAPI
+		wantErr bool
+	}{
+		{"loopback", cliConfigAPI{Listen: "127.0.0.1:8090"}, false},
+		{"loopback ipv6", cliConfigAPI{Listen: "[::1]:8090"}, false},
+		{"localhost", cliConfigAPI{Listen: "localhost:8090"}, false},
+		{"all interfaces", cliConfigAPI{Listen: ":8090"}, true},
+		{"lan", cliConfigAPI{Listen: "192.168.1.1:8090"}, true},
+		{"lan token", cliConfigAPI{Listen: "192.168.1.1:8090", Token: "xxx"}, false},
+		{"lan client ca", cliConfigAPI{Listen: "0.0.0.0:8090", ClientCA: "ca.pem"}, false},
+		{"lan insecure", cliConfigAPI{Listen: "0.0.0.0:8090", Insecure: true}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.config.checkAuth(); (err != nil) != tc.wantErr {
+				t.Errorf("checkAuth() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,381 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"gopkg.in/yaml.v3"
+)
+
+const rulesetDefaultHistory = 5
+
+var (
+	errRulesetUnchanged       = errors.New("ruleset unchanged")
+	errRulesetVersionNotFound = errors.New("ruleset version not found")
+)
+
+// rulesetVersion is a compiled ruleset kept for rollback.
+type rulesetVersion struct {
+	ID      int
+	Hash    string // SHA-256 of the rules, to tell whether two versions are the same
+	Time    time.Time
+	Ruleset ruleset.Ruleset
+	Rules   map[string]string // SHA-256 of each rule by name, to tell what changed between versions
+}
+
+// rulesetManager loads & compiles rulesets from their source, applies them to the engine,
+// and keeps track of the one currently in use. It is safe for concurrent use.
+type rulesetManager struct {
+	Source   string
+	Config   *cliConfig
+	RSConfig *ruleset.BuiltinConfig
+	Engine   engine.Engine // Must be set before calling Reload
+	Audit    *auditLog     // Optional
+
+	mutex    sync.Mutex
+	current  ruleset.Ruleset
+	digest   [32]byte
+	versions []rulesetVersion // Oldest first
+	lastID   int
+	activeID int
+	lastErr  error // Of the latest reload, nil if it succeeded or the rules were unchanged
+
+	pushed       []ruleset.ExprRule // Main rules pushed by the controller, used instead of Source if set
+	pushedDigest [32]byte
+
+	Prepend []ruleset.ExprRule // Evaluated before the rules of every source, e.g. those of the sinkhole
+	Append  []ruleset.ExprRule // Evaluated after the rules of every source, e.g. those of strict mode
+}
+
+// Init loads and compiles the initial ruleset.
+func (m *rulesetManager) Init() (ruleset.Ruleset, error) {
+	raw, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	rs, err := m.compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	m.current, m.digest = rs, raw.Digest
+	m.addVersion(rs, raw)
+	v := m.active()
+	m.Audit.Record(auditRecord{
+		Who:     "startup",
+		Action:  "start",
+		Summary: fmt.Sprintf("version %d: %d rules", v.ID, len(v.Rules)),
+		Version: v.Hash,
+	})
+	return rs, nil
+}
+
+// Reload loads, compiles and applies the ruleset from the source.
+// If skipUnchanged is true and the sources are remote, it returns errRulesetUnchanged
+// without recompiling when the content hasn't changed since the last load.
+// who is recorded in the audit log, with the changes.
+func (m *rulesetManager) Reload(skipUnchanged bool, who string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	prev := m.active()
+	err := m.reload(skipUnchanged)
+	if errors.Is(err, errRulesetUnchanged) {
+		m.lastErr = nil
+		return err
+	}
+	m.lastErr = err
+	m.audit("ruleset.reload", who, prev, err)
+	return err
+}
+
+func (m *rulesetManager) reload(skipUnchanged bool) error {
+	raw, err := m.load()
+	if err != nil {
+		return err
+	}
+	if skipUnchanged && raw.Digest != ([32]byte{}) && raw.Digest == m.digest {
+		return errRulesetUnchanged
+	}
+	rs, err := m.compile(raw)
+	if err != nil {
+		return err
+	}
+	if err := m.Engine.UpdateRuleset(rs); err != nil {
+		return err
+	}
+	m.current, m.digest = rs, raw.Digest
+	m.addVersion(rs, raw)
+	return nil
+}
+
+// Push compiles and applies main rules pushed by the controller (YAML), which replace the source
+// until the process is restarted. Pushing the rules in use again returns errRulesetUnchanged.
+func (m *rulesetManager) Push(data []byte, who string) error {
+	rules, err := ruleset.ExprRulesFromYAMLBytes(data)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	prev := m.active()
+	prevRules, prevDigest := m.pushed, m.pushedDigest
+	m.pushed, m.pushedDigest = rules, sha256.Sum256(data)
+	err = m.reload(true)
+	if errors.Is(err, errRulesetUnchanged) {
+		m.lastErr = nil
+		return err
+	}
+	if err != nil {
+		m.pushed, m.pushedDigest = prevRules, prevDigest
+	}
+	m.lastErr = err
+	m.audit("ruleset.push", who, prev, err)
+	return err
+}
+
+// Rollback applies a previously loaded version of the ruleset, or the one before
+// the current one if id is 0. The version stays current until the next reload;
+// a remote source that hasn't changed since is not reapplied by periodic refreshes.
+func (m *rulesetManager) Rollback(id int, who string) (rulesetVersion, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	prev := m.active()
+	idx := -1
+	for i, v := range m.versions {
+		if (id == 0 && v.ID < m.activeID) || v.ID == id {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return rulesetVersion{}, errRulesetVersionNotFound
+	}
+	v := m.versions[idx]
+	if err := m.Engine.UpdateRuleset(v.Ruleset); err != nil {
+		m.audit("ruleset.rollback", who, prev, err)
+		return rulesetVersion{}, err
+	}
+	m.current, m.activeID = v.Ruleset, v.ID
+	m.audit("ruleset.rollback", who, prev, nil)
+	return v, nil
+}
+
+// active returns the version in use, the zero value before Init.
+func (m *rulesetManager) active() rulesetVersion {
+	for _, v := range m.versions {
+		if v.ID == m.activeID {
+			return v
+		}
+	}
+	return rulesetVersion{}
+}
+
+// audit records a change of the ruleset in use from prev, or its failure.
+func (m *rulesetManager) audit(action, who string, prev rulesetVersion, err error) {
+	cur := m.active()
+	r := auditRecord{Who: who, Action: action, Version: cur.Hash}
+	if err != nil {
+		r.Summary, r.Error = fmt.Sprintf("failed, version %d still in use", cur.ID), err.Error()
+	} else {
+		diff := diffRules(prev.Rules, cur.Rules)
+		r.Summary, r.Details = fmt.Sprintf("version %d: %s", cur.ID, diff), diff
+	}
+	m.Audit.Record(r)
+}
+
+// LastError returns the error of the latest reload, nil if it succeeded.
+// The ruleset in use is then still the one before.
+func (m *rulesetManager) LastError() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lastErr
+}
+
+// Versions returns the versions kept for rollback, oldest first, and the ID of the current one.
+func (m *rulesetManager) Versions() ([]rulesetVersion, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]rulesetVersion(nil), m.versions...), m.activeID
+}
+
+func (m *rulesetManager) addVersion(rs ruleset.Ruleset, raw *rawRulesets) {
+	m.lastID++
+	m.activeID = m.lastID
+	m.versions = append(m.versions, rulesetVersion{
+		ID:      m.lastID,
+		Hash:    raw.Hash(),
+		Time:    time.Now(),
+		Ruleset: rs,
+		Rules:   raw.RuleHashes(),
+	})
+	history := m.Config.Ruleset.History
+	if history <= 0 {
+		history = rulesetDefaultHistory
+	}
+	if len(m.versions) > history {
+		m.versions = append(m.versions[:0], m.versions[len(m.versions)-history:]...)
+	}
+}
+
+// Current returns the ruleset currently in use.
+func (m *rulesetManager) Current() ruleset.Ruleset {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.current
+}
+
+// rawRulesets holds the raw rules of the main source and of every ruleset selector.
+type rawRulesets struct {
+	Main      []ruleset.ExprRule
+	Selected  [][]ruleset.ExprRule // Same order as the selectors in the config
+	Selectors []ruleset.RulesetSelector
+	Digest    [32]byte // Zero if any of the sources is a local file
+}
+
+// Hash returns the hex SHA-256 of the rules, regardless of where they were loaded from.
+func (r *rawRulesets) Hash() string {
+	h := sha256.New()
+	_ = yaml.NewEncoder(h).Encode(r.Main)
+	for _, rules := range r.Selected {
+		_ = yaml.NewEncoder(h).Encode(rules)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RuleHashes returns the hex SHA-256 of each rule, by name. The rules of selectors are prefixed with
+// the selector's name and a slash, and rules with the same name get "#2", "#3"... suffixes.
+func (r *rawRulesets) RuleHashes() map[string]string {
+	hashes := make(map[string]string)
+	add := func(prefix string, rules []ruleset.ExprRule) {
+		for _, rule := range rules {
+			h := sha256.New()
+			_ = yaml.NewEncoder(h).Encode(rule)
+			name := prefix + rule.Name
+			for i := 2; hashes[name] != ""; i++ {
+				name = prefix + rule.Name + "#" + strconv.Itoa(i)
+			}
+			hashes[name] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	add("", r.Main)
+	for i, rules := range r.Selected {
+		add(r.Selectors[i].Name+"/", rules)
+	}
+	return hashes
+}
+
+// rulesetDiff lists the rules that changed between two versions, by name.
+type rulesetDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+func diffRules(from, to map[string]string) rulesetDiff {
+	var d rulesetDiff
+	for name, h := range to {
+		if oh, ok := from[name]; !ok {
+			d.Added = append(d.Added, name)
+		} else if oh != h {
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+func (d rulesetDiff) String() string {
+	if len(d.Added)+len(d.Removed)+len(d.Changed) == 0 {
+		return "no rule changed"
+	}
+	var parts []string
+	for _, p := range []struct {
+		what  string
+		names []string
+	}{{"added", d.Added}, {"removed", d.Removed}, {"changed", d.Changed}} {
+		if len(p.names) > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", len(p.names), p.what))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (m *rulesetManager) load() (*rawRulesets, error) {
+	selectors, err := m.Config.rulesetSelectors()
+	if err != nil {
+		return nil, err
+	}
+	raw := &rawRulesets{Selectors: selectors}
+	var digest [32]byte
+	if m.pushed != nil {
+		raw.Main, digest = m.pushed, m.pushedDigest
+	} else {
+		raw.Main, digest, err = m.Config.loadRules(m.Source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(selectors) == 0 {
+		raw.Digest = digest
+		return raw, nil
+	}
+	h := sha256.New()
+	allRemote := digest != [32]byte{}
+	h.Write(digest[:])
+	for i, cs := range m.Config.Ruleset.Selectors {
+		rules, digest, err := m.Config.loadRules(cs.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %w", selectors[i].Name, err)
+		}
+		raw.Selected = append(raw.Selected, rules)
+		allRemote = allRemote && digest != [32]byte{}
+		h.Write(digest[:])
+	}
+	if allRemote {
+		h.Sum(raw.Digest[:0])
+	}
+	return raw, nil
+}
+
+func (m *rulesetManager) compile(raw *rawRulesets) (ruleset.Ruleset, error) {
+	rs, err := ruleset.CompileExprRules(m.wrap(raw.Main), analyzers, modifiers, m.RSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw.Selectors) == 0 {
+		return rs, nil
+	}
+	for i := range raw.Selectors {
+		raw.Selectors[i].Ruleset, err = ruleset.CompileExprRules(m.wrap(raw.Selected[i]), analyzers, modifiers, m.RSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %w", raw.Selectors[i].Name, err)
+		}
+	}
+	return ruleset.NewSelectorRuleset(rs, raw.Selectors), nil
+}
+
+// wrap returns the rules between Prepend & Append, without changing them.
+func (m *rulesetManager) wrap(rules []ruleset.ExprRule) []ruleset.ExprRule {
+	if len(m.Prepend) == 0 && len(m.Append) == 0 {
+		return rules
+	}
+	wrapped := make([]ruleset.ExprRule, 0, len(m.Prepend)+len(rules)+len(m.Append))
+	wrapped = append(wrapped, m.Prepend...)
+	wrapped = append(wrapped, rules...)
+	return append(wrapped, m.Append...)
+}
@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Flags
+var (
+	lintStrict    bool
+	lintCosts     bool
+	simulateRules string
+)
+
+var rulesetCmd = &cobra.Command{
+	Use:   "ruleset",
+	Short: "Ruleset tools",
+}
+
+var rulesetLintCmd = &cobra.Command{
+	Use:   "lint [flags] rule_file",
+	Short: "Check a ruleset for errors, unreachable rules, expensive expressions and other problems",
+	Args:  cobra.ExactArgs(1),
+	Run:   runRulesetLint,
+}
+
+var rulesetVersionsCmd = &cobra.Command{
+	Use:   "versions",
+	Short: "List the ruleset versions of a running instance that can be rolled back to",
+	Args:  cobra.NoArgs,
+	Run:   runRulesetVersions,
+}
+
+var rulesetRollbackCmd = &cobra.Command{
+	Use:   "rollback [version]",
+	Short: "Roll a running instance back to a previous ruleset version (default: the one before the current one)",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   runRulesetRollback,
+}
+
+var rulesetSimulateCmd = &cobra.Command{
+	Use:   "simulate [flags] case_file",
+	Short: "Show which rules match a synthetic stream, and the resulting action",
+	Long: "Show which rules of a running instance match a synthetic stream, and the resulting action, " +
+		"without any traffic. The case file (- for stdin) is a test case in the format of \"test --cases\": " +
+		"proto, ip, port, flow & analyzer props. With --rules, a rule file is used instead of a running instance.",
+	Args: cobra.ExactArgs(1),
+	Run:  runRulesetSimulate,
+}
+
+func init() {
+	rulesetLintCmd.Flags().BoolVar(&lintStrict, "strict", false, "exit with a non-zero status on warnings too")
+	rulesetLintCmd.Flags().BoolVar(&lintCosts, "costs", false, "print the estimated cost of every rule")
+	rulesetSimulateCmd.Flags().StringVar(&simulateRules, "rules", "", "rule file to simulate instead of the ruleset of a running instance")
+	for _, c := range []*cobra.Command{rulesetVersionsCmd, rulesetRollbackCmd, rulesetSimulateCmd} {
+		c.Flags().StringVar(&apiAddr, "api", "", "API address (default: api.listen from the config file)")
+		c.Flags().StringVar(&apiToken, "api-token", "", "API token (default: api.token from the config file)")
+	}
+	rulesetCmd.AddCommand(rulesetLintCmd, rulesetVersionsCmd, rulesetRollbackCmd, rulesetSimulateCmd)
+	rootCmd.AddCommand(rulesetCmd)
+}
+
+func runRulesetVersions(cmd *cobra.Command, args []string) {
+	var versions []apiRulesetVersion
+	callAPI(http.MethodGet, "/ruleset/versions", nil, &versions)
+	for _, v := range versions {
+		current := ""
+		if v.Current {
+			current = "\t(current)"
+		}
+		fmt.Printf("%d\t%s\t%s%s\n", v.ID, v.Time.Format(time.RFC3339), v.Hash[:12], current)
+	}
+}
+
+func runRulesetRollback(cmd *cobra.Command, args []string) {
+	var req apiRollbackRequest
+	if len(args) > 0 {
+		var err error
+		req.Version, err = strconv.Atoi(args[0])
+		if err != nil || req.Version <= 0 {
+			logger.Fatal("invalid version", zap.String("version", args[0]))
+		}
+	}
+	var v apiRulesetVersion
+	callAPI(http.MethodPost, "/ruleset/rollback", req, &v)
+	fmt.Printf("rolled back to version %d (%s)\n", v.ID, v.Hash[:12])
+}
+
+func runRulesetSimulate(cmd *cobra.Command, args []string) {
+	var bs []byte
+	var err error
+	if args[0] == "-" {
+		bs, err = io.ReadAll(os.Stdin)
+	} else {
+		bs, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		logger.Fatal("failed to read test case", zap.Error(err))
+	}
+	var sim apiSimulation
+	if simulateRules == "" {
+		// Sent as is, the API takes YAML too
+		callAPI(http.MethodPost, "/ruleset/simulate", bs, &sim)
+	} else {
+		var c testCase
+		if err := yaml.Unmarshal(bs, &c); err != nil {
+			logger.Fatal("failed to parse test case", zap.Error(err))
+		}
+		info, err := c.streamInfo(0)
+		if err != nil {
+			logger.Fatal("invalid test case", zap.Error(err))
+		}
+		rs := testRuleset(simulateRules, &testRulesetLogger{}, nil)
+		testCaseWorkloads.set(&c)
+		testCaseContainers.set(&c)
+		testCaseProcesses.set(&c)
+		sim = newAPISimulation(ruleset.Simulate(rs, info))
+	}
+	if sim.Selector != "" {
+		fmt.Printf("selector %s\n", sim.Selector)
+	}
+	for _, ev := range sim.Rules {
+		name := ev.Name
+		if ev.Group != "" {
+			name = ev.Group + "/" + name
+		}
+		var result string
+		switch {
+		case ev.Inactive:
+			result = "inactive"
+		case ev.Error != "":
+			result = "error"
+		case ev.Matched:
+			result = "match"
+		default:
+			result = "no match"
+		}
+		var what string
+		switch {
+		case ev.Jump != "":
+			what = "jump " + ev.Jump
+		case ev.Return:
+			what = "return"
+		case ev.DryRun:
+			what = ev.Action + " (dry-run)"
+		case ev.Action != "":
+			what = ev.Action
+		default:
+			what = "log"
+		}
+		decisive := " "
+		if ev.Decisive {
+			decisive = "*"
+		}
+		fmt.Printf("%s %-10s %-24s %s\n", decisive, result, what, name)
+		if ev.Error != "" {
+			// Expression errors span several lines, with the position in the expression
+			for _, line := range strings.Split(ev.Error, "\n") {
+				fmt.Printf("    %s\n", line)
+			}
+		}
+	}
+	if sim.Rule == "" {
+		fmt.Printf("result: %s (no match)\n", sim.Action)
+	} else {
+		fmt.Printf("result: %s (rule %s)\n", sim.Action, sim.Rule)
+	}
+}
+
+func runRulesetLint(cmd *cobra.Command, args []string) {
+	// Config is optional here, only the ruleset part is used
+	var config cliConfig
+	if err := readConfig(); err == nil {
+		if err := viper.Unmarshal(&config); err != nil {
+			logger.Fatal("failed to parse config", zap.Error(err))
+		}
+	} else if errors.As(err, &configError{}) {
+		// The file exists, but a reference can't be expanded
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	shapingClasses, err := config.shapingClasses()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	sets, err := config.sets()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	nat64, err := config.nat64()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	rawRs, _, err := config.loadRules(args[0])
+	if err != nil {
+		logger.Fatal("failed to load rules", zap.Error(err))
+	}
+	result, err := ruleset.LintExprRules(rawRs, analyzers, modifiers, &ruleset.BuiltinConfig{
+		Logger:             &rulesetLogger{},
+		GeoSiteFilename:    config.Ruleset.GeoSite,
+		GeoIpFilename:      config.Ruleset.GeoIp,
+		AppsFilename:       config.Ruleset.Apps,
+		AppsAnalyzers:      len(config.QoS.Classes) > 0,
+		ShapingClasses:     shapingClasses,
+		Sets:               sets,
+		Functions:          config.Ruleset.Functions,
+		CaptureEnabled:     config.Capture.Dir != "",
+		MirrorEnabled:      config.Mirror.Type != "",
+		DivertEnabled:      config.divertEnabled(),
+		CaptureHTTPEnabled: config.HAR.Dir != "",
+		HoneypotEnabled:    config.honeypotEnabled(),
+		Notifier:           config.testNotifier(),
+		Workloads:          config.testWorkloads(),
+		Containers:         config.testContainers(),
+		Processes:          config.testProcesses(),
+		NAT64:              nat64,
+	})
+	if err != nil {
+		logger.Fatal("failed to lint rules", zap.Error(err))
+	}
+
+	for _, issue := range result.Issues {
+		fmt.Printf("rule #%d (%s): %s: %s\n", issue.Index+1, issue.Rule, issue.Severity, issue.Message)
+	}
+	if lintCosts {
+		costs := append([]ruleset.LintRuleCost(nil), result.Costs...)
+		sort.SliceStable(costs, func(i, j int) bool { return costs[i].Cost > costs[j].Cost })
+		fmt.Println("estimated cost per evaluation:")
+		for _, c := range costs {
+			fmt.Printf("%6d  rule #%d (%s)\n", c.Cost, c.Index+1, c.Rule)
+		}
+	}
+	fmt.Printf("%d rules, %d issues\n", len(rawRs), len(result.Issues))
+	if result.HasErrors() || (lintStrict && len(result.Issues) > 0) {
+		os.Exit(1)
+	}
+}
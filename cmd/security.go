@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// securityDefaultCapabilities are kept by default: NET_ADMIN for the firewall rules (nft, tc), divert &
+// honeypot sets & health checks, NET_RAW for injecting packets.
+var securityDefaultCapabilities = []string{"net_admin", "net_raw"}
+
+var errSecurityUnsupported = errors.New("only supported on Linux")
+
+// privilegeDrop switches to an unprivileged user keeping only some capabilities, and applies
+// a seccomp filter, once the queue is attached and the firewall rules are in place.
+// Both are optional: the zero value does nothing.
+type privilegeDrop struct {
+	UID, GID int // -1 to keep running as root
+	Groups   []int
+	Caps     []uintptr
+	Seccomp  bool
+}
+
+func newPrivilegeDrop(c cliConfigSecurity) (*privilegeDrop, error) {
+	d := &privilegeDrop{UID: -1, GID: -1, Seccomp: c.Seccomp}
+	if c.User == "" {
+		if c.Group != "" || c.Capabilities != nil {
+			return nil, configError{Field: "security.user", Err: errors.New("required with group or capabilities")}
+		}
+		return d, nil
+	}
+	if securityCapabilities == nil {
+		return nil, configError{Field: "security.user", Err: errSecurityUnsupported}
+	}
+	u, err := user.Lookup(c.User)
+	if err != nil {
+		return nil, configError{Field: "security.user", Err: err}
+	}
+	d.UID, _ = strconv.Atoi(u.Uid)
+	d.GID, _ = strconv.Atoi(u.Gid)
+	if d.UID == 0 {
+		return nil, configError{Field: "security.user", Err: errors.New("must not be root")}
+	}
+	if c.Group != "" {
+		g, err := user.LookupGroup(c.Group)
+		if err != nil {
+			return nil, configError{Field: "security.group", Err: err}
+		}
+		d.GID, _ = strconv.Atoi(g.Gid)
+	}
+	// Supplementary groups, for access to e.g. the log directories; no error if they can't be listed
+	gids, _ := u.GroupIds()
+	for _, gid := range gids {
+		if id, err := strconv.Atoi(gid); err == nil {
+			d.Groups = append(d.Groups, id)
+		}
+	}
+	caps := c.Capabilities
+	if caps == nil {
+		caps = securityDefaultCapabilities
+	}
+	for _, name := range caps {
+		c, ok := securityCapabilities[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+		if !ok {
+			return nil, configError{Field: "security.capabilities", Err: fmt.Errorf("unsupported capability %q", name)}
+		}
+		d.Caps = append(d.Caps, c)
+	}
+	return d, nil
+}
+
+// Apply drops the privileges of every thread of the process. Child processes (nft, tc...)
+// get the kept capabilities too, as ambient capabilities.
+func (d *privilegeDrop) Apply() error {
+	if d.UID >= 0 {
+		if err := d.setUser(); err != nil {
+			return fmt.Errorf("failed to drop privileges: %w", err)
+		}
+		logger.Info("privileges dropped")
+	}
+	if d.Seccomp {
+		if err := applySeccomp(); err != nil {
+			return fmt.Errorf("failed to apply seccomp filter: %w", err)
+		}
+		logger.Info("seccomp filter applied")
+	}
+	return nil
+}
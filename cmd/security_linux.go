@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// securityCapabilities are the capabilities that can be kept, by their name in capabilities(7),
+// in lower case without CAP_.
+var securityCapabilities = map[string]uintptr{
+	"chown":            unix.CAP_CHOWN,
+	"dac_override":     unix.CAP_DAC_OVERRIDE,
+	"dac_read_search":  unix.CAP_DAC_READ_SEARCH,
+	"fowner":           unix.CAP_FOWNER,
+	"ipc_lock":         unix.CAP_IPC_LOCK,
+	"kill":             unix.CAP_KILL,
+	"net_admin":        unix.CAP_NET_ADMIN,
+	"net_bind_service": unix.CAP_NET_BIND_SERVICE,
+	"net_raw":          unix.CAP_NET_RAW,
+	"sys_nice":         unix.CAP_SYS_NICE,
+	"sys_resource":     unix.CAP_SYS_RESOURCE,
+}
+
+// seccompDeniedSyscalls fail with EPERM under the seccomp filter: nothing OpenGFW, nft, iptables or tc
+// need, but what an attacker would to escalate or persist (kernel modules, mounts, namespaces, tracing...).
+var seccompDeniedSyscalls = []uintptr{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_ADJTIMEX,
+	unix.SYS_BPF,
+	unix.SYS_CHROOT,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_FSMOUNT,
+	unix.SYS_FSOPEN,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_MOUNT,
+	unix.SYS_MOVE_MOUNT,
+	unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_OPEN_TREE,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_SYSLOG,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_VHANGUP,
+}
+
+var errAllThreadsCgo = errors.New("not supported by builds with cgo, build with CGO_ENABLED=0")
+
+func (d *privilegeDrop) setUser() error {
+	if os.Geteuid() != 0 {
+		return errors.New("not running as root")
+	}
+	var keep [2]unix.CapUserData
+	for _, c := range d.Caps {
+		keep[c/32].Permitted |= 1 << (c % 32)
+	}
+	keep[0].Effective, keep[1].Effective = keep[0].Permitted, keep[1].Permitted
+	keep[0].Inheritable, keep[1].Inheritable = keep[0].Permitted, keep[1].Permitted
+
+	// Capabilities are per thread, unlike user & group IDs, which Go changes on every thread
+	// Bounding set first, as it takes CAP_SETPCAP
+	for c := uintptr(0); c <= lastCapability(); c++ {
+		if keep[c/32].Permitted&(1<<(c%32)) == 0 {
+			if err := allThreadsPrctl(unix.PR_CAPBSET_DROP, c); err != nil {
+				return fmt.Errorf("PR_CAPBSET_DROP: %w", err)
+			}
+		}
+	}
+	// Keep the permitted capabilities when switching from root
+	if err := allThreadsPrctl(unix.PR_SET_KEEPCAPS, 1); err != nil {
+		return fmt.Errorf("PR_SET_KEEPCAPS: %w", err)
+	}
+	if err := syscall.Setgroups(d.Groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setresgid(d.GID, d.GID, d.GID); err != nil {
+		return fmt.Errorf("setresgid: %w", err)
+	}
+	if err := syscall.Setresuid(d.UID, d.UID, d.UID); err != nil {
+		return fmt.Errorf("setresuid: %w", err)
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&keep[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", allThreadsError(errno))
+	}
+	for _, c := range d.Caps {
+		if err := allThreadsPrctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c); err != nil {
+			return fmt.Errorf("PR_CAP_AMBIENT_RAISE: %w", err)
+		}
+	}
+	return allThreadsPrctl(unix.PR_SET_KEEPCAPS, 0)
+}
+
+// lastCapability returns the highest capability supported by the kernel.
+func lastCapability() uintptr {
+	bs, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	c, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return uintptr(c)
+}
+
+func allThreadsPrctl(option int, args ...uintptr) error {
+	var a [2]uintptr
+	copy(a[:], args)
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, uintptr(option), a[0], a[1]); errno != 0 {
+		return allThreadsError(errno)
+	}
+	return nil
+}
+
+func allThreadsError(errno syscall.Errno) error {
+	if errno == syscall.ENOTSUP {
+		return errAllThreadsCgo
+	}
+	return errno
+}
+
+// applySeccomp installs a filter making seccompDeniedSyscalls fail, on every thread.
+// It also sets no_new_privs, so setuid binaries can no longer gain privileges.
+func applySeccomp() error {
+	var arch uint32
+	switch runtime.GOARCH {
+	case "386":
+		arch = unix.AUDIT_ARCH_I386
+	case "amd64":
+		arch = unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		arch = unix.AUDIT_ARCH_AARCH64
+	default:
+		return fmt.Errorf("unsupported architecture %s", runtime.GOARCH)
+	}
+	deny := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	n := uint8(len(seccompDeniedSyscalls))
+	filter := []unix.SockFilter{
+		// struct seccomp_data: int nr; __u32 arch; ...
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: deny}, // Other ABIs (e.g. 32-bit on 64-bit)
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+	}
+	if arch == unix.AUDIT_ARCH_X86_64 {
+		// x32 syscalls have the same arch, but 0x40000000 set
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: n + 1, K: 0x40000000})
+	}
+	for i, nr := range seccompDeniedSyscalls {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: n - uint8(i), K: uint32(nr)})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: deny},
+	)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is set on the other threads by TSYNC
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %w", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
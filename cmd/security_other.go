@@ -0,0 +1,14 @@
+//go:build !linux
+
+package cmd
+
+// securityCapabilities is nil, as dropping privileges & seccomp are only supported on Linux.
+var securityCapabilities map[string]uintptr
+
+func (d *privilegeDrop) setUser() error {
+	return errSecurityUnsupported
+}
+
+func applySeccomp() error {
+	return errSecurityUnsupported
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"github.com/spf13/cobra"
+)
+
+// Flags
+var (
+	setTTL time.Duration
+)
+
+var setCmd = &cobra.Command{
+	Use:   "set",
+	Short: "Manage the named sets of a running instance through its API",
+}
+
+var setListCmd = &cobra.Command{
+	Use:   "list [set_name]",
+	Short: "List all sets, or the entries of a set",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   runSetList,
+}
+
+var setAddCmd = &cobra.Command{
+	Use:   "add set_name entry...",
+	Short: "Add entries to a set",
+	Args:  cobra.MinimumNArgs(2),
+	Run:   runSetModify,
+}
+
+var setRemoveCmd = &cobra.Command{
+	Use:   "remove set_name entry...",
+	Short: "Remove entries from a set",
+	Args:  cobra.MinimumNArgs(2),
+	Run:   runSetModify,
+}
+
+func init() {
+	setCmd.PersistentFlags().StringVar(&apiAddr, "api", "", "API address (default: api.listen from the config file)")
+	setCmd.PersistentFlags().StringVar(&apiToken, "api-token", "", "API token (default: api.token from the config file)")
+	setAddCmd.Flags().DurationVar(&setTTL, "ttl", 0, "expire the entries after this duration (0 = never)")
+	setCmd.AddCommand(setListCmd, setAddCmd, setRemoveCmd)
+	rootCmd.AddCommand(setCmd)
+}
+
+func runSetList(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		var sets []apiSetInfo
+		callAPI(http.MethodGet, "/sets", nil, &sets)
+		for _, s := range sets {
+			fmt.Printf("%s\t%s\t%d\n", s.Name, s.Type, s.Size)
+		}
+		return
+	}
+	var entries []builtins.SetEntry
+	callAPI(http.MethodGet, "/sets/"+url.PathEscape(args[0]), nil, &entries)
+	for _, e := range entries {
+		if e.Expiry.IsZero() {
+			fmt.Println(e.Value)
+		} else {
+			fmt.Printf("%s\t(expires %s)\n", e.Value, e.Expiry.Format(time.RFC3339))
+		}
+	}
+}
+
+func runSetModify(cmd *cobra.Command, args []string) {
+	req := apiSetEntriesRequest{Entries: args[1:]}
+	method := http.MethodDelete
+	if cmd.Name() == "add" {
+		method = http.MethodPost
+		if setTTL > 0 {
+			req.TTL = setTTL.String()
+		}
+	}
+	var resp apiSetEntriesResponse
+	callAPI(method, "/sets/"+url.PathEscape(args[0]), req, &resp)
+	if cmd.Name() == "add" {
+		fmt.Printf("%d entries added\n", resp.Count)
+	} else {
+		fmt.Printf("%d entries removed\n", resp.Count)
+	}
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset"
+	"github.com/apernet/OpenGFW/sink"
+)
+
+const (
+	sinkholeRuleName          = "sinkhole"
+	sinkholeDefaultA          = "0.0.0.0"
+	sinkholeDefaultAAAA       = "::"
+	sinkholeDefaultTTL        = 60
+	sinkholeDefaultMaxClients = 10000
+	sinkholeMaxDomains        = 100 // Counted per client, the other domains only in the total
+)
+
+// sinkhole answers the DNS queries for the domains of its lists with its own addresses (or NXDOMAIN),
+// like Pi-hole but inline: the "sinkhole" rule it generates is evaluated before all the others,
+// and answers through the dns modifier (the responses of the server for UDP, the queries themselves for TCP).
+// Domains of the exclusion lists and clients of the excluded networks are left alone.
+// The sinkholed queries are counted per client, and logged to a file if configured.
+// A nil *sinkhole records nothing.
+type sinkhole struct {
+	Lists          []string // Domain sets
+	Exclude        []string // Domain sets
+	ExcludeClients []string // CIDRs
+	NXDomain       bool
+	A, AAAA        string
+	TTL            int
+	MaxClients     int
+	Log            *sink.File // Optional
+
+	mutex   sync.Mutex
+	total   uint64
+	clients map[string]*sinkholeClient
+}
+
+type sinkholeClient struct {
+	Queries   uint64
+	LastQuery time.Time
+	Domains   map[string]uint64
+}
+
+// sinkholeRecord is a line of the log of the sinkholed queries.
+type sinkholeRecord struct {
+	Timestamp string `json:"timestamp"`
+	Client    string `json:"client"`
+	Server    string `json:"server"`
+	Proto     string `json:"proto"`
+	Domain    string `json:"domain"`
+	Type      string `json:"type"`
+}
+
+// Rules returns the rule of the sinkhole, to be evaluated before the others.
+func (s *sinkhole) Rules() []ruleset.ExprRule {
+	var lists, excluded []string
+	for _, name := range s.Lists {
+		lists = append(lists, fmt.Sprintf("in_set(%s, string(dns.questions[0].name))", strconv.Quote(name)))
+	}
+	for _, name := range s.Exclude {
+		excluded = append(excluded, fmt.Sprintf("in_set(%s, string(dns.questions[0].name))", strconv.Quote(name)))
+	}
+	for _, cidr := range s.ExcludeClients {
+		excluded = append(excluded, fmt.Sprintf("cidr(ip.src, %s)", strconv.Quote(cidr)))
+	}
+	// Over UDP the response of the server is rewritten, over TCP the query is answered
+	expr := `dns != nil && len(dns.questions) > 0 && (proto == "udp" ? dns.qr : !dns.qr) && (` +
+		strings.Join(lists, " || ") + ")"
+	if !s.NXDomain {
+		// Only A & AAAA queries are answered with addresses, the others are left alone
+		expr += ` && string(dns.questions[0].type) in ["A", "AAAA"]`
+	}
+	if len(excluded) > 0 {
+		expr += " && !(" + strings.Join(excluded, " || ") + ")"
+	}
+	args := map[string]interface{}{"ttl": s.TTL}
+	if s.NXDomain {
+		args["nxdomain"] = true
+	} else {
+		args["a"], args["aaaa"] = s.A, s.AAAA
+	}
+	return []ruleset.ExprRule{{
+		Name:   sinkholeRuleName,
+		Action: ruleset.ActionModify.String(),
+		Modifier: ruleset.ModifierEntry{
+			Name: "dns",
+			Args: args,
+		},
+		Expr: expr,
+	}}
+}
+
+// StreamAction counts & logs the query of a stream if the sinkhole rule matched it.
+func (s *sinkhole) StreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	if s == nil || noMatch || rule != sinkholeRuleName {
+		return
+	}
+	questions, _ := info.Props["dns"]["questions"].([]analyzer.PropMap)
+	if len(questions) == 0 {
+		return
+	}
+	name, _ := questions[0]["name"].(string)
+	domain := normalizeDomain(name)
+	client := info.SrcIP.String()
+	now := time.Now()
+	s.mutex.Lock()
+	s.total++
+	c := s.clients[client]
+	if c == nil && len(s.clients) < s.MaxClients {
+		c = &sinkholeClient{Domains: make(map[string]uint64)}
+		s.clients[client] = c
+	}
+	if c != nil {
+		c.Queries++
+		c.LastQuery = now
+		if _, ok := c.Domains[domain]; ok || len(c.Domains) < sinkholeMaxDomains {
+			c.Domains[domain]++
+		}
+	}
+	s.mutex.Unlock()
+	if s.Log == nil {
+		return
+	}
+	data, err := json.Marshal(sinkholeRecord{
+		Timestamp: now.Format(time.RFC3339Nano),
+		Client:    client,
+		Server:    info.DstIP.String(),
+		Proto:     info.Protocol.String(),
+		Domain:    domain,
+		Type:      fmt.Sprint(questions[0]["type"]),
+	})
+	if err != nil {
+		return
+	}
+	s.Log.Send(sink.Event{Type: sinkholeRuleName, Time: now, Data: data})
+}
+
+// sinkholeStats are the statistics of the sinkhole, served by the API.
+type sinkholeStats struct {
+	Total   uint64                `json:"total"`
+	Clients []sinkholeClientStats `json:"clients"` // Most sinkholed first
+}
+
+type sinkholeClientStats struct {
+	Client    string                `json:"client"`
+	Queries   uint64                `json:"queries"`
+	LastQuery time.Time             `json:"lastQuery"`
+	Domains   []sinkholeDomainStats `json:"domains"` // Most sinkholed first
+}
+
+type sinkholeDomainStats struct {
+	Domain  string `json:"domain"`
+	Queries uint64 `json:"queries"`
+}
+
+// Stats returns the statistics of a client, or of all of them if client is empty.
+func (s *sinkhole) Stats(client string) sinkholeStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	st := sinkholeStats{Total: s.total, Clients: []sinkholeClientStats{}}
+	for ip, c := range s.clients {
+		if client != "" && ip != client {
+			continue
+		}
+		cs := sinkholeClientStats{Client: ip, Queries: c.Queries, LastQuery: c.LastQuery}
+		for domain, n := range c.Domains {
+			cs.Domains = append(cs.Domains, sinkholeDomainStats{Domain: domain, Queries: n})
+		}
+		sort.Slice(cs.Domains, func(i, j int) bool {
+			if cs.Domains[i].Queries != cs.Domains[j].Queries {
+				return cs.Domains[i].Queries > cs.Domains[j].Queries
+			}
+			return cs.Domains[i].Domain < cs.Domains[j].Domain
+		})
+		st.Clients = append(st.Clients, cs)
+	}
+	sort.Slice(st.Clients, func(i, j int) bool {
+		if st.Clients[i].Queries != st.Clients[j].Queries {
+			return st.Clients[i].Queries > st.Clients[j].Queries
+		}
+		return st.Clients[i].Client < st.Clients[j].Client
+	})
+	return st
+}
+
+// Reopen reopens the log, for log rotation.
+func (s *sinkhole) Reopen() error {
+	if s == nil || s.Log == nil {
+		return nil
+	}
+	return s.Log.Reopen()
+}
+
+// Check returns the error of the latest write to the log.
+func (s *sinkhole) Check() error {
+	if s.Log == nil {
+		return nil
+	}
+	return s.Log.Check()
+}
+
+// Close closes the log.
+func (s *sinkhole) Close() error {
+	if s == nil || s.Log == nil {
+		return nil
+	}
+	return s.Log.Close()
+}
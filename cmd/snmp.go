@@ -0,0 +1,579 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	stdio "io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/io"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// snmpDefaultOID is in net-snmp's playground (netSnmpPlaypen), for local use,
+	// as OpenGFW has no enterprise number. See docs/OPENGFW-MIB.txt.
+	snmpDefaultOID            = "1.3.6.1.4.1.8072.9999.9999.1"
+	snmpDefaultAgentX         = "/var/agentx/master"
+	snmpReconnectInterval     = 10 * time.Second
+	snmpAgentXTimeout         = 10 * time.Second
+	snmpAgentXMaxPayload      = 64 * 1024
+	snmpAgentXMaxRepetitions  = 1024
+	snmpAgentXHeaderLength    = 20
+	snmpAgentXVersion         = 1
+	snmpAgentXFlagNonDefault  = 0x08
+	snmpAgentXFlagNetworkByte = 0x10
+	snmpAgentXCloseShutdown   = 5
+	snmpAgentXNotWritable     = 17
+	snmpAgentXParseError      = 266
+)
+
+// AgentX PDU types (RFC 2741)
+const (
+	agentxOpen      = 1
+	agentxClose     = 2
+	agentxRegister  = 3
+	agentxGet       = 5
+	agentxGetNext   = 6
+	agentxGetBulk   = 7
+	agentxTestSet   = 8
+	agentxCommitSet = 9
+	agentxUndoSet   = 10
+	agentxCleanup   = 11
+	agentxResponse  = 18
+)
+
+// AgentX value types
+const (
+	agentxGauge32        = 66
+	agentxCounter64      = 70
+	agentxOctetString    = 4
+	agentxNoSuchObject   = 128
+	agentxNoSuchInstance = 129
+	agentxEndOfMibView   = 130
+)
+
+// snmpVerdicts are the verdicts exposed, with their index in the verdict table of the MIB.
+var snmpVerdicts = []io.Verdict{
+	io.VerdictAccept,
+	io.VerdictAcceptModify,
+	io.VerdictAcceptStream,
+	io.VerdictDrop,
+	io.VerdictDropStream,
+	io.VerdictDivertStream,
+	io.VerdictHoneypotStream,
+}
+
+type snmpOID []uint32
+
+func parseSNMPOID(s string) (snmpOID, error) {
+	var oid snmpOID
+	for _, part := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, uint32(n))
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
+
+func (o snmpOID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// append returns the OID with sub-identifiers appended, without modifying o.
+func (o snmpOID) append(subs ...uint32) snmpOID {
+	return append(append(make(snmpOID, 0, len(o)+len(subs)), o...), subs...)
+}
+
+// snmpVarBind is a variable of the MIB, or the answer for a variable that doesn't exist (Value nil).
+type snmpVarBind struct {
+	OID   snmpOID
+	Type  uint16
+	Value interface{} // uint32, uint64 or string
+}
+
+// snmpAgent is an AgentX subagent (RFC 2741), exposing the statistics of the engine through
+// the SNMP agent of the host (e.g. net-snmp's snmpd with "master agentx"), for monitoring systems
+// that only speak SNMP. Everything is read-only.
+//
+// Under the base OID (see docs/OPENGFW-MIB.txt):
+//
+//	.1.0   packets handled (Counter64)
+//	.2.1.2.<verdict> name of the verdict, indexed from 1 in the order of snmpVerdicts
+//	.2.1.3.<verdict> packets with the verdict (Counter64)
+//	.3.1.0 TCP streams created (Counter64)
+//	.3.2.0 UDP streams created (Counter64)
+//	.3.3.0 TCP streams being tracked (Gauge32)
+//	.3.4.0 UDP streams being tracked (Gauge32)
+//	.4.1.0 packets waiting in the worker queues (Gauge32)
+//	.4.2.0 size of the worker queues (Gauge32)
+//	.4.3.0 packets that had to wait for room in a full worker queue (Counter64)
+//	.4.4.0 workers (Gauge32)
+type snmpAgent struct {
+	Network string // unix or tcp
+	Address string
+	OID     snmpOID
+	Stats   func() engine.Stats
+
+	start time.Time
+}
+
+// newSNMPAgent creates an agent connecting to the master agent at address, in net-snmp's format:
+// the path of a unix socket, or tcp:host:port.
+func newSNMPAgent(address, oid string, stats func() engine.Stats) (*snmpAgent, error) {
+	if address == "" {
+		address = snmpDefaultAgentX
+	}
+	if oid == "" {
+		oid = snmpDefaultOID
+	}
+	a := &snmpAgent{Network: "unix", Address: address, Stats: stats, start: time.Now()}
+	if strings.HasPrefix(address, "tcp:") {
+		a.Network, a.Address = "tcp", strings.TrimPrefix(address, "tcp:")
+		if _, _, err := net.SplitHostPort(a.Address); err != nil {
+			return nil, err
+		}
+	} else {
+		a.Address = strings.TrimPrefix(address, "unix:")
+	}
+	var err error
+	if a.OID, err = parseSNMPOID(oid); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Run serves the master agent until the context is cancelled, reconnecting when the connection is lost.
+func (a *snmpAgent) Run(ctx context.Context) {
+	for {
+		err := a.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("AgentX session ended, reconnecting",
+			zap.String("address", a.Address), zap.Duration("after", snmpReconnectInterval), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(snmpReconnectInterval):
+		}
+	}
+}
+
+// variables returns the variables of the MIB, sorted by OID.
+func (a *snmpAgent) variables() []snmpVarBind {
+	st := a.Stats()
+	vars := []snmpVarBind{
+		{a.OID.append(1, 0), agentxCounter64, st.Packets},
+	}
+	for i, v := range snmpVerdicts {
+		vars = append(vars, snmpVarBind{a.OID.append(2, 1, 2, uint32(i+1)), agentxOctetString, otlpVerdictNames[v]})
+	}
+	for i, v := range snmpVerdicts {
+		vars = append(vars, snmpVarBind{a.OID.append(2, 1, 3, uint32(i+1)), agentxCounter64, st.Verdicts[v]})
+	}
+	return append(vars,
+		snmpVarBind{a.OID.append(3, 1, 0), agentxCounter64, st.TCPStreams},
+		snmpVarBind{a.OID.append(3, 2, 0), agentxCounter64, st.UDPStreams},
+		snmpVarBind{a.OID.append(3, 3, 0), agentxGauge32, snmpGauge(st.ActiveTCPStreams)},
+		snmpVarBind{a.OID.append(3, 4, 0), agentxGauge32, snmpGauge(st.ActiveUDPStreams)},
+		snmpVarBind{a.OID.append(4, 1, 0), agentxGauge32, snmpGauge(st.QueueLength)},
+		snmpVarBind{a.OID.append(4, 2, 0), agentxGauge32, snmpGauge(st.QueueCapacity)},
+		snmpVarBind{a.OID.append(4, 3, 0), agentxCounter64, st.QueueFull},
+		snmpVarBind{a.OID.append(4, 4, 0), agentxGauge32, snmpGauge(uint64(st.Workers))},
+	)
+}
+
+// snmpGauge caps a value to the maximum of a Gauge32.
+func snmpGauge(n uint64) uint32 {
+	if n > 0xffffffff {
+		return 0xffffffff
+	}
+	return uint32(n)
+}
+
+// AgentX session
+
+type agentxHeader struct {
+	Type          uint8
+	Flags         uint8
+	SessionID     uint32
+	TransactionID uint32
+	PacketID      uint32
+}
+
+// agentxSearchRange is a range of OIDs of a Get, GetNext or GetBulk request.
+type agentxSearchRange struct {
+	Start   snmpOID
+	Include bool // Whether Start itself can be returned by GetNext
+	End     snmpOID
+}
+
+type agentxConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	mutex     sync.Mutex // For writes & sessionID
+	sessionID uint32
+	packetID  uint32 // Of the requests sent, only used before the session starts serving requests
+}
+
+// session opens a session with the master agent, registers the base OID and answers its requests.
+func (a *snmpAgent) session(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: snmpAgentXTimeout}
+	conn, err := dialer.DialContext(ctx, a.Network, a.Address)
+	if err != nil {
+		return err
+	}
+	c := &agentxConn{conn: conn, r: bufio.NewReader(conn)}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Tell the master agent, which otherwise keeps the registration until it notices
+			_ = c.close(snmpAgentXCloseShutdown)
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+
+	// Open, with the base OID as the subagent's ID
+	open := []byte{byte(snmpAgentXTimeout / time.Second), 0, 0, 0}
+	open = agentxAppendOID(open, a.OID, false)
+	open = agentxAppendString(open, "OpenGFW")
+	if _, err := c.call(agentxOpen, open); err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	// Register the base OID: timeout (default), priority (default), no range
+	register := agentxAppendOID([]byte{0, 127, 0, 0}, a.OID, false)
+	if _, err := c.call(agentxRegister, register); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	logger.Info("AgentX session opened", zap.String("address", a.Address), zap.Stringer("oid", a.OID))
+	_ = conn.SetDeadline(time.Time{})
+
+	for {
+		h, payload, err := c.read()
+		if err != nil {
+			return err
+		}
+		var resp []byte
+		switch h.Type {
+		case agentxGet, agentxGetNext, agentxGetBulk:
+			resp, err = a.handleGet(h, payload)
+			if err != nil {
+				resp = agentxResponsePayload(a.uptime(), snmpAgentXParseError, 0, nil)
+			}
+		case agentxTestSet:
+			resp = agentxResponsePayload(a.uptime(), snmpAgentXNotWritable, 1, nil)
+		case agentxCommitSet, agentxUndoSet, agentxCleanup:
+			resp = agentxResponsePayload(a.uptime(), 0, 0, nil)
+		case agentxClose:
+			return errors.New("closed by the master agent")
+		default:
+			// Responses to nothing we've sent, notifications...
+			continue
+		}
+		if h.Type == agentxCleanup {
+			continue // No response expected
+		}
+		h.Type = agentxResponse
+		if err := c.write(h, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// uptime returns the time since the agent was created, in hundredths of a second.
+func (a *snmpAgent) uptime() uint32 {
+	return uint32(time.Since(a.start) / (10 * time.Millisecond))
+}
+
+// handleGet answers a Get, GetNext or GetBulk request.
+func (a *snmpAgent) handleGet(h agentxHeader, payload []byte) ([]byte, error) {
+	order := agentxByteOrder(h.Flags)
+	if h.Flags&snmpAgentXFlagNonDefault != 0 {
+		// Context, which is ignored: the same variables are in every context
+		_, n, err := agentxReadString(order, payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[n:]
+	}
+	var nonRepeaters, maxRepetitions int
+	if h.Type == agentxGetBulk {
+		if len(payload) < 4 {
+			return nil, errors.New("short GetBulk")
+		}
+		nonRepeaters = int(order.Uint16(payload))
+		maxRepetitions = int(order.Uint16(payload[2:]))
+		if maxRepetitions > snmpAgentXMaxRepetitions {
+			maxRepetitions = snmpAgentXMaxRepetitions
+		}
+		payload = payload[4:]
+	}
+	var ranges []agentxSearchRange
+	for len(payload) > 0 {
+		var sr agentxSearchRange
+		var n int
+		var err error
+		if sr.Start, sr.Include, n, err = agentxReadOID(order, payload); err != nil {
+			return nil, err
+		}
+		payload = payload[n:]
+		if sr.End, _, n, err = agentxReadOID(order, payload); err != nil {
+			return nil, err
+		}
+		payload = payload[n:]
+		ranges = append(ranges, sr)
+	}
+
+	vars := a.variables()
+	var results []snmpVarBind
+	switch h.Type {
+	case agentxGet:
+		for _, sr := range ranges {
+			results = append(results, snmpGet(vars, sr.Start))
+		}
+	case agentxGetNext:
+		for _, sr := range ranges {
+			results = append(results, snmpGetNext(vars, sr))
+		}
+	case agentxGetBulk:
+		if nonRepeaters > len(ranges) {
+			nonRepeaters = len(ranges)
+		}
+		for _, sr := range ranges[:nonRepeaters] {
+			results = append(results, snmpGetNext(vars, sr))
+		}
+		repeaters := ranges[nonRepeaters:]
+		for i := 0; i < maxRepetitions && len(repeaters) > 0; i++ {
+			allEnd := true
+			for j := range repeaters {
+				vb := snmpGetNext(vars, repeaters[j])
+				results = append(results, vb)
+				if vb.Type != agentxEndOfMibView {
+					allEnd = false
+					repeaters[j].Start, repeaters[j].Include = vb.OID, false
+				}
+			}
+			if allEnd {
+				break
+			}
+		}
+	}
+	return agentxResponsePayload(a.uptime(), 0, 0, results), nil
+}
+
+// snmpGet returns the variable with an OID, or noSuchInstance/noSuchObject.
+func snmpGet(vars []snmpVarBind, oid snmpOID) snmpVarBind {
+	for _, v := range vars {
+		if slices.Equal(v.OID, oid) {
+			return v
+		}
+	}
+	for _, v := range vars {
+		if len(oid) > 0 && slices.Equal(v.OID[:len(v.OID)-1], oid[:len(oid)-1]) {
+			return snmpVarBind{OID: oid, Type: agentxNoSuchInstance}
+		}
+	}
+	return snmpVarBind{OID: oid, Type: agentxNoSuchObject}
+}
+
+// snmpGetNext returns the first variable in a search range, or endOfMibView.
+func snmpGetNext(vars []snmpVarBind, sr agentxSearchRange) snmpVarBind {
+	for _, v := range vars {
+		c := slices.Compare(v.OID, sr.Start)
+		if c < 0 || (c == 0 && !sr.Include) {
+			continue
+		}
+		if len(sr.End) > 0 && slices.Compare(v.OID, sr.End) >= 0 {
+			break
+		}
+		return v
+	}
+	return snmpVarBind{OID: sr.Start, Type: agentxEndOfMibView}
+}
+
+// call sends a PDU and waits for its response, which must be successful.
+// It's only used before the session starts serving requests.
+func (c *agentxConn) call(typ uint8, payload []byte) ([]byte, error) {
+	c.packetID++
+	c.mutex.Lock()
+	h := agentxHeader{Type: typ, SessionID: c.sessionID, PacketID: c.packetID}
+	c.mutex.Unlock()
+	if err := c.write(h, payload); err != nil {
+		return nil, err
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(snmpAgentXTimeout))
+	for {
+		rh, resp, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if rh.Type != agentxResponse || rh.PacketID != h.PacketID {
+			continue
+		}
+		if len(resp) < 8 {
+			return nil, errors.New("short response")
+		}
+		if code := agentxByteOrder(rh.Flags).Uint16(resp[4:]); code != 0 {
+			return nil, fmt.Errorf("error %d", code)
+		}
+		c.mutex.Lock()
+		c.sessionID = rh.SessionID
+		c.mutex.Unlock()
+		return resp[8:], nil
+	}
+}
+
+// close closes the session, for a reason.
+func (c *agentxConn) close(reason uint8) error {
+	c.mutex.Lock()
+	h := agentxHeader{Type: agentxClose, SessionID: c.sessionID}
+	c.mutex.Unlock()
+	return c.write(h, []byte{reason, 0, 0, 0})
+}
+
+func (c *agentxConn) write(h agentxHeader, payload []byte) error {
+	b := make([]byte, 0, snmpAgentXHeaderLength+len(payload))
+	b = append(b, snmpAgentXVersion, h.Type, snmpAgentXFlagNetworkByte, 0)
+	b = binary.BigEndian.AppendUint32(b, h.SessionID)
+	b = binary.BigEndian.AppendUint32(b, h.TransactionID)
+	b = binary.BigEndian.AppendUint32(b, h.PacketID)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	b = append(b, payload...)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *agentxConn) read() (agentxHeader, []byte, error) {
+	var hb [snmpAgentXHeaderLength]byte
+	if _, err := stdio.ReadFull(c.r, hb[:]); err != nil {
+		return agentxHeader{}, nil, err
+	}
+	if hb[0] != snmpAgentXVersion {
+		return agentxHeader{}, nil, fmt.Errorf("unsupported AgentX version %d", hb[0])
+	}
+	order := agentxByteOrder(hb[2])
+	h := agentxHeader{
+		Type:          hb[1],
+		Flags:         hb[2],
+		SessionID:     order.Uint32(hb[4:]),
+		TransactionID: order.Uint32(hb[8:]),
+		PacketID:      order.Uint32(hb[12:]),
+	}
+	length := order.Uint32(hb[16:])
+	if length > snmpAgentXMaxPayload {
+		return h, nil, fmt.Errorf("PDU too large (%d bytes)", length)
+	}
+	payload := make([]byte, length)
+	_, err := stdio.ReadFull(c.r, payload)
+	return h, payload, err
+}
+
+func agentxByteOrder(flags uint8) binary.ByteOrder {
+	if flags&snmpAgentXFlagNetworkByte != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// agentxResponsePayload returns the payload of a Response PDU.
+func agentxResponsePayload(uptime uint32, code, index uint16, vars []snmpVarBind) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uptime)
+	b = binary.BigEndian.AppendUint16(b, code)
+	b = binary.BigEndian.AppendUint16(b, index)
+	for _, v := range vars {
+		b = binary.BigEndian.AppendUint16(b, v.Type)
+		b = append(b, 0, 0)
+		b = agentxAppendOID(b, v.OID, false)
+		switch x := v.Value.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, x)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, x)
+		case string:
+			b = agentxAppendString(b, x)
+		}
+	}
+	return b
+}
+
+// agentxAppendOID encodes an OID, with the 1.3.6.1.x prefix compressed.
+func agentxAppendOID(b []byte, oid snmpOID, include bool) []byte {
+	prefix := uint8(0)
+	if len(oid) >= 5 && slices.Equal(oid[:4], snmpOID{1, 3, 6, 1}) && oid[4] > 0 && oid[4] < 256 {
+		prefix, oid = uint8(oid[4]), oid[5:]
+	}
+	var inc uint8
+	if include {
+		inc = 1
+	}
+	b = append(b, uint8(len(oid)), prefix, inc, 0)
+	for _, n := range oid {
+		b = binary.BigEndian.AppendUint32(b, n)
+	}
+	return b
+}
+
+// agentxReadOID decodes an OID, and returns it, its include flag, and its encoded length.
+func agentxReadOID(order binary.ByteOrder, b []byte) (snmpOID, bool, int, error) {
+	if len(b) < 4 {
+		return nil, false, 0, errors.New("short OID")
+	}
+	count, prefix, include := int(b[0]), b[1], b[2] != 0
+	n := 4 + 4*count
+	if len(b) < n {
+		return nil, false, 0, errors.New("short OID")
+	}
+	var oid snmpOID
+	if prefix != 0 {
+		oid = snmpOID{1, 3, 6, 1, uint32(prefix)}
+	}
+	for i := 0; i < count; i++ {
+		oid = append(oid, order.Uint32(b[4+4*i:]))
+	}
+	return oid, include, n, nil
+}
+
+// agentxAppendString encodes an octet string, padded to 4 bytes.
+func agentxAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	b = append(b, s...)
+	return append(b, make([]byte, (4-len(s)%4)%4)...)
+}
+
+// agentxReadString decodes an octet string, and returns it and its encoded length.
+func agentxReadString(order binary.ByteOrder, b []byte) (string, int, error) {
+	if len(b) < 4 {
+		return "", 0, errors.New("short octet string")
+	}
+	length := int(order.Uint32(b))
+	n := 4 + (length+3)&^3
+	if length < 0 || len(b) < n {
+		return "", 0, errors.New("short octet string")
+	}
+	return string(b[4 : 4+length]), n, nil
+}
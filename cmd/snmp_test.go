@@ -0,0 +1,399 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/io"
+
+	"go.uber.org/zap"
+)
+
+func TestAgentxOID(t *testing.T) {
+	testCases := []struct {
+		name    string
+		oid     snmpOID
+		include bool
+		want    []byte
+	}{
+		{
+			name: "prefix",
+			oid:  snmpOID{1, 3, 6, 1, 4, 1, 8072},
+			want: []byte{2, 4, 0, 0, 0, 0, 0, 1, 0, 0, 0x1f, 0x88},
+		},
+		{
+			name:    "prefix only, included",
+			oid:     snmpOID{1, 3, 6, 1, 2},
+			include: true,
+			want:    []byte{0, 2, 1, 0},
+		},
+		{
+			name: "no prefix",
+			oid:  snmpOID{1, 3, 6, 2, 1},
+			want: []byte{5, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 6, 0, 0, 0, 2, 0, 0, 0, 1},
+		},
+		{
+			name: "prefix out of range",
+			oid:  snmpOID{1, 3, 6, 1, 256, 1},
+			want: []byte{6, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 6, 0, 0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := agentxAppendOID(nil, tc.oid, tc.include)
+			if !reflect.DeepEqual(b, tc.want) {
+				t.Fatalf("agentxAppendOID() = %v, want %v", b, tc.want)
+			}
+			oid, include, n, err := agentxReadOID(binary.BigEndian, append(b, 0xff))
+			if err != nil || !reflect.DeepEqual(oid, tc.oid) || include != tc.include || n != len(b) {
+				t.Errorf("agentxReadOID() = %v, %v, %d, %v, want %v, %v, %d", oid, include, n, err, tc.oid, tc.include, len(b))
+			}
+			// Little endian, from the master agent
+			le := agentxTestOID(binary.LittleEndian, tc.oid, tc.include)
+			if oid, _, _, err := agentxReadOID(binary.LittleEndian, le); err != nil || !reflect.DeepEqual(oid, tc.oid) {
+				t.Errorf("agentxReadOID() little endian = %v, %v, want %v", oid, err, tc.oid)
+			}
+			if _, _, _, err := agentxReadOID(binary.BigEndian, b[:len(b)-1]); err == nil && len(b) > 4 {
+				t.Error("agentxReadOID() of a truncated OID error = nil")
+			}
+		})
+	}
+	if _, _, _, err := agentxReadOID(binary.BigEndian, []byte{1, 0}); err == nil {
+		t.Error("agentxReadOID() of a truncated header error = nil")
+	}
+}
+
+func TestAgentxString(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want []byte
+	}{
+		{"", []byte{0, 0, 0, 0}},
+		{"abcd", []byte{0, 0, 0, 4, 'a', 'b', 'c', 'd'}},
+		{"OpenGFW", []byte{0, 0, 0, 7, 'O', 'p', 'e', 'n', 'G', 'F', 'W', 0}},
+	}
+	for _, tc := range testCases {
+		b := agentxAppendString(nil, tc.s)
+		if !reflect.DeepEqual(b, tc.want) {
+			t.Errorf("agentxAppendString(%q) = %v, want %v", tc.s, b, tc.want)
+		}
+		s, n, err := agentxReadString(binary.BigEndian, b)
+		if err != nil || s != tc.s || n != len(b) {
+			t.Errorf("agentxReadString() = %q, %d, %v, want %q, %d", s, n, err, tc.s, len(b))
+		}
+	}
+	for _, b := range [][]byte{{0, 0}, {0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e'}, {0xff, 0xff, 0xff, 0xff}} {
+		if _, _, err := agentxReadString(binary.BigEndian, b); err == nil {
+			t.Errorf("agentxReadString(%v) error = nil", b)
+		}
+	}
+}
+
+// agentxTestOID encodes an OID in a byte order, without compressing the prefix.
+func agentxTestOID(order binary.ByteOrder, oid snmpOID, include bool) []byte {
+	var inc byte
+	if include {
+		inc = 1
+	}
+	b := []byte{byte(len(oid)), 0, inc, 0}
+	for _, n := range oid {
+		b = agentxTestAppendUint32(order, b, n)
+	}
+	return b
+}
+
+func agentxTestAppendUint32(order binary.ByteOrder, b []byte, v uint32) []byte {
+	var x [4]byte
+	order.PutUint32(x[:], v)
+	return append(b, x[:]...)
+}
+
+// agentxTestMaster is the master agent side of an AgentX session.
+type agentxTestMaster struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Write sends a PDU in a byte order.
+func (m *agentxTestMaster) Write(order binary.ByteOrder, h agentxHeader, payload []byte) {
+	h.Flags &^= snmpAgentXFlagNetworkByte
+	if order == binary.BigEndian {
+		h.Flags |= snmpAgentXFlagNetworkByte
+	}
+	b := []byte{snmpAgentXVersion, h.Type, h.Flags, 0}
+	b = agentxTestAppendUint32(order, b, h.SessionID)
+	b = agentxTestAppendUint32(order, b, h.TransactionID)
+	b = agentxTestAppendUint32(order, b, h.PacketID)
+	b = agentxTestAppendUint32(order, b, uint32(len(payload)))
+	if _, err := m.conn.Write(append(b, payload...)); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+// Read reads a PDU, which must be of a type.
+func (m *agentxTestMaster) Read(typ uint8) (agentxHeader, []byte) {
+	_ = m.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	c := &agentxConn{conn: m.conn, r: m.r}
+	h, payload, err := c.read()
+	if err != nil {
+		m.t.Fatalf("read() error = %v", err)
+	}
+	if h.Type != typ {
+		m.t.Fatalf("PDU type = %d, want %d", h.Type, typ)
+	}
+	if h.Flags&snmpAgentXFlagNetworkByte == 0 {
+		m.t.Errorf("PDU flags = %#x, want network byte order", h.Flags)
+	}
+	return h, payload
+}
+
+// decodeAgentxTestResponse decodes the payload of a Response PDU.
+func decodeAgentxTestResponse(t *testing.T, b []byte) (code, index uint16, vars []snmpVarBind) {
+	if len(b) < 8 {
+		t.Fatalf("response length = %d", len(b))
+	}
+	code, index, b = binary.BigEndian.Uint16(b[4:]), binary.BigEndian.Uint16(b[6:]), b[8:]
+	for len(b) > 0 {
+		vb := snmpVarBind{Type: binary.BigEndian.Uint16(b)}
+		var n int
+		var err error
+		if vb.OID, _, n, err = agentxReadOID(binary.BigEndian, b[4:]); err != nil {
+			t.Fatalf("var %d: %v", len(vars), err)
+		}
+		b = b[4+n:]
+		switch vb.Type {
+		case agentxGauge32:
+			vb.Value, b = binary.BigEndian.Uint32(b), b[4:]
+		case agentxCounter64:
+			vb.Value, b = binary.BigEndian.Uint64(b), b[8:]
+		case agentxOctetString:
+			if vb.Value, n, err = agentxReadString(binary.BigEndian, b); err != nil {
+				t.Fatalf("var %d: %v", len(vars), err)
+			}
+			b = b[n:]
+		}
+		vars = append(vars, vb)
+	}
+	return code, index, vars
+}
+
+// startAgentxTestSession starts a session of the agent with a master agent, until the context is cancelled.
+func startAgentxTestSession(t *testing.T, ctx context.Context, stats engine.Stats) (*snmpAgent, *agentxTestMaster, chan error) {
+	logger = zap.NewNop()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := newSNMPAgent("tcp:"+ln.Addr().String(), "", func() engine.Stats { return stats })
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- a.session(ctx) }()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return a, &agentxTestMaster{t: t, conn: conn, r: bufio.NewReader(conn)}, errCh
+}
+
+func TestSNMPAgent_Session(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, m, errCh := startAgentxTestSession(t, ctx, engine.Stats{
+		Workers:          4,
+		Packets:          100,
+		Verdicts:         map[io.Verdict]uint64{io.VerdictAccept: 90, io.VerdictDropStream: 10},
+		TCPStreams:       7,
+		ActiveTCPStreams: 2,
+		QueueCapacity:    1 << 40, // Capped
+	})
+	base := a.OID
+
+	// Open, with the base OID & description
+	h, payload := m.Read(agentxOpen)
+	if payload[0] != byte(snmpAgentXTimeout/time.Second) {
+		t.Errorf("open timeout = %d", payload[0])
+	}
+	oid, _, n, err := agentxReadOID(binary.BigEndian, payload[4:])
+	if err != nil || !reflect.DeepEqual(oid, base) {
+		t.Errorf("open OID = %v, %v, want %v", oid, err, base)
+	}
+	if descr, _, err := agentxReadString(binary.BigEndian, payload[4+n:]); err != nil || descr != "OpenGFW" {
+		t.Errorf("open description = %q, %v", descr, err)
+	}
+	m.Write(binary.LittleEndian, agentxHeader{Type: agentxResponse, SessionID: 42, PacketID: h.PacketID}, make([]byte, 8))
+
+	// Register the base OID, in the session
+	h, payload = m.Read(agentxRegister)
+	if h.SessionID != 42 {
+		t.Errorf("register session ID = %d, want 42", h.SessionID)
+	}
+	if want := agentxAppendOID([]byte{0, 127, 0, 0}, base, false); !reflect.DeepEqual(payload, want) {
+		t.Errorf("register = %v, want %v", payload, want)
+	}
+	m.Write(binary.BigEndian, agentxHeader{Type: agentxResponse, SessionID: 42, PacketID: h.PacketID}, make([]byte, 8))
+
+	searchRanges := func(order binary.ByteOrder, ranges ...agentxSearchRange) []byte {
+		var b []byte
+		for _, sr := range ranges {
+			b = append(b, agentxTestOID(order, sr.Start, sr.Include)...)
+			b = append(b, agentxTestOID(order, sr.End, false)...)
+		}
+		return b
+	}
+	testCases := []struct {
+		name      string
+		order     binary.ByteOrder
+		typ       uint8
+		flags     uint8
+		payload   []byte
+		wantCode  uint16
+		wantIndex uint16
+		wantVars  []snmpVarBind
+	}{
+		{
+			name:  "get",
+			order: binary.BigEndian,
+			typ:   agentxGet,
+			payload: searchRanges(binary.BigEndian,
+				agentxSearchRange{Start: base.append(1, 0)},
+				agentxSearchRange{Start: base.append(2, 1, 3, 5)},
+				agentxSearchRange{Start: base.append(4, 2, 0)},
+				agentxSearchRange{Start: base.append(2, 1, 3, 99)},
+				agentxSearchRange{Start: base.append(9, 0)},
+			),
+			wantVars: []snmpVarBind{
+				{base.append(1, 0), agentxCounter64, uint64(100)},
+				{base.append(2, 1, 3, 5), agentxCounter64, uint64(10)},
+				{base.append(4, 2, 0), agentxGauge32, uint32(0xffffffff)},
+				{base.append(2, 1, 3, 99), agentxNoSuchInstance, nil},
+				{base.append(9, 0), agentxNoSuchObject, nil},
+			},
+		},
+		{
+			name:  "get next, little endian",
+			order: binary.LittleEndian,
+			typ:   agentxGetNext,
+			payload: searchRanges(binary.LittleEndian,
+				agentxSearchRange{Start: base},
+				agentxSearchRange{Start: base.append(4, 4, 0), Include: true},
+				agentxSearchRange{Start: base.append(3, 4, 0), End: base.append(4)},
+				agentxSearchRange{Start: base.append(4, 4, 0)},
+			),
+			wantVars: []snmpVarBind{
+				{base.append(1, 0), agentxCounter64, uint64(100)},
+				{base.append(4, 4, 0), agentxGauge32, uint32(4)},
+				{base.append(3, 4, 0), agentxEndOfMibView, nil},
+				{base.append(4, 4, 0), agentxEndOfMibView, nil},
+			},
+		},
+		{
+			name:  "get bulk, with a context",
+			order: binary.BigEndian,
+			typ:   agentxGetBulk,
+			flags: snmpAgentXFlagNonDefault,
+			payload: append(append(agentxAppendString(nil, "ctx"), 0, 1, 0, 3), searchRanges(binary.BigEndian,
+				agentxSearchRange{Start: base.append(1, 0)},
+				agentxSearchRange{Start: base.append(4, 3, 0)},
+			)...),
+			wantVars: []snmpVarBind{
+				{base.append(2, 1, 2, 1), agentxOctetString, "accept"},
+				{base.append(4, 4, 0), agentxGauge32, uint32(4)},
+				{base.append(4, 4, 0), agentxEndOfMibView, nil},
+			},
+		},
+		{
+			name:      "test set",
+			order:     binary.BigEndian,
+			typ:       agentxTestSet,
+			wantCode:  snmpAgentXNotWritable,
+			wantIndex: 1,
+		},
+		{
+			name:    "truncated",
+			order:   binary.BigEndian,
+			typ:     agentxGet,
+			payload: []byte{5, 4, 0, 0, 0, 0, 0, 1},
+			// Parse error
+			wantCode: snmpAgentXParseError,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := agentxHeader{Type: tc.typ, Flags: tc.flags, SessionID: 42, TransactionID: uint32(i), PacketID: uint32(100 + i)}
+			m.Write(tc.order, req, tc.payload)
+			h, payload := m.Read(agentxResponse)
+			if h.SessionID != req.SessionID || h.TransactionID != req.TransactionID || h.PacketID != req.PacketID {
+				t.Errorf("response header = %+v, want the IDs of %+v", h, req)
+			}
+			code, index, vars := decodeAgentxTestResponse(t, payload)
+			if code != tc.wantCode || index != tc.wantIndex {
+				t.Errorf("response error = %d, index %d, want %d, %d", code, index, tc.wantCode, tc.wantIndex)
+			}
+			if !reflect.DeepEqual(vars, tc.wantVars) {
+				t.Errorf("response vars = %v, want %v", vars, tc.wantVars)
+			}
+		})
+	}
+
+	// Cleanup has no response
+	m.Write(binary.BigEndian, agentxHeader{Type: agentxCleanup, SessionID: 42, PacketID: 200}, nil)
+	m.Write(binary.BigEndian, agentxHeader{Type: agentxCommitSet, SessionID: 42, PacketID: 201}, nil)
+	if h, _ := m.Read(agentxResponse); h.PacketID != 201 {
+		t.Errorf("response packet ID = %d, want 201", h.PacketID)
+	}
+
+	// Closed with the shutdown reason
+	cancel()
+	h, payload = m.Read(agentxClose)
+	if h.SessionID != 42 || len(payload) != 4 || payload[0] != snmpAgentXCloseShutdown {
+		t.Errorf("close = %+v, %v", h, payload)
+	}
+	<-errCh
+}
+
+func TestSNMPAgent_Refused(t *testing.T) {
+	testCases := []struct {
+		name    string
+		typ     uint8 // The PDU refused
+		wantErr string
+	}{
+		{"open", agentxOpen, "open: error 256"},
+		{"register", agentxRegister, "register: error 263"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, m, errCh := startAgentxTestSession(t, ctx, engine.Stats{})
+			code := map[uint8]uint16{agentxOpen: 256, agentxRegister: 263}[tc.typ]
+			for _, typ := range []uint8{agentxOpen, agentxRegister} {
+				h, _ := m.Read(typ)
+				resp := make([]byte, 8)
+				if typ == tc.typ {
+					binary.BigEndian.PutUint16(resp[4:], code)
+				}
+				// A response to something else first, ignored
+				m.Write(binary.BigEndian, agentxHeader{Type: agentxResponse, SessionID: 1, PacketID: h.PacketID + 1}, []byte{})
+				m.Write(binary.BigEndian, agentxHeader{Type: agentxResponse, SessionID: 1, PacketID: h.PacketID}, resp)
+				if typ == tc.typ {
+					break
+				}
+			}
+			if err := <-errCh; err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("session() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+const strictDefaultGrace = 16384
+
+// strictPort is a range of destination ports allowed in strict mode, for a protocol or both if empty.
+type strictPort struct {
+	Proto      string
+	Start, End uint16
+}
+
+func (p strictPort) expr() string {
+	var e string
+	if p.Start == p.End {
+		e = fmt.Sprintf("port.dst == %d", p.Start)
+	} else {
+		e = fmt.Sprintf("port.dst >= %d && port.dst <= %d", p.Start, p.End)
+	}
+	if p.Proto != "" {
+		e = fmt.Sprintf("proto == %s && %s", strconv.Quote(p.Proto), e)
+	}
+	return "(" + e + ")"
+}
+
+// parseStrictPort parses a port or range of ports, optionally for a protocol, e.g. 53/udp, 22, 1000-2000/tcp.
+func parseStrictPort(s string) (strictPort, error) {
+	var p strictPort
+	ports, proto, hasProto := strings.Cut(s, "/")
+	if hasProto {
+		p.Proto = strings.ToLower(proto)
+		if p.Proto != "tcp" && p.Proto != "udp" {
+			return p, fmt.Errorf("invalid protocol in %q, must be tcp or udp", s)
+		}
+	}
+	start, end, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		end = start
+	}
+	s1, err1 := strconv.ParseUint(start, 10, 16)
+	s2, err2 := strconv.ParseUint(end, 10, 16)
+	if err1 != nil || err2 != nil || s1 == 0 || s1 > s2 {
+		return p, fmt.Errorf("invalid port %q", s)
+	}
+	p.Start, p.End = uint16(s1), uint16(s2)
+	return p, nil
+}
+
+// strictMode is a default deny policy: only the streams whose TLS or QUIC SNI, or HTTP Host, is
+// in one of the domain sets of Allow, to the ports of Ports, or from the clients of Exempt, are allowed.
+// Its rules are evaluated after all the others, so that explicit rules still apply: the allowed streams
+// are allowed as soon as they're known to be, those classified as HTTP, TLS or QUIC with another name
+// are blocked right away, and the others once they've transferred Grace bytes without being allowed.
+// Streams that no rule matches once analyzed are dropped too, through the default verdicts.
+type strictMode struct {
+	Allow  []string // Domain sets
+	Ports  []strictPort
+	Exempt []string // CIDRs
+	Grace  int      // Bytes
+}
+
+// Rules returns the rules of strict mode, to be evaluated after the others.
+func (s *strictMode) Rules() []ruleset.ExprRule {
+	var allowed []string
+	for _, cidr := range s.Exempt {
+		allowed = append(allowed, fmt.Sprintf("cidr(ip.src, %s)", strconv.Quote(cidr)))
+	}
+	for _, p := range s.Ports {
+		allowed = append(allowed, p.expr())
+	}
+	for _, name := range s.Allow {
+		q := strconv.Quote(name)
+		allowed = append(allowed,
+			fmt.Sprintf("in_set(%s, string(tls?.req?.sni))", q),
+			fmt.Sprintf("in_set(%s, string(quic?.req?.sni))", q),
+			fmt.Sprintf("in_set(%s, string(http?.req?.headers?.host))", q))
+	}
+	return []ruleset.ExprRule{
+		{
+			Name:   "strict-allow",
+			Action: ruleset.ActionAllow.String(),
+			Expr:   strings.Join(allowed, " || "),
+		},
+		{
+			Name:   "strict-deny",
+			Action: ruleset.ActionBlock.String(),
+			Expr:   "tls?.req != nil || quic?.req != nil || http?.req != nil",
+		},
+		{
+			Name:   "strict-unclassified",
+			Action: ruleset.ActionBlock.String(),
+			Expr:   fmt.Sprintf("flow.bytes > %d", s.Grace),
+		},
+	}
+}
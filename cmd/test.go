@@ -0,0 +1,369 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/engine"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// Flags
+var (
+	testPcapFile  string
+	testCasesFile string
+)
+
+var testCmd = &cobra.Command{
+	Use:   "test [flags] rule_file",
+	Short: "Test a ruleset against a pcap file or synthetic test cases",
+	Long: "Test a ruleset against a pcap file (--pcap) or a YAML file of synthetic test cases (--cases), " +
+		"and print which rules matched and the resulting actions. " +
+		"Exits with a non-zero status if any test case does not get its expected action.",
+	Args: cobra.ExactArgs(1),
+	Run:  runTest,
+}
+
+func init() {
+	testCmd.Flags().StringVar(&testPcapFile, "pcap", "", "pcap/pcapng file to replay")
+	testCmd.Flags().StringVar(&testCasesFile, "cases", "", "YAML file of test cases")
+	rootCmd.AddCommand(testCmd)
+}
+
+// testCase is a synthetic stream with a set of analyzer properties.
+type testCase struct {
+	Name  string `yaml:"name"`
+	Proto string `yaml:"proto"`
+	IP    struct {
+		Src string `yaml:"src"`
+		Dst string `yaml:"dst"`
+	} `yaml:"ip"`
+	Port struct {
+		Src uint16 `yaml:"src"`
+		Dst uint16 `yaml:"dst"`
+	} `yaml:"port"`
+	Flow struct {
+		Age time.Duration   `yaml:"age"`
+		Src testCaseCounter `yaml:"src"`
+		Dst testCaseCounter `yaml:"dst"`
+	} `yaml:"flow"`
+	Props analyzer.CombinedPropMap `yaml:"props"`
+	// K8s are the workloads of the source & destination IPs, used if kubernetes is configured.
+	K8s struct {
+		Src *testCaseWorkload `yaml:"src"`
+		Dst *testCaseWorkload `yaml:"dst"`
+	} `yaml:"k8s"`
+	// Container are the containers of the source & destination IPs, used if docker is configured.
+	Container struct {
+		Src *testCaseContainer `yaml:"src"`
+		Dst *testCaseContainer `yaml:"dst"`
+	} `yaml:"container"`
+	// Process is the local process owning the socket of the stream, used in local mode.
+	Process *testCaseProcess `yaml:"process"`
+	// Expect is the expected action. Empty means no expectation (only print the result).
+	Expect string `yaml:"expect"`
+	// ExpectRule is the expected name of the matched rule, "" means no expectation.
+	ExpectRule string `yaml:"expectRule"`
+}
+
+type testCaseWorkload struct {
+	Kind      string            `yaml:"kind"`
+	Namespace string            `yaml:"namespace"`
+	Name      string            `yaml:"name"`
+	Labels    map[string]string `yaml:"labels"`
+}
+
+type testCaseProcess struct {
+	PID  int    `yaml:"pid"`
+	Name string `yaml:"name"`
+	Exe  string `yaml:"exe"`
+	UID  *int   `yaml:"uid"` // Unknown if not set
+	GID  *int   `yaml:"gid"`
+}
+
+type testCaseContainer struct {
+	ID     string            `yaml:"id"`
+	Name   string            `yaml:"name"`
+	Image  string            `yaml:"image"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type testCaseCounter struct {
+	Packets uint64 `yaml:"packets"`
+	Bytes   uint64 `yaml:"bytes"`
+}
+
+func (c *testCase) streamInfo(id int64) (ruleset.StreamInfo, error) {
+	info := ruleset.StreamInfo{
+		ID:      id,
+		SrcIP:   net.ParseIP(c.IP.Src),
+		DstIP:   net.ParseIP(c.IP.Dst),
+		SrcPort: c.Port.Src,
+		DstPort: c.Port.Dst,
+		Props:   c.Props,
+		Counters: ruleset.StreamCounters{
+			StartTime:  time.Now().Add(-c.Flow.Age),
+			SrcPackets: c.Flow.Src.Packets,
+			DstPackets: c.Flow.Dst.Packets,
+			SrcBytes:   c.Flow.Src.Bytes,
+			DstBytes:   c.Flow.Dst.Bytes,
+		},
+	}
+	switch c.Proto {
+	case "tcp", "":
+		info.Protocol = ruleset.ProtocolTCP
+	case "udp":
+		info.Protocol = ruleset.ProtocolUDP
+	case "sctp":
+		info.Protocol = ruleset.ProtocolSCTP
+	case "icmp":
+		info.Protocol = ruleset.ProtocolICMP
+	default:
+		return info, fmt.Errorf("invalid protocol %q", c.Proto)
+	}
+	if info.SrcIP == nil || info.DstIP == nil {
+		return info, errors.New("invalid IP address")
+	}
+	if info.Props == nil {
+		info.Props = make(analyzer.CombinedPropMap)
+	}
+	return info, nil
+}
+
+func runTest(cmd *cobra.Command, args []string) {
+	if (testPcapFile == "") == (testCasesFile == "") {
+		logger.Fatal("exactly one of --pcap or --cases must be specified")
+	}
+
+	rs := testRuleset(args[0], &testRulesetLogger{}, &testPrintNotifier{})
+
+	var ok bool
+	if testCasesFile != "" {
+		ok = runTestCases(rs)
+	} else {
+		ok = runTestPcap(rs)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// testRuleset compiles a rule file for offline use, with the sets, shaping classes & functions
+// of the config if there's one. The notifier gets the notifications if a webhook is configured.
+func testRuleset(file string, rsLogger ruleset.Logger, notifier ruleset.Notifier) ruleset.Ruleset {
+	// Config is optional here, only the ruleset part is used
+	var config cliConfig
+	if err := readConfig(); err == nil {
+		if err := viper.Unmarshal(&config); err != nil {
+			logger.Fatal("failed to parse config", zap.Error(err))
+		}
+	} else if errors.As(err, &configError{}) {
+		// The file exists, but a reference can't be expanded
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	shapingClasses, err := config.shapingClasses()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	sets, err := config.sets()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	nat64, err := config.nat64()
+	if err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if err := config.httpAnalyzer(); err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	if err := config.sshAnalyzer(); err != nil {
+		logger.Fatal("failed to parse config", zap.Error(err))
+	}
+	rawRs, _, err := config.loadRules(file)
+	if err != nil {
+		logger.Fatal("failed to load rules", zap.Error(err))
+	}
+	if config.Webhook.URL == "" {
+		notifier = nil
+	}
+	rs, err := ruleset.CompileExprRules(rawRs, analyzers, modifiers, &ruleset.BuiltinConfig{
+		Logger:             rsLogger,
+		GeoSiteFilename:    config.Ruleset.GeoSite,
+		GeoIpFilename:      config.Ruleset.GeoIp,
+		AppsFilename:       config.Ruleset.Apps,
+		AppsAnalyzers:      len(config.QoS.Classes) > 0,
+		ShapingClasses:     shapingClasses,
+		Sets:               sets,
+		Functions:          config.Ruleset.Functions,
+		CaptureEnabled:     config.Capture.Dir != "",
+		MirrorEnabled:      config.Mirror.Type != "",
+		DivertEnabled:      config.divertEnabled(),
+		CaptureHTTPEnabled: config.HAR.Dir != "",
+		HoneypotEnabled:    config.honeypotEnabled(),
+		Notifier:           notifier,
+		Workloads:          config.testWorkloads(),
+		Containers:         config.testContainers(),
+		Processes:          config.testProcesses(),
+		NAT64:              nat64,
+	})
+	if err != nil {
+		logger.Fatal("failed to compile rules", zap.Error(err))
+	}
+	return rs
+}
+
+func runTestCases(rs ruleset.Ruleset) bool {
+	bs, err := os.ReadFile(testCasesFile)
+	if err != nil {
+		logger.Fatal("failed to read test cases", zap.Error(err))
+	}
+	var cases []testCase
+	if err := yaml.Unmarshal(bs, &cases); err != nil {
+		logger.Fatal("failed to parse test cases", zap.Error(err))
+	}
+	pass, fail := 0, 0
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		info, err := c.streamInfo(int64(i))
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			fail++
+			continue
+		}
+		testCaseWorkloads.set(&c)
+		testCaseContainers.set(&c)
+		testCaseProcesses.set(&c)
+		result := rs.Match(info)
+		got := formatTestResult(result.Action, result.RuleName)
+		if (c.Expect != "" && c.Expect != result.Action.String()) ||
+			(c.ExpectRule != "" && c.ExpectRule != result.RuleName) {
+			expectAction, expectRule := c.Expect, c.ExpectRule
+			if expectAction == "" {
+				expectAction = "*"
+			}
+			if expectRule == "" {
+				expectRule = "*"
+			}
+			fmt.Printf("FAIL %s: %s, expected %s (rule %s)\n", name, got, expectAction, expectRule)
+			fail++
+		} else {
+			fmt.Printf("PASS %s: %s\n", name, got)
+			pass++
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", pass, fail)
+	return fail == 0
+}
+
+func runTestPcap(rs ruleset.Ruleset) bool {
+	pcapIO, err := io.NewPcapPacketIO(io.PcapPacketIOConfig{PcapFile: testPcapFile})
+	if err != nil {
+		logger.Fatal("failed to open pcap file", zap.Error(err))
+	}
+	defer pcapIO.Close()
+	en, err := engine.NewEngine(engine.Config{
+		Logger:  &testEngineLogger{},
+		IOs:     []io.PacketIO{pcapIO},
+		Ruleset: rs,
+		Workers: 1, // Keep the output deterministic
+	})
+	if err != nil {
+		logger.Fatal("failed to initialize engine", zap.Error(err))
+	}
+	err = en.Run(context.Background())
+	if err != nil && !errors.Is(err, io.ErrEndOfInput) {
+		logger.Fatal("failed to replay pcap file", zap.Error(err))
+	}
+	for _, st := range rs.Stats() {
+		if st.Hits > 0 {
+			fmt.Printf("rule %s: %d hits\n", st.Name, st.Hits)
+		}
+	}
+	return true
+}
+
+func formatTestResult(action ruleset.Action, rule string) string {
+	if rule == "" {
+		return fmt.Sprintf("%s (no match)", action)
+	}
+	return fmt.Sprintf("%s (rule %s)", action, rule)
+}
+
+// testEngineLogger prints the final action of each stream to stdout,
+// everything else goes to the regular log.
+type testEngineLogger struct {
+	engineLogger
+}
+
+func (l *testEngineLogger) TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	l.printAction(info, action, rule)
+}
+
+func (l *testEngineLogger) UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	l.printAction(info, action, rule)
+}
+
+func (l *testEngineLogger) SCTPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	l.printAction(info, action, rule)
+}
+
+func (l *testEngineLogger) ICMPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool) {
+	l.printAction(info, action, rule)
+}
+
+func (l *testEngineLogger) printAction(info ruleset.StreamInfo, action ruleset.Action, rule string) {
+	fmt.Printf("%s %s -> %s: %s\n", info.Protocol, info.SrcString(), info.DstString(), formatTestResult(action, rule))
+}
+
+// testNotifier returns a notifier that prints the events instead of sending them,
+// or nil if no webhook is configured.
+func (c *cliConfig) testNotifier() ruleset.Notifier {
+	if c.Webhook.URL == "" {
+		return nil
+	}
+	return &testPrintNotifier{}
+}
+
+type testPrintNotifier struct{}
+
+func (n *testPrintNotifier) Notify(ev ruleset.NotifyEvent) {
+	src := net.JoinHostPort(ev.SrcIP.String(), strconv.Itoa(int(ev.SrcPort)))
+	dst := net.JoinHostPort(ev.DstIP.String(), strconv.Itoa(int(ev.DstPort)))
+	fmt.Printf("%s %s -> %s: notify (rule %s)\n", ev.Protocol, src, dst, ev.Rule)
+}
+
+// testRulesetLogger is like rulesetLogger, but logs at debug level only,
+// to keep the test output clean.
+type testRulesetLogger struct{}
+
+func (l *testRulesetLogger) Log(level ruleset.LogLevel, info ruleset.StreamInfo, name string) {
+	logger.Debug("ruleset log",
+		zap.String("name", name),
+		zap.Int64("id", info.ID),
+		zap.String("src", info.SrcString()),
+		zap.String("dst", info.DstString()),
+		zap.Any("props", info.Props))
+}
+
+func (l *testRulesetLogger) DryRun(info ruleset.StreamInfo, name string, action ruleset.Action) {
+	fmt.Printf("%s %s -> %s: would %s (dry-run rule %s)\n", info.Protocol, info.SrcString(), info.DstString(), action, name)
+}
+
+func (l *testRulesetLogger) MatchError(info ruleset.StreamInfo, name string, err error) {
+	fmt.Printf("%s %s -> %s: error in rule %s: %v\n", info.Protocol, info.SrcString(), info.DstString(), name, err)
+}
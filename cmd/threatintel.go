@@ -0,0 +1,500 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+
+	"go.uber.org/zap"
+)
+
+const (
+	intelDefaultInterval = time.Hour
+	intelRequestTimeout  = 5 * time.Minute
+	intelMaxPages        = 1000
+
+	intelTypeIP     = "ip"
+	intelTypeDomain = "domain"
+	intelTypeJA3    = "ja3"
+	intelTypeURL    = "url"
+)
+
+// intelIndicator is an indicator of compromise of a feed.
+type intelIndicator struct {
+	Type       string    // ip, domain, ja3 or url
+	Value      string    // IP or CIDR, domain, JA3 hash in lowercase hex, or URL
+	Confidence int       // 0-100, -1 if unknown
+	Time       time.Time // When it was created or last changed, zero if unknown
+	ValidUntil time.Time // Zero if unknown
+}
+
+// intelSource fetches all the current indicators of a feed.
+type intelSource interface {
+	Fetch(ctx context.Context, client *http.Client, since time.Time) ([]intelIndicator, error)
+}
+
+// intelFeed pulls the indicators of a threat intelligence feed (MISP or TAXII) every Interval,
+// and keeps the sets of their types (IPs & CIDRs, domains, JA3 hashes, URLs) in sync with them:
+// indicators no longer in the feed are removed at the next pull. Indicators under MinConfidence
+// are left out (those without a confidence are kept), and so are those older than MaxAge.
+// Entries expire with their indicator (valid_until), MaxAge after it was last changed, or TTL
+// after the latest pull that had it, whichever comes first, so that they don't outlive it
+// if the feed becomes unreachable.
+type intelFeed struct {
+	Name          string
+	Source        intelSource
+	Client        *http.Client
+	Sets          map[string]*intelSet // Indicator type -> set, types without one are ignored
+	Interval      time.Duration
+	MinConfidence int
+	MaxAge        time.Duration // 0 = no limit
+	TTL           time.Duration // 0 = no limit
+
+	mutex    sync.Mutex
+	lastErr  error
+	lastPull time.Time
+}
+
+// Run pulls the feed every Interval until the context is cancelled.
+func (f *intelFeed) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Pull(ctx); err != nil && ctx.Err() == nil {
+			logger.Warn("failed to pull threat intel feed", zap.String("feed", f.Name), zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pull fetches the indicators of the feed, and replaces those of the feed in the sets with them.
+func (f *intelFeed) Pull(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, intelRequestTimeout)
+	defer cancel()
+	now := time.Now()
+	var since time.Time
+	if f.MaxAge > 0 {
+		since = now.Add(-f.MaxAge)
+	}
+	indicators, err := f.Source.Fetch(ctx, f.Client, since)
+	f.mutex.Lock()
+	f.lastErr = err
+	if err == nil {
+		f.lastPull = now
+	}
+	f.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	entries := make(map[*intelSet]map[string]time.Time, len(f.Sets))
+	for _, set := range f.Sets {
+		entries[set] = make(map[string]time.Time)
+	}
+	skipped := 0
+	for _, ind := range indicators {
+		set := f.Sets[ind.Type]
+		if set == nil {
+			continue
+		}
+		if ind.Confidence >= 0 && ind.Confidence < f.MinConfidence {
+			skipped++
+			continue
+		}
+		var expiry time.Time
+		for _, exp := range []time.Time{
+			ind.ValidUntil,
+			expiryAfter(ind.Time, f.MaxAge),
+			expiryAfter(now, f.TTL),
+		} {
+			if !exp.IsZero() && (expiry.IsZero() || exp.Before(expiry)) {
+				expiry = exp
+			}
+		}
+		if !expiry.IsZero() && !expiry.After(now) {
+			skipped++
+			continue
+		}
+		if prev, ok := entries[set][ind.Value]; ok && (prev.IsZero() || (!expiry.IsZero() && prev.After(expiry))) {
+			// Listed twice, the latest expiry wins
+			continue
+		}
+		entries[set][ind.Value] = expiry
+	}
+	fields := []zap.Field{zap.String("feed", f.Name), zap.Int("indicators", len(indicators)), zap.Int("skipped", skipped)}
+	for typ, set := range f.Sets {
+		added, removed, invalid := set.Update(f.Name, entries[set])
+		fields = append(fields, zap.Dict(typ, zap.Int("added", added), zap.Int("removed", removed), zap.Int("invalid", invalid)))
+	}
+	logger.Info("threat intel feed pulled", fields...)
+	return nil
+}
+
+// expiryAfter returns t+d, or zero if either is zero.
+func expiryAfter(t time.Time, d time.Duration) time.Time {
+	if t.IsZero() || d <= 0 {
+		return time.Time{}
+	}
+	return t.Add(d)
+}
+
+// Check returns the error of the latest pull, for readiness: the sets may be out of date.
+func (f *intelFeed) Check() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.lastErr != nil {
+		if f.lastPull.IsZero() {
+			return fmt.Errorf("failed to pull: %w", f.lastErr)
+		}
+		return fmt.Errorf("failed to pull, last pulled %s ago: %w", time.Since(f.lastPull).Round(time.Second), f.lastErr)
+	}
+	return nil
+}
+
+// intelSet is a set filled by one or more feeds: an entry stays as long as a feed has it,
+// with the latest of its expiries.
+type intelSet struct {
+	Set *builtins.Set
+
+	mutex   sync.Mutex
+	entries map[string]map[string]time.Time // Entry -> feed -> expiry (zero = never)
+}
+
+func newIntelSet(set *builtins.Set) *intelSet {
+	return &intelSet{Set: set, entries: make(map[string]map[string]time.Time)}
+}
+
+// Update replaces the entries of a feed, and returns the number of entries added to & removed from the set,
+// and of those the set rejected.
+func (s *intelSet) Update(feed string, entries map[string]time.Time) (added, removed, invalid int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := make(map[string]bool)
+	for entry, feeds := range s.entries {
+		if _, ok := entries[entry]; !ok {
+			if _, ok := feeds[feed]; ok {
+				delete(feeds, feed)
+				changed[entry] = true
+			}
+		}
+	}
+	for entry, expiry := range entries {
+		feeds := s.entries[entry]
+		if feeds == nil {
+			feeds = make(map[string]time.Time)
+			s.entries[entry] = feeds
+			added++
+		}
+		if prev, ok := feeds[feed]; !ok || !prev.Equal(expiry) {
+			feeds[feed] = expiry
+			changed[entry] = true
+		}
+	}
+	now := time.Now()
+	for entry := range changed {
+		feeds := s.entries[entry]
+		if len(feeds) == 0 {
+			delete(s.entries, entry)
+			_, _ = s.Set.Remove([]string{entry})
+			removed++
+			continue
+		}
+		var expiry time.Time
+		never := false
+		for _, exp := range feeds {
+			if exp.IsZero() {
+				never = true
+			} else if exp.After(expiry) {
+				expiry = exp
+			}
+		}
+		var ttl time.Duration
+		if !never {
+			ttl = expiry.Sub(now)
+		}
+		if err := s.Set.Add([]string{entry}, ttl); err != nil {
+			delete(s.entries, entry)
+			added--
+			invalid++
+		}
+	}
+	return added, removed, invalid
+}
+
+// mispSource fetches the attributes flagged for IDS of a MISP instance through its REST API,
+// without those matching its warning lists (known false positives) or decayed, if decaying models are enabled.
+// The confidence of an attribute is its highest decay score.
+type mispSource struct {
+	URL    string
+	APIKey string
+	Tags   []string // Only the attributes with one of them, all if empty
+}
+
+// mispTypes maps the MISP attribute types to indicator types.
+var mispTypes = map[string]string{
+	"ip-src":              intelTypeIP,
+	"ip-dst":              intelTypeIP,
+	"ip-src|port":         intelTypeIP,
+	"ip-dst|port":         intelTypeIP,
+	"domain":              intelTypeDomain,
+	"hostname":            intelTypeDomain,
+	"domain|ip":           intelTypeDomain, // And IP
+	"ja3-fingerprint-md5": intelTypeJA3,
+	"url":                 intelTypeURL,
+}
+
+func (s *mispSource) Fetch(ctx context.Context, client *http.Client, since time.Time) ([]intelIndicator, error) {
+	types := make([]string, 0, len(mispTypes))
+	for t := range mispTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	query := map[string]any{
+		"returnFormat":       "json",
+		"type":               types,
+		"to_ids":             true,
+		"deleted":            false,
+		"enforceWarninglist": true,
+		"includeDecayScore":  true,
+		"excludeDecayed":     true,
+	}
+	if len(s.Tags) > 0 {
+		query["tags"] = s.Tags
+	}
+	if !since.IsZero() {
+		query["attribute_timestamp"] = strconv.FormatInt(since.Unix(), 10)
+	}
+	body, _ := json.Marshal(query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL+"/attributes/restSearch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", s.APIKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Response struct {
+			Attribute []struct {
+				Type       string `json:"type"`
+				Value      string `json:"value"`
+				Timestamp  string `json:"timestamp"`
+				LastSeen   string `json:"last_seen"`
+				DecayScore []struct {
+					Score float64 `json:"score"`
+				} `json:"decay_score"`
+			} `json:"Attribute"`
+		} `json:"response"`
+	}
+	if err := intelDo(client, req, &resp); err != nil {
+		return nil, err
+	}
+	var indicators []intelIndicator
+	for _, a := range resp.Response.Attribute {
+		typ := mispTypes[a.Type]
+		if typ == "" {
+			continue
+		}
+		ind := intelIndicator{Type: typ, Confidence: -1}
+		if ts, err := strconv.ParseInt(a.Timestamp, 10, 64); err == nil {
+			ind.Time = time.Unix(ts, 0)
+		}
+		if t, err := time.Parse(time.RFC3339, a.LastSeen); err == nil && t.After(ind.Time) {
+			ind.Time = t
+		}
+		for _, ds := range a.DecayScore {
+			ind.Confidence = max(ind.Confidence, int(ds.Score))
+		}
+		// Composite types are value|port and domain|ip
+		value, extra, _ := strings.Cut(a.Value, "|")
+		if a.Type == "domain|ip" {
+			if ip, ok := normalizeIndicator(intelTypeIP, extra); ok {
+				ipInd := ind
+				ipInd.Type, ipInd.Value = intelTypeIP, ip
+				indicators = append(indicators, ipInd)
+			}
+		}
+		if value, ok := normalizeIndicator(typ, value); ok {
+			ind.Value = value
+			indicators = append(indicators, ind)
+		}
+	}
+	return indicators, nil
+}
+
+// taxiiSource fetches the indicators of a TAXII 2.1 collection, in STIX 2.1.
+// Only the patterns made of comparisons of IPs, domains, URLs & JA3 hashes joined by OR are supported,
+// as each one of them is an indicator on its own.
+type taxiiSource struct {
+	URL      string // Of the collection, e.g. https://host/api-root/collections/<id>/
+	Username string
+	Password string
+	Token    string // Bearer, instead of the username & password
+}
+
+// stixComparisonRegexp matches a comparison of a STIX pattern, e.g. ipv4-addr:value = '192.0.2.1'.
+var stixComparisonRegexp = regexp.MustCompile(`([a-z0-9-]+):([A-Za-z0-9_.'-]+)\s*(=|ISSUBSET)\s*'((?:[^'\\]|\\.)*)'`)
+
+// stixQuotedRegexp matches the string literals of a STIX pattern.
+var stixQuotedRegexp = regexp.MustCompile(`'(?:[^'\\]|\\.)*'`)
+
+func (s *taxiiSource) Fetch(ctx context.Context, client *http.Client, since time.Time) ([]intelIndicator, error) {
+	var indicators []intelIndicator
+	next := ""
+	for page := 0; ; page++ {
+		if page == intelMaxPages {
+			return nil, fmt.Errorf("more than %d pages", intelMaxPages)
+		}
+		query := url.Values{"match[type]": {"indicator"}}
+		if !since.IsZero() {
+			query.Set("added_after", since.UTC().Format(time.RFC3339))
+		}
+		if next != "" {
+			query.Set("next", next)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			strings.TrimSuffix(s.URL, "/")+"/objects/?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/taxii+json;version=2.1")
+		if s.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.Token)
+		} else if s.Username != "" {
+			req.SetBasicAuth(s.Username, s.Password)
+		}
+		var envelope struct {
+			More    bool   `json:"more"`
+			Next    string `json:"next"`
+			Objects []struct {
+				Type        string    `json:"type"`
+				Pattern     string    `json:"pattern"`
+				PatternType string    `json:"pattern_type"`
+				Modified    time.Time `json:"modified"`
+				ValidUntil  time.Time `json:"valid_until"`
+				Confidence  *int      `json:"confidence"`
+				Revoked     bool      `json:"revoked"`
+			} `json:"objects"`
+		}
+		if err := intelDo(client, req, &envelope); err != nil {
+			return nil, err
+		}
+		for _, o := range envelope.Objects {
+			if o.Type != "indicator" || o.Revoked || (o.PatternType != "" && o.PatternType != "stix") {
+				continue
+			}
+			confidence := -1
+			if o.Confidence != nil {
+				confidence = *o.Confidence
+			}
+			for _, ind := range parseSTIXPattern(o.Pattern) {
+				ind.Confidence, ind.Time, ind.ValidUntil = confidence, o.Modified, o.ValidUntil
+				indicators = append(indicators, ind)
+			}
+		}
+		if !envelope.More || envelope.Next == "" {
+			return indicators, nil
+		}
+		next = envelope.Next
+	}
+}
+
+// parseSTIXPattern returns the indicators of a STIX pattern, if it's made of supported comparisons joined by OR,
+// e.g. [ipv4-addr:value = '192.0.2.1' OR ipv4-addr:value = '192.0.2.2'] OR [domain-name:value = 'example.com'].
+func parseSTIXPattern(pattern string) []intelIndicator {
+	unquoted := stixQuotedRegexp.ReplaceAllString(pattern, "''")
+	for _, op := range []string{" AND ", " FOLLOWEDBY ", " WITHIN ", " REPEATS ", " START ", " NOT ", "!=", " LIKE ", " MATCHES "} {
+		if strings.Contains(unquoted, op) {
+			// Not a plain list of values
+			return nil
+		}
+	}
+	var indicators []intelIndicator
+	for _, m := range stixComparisonRegexp.FindAllStringSubmatch(pattern, -1) {
+		object, path, value := m[1], m[2], strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(m[4])
+		var typ string
+		switch {
+		case (object == "ipv4-addr" || object == "ipv6-addr") && path == "value":
+			typ = intelTypeIP
+		case object == "domain-name" && path == "value":
+			typ = intelTypeDomain
+		case object == "url" && path == "value":
+			typ = intelTypeURL
+		case strings.Contains(strings.ToLower(path), "ja3"):
+			typ = intelTypeJA3
+		default:
+			continue
+		}
+		if value, ok := normalizeIndicator(typ, value); ok {
+			indicators = append(indicators, intelIndicator{Type: typ, Value: value})
+		}
+	}
+	return indicators
+}
+
+// normalizeIndicator returns the value of an indicator as its set expects it, or false if it's invalid.
+func normalizeIndicator(typ, value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	switch typ {
+	case intelTypeIP:
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String(), true
+		}
+		if _, n, err := net.ParseCIDR(value); err == nil {
+			return n.String(), true
+		}
+		return "", false
+	case intelTypeDomain:
+		value = normalizeDomain(value)
+		return value, value != ""
+	case intelTypeJA3:
+		value = strings.ToLower(value)
+		if len(value) != 32 || strings.Trim(value, "0123456789abcdef") != "" {
+			return "", false
+		}
+		return value, true
+	default:
+		return value, value != ""
+	}
+}
+
+// intelDo sends a request to a feed, and decodes the JSON body of the response into v.
+func intelDo(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg struct {
+			Message     string `json:"message"`
+			Title       string `json:"title"` // TAXII
+			Description string `json:"description"`
+		}
+		bs, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(bs, &msg) != nil {
+			msg.Message = strings.TrimSpace(string(bs))
+		}
+		text := strings.TrimSpace(strings.Join([]string{msg.Message, msg.Title, msg.Description}, " "))
+		return fmt.Errorf("%s: %s", resp.Status, text)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// Flags
+var (
+	topInterval time.Duration
+	topSort     string
+	topCIDRs    []string
+	topPorts    []string
+	topProtocol string
+	topOnce     bool
+)
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Live view of the streams of a running instance through its API, with their protocols, rates and verdicts",
+	Long: `Live view of the streams of a running instance through its API, with their protocols, rates and verdicts.
+
+Keys: s cycle the sort column, r reverse the order, / filter (Enter to apply, Esc to clear),
+p cycle the protocols shown, b show only blocked streams, j/k or arrows to scroll, q quit.
+
+If the output is not a terminal, or with --once, the streams are printed once and the command exits.`,
+	Args: cobra.NoArgs,
+	Run:  runTop,
+}
+
+var topSortKeys = []string{"rate", "bytes", "age", "app", "src"}
+
+var topProtocols = []string{"", "tcp", "udp"}
+
+func init() {
+	topCmd.Flags().StringVar(&apiAddr, "api", "", "API address (default: api.listen from the config file)")
+	topCmd.Flags().StringVar(&apiToken, "api-token", "", "API token (default: api.token from the config file)")
+	topCmd.Flags().DurationVarP(&topInterval, "interval", "n", 2*time.Second, "refresh interval, over which rates are measured")
+	topCmd.Flags().StringVar(&topSort, "sort", "rate", "sort by: "+strings.Join(topSortKeys, ", "))
+	topCmd.Flags().StringSliceVar(&topCIDRs, "cidr", nil, "only streams from or to these IPs/CIDRs")
+	topCmd.Flags().StringSliceVar(&topPorts, "port", nil, "only streams from or to these ports")
+	topCmd.Flags().StringVar(&topProtocol, "protocol", "", "only tcp or udp streams")
+	topCmd.Flags().BoolVar(&topOnce, "once", false, "print the streams once and exit")
+	rootCmd.AddCommand(topCmd)
+}
+
+// topRow is a stream with its rate since the previous refresh.
+type topRow struct {
+	apiStream
+	Rate float64 // Bytes per second, both directions
+}
+
+// topView is the state of the top screen.
+type topView struct {
+	rows      []topRow
+	total     int // Streams matching the server-side filters
+	prevBytes map[int64]uint64
+	prevTime  time.Time
+	err       error
+
+	sortBy      int
+	reverse     bool
+	protocol    int // Index in topProtocols
+	blockedOnly bool
+	filter      string
+	editing     bool // Typing the filter
+	offset      int  // Scroll offset
+}
+
+// update replaces the streams with a new snapshot, computing their rates from the previous one.
+func (v *topView) update(resp apiStreamsResponse, now time.Time) {
+	elapsed := now.Sub(v.prevTime).Seconds()
+	bytes := make(map[int64]uint64, len(resp.Streams))
+	v.rows = v.rows[:0]
+	for _, s := range resp.Streams {
+		b := s.SrcBytes + s.DstBytes
+		bytes[s.ID] = b
+		row := topRow{apiStream: s}
+		if prev, ok := v.prevBytes[s.ID]; ok && elapsed > 0 && b >= prev {
+			row.Rate = float64(b-prev) / elapsed
+		}
+		v.rows = append(v.rows, row)
+	}
+	v.total = resp.Total
+	v.prevBytes, v.prevTime = bytes, now
+	v.err = nil
+}
+
+// visible returns the rows that pass the filters, sorted.
+func (v *topView) visible() []topRow {
+	filter := strings.ToLower(v.filter)
+	rows := make([]topRow, 0, len(v.rows))
+	for _, r := range v.rows {
+		if p := topProtocols[v.protocol]; p != "" && r.Protocol != p {
+			continue
+		}
+		if v.blockedOnly && !topBlocked(r.Verdict) {
+			continue
+		}
+		if filter != "" && !strings.Contains(strings.ToLower(strings.Join(
+			[]string{r.Src, r.Dst, r.Protocol, r.AppProto, r.Verdict, r.Rule}, " ")), filter) {
+			continue
+		}
+		rows = append(rows, r)
+	}
+	less := map[string]func(a, b *topRow) bool{
+		"rate":  func(a, b *topRow) bool { return a.Rate > b.Rate },
+		"bytes": func(a, b *topRow) bool { return a.SrcBytes+a.DstBytes > b.SrcBytes+b.DstBytes },
+		"age":   func(a, b *topRow) bool { return a.StartTime.Before(b.StartTime) },
+		"app":   func(a, b *topRow) bool { return a.AppProto < b.AppProto },
+		"src":   func(a, b *topRow) bool { return a.Src < b.Src },
+	}[topSortKeys[v.sortBy]]
+	sort.SliceStable(rows, func(i, j int) bool {
+		if v.reverse {
+			return less(&rows[j], &rows[i])
+		}
+		return less(&rows[i], &rows[j])
+	})
+	return rows
+}
+
+func topBlocked(verdict string) bool {
+	return strings.HasPrefix(verdict, "drop") || strings.HasPrefix(verdict, "divert") || strings.HasPrefix(verdict, "honeypot")
+}
+
+// render returns the lines of the screen. Lines are cut to width, and the rows to height
+// (no limits if zero).
+func (v *topView) render(width, height int, now time.Time) []string {
+	rows := v.visible()
+	var rate float64
+	for _, r := range rows {
+		rate += r.Rate
+	}
+	order := topSortKeys[v.sortBy]
+	if v.reverse {
+		order += " (reversed)"
+	}
+	status := fmt.Sprintf("OpenGFW top - %s - %d streams shown, %d tracked - %s total - sort: %s",
+		now.Format("15:04:05"), len(rows), v.total, topFormatRate(rate), order)
+	if p := topProtocols[v.protocol]; p != "" {
+		status += " - " + p + " only"
+	}
+	if v.blockedOnly {
+		status += " - blocked only"
+	}
+	lines := []string{status}
+	switch {
+	case v.editing:
+		lines = append(lines, "Filter: "+v.filter+"_")
+	case v.err != nil:
+		lines = append(lines, "Error: "+v.err.Error())
+	case v.filter != "":
+		lines = append(lines, "Filter: "+v.filter)
+	default:
+		lines = append(lines, "")
+	}
+	const format = "%-5s %-9s %-28s %-28s %11s %10s %8s %-13s %s"
+	lines = append(lines, fmt.Sprintf(format, "PROTO", "APP", "SOURCE", "DESTINATION", "RATE", "TOTAL", "AGE", "VERDICT", "RULE"))
+	if height > 0 {
+		maxRows := height - len(lines)
+		if maxRows < 0 {
+			maxRows = 0
+		}
+		if v.offset > len(rows)-maxRows {
+			v.offset = len(rows) - maxRows
+		}
+		if v.offset < 0 {
+			v.offset = 0
+		}
+		rows = rows[v.offset:]
+		if len(rows) > maxRows {
+			rows = rows[:maxRows]
+		}
+	}
+	for _, r := range rows {
+		lines = append(lines, fmt.Sprintf(format,
+			r.Protocol, r.AppProto, r.Src, r.Dst, topFormatRate(r.Rate),
+			topFormatBytes(r.SrcBytes+r.DstBytes), topFormatAge(now.Sub(r.StartTime)), r.Verdict, r.Rule))
+	}
+	if width > 0 {
+		for i, l := range lines {
+			if len(l) > width {
+				lines[i] = l[:width]
+			}
+		}
+	}
+	return lines
+}
+
+// key handles a key press, and returns false to quit.
+func (v *topView) key(k string) bool {
+	if v.editing {
+		switch k {
+		case "\r", "\n":
+			v.editing = false
+		case "\x1b":
+			v.editing = false
+			v.filter = ""
+		case "\x7f", "\b":
+			if len(v.filter) > 0 {
+				v.filter = v.filter[:len(v.filter)-1]
+			}
+		default:
+			if len(k) == 1 && k[0] >= ' ' && k[0] <= '~' {
+				v.filter += k
+			}
+		}
+		return true
+	}
+	switch k {
+	case "q", "Q", "\x03":
+		return false
+	case "s":
+		v.sortBy = (v.sortBy + 1) % len(topSortKeys)
+	case "r":
+		v.reverse = !v.reverse
+	case "p":
+		v.protocol = (v.protocol + 1) % len(topProtocols)
+	case "b":
+		v.blockedOnly = !v.blockedOnly
+	case "/":
+		v.editing = true
+	case "j", "\x1b[B":
+		v.offset++
+	case "k", "\x1b[A":
+		v.offset--
+	}
+	return true
+}
+
+func topFormatBytes(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+func topFormatRate(r float64) string {
+	return topFormatBytes(uint64(r)) + "/s"
+}
+
+func topFormatAge(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+}
+
+func topQuery() string {
+	q := url.Values{}
+	for _, c := range topCIDRs {
+		q.Add("cidr", c)
+	}
+	for _, p := range topPorts {
+		q.Add("port", p)
+	}
+	if topProtocol != "" {
+		q.Set("protocol", topProtocol)
+	}
+	if len(q) == 0 {
+		return "/streams"
+	}
+	return "/streams?" + q.Encode()
+}
+
+func runTop(cmd *cobra.Command, args []string) {
+	view := &topView{sortBy: -1}
+	for i, k := range topSortKeys {
+		if k == topSort {
+			view.sortBy = i
+		}
+	}
+	if view.sortBy < 0 {
+		logger.Fatal("invalid sort key", zap.String("sort", topSort))
+	}
+	// Resolve the address & token once, instead of reading the config on every refresh
+	apiAddr = apiURL("")
+	apiToken = apiAuthToken()
+	path := topQuery()
+
+	fd := int(os.Stdin.Fd())
+	oldState, err := unix.IoctlGetTermios(fd, topIoctlGetTermios)
+	if topOnce || err != nil || !topIsTerminal(int(os.Stdout.Fd())) {
+		// Two samples for the rates
+		var resp apiStreamsResponse
+		callAPI(http.MethodGet, path, nil, &resp)
+		view.update(resp, time.Now())
+		time.Sleep(topInterval)
+		callAPI(http.MethodGet, path, nil, &resp)
+		now := time.Now()
+		view.update(resp, now)
+		for _, l := range view.render(0, 0, now) {
+			fmt.Println(strings.TrimRight(l, " "))
+		}
+		return
+	}
+
+	raw := *oldState
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, topIoctlSetTermios, &raw); err != nil {
+		logger.Fatal("failed to set up the terminal", zap.Error(err))
+	}
+	out := bufio.NewWriter(os.Stdout)
+	// Alternate screen, hidden cursor
+	_, _ = out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		_, _ = out.WriteString("\x1b[?25h\x1b[?1049l")
+		_ = out.Flush()
+		_ = unix.IoctlSetTermios(fd, topIoctlSetTermios, oldState)
+	}()
+
+	type result struct {
+		resp apiStreamsResponse
+		time time.Time
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		for {
+			var r result
+			r.err = requestAPI(http.MethodGet, path, nil, &r.resp)
+			r.time = time.Now()
+			results <- r
+			time.Sleep(topInterval)
+		}
+	}()
+	keys := make(chan string, 16)
+	go topReadKeys(os.Stdin, keys)
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+
+	for {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				view.err = r.err
+			} else {
+				view.update(r.resp, r.time)
+			}
+		case k, ok := <-keys:
+			if !ok {
+				// stdin closed
+				return
+			}
+			if !view.key(k) {
+				return
+			}
+		case <-resize:
+		}
+		width, height := 80, 24
+		if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil && ws.Col > 0 {
+			width, height = int(ws.Col), int(ws.Row)
+		}
+		_, _ = out.WriteString("\x1b[H")
+		for i, l := range view.render(width, height, time.Now()) {
+			if i > 0 {
+				_, _ = out.WriteString("\r\n")
+			}
+			_, _ = out.WriteString(l)
+			_, _ = out.WriteString("\x1b[K")
+		}
+		_, _ = out.WriteString("\x1b[J")
+		_ = out.Flush()
+	}
+}
+
+func topIsTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, topIoctlGetTermios)
+	return err == nil
+}
+
+// topReadKeys reads the key presses from the terminal, with the escape sequences
+// of the arrow keys as a single key.
+func topReadKeys(f *os.File, keys chan<- string) {
+	buf := make([]byte, 64)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			close(keys)
+			return
+		}
+		b := buf[:n]
+		for len(b) > 0 {
+			if len(b) >= 3 && b[0] == 0x1b && b[1] == '[' {
+				keys <- string(b[:3])
+				b = b[3:]
+				continue
+			}
+			keys <- string(b[:1])
+			b = b[1:]
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package cmd
+
+import "golang.org/x/sys/unix"
+
+const (
+	topIoctlGetTermios = unix.TIOCGETA
+	topIoctlSetTermios = unix.TIOCSETA
+)
@@ -0,0 +1,8 @@
+package cmd
+
+import "golang.org/x/sys/unix"
+
+const (
+	topIoctlGetTermios = unix.TCGETS
+	topIoctlSetTermios = unix.TCSETS
+)
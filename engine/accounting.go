@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+const (
+	// The bytes of a stream are passed to Accounting once this many are pending,
+	// or once the oldest pending ones are this old, and when the stream ends.
+	accountingFlushBytes    = 64 * 1024
+	accountingFlushInterval = 5 * time.Second
+)
+
+// streamAccount batches the bytes of a stream for Accounting.
+// A nil *streamAccount counts nothing.
+type streamAccount struct {
+	accounting Accounting
+	pending    uint64
+	since      time.Time // Of the oldest pending bytes
+}
+
+func newStreamAccount(accounting Accounting) *streamAccount {
+	if accounting == nil {
+		return nil
+	}
+	return &streamAccount{accounting: accounting}
+}
+
+func (a *streamAccount) Add(info ruleset.StreamInfo, bytes int, now time.Time) {
+	if a == nil {
+		return
+	}
+	if a.pending == 0 {
+		a.since = now
+	}
+	a.pending += uint64(bytes)
+	if a.pending >= accountingFlushBytes || now.Sub(a.since) >= accountingFlushInterval {
+		a.Flush(info)
+	}
+}
+
+func (a *streamAccount) Flush(info ruleset.StreamInfo) {
+	if a == nil || a.pending == 0 {
+		return
+	}
+	a.accounting.Account(info, a.pending)
+	a.pending = 0
+}
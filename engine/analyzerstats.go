@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AnalyzerStats are the statistics of an analyzer, summed over all workers.
+type AnalyzerStats struct {
+	Name         string
+	Streams      uint64        // Streams the analyzer has been run on
+	Bytes        uint64        // Bytes fed to the analyzer
+	Time         time.Duration // Time spent in the analyzer
+	Classified   uint64        // Streams the analyzer has found properties for
+	Unclassified uint64        // Streams the analyzer is done with, without having found any properties
+	Errors       uint64        // Errors reported by the analyzer
+}
+
+// analyzerCounters are the statistics of an analyzer in a worker.
+// Only updated by the worker's goroutine, but read from others.
+type analyzerCounters struct {
+	streams      atomic.Uint64
+	bytes        atomic.Uint64
+	time         atomic.Int64 // Nanoseconds
+	classified   atomic.Uint64
+	unclassified atomic.Uint64
+	errors       atomic.Uint64
+}
+
+// analyzerStatsSet holds the counters of the analyzers of a worker, by name.
+type analyzerStatsSet struct {
+	mutex    sync.Mutex
+	counters map[string]*analyzerCounters
+}
+
+func newAnalyzerStatsSet() *analyzerStatsSet {
+	return &analyzerStatsSet{counters: make(map[string]*analyzerCounters)}
+}
+
+// Get returns the counters of an analyzer, creating them if needed.
+func (s *analyzerStatsSet) Get(name string) *analyzerCounters {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := s.counters[name]
+	if c == nil {
+		c = &analyzerCounters{}
+		s.counters[name] = c
+	}
+	return c
+}
+
+// addTo adds the counters of the set to the stats in m.
+func (s *analyzerStatsSet) addTo(m map[string]*AnalyzerStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, c := range s.counters {
+		st := m[name]
+		if st == nil {
+			st = &AnalyzerStats{Name: name}
+			m[name] = st
+		}
+		st.Streams += c.streams.Load()
+		st.Bytes += c.bytes.Load()
+		st.Time += time.Duration(c.time.Load())
+		st.Classified += c.classified.Load()
+		st.Unclassified += c.unclassified.Load()
+		st.Errors += c.errors.Load()
+	}
+}
+
+// analyzerRun tracks the run of an analyzer on a stream, for the analyzer's statistics.
+type analyzerRun struct {
+	stats      *analyzerCounters
+	classified bool
+}
+
+func newAnalyzerRun(stats *analyzerCounters) analyzerRun {
+	stats.streams.Add(1)
+	return analyzerRun{stats: stats}
+}
+
+// Fed records a call of the analyzer that started at start, with the number of bytes it was fed.
+func (r *analyzerRun) Fed(start time.Time, bytes int) {
+	r.stats.time.Add(int64(time.Since(start)))
+	r.stats.bytes.Add(uint64(bytes))
+}
+
+// Updated records whether the analyzer has updated the stream's properties.
+func (r *analyzerRun) Updated(updated bool) {
+	if updated && !r.classified {
+		r.classified = true
+		r.stats.classified.Add(1)
+	}
+}
+
+// Done records that the analyzer is done with the stream.
+func (r *analyzerRun) Done() {
+	if !r.classified {
+		r.stats.unclassified.Add(1)
+	}
+}
+
+// AnalyzerStats returns the statistics of every analyzer that has been run, sorted by name.
+func (e *engine) AnalyzerStats() []AnalyzerStats {
+	m := make(map[string]*AnalyzerStats)
+	for _, w := range e.workers {
+		w.analyzerStats.addTo(m)
+	}
+	stats := make([]AnalyzerStats, 0, len(m))
+	for _, st := range m {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
@@ -0,0 +1,22 @@
+package engine
+
+// AsymmetricVerdict is what to do with the TCP streams found to be asymmetric.
+type AsymmetricVerdict int
+
+const (
+	// AsymmetricVerdictAnalyze keeps analyzing the stream, the rules seeing it as asymmetric.
+	AsymmetricVerdictAnalyze AsymmetricVerdict = iota
+	// AsymmetricVerdictAccept accepts the stream and stops analyzing it.
+	AsymmetricVerdictAccept
+	// AsymmetricVerdictDrop blocks the stream.
+	AsymmetricVerdictDrop
+)
+
+// AsymmetricPolicy handles the TCP streams only one direction of which crosses the engine, due to asymmetric
+// routing, whose analyzers would otherwise wait for the other direction until the stream ends.
+// A stream is asymmetric once Packets segments of one direction have acknowledged data never seen from the other,
+// which is reported to Logger.PacketAnomaly. Only the streams still being analyzed are checked.
+type AsymmetricPolicy struct {
+	Packets int
+	Verdict AsymmetricVerdict
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"github.com/google/gopacket"
+
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+// PacketSink receives copies of the packets of streams matched by capture, mirror or capture-http rules.
+// It must be safe for concurrent use.
+type PacketSink interface {
+	// WritePacket writes a packet starting with the IP header.
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+type capturedPacket struct {
+	CI   gopacket.CaptureInfo
+	Data []byte
+}
+
+// streamCapture keeps the latest packets of a stream until a capture, mirror or capture-http rule
+// matches it, then writes them and all its following packets to the rule's sink,
+// tagged with the stream's UUID as io.PacketComment. A nil *streamCapture does nothing.
+type streamCapture struct {
+	capturer  PacketSink
+	mirror    PacketSink
+	http      PacketSink
+	ancillary []interface{}    // AncillaryData of the packets, shared
+	sink      PacketSink       // Non-nil once started
+	lookback  []capturedPacket // Ring buffer
+	next      int              // Index of the oldest packet, once the buffer is full
+}
+
+func newStreamCapture(capturer, mirror, http PacketSink, lookback int, uuid string) *streamCapture {
+	if capturer == nil && mirror == nil && http == nil {
+		return nil
+	}
+	return &streamCapture{
+		capturer:  capturer,
+		mirror:    mirror,
+		http:      http,
+		ancillary: []interface{}{io.PacketComment("flow_uuid=" + uuid)},
+		lookback:  make([]capturedPacket, 0, lookback),
+	}
+}
+
+// Packet handles a packet of the stream. data is copied if it needs to be kept.
+func (c *streamCapture) Packet(ci gopacket.CaptureInfo, data []byte) error {
+	if c == nil || data == nil {
+		return nil
+	}
+	ci.AncillaryData = c.ancillary
+	if c.sink != nil {
+		return c.sink.WritePacket(ci, data)
+	}
+	if cap(c.lookback) == 0 {
+		return nil
+	}
+	p := capturedPacket{CI: ci, Data: append([]byte(nil), data...)}
+	if len(c.lookback) < cap(c.lookback) {
+		c.lookback = append(c.lookback, p)
+	} else {
+		c.lookback[c.next] = p
+		c.next = (c.next + 1) % len(c.lookback)
+	}
+	return nil
+}
+
+// Start writes the buffered packets to the sink of the action (ActionCapture, ActionMirror or ActionCaptureHTTP),
+// and makes every following packet be written there directly.
+func (c *streamCapture) Start(action ruleset.Action) error {
+	if c == nil || c.sink != nil {
+		return nil
+	}
+	switch action {
+	case ruleset.ActionCapture:
+		c.sink = c.capturer
+	case ruleset.ActionMirror:
+		c.sink = c.mirror
+	case ruleset.ActionCaptureHTTP:
+		c.sink = c.http
+	}
+	if c.sink == nil {
+		return nil
+	}
+	lookback := append(c.lookback[c.next:], c.lookback[:c.next]...)
+	c.lookback = nil
+	for _, p := range lookback {
+		if err := c.sink.WritePacket(p.CI, p.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Active returns whether a capture, mirror or capture-http rule has matched the stream.
+func (c *streamCapture) Active() bool {
+	return c != nil && c.sink != nil
+}
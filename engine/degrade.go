@@ -0,0 +1,41 @@
+package engine
+
+import "github.com/apernet/OpenGFW/analyzer"
+
+// Degradation is what the engine gives up in degraded mode, to keep up with the traffic under overload
+// instead of letting its queues overflow. Streams that no analyzer found any properties for
+// get DefaultVerdictAcceptStream, whatever UnclassifiedVerdict is.
+type Degradation struct {
+	SkipAnalyzers map[string]bool // Not run on the streams created while degraded
+}
+
+func (e *engine) SetDegraded(d *Degradation) {
+	e.degraded.Store(d)
+}
+
+func (e *engine) Degraded() *Degradation {
+	return e.degraded.Load()
+}
+
+// degradedAnalyzers removes the analyzers skipped in degraded mode, if it's enabled.
+func degradedAnalyzers[T analyzer.Analyzer](ans []T, d *Degradation) []T {
+	if d == nil || len(d.SkipAnalyzers) == 0 {
+		return ans
+	}
+	kept := ans[:0]
+	for _, a := range ans {
+		if !d.SkipAnalyzers[a.Name()] {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// unclassifiedVerdict returns the default verdict of unclassified streams, which is
+// DefaultVerdictAcceptStream in degraded mode.
+func unclassifiedVerdict(v DefaultVerdict, d *Degradation) DefaultVerdict {
+	if d != nil {
+		return DefaultVerdictAcceptStream
+	}
+	return v
+}
@@ -2,7 +2,11 @@ package engine
 
 import (
 	"context"
+	"errors"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apernet/OpenGFW/io"
 	"github.com/apernet/OpenGFW/ruleset"
@@ -13,10 +17,25 @@ import (
 
 var _ Engine = (*engine)(nil)
 
+const (
+	DefaultDrainTimeout = 2 * time.Second
+
+	drainPollInterval = 10 * time.Millisecond
+)
+
 type engine struct {
-	logger  Logger
-	ioList  []io.PacketIO
-	workers []*worker
+	logger   Logger
+	ioList   []io.PacketIO
+	ioNames  []string
+	workers  []*worker
+	tracer   Tracer
+	idsOnly  *atomic.Bool                 // Shared with the workers
+	degraded *atomic.Pointer[Degradation] // Shared with the workers
+	held     *heldPackets                 // Shared with the workers
+	running  atomic.Bool                  // From when the IOs are registered until Run returns
+
+	started      func() error
+	drainTimeout time.Duration
 }
 
 func NewEngine(config Config) (Engine, error) {
@@ -25,6 +44,14 @@ func NewEngine(config Config) (Engine, error) {
 		workerCount = runtime.NumCPU()
 	}
 	var err error
+	idsOnly := &atomic.Bool{}
+	idsOnly.Store(config.IDSOnly)
+	degraded := &atomic.Pointer[Degradation]{}
+	held := newHeldPackets(config.MaxHeldPackets, config.MaxHeldPacketsPerStream)
+	external := make(map[string]bool, len(config.ExternalInterfaces))
+	for _, name := range config.ExternalInterfaces {
+		external[name] = true
+	}
 	workers := make([]*worker, workerCount)
 	for i := range workers {
 		workers[i], err = newWorker(workerConfig{
@@ -35,15 +62,48 @@ func NewEngine(config Config) (Engine, error) {
 			TCPMaxBufferedPagesTotal:   config.WorkerTCPMaxBufferedPagesTotal,
 			TCPMaxBufferedPagesPerConn: config.WorkerTCPMaxBufferedPagesPerConn,
 			UDPMaxStreams:              config.WorkerUDPMaxStreams,
+			SCTPMaxStreams:             config.WorkerSCTPMaxStreams,
+			ICMPMaxStreams:             config.WorkerICMPMaxStreams,
+			StreamIdleTimeout:          config.StreamIdleTimeout,
+			UnmatchedVerdict:           config.UnmatchedVerdict,
+			UnclassifiedVerdict:        config.UnclassifiedVerdict,
+			Capturer:                   config.Capturer,
+			Mirror:                     config.Mirror,
+			HTTPCapturer:               config.HTTPCapturer,
+			CaptureLookback:            config.CaptureLookback,
+			Tracer:                     config.Tracer,
+			IDSOnly:                    idsOnly,
+			Degraded:                   degraded,
+			StateSync:                  config.StateSync,
+			Accounting:                 config.Accounting,
+			QoS:                        config.QoS,
+			IPv6Ext:                    config.IPv6Ext,
+			TCPEvasion:                 config.TCPEvasion,
+			External:                   external,
+			Asymmetric:                 config.Asymmetric,
+			PacketRing:                 config.PacketRing,
+			PacketRingDumper:           config.PacketRingDumper,
+			Held:                       held,
 		})
 		if err != nil {
 			return nil, err
 		}
 	}
+	drainTimeout := config.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = DefaultDrainTimeout
+	}
 	return &engine{
-		logger:  config.Logger,
-		ioList:  config.IOs,
-		workers: workers,
+		logger:       config.Logger,
+		held:         held,
+		ioList:       config.IOs,
+		ioNames:      config.IONames,
+		workers:      workers,
+		tracer:       config.Tracer,
+		idsOnly:      idsOnly,
+		degraded:     degraded,
+		started:      config.Started,
+		drainTimeout: drainTimeout,
 	}, nil
 }
 
@@ -56,43 +116,111 @@ func (e *engine) UpdateRuleset(r ruleset.Ruleset) error {
 	return nil
 }
 
+func (e *engine) SetIDSOnly(enabled bool) {
+	e.idsOnly.Store(enabled)
+}
+
+func (e *engine) IDSOnly() bool {
+	return e.idsOnly.Load()
+}
+
 func (e *engine) Run(ctx context.Context) error {
-	ioCtx, ioCancel := context.WithCancel(ctx)
-	defer ioCancel() // Stop workers & IOs
+	// Not derived from ctx, so that the IOs & workers keep running while draining
+	ioCtx, ioCancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		// Stop workers & IOs
+		ioCancel()
+		wg.Wait()
+	}()
 
 	// Start workers
 	for _, w := range e.workers {
-		go w.Run(ioCtx)
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.Run(ioCtx)
+		}(w)
 	}
 
 	// Register callbacks
 	errChan := make(chan error, len(e.ioList))
-	for _, i := range e.ioList {
+	for idx, i := range e.ioList {
 		ioEntry := i // Make sure dispatch() uses the correct ioEntry
+		var ioName string
+		if idx < len(e.ioNames) {
+			ioName = e.ioNames[idx]
+		}
 		err := ioEntry.Register(ioCtx, func(p io.Packet, err error) bool {
 			if err != nil {
 				errChan <- err
 				return false
 			}
-			return e.dispatch(ioEntry, p)
+			return e.dispatch(ioEntry, ioName, p)
 		})
 		if err != nil {
 			return err
 		}
 	}
+	e.running.Store(true)
+	defer e.running.Store(false)
+	if e.started != nil {
+		if err := e.started(); err != nil {
+			return err
+		}
+	}
 
 	// Block until IO errors or context is cancelled
 	select {
 	case err := <-errChan:
 		return err
 	case <-ctx.Done():
-		return nil
+		return e.drain(errChan)
+	}
+}
+
+// drain removes the firewall rules of the IOs, so that no more packets are queued to the engine,
+// and waits for the packets already in the worker queues to be processed, up to the drain timeout.
+// It returns the errors of removing the rules.
+func (e *engine) drain(errChan <-chan error) error {
+	var errs []error
+	for _, i := range e.ioList {
+		if rr, ok := i.(io.RuleRemover); ok {
+			if err := rr.RemoveRules(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if e.drainTimeout < 0 {
+		return errors.Join(errs...)
 	}
+	timeout := time.NewTimer(e.drainTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	// Packets may still be on their way from the IOs, so the queues must be empty twice in a row
+	empty := 0
+	for empty < 2 {
+		select {
+		case <-timeout.C:
+			return errors.Join(errs...)
+		case <-errChan:
+			// IO stopped, nothing more to wait for
+			return errors.Join(errs...)
+		case <-ticker.C:
+		}
+		if e.Stats().QueueLength == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // dispatch dispatches a packet to a worker.
 // This must be safe for concurrent use, as it may be called from multiple IOs.
-func (e *engine) dispatch(ioEntry io.PacketIO, p io.Packet) bool {
+func (e *engine) dispatch(ioEntry io.PacketIO, ioName string, p io.Packet) bool {
 	data := p.Data()
 	ipVersion := data[0] >> 4
 	var layerType gopacket.LayerType
@@ -107,13 +235,44 @@ func (e *engine) dispatch(ioEntry io.PacketIO, p io.Packet) bool {
 	}
 	// Load balance by stream ID
 	index := p.StreamID() % uint32(len(e.workers))
+	if ports, ok := sctpPorts(data, ipVersion); ok {
+		// The paths of a multi-homed association are different streams to the IO,
+		// but must be handled by the same worker
+		index = ports % uint32(len(e.workers))
+	}
 	packet := gopacket.NewPacket(data, layerType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-	e.workers[index].Feed(&workerPacket{
+	packet.Metadata().Timestamp = time.Now()
+	packet.Metadata().Length = len(data)
+	packet.Metadata().CaptureLength = len(data)
+	if ip, ok := p.(io.InterfacePacket); ok {
+		packet.Metadata().InterfaceIndex = ip.InterfaceIndex()
+		if out := ip.OutInterfaceIndex(); out != 0 {
+			packet.Metadata().AncillaryData = []interface{}{outInterface(out)}
+		}
+	}
+	if op, ok := p.(io.OwnerPacket); ok {
+		if uid, gid, ok := op.Owner(); ok {
+			packet.Metadata().AncillaryData = append(packet.Metadata().AncillaryData,
+				socketOwner{UID: uid, GID: gid})
+		}
+	}
+	wPkt := &workerPacket{
 		StreamID: p.StreamID(),
 		Packet:   packet,
-		SetVerdict: func(v io.Verdict, b []byte) error {
+		IO:       ioName,
+		SetVerdict: func(v io.Verdict, mark uint32, b []byte) error {
+			if mark != 0 {
+				return ioEntry.SetVerdictWithMark(p, v, mark)
+			}
 			return ioEntry.SetVerdict(p, v, b)
 		},
-	})
+	}
+	if inj, ok := ioEntry.(io.PacketInjector); ok {
+		wPkt.Inject = inj.InjectPacket
+	}
+	if e.tracer != nil {
+		wPkt.Received = packet.Metadata().Timestamp
+	}
+	e.workers[index].Feed(wPkt)
 	return true
 }
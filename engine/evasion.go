@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// EvasionAction is what to do with the packets of an evasion attempt.
+type EvasionAction int
+
+const (
+	// EvasionActionNone handles the packets like the others.
+	EvasionActionNone EvasionAction = iota
+	// EvasionActionLog reports the packets to Logger.PacketAnomaly, and handles them like the others.
+	EvasionActionLog
+	// EvasionActionIgnore reports the packets, and lets them through without analyzing them,
+	// like the server they're meant to confuse us about discards them.
+	EvasionActionIgnore
+	// EvasionActionDrop reports & drops the packets.
+	EvasionActionDrop
+)
+
+// TCPEvasionPolicy handles the TCP segments of classic IDS evasion: segments the server discards or never
+// gets, but that would otherwise be analyzed, so that what is analyzed differs from what the server sees.
+// Only the segments of the streams still being analyzed are checked.
+type TCPEvasionPolicy struct {
+	// BadChecksum is for segments with an invalid TCP checksum.
+	BadChecksum EvasionAction
+	// LowTTL is for segments whose TTL (hop limit) is lower by more than TTLDelta than that of the first
+	// packet of their direction, so that they can expire between us and the server.
+	LowTTL   EvasionAction
+	TTLDelta uint8
+	// Overlap is for segments carrying data the receiver has already acknowledged, which it discards,
+	// but for keep-alives (1 byte).
+	Overlap EvasionAction
+}
+
+// tcpEvasion is the state of a TCP stream for TCPEvasionPolicy, by direction (client to server first).
+type tcpEvasion struct {
+	ttl    [2]uint8
+	acked  [2]reassembly.Sequence // Of the data sent that way, by the ACKs of the other way
+	hasAck [2]bool
+}
+
+// check returns what to do with a segment & why, the direction being that of reassembly.
+func (e *tcpEvasion) check(p *TCPEvasionPolicy, tcp *layers.TCP, data []byte, dir reassembly.TCPFlowDirection) (EvasionAction, string) {
+	d, other := 0, 1
+	if dir == reassembly.TCPDirServerToClient {
+		d, other = 1, 0
+	}
+	action, reason := EvasionActionNone, ""
+	report := func(a EvasionAction, r string) {
+		if a > action {
+			action, reason = a, r
+		}
+	}
+	if p.BadChecksum != EvasionActionNone && !tcpChecksumValid(data) {
+		report(p.BadChecksum, "bad TCP checksum")
+	}
+	if ttl, ok := packetTTL(data); ok && p.LowTTL != EvasionActionNone {
+		if e.ttl[d] == 0 {
+			e.ttl[d] = ttl
+		} else if int(ttl)+int(p.TTLDelta) < int(e.ttl[d]) {
+			report(p.LowTTL, fmt.Sprintf("low TTL %d instead of %d", ttl, e.ttl[d]))
+		}
+	}
+	if p.Overlap != EvasionActionNone && len(tcp.Payload) > 1 && e.hasAck[d] &&
+		e.acked[d].Difference(reassembly.Sequence(tcp.Seq)) < 0 {
+		report(p.Overlap, "TCP data overlapping acknowledged data")
+	}
+	if action < EvasionActionIgnore && tcp.ACK {
+		// Only the ACKs of segments that get through count
+		ack := reassembly.Sequence(tcp.Ack)
+		if !e.hasAck[other] || e.acked[other].Difference(ack) > 0 {
+			e.acked[other], e.hasAck[other] = ack, true
+		}
+	}
+	return action, reason
+}
+
+// packetTTL returns the TTL (IPv4) or hop limit (IPv6) of a packet, starting with the IP header.
+func packetTTL(data []byte) (uint8, bool) {
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		return data[8], true
+	case len(data) >= ipv6HeaderLen && data[0]>>4 == 6:
+		return data[7], true
+	default:
+		return 0, false
+	}
+}
+
+// tcpChecksumValid returns whether the TCP checksum of a packet, starting with the IP header, is valid.
+// It returns true if it can't tell, e.g. for truncated packets or with IPv6 routing headers,
+// with which the pseudo header has the final destination instead of the one of the packet.
+func tcpChecksumValid(data []byte) bool {
+	var sum uint32
+	var segment []byte
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		ihl, total := int(data[0]&0x0f)*4, int(binary.BigEndian.Uint16(data[2:4]))
+		if ihl < 20 || total > len(data) || total < ihl+20 {
+			return true
+		}
+		sum = checksumAdd(0, data[12:20])
+		segment = data[ihl:total]
+	case len(data) >= ipv6HeaderLen && data[0]>>4 == 6:
+		offset, end := ipv6HeaderLen, ipv6HeaderLen+int(binary.BigEndian.Uint16(data[4:6]))
+		if ext, ok := parseIPv6Ext(data); ok {
+			if ext.UpperOffset == 0 || ext.Fragment || slices.Contains(ext.Headers, 43) {
+				return true
+			}
+			offset = ext.UpperOffset
+		}
+		if end > len(data) || end < offset+20 {
+			return true
+		}
+		sum = checksumAdd(0, data[8:40])
+		segment = data[offset:end]
+	default:
+		return true
+	}
+	sum += uint32(layers.IPProtocolTCP) + uint32(len(segment))
+	sum = checksumAdd(sum, segment)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum == 0xffff
+}
+
+// checksumAdd adds data to an Internet checksum (RFC 1071) being computed.
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
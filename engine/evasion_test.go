@@ -0,0 +1,423 @@
+package engine
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+// evasionTestSegment is a TCP segment of a test stream.
+type evasionTestSegment struct {
+	rev     bool // Server to client
+	ttl     uint8
+	tcp     layers.TCP
+	corrupt bool // Invalid checksum
+}
+
+// packet returns the serialized segment and the TCP layer decoded from it.
+func (g evasionTestSegment) packet(t *testing.T, v6 bool) ([]byte, *layers.TCP) {
+	tcp := g.tcp
+	data, decoded := evasionTestPacket(t, v6, g.rev, g.ttl, &tcp)
+	if g.corrupt {
+		data[len(data)-1] ^= 0xff
+	}
+	return data, decoded
+}
+
+// evasionTestPacket returns a serialized IPv4 or IPv6 packet between the addresses & ports of synTestPacket,
+// with the TCP layer & its payload, and the TCP layer decoded from it.
+func evasionTestPacket(t *testing.T, v6, rev bool, ttl uint8, tcp *layers.TCP) ([]byte, *layers.TCP) {
+	var ip gopacket.NetworkLayer
+	firstLayer := layers.LayerTypeIPv4
+	if v6 {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: ttl, NextHeader: layers.IPProtocolTCP,
+			SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+		if rev {
+			ip6.SrcIP, ip6.DstIP = ip6.DstIP, ip6.SrcIP
+		}
+		ip, firstLayer = ip6, layers.LayerTypeIPv6
+	} else {
+		ip4 := &layers.IPv4{Version: 4, TTL: ttl, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+		if rev {
+			ip4.SrcIP, ip4.DstIP = ip4.DstIP, ip4.SrcIP
+		}
+		ip = ip4
+	}
+	tcp.SrcPort, tcp.DstPort = 40000, 443
+	if rev {
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(tcp.Payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), firstLayer, gopacket.Default)
+	decoded, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		t.Fatalf("no TCP layer in %v", packet)
+	}
+	return buf.Bytes(), decoded
+}
+
+// evasionTestHandshake is the handshake of the test streams, the client's ISN being 1000 & the server's 5000.
+var evasionTestHandshake = []evasionTestSegment{
+	{ttl: 64, tcp: layers.TCP{SYN: true, Seq: 999, Window: 64240}},
+	{rev: true, ttl: 58, tcp: layers.TCP{SYN: true, ACK: true, Seq: 4999, Ack: 1000, Window: 65160}},
+	{ttl: 64, tcp: layers.TCP{ACK: true, Seq: 1000, Ack: 5000, Window: 502}},
+}
+
+func TestTCPEvasion_Check(t *testing.T) {
+	all := &TCPEvasionPolicy{
+		BadChecksum: EvasionActionDrop,
+		LowTTL:      EvasionActionDrop,
+		TTLDelta:    5,
+		Overlap:     EvasionActionDrop,
+	}
+	request := layers.TCP{ACK: true, PSH: true, Seq: 1000, Ack: 5000, BaseLayer: layers.BaseLayer{Payload: []byte("GET / HTTP/1.1\r\n\r\n")}}
+	ackRequest := layers.TCP{ACK: true, Seq: 5000, Ack: 1018}
+	testCases := []struct {
+		name       string
+		policy     *TCPEvasionPolicy
+		segments   []evasionTestSegment // After the handshake, the last one being checked
+		wantAction EvasionAction
+		wantReason string
+	}{
+		{
+			name:   "normal traffic",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest},
+				{rev: true, ttl: 58, tcp: layers.TCP{ACK: true, PSH: true, Seq: 5000, Ack: 1018, BaseLayer: layers.BaseLayer{Payload: []byte("HTTP/1.1 200 OK\r\n\r\n")}}},
+				{ttl: 64, tcp: layers.TCP{ACK: true, Seq: 1018, Ack: 5019}},
+				{ttl: 64, tcp: layers.TCP{ACK: true, PSH: true, Seq: 1018, Ack: 5019, BaseLayer: layers.BaseLayer{Payload: []byte("GET /next HTTP/1.1\r\n\r\n")}}},
+			},
+		},
+		{
+			name:   "TTL within delta",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 59, tcp: request},
+			},
+		},
+		{
+			name:   "retransmission of unacknowledged data",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{ttl: 64, tcp: request},
+			},
+		},
+		{
+			name:   "keep-alive",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest},
+				{ttl: 64, tcp: layers.TCP{ACK: true, Seq: 1017, Ack: 5000, BaseLayer: layers.BaseLayer{Payload: []byte{0}}}},
+			},
+		},
+		{
+			name:   "bad checksum",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request, corrupt: true},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "bad TCP checksum",
+		},
+		{
+			name:   "bad checksum of the server",
+			policy: all,
+			segments: []evasionTestSegment{
+				{rev: true, ttl: 58, tcp: ackRequest, corrupt: true},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "bad TCP checksum",
+		},
+		{
+			name:   "bad checksum not checked",
+			policy: &TCPEvasionPolicy{LowTTL: EvasionActionDrop, TTLDelta: 5},
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request, corrupt: true},
+			},
+		},
+		{
+			name:   "low TTL",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 3, tcp: request},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "low TTL 3 instead of 64",
+		},
+		{
+			name:   "low TTL of the server",
+			policy: all,
+			segments: []evasionTestSegment{
+				{rev: true, ttl: 50, tcp: ackRequest},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "low TTL 50 instead of 58",
+		},
+		{
+			name:   "low TTL not checked",
+			policy: &TCPEvasionPolicy{BadChecksum: EvasionActionDrop},
+			segments: []evasionTestSegment{
+				{ttl: 3, tcp: request},
+			},
+		},
+		{
+			name:   "overlap",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest},
+				{ttl: 64, tcp: layers.TCP{ACK: true, PSH: true, Seq: 1000, Ack: 5000, BaseLayer: layers.BaseLayer{Payload: []byte("GET /evil HTTP/1.1\r\n\r\n")}}},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "TCP data overlapping acknowledged data",
+		},
+		{
+			name:   "partial overlap",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest},
+				{ttl: 64, tcp: layers.TCP{ACK: true, PSH: true, Seq: 1010, Ack: 5000, BaseLayer: layers.BaseLayer{Payload: []byte("1.1\r\n\r\nGET / HTTP/1.1\r\n\r\n")}}},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "TCP data overlapping acknowledged data",
+		},
+		{
+			name:   "ACK of a dropped segment ignored",
+			policy: all,
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest, corrupt: true},
+				{ttl: 64, tcp: request},
+			},
+		},
+		{
+			name: "ACK of a logged segment counted",
+			policy: &TCPEvasionPolicy{
+				BadChecksum: EvasionActionLog,
+				Overlap:     EvasionActionDrop,
+			},
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest, corrupt: true},
+				{ttl: 64, tcp: request},
+			},
+			wantAction: EvasionActionDrop,
+			wantReason: "TCP data overlapping acknowledged data",
+		},
+		{
+			name:   "overlap not checked",
+			policy: &TCPEvasionPolicy{BadChecksum: EvasionActionDrop},
+			segments: []evasionTestSegment{
+				{ttl: 64, tcp: request},
+				{rev: true, ttl: 58, tcp: ackRequest},
+				{ttl: 64, tcp: request},
+			},
+		},
+		{
+			name: "strongest action",
+			policy: &TCPEvasionPolicy{
+				BadChecksum: EvasionActionLog,
+				LowTTL:      EvasionActionIgnore,
+				TTLDelta:    5,
+			},
+			segments: []evasionTestSegment{
+				{ttl: 3, tcp: request, corrupt: true},
+			},
+			wantAction: EvasionActionIgnore,
+			wantReason: "low TTL 3 instead of 64",
+		},
+	}
+	for _, tc := range testCases {
+		for _, v6 := range []bool{false, true} {
+			name := tc.name
+			if v6 {
+				name += " IPv6"
+			}
+			t.Run(name, func(t *testing.T) {
+				var e tcpEvasion
+				segments := append(append([]evasionTestSegment(nil), evasionTestHandshake...), tc.segments...)
+				for i, g := range segments {
+					data, tcp := g.packet(t, v6)
+					dir := reassembly.TCPDirClientToServer
+					if g.rev {
+						dir = reassembly.TCPDirServerToClient
+					}
+					action, reason := e.check(tc.policy, tcp, data, dir)
+					if i < len(segments)-1 {
+						continue
+					}
+					if action != tc.wantAction || reason != tc.wantReason {
+						t.Errorf("check() = %v, %q, want %v, %q", action, reason, tc.wantAction, tc.wantReason)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestTCPChecksumValid(t *testing.T) {
+	tcp := layers.TCP{ACK: true, PSH: true, Seq: 1000, Ack: 5000, BaseLayer: layers.BaseLayer{Payload: []byte("hello")}}
+	v4, _ := evasionTestPacket(t, false, false, 64, &tcp)
+	v6, _ := evasionTestPacket(t, true, false, 64, &tcp)
+	corrupt := func(data []byte, i int) []byte {
+		data = append([]byte(nil), data...)
+		data[i] ^= 0x01
+		return data
+	}
+	odd, _ := evasionTestPacket(t, false, false, 64, &layers.TCP{ACK: true, Seq: 1, BaseLayer: layers.BaseLayer{Payload: []byte("odd")}})
+	segment := v6[ipv6HeaderLen:]
+	testCases := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"IPv4", v4, true},
+		{"IPv4 odd length", odd, true},
+		{"IPv4 corrupt payload", corrupt(v4, len(v4)-1), false},
+		{"IPv4 corrupt header", corrupt(v4, 20+4), false},
+		{"IPv4 corrupt pseudo header", corrupt(v4, 12), false},
+		{"IPv4 odd length corrupt", corrupt(odd, len(odd)-1), false},
+		{"IPv4 truncated", v4[:len(v4)-1], true},
+		{"IPv4 trailer", append(append([]byte(nil), v4...), 0xff, 0xff), true},
+		{"IPv6", v6, true},
+		{"IPv6 corrupt payload", corrupt(v6, len(v6)-1), false},
+		{"IPv6 corrupt pseudo header", corrupt(v6, 39), false},
+		{"IPv6 truncated", v6[:len(v6)-1], true},
+		{"IPv6 destination options", ipv6TestPacket([]ipv6TestHeader{ipv6TestDestination}, 6, segment), true},
+		{"IPv6 destination options corrupt", ipv6TestPacket([]ipv6TestHeader{ipv6TestDestination}, 6, corrupt(segment, len(segment)-1)), false},
+		{"IPv6 routing", ipv6TestPacket([]ipv6TestHeader{ipv6TestRouting}, 6, corrupt(segment, len(segment)-1)), true},
+		{"IPv6 fragment", ipv6TestPacket([]ipv6TestHeader{ipv6TestFirstFrag}, 6, corrupt(segment, len(segment)-1)), true},
+		{"not IP", []byte("hello"), true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tcpChecksumValid(tc.data); got != tc.want {
+				t.Errorf("tcpChecksumValid() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// evasionTestAnalyzer is a TCP analyzer that's never done, so that streams are analyzed until the end.
+type evasionTestAnalyzer struct{}
+
+func (a *evasionTestAnalyzer) Name() string { return "evasion" }
+func (a *evasionTestAnalyzer) Limit() int   { return 0 }
+func (a *evasionTestAnalyzer) NewTCP(analyzer.TCPInfo, analyzer.Logger) analyzer.TCPStream {
+	return a
+}
+
+func (a *evasionTestAnalyzer) Feed(bool, bool, bool, int, []byte) (*analyzer.PropUpdate, bool) {
+	return nil, false
+}
+func (a *evasionTestAnalyzer) Close(bool) *analyzer.PropUpdate { return nil }
+
+func TestWorker_TCPEvasion(t *testing.T) {
+	request := layers.TCP{ACK: true, PSH: true, Seq: 1000, Ack: 5000, BaseLayer: layers.BaseLayer{Payload: []byte("GET / HTTP/1.1\r\n\r\n")}}
+	testCases := []struct {
+		name        string
+		policy      *TCPEvasionPolicy
+		analyzed    bool // Whether the stream is still being analyzed
+		segment     evasionTestSegment
+		wantVerdict io.Verdict
+		wantReason  string
+	}{
+		{
+			name:        "normal traffic",
+			policy:      &TCPEvasionPolicy{BadChecksum: EvasionActionDrop, LowTTL: EvasionActionDrop, TTLDelta: 5},
+			analyzed:    true,
+			segment:     evasionTestSegment{ttl: 64, tcp: request},
+			wantVerdict: io.VerdictAccept,
+		},
+		{
+			name:        "dropped",
+			policy:      &TCPEvasionPolicy{BadChecksum: EvasionActionDrop},
+			analyzed:    true,
+			segment:     evasionTestSegment{ttl: 64, tcp: request, corrupt: true},
+			wantVerdict: io.VerdictDrop,
+			wantReason:  "bad TCP checksum",
+		},
+		{
+			name:        "ignored",
+			policy:      &TCPEvasionPolicy{LowTTL: EvasionActionIgnore, TTLDelta: 5},
+			analyzed:    true,
+			segment:     evasionTestSegment{ttl: 3, tcp: request},
+			wantVerdict: io.VerdictAccept,
+			wantReason:  "low TTL 3 instead of 64",
+		},
+		{
+			name:        "logged",
+			policy:      &TCPEvasionPolicy{LowTTL: EvasionActionLog, TTLDelta: 5},
+			analyzed:    true,
+			segment:     evasionTestSegment{ttl: 3, tcp: request},
+			wantVerdict: io.VerdictAccept,
+			wantReason:  "low TTL 3 instead of 64",
+		},
+		{
+			name:        "classified stream",
+			policy:      &TCPEvasionPolicy{BadChecksum: EvasionActionDrop},
+			segment:     evasionTestSegment{ttl: 64, tcp: request, corrupt: true},
+			wantVerdict: io.VerdictAcceptStream,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &testLogger{}
+			rs := &testRuleset{result: ruleset.MatchResult{Action: ruleset.ActionAllow, RuleName: "test"}}
+			if tc.analyzed {
+				rs = &testRuleset{analyzers: []analyzer.Analyzer{&evasionTestAnalyzer{}}}
+			}
+			w, err := newWorker(workerConfig{Logger: logger, Ruleset: rs, TCPEvasion: tc.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v workerVerdict
+			for _, g := range append(append([]evasionTestSegment(nil), evasionTestHandshake...), tc.segment) {
+				data, _ := g.packet(t, false)
+				v = w.handle(&workerPacket{Packet: gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)}, nil)
+			}
+			if v.Verdict != tc.wantVerdict {
+				t.Errorf("verdict = %v, want %v", v.Verdict, tc.wantVerdict)
+			}
+			var reasons []string
+			for _, a := range logger.anomalies {
+				reasons = append(reasons, a.Reason)
+				if !a.SrcIP.Equal(net.IPv4(10, 0, 0, 1)) || !a.DstIP.Equal(net.IPv4(10, 0, 0, 2)) {
+					t.Errorf("anomaly from %v to %v, want from 10.0.0.1 to 10.0.0.2", a.SrcIP, a.DstIP)
+				}
+				if a.Dropped != (tc.wantVerdict == io.VerdictDrop) {
+					t.Errorf("anomaly dropped = %v", a.Dropped)
+				}
+			}
+			var wantReasons []string
+			if tc.wantReason != "" {
+				wantReasons = []string{tc.wantReason}
+			}
+			if !reflect.DeepEqual(reasons, wantReasons) {
+				t.Errorf("anomalies = %s, want %s", strings.Join(reasons, ", "), strings.Join(wantReasons, ", "))
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/apernet/OpenGFW/io"
+)
+
+// ErrNotRunning is reported by Engine.Health when the engine isn't running.
+var ErrNotRunning = errors.New("engine is not running")
+
+// Health is the state of the engine, see Engine.Health.
+type Health struct {
+	// Workers is nil if the engine is running, and every worker is picking up work.
+	Workers error
+	// IOs has the state of each IO, in the order of Config.IOs.
+	// nil if the IO is healthy, or can't tell (doesn't implement io.HealthChecker).
+	IOs []error
+}
+
+func (e *engine) Health(ctx context.Context) Health {
+	h := Health{IOs: make([]error, len(e.ioList))}
+	if !e.running.Load() {
+		h.Workers = ErrNotRunning
+	} else {
+		for _, w := range e.workers {
+			if err := w.ping(ctx); err != nil {
+				h.Workers = fmt.Errorf("worker %d not responding: %w", w.id, err)
+				break
+			}
+		}
+	}
+	for i, pio := range e.ioList {
+		if hc, ok := pio.(io.HealthChecker); ok {
+			h.IOs[i] = hc.Health()
+		}
+	}
+	return h
+}
+
+// ping waits for the worker's goroutine to get between two packets.
+func (w *worker) ping(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case w.queryChan <- func() { close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
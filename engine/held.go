@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/apernet/OpenGFW/io"
+)
+
+const (
+	DefaultMaxHeldPackets          = 64
+	DefaultMaxHeldPacketsPerStream = 8
+)
+
+// heldPackets counts the packets held back by tarpits & delay modifiers, which keep their place
+// in the queue of their IO until their verdict is issued. Once the queue is full, the kernel drops
+// (or lets through, if it fails open) every new packet, so the packets held are capped, in total
+// and per stream. It is shared by all the workers.
+type heldPackets struct {
+	max          int
+	maxPerStream int
+
+	mutex    sync.Mutex
+	total    int
+	streams  map[uint32]int // Stream ID (as dispatched to the workers) -> packets held
+	overflow atomic.Uint64  // Packets not held as over a cap
+}
+
+func newHeldPackets(max, maxPerStream int) *heldPackets {
+	if max <= 0 {
+		max = DefaultMaxHeldPackets
+	}
+	if maxPerStream <= 0 {
+		maxPerStream = DefaultMaxHeldPacketsPerStream
+	}
+	return &heldPackets{max: max, maxPerStream: maxPerStream, streams: make(map[uint32]int)}
+}
+
+// Hold reserves room for a packet of the stream, and returns false if it's over a cap.
+// Every successful Hold must be followed by a Release once the verdict is issued.
+func (h *heldPackets) Hold(streamID uint32) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.total >= h.max || h.streams[streamID] >= h.maxPerStream {
+		h.overflow.Add(1)
+		return false
+	}
+	h.total++
+	h.streams[streamID]++
+	return true
+}
+
+func (h *heldPackets) Release(streamID uint32) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.total--
+	if n := h.streams[streamID]; n > 1 {
+		h.streams[streamID] = n - 1
+	} else {
+		delete(h.streams, streamID)
+	}
+}
+
+// Verdict reserves room for a packet if its verdict is delayed, and returns the verdict to issue right away instead
+// if it's over a cap: drop for the packets of tarpits, the same verdict without the delay for the others.
+func (h *heldPackets) Verdict(streamID uint32, v workerVerdict) workerVerdict {
+	if v.Delay <= 0 || h.Hold(streamID) {
+		return v
+	}
+	if v.Tarpit {
+		return workerVerdict{Verdict: io.VerdictDrop}
+	}
+	v.Delay = 0
+	return v
+}
+
+// Len returns the number of packets being held.
+func (h *heldPackets) Len() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.total
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/io"
+)
+
+func TestHeldPackets(t *testing.T) {
+	h := newHeldPackets(4, 2)
+	steps := []struct {
+		stream  uint32
+		release bool // Release, or Hold
+		want    bool
+	}{
+		{1, false, true},
+		{1, false, true},
+		{1, false, false}, // Per stream cap
+		{2, false, true},
+		{3, false, true},
+		{4, false, false}, // Total cap
+		{1, true, true},
+		{4, false, true},
+		{1, false, false},
+		{3, true, true},
+		{2, true, true},
+		{1, false, true},
+	}
+	for i, s := range steps {
+		if s.release {
+			h.Release(s.stream)
+			continue
+		}
+		if got := h.Hold(s.stream); got != s.want {
+			t.Errorf("step %d: Hold(%d) = %v, want %v", i, s.stream, got, s.want)
+		}
+	}
+	if n := h.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	if n := h.overflow.Load(); n != 3 {
+		t.Errorf("overflow = %d, want 3", n)
+	}
+	for _, stream := range []uint32{1, 1, 4} {
+		h.Release(stream)
+	}
+	if n := h.Len(); n != 0 || len(h.streams) != 0 {
+		t.Errorf("Len() = %d with %d streams after releasing all, want 0", n, len(h.streams))
+	}
+}
+
+func TestHeldPackets_Verdict(t *testing.T) {
+	tarpit := workerVerdict{Verdict: io.VerdictAcceptModify, Packet: []byte{1}, Delay: time.Second, Tarpit: true}
+	testCases := []struct {
+		name string
+		v    workerVerdict
+		full bool // Whether the stream is at its cap
+		want workerVerdict
+	}{
+		{
+			name: "not delayed",
+			v:    workerVerdict{Verdict: io.VerdictAccept, Mark: 1},
+			full: true,
+			want: workerVerdict{Verdict: io.VerdictAccept, Mark: 1},
+		},
+		{
+			name: "tarpit",
+			v:    tarpit,
+			want: tarpit,
+		},
+		{
+			name: "delay",
+			v:    workerVerdict{Verdict: io.VerdictAccept, Mark: 2, Delay: 100 * time.Millisecond},
+			want: workerVerdict{Verdict: io.VerdictAccept, Mark: 2, Delay: 100 * time.Millisecond},
+		},
+		{
+			name: "delay over the cap",
+			v:    workerVerdict{Verdict: io.VerdictAcceptModify, Packet: []byte{1}, Delay: 100 * time.Millisecond},
+			full: true,
+			want: workerVerdict{Verdict: io.VerdictAcceptModify, Packet: []byte{1}},
+		},
+		{
+			name: "tarpit over the cap",
+			v:    tarpit,
+			full: true,
+			want: workerVerdict{Verdict: io.VerdictDrop},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHeldPackets(0, 1)
+			if tc.full {
+				h.Hold(1)
+			}
+			if got := h.Verdict(1, tc.v); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Verdict() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
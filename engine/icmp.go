@@ -0,0 +1,464 @@
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/modifier"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// icmpVerdict is a subset of io.Verdict for ICMP streams.
+// ICMP packets are never modified.
+type icmpVerdict io.Verdict
+
+const (
+	icmpVerdictAccept       = icmpVerdict(io.VerdictAccept)
+	icmpVerdictAcceptStream = icmpVerdict(io.VerdictAcceptStream)
+	icmpVerdictDrop         = icmpVerdict(io.VerdictDrop)
+	icmpVerdictDropStream   = icmpVerdict(io.VerdictDropStream)
+)
+
+// icmpRequests are the request types of the ICMP query messages, whose replies (the values) carry the
+// same identifier & sequence number. Only echo is still in use, but the others are tracked the same way.
+var (
+	icmpv4Requests = map[uint8]uint8{8: 0, 13: 14, 15: 16, 17: 18} // Echo, timestamp, information & address mask
+	icmpv6Requests = map[uint8]uint8{128: 129}                     // Echo
+)
+
+// icmpTracked returns whether ICMP messages of the type are streams of their own. Error messages are about
+// other streams, and the ICMPv6 messages of neighbor discovery & multicast listeners are what IPv6 needs to
+// work at all, so they're let through as before ICMP was handled.
+func icmpTracked(v6 bool, typ uint8) bool {
+	if !v6 {
+		switch typ {
+		case 3, 4, 5, 11, 12: // Destination unreachable, source quench, redirect, time exceeded & parameter problem
+			return false
+		}
+		return true
+	}
+	switch {
+	case typ < 128: // Errors
+		return false
+	case typ >= 130 && typ <= 137, typ == 143, typ >= 148 && typ <= 153:
+		return false
+	}
+	return true
+}
+
+// icmpRequestType returns the type of the request of a reply, and whether it's a reply.
+func icmpRequestType(v6 bool, typ uint8) (uint8, bool) {
+	requests := icmpv4Requests
+	if v6 {
+		requests = icmpv6Requests
+	}
+	for req, reply := range requests {
+		if reply == typ {
+			return req, true
+		}
+	}
+	return typ, false
+}
+
+// icmpIsQuery returns whether the type is a request or reply of a query, whose messages have an identifier.
+func icmpIsQuery(v6 bool, typ uint8) bool {
+	requests := icmpv4Requests
+	if v6 {
+		requests = icmpv6Requests
+	}
+	if _, ok := requests[typ]; ok {
+		return true
+	}
+	_, ok := icmpRequestType(v6, typ)
+	return ok
+}
+
+// icmpMessage returns an ICMP message from the header & payload gopacket splits it into.
+func icmpMessage(header, payload []byte) []byte {
+	return append(header[:len(header):len(header)], payload...)
+}
+
+type icmpContext struct {
+	*gopacket.PacketMetadata
+	Verdict icmpVerdict
+	Mark    uint32
+	Data    []byte        // Raw packet, starting with the IP header
+	IPv6Ext *ipv6Ext      // Extension headers of the packet, nil if it has none
+	IO      string        // Name of the IO the packet came from
+	Delay   time.Duration // How long to hold the packet, for delay modifiers
+	Trace   *PacketTrace  // nil if tracing is not enabled
+}
+
+// icmpKey identifies an ICMP stream: an echo (or other query) session between a client & a server,
+// or the messages of another type from a host to another.
+type icmpKey struct {
+	Client, Server [16]byte // IPv4 addresses are mapped to IPv6
+	V6             bool
+	Type           uint8  // Of the requests for query sessions
+	ID             uint16 // 0 for the others
+}
+
+func newICMPKey(client, server net.IP, v6 bool, typ uint8, id uint16) icmpKey {
+	k := icmpKey{V6: v6, Type: typ, ID: id}
+	copy(k.Client[:], client.To16())
+	copy(k.Server[:], server.To16())
+	return k
+}
+
+type icmpStreamFactory struct {
+	streamFactoryConfig
+
+	RulesetMutex sync.RWMutex
+	Ruleset      ruleset.Ruleset
+}
+
+// New creates a stream, whose source is the client (the sender of the requests for query sessions).
+func (f *icmpStreamFactory) New(client, server net.IP, v6 bool, typ uint8, id uint16, query bool, ic *icmpContext) *icmpStream {
+	snowID := f.Node.Generate()
+	info := ruleset.StreamInfo{
+		ID:           snowID.Int64(),
+		UUID:         StreamUUID(snowID.Int64()),
+		Protocol:     ruleset.ProtocolICMP,
+		SrcIP:        client,
+		DstIP:        server,
+		InInterface:  interfaceName(ic.InterfaceIndex),
+		OutInterface: interfaceName(outInterfaceIndex(ic.CaptureInfo)),
+		Owner:        packetOwner(ic.CaptureInfo),
+		IO:           ic.IO,
+		Props:        make(analyzer.CombinedPropMap),
+		Counters:     ruleset.StreamCounters{StartTime: time.Now()},
+	}
+	info.Direction = streamDirection(info.InInterface, info.OutInterface, f.External)
+	f.Logger.ICMPStreamNew(f.WorkerID, info)
+	f.Counters.icmpStreams.Add(1)
+	f.RulesetMutex.RLock()
+	rs := f.Ruleset
+	f.RulesetMutex.RUnlock()
+	ans := degradedAnalyzers(analyzersToICMPAnalyzers(rs.Analyzers(info)), f.Degraded.Load())
+	// Create entries for each analyzer
+	entries := make([]*icmpStreamEntry, 0, len(ans))
+	for _, a := range ans {
+		stats := f.AnalyzerStats.Get(a.Name())
+		entries = append(entries, &icmpStreamEntry{
+			Name: a.Name(),
+			Stream: a.NewICMP(analyzer.ICMPInfo{
+				SrcIP: client,
+				DstIP: server,
+				V6:    v6,
+				Type:  typ,
+				ID:    id,
+			}, &analyzerLogger{
+				StreamID: snowID.Int64(),
+				Name:     a.Name(),
+				Logger:   f.Logger,
+				Ring:     f.Ring,
+				Stats:    stats,
+			}),
+			HasLimit: a.Limit() > 0,
+			Quota:    a.Limit(),
+			Run:      newAnalyzerRun(stats),
+		})
+	}
+	return &icmpStream{
+		streamBase:    newStreamBase[icmpVerdict](&f.streamFactoryConfig, info, rs, nil),
+		activeEntries: entries,
+		query:         query,
+	}
+}
+
+func (f *icmpStreamFactory) UpdateRuleset(r ruleset.Ruleset) error {
+	f.RulesetMutex.Lock()
+	defer f.RulesetMutex.Unlock()
+	f.Ruleset = r
+	return nil
+}
+
+type icmpStreamManager struct {
+	factory *icmpStreamFactory
+	streams *lru.Cache[icmpKey, *icmpStream]
+}
+
+func newICMPStreamManager(factory *icmpStreamFactory, maxStreams int) (*icmpStreamManager, error) {
+	ss, err := lru.NewWithEvict[icmpKey, *icmpStream](maxStreams, func(_ icmpKey, s *icmpStream) {
+		s.Close(StreamEndEvicted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &icmpStreamManager{
+		factory: factory,
+		streams: ss,
+	}, nil
+}
+
+// MatchWithContext handles an ICMP message, starting with its type, from src to dst.
+func (m *icmpStreamManager) MatchWithContext(src, dst net.IP, v6 bool, data []byte, ic *icmpContext) {
+	if len(data) < 4 || !icmpTracked(v6, data[0]) {
+		ic.Verdict = icmpVerdictAccept
+		return
+	}
+	msg := analyzer.ICMPMessage{Type: data[0], Code: data[1], Data: data[4:]}
+	query := icmpIsQuery(v6, msg.Type) && len(data) >= 8
+	if query {
+		msg.ID, msg.Seq = binary.BigEndian.Uint16(data[4:6]), binary.BigEndian.Uint16(data[6:8])
+		msg.Data = data[8:]
+	}
+	typ, rev := msg.Type, false
+	client, server := src, dst
+	if query {
+		typ, rev = icmpRequestType(v6, msg.Type)
+		if rev {
+			client, server = dst, src
+		}
+	}
+	key := newICMPKey(client, server, v6, typ, msg.ID)
+	s, ok := m.streams.Get(key)
+	if !ok {
+		// Even from a reply, e.g. if the request was sent before the engine started
+		s = m.factory.New(client, server, v6, typ, msg.ID, query, ic)
+		m.streams.Add(key, s)
+	}
+	if s.Accept(rev, ic) {
+		s.Feed(rev, msg, ic)
+	}
+}
+
+// CloseIdle ends the streams whose latest packet is older than cutoff.
+func (m *icmpStreamManager) CloseIdle(cutoff time.Time) {
+	for _, k := range m.streams.Keys() {
+		s, ok := m.streams.Peek(k)
+		if ok && s.lastSeen.Before(cutoff) {
+			s.Close(StreamEndIdle)
+			m.streams.Remove(k)
+		}
+	}
+}
+
+type icmpStream struct {
+	streamBase[icmpVerdict]
+	activeEntries []*icmpStreamEntry
+	doneEntries   []*icmpStreamEntry
+	delayer       modifier.DelayerInstance // non-nil once a delay modifier has matched
+	ended         bool                     // Whether StreamEnd has been logged
+	query         bool                     // Whether it's a query session, which the kernel tracks as a connection
+}
+
+type icmpStreamEntry struct {
+	Name     string
+	Stream   analyzer.ICMPStream
+	HasLimit bool
+	Quota    int
+	Run      analyzerRun
+}
+
+func (s *icmpStream) Accept(rev bool, ic *icmpContext) bool {
+	ic.Trace.stream(s.info, s.traced)
+	s.countPacket(rev, ic.Length, ic.Timestamp)
+	addIPv6Ext(&s.info, ic.IPv6Ext)
+	if err := s.capture.Packet(ic.CaptureInfo, ic.Data); err != nil {
+		s.logger.CaptureError(s.info, err)
+	}
+	if s.delayer != nil {
+		ic.Delay = s.delayer.PacketDelay()
+	}
+	if len(s.activeEntries) > 0 || s.virgin {
+		// Make sure every stream matches against the ruleset at least once,
+		// even if there are no activeEntries, as the ruleset may have built-in
+		// properties that need to be matched.
+		return true
+	}
+	s.checkQuota()
+	if s.limiter != nil {
+		ic.Verdict = s.limitVerdict(ic.Length)
+	} else {
+		ic.Verdict = s.packetVerdict(s.lastVerdict)
+		ic.Mark = s.lastMark
+	}
+	return false
+}
+
+func (s *icmpStream) Feed(rev bool, msg analyzer.ICMPMessage, ic *icmpContext) {
+	updated := false
+	for i := len(s.activeEntries) - 1; i >= 0; i-- {
+		// Important: reverse order so we can remove entries
+		entry := s.activeEntries[i]
+		ic.Trace.analyzed()
+		stageStart := ic.Trace.begin()
+		update, closeUpdate, done := s.feedEntry(entry, rev, msg)
+		ic.Trace.end(TraceStageAnalyzer, entry.Name, stageStart)
+		up1 := processPropUpdate(s.info.Props, entry.Name, update)
+		up2 := processPropUpdate(s.info.Props, entry.Name, closeUpdate)
+		updated = updated || up1 || up2
+		entry.Run.Updated(up1 || up2)
+		if done {
+			entry.Run.Done()
+			s.activeEntries = append(s.activeEntries[:i], s.activeEntries[i+1:]...)
+			s.doneEntries = append(s.doneEntries, entry)
+		}
+	}
+	if updated || s.virgin {
+		s.virgin = false
+		s.logger.ICMPStreamPropUpdate(s.info, false)
+		// Match properties against ruleset
+		stageStart := ic.Trace.begin()
+		result := s.ruleset.Match(s.info)
+		ic.Trace.end(TraceStageRuleset, result.RuleName, stageStart)
+		action := result.Action
+		if action == ruleset.ActionModify {
+			if di, isDelayer := result.ModInstance.(modifier.DelayerInstance); isDelayer {
+				s.delayer = di
+				ic.Delay = di.PacketDelay()
+			} else {
+				// Only delay modifiers apply to ICMP, fallback to maybe
+				s.logger.ModifyError(s.info, errInvalidModifier)
+				action = ruleset.ActionMaybe
+			}
+		}
+		if action != ruleset.ActionMaybe {
+			verdict, final := actionToICMPVerdict(action)
+			s.setVerdict(result, action, verdict)
+			ic.Verdict = s.packetVerdict(verdict)
+			ic.Mark = s.lastMark
+			if action == ruleset.ActionRateLimit {
+				s.limiter = result.RateLimiter
+				ic.Verdict = s.limitVerdict(ic.Length)
+			}
+			if action == ruleset.ActionQuota {
+				s.setQuota(result.Quota)
+				if s.limiter != nil {
+					ic.Verdict = s.limitVerdict(ic.Length)
+				} else {
+					ic.Verdict = s.packetVerdict(s.lastVerdict)
+				}
+			}
+			if action == ruleset.ActionCapture || action == ruleset.ActionMirror {
+				if err := s.capture.Start(action); err != nil {
+					s.logger.CaptureError(s.info, err)
+				}
+			}
+			if final {
+				s.closeActiveEntries()
+			}
+		}
+	}
+	if len(s.activeEntries) == 0 && ic.Verdict == icmpVerdictAccept && s.limiter == nil && s.quota == nil && s.delayer == nil && !s.capture.Active() {
+		// All entries are done but no verdict issued, apply the default verdict
+		s.setDefaultVerdict()
+		ic.Verdict = s.packetVerdict(s.lastVerdict)
+		ic.Mark = s.lastMark
+	}
+}
+
+// packetVerdict returns the verdict of a packet of the stream. Only the query sessions are tracked
+// by the kernel, and can be offloaded to it: the other streams get a verdict for every packet.
+func (s *icmpStream) packetVerdict(v icmpVerdict) icmpVerdict {
+	if s.query {
+		return v
+	}
+	switch v {
+	case icmpVerdictAcceptStream:
+		return icmpVerdictAccept
+	case icmpVerdictDropStream:
+		return icmpVerdictDrop
+	default:
+		return v
+	}
+}
+
+// Close ends the stream. It does nothing if the stream has already ended.
+func (s *icmpStream) Close(reason StreamEndReason) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.closeActiveEntries()
+	s.account.Flush(s.info)
+	s.counters.icmpEnded.Add(1)
+	s.logger.StreamEnd(StreamEnd{
+		WorkerID: s.workerID,
+		Info:     s.info,
+		Reason:   reason,
+		LastSeen: s.lastSeen,
+		Verdict:  io.Verdict(s.lastVerdict),
+		Actions:  s.actions,
+	})
+}
+
+func (s *icmpStream) closeActiveEntries() {
+	// Signal close to all active entries & move them to doneEntries
+	updated := false
+	for _, entry := range s.activeEntries {
+		start := time.Now()
+		update := entry.Stream.Close(false)
+		entry.Run.Fed(start, 0)
+		up := processPropUpdate(s.info.Props, entry.Name, update)
+		updated = updated || up
+		entry.Run.Updated(up)
+		entry.Run.Done()
+	}
+	if updated {
+		s.logger.ICMPStreamPropUpdate(s.info, true)
+	}
+	s.doneEntries = append(s.doneEntries, s.activeEntries...)
+	s.activeEntries = nil
+}
+
+func (s *icmpStream) feedEntry(entry *icmpStreamEntry, rev bool, msg analyzer.ICMPMessage) (update *analyzer.PropUpdate, closeUpdate *analyzer.PropUpdate, done bool) {
+	start := time.Now()
+	update, done = entry.Stream.Feed(rev, msg)
+	if entry.HasLimit {
+		entry.Quota -= len(msg.Data)
+		if entry.Quota <= 0 {
+			// Quota exhausted, signal close & move to doneEntries
+			closeUpdate = entry.Stream.Close(true)
+			done = true
+		}
+	}
+	entry.Run.Fed(start, len(msg.Data))
+	return
+}
+
+func analyzersToICMPAnalyzers(ans []analyzer.Analyzer) []analyzer.ICMPAnalyzer {
+	icmpAns := make([]analyzer.ICMPAnalyzer, 0, len(ans))
+	for _, a := range ans {
+		if icmpM, ok := a.(analyzer.ICMPAnalyzer); ok {
+			icmpAns = append(icmpAns, icmpM)
+		}
+	}
+	return icmpAns
+}
+
+func actionToICMPVerdict(a ruleset.Action) (v icmpVerdict, final bool) {
+	switch a {
+	case ruleset.ActionMaybe:
+		return icmpVerdictAccept, false
+	case ruleset.ActionAllow, ruleset.ActionShape, ruleset.ActionMark:
+		return icmpVerdictAcceptStream, true
+	case ruleset.ActionBlock:
+		return icmpVerdictDropStream, true
+	case ruleset.ActionDrop:
+		return icmpVerdictDrop, false
+	case ruleset.ActionModify:
+		// Only delay modifiers, which hold the packets unchanged
+		return icmpVerdictAccept, false
+	case ruleset.ActionTarpit, ruleset.ActionDivert, ruleset.ActionHoneypot, ruleset.ActionCaptureHTTP:
+		// Not supported for ICMP
+		return icmpVerdictAccept, false
+	case ruleset.ActionRateLimit, ruleset.ActionQuota:
+		// The actual verdict of each packet is decided by the rate limiter or quota
+		return icmpVerdictAccept, true
+	case ruleset.ActionCapture, ruleset.ActionMirror:
+		// Each packet must still go through the engine to be copied
+		return icmpVerdictAccept, true
+	default:
+		// Should never happen
+		return icmpVerdictAccept, false
+	}
+}
@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"net"
+	"testing"
+
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestICMPTypes(t *testing.T) {
+	testCases := []struct {
+		name        string
+		v6          bool
+		typ         uint8
+		wantTracked bool
+		wantQuery   bool
+		wantRequest uint8 // For replies
+	}{
+		{"v4 echo", false, 8, true, true, 0},
+		{"v4 echo reply", false, 0, true, true, 8},
+		{"v4 timestamp reply", false, 14, true, true, 13},
+		{"v4 unreachable", false, 3, false, false, 0},
+		{"v4 time exceeded", false, 11, false, false, 0},
+		{"v4 redirect", false, 5, false, false, 0},
+		{"v4 router advertisement", false, 9, true, false, 0},
+		{"v6 echo", true, 128, true, true, 0},
+		{"v6 echo reply", true, 129, true, true, 128},
+		{"v6 unreachable", true, 1, false, false, 0},
+		{"v6 packet too big", true, 2, false, false, 0},
+		{"v6 neighbor solicitation", true, 135, false, false, 0},
+		{"v6 multicast listener report v2", true, 143, false, false, 0},
+		{"v6 node information query", true, 139, true, false, 0},
+		{"v4 type of v6 echo", false, 128, true, false, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tracked := icmpTracked(tc.v6, tc.typ); tracked != tc.wantTracked {
+				t.Errorf("icmpTracked() = %v, want %v", tracked, tc.wantTracked)
+			}
+			if query := icmpIsQuery(tc.v6, tc.typ); query != tc.wantQuery {
+				t.Errorf("icmpIsQuery() = %v, want %v", query, tc.wantQuery)
+			}
+			req, reply := icmpRequestType(tc.v6, tc.typ)
+			if wantReply := tc.wantRequest != 0 || (!tc.v6 && tc.typ == 0); reply != wantReply || (reply && req != tc.wantRequest) {
+				t.Errorf("icmpRequestType() = %d, %v, want %d, %v", req, reply, tc.wantRequest, wantReply)
+			}
+		})
+	}
+}
+
+// icmpTestPacket returns a decoded IPv4 or IPv6 packet with an ICMP message of the type & code,
+// with the ID & sequence number (or the unused field of errors) and payload after them.
+func icmpTestPacket(t *testing.T, src, dst net.IP, typ, code uint8, id, seq uint16, payload []byte) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	var err error
+	if src.To4() != nil {
+		err = gopacket.SerializeLayers(buf, opts,
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: src, DstIP: dst},
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, code), Id: id, Seq: seq},
+			gopacket.Payload(payload))
+	} else {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: src, DstIP: dst}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, code)}
+		_ = icmp.SetNetworkLayerForChecksum(ip)
+		rest := make([]byte, 4, 4+len(payload))
+		rest[0], rest[1], rest[2], rest[3] = byte(id>>8), byte(id), byte(seq>>8), byte(seq)
+		err = gopacket.SerializeLayers(buf, opts, ip, icmp, gopacket.Payload(append(rest, payload...)))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := layers.LayerTypeIPv4
+	if src.To4() == nil {
+		first = layers.LayerTypeIPv6
+	}
+	return gopacket.NewPacket(buf.Bytes(), first, gopacket.Default)
+}
+
+// icmpTestInner returns the start of a packet from src to dst with a UDP header, as embedded in ICMP errors.
+func icmpTestInner(t *testing.T, src, dst net.IP) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	var ip gopacket.NetworkLayer
+	if src.To4() != nil {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	} else {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+	}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), udp, gopacket.Payload("query")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWorker_ICMP(t *testing.T) {
+	client4, server4 := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4()
+	router4 := net.IPv4(10, 0, 0, 254).To4()
+	client6, server6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	router6 := net.ParseIP("2001:db8::fe")
+	type message struct {
+		src, dst  net.IP
+		typ, code uint8
+		id, seq   uint16
+		payload   []byte
+	}
+	testCases := []struct {
+		name         string
+		action       ruleset.Action
+		messages     []message
+		wantStreams  int
+		wantVerdicts []io.Verdict
+	}{
+		{
+			name:   "echo session",
+			action: ruleset.ActionBlock,
+			messages: []message{
+				{client4, server4, 8, 0, 1, 1, []byte("ping")},
+				{server4, client4, 0, 0, 1, 1, []byte("ping")},
+				{client4, server4, 8, 0, 1, 2, []byte("ping")},
+			},
+			wantStreams:  1,
+			wantVerdicts: []io.Verdict{io.VerdictDropStream, io.VerdictDropStream, io.VerdictDropStream},
+		},
+		{
+			name:   "echo sessions by id",
+			action: ruleset.ActionAllow,
+			messages: []message{
+				{client4, server4, 8, 0, 1, 1, nil},
+				{client4, server4, 8, 0, 2, 1, nil},
+				{server4, client4, 8, 0, 1, 1, nil}, // The other way round
+			},
+			wantStreams:  3,
+			wantVerdicts: []io.Verdict{io.VerdictAcceptStream, io.VerdictAcceptStream, io.VerdictAcceptStream},
+		},
+		{
+			name:   "reply first",
+			action: ruleset.ActionAllow,
+			messages: []message{
+				{server6, client6, 129, 0, 7, 1, nil},
+				{client6, server6, 128, 0, 7, 2, nil},
+			},
+			wantStreams:  1,
+			wantVerdicts: []io.Verdict{io.VerdictAcceptStream, io.VerdictAcceptStream},
+		},
+		{
+			name:   "not a query",
+			action: ruleset.ActionBlock,
+			messages: []message{
+				{router4, client4, 9, 0, 0, 0, nil},
+				{router4, client4, 9, 0, 0, 0, nil},
+			},
+			wantStreams: 1,
+			// Not tracked by the kernel, so never offloaded to it
+			wantVerdicts: []io.Verdict{io.VerdictDrop, io.VerdictDrop},
+		},
+		{
+			name:   "v4 errors",
+			action: ruleset.ActionBlock,
+			messages: []message{
+				{router4, client4, 3, 1, 0, 0, icmpTestInner(t, client4, server4)},
+				{router4, client4, 11, 0, 0, 0, icmpTestInner(t, client4, server4)},
+			},
+			wantVerdicts: []io.Verdict{io.VerdictAccept, io.VerdictAccept},
+		},
+		{
+			name:   "v6 errors",
+			action: ruleset.ActionBlock,
+			messages: []message{
+				{router6, client6, 1, 3, 0, 0, icmpTestInner(t, client6, server6)},
+				{router6, client6, 2, 0, 0, 1280, icmpTestInner(t, client6, server6)},
+			},
+			wantVerdicts: []io.Verdict{io.VerdictAccept, io.VerdictAccept},
+		},
+		{
+			name:   "v6 error embedding an echo",
+			action: ruleset.ActionBlock,
+			messages: []message{
+				{client6, server6, 128, 0, 7, 1, nil},
+				{router6, client6, 3, 0, 0, 0, icmpTestPacket(t, client6, server6, 128, 0, 7, 1, nil).Data()},
+			},
+			wantStreams:  1,
+			wantVerdicts: []io.Verdict{io.VerdictDropStream, io.VerdictAccept},
+		},
+		{
+			name:   "neighbor discovery",
+			action: ruleset.ActionBlock,
+			messages: []message{
+				{client6, server6, 135, 0, 0, 0, server6},
+				{server6, client6, 136, 0, 0x6000, 0, server6},
+			},
+			wantVerdicts: []io.Verdict{io.VerdictAccept, io.VerdictAccept},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &testLogger{}
+			w, err := newWorker(workerConfig{
+				Logger:  logger,
+				Ruleset: &testRuleset{result: ruleset.MatchResult{Action: tc.action, RuleName: "test"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, m := range tc.messages {
+				p := icmpTestPacket(t, m.src, m.dst, m.typ, m.code, m.id, m.seq, m.payload)
+				if p.TransportLayer() != nil {
+					t.Fatalf("message %d decoded with transport layer %v", i, p.TransportLayer().LayerType())
+				}
+				v := w.handle(&workerPacket{Packet: p}, nil)
+				if v.Verdict != tc.wantVerdicts[i] {
+					t.Errorf("message %d verdict = %v, want %v", i, v.Verdict, tc.wantVerdicts[i])
+				}
+			}
+			if logger.streams != tc.wantStreams {
+				t.Errorf("streams = %d, want %d", logger.streams, tc.wantStreams)
+			}
+		})
+	}
+}
+
+func TestICMPStreamManager_Short(t *testing.T) {
+	logger := &testLogger{}
+	factory := &icmpStreamFactory{
+		streamFactoryConfig: newTestStreamFactoryConfig(t, logger),
+		Ruleset:             &testRuleset{result: ruleset.MatchResult{Action: ruleset.ActionBlock}},
+	}
+	m, err := newICMPStreamManager(factory, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	testCases := []struct {
+		name        string
+		data        []byte
+		wantVerdict icmpVerdict
+		wantStreams int
+	}{
+		{"empty", nil, icmpVerdictAccept, 0},
+		{"truncated header", []byte{8, 0, 0}, icmpVerdictAccept, 0},
+		// Without the ID, an echo is handled like the messages that aren't queries
+		{"echo without id", []byte{8, 0, 0, 0}, icmpVerdictDrop, 1},
+		{"echo", []byte{8, 0, 0, 0, 0, 1, 0, 1}, icmpVerdictDropStream, 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ic := &icmpContext{PacketMetadata: &gopacket.PacketMetadata{}, Verdict: icmpVerdictAccept}
+			m.MatchWithContext(src, dst, false, tc.data, ic)
+			if ic.Verdict != tc.wantVerdict {
+				t.Errorf("verdict = %v, want %v", ic.Verdict, tc.wantVerdict)
+			}
+			if logger.streams != tc.wantStreams {
+				t.Errorf("streams = %d, want %d", logger.streams, tc.wantStreams)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	interfaceNamesTTL        = 1 * time.Minute
+	interfaceNamesMinRefresh = 1 * time.Second // Limits refreshes due to unknown indexes
+)
+
+// interfaceNames caches the names of network interfaces by index, as looking up
+// a single interface by index still requires a dump of all of them.
+var interfaceNames = struct {
+	sync.Mutex
+	names   map[int]string
+	updated time.Time
+}{}
+
+// interfaceName returns the name of the interface with the given index,
+// or an empty string if the index is 0 or unknown.
+func interfaceName(index int) string {
+	if index <= 0 {
+		return ""
+	}
+	interfaceNames.Lock()
+	defer interfaceNames.Unlock()
+	name, ok := interfaceNames.names[index]
+	age := time.Since(interfaceNames.updated)
+	if age > interfaceNamesTTL || (!ok && age > interfaceNamesMinRefresh) {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return name
+		}
+		names := make(map[int]string, len(ifaces))
+		for _, iface := range ifaces {
+			names[iface.Index] = iface.Name
+		}
+		interfaceNames.names, interfaceNames.updated = names, time.Now()
+		name = names[index]
+	}
+	return name
+}
+
+// outInterface is the index of the output interface of a packet, in the AncillaryData of its CaptureInfo.
+type outInterface int
+
+// outInterfaceIndex returns the index of the output interface of a packet, 0 if unknown.
+func outInterfaceIndex(ci gopacket.CaptureInfo) int {
+	for _, d := range ci.AncillaryData {
+		if o, ok := d.(outInterface); ok {
+			return int(o)
+		}
+	}
+	return 0
+}
+
+// streamDirection returns the direction of a stream from the interfaces of its first packet.
+// In local mode, only one of them is known. Otherwise it takes external interfaces to tell.
+func streamDirection(in, out string, external map[string]bool) ruleset.Direction {
+	switch {
+	case in != "" && out == "":
+		return ruleset.DirectionInbound
+	case in == "" && out != "":
+		return ruleset.DirectionOutbound
+	case in == "" || len(external) == 0:
+		return ruleset.DirectionUnknown
+	case external[in] && external[out]:
+		return ruleset.DirectionTransit
+	case external[in]:
+		return ruleset.DirectionInbound
+	case external[out]:
+		return ruleset.DirectionOutbound
+	default:
+		return ruleset.DirectionInternal
+	}
+}
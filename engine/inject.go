@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// injectMaxSegmentSize is the maximum payload size of the TCP segments injected toward clients,
+// small enough to fit the MTU of most paths without relying on the client's MSS.
+const injectMaxSegmentSize = 1200
+
+var (
+	errInjectNotSupported = errors.New("packet injection is not supported by the packet IO")
+	errNotClientPacket    = errors.New("matched on a server packet, the client can't be answered")
+	errInvalidTCPPacket   = errors.New("invalid tcp packet")
+)
+
+// tcpReply builds the packets to answer a client's TCP packet on behalf of the server:
+// the segments carrying the payload (the last one with FIN) to the client, and a RST
+// to the server to replace the client's packet with.
+func tcpReply(pkt, payload []byte) (toClient [][]byte, toServer []byte, err error) {
+	var p gopacket.Packet
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		p = gopacket.NewPacket(pkt, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	} else {
+		p = gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	}
+	tcp, ok := p.TransportLayer().(*layers.TCP)
+	if !ok || p.NetworkLayer() == nil {
+		return nil, nil, errInvalidTCPPacket
+	}
+	srcIP, dstIP := net.IP(p.NetworkLayer().NetworkFlow().Src().Raw()), net.IP(p.NetworkLayer().NetworkFlow().Dst().Raw())
+	ack := tcp.Seq + uint32(len(tcp.Payload))
+	if tcp.SYN || tcp.FIN {
+		ack++
+	}
+	seq := tcp.Ack
+	for len(toClient) == 0 || len(payload) > 0 {
+		n := len(payload)
+		if n > injectMaxSegmentSize {
+			n = injectMaxSegmentSize
+		}
+		seg := &layers.TCP{
+			SrcPort: tcp.DstPort,
+			DstPort: tcp.SrcPort,
+			Seq:     seq,
+			Ack:     ack,
+			ACK:     true,
+			PSH:     n > 0,
+			FIN:     n == len(payload),
+			Window:  tcp.Window,
+		}
+		b, err := serializeTCP(dstIP, srcIP, seg, payload[:n])
+		if err != nil {
+			return nil, nil, err
+		}
+		toClient = append(toClient, b)
+		seq += uint32(n)
+		payload = payload[n:]
+	}
+	rst := &layers.TCP{
+		SrcPort: tcp.SrcPort,
+		DstPort: tcp.DstPort,
+		Seq:     tcp.Seq,
+		RST:     true,
+	}
+	toServer, err = serializeTCP(srcIP, dstIP, rst, nil)
+	return toClient, toServer, err
+}
+
+func serializeTCP(src, dst net.IP, tcp *layers.TCP, payload []byte) ([]byte, error) {
+	var ip gopacket.NetworkLayer
+	if src4 := src.To4(); src4 != nil {
+		ip = &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    src4,
+			DstIP:    dst.To4(),
+		}
+	} else {
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolTCP,
+			SrcIP:      src,
+			DstIP:      dst,
+		}
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// injectSegment sends an extra segment of a rewritten packet, with the packet's headers.
+func injectSegment(inject func([]byte) error, netLayer gopacket.NetworkLayer, tcp *layers.TCP, seg tcpSegment) error {
+	flow := netLayer.NetworkFlow()
+	b, err := serializeTCP(net.IP(flow.Src().Raw()), net.IP(flow.Dst().Raw()), &layers.TCP{
+		SrcPort: tcp.SrcPort,
+		DstPort: tcp.DstPort,
+		Seq:     seg.Seq,
+		Ack:     tcp.Ack,
+		ACK:     tcp.ACK,
+		PSH:     true,
+		FIN:     seg.FIN,
+		Window:  tcp.Window,
+	}, seg.Payload)
+	if err != nil {
+		return err
+	}
+	return inject(b)
+}
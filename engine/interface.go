@@ -2,6 +2,8 @@ package engine
 
 import (
 	"context"
+	"net"
+	"time"
 
 	"github.com/apernet/OpenGFW/io"
 	"github.com/apernet/OpenGFW/ruleset"
@@ -12,13 +14,36 @@ type Engine interface {
 	// UpdateRuleset updates the ruleset.
 	UpdateRuleset(ruleset.Ruleset) error
 	// Run runs the engine, until an error occurs or the context is cancelled.
+	// It returns once every worker has stopped, so that no verdict is set after the IOs are closed.
 	Run(context.Context) error
+	// Streams returns a snapshot of the streams being tracked.
+	// It must only be called while the engine is running.
+	Streams(context.Context) ([]StreamEntry, error)
+	// SetIDSOnly enables or disables IDS-only mode, see Config.IDSOnly.
+	SetIDSOnly(bool)
+	// IDSOnly returns whether IDS-only mode is enabled.
+	IDSOnly() bool
+	// SetDegraded enables degraded mode with what to give up, or disables it if nil.
+	SetDegraded(*Degradation)
+	// Degraded returns what is given up in degraded mode, nil if it's not enabled.
+	Degraded() *Degradation
+	// DumpPacketRings dumps the packet ring of every worker, see Config.PacketRing,
+	// and returns where they have been written. It must only be called while the engine is running.
+	DumpPacketRings(ctx context.Context, reason string) ([]string, error)
+	// AnalyzerStats returns the statistics of every analyzer that has been run.
+	AnalyzerStats() []AnalyzerStats
+	// Stats returns the packet, stream & queue statistics of the engine.
+	Stats() Stats
+	// Health returns the state of the engine and its IOs, for health checks.
+	// It blocks until every worker has answered, or the context is cancelled.
+	Health(context.Context) Health
 }
 
 // Config is the configuration for the engine.
 type Config struct {
 	Logger  Logger
 	IOs     []io.PacketIO
+	IONames []string // Same order as IOs, reported in StreamInfo.IO. Optional.
 	Ruleset ruleset.Ruleset
 
 	Workers                          int // Number of workers. Zero or negative means auto (number of CPU cores).
@@ -26,8 +51,107 @@ type Config struct {
 	WorkerTCPMaxBufferedPagesTotal   int
 	WorkerTCPMaxBufferedPagesPerConn int
 	WorkerUDPMaxStreams              int
+	WorkerSCTPMaxStreams             int // Associations
+	WorkerICMPMaxStreams             int // Echo sessions & other ICMP flows
+
+	// MaxHeldPackets & MaxHeldPacketsPerStream cap the packets held back by tarpits & delay modifiers,
+	// which keep their place in the queue of their IO meanwhile. Packets over a cap aren't held:
+	// those of tarpits are dropped, the others let through right away. Zero means
+	// DefaultMaxHeldPackets & DefaultMaxHeldPacketsPerStream.
+	MaxHeldPackets          int
+	MaxHeldPacketsPerStream int
+
+	// StreamIdleTimeout is how long a stream can go without packets before it's considered ended.
+	// Streams offloaded to the kernel are never seen again, so without it their end is never known.
+	// Zero means never, streams are only ended when closed by their peers or evicted.
+	StreamIdleTimeout time.Duration
+
+	UnmatchedVerdict    DefaultVerdict // For streams that analyzers found properties for
+	UnclassifiedVerdict DefaultVerdict // For streams that no analyzer found any properties for
+
+	Capturer        PacketSink // Where to write streams matched by capture rules, nil if not available
+	Mirror          PacketSink // Where to send streams matched by mirror rules, nil if not available
+	HTTPCapturer    PacketSink // Where to write TCP streams matched by capture-http rules, nil if not available
+	CaptureLookback int        // Number of packets to keep per stream, sent once a capture, mirror or capture-http rule matches
+
+	Tracer Tracer // Receives the processing timeline of every packet, nil if not enabled
+
+	StateSync StateSync // Shares the classification of streams with the other instance of an HA pair, nil if not enabled
+
+	// Accounting receives the bytes of every stream, nil if not enabled. Streams are then never
+	// offloaded to the kernel, so that all their packets are counted.
+	Accounting Accounting
+
+	// QoS marks the streams accepted without a mark, e.g. by application, nil if not enabled.
+	QoS QoSMarker
+
+	// PacketRing is the number of latest packets each worker keeps, to be written to PacketRingDumper
+	// on demand, or automatically when an analyzer reports an error or the worker crashes.
+	// Zero means disabled.
+	PacketRing       int
+	PacketRingDumper PacketRingDumper
+
+	// Started is called by Run once every IO is registered (attached to its queue, with its firewall rules
+	// in place), e.g. to drop privileges. If it fails, Run stops & returns its error. Optional.
+	Started func() error
+
+	// DrainTimeout is how long Run waits, once its context is cancelled, for the packets already queued
+	// to be processed, after removing the firewall rules of the IOs (see io.RuleRemover) so that no more
+	// are queued. Zero means DefaultDrainTimeout, negative means not waiting.
+	DrainTimeout time.Duration
+
+	// IPv6Ext limits the extension headers of IPv6 packets, nil if not enabled.
+	// The packets breaking it are dropped before being handled, and reported to Logger.PacketAnomaly.
+	IPv6Ext *IPv6ExtPolicy
+
+	// TCPEvasion handles the TCP segments of IDS evasion attempts, nil if not enabled.
+	TCPEvasion *TCPEvasionPolicy
+
+	// ExternalInterfaces are the interfaces to the outside (e.g. WAN), for the direction of forwarded streams.
+	// If empty, only that of the streams to & from this host (local mode) is known.
+	ExternalInterfaces []string
+
+	// Asymmetric handles the TCP streams only one direction of which crosses the engine, nil if not enabled.
+	Asymmetric *AsymmetricPolicy
+
+	// IDSOnly makes the engine inspect & log only: streams are still analyzed and matched against
+	// the rules, and their actions logged, but every packet is let through unchanged,
+	// and no packets are injected.
+	IDSOnly bool
+}
+
+// Accounting counts the traffic of streams, e.g. per client.
+type Accounting interface {
+	// Account is called with the bytes (both directions) of a stream since the previous call,
+	// every few seconds or tens of KB, and when the stream ends.
+	// It's called from the workers, so it must be fast & safe for concurrent use.
+	Account(info ruleset.StreamInfo, bytes uint64)
+}
+
+// QoSMarker chooses the user mark of the accepted streams that no rule has marked,
+// so that tc & routers can prioritize them, e.g. from the connmark or a DSCP set from it.
+type QoSMarker interface {
+	// QoSMark returns the mark of a stream, 0 for none. It's called from the workers
+	// when a stream is accepted, so it must be safe for concurrent use.
+	QoSMark(info ruleset.StreamInfo) uint32
 }
 
+// DefaultVerdict is what to do with a stream once all its analyzers are done
+// and no rule has matched it.
+type DefaultVerdict int
+
+const (
+	// DefaultVerdictAcceptStream accepts the stream and stops processing it.
+	DefaultVerdictAcceptStream DefaultVerdict = iota
+	// DefaultVerdictAccept accepts the packets of the stream one by one,
+	// instead of offloading the stream to the kernel.
+	DefaultVerdictAccept
+	// DefaultVerdictDrop blocks the stream.
+	DefaultVerdictDrop
+	// DefaultVerdictLog is like DefaultVerdictAcceptStream, but also logs the stream.
+	DefaultVerdictLog
+)
+
 // Logger is the combined logging interface for the engine, workers and analyzers.
 type Logger interface {
 	WorkerStart(id int)
@@ -35,15 +159,45 @@ type Logger interface {
 
 	TCPStreamNew(workerID int, info ruleset.StreamInfo)
 	TCPStreamPropUpdate(info ruleset.StreamInfo, close bool)
-	TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, noMatch bool)
+	// TCPStreamAction, UDPStreamAction, SCTPStreamAction & ICMPStreamAction are called with the rule that issued the action,
+	// empty for the default verdict of streams no rule matched (noMatch).
+	TCPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool)
 
 	UDPStreamNew(workerID int, info ruleset.StreamInfo)
 	UDPStreamPropUpdate(info ruleset.StreamInfo, close bool)
-	UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, noMatch bool)
+	UDPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool)
+
+	SCTPStreamNew(workerID int, info ruleset.StreamInfo)
+	SCTPStreamPropUpdate(info ruleset.StreamInfo, close bool)
+	SCTPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool)
+
+	ICMPStreamNew(workerID int, info ruleset.StreamInfo)
+	ICMPStreamPropUpdate(info ruleset.StreamInfo, close bool)
+	ICMPStreamAction(info ruleset.StreamInfo, action ruleset.Action, rule string, noMatch bool)
+
+	// StreamEnd is called once for every stream when it ends, with its summary.
+	StreamEnd(end StreamEnd)
+
+	// StreamNoMatch is called for streams that no rule matched, if their default verdict is DefaultVerdictLog.
+	StreamNoMatch(info ruleset.StreamInfo, classified bool)
+
+	// PacketAnomaly is called for every packet breaking a policy on malformed or evasive packets.
+	PacketAnomaly(a PacketAnomaly)
 
 	ModifyError(info ruleset.StreamInfo, err error)
+	CaptureError(info ruleset.StreamInfo, err error)
+	PacketRingDump(workerID int, reason string, name string, packets int, err error)
 
 	AnalyzerDebugf(streamID int64, name string, format string, args ...interface{})
 	AnalyzerInfof(streamID int64, name string, format string, args ...interface{})
 	AnalyzerErrorf(streamID int64, name string, format string, args ...interface{})
 }
+
+// PacketAnomaly is a packet breaking a policy on malformed or evasive packets, e.g. Config.IPv6Ext or Config.TCPEvasion.
+type PacketAnomaly struct {
+	WorkerID     int
+	StreamID     int64 // 0 if the packet isn't handled as part of a stream
+	SrcIP, DstIP net.IP
+	Reason       string
+	Dropped      bool // false if only reported
+}
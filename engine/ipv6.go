@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const ipv6HeaderLen = 40
+
+// ipv6ExtNames are the names of the IPv6 extension headers, by their next header value.
+var ipv6ExtNames = map[uint8]string{
+	0:   "hopbyhop",
+	43:  "routing",
+	44:  "fragment",
+	50:  "esp",
+	51:  "ah",
+	60:  "destination",
+	135: "mobility",
+	139: "hip",
+	140: "shim6",
+	253: "experimental",
+	254: "experimental",
+}
+
+// ipv6UpperHeaderLen is the length of the headers of the upper-layer protocols,
+// which the first fragment of a packet must include (RFC 7112).
+var ipv6UpperHeaderLen = map[uint8]int{
+	uint8(layers.IPProtocolTCP):    20,
+	uint8(layers.IPProtocolUDP):    8,
+	uint8(layers.IPProtocolSCTP):   12,
+	uint8(layers.IPProtocolICMPv6): 4,
+}
+
+// IPv6ExtHeaderTypes returns the next header values of an extension header by name, e.g. "routing",
+// or by number. Experimental has two.
+func IPv6ExtHeaderTypes(name string) ([]uint8, error) {
+	var types []uint8
+	for t, n := range ipv6ExtNames {
+		if n == name {
+			types = append(types, t)
+		}
+	}
+	if len(types) > 0 {
+		slices.Sort(types)
+		return types, nil
+	}
+	t, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || ipv6ExtNames[uint8(t)] == "" {
+		return nil, fmt.Errorf("unknown IPv6 extension header %q", name)
+	}
+	return []uint8{uint8(t)}, nil
+}
+
+// IPv6ExtPolicy limits the extension headers of IPv6 packets. Long or malformed chains of extension headers
+// are a known way to evade DPI, by pushing the transport header out of reach or into a later fragment,
+// and to exhaust the routers that process them in software.
+type IPv6ExtPolicy struct {
+	// MaxHeaders is the most extension headers a packet can have. Zero means no limit.
+	MaxHeaders int
+	// Forbidden are the next header values of the extension headers packets must not have.
+	Forbidden []uint8
+	// Strict also rejects the packets whose chains break the rules of RFC 8200 & 7112: truncated,
+	// hop-by-hop options not first, headers repeated (but destination options, which can be there twice),
+	// type 0 routing headers, and first fragments without the whole chain & upper-layer header.
+	Strict bool
+	// LogOnly reports the packets breaking the policy without dropping them.
+	LogOnly bool
+}
+
+// check returns why a packet breaks the policy, empty if it doesn't.
+func (p *IPv6ExtPolicy) check(ext *ipv6Ext) string {
+	if p.MaxHeaders > 0 && len(ext.Headers) > p.MaxHeaders {
+		return fmt.Sprintf("%d IPv6 extension headers", len(ext.Headers))
+	}
+	for _, h := range ext.Headers {
+		if slices.Contains(p.Forbidden, h) {
+			return "forbidden IPv6 extension header " + ipv6ExtNames[h]
+		}
+	}
+	if p.Strict && ext.Malformed != "" {
+		return ext.Malformed
+	}
+	return ""
+}
+
+// ipv6Ext are the extension headers of an IPv6 packet.
+type ipv6Ext struct {
+	Headers     []uint8 // Next header values, in order
+	Fragment    bool    // Whether the packet is a fragment
+	Malformed   string  // Why the chain breaks the rules of RFC 8200 & 7112, empty if it doesn't
+	Upper       uint8   // Next header value of the upper-layer header
+	UpperOffset int     // Of the upper-layer header in the packet, 0 if not reached
+}
+
+// Names returns the names of the extension headers.
+func (e *ipv6Ext) Names() []string {
+	names := make([]string, len(e.Headers))
+	for i, h := range e.Headers {
+		names[i] = ipv6ExtNames[h]
+	}
+	return names
+}
+
+// parseIPv6Ext returns the extension headers of a packet, starting with the IP header,
+// or false if it's not IPv6 or has none.
+func parseIPv6Ext(data []byte) (ipv6Ext, bool) {
+	var ext ipv6Ext
+	if len(data) < ipv6HeaderLen || data[0]>>4 != 6 {
+		return ext, false
+	}
+	next := data[6]
+	if _, ok := ipv6ExtNames[next]; !ok {
+		return ext, false
+	}
+	offset := ipv6HeaderLen
+	firstFragment := false
+	for {
+		name, ok := ipv6ExtNames[next]
+		if !ok {
+			break
+		}
+		if next == 0 && len(ext.Headers) > 0 {
+			ext.malformed("IPv6 hop-by-hop options not first")
+		}
+		if n := bytes.Count(ext.Headers, []byte{next}); n > 0 && (next != 60 || n > 1) {
+			ext.malformed("repeated IPv6 " + name + " header")
+		}
+		ext.Headers = append(ext.Headers, next)
+		if next == 50 {
+			// ESP, the rest is encrypted
+			return ext, true
+		}
+		if len(data) < offset+8 {
+			ext.malformed("truncated IPv6 extension headers")
+			return ext, true
+		}
+		var length int
+		switch next {
+		case 44:
+			length = 8
+			ext.Fragment = true
+			if binary.BigEndian.Uint16(data[offset+2:offset+4])>>3 != 0 {
+				// Not the first fragment, the rest is the data of the fragmented packet
+				return ext, true
+			}
+			firstFragment = true
+		case 51:
+			length = (int(data[offset+1]) + 2) * 4
+		default:
+			length = (int(data[offset+1]) + 1) * 8
+		}
+		if next == 43 && data[offset+2] == 0 {
+			ext.malformed("IPv6 type 0 routing header")
+		}
+		next = data[offset]
+		offset += length
+		if offset > len(data) {
+			ext.malformed("truncated IPv6 extension headers")
+			return ext, true
+		}
+	}
+	if firstFragment && len(data)-offset < ipv6UpperHeaderLen[next] {
+		ext.malformed("IPv6 first fragment without the upper-layer header")
+	}
+	ext.Upper, ext.UpperOffset = next, offset
+	return ext, true
+}
+
+// decodeIPv6Upper decodes the upper-layer header of an IPv6 packet after extension headers gopacket
+// can't decode, so that such packets aren't let through uninspected. It returns the transport layer,
+// or nil and the offset of the message for ICMPv6, or nil and 0 if there's nothing to decode.
+func decodeIPv6Upper(data []byte, ext *ipv6Ext) (gopacket.TransportLayer, int) {
+	if ext.UpperOffset == 0 || ext.Fragment {
+		return nil, 0
+	}
+	var l interface {
+		gopacket.DecodingLayer
+		gopacket.TransportLayer
+	}
+	switch layers.IPProtocol(ext.Upper) {
+	case layers.IPProtocolTCP:
+		l = &layers.TCP{}
+	case layers.IPProtocolUDP:
+		l = &layers.UDP{}
+	case layers.IPProtocolSCTP:
+		l = &layers.SCTP{}
+	case layers.IPProtocolICMPv6:
+		if len(data)-ext.UpperOffset < 4 {
+			return nil, 0
+		}
+		return nil, ext.UpperOffset
+	default:
+		return nil, 0
+	}
+	if err := l.DecodeFromBytes(data[ext.UpperOffset:], gopacket.NilDecodeFeedback); err != nil {
+		return nil, 0
+	}
+	return l, 0
+}
+
+func (e *ipv6Ext) malformed(reason string) {
+	if e.Malformed == "" {
+		e.Malformed = reason
+	}
+}
+
+// addIPv6Ext adds the extension headers of a packet of a stream, if any, to those of the stream.
+func addIPv6Ext(info *ruleset.StreamInfo, ext *ipv6Ext) {
+	if ext != nil {
+		info.IPv6Ext.Add(ext.Names(), ext.Fragment)
+	}
+}
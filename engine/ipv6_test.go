@@ -0,0 +1,431 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ipv6TestHeader is an extension header of a test packet.
+type ipv6TestHeader struct {
+	typ    uint8
+	length int    // In bytes, 8 if 0
+	data   []byte // After the next header & length fields, zeros if nil
+}
+
+var (
+	ipv6TestHopByHop    = ipv6TestHeader{typ: 0}
+	ipv6TestDestination = ipv6TestHeader{typ: 60}
+	ipv6TestRouting     = ipv6TestHeader{typ: 43, length: 24, data: []byte{2}} // Type 2, no segments left
+	ipv6TestFirstFrag   = ipv6TestHeader{typ: 44, data: []byte{0x00, 0x01}}    // Offset 0, more fragments
+	ipv6TestLaterFrag   = ipv6TestHeader{typ: 44, data: []byte{0x00, 0x08}}    // Offset 8 bytes, last
+)
+
+// ipv6TestPacket returns an IPv6 packet from 2001:db8::1 to 2001:db8::2, with the extension headers
+// chained in order to the upper-layer protocol & its payload.
+func ipv6TestPacket(headers []ipv6TestHeader, upper uint8, payload []byte) []byte {
+	b := make([]byte, ipv6HeaderLen)
+	b[0], b[7] = 6<<4, 64
+	copy(b[8:24], net.ParseIP("2001:db8::1"))
+	copy(b[24:40], net.ParseIP("2001:db8::2"))
+	types := make([]uint8, 0, len(headers)+1)
+	for _, h := range headers {
+		types = append(types, h.typ)
+	}
+	types = append(types, upper)
+	b[6] = types[0]
+	for i, h := range headers {
+		e := make([]byte, max(h.length, 8))
+		e[0] = types[i+1]
+		switch h.typ {
+		case 44:
+			// Reserved
+		case 51:
+			e[1] = byte(len(e)/4 - 2)
+		default:
+			e[1] = byte(len(e)/8 - 1)
+		}
+		copy(e[2:], h.data)
+		b = append(b, e...)
+	}
+	b = append(b, payload...)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)-ipv6HeaderLen))
+	return b
+}
+
+// ipv6TestRepeat returns a chain of n times the same header.
+func ipv6TestRepeat(h ipv6TestHeader, n int) []ipv6TestHeader {
+	headers := make([]ipv6TestHeader, n)
+	for i := range headers {
+		headers[i] = h
+	}
+	return headers
+}
+
+// ipv6TestUDP returns a UDP header from port 40000 to 53, and its payload.
+func ipv6TestUDP(payload string) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(b[0:], 40000)
+	binary.BigEndian.PutUint16(b[2:], 53)
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(payload)))
+	return append(b, payload...)
+}
+
+func TestParseIPv6Ext(t *testing.T) {
+	udp, tcp := uint8(layers.IPProtocolUDP), uint8(layers.IPProtocolTCP)
+	testCases := []struct {
+		name     string
+		headers  []ipv6TestHeader
+		upper    uint8
+		payload  []byte
+		truncate int // Bytes cut from the end of the packet
+		wantOK   bool
+		want     ipv6Ext
+	}{
+		{
+			name:    "none",
+			upper:   tcp,
+			payload: make([]byte, 20),
+		},
+		{
+			name:    "hop-by-hop",
+			headers: []ipv6TestHeader{ipv6TestHopByHop},
+			upper:   tcp,
+			payload: make([]byte, 20),
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{0}, Upper: tcp, UpperOffset: 48},
+		},
+		{
+			name:    "recommended order",
+			headers: []ipv6TestHeader{ipv6TestHopByHop, ipv6TestDestination, ipv6TestRouting, ipv6TestDestination},
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{0, 60, 43, 60}, Upper: udp, UpperOffset: 88},
+		},
+		{
+			name:    "authentication header",
+			headers: []ipv6TestHeader{{typ: 51, length: 24}},
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{51}, Upper: udp, UpperOffset: 64},
+		},
+		{
+			name:    "esp",
+			upper:   50,
+			payload: make([]byte, 32),
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{50}},
+		},
+		{
+			name:    "first fragment",
+			headers: []ipv6TestHeader{ipv6TestFirstFrag},
+			upper:   tcp,
+			payload: make([]byte, 20),
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{44}, Fragment: true, Upper: tcp, UpperOffset: 48},
+		},
+		{
+			name:    "first fragment without the upper-layer header",
+			headers: []ipv6TestHeader{ipv6TestFirstFrag},
+			upper:   tcp,
+			payload: make([]byte, 10),
+			wantOK:  true,
+			want: ipv6Ext{Headers: []uint8{44}, Fragment: true, Upper: tcp, UpperOffset: 48,
+				Malformed: "IPv6 first fragment without the upper-layer header"},
+		},
+		{
+			// The rest is data of the fragmented packet, not headers
+			name:    "later fragment",
+			headers: []ipv6TestHeader{ipv6TestLaterFrag},
+			upper:   60,
+			payload: []byte{0xff, 0xff, 0xff},
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{44}, Fragment: true},
+		},
+		{
+			name:    "hop-by-hop not first",
+			headers: []ipv6TestHeader{ipv6TestDestination, ipv6TestHopByHop},
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want: ipv6Ext{Headers: []uint8{60, 0}, Upper: udp, UpperOffset: 56,
+				Malformed: "IPv6 hop-by-hop options not first"},
+		},
+		{
+			name:    "hop-by-hop chained to itself",
+			headers: []ipv6TestHeader{ipv6TestHopByHop, ipv6TestHopByHop, ipv6TestHopByHop},
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want: ipv6Ext{Headers: []uint8{0, 0, 0}, Upper: udp, UpperOffset: 64,
+				Malformed: "IPv6 hop-by-hop options not first"},
+		},
+		{
+			name:    "repeated routing",
+			headers: []ipv6TestHeader{ipv6TestRouting, ipv6TestRouting},
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want: ipv6Ext{Headers: []uint8{43, 43}, Upper: udp, UpperOffset: 88,
+				Malformed: "repeated IPv6 routing header"},
+		},
+		{
+			name:    "destination options thrice",
+			headers: ipv6TestRepeat(ipv6TestDestination, 3),
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want: ipv6Ext{Headers: []uint8{60, 60, 60}, Upper: udp, UpperOffset: 64,
+				Malformed: "repeated IPv6 destination header"},
+		},
+		{
+			name:    "long chain",
+			headers: ipv6TestRepeat(ipv6TestDestination, 200),
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want: ipv6Ext{Headers: bytes.Repeat([]uint8{60}, 200), Upper: udp, UpperOffset: 40 + 200*8,
+				Malformed: "repeated IPv6 destination header"},
+		},
+		{
+			name:    "type 0 routing",
+			headers: []ipv6TestHeader{{typ: 43, length: 24}},
+			upper:   udp,
+			payload: ipv6TestUDP(""),
+			wantOK:  true,
+			want: ipv6Ext{Headers: []uint8{43}, Upper: udp, UpperOffset: 64,
+				Malformed: "IPv6 type 0 routing header"},
+		},
+		{
+			name:     "truncated header",
+			headers:  []ipv6TestHeader{ipv6TestHopByHop},
+			upper:    udp,
+			truncate: 4,
+			wantOK:   true,
+			want:     ipv6Ext{Headers: []uint8{0}, Malformed: "truncated IPv6 extension headers"},
+		},
+		{
+			name:     "header longer than the packet",
+			headers:  []ipv6TestHeader{ipv6TestDestination, {typ: 60, length: 64}},
+			upper:    udp,
+			truncate: 32,
+			wantOK:   true,
+			want:     ipv6Ext{Headers: []uint8{60, 60}, Malformed: "truncated IPv6 extension headers"},
+		},
+		{
+			// The last header announces another one, but the packet ends
+			name:    "chain without end",
+			headers: []ipv6TestHeader{ipv6TestHopByHop, ipv6TestRouting},
+			upper:   60,
+			wantOK:  true,
+			want:    ipv6Ext{Headers: []uint8{0, 43, 60}, Malformed: "truncated IPv6 extension headers"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := ipv6TestPacket(tc.headers, tc.upper, tc.payload)
+			data = data[:len(data)-tc.truncate]
+			ext, ok := parseIPv6Ext(data)
+			if ok != tc.wantOK || (ok && !reflect.DeepEqual(ext, tc.want)) {
+				t.Errorf("parseIPv6Ext() = %+v, %v, want %+v, %v", ext, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+
+	// Not IPv6 packets
+	for _, data := range [][]byte{nil, make([]byte, 39), append([]byte{0x45}, make([]byte, 59)...)} {
+		if ext, ok := parseIPv6Ext(data); ok {
+			t.Errorf("parseIPv6Ext(%d bytes) = %+v, want none", len(data), ext)
+		}
+	}
+}
+
+func TestIPv6ExtPolicy_Check(t *testing.T) {
+	routed := &ipv6Ext{Headers: []uint8{0, 43, 60}}
+	malformed := &ipv6Ext{Headers: []uint8{60, 0}, Malformed: "IPv6 hop-by-hop options not first"}
+	testCases := []struct {
+		name   string
+		policy IPv6ExtPolicy
+		ext    *ipv6Ext
+		want   string
+	}{
+		{"no limits", IPv6ExtPolicy{}, routed, ""},
+		{"max headers", IPv6ExtPolicy{MaxHeaders: 2}, routed, "3 IPv6 extension headers"},
+		{"within max headers", IPv6ExtPolicy{MaxHeaders: 3}, routed, ""},
+		{"forbidden", IPv6ExtPolicy{Forbidden: []uint8{43}}, routed, "forbidden IPv6 extension header routing"},
+		{"not forbidden", IPv6ExtPolicy{Forbidden: []uint8{44, 253, 254}}, routed, ""},
+		{"malformed not strict", IPv6ExtPolicy{}, malformed, ""},
+		{"malformed strict", IPv6ExtPolicy{Strict: true}, malformed, "IPv6 hop-by-hop options not first"},
+		{"well-formed strict", IPv6ExtPolicy{Strict: true}, routed, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.check(tc.ext); got != tc.want {
+				t.Errorf("check() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeIPv6Upper(t *testing.T) {
+	udp, tcp, icmp := uint8(layers.IPProtocolUDP), uint8(layers.IPProtocolTCP), uint8(layers.IPProtocolICMPv6)
+	testCases := []struct {
+		name       string
+		headers    []ipv6TestHeader
+		upper      uint8
+		payload    []byte
+		wantUDP    bool
+		wantOffset int
+	}{
+		{"udp after routing", []ipv6TestHeader{ipv6TestRouting}, udp, ipv6TestUDP("query"), true, 0},
+		{"icmpv6 after destination options", []ipv6TestHeader{ipv6TestDestination}, icmp, []byte{128, 0, 0, 0, 0, 1, 0, 1}, false, 48},
+		{"truncated icmpv6", []ipv6TestHeader{ipv6TestDestination}, icmp, []byte{128, 0}, false, 0},
+		{"truncated tcp", []ipv6TestHeader{ipv6TestRouting}, tcp, make([]byte, 10), false, 0},
+		{"fragment", []ipv6TestHeader{ipv6TestFirstFrag}, udp, ipv6TestUDP("query"), false, 0},
+		{"esp", nil, 50, make([]byte, 32), false, 0},
+		{"unknown protocol", []ipv6TestHeader{ipv6TestRouting}, 99, make([]byte, 20), false, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := ipv6TestPacket(tc.headers, tc.upper, tc.payload)
+			ext, ok := parseIPv6Ext(data)
+			if !ok {
+				t.Fatal("no extension headers")
+			}
+			l, offset := decodeIPv6Upper(data, &ext)
+			if offset != tc.wantOffset {
+				t.Errorf("offset = %d, want %d", offset, tc.wantOffset)
+			}
+			u, isUDP := l.(*layers.UDP)
+			if isUDP != tc.wantUDP || (l != nil && !isUDP) {
+				t.Fatalf("layer = %v, want UDP %v", l, tc.wantUDP)
+			}
+			if isUDP && (u.SrcPort != 40000 || u.DstPort != 53 || string(u.Payload) != "query") {
+				t.Errorf("UDP = %d -> %d %q, want 40000 -> 53 \"query\"", u.SrcPort, u.DstPort, u.Payload)
+			}
+		})
+	}
+}
+
+// ipv6TestRuleset records the info of the streams it matches.
+type ipv6TestRuleset struct {
+	testRuleset
+	infos []ruleset.StreamInfo
+}
+
+func (r *ipv6TestRuleset) Match(info ruleset.StreamInfo) ruleset.MatchResult {
+	r.infos = append(r.infos, info)
+	return r.result
+}
+
+func TestWorker_IPv6Ext(t *testing.T) {
+	udp := uint8(layers.IPProtocolUDP)
+	testCases := []struct {
+		name        string
+		policy      *IPv6ExtPolicy
+		headers     []ipv6TestHeader
+		payload     []byte
+		wantVerdict io.Verdict
+		wantReason  string          // Of the anomaly, if any
+		wantExt     ruleset.IPv6Ext // Of the stream, if any
+	}{
+		{
+			// gopacket can't decode type 2 routing headers, the engine does
+			name:        "routing without policy",
+			headers:     []ipv6TestHeader{ipv6TestRouting},
+			payload:     ipv6TestUDP("query"),
+			wantVerdict: io.VerdictAcceptStream,
+			wantExt:     ruleset.IPv6Ext{Headers: []string{"routing"}, Max: 1},
+		},
+		{
+			name:        "forbidden routing",
+			policy:      &IPv6ExtPolicy{Forbidden: []uint8{43}},
+			headers:     []ipv6TestHeader{ipv6TestRouting},
+			payload:     ipv6TestUDP("query"),
+			wantVerdict: io.VerdictDrop,
+			wantReason:  "forbidden IPv6 extension header routing",
+		},
+		{
+			name:        "allowed destination options",
+			policy:      &IPv6ExtPolicy{Forbidden: []uint8{43}},
+			headers:     []ipv6TestHeader{ipv6TestDestination},
+			payload:     ipv6TestUDP("query"),
+			wantVerdict: io.VerdictAcceptStream,
+			wantExt:     ruleset.IPv6Ext{Headers: []string{"destination"}, Max: 1},
+		},
+		{
+			name:        "too many headers logged",
+			policy:      &IPv6ExtPolicy{MaxHeaders: 1, LogOnly: true},
+			headers:     []ipv6TestHeader{ipv6TestHopByHop, ipv6TestDestination},
+			payload:     ipv6TestUDP("query"),
+			wantVerdict: io.VerdictAcceptStream,
+			wantReason:  "2 IPv6 extension headers",
+			wantExt:     ruleset.IPv6Ext{Headers: []string{"hopbyhop", "destination"}, Max: 2},
+		},
+		{
+			name:        "tiny first fragment",
+			policy:      &IPv6ExtPolicy{Strict: true},
+			headers:     []ipv6TestHeader{ipv6TestFirstFrag},
+			payload:     ipv6TestUDP("")[:4],
+			wantVerdict: io.VerdictDrop,
+			wantReason:  "IPv6 first fragment without the upper-layer header",
+		},
+		{
+			name:        "long chain",
+			policy:      &IPv6ExtPolicy{MaxHeaders: 8},
+			headers:     ipv6TestRepeat(ipv6TestDestination, 9),
+			payload:     ipv6TestUDP("query"),
+			wantVerdict: io.VerdictDrop,
+			wantReason:  "9 IPv6 extension headers",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &testLogger{}
+			rs := &ipv6TestRuleset{testRuleset: testRuleset{result: ruleset.MatchResult{Action: ruleset.ActionAllow, RuleName: "test"}}}
+			w, err := newWorker(workerConfig{Logger: logger, Ruleset: rs, IPv6Ext: tc.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := gopacket.NewPacket(ipv6TestPacket(tc.headers, udp, tc.payload), layers.LayerTypeIPv6, gopacket.Default)
+			v := w.handle(&workerPacket{Packet: p}, nil)
+			if v.Verdict != tc.wantVerdict {
+				t.Errorf("verdict = %v, want %v", v.Verdict, tc.wantVerdict)
+			}
+			var wantAnomalies []PacketAnomaly
+			if tc.wantReason != "" {
+				wantAnomalies = []PacketAnomaly{{
+					SrcIP:   net.ParseIP("2001:db8::1"),
+					DstIP:   net.ParseIP("2001:db8::2"),
+					Reason:  tc.wantReason,
+					Dropped: tc.wantVerdict == io.VerdictDrop,
+				}}
+			}
+			if !reflect.DeepEqual(logger.anomalies, wantAnomalies) {
+				t.Errorf("anomalies = %+v, want %+v", logger.anomalies, wantAnomalies)
+			}
+			if tc.wantVerdict == io.VerdictDrop {
+				if logger.streams != 0 {
+					t.Errorf("streams = %d, want 0", logger.streams)
+				}
+				return
+			}
+			if len(rs.infos) == 0 {
+				t.Fatal("no stream matched")
+			}
+			if ext := rs.infos[len(rs.infos)-1].IPv6Ext; !reflect.DeepEqual(ext, tc.wantExt) {
+				t.Errorf("stream IPv6Ext = %+v, want %+v", ext, tc.wantExt)
+			}
+		})
+	}
+}
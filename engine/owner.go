@@ -0,0 +1,21 @@
+package engine
+
+import (
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+)
+
+// socketOwner is the owner of the local socket of a packet, in the AncillaryData of its CaptureInfo.
+type socketOwner ruleset.SocketOwner
+
+// packetOwner returns the owner of the local socket of a packet, nil if unknown.
+func packetOwner(ci gopacket.CaptureInfo) *ruleset.SocketOwner {
+	for _, d := range ci.AncillaryData {
+		if o, ok := d.(socketOwner); ok {
+			owner := ruleset.SocketOwner(o)
+			return &owner
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+package engine
+
+import "github.com/apernet/OpenGFW/ruleset"
+
+// qosMark returns the mark of an accepted stream: that of its rule, if any, or else that of q.
+func qosMark(q QoSMarker, info ruleset.StreamInfo, mark uint32) uint32 {
+	if mark != 0 || q == nil {
+		return mark
+	}
+	return q.QoSMark(info)
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"errors"
+
+	"github.com/apernet/OpenGFW/modifier"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// rewriteMaxPayload is the maximum payload size of rewritten TCP segments, larger output
+	// is split into several segments so that it still fits the MTU of most paths.
+	rewriteMaxPayload = 1400
+	// rewriteMaxSent is the number of sent segments kept per direction for retransmissions.
+	rewriteMaxSent = 64
+)
+
+var errRewriteSpansPackets = errors.New("the data to rewrite spans multiple packets")
+
+// tcpRewriteVerdict is what to do with a packet of a rewritten stream.
+type tcpRewriteVerdict int
+
+const (
+	tcpRewriteUnchanged tcpRewriteVerdict = iota
+	tcpRewriteModified                    // Header and/or payload modified
+	tcpRewriteDrop
+)
+
+// tcpSegment is an extra segment to send after a rewritten packet,
+// when its new payload doesn't fit in one.
+type tcpSegment struct {
+	Seq     uint32
+	Payload []byte
+	FIN     bool
+}
+
+// tcpSeqMark maps a position in the sender's sequence space to the receiver's,
+// at the end of a rewritten segment.
+type tcpSeqMark struct {
+	Orig, Out uint32
+}
+
+// tcpSentSegment is a rewritten segment, kept to answer retransmissions of the original.
+type tcpSentSegment struct {
+	Orig    uint32 // Sequence number of the original segment
+	OrigLen int
+	Out     uint32 // Sequence number of the rewritten segment
+	Payload []byte
+	FIN     bool
+}
+
+// tcpRewriteDir is the state of one direction of a rewritten stream.
+// The sender keeps using its own sequence numbers ("orig"), the receiver sees those
+// of the rewritten data ("out").
+type tcpRewriteDir struct {
+	init     bool
+	origNext uint32 // Next sequence number expected from the sender
+	outNext  uint32 // Next sequence number sent to the receiver
+	marks    []tcpSeqMark
+	sent     []tcpSentSegment
+}
+
+// translateAck translates an ack from the receiver into the sender's sequence space.
+// Only data that has been fully delivered as rewritten segments is acknowledged,
+// so that the sender retransmits the rest if it gets lost.
+func (d *tcpRewriteDir) translateAck(ack uint32) uint32 {
+	i := len(d.marks) - 1
+	for ; i > 0; i-- {
+		if int32(ack-d.marks[i].Out) >= 0 {
+			break
+		}
+	}
+	m := d.marks[i]
+	if i == 0 && int32(ack-m.Out) < 0 {
+		// Before the rewrite, only shifted
+		return ack - m.Out + m.Orig
+	}
+	// Forget what has been acknowledged
+	d.marks = d.marks[i:]
+	for len(d.sent) > 0 && int32(d.sent[0].Orig+uint32(d.sent[0].OrigLen)-m.Orig) <= 0 {
+		d.sent = d.sent[1:]
+	}
+	return m.Orig
+}
+
+func (d *tcpRewriteDir) findSent(seq uint32) *tcpSentSegment {
+	for i := len(d.sent) - 1; i >= 0; i-- {
+		s := &d.sent[i]
+		if seq == s.Orig || (int32(seq-s.Orig) > 0 && int32(seq-s.Orig) < int32(s.OrigLen)) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (d *tcpRewriteDir) addSent(s tcpSentSegment) {
+	if len(d.sent) >= rewriteMaxSent {
+		d.sent = d.sent[1:]
+	}
+	d.sent = append(d.sent, s)
+}
+
+// tcpStreamRewrite applies a TCPStreamRewriter to the packets of a stream, from the
+// packet that made the rule match on, fixing up their sequence & ack numbers.
+type tcpStreamRewrite struct {
+	rewriter modifier.TCPStreamRewriter
+	dirs     [2]tcpRewriteDir // Client to server, server to client
+}
+
+func newTCPStreamRewrite(rewriter modifier.TCPStreamRewriter) *tcpStreamRewrite {
+	return &tcpStreamRewrite{rewriter: rewriter}
+}
+
+// process rewrites a packet in place. payload is its new payload if it has changed,
+// and extra the segments to send after it if the new payload doesn't fit in one packet
+// (only if split is true).
+func (r *tcpStreamRewrite) process(tcp *layers.TCP, rev, split bool) (v tcpRewriteVerdict, payload []byte, extra []tcpSegment) {
+	if tcp.SYN {
+		return tcpRewriteUnchanged, nil, nil
+	}
+	d, o := &r.dirs[0], &r.dirs[1]
+	if rev {
+		d, o = o, d
+	}
+	if !d.init {
+		d.init = true
+		d.origNext, d.outNext = tcp.Seq, tcp.Seq
+		d.marks = []tcpSeqMark{{Orig: tcp.Seq, Out: tcp.Seq}}
+	}
+	v = tcpRewriteUnchanged
+	if tcp.ACK && o.init {
+		if ack := o.translateAck(tcp.Ack); ack != tcp.Ack {
+			tcp.Ack = ack
+			v = tcpRewriteModified
+		}
+	}
+	if stripSACK(tcp) {
+		v = tcpRewriteModified
+	}
+	if tcp.RST || (len(tcp.Payload) == 0 && !tcp.FIN) {
+		// No data, only shift the sequence number
+		if seq := tcp.Seq - d.origNext + d.outNext; seq != tcp.Seq {
+			tcp.Seq = seq
+			v = tcpRewriteModified
+		}
+		return v, nil, nil
+	}
+	data, fin := tcp.Payload, tcp.FIN
+	diff := int32(tcp.Seq - d.origNext)
+	if diff > 0 {
+		// Out of order, wait for the sender to retransmit it in order
+		return tcpRewriteDrop, nil, nil
+	}
+	if diff < 0 {
+		if int32(tcp.Seq+uint32(len(data))-d.origNext) <= 0 {
+			// Retransmission
+			if s := d.findSent(tcp.Seq); s != nil {
+				payload, tcp.FIN, extra = segmentRewritten(tcp, s.Out, s.Payload, s.FIN, split)
+				return tcpRewriteModified, payload, extra
+			}
+			// Of data held back by the rewriter, the sender is waiting for it to be acknowledged
+			data, fin = nil, false
+			if out := r.rewriter.Feed(rev, nil, true); len(out) > 0 {
+				return r.send(d, tcp, tcp.Seq, 0, out, false, split)
+			}
+			tcp.Seq, tcp.FIN = d.outNext, false
+			return tcpRewriteModified, []byte{}, nil
+		}
+		// Partly new, only feed the new part
+		data = data[-diff:]
+	}
+	out := r.rewriter.Feed(rev, data, fin)
+	orig := d.origNext
+	d.origNext += uint32(len(data))
+	if fin {
+		d.origNext++
+	}
+	return r.send(d, tcp, orig, len(data), out, fin, split)
+}
+
+// send replaces the payload of a packet with rewritten data.
+func (r *tcpStreamRewrite) send(d *tcpRewriteDir, tcp *layers.TCP, orig uint32, origLen int, out []byte, fin, split bool) (tcpRewriteVerdict, []byte, []tcpSegment) {
+	seq := d.outNext
+	d.outNext += uint32(len(out))
+	if fin {
+		d.outNext++
+	}
+	if len(out) > 0 || fin {
+		// Data held back by the rewriter must not be acknowledged until it's sent
+		out = append([]byte(nil), out...) // May be the packet's buffer
+		d.marks = append(d.marks, tcpSeqMark{Orig: d.origNext, Out: d.outNext})
+		d.addSent(tcpSentSegment{Orig: orig, OrigLen: origLen, Out: seq, Payload: out, FIN: fin})
+	}
+	payload, finFlag, extra := segmentRewritten(tcp, seq, out, fin, split)
+	tcp.FIN = finFlag
+	if payload == nil {
+		payload = []byte{}
+	}
+	return tcpRewriteModified, payload, extra
+}
+
+// segmentRewritten sets the sequence number of a packet carrying rewritten data, and splits
+// the data into extra segments if it doesn't fit. It returns the payload & FIN flag of the packet.
+func segmentRewritten(tcp *layers.TCP, seq uint32, data []byte, fin, split bool) ([]byte, bool, []tcpSegment) {
+	tcp.Seq = seq
+	if !split || len(data) <= rewriteMaxPayload {
+		return data, fin, nil
+	}
+	var extra []tcpSegment
+	for off := rewriteMaxPayload; off < len(data); off += rewriteMaxPayload {
+		end := off + rewriteMaxPayload
+		if end > len(data) {
+			end = len(data)
+		}
+		extra = append(extra, tcpSegment{Seq: seq + uint32(off), Payload: data[off:end]})
+	}
+	extra[len(extra)-1].FIN = fin
+	return data[:rewriteMaxPayload], false, extra
+}
+
+// stripSACK removes the SACK blocks of a packet, as they would be in the wrong sequence space.
+func stripSACK(tcp *layers.TCP) bool {
+	opts := tcp.Options[:0]
+	for _, o := range tcp.Options {
+		if o.OptionType != layers.TCPOptionKindSACK {
+			opts = append(opts, o)
+		}
+	}
+	stripped := len(opts) != len(tcp.Options)
+	tcp.Options = opts
+	return stripped
+}
+
+// tcpOnceRewriter adapts a TCPRewriterInstance, which only rewrites the client's packet
+// that made the rule match, to the stream rewriter framework.
+type tcpOnceRewriter struct {
+	first []byte // Rewritten payload of the first packet
+	done  bool
+}
+
+func (r *tcpOnceRewriter) Feed(rev bool, data []byte, flush bool) []byte {
+	if !rev && !r.done {
+		r.done = true
+		return r.first
+	}
+	return data
+}
@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/modifier"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// rewriteTestUpper rewrites the data of the client to upper case, with a "!" added to every chunk,
+// so that the rewritten segments are longer than the originals. The data of the server is left alone.
+type rewriteTestUpper struct{}
+
+func (m *rewriteTestUpper) NewStream(modifier.StreamInfo) modifier.TCPStreamRewriter { return m }
+
+func (m *rewriteTestUpper) Feed(rev bool, data []byte, flush bool) []byte {
+	if rev || len(data) == 0 {
+		return data
+	}
+	return append(bytes.ToUpper(data), '!')
+}
+
+func (m *rewriteTestUpper) Process(data []byte) ([]byte, error) {
+	return append(bytes.ToUpper(data), '!'), nil
+}
+
+// rewriteTestTTL sets the TTL (hop limit) of the packets to 1.
+type rewriteTestTTL struct{}
+
+func (m *rewriteTestTTL) ModifyIP(ip gopacket.NetworkLayer, rev bool) bool {
+	switch ip := ip.(type) {
+	case *layers.IPv4:
+		ip.TTL = 1
+	case *layers.IPv6:
+		ip.HopLimit = 1
+	}
+	return true
+}
+
+// rewriteTestUDP returns a serialized IPv4 or IPv6 packet from the client to the server of synTestPacket,
+// with a UDP datagram.
+func rewriteTestUDP(t *testing.T, v6 bool, payload []byte) []byte {
+	var ip gopacket.NetworkLayer
+	if v6 {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP,
+			SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	} else {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+	}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// rewriteTestCheck checks the lengths & checksums of the IP header and of the TCP or UDP header
+// of a packet sent by the engine, and returns its decoded transport layer.
+func rewriteTestCheck(t *testing.T, data []byte) gopacket.TransportLayer {
+	t.Helper()
+	fold := func(sum uint32) uint16 {
+		for sum>>16 != 0 {
+			sum = sum&0xffff + sum>>16
+		}
+		return uint16(sum)
+	}
+	var pseudo uint32
+	var segment []byte
+	var proto uint8
+	first := layers.LayerTypeIPv4
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0f) * 4
+		if total := int(binary.BigEndian.Uint16(data[2:4])); total != len(data) {
+			t.Errorf("IPv4 total length = %d, want %d", total, len(data))
+		}
+		if sum := fold(checksumAdd(0, data[:ihl])); sum != 0xffff {
+			t.Errorf("invalid IPv4 header checksum %#04x", binary.BigEndian.Uint16(data[10:12]))
+		}
+		pseudo, proto, segment = checksumAdd(0, data[12:20]), data[9], data[ihl:]
+	case 6:
+		if payload := int(binary.BigEndian.Uint16(data[4:6])); payload != len(data)-ipv6HeaderLen {
+			t.Errorf("IPv6 payload length = %d, want %d", payload, len(data)-ipv6HeaderLen)
+		}
+		pseudo, proto, segment = checksumAdd(0, data[8:40]), data[6], data[ipv6HeaderLen:]
+		first = layers.LayerTypeIPv6
+	default:
+		t.Fatalf("not an IP packet: %x", data)
+	}
+	if proto == uint8(layers.IPProtocolUDP) {
+		if length := int(binary.BigEndian.Uint16(segment[4:6])); length != len(segment) {
+			t.Errorf("UDP length = %d, want %d", length, len(segment))
+		}
+	}
+	sum := pseudo + uint32(proto) + uint32(len(segment))
+	if sum := fold(checksumAdd(sum, segment)); sum != 0xffff {
+		t.Errorf("invalid %v checksum", layers.IPProtocol(proto))
+	}
+	p := gopacket.NewPacket(data, first, gopacket.Default)
+	if p.TransportLayer() == nil {
+		t.Fatalf("no transport layer in %v", p)
+	}
+	return p.TransportLayer()
+}
+
+func TestWorker_TCPStreamRewrite_Checksums(t *testing.T) {
+	testCases := []struct {
+		name     string
+		instance modifier.Instance
+	}{
+		{"stream rewriter", &rewriteTestUpper{}},
+		{"IP modifier", &rewriteTestTTL{}},
+	}
+	for _, tc := range testCases {
+		for _, v6 := range []bool{false, true} {
+			name := tc.name
+			if v6 {
+				name += " IPv6"
+			}
+			t.Run(name, func(t *testing.T) {
+				_, rewriting := tc.instance.(*rewriteTestUpper)
+				rs := &testRuleset{result: ruleset.MatchResult{Action: ruleset.ActionModify, RuleName: "test", ModInstance: tc.instance}}
+				w, err := newWorker(workerConfig{Logger: &testLogger{}, Ruleset: rs})
+				if err != nil {
+					t.Fatal(err)
+				}
+				first := layers.LayerTypeIPv4
+				if v6 {
+					first = layers.LayerTypeIPv6
+				}
+				var injected [][]byte
+				inject := func(b []byte) error {
+					injected = append(injected, append([]byte(nil), b...))
+					return nil
+				}
+				handle := func(g evasionTestSegment) workerVerdict {
+					data, _ := g.packet(t, v6)
+					return w.handle(&workerPacket{Packet: gopacket.NewPacket(data, first, gopacket.Default), Inject: inject}, nil)
+				}
+				for _, g := range evasionTestHandshake {
+					handle(g)
+				}
+
+				// Rewritten data
+				v := handle(evasionTestSegment{ttl: 64, tcp: layers.TCP{ACK: true, PSH: true, Seq: 1000, Ack: 5000,
+					BaseLayer: layers.BaseLayer{Payload: []byte("hello")}}})
+				if v.Verdict != io.VerdictAcceptModify {
+					t.Fatalf("verdict = %v, want %v", v.Verdict, io.VerdictAcceptModify)
+				}
+				tcp := rewriteTestCheck(t, v.Packet).(*layers.TCP)
+				wantPayload, wantAck := "hello", uint32(1005)
+				if rewriting {
+					wantPayload, wantAck = "HELLO!", 1006
+				}
+				if string(tcp.Payload) != wantPayload || tcp.Seq != 1000 {
+					t.Errorf("segment = %d %q, want 1000 %q", tcp.Seq, tcp.Payload, wantPayload)
+				}
+
+				// ACK of the rewritten data, translated for the client
+				v = handle(evasionTestSegment{rev: true, ttl: 58, tcp: layers.TCP{ACK: true, Seq: 5000, Ack: wantAck}})
+				if v.Verdict != io.VerdictAcceptModify {
+					t.Fatalf("verdict = %v, want %v", v.Verdict, io.VerdictAcceptModify)
+				}
+				tcp = rewriteTestCheck(t, v.Packet).(*layers.TCP)
+				if tcp.Ack != 1005 {
+					t.Errorf("ack = %d, want 1005", tcp.Ack)
+				}
+
+				// Rewritten data too large for one packet, split
+				large := bytes.Repeat([]byte("a"), 2000)
+				v = handle(evasionTestSegment{ttl: 64, tcp: layers.TCP{ACK: true, PSH: true, Seq: 1005, Ack: 5000,
+					BaseLayer: layers.BaseLayer{Payload: large}}})
+				if v.Verdict != io.VerdictAcceptModify {
+					t.Fatalf("verdict = %v, want %v", v.Verdict, io.VerdictAcceptModify)
+				}
+				tcp = rewriteTestCheck(t, v.Packet).(*layers.TCP)
+				got := append([]byte(nil), tcp.Payload...)
+				for _, b := range injected {
+					extra := rewriteTestCheck(t, b).(*layers.TCP)
+					if want := wantAck + uint32(len(got)); extra.Seq != want {
+						t.Errorf("injected seq = %d, want %d", extra.Seq, want)
+					}
+					got = append(got, extra.Payload...)
+				}
+				want := large
+				if rewriting {
+					want = append(bytes.ToUpper(large), '!')
+					if len(injected) != 1 {
+						t.Errorf("injected %d segments, want 1", len(injected))
+					}
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("data = %q, want %q", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestWorker_UDPModify_Checksums(t *testing.T) {
+	testCases := []struct {
+		name        string
+		instance    modifier.Instance
+		wantPayload string
+	}{
+		{"payload", &rewriteTestUpper{}, "QUERY!"},
+		{"IP modifier", &rewriteTestTTL{}, "query"},
+	}
+	for _, tc := range testCases {
+		for _, v6 := range []bool{false, true} {
+			name := tc.name
+			if v6 {
+				name += " IPv6"
+			}
+			t.Run(name, func(t *testing.T) {
+				rs := &testRuleset{result: ruleset.MatchResult{Action: ruleset.ActionModify, RuleName: "test", ModInstance: tc.instance}}
+				w, err := newWorker(workerConfig{Logger: &testLogger{}, Ruleset: rs})
+				if err != nil {
+					t.Fatal(err)
+				}
+				first := layers.LayerTypeIPv4
+				if v6 {
+					first = layers.LayerTypeIPv6
+				}
+				p := gopacket.NewPacket(rewriteTestUDP(t, v6, []byte("query")), first, gopacket.Default)
+				v := w.handle(&workerPacket{Packet: p}, nil)
+				if v.Verdict != io.VerdictAcceptModify {
+					t.Fatalf("verdict = %v, want %v", v.Verdict, io.VerdictAcceptModify)
+				}
+				udp := rewriteTestCheck(t, v.Packet).(*layers.UDP)
+				if string(udp.Payload) != tc.wantPayload {
+					t.Errorf("payload = %q, want %q", udp.Payload, tc.wantPayload)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// packetRingAutoDumpInterval limits how often a worker dumps its packet ring on its own,
+// so that an analyzer that keeps failing doesn't fill up the disk.
+const packetRingAutoDumpInterval = time.Minute
+
+// ErrPacketRingDisabled is returned by Engine.DumpPacketRings if Config.PacketRing is not set.
+var ErrPacketRingDisabled = errors.New("packet ring is not enabled")
+
+// RingPacket is a packet kept in a worker's packet ring.
+type RingPacket struct {
+	CI   gopacket.CaptureInfo
+	Data []byte // Starting with the IP header
+}
+
+// PacketRingDumper writes the packet ring of a worker when it's dumped.
+// It must be safe for concurrent use.
+type PacketRingDumper interface {
+	// DumpPacketRing writes the packets of a worker's ring, oldest first,
+	// and returns where they have been written.
+	DumpPacketRing(workerID int, reason string, packets []RingPacket) (string, error)
+}
+
+// packetRing keeps the latest packets handled by a worker, whatever their stream,
+// so that they can be written out when an analyzer fails and the failure can be reproduced.
+// Only used by the worker's goroutine. A nil *packetRing does nothing.
+type packetRing struct {
+	workerID     int
+	dumper       PacketRingDumper
+	logger       Logger
+	packets      []RingPacket // Ring buffer
+	next         int          // Index of the oldest packet, once the buffer is full
+	lastAutoDump time.Time
+}
+
+func newPacketRing(workerID, size int, dumper PacketRingDumper, logger Logger) *packetRing {
+	if size <= 0 || dumper == nil {
+		return nil
+	}
+	return &packetRing{
+		workerID: workerID,
+		dumper:   dumper,
+		logger:   logger,
+		packets:  make([]RingPacket, 0, size),
+	}
+}
+
+// Packet adds a packet to the ring, replacing the oldest one if it's full. data is copied.
+func (r *packetRing) Packet(ci gopacket.CaptureInfo, data []byte) {
+	if r == nil {
+		return
+	}
+	if ci.Timestamp.IsZero() {
+		ci.Timestamp = time.Now()
+	}
+	p := RingPacket{CI: ci, Data: append([]byte(nil), data...)}
+	if len(r.packets) < cap(r.packets) {
+		r.packets = append(r.packets, p)
+	} else {
+		r.packets[r.next] = p
+		r.next = (r.next + 1) % len(r.packets)
+	}
+}
+
+// Snapshot returns the packets in the ring, oldest first.
+// The packets themselves are never modified, so the result can be used from any goroutine.
+func (r *packetRing) Snapshot() []RingPacket {
+	packets := make([]RingPacket, 0, len(r.packets))
+	packets = append(packets, r.packets[r.next:]...)
+	return append(packets, r.packets[:r.next]...)
+}
+
+// AutoDump dumps the ring in the background, unless it has already been dumped
+// this way less than packetRingAutoDumpInterval ago.
+func (r *packetRing) AutoDump(reason string) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(r.lastAutoDump) < packetRingAutoDumpInterval {
+		return
+	}
+	r.lastAutoDump = now
+	packets := r.Snapshot()
+	go func() {
+		_, _ = r.dump(reason, packets)
+	}()
+}
+
+// DumpOnPanic dumps the ring if the worker is panicking, then resumes panicking.
+// It must be deferred directly.
+func (r *packetRing) DumpOnPanic() {
+	if e := recover(); e != nil {
+		_, _ = r.dump(fmt.Sprintf("panic: %v", e), r.Snapshot())
+		panic(e)
+	}
+}
+
+func (r *packetRing) dump(reason string, packets []RingPacket) (string, error) {
+	name, err := r.dumper.DumpPacketRing(r.workerID, reason, packets)
+	r.logger.PacketRingDump(r.workerID, reason, name, len(packets), err)
+	return name, err
+}
+
+// DumpPacketRings dumps the packet ring of every worker, and returns where they have been written.
+// Each worker takes the snapshot of its ring between two packets, so this blocks until all workers
+// have done so, or the context is cancelled.
+func (e *engine) DumpPacketRings(ctx context.Context, reason string) ([]string, error) {
+	var names []string
+	for _, w := range e.workers {
+		if w.ring == nil {
+			return nil, ErrPacketRingDisabled
+		}
+		result := make(chan []RingPacket, 1)
+		select {
+		case w.queryChan <- func() { result <- w.ring.Snapshot() }:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var packets []RingPacket
+		select {
+		case packets = <-result:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		name, err := w.ring.dump(reason, packets)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
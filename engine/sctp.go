@@ -0,0 +1,686 @@
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/modifier"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// sctpVerdict is a subset of io.Verdict for SCTP associations.
+// SCTP packets are never modified.
+type sctpVerdict io.Verdict
+
+const (
+	sctpVerdictAccept       = sctpVerdict(io.VerdictAccept)
+	sctpVerdictAcceptStream = sctpVerdict(io.VerdictAcceptStream)
+	sctpVerdictDrop         = sctpVerdict(io.VerdictDrop)
+	sctpVerdictDropStream   = sctpVerdict(io.VerdictDropStream)
+)
+
+const (
+	sctpMaxMessageSize = 65536 // Of the user messages fed to analyzers, larger ones are truncated
+	sctpMaxAddrs       = 16    // Per endpoint
+
+	sctpParamIPv4 = 5
+	sctpParamIPv6 = 6
+
+	sctpDataFlagEnd       = 0x01
+	sctpDataFlagBegin     = 0x02
+	sctpDataFlagUnordered = 0x04
+)
+
+type sctpContext struct {
+	*gopacket.PacketMetadata
+	Verdict sctpVerdict
+	Mark    uint32
+	Data    []byte        // Raw packet, starting with the IP header
+	IPv6Ext *ipv6Ext      // Extension headers of the packet, nil if it has none
+	IO      string        // Name of the IO the packet came from
+	Delay   time.Duration // How long to hold the packet, for delay modifiers
+	Trace   *PacketTrace  // nil if tracing is not enabled
+}
+
+// sctpChunk is a chunk of an SCTP packet, its value starting after the chunk header.
+type sctpChunk struct {
+	Type  uint8
+	Flags uint8
+	Value []byte
+}
+
+// parseSCTPChunks returns the chunks of the payload of an SCTP packet, up to the first invalid one.
+func parseSCTPChunks(payload []byte) []sctpChunk {
+	var chunks []sctpChunk
+	for len(payload) >= 4 {
+		length := int(binary.BigEndian.Uint16(payload[2:4]))
+		if length < 4 || length > len(payload) {
+			break
+		}
+		chunks = append(chunks, sctpChunk{Type: payload[0], Flags: payload[1], Value: payload[4:length]})
+		// Chunks are padded to 4 bytes
+		length = (length + 3) &^ 3
+		if length > len(payload) {
+			break
+		}
+		payload = payload[length:]
+	}
+	return chunks
+}
+
+// sctpInitTag returns the initiate tag of an INIT or INIT ACK chunk, 0 if it's invalid.
+func sctpInitTag(c sctpChunk) uint32 {
+	if len(c.Value) < 16 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(c.Value[0:4])
+}
+
+// sctpInitAddrs returns the addresses listed in the parameters of an INIT or INIT ACK chunk.
+func sctpInitAddrs(c sctpChunk) []net.IP {
+	if len(c.Value) < 16 {
+		return nil
+	}
+	var addrs []net.IP
+	params := c.Value[16:]
+	for len(params) >= 4 {
+		typ, length := binary.BigEndian.Uint16(params[0:2]), int(binary.BigEndian.Uint16(params[2:4]))
+		if length < 4 || length > len(params) {
+			break
+		}
+		switch {
+		case typ == sctpParamIPv4 && length == 8:
+			addrs = append(addrs, net.IP(append([]byte(nil), params[4:8]...)))
+		case typ == sctpParamIPv6 && length == 20:
+			addrs = append(addrs, net.IP(append([]byte(nil), params[4:20]...)))
+		}
+		length = (length + 3) &^ 3
+		if length > len(params) {
+			break
+		}
+		params = params[length:]
+	}
+	return addrs
+}
+
+// sctpPorts returns the sum of the ports of an SCTP packet, the same both ways,
+// or false if the packet isn't SCTP. IPv6 extension headers aren't followed.
+func sctpPorts(data []byte, ipVersion byte) (uint32, bool) {
+	var payload []byte
+	switch {
+	case ipVersion == 4 && len(data) >= 20:
+		ihl := int(data[0]&0x0f) * 4
+		if data[9] != byte(layers.IPProtocolSCTP) || len(data) < ihl+4 {
+			return 0, false
+		}
+		payload = data[ihl:]
+	case ipVersion == 6 && len(data) >= 44:
+		if data[6] != byte(layers.IPProtocolSCTP) {
+			return 0, false
+		}
+		payload = data[40:]
+	default:
+		return 0, false
+	}
+	return uint32(binary.BigEndian.Uint16(payload[0:2])) + uint32(binary.BigEndian.Uint16(payload[2:4])), true
+}
+
+type sctpStreamFactory struct {
+	streamFactoryConfig
+
+	RulesetMutex sync.RWMutex
+	Ruleset      ruleset.Ruleset
+}
+
+// New creates the stream of an association, whose client is the source of the packet.
+func (f *sctpStreamFactory) New(ipFlow gopacket.Flow, sctp *layers.SCTP, sc *sctpContext) *sctpStream {
+	id := f.Node.Generate()
+	ipSrc, ipDst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
+	info := ruleset.StreamInfo{
+		ID:           id.Int64(),
+		UUID:         StreamUUID(id.Int64()),
+		Protocol:     ruleset.ProtocolSCTP,
+		SrcIP:        ipSrc,
+		DstIP:        ipDst,
+		SrcPort:      uint16(sctp.SrcPort),
+		DstPort:      uint16(sctp.DstPort),
+		InInterface:  interfaceName(sc.InterfaceIndex),
+		OutInterface: interfaceName(outInterfaceIndex(sc.CaptureInfo)),
+		Owner:        packetOwner(sc.CaptureInfo),
+		IO:           sc.IO,
+		Props:        make(analyzer.CombinedPropMap),
+		Counters:     ruleset.StreamCounters{StartTime: time.Now()},
+	}
+	info.Direction = streamDirection(info.InInterface, info.OutInterface, f.External)
+	resumed, reversed := resumeStream(f.StateSync, &info)
+	f.Logger.SCTPStreamNew(f.WorkerID, info)
+	f.Counters.sctpStreams.Add(1)
+	f.RulesetMutex.RLock()
+	rs := f.Ruleset
+	f.RulesetMutex.RUnlock()
+	degraded := f.Degraded.Load()
+	var ans []analyzer.SCTPAnalyzer
+	if !resumed {
+		ans = degradedAnalyzers(analyzersToSCTPAnalyzers(rs.Analyzers(info)), degraded)
+	}
+	// Create entries for each analyzer
+	entries := make([]*sctpStreamEntry, 0, len(ans))
+	for _, a := range ans {
+		stats := f.AnalyzerStats.Get(a.Name())
+		entries = append(entries, &sctpStreamEntry{
+			Name: a.Name(),
+			Stream: a.NewSCTP(analyzer.SCTPInfo{
+				SrcIP:   info.SrcIP,
+				DstIP:   info.DstIP,
+				SrcPort: info.SrcPort,
+				DstPort: info.DstPort,
+			}, &analyzerLogger{
+				StreamID: id.Int64(),
+				Name:     a.Name(),
+				Logger:   f.Logger,
+				Ring:     f.Ring,
+				Stats:    stats,
+			}),
+			HasLimit: a.Limit() > 0,
+			Quota:    a.Limit(),
+			Run:      newAnalyzerRun(stats),
+		})
+	}
+	return &sctpStream{
+		streamBase:    newStreamBase[sctpVerdict](&f.streamFactoryConfig, info, rs, nil),
+		stateSync:     f.StateSync,
+		reversed:      reversed,
+		activeEntries: entries,
+		ports:         [2]uint16{uint16(sctp.SrcPort), uint16(sctp.DstPort)},
+		addrs:         [2][]net.IP{{ipSrc}, {ipDst}},
+	}
+}
+
+func (f *sctpStreamFactory) UpdateRuleset(r ruleset.Ruleset) error {
+	f.RulesetMutex.Lock()
+	defer f.RulesetMutex.Unlock()
+	f.Ruleset = r
+	return nil
+}
+
+// sctpKey identifies the packets of an association sent to one of its endpoints:
+// they carry the verification tag chosen by that endpoint, whatever the addresses of the path.
+// A zero Tag is for the packets to an endpoint whose tag isn't known yet.
+type sctpKey struct {
+	SrcPort, DstPort uint16
+	Tag              uint32
+}
+
+type sctpKeyValue struct {
+	Stream *sctpStream
+	Rev    bool // Whether the packets are sent to the client
+}
+
+// sctpStreamManager tracks associations by their verification tags rather than by their addresses,
+// so that the packets of all the paths of a multi-homed association are handled as one stream.
+// The engine dispatches them to the same worker by their ports.
+type sctpStreamManager struct {
+	factory *sctpStreamFactory
+	streams *lru.Cache[int64, *sctpStream] // By stream ID
+	keys    map[sctpKey]sctpKeyValue
+}
+
+func newSCTPStreamManager(factory *sctpStreamFactory, maxStreams int) (*sctpStreamManager, error) {
+	m := &sctpStreamManager{
+		factory: factory,
+		keys:    make(map[sctpKey]sctpKeyValue),
+	}
+	ss, err := lru.NewWithEvict[int64, *sctpStream](maxStreams, func(_ int64, s *sctpStream) {
+		m.unregister(s)
+		s.Close(StreamEndEvicted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.streams = ss
+	return m, nil
+}
+
+func (m *sctpStreamManager) register(s *sctpStream, key sctpKey, rev bool) {
+	m.keys[key] = sctpKeyValue{Stream: s, Rev: rev}
+	s.keys = append(s.keys, key)
+}
+
+func (m *sctpStreamManager) unregister(s *sctpStream) {
+	for _, key := range s.keys {
+		if v, ok := m.keys[key]; ok && v.Stream == s {
+			delete(m.keys, key)
+		}
+	}
+	s.keys = nil
+}
+
+// lookup returns the association of a packet, and whether it's sent to the client.
+func (m *sctpStreamManager) lookup(srcPort, dstPort uint16, tag uint32) (*sctpStream, bool) {
+	key := sctpKey{SrcPort: srcPort, DstPort: dstPort, Tag: tag}
+	if v, ok := m.keys[key]; ok {
+		m.streams.Get(v.Stream.info.ID) // Most recently used
+		return v.Stream, v.Rev
+	}
+	// An association whose first packet we saw wasn't an INIT, and whose other side is now sending
+	wildcard := sctpKey{SrcPort: srcPort, DstPort: dstPort}
+	v, ok := m.keys[wildcard]
+	if !ok || tag == 0 {
+		return nil, false
+	}
+	delete(m.keys, wildcard)
+	m.register(v.Stream, key, v.Rev)
+	if v.Rev {
+		v.Stream.tags[0] = tag
+	} else {
+		v.Stream.tags[1] = tag
+	}
+	m.streams.Get(v.Stream.info.ID)
+	return v.Stream, v.Rev
+}
+
+func (m *sctpStreamManager) MatchWithContext(ipFlow gopacket.Flow, sctp *layers.SCTP, sc *sctpContext) {
+	srcPort, dstPort := uint16(sctp.SrcPort), uint16(sctp.DstPort)
+	chunks := parseSCTPChunks(sctp.Payload)
+	var s *sctpStream
+	rev := false
+	if len(chunks) > 0 && chunks[0].Type == analyzer.SCTPChunkInit && sctp.VerificationTag == 0 {
+		// The client's INIT, which the packets to the client will carry the tag of, or its retransmission
+		tag := sctpInitTag(chunks[0])
+		if v, ok := m.keys[sctpKey{SrcPort: dstPort, DstPort: srcPort, Tag: tag}]; ok && !v.Stream.ended {
+			s = v.Stream
+		} else {
+			s = m.factory.New(ipFlow, sctp, sc)
+			s.tags[0] = tag
+			m.register(s, sctpKey{SrcPort: dstPort, DstPort: srcPort, Tag: tag}, true)
+			m.streams.Add(s.info.ID, s)
+		}
+	} else {
+		s, rev = m.lookup(srcPort, dstPort, sctp.VerificationTag)
+		if s == nil {
+			if len(chunks) == 0 || chunks[0].Type == analyzer.SCTPChunkAbort || chunks[0].Type == analyzer.SCTPChunkShutdownComplete {
+				// Nothing to track
+				sc.Verdict = sctpVerdictAccept
+				return
+			}
+			// An association already established, the sender being its client as far as we know
+			s = m.factory.New(ipFlow, sctp, sc)
+			s.tags[1] = sctp.VerificationTag
+			m.register(s, sctpKey{SrcPort: srcPort, DstPort: dstPort, Tag: sctp.VerificationTag}, false)
+			m.register(s, sctpKey{SrcPort: dstPort, DstPort: srcPort}, true)
+			m.streams.Add(s.info.ID, s)
+		}
+	}
+	m.learn(s, rev, net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw()), chunks)
+	if s.Accept(rev, sc) {
+		s.Feed(rev, chunks, sc)
+	}
+	if s.closing {
+		m.unregister(s)
+		s.Close(StreamEndClosed)
+		m.streams.Remove(s.info.ID)
+	}
+}
+
+// learn records the addresses & verification tags of the endpoints of an association from one of its packets.
+func (m *sctpStreamManager) learn(s *sctpStream, rev bool, src, dst net.IP, chunks []sctpChunk) {
+	from, to := 0, 1
+	if rev {
+		from, to = 1, 0
+	}
+	s.addAddr(from, src)
+	s.addAddr(to, dst)
+	for _, c := range chunks {
+		switch c.Type {
+		case analyzer.SCTPChunkInit, analyzer.SCTPChunkInitAck:
+			if (c.Type == analyzer.SCTPChunkInit) == rev {
+				// Not the way we expect it
+				continue
+			}
+			for _, addr := range sctpInitAddrs(c) {
+				s.addAddr(from, addr)
+			}
+			if c.Type == analyzer.SCTPChunkInitAck && s.tags[1] == 0 {
+				if tag := sctpInitTag(c); tag != 0 {
+					s.tags[1] = tag
+					m.register(s, sctpKey{SrcPort: s.ports[0], DstPort: s.ports[1], Tag: tag}, false)
+				}
+			}
+		case analyzer.SCTPChunkAbort, analyzer.SCTPChunkShutdownComplete:
+			s.closing = true
+		}
+	}
+}
+
+// CloseIdle ends the streams whose latest packet is older than cutoff.
+func (m *sctpStreamManager) CloseIdle(cutoff time.Time) {
+	for _, k := range m.streams.Keys() {
+		s, ok := m.streams.Peek(k)
+		if ok && s.lastSeen.Before(cutoff) {
+			m.unregister(s)
+			s.Close(StreamEndIdle)
+			m.streams.Remove(k)
+		}
+	}
+}
+
+// sctpReassembly reassembles the user messages sent one way from their DATA chunks.
+// The fragments of a message have consecutive TSNs, so only one message is in progress at a time.
+type sctpReassembly struct {
+	started bool
+	next    uint32 // Expected TSN
+	active  bool   // Whether a message is in progress
+	msg     analyzer.SCTPChunk
+}
+
+// add handles a DATA chunk, and returns the message it completes, if any.
+func (r *sctpReassembly) add(c sctpChunk) (analyzer.SCTPChunk, bool) {
+	if len(c.Value) < 12 {
+		return analyzer.SCTPChunk{}, false
+	}
+	tsn := binary.BigEndian.Uint32(c.Value[0:4])
+	if r.started && int32(tsn-r.next) < 0 {
+		// Retransmitted
+		return analyzer.SCTPChunk{}, false
+	}
+	if r.started && tsn != r.next {
+		// Missing chunks, the message in progress can't be completed
+		r.active = false
+	}
+	r.started, r.next = true, tsn+1
+	data := c.Value[12:]
+	if c.Flags&sctpDataFlagBegin != 0 {
+		r.active = true
+		r.msg = analyzer.SCTPChunk{
+			Type:     analyzer.SCTPChunkData,
+			Flags:    c.Flags & sctpDataFlagUnordered,
+			StreamID: binary.BigEndian.Uint16(c.Value[4:6]),
+			PPID:     binary.BigEndian.Uint32(c.Value[8:12]),
+		}
+		if c.Flags&sctpDataFlagEnd != 0 {
+			// Not fragmented, no need to copy it
+			r.active = false
+			r.msg.Data = data
+			return r.msg, true
+		}
+		r.msg.Data = nil
+	}
+	if !r.active {
+		return analyzer.SCTPChunk{}, false
+	}
+	if room := sctpMaxMessageSize - len(r.msg.Data); room > 0 {
+		r.msg.Data = append(r.msg.Data, data[:min(room, len(data))]...)
+	}
+	if c.Flags&sctpDataFlagEnd == 0 {
+		return analyzer.SCTPChunk{}, false
+	}
+	r.active = false
+	return r.msg, true
+}
+
+type sctpStream struct {
+	streamBase[sctpVerdict]
+	stateSync     StateSync
+	state         *StreamState // Passed to stateSync, nil if not (yet) or not classified
+	stateDone     bool         // Whether the properties are final & have been passed to stateSync if classified
+	reversed      bool         // Whether the stream was resumed from the other instance the other way round
+	activeEntries []*sctpStreamEntry
+	doneEntries   []*sctpStreamEntry
+	delayer       modifier.DelayerInstance // non-nil once a delay modifier has matched
+	closing       bool                     // Whether the association has been shut down or aborted
+	ended         bool                     // Whether StreamEnd has been logged
+
+	ports      [2]uint16   // Of the client & server
+	tags       [2]uint32   // Verification tags of the client & server, 0 if not known (yet)
+	addrs      [2][]net.IP // Of the client & server, from the packets and their INIT & INIT ACK
+	keys       []sctpKey   // Registered in the manager
+	reassembly [2]sctpReassembly
+}
+
+type sctpStreamEntry struct {
+	Name     string
+	Stream   analyzer.SCTPStream
+	HasLimit bool
+	Quota    int
+	Run      analyzerRun
+}
+
+func (s *sctpStream) addAddr(side int, ip net.IP) {
+	if len(s.addrs[side]) >= sctpMaxAddrs {
+		return
+	}
+	for _, a := range s.addrs[side] {
+		if a.Equal(ip) {
+			return
+		}
+	}
+	s.addrs[side] = append(s.addrs[side], ip)
+}
+
+func (s *sctpStream) Accept(rev bool, sc *sctpContext) bool {
+	rev = rev != s.reversed
+	sc.Trace.stream(s.info, s.traced)
+	s.countPacket(rev, sc.Length, sc.Timestamp)
+	addIPv6Ext(&s.info, sc.IPv6Ext)
+	if err := s.capture.Packet(sc.CaptureInfo, sc.Data); err != nil {
+		s.logger.CaptureError(s.info, err)
+	}
+	if s.delayer != nil {
+		sc.Delay = s.delayer.PacketDelay()
+	}
+	if len(s.activeEntries) > 0 || s.virgin {
+		// Make sure every stream matches against the ruleset at least once,
+		// even if there are no activeEntries, as the ruleset may have built-in
+		// properties that need to be matched.
+		return true
+	}
+	s.checkQuota()
+	if s.limiter != nil {
+		sc.Verdict = s.limitVerdict(sc.Length)
+	} else {
+		sc.Verdict = s.lastVerdict
+		sc.Mark = s.lastMark
+	}
+	return false
+}
+
+func (s *sctpStream) Feed(rev bool, chunks []sctpChunk, sc *sctpContext) {
+	dir := 0
+	if rev {
+		dir = 1
+	}
+	rev = rev != s.reversed
+	var fed []analyzer.SCTPChunk
+	for _, c := range chunks {
+		if c.Type != analyzer.SCTPChunkData {
+			fed = append(fed, analyzer.SCTPChunk{Type: c.Type, Flags: c.Flags, Data: c.Value})
+		} else if msg, ok := s.reassembly[dir].add(c); ok {
+			fed = append(fed, msg)
+		}
+	}
+	updated := false
+	for i := len(s.activeEntries) - 1; i >= 0; i-- {
+		// Important: reverse order so we can remove entries
+		entry := s.activeEntries[i]
+		sc.Trace.analyzed()
+		stageStart := sc.Trace.begin()
+		var up, done bool
+		for _, c := range fed {
+			update, closeUpdate, d := s.feedEntry(entry, rev, c)
+			up1 := processPropUpdate(s.info.Props, entry.Name, update)
+			up2 := processPropUpdate(s.info.Props, entry.Name, closeUpdate)
+			up = up || up1 || up2
+			if d {
+				done = true
+				break
+			}
+		}
+		sc.Trace.end(TraceStageAnalyzer, entry.Name, stageStart)
+		updated = updated || up
+		entry.Run.Updated(up)
+		if done {
+			entry.Run.Done()
+			s.activeEntries = append(s.activeEntries[:i], s.activeEntries[i+1:]...)
+			s.doneEntries = append(s.doneEntries, entry)
+		}
+	}
+	if updated || s.virgin {
+		s.virgin = false
+		s.logger.SCTPStreamPropUpdate(s.info, false)
+		// Match properties against ruleset
+		stageStart := sc.Trace.begin()
+		result := s.ruleset.Match(s.info)
+		sc.Trace.end(TraceStageRuleset, result.RuleName, stageStart)
+		action := result.Action
+		if action == ruleset.ActionModify {
+			if di, isDelayer := result.ModInstance.(modifier.DelayerInstance); isDelayer {
+				s.delayer = di
+				sc.Delay = di.PacketDelay()
+			} else {
+				// Only delay modifiers apply to SCTP, fallback to maybe
+				s.logger.ModifyError(s.info, errInvalidModifier)
+				action = ruleset.ActionMaybe
+			}
+		}
+		if action != ruleset.ActionMaybe {
+			verdict, final := actionToSCTPVerdict(action)
+			s.setVerdict(result, action, verdict)
+			sc.Verdict = verdict
+			sc.Mark = s.lastMark
+			if action == ruleset.ActionRateLimit {
+				s.limiter = result.RateLimiter
+				sc.Verdict = s.limitVerdict(sc.Length)
+			}
+			if action == ruleset.ActionQuota {
+				s.setQuota(result.Quota)
+				if s.limiter != nil {
+					sc.Verdict = s.limitVerdict(sc.Length)
+				} else {
+					sc.Verdict = s.lastVerdict
+				}
+			}
+			if action == ruleset.ActionCapture || action == ruleset.ActionMirror {
+				if err := s.capture.Start(action); err != nil {
+					s.logger.CaptureError(s.info, err)
+				}
+			}
+			if final {
+				s.closeActiveEntries()
+			}
+		}
+	}
+	if len(s.activeEntries) == 0 && sc.Verdict == sctpVerdictAccept && s.limiter == nil && s.quota == nil && s.delayer == nil && !s.capture.Active() {
+		// All entries are done but no verdict issued, apply the default verdict
+		s.setDefaultVerdict()
+		sc.Verdict = s.lastVerdict
+		sc.Mark = s.lastMark
+	}
+	if s.stateSync != nil && !s.stateDone && len(s.activeEntries) == 0 {
+		s.stateDone = true
+		if s.state = newStreamState(s.info); s.state != nil {
+			s.stateSync.Classified(s.state)
+		}
+	}
+}
+
+// Close ends the stream. It does nothing if the stream has already ended.
+func (s *sctpStream) Close(reason StreamEndReason) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.closeActiveEntries()
+	s.account.Flush(s.info)
+	s.counters.sctpEnded.Add(1)
+	if s.state != nil {
+		s.stateSync.Ended(s.state)
+	}
+	s.logger.StreamEnd(StreamEnd{
+		WorkerID: s.workerID,
+		Info:     s.info,
+		Reason:   reason,
+		LastSeen: s.lastSeen,
+		Verdict:  io.Verdict(s.lastVerdict),
+		Actions:  s.actions,
+	})
+}
+
+func (s *sctpStream) closeActiveEntries() {
+	// Signal close to all active entries & move them to doneEntries
+	updated := false
+	for _, entry := range s.activeEntries {
+		start := time.Now()
+		update := entry.Stream.Close(false)
+		entry.Run.Fed(start, 0)
+		up := processPropUpdate(s.info.Props, entry.Name, update)
+		updated = updated || up
+		entry.Run.Updated(up)
+		entry.Run.Done()
+	}
+	if updated {
+		s.logger.SCTPStreamPropUpdate(s.info, true)
+	}
+	s.doneEntries = append(s.doneEntries, s.activeEntries...)
+	s.activeEntries = nil
+}
+
+func (s *sctpStream) feedEntry(entry *sctpStreamEntry, rev bool, chunk analyzer.SCTPChunk) (update *analyzer.PropUpdate, closeUpdate *analyzer.PropUpdate, done bool) {
+	start := time.Now()
+	update, done = entry.Stream.Feed(rev, chunk)
+	if entry.HasLimit {
+		entry.Quota -= len(chunk.Data)
+		if entry.Quota <= 0 {
+			// Quota exhausted, signal close & move to doneEntries
+			closeUpdate = entry.Stream.Close(true)
+			done = true
+		}
+	}
+	entry.Run.Fed(start, len(chunk.Data))
+	return
+}
+
+func analyzersToSCTPAnalyzers(ans []analyzer.Analyzer) []analyzer.SCTPAnalyzer {
+	sctpAns := make([]analyzer.SCTPAnalyzer, 0, len(ans))
+	for _, a := range ans {
+		if sctpM, ok := a.(analyzer.SCTPAnalyzer); ok {
+			sctpAns = append(sctpAns, sctpM)
+		}
+	}
+	return sctpAns
+}
+
+func actionToSCTPVerdict(a ruleset.Action) (v sctpVerdict, final bool) {
+	switch a {
+	case ruleset.ActionMaybe:
+		return sctpVerdictAccept, false
+	case ruleset.ActionAllow, ruleset.ActionShape, ruleset.ActionMark:
+		return sctpVerdictAcceptStream, true
+	case ruleset.ActionBlock:
+		return sctpVerdictDropStream, true
+	case ruleset.ActionDrop:
+		return sctpVerdictDrop, false
+	case ruleset.ActionModify:
+		// Only delay modifiers, which hold the packets unchanged
+		return sctpVerdictAccept, false
+	case ruleset.ActionTarpit, ruleset.ActionDivert, ruleset.ActionHoneypot, ruleset.ActionCaptureHTTP:
+		// Not supported for SCTP
+		return sctpVerdictAccept, false
+	case ruleset.ActionRateLimit, ruleset.ActionQuota:
+		// The actual verdict of each packet is decided by the rate limiter or quota
+		return sctpVerdictAccept, true
+	case ruleset.ActionCapture, ruleset.ActionMirror:
+		// Each packet must still go through the engine to be copied
+		return sctpVerdictAccept, true
+	default:
+		// Should never happen
+		return sctpVerdictAccept, false
+	}
+}
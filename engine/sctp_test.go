@@ -0,0 +1,314 @@
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// sctpTestChunk returns a chunk with its header, padded to 4 bytes.
+func sctpTestChunk(typ, flags uint8, value []byte) []byte {
+	b := make([]byte, 4, 4+len(value)+3)
+	b[0], b[1] = typ, flags
+	binary.BigEndian.PutUint16(b[2:4], uint16(4+len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// sctpTestInit returns the value of an INIT or INIT ACK chunk with the initiate tag & addresses.
+func sctpTestInit(tag uint32, addrs ...net.IP) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint32(b[0:4], tag)
+	for _, addr := range addrs {
+		if ip4 := addr.To4(); ip4 != nil {
+			b = append(b, 0, sctpParamIPv4, 0, 8)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, 0, sctpParamIPv6, 0, 20)
+			b = append(b, addr.To16()...)
+		}
+	}
+	return b
+}
+
+// sctpTestData returns the value of a DATA chunk.
+func sctpTestData(tsn uint32, streamID uint16, ppid uint32, data string) []byte {
+	b := make([]byte, 12, 12+len(data))
+	binary.BigEndian.PutUint32(b[0:4], tsn)
+	binary.BigEndian.PutUint16(b[4:6], streamID)
+	binary.BigEndian.PutUint32(b[8:12], ppid)
+	return append(b, data...)
+}
+
+func TestParseSCTPChunks(t *testing.T) {
+	data := sctpTestChunk(analyzer.SCTPChunkData, 0x03, []byte("abcde")) // Padded
+	sack := sctpTestChunk(3, 0, make([]byte, 12))
+	testCases := []struct {
+		name    string
+		payload []byte
+		want    []sctpChunk
+	}{
+		{"empty", nil, nil},
+		{"one", sack, []sctpChunk{{Type: 3, Value: make([]byte, 12)}}},
+		{"padded", append(append([]byte(nil), data...), sack...), []sctpChunk{
+			{Type: analyzer.SCTPChunkData, Flags: 0x03, Value: []byte("abcde")},
+			{Type: 3, Value: make([]byte, 12)},
+		}},
+		{"padding missing at the end", data[:9], []sctpChunk{{Type: analyzer.SCTPChunkData, Flags: 0x03, Value: []byte("abcde")}}},
+		{"truncated", sack[:8], nil},
+		{"length too short", []byte{3, 0, 0, 2, 0, 0, 0, 0}, nil},
+		{"invalid after valid", append(append([]byte(nil), sack...), 3, 0, 0xff, 0xff), []sctpChunk{{Type: 3, Value: make([]byte, 12)}}},
+		{"short header", []byte{3, 0, 0}, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseSCTPChunks(tc.payload); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseSCTPChunks() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSCTPInit(t *testing.T) {
+	v4, v6 := net.IPv4(192, 0, 2, 1).To4(), net.ParseIP("2001:db8::1")
+	bad := sctpTestInit(0x1234)
+	bad = append(bad, 0, sctpParamIPv4, 0, 8, 1, 2) // Truncated
+	testCases := []struct {
+		name      string
+		value     []byte
+		wantTag   uint32
+		wantAddrs []net.IP
+	}{
+		{"no addresses", sctpTestInit(0x1234), 0x1234, nil},
+		{"addresses", sctpTestInit(0x1234, v4, v6), 0x1234, []net.IP{v4, v6}},
+		{"truncated parameter", bad, 0x1234, nil},
+		{"unknown parameter", append(sctpTestInit(0x1234), 0, 9, 0, 8, 0, 0, 0, 0), 0x1234, nil},
+		{"too short", make([]byte, 15), 0, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := sctpChunk{Type: analyzer.SCTPChunkInit, Value: tc.value}
+			if tag := sctpInitTag(c); tag != tc.wantTag {
+				t.Errorf("sctpInitTag() = %#x, want %#x", tag, tc.wantTag)
+			}
+			if addrs := sctpInitAddrs(c); !reflect.DeepEqual(addrs, tc.wantAddrs) {
+				t.Errorf("sctpInitAddrs() = %v, want %v", addrs, tc.wantAddrs)
+			}
+		})
+	}
+}
+
+func TestSCTPReassembly(t *testing.T) {
+	const (
+		begin = sctpDataFlagBegin
+		end   = sctpDataFlagEnd
+	)
+	type chunk struct {
+		tsn   uint32
+		flags uint8
+		data  string
+	}
+	testCases := []struct {
+		name   string
+		chunks []chunk
+		want   []string
+	}{
+		{"unfragmented", []chunk{{1, begin | end, "a"}, {2, begin | end, "b"}}, []string{"a", "b"}},
+		{"fragmented", []chunk{{1, begin, "a"}, {2, 0, "b"}, {3, end, "c"}}, []string{"abc"}},
+		{"retransmitted", []chunk{{1, begin, "a"}, {1, begin, "a"}, {2, end, "b"}, {2, end, "b"}}, []string{"ab"}},
+		{"missing fragment", []chunk{{1, begin, "a"}, {3, end, "c"}, {4, begin | end, "d"}}, []string{"d"}},
+		{"no beginning", []chunk{{5, 0, "b"}, {6, end, "c"}, {7, begin | end, "d"}}, []string{"d"}},
+		{"tsn wraparound", []chunk{{0xffffffff, begin, "a"}, {0, end, "b"}}, []string{"ab"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r sctpReassembly
+			var got []string
+			for _, c := range tc.chunks {
+				msg, ok := r.add(sctpChunk{Type: analyzer.SCTPChunkData, Flags: c.flags, Value: sctpTestData(c.tsn, 1, 46, c.data)})
+				if ok {
+					if msg.StreamID != 1 || msg.PPID != 46 {
+						t.Errorf("message stream %d PPID %d, want 1 & 46", msg.StreamID, msg.PPID)
+					}
+					got = append(got, string(msg.Data))
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("messages = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSCTPReassembly_MaxSize(t *testing.T) {
+	var r sctpReassembly
+	big := string(make([]byte, sctpMaxMessageSize-10))
+	r.add(sctpChunk{Flags: sctpDataFlagBegin, Value: sctpTestData(1, 0, 0, big)})
+	msg, ok := r.add(sctpChunk{Flags: sctpDataFlagEnd, Value: sctpTestData(2, 0, 0, "0123456789abcdef")})
+	if !ok || len(msg.Data) != sctpMaxMessageSize || string(msg.Data[len(big):]) != "0123456789" {
+		t.Errorf("message of %d bytes (%v), want truncated to %d", len(msg.Data), ok, sctpMaxMessageSize)
+	}
+}
+
+func TestSCTPStreamManager(t *testing.T) {
+	client, server, server2 := net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4(), net.IPv4(10, 0, 1, 2).To4()
+	const (
+		clientPort = 5000
+		serverPort = 38412
+	)
+	type packet struct {
+		fromServer bool
+		dst        net.IP // Of the packets from the client, server by default
+		tag        uint32 // Verification tag
+		chunks     [][]byte
+	}
+	testCases := []struct {
+		name        string
+		packets     []packet
+		wantStreams int // Created
+		wantOpen    int
+		wantTags    [2]uint32 // Of the open stream
+		wantAddrs   [2][]net.IP
+	}{
+		{
+			name: "handshake & multi-homing",
+			packets: []packet{
+				{tag: 0, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInit, 0, sctpTestInit(0x1111))}},
+				{tag: 0, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInit, 0, sctpTestInit(0x1111))}}, // Retransmitted
+				{fromServer: true, tag: 0x1111, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInitAck, 0, sctpTestInit(0x2222, server2))}},
+				{tag: 0x2222, dst: server2, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkData, 0x03, sctpTestData(1, 0, 0, "hi"))}},
+				{fromServer: true, tag: 0x1111, chunks: [][]byte{sctpTestChunk(3, 0, make([]byte, 12))}},
+			},
+			wantStreams: 1,
+			wantOpen:    1,
+			wantTags:    [2]uint32{0x1111, 0x2222},
+			wantAddrs:   [2][]net.IP{{client}, {server, server2}},
+		},
+		{
+			name: "established",
+			packets: []packet{
+				{tag: 0x3333, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkData, 0x03, sctpTestData(1, 0, 0, "hi"))}},
+				{fromServer: true, tag: 0x4444, chunks: [][]byte{sctpTestChunk(3, 0, make([]byte, 12))}},
+				{tag: 0x3333, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkData, 0x03, sctpTestData(2, 0, 0, "hi"))}},
+			},
+			wantStreams: 1,
+			wantOpen:    1,
+			wantTags:    [2]uint32{0x4444, 0x3333},
+			wantAddrs:   [2][]net.IP{{client}, {server}},
+		},
+		{
+			name: "other tag",
+			packets: []packet{
+				{tag: 0, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInit, 0, sctpTestInit(0x1111))}},
+				{fromServer: true, tag: 0x1111, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInitAck, 0, sctpTestInit(0x2222))}},
+				{tag: 0x9999, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkData, 0x03, sctpTestData(1, 0, 0, "hi"))}},
+			},
+			wantStreams: 2,
+			wantOpen:    2,
+		},
+		{
+			name: "aborted",
+			packets: []packet{
+				{tag: 0, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInit, 0, sctpTestInit(0x1111))}},
+				{fromServer: true, tag: 0x1111, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkAbort, 0, nil)}},
+				{fromServer: true, tag: 0x1111, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkAbort, 0, nil)}},
+			},
+			wantStreams: 1,
+		},
+		{
+			name: "shut down",
+			packets: []packet{
+				{tag: 0, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInit, 0, sctpTestInit(0x1111))}},
+				{fromServer: true, tag: 0x1111, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkInitAck, 0, sctpTestInit(0x2222))}},
+				{tag: 0x2222, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkShutdownComplete, 0, nil)}},
+			},
+			wantStreams: 1,
+		},
+		{
+			name: "nothing to track",
+			packets: []packet{
+				{tag: 0x1111, chunks: [][]byte{sctpTestChunk(analyzer.SCTPChunkAbort, 0, nil)}},
+				{tag: 0x1111},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &testLogger{}
+			factory := &sctpStreamFactory{
+				streamFactoryConfig: newTestStreamFactoryConfig(t, logger),
+				Ruleset:             &testRuleset{},
+			}
+			m, err := newSCTPStreamManager(factory, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range tc.packets {
+				src, dst := client, server
+				srcPort, dstPort := clientPort, serverPort
+				if p.dst != nil {
+					dst = p.dst
+				}
+				if p.fromServer {
+					src, dst, srcPort, dstPort = server, client, serverPort, clientPort
+				}
+				var payload []byte
+				for _, c := range p.chunks {
+					payload = append(payload, c...)
+				}
+				sctp := &layers.SCTP{
+					BaseLayer:       layers.BaseLayer{Payload: payload},
+					SrcPort:         layers.SCTPPort(srcPort),
+					DstPort:         layers.SCTPPort(dstPort),
+					VerificationTag: p.tag,
+				}
+				sc := &sctpContext{PacketMetadata: &gopacket.PacketMetadata{CaptureInfo: gopacket.CaptureInfo{
+					Timestamp: time.Unix(1700000000+int64(i), 0),
+					Length:    12 + len(payload),
+				}}}
+				m.MatchWithContext(gopacket.NewFlow(layers.EndpointIPv4, src, dst), sctp, sc)
+			}
+			if logger.streams != tc.wantStreams {
+				t.Errorf("streams = %d, want %d", logger.streams, tc.wantStreams)
+			}
+			if n := m.streams.Len(); n != tc.wantOpen {
+				t.Fatalf("open streams = %d, want %d", n, tc.wantOpen)
+			}
+			if tc.wantOpen == 0 {
+				if len(m.keys) != 0 {
+					t.Errorf("keys = %v, want none", m.keys)
+				}
+				for _, end := range logger.ends {
+					if end.Reason != StreamEndClosed {
+						t.Errorf("end reason = %v, want %v", end.Reason, StreamEndClosed)
+					}
+				}
+				return
+			}
+			if tc.wantOpen != 1 {
+				return
+			}
+			s := m.streams.Values()[0]
+			if s.tags != tc.wantTags {
+				t.Errorf("tags = %#x, want %#x", s.tags, tc.wantTags)
+			}
+			if !reflect.DeepEqual(s.addrs, tc.wantAddrs) {
+				t.Errorf("addrs = %v, want %v", s.addrs, tc.wantAddrs)
+			}
+			if s.info.Protocol != ruleset.ProtocolSCTP || !s.info.SrcIP.Equal(client) || s.info.DstPort != serverPort {
+				t.Errorf("info = %v %v:%d, want the client to the server", s.info.Protocol, s.info.SrcIP, s.info.DstPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"net"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+// StreamState is the classification of a stream, shared with the other instance of an HA pair
+// (see StateSync), so that the stream isn't classified again when it fails over to it:
+// a stream joined midway can't be, its analyzers would have missed its start.
+type StreamState struct {
+	Protocol  ruleset.Protocol
+	SrcIP     net.IP
+	DstIP     net.IP
+	SrcPort   uint16
+	DstPort   uint16
+	StartTime time.Time
+	Props     analyzer.CombinedPropMap // Final, never modified
+}
+
+// StateSync shares the classification of streams between the instances of an HA pair.
+// Its methods are called by the workers in the packet path, so they must not block,
+// and be safe for concurrent use.
+type StateSync interface {
+	// Classified is called once the properties of a stream are final (all its analyzers are done,
+	// or a rule has issued a verdict), if any analyzer found properties for it.
+	Classified(*StreamState)
+	// Ended is called when a stream passed to Classified ends.
+	Ended(*StreamState)
+	// Lookup returns the state of a new stream classified by the other instance, nil if there's none.
+	Lookup(proto ruleset.Protocol, srcIP, dstIP net.IP, srcPort, dstPort uint16) *StreamState
+}
+
+// resumeStream looks up a new stream classified by the other instance, in both directions as the first
+// packet seen of a stream that failed over may be from the server. If found, the stream takes its properties,
+// start time & direction, and its analyzers are skipped: the ruleset matches it as it would have.
+func resumeStream(ss StateSync, info *ruleset.StreamInfo) (resumed, reversed bool) {
+	if ss == nil {
+		return false, false
+	}
+	st := ss.Lookup(info.Protocol, info.SrcIP, info.DstIP, info.SrcPort, info.DstPort)
+	if st == nil {
+		st = ss.Lookup(info.Protocol, info.DstIP, info.SrcIP, info.DstPort, info.SrcPort)
+		if st == nil {
+			return false, false
+		}
+		reversed = true
+		info.SrcIP, info.DstIP = info.DstIP, info.SrcIP
+		info.SrcPort, info.DstPort = info.DstPort, info.SrcPort
+	}
+	for name, props := range st.Props {
+		info.Props[name] = props
+	}
+	info.Counters.StartTime = st.StartTime
+	return true, reversed
+}
+
+// newStreamState returns the state of a stream to pass to StateSync.Classified,
+// nil if it wasn't classified.
+func newStreamState(info ruleset.StreamInfo) *StreamState {
+	if !isClassified(info.Props) {
+		return nil
+	}
+	return &StreamState{
+		Protocol:  info.Protocol,
+		SrcIP:     info.SrcIP,
+		DstIP:     info.DstIP,
+		SrcPort:   info.SrcPort,
+		DstPort:   info.DstPort,
+		StartTime: info.Counters.StartTime,
+		Props:     info.Props,
+	}
+}
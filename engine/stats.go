@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/io"
+)
+
+// verdictCount is the number of io.Verdict values.
+const verdictCount = int(io.VerdictHoneypotStream) + 1
+
+// Stats are the statistics of the engine, summed over all workers.
+type Stats struct {
+	Workers           int
+	Packets           uint64                // Packets whose verdict has been submitted
+	Verdicts          map[io.Verdict]uint64 // Packets by verdict
+	TCPStreams        uint64                // TCP streams created
+	UDPStreams        uint64                // UDP streams created
+	ActiveTCPStreams  uint64                // TCP streams being tracked
+	ActiveUDPStreams  uint64                // UDP streams being tracked
+	SCTPStreams       uint64                // SCTP associations created
+	ActiveSCTPStreams uint64                // SCTP associations being tracked
+	ICMPStreams       uint64                // ICMP streams created
+	ActiveICMPStreams uint64                // ICMP streams being tracked
+	Anomalies         uint64                // Packets breaking a policy on malformed or evasive packets, dropped or not
+	QueueLength       uint64                // Packets waiting in the worker queues
+	QueueCapacity     uint64                // Size of the worker queues
+	QueueFull         uint64                // Packets that had to wait for room in a full worker queue
+	HeldPackets       uint64                // Packets held back by tarpits & delay modifiers
+	HeldOverflow      uint64                // Packets not held back as over a cap
+	// Latency is the total time from the dispatch of packets to a worker to their verdict being decided,
+	// so that the average latency between two calls is the difference of Latency over that of Packets.
+	Latency time.Duration
+}
+
+// workerCounters are the statistics of a worker.
+// Only updated by the worker's goroutine (and its delayed verdicts), but read from others.
+type workerCounters struct {
+	verdicts    [verdictCount]atomic.Uint64
+	tcpStreams  atomic.Uint64
+	udpStreams  atomic.Uint64
+	tcpEnded    atomic.Uint64
+	udpEnded    atomic.Uint64
+	sctpStreams atomic.Uint64
+	sctpEnded   atomic.Uint64
+	icmpStreams atomic.Uint64
+	icmpEnded   atomic.Uint64
+	anomalies   atomic.Uint64
+	queueFull   atomic.Uint64 // Updated by the dispatching goroutines
+	latency     atomic.Int64  // Nanoseconds
+}
+
+// Verdict records the verdict of a packet.
+func (c *workerCounters) Verdict(v io.Verdict) {
+	if v >= 0 && int(v) < verdictCount {
+		c.verdicts[v].Add(1)
+	}
+}
+
+// Stats returns the statistics of the engine.
+func (e *engine) Stats() Stats {
+	st := Stats{
+		Workers:      len(e.workers),
+		Verdicts:     make(map[io.Verdict]uint64, verdictCount),
+		HeldPackets:  uint64(e.held.Len()),
+		HeldOverflow: e.held.overflow.Load(),
+	}
+	for _, w := range e.workers {
+		c := w.counters
+		for v := range c.verdicts {
+			n := c.verdicts[v].Load()
+			st.Verdicts[io.Verdict(v)] += n
+			st.Packets += n
+		}
+		// Ended before created, so that a stream ending in between isn't counted as -1 active
+		tcpEnded, udpEnded := c.tcpEnded.Load(), c.udpEnded.Load()
+		tcpStreams, udpStreams := c.tcpStreams.Load(), c.udpStreams.Load()
+		st.TCPStreams += tcpStreams
+		st.UDPStreams += udpStreams
+		st.ActiveTCPStreams += tcpStreams - tcpEnded
+		st.ActiveUDPStreams += udpStreams - udpEnded
+		sctpEnded := c.sctpEnded.Load()
+		sctpStreams := c.sctpStreams.Load()
+		st.SCTPStreams += sctpStreams
+		st.ActiveSCTPStreams += sctpStreams - sctpEnded
+		icmpEnded := c.icmpEnded.Load()
+		icmpStreams := c.icmpStreams.Load()
+		st.ICMPStreams += icmpStreams
+		st.ActiveICMPStreams += icmpStreams - icmpEnded
+		st.Anomalies += c.anomalies.Load()
+		st.QueueLength += uint64(len(w.packetChan))
+		st.QueueCapacity += uint64(cap(w.packetChan))
+		st.QueueFull += c.queueFull.Load()
+		st.Latency += time.Duration(c.latency.Load())
+	}
+	return st
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// streamFactoryConfig is what the stream factories of all protocols are created with.
+type streamFactoryConfig struct {
+	WorkerID            int
+	Logger              Logger
+	Node                *snowflake.Node
+	External            map[string]bool // External interfaces, for the direction of streams
+	UnmatchedVerdict    DefaultVerdict
+	UnclassifiedVerdict DefaultVerdict
+	Capturer            PacketSink
+	Mirror              PacketSink
+	CaptureLookback     int
+	Tracer              Tracer
+	Ring                *packetRing
+	AnalyzerStats       *analyzerStatsSet
+	Counters            *workerCounters
+	Degraded            *atomic.Pointer[Degradation]
+	StateSync           StateSync // Not used for ICMP
+	Accounting          Accounting
+	QoS                 QoSMarker
+}
+
+// streamVerdict is the verdict type of the streams of a protocol.
+type streamVerdict interface {
+	tcpVerdict | udpVerdict | sctpVerdict | icmpVerdict
+}
+
+// streamBase is what the streams of all protocols have in common:
+// the verdict issued for them, by a rule or by default, and what the rule set up for their next packets.
+type streamBase[V streamVerdict] struct {
+	info         ruleset.StreamInfo
+	virgin       bool // true if no packets have been processed
+	traced       bool // Whether the analyzer & ruleset runs of its packets are timed
+	logger       Logger
+	ruleset      ruleset.Ruleset
+	unmatched    DefaultVerdict
+	unclassified DefaultVerdict
+	degraded     *atomic.Pointer[Degradation]
+	account      *streamAccount // nil if accounting is not enabled
+	qos          QoSMarker      // nil if not enabled
+	capture      *streamCapture
+	lastVerdict  V
+	lastMark     uint32
+	limiter      *ruleset.RateLimiter // non-nil once a ratelimit rule has matched
+	quota        *ruleset.Quota       // non-nil from when a quota rule has matched until the quota is exceeded
+	rule         string               // Name of the rule that issued the verdict
+	stats        *ruleset.RuleStats   // Statistics of the rule that issued the verdict
+	hitRules     []*ruleset.RuleStats // Statistics of the rules whose hit has been counted for the stream
+	counters     *workerCounters
+	workerID     int
+	lastSeen     time.Time      // Time of the latest packet
+	actions      []StreamAction // For StreamEnd
+}
+
+func newStreamBase[V streamVerdict](f *streamFactoryConfig, info ruleset.StreamInfo, rs ruleset.Ruleset, httpCapturer PacketSink) streamBase[V] {
+	return streamBase[V]{
+		info:         info,
+		virgin:       true,
+		traced:       f.Tracer != nil && f.Tracer.SampleStream(info),
+		logger:       f.Logger,
+		ruleset:      rs,
+		unmatched:    f.UnmatchedVerdict,
+		unclassified: f.UnclassifiedVerdict,
+		degraded:     f.Degraded,
+		account:      newStreamAccount(f.Accounting),
+		qos:          f.QoS,
+		capture:      newStreamCapture(f.Capturer, f.Mirror, httpCapturer, f.CaptureLookback, info.UUID),
+		counters:     f.Counters,
+		workerID:     f.WorkerID,
+	}
+}
+
+// countPacket counts a packet of the stream, in its counters and in those of the rule that issued its verdict.
+func (s *streamBase[V]) countPacket(rev bool, length int, t time.Time) {
+	s.info.Counters.Add(rev, length)
+	s.account.Add(s.info, length, t)
+	if s.quota != nil {
+		s.quota.Count(s.info, length, t)
+	}
+	s.lastSeen = t
+	if s.stats != nil {
+		s.stats.AddBytes(length)
+	}
+}
+
+// logAction logs an action issued for the stream, and keeps it for the stream's summary.
+func (s *streamBase[V]) logAction(action ruleset.Action, rule string, noMatch bool) {
+	s.actions = addStreamAction(s.actions, s.lastSeen, action, rule, noMatch)
+	switch s.info.Protocol {
+	case ruleset.ProtocolTCP:
+		s.logger.TCPStreamAction(s.info, action, rule, noMatch)
+	case ruleset.ProtocolUDP:
+		s.logger.UDPStreamAction(s.info, action, rule, noMatch)
+	case ruleset.ProtocolSCTP:
+		s.logger.SCTPStreamAction(s.info, action, rule, noMatch)
+	case ruleset.ProtocolICMP:
+		s.logger.ICMPStreamAction(s.info, action, rule, noMatch)
+	}
+}
+
+// setRule records the rule that issued the verdict, counts a hit of the rule unless it already
+// had one for the stream, and attributes the stream's bytes to it.
+func (s *streamBase[V]) setRule(result ruleset.MatchResult) {
+	s.rule = result.RuleName
+	if result.Stats != nil && !slices.Contains(s.hitRules, result.Stats) {
+		s.hitRules = append(s.hitRules, result.Stats)
+		result.Stats.Hit(s.lastSeen)
+	}
+	if result.Stats != nil && result.Stats != s.stats {
+		s.stats = result.Stats
+		s.stats.AddBytes(int(s.info.Counters.Bytes()))
+	}
+}
+
+// setVerdict records the verdict issued by the rule of a match result, with its mark (or QoS mark)
+// if the stream is accepted, and logs its action.
+func (s *streamBase[V]) setVerdict(result ruleset.MatchResult, action ruleset.Action, verdict V) {
+	s.setRule(result)
+	s.lastVerdict = verdict
+	s.lastMark = result.Mark
+	if io.Verdict(verdict) == io.VerdictAcceptStream {
+		s.lastMark = qosMark(s.qos, s.info, result.Mark)
+	}
+	s.logAction(action, s.rule, false)
+}
+
+// setQuota starts counting the stream against the quota of a rule.
+func (s *streamBase[V]) setQuota(quota *ruleset.Quota) {
+	s.quota = quota
+	// The bytes of the stream so far count too
+	s.quota.Count(s.info, int(s.info.Counters.Bytes()), s.lastSeen)
+	s.checkQuota()
+}
+
+// checkQuota switches the stream to the verdict for exceeded quotas once it has used up its quota,
+// as of its latest packet.
+func (s *streamBase[V]) checkQuota() {
+	if s.quota == nil || !s.quota.Exceeded(s.info, s.lastSeen) {
+		return
+	}
+	if s.quota.Limiter != nil {
+		s.limiter = s.quota.Limiter
+		s.logAction(ruleset.ActionRateLimit, s.rule, false)
+	} else {
+		s.lastVerdict = V(io.VerdictDropStream)
+		s.lastMark = 0
+		s.logAction(ruleset.ActionBlock, s.rule, false)
+	}
+	s.quota = nil
+}
+
+// limitVerdict returns the verdict of the rate limiter for a packet of the stream.
+func (s *streamBase[V]) limitVerdict(length int) V {
+	if s.limiter.Allow(s.info, length, s.lastSeen) {
+		return V(io.VerdictAccept)
+	}
+	return V(io.VerdictDrop)
+}
+
+// setDefaultVerdict issues the default verdict, for the streams whose analyzers are all done
+// without any rule issuing a verdict.
+func (s *streamBase[V]) setDefaultVerdict() {
+	classified := isClassified(s.info.Props)
+	dv := s.unmatched
+	if !classified {
+		dv = unclassifiedVerdict(s.unclassified, s.degraded.Load())
+	}
+	action := ruleset.ActionAllow
+	switch dv {
+	case DefaultVerdictAccept:
+		s.lastVerdict = V(io.VerdictAccept)
+	case DefaultVerdictDrop:
+		s.lastVerdict = V(io.VerdictDropStream)
+		action = ruleset.ActionBlock
+	default:
+		s.lastVerdict = V(io.VerdictAcceptStream)
+		s.lastMark = qosMark(s.qos, s.info, 0)
+	}
+	if dv == DefaultVerdictLog {
+		s.logger.StreamNoMatch(s.info, classified)
+	}
+	s.logAction(action, "", true)
+}
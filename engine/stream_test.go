@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// testLogger records the streams created & ended, the actions issued for them and the packet anomalies.
+// The methods the streams aren't expected to call panic.
+type testLogger struct {
+	Logger
+	streams   int
+	actions   []StreamAction
+	ends      []StreamEnd
+	anomalies []PacketAnomaly
+}
+
+func (l *testLogger) TCPStreamNew(int, ruleset.StreamInfo)          { l.streams++ }
+func (l *testLogger) UDPStreamNew(int, ruleset.StreamInfo)          { l.streams++ }
+func (l *testLogger) SCTPStreamNew(int, ruleset.StreamInfo)         { l.streams++ }
+func (l *testLogger) ICMPStreamNew(int, ruleset.StreamInfo)         { l.streams++ }
+func (l *testLogger) TCPStreamPropUpdate(ruleset.StreamInfo, bool)  {}
+func (l *testLogger) UDPStreamPropUpdate(ruleset.StreamInfo, bool)  {}
+func (l *testLogger) SCTPStreamPropUpdate(ruleset.StreamInfo, bool) {}
+func (l *testLogger) ICMPStreamPropUpdate(ruleset.StreamInfo, bool) {}
+func (l *testLogger) StreamNoMatch(ruleset.StreamInfo, bool)        {}
+func (l *testLogger) StreamEnd(end StreamEnd)                       { l.ends = append(l.ends, end) }
+func (l *testLogger) PacketAnomaly(a PacketAnomaly)                 { l.anomalies = append(l.anomalies, a) }
+func (l *testLogger) TCPStreamAction(_ ruleset.StreamInfo, a ruleset.Action, rule string, noMatch bool) {
+	l.action(a, rule, noMatch)
+}
+
+func (l *testLogger) UDPStreamAction(_ ruleset.StreamInfo, a ruleset.Action, rule string, noMatch bool) {
+	l.action(a, rule, noMatch)
+}
+
+func (l *testLogger) SCTPStreamAction(_ ruleset.StreamInfo, a ruleset.Action, rule string, noMatch bool) {
+	l.action(a, rule, noMatch)
+}
+
+func (l *testLogger) ICMPStreamAction(_ ruleset.StreamInfo, a ruleset.Action, rule string, noMatch bool) {
+	l.action(a, rule, noMatch)
+}
+
+func (l *testLogger) action(a ruleset.Action, rule string, noMatch bool) {
+	l.actions = append(l.actions, StreamAction{Action: a, Rule: rule, NoMatch: noMatch})
+}
+
+// testRuleset uses the same analyzers & match result for every stream.
+type testRuleset struct {
+	analyzers []analyzer.Analyzer
+	result    ruleset.MatchResult
+}
+
+func (r *testRuleset) Analyzers(ruleset.StreamInfo) []analyzer.Analyzer { return r.analyzers }
+func (r *testRuleset) Match(ruleset.StreamInfo) ruleset.MatchResult     { return r.result }
+func (r *testRuleset) Stats() []ruleset.RuleStatsSnapshot               { return nil }
+
+func newTestStreamFactoryConfig(t *testing.T, logger *testLogger) streamFactoryConfig {
+	node, err := snowflake.NewNode(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return streamFactoryConfig{
+		Logger:        logger,
+		Node:          node,
+		AnalyzerStats: newAnalyzerStatsSet(),
+		Counters:      &workerCounters{},
+		Degraded:      &atomic.Pointer[Degradation]{},
+	}
+}
+
+func TestStreamBase_SetDefaultVerdict(t *testing.T) {
+	testCases := []struct {
+		name        string
+		unmatched   DefaultVerdict
+		props       analyzer.CombinedPropMap
+		wantVerdict io.Verdict
+		wantAction  ruleset.Action
+	}{
+		{"accept stream", DefaultVerdictAcceptStream, nil, io.VerdictAcceptStream, ruleset.ActionAllow},
+		{"accept", DefaultVerdictAccept, nil, io.VerdictAccept, ruleset.ActionAllow},
+		{"drop", DefaultVerdictDrop, nil, io.VerdictDropStream, ruleset.ActionBlock},
+		{"log", DefaultVerdictLog, nil, io.VerdictAcceptStream, ruleset.ActionAllow},
+		{"classified drop", DefaultVerdictDrop, analyzer.CombinedPropMap{"http": {"host": "a"}}, io.VerdictDropStream, ruleset.ActionBlock},
+		{"classified accept", DefaultVerdictAccept, analyzer.CombinedPropMap{"http": {"host": "a"}}, io.VerdictAccept, ruleset.ActionAllow},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &testLogger{}
+			s := streamBase[udpVerdict]{
+				info:         ruleset.StreamInfo{Protocol: ruleset.ProtocolUDP, Props: tc.props},
+				logger:       logger,
+				unmatched:    tc.unmatched,
+				unclassified: tc.unmatched,
+				degraded:     &atomic.Pointer[Degradation]{},
+			}
+			s.setDefaultVerdict()
+			if io.Verdict(s.lastVerdict) != tc.wantVerdict {
+				t.Errorf("lastVerdict = %v, want %v", s.lastVerdict, tc.wantVerdict)
+			}
+			want := []StreamAction{{Action: tc.wantAction, NoMatch: true}}
+			if !reflect.DeepEqual(logger.actions, want) || !reflect.DeepEqual(s.actions, want) {
+				t.Errorf("actions = %v (logged %v), want %v", s.actions, logger.actions, want)
+			}
+		})
+	}
+}
+
+func TestStreamBase_Quota(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	testCases := []struct {
+		name        string
+		quota       *ruleset.Quota
+		packets     []int         // Bytes of the packets after the quota rule matched
+		at          time.Duration // Time of these packets, from the start of the stream
+		wantVerdict io.Verdict
+		wantActions []ruleset.Action
+		wantLimiter bool
+	}{
+		{"under", &ruleset.Quota{Bytes: 1000}, []int{100, 100}, 0, io.VerdictAccept, nil, false},
+		{"bytes so far", &ruleset.Quota{Bytes: 100}, nil, 0, io.VerdictDropStream, []ruleset.Action{ruleset.ActionBlock}, false},
+		{"exceeded", &ruleset.Quota{Bytes: 300}, []int{100, 100}, 0, io.VerdictDropStream, []ruleset.Action{ruleset.ActionBlock}, false},
+		{"exceeded rate limited", &ruleset.Quota{Bytes: 300, Limiter: &ruleset.RateLimiter{}}, []int{100, 100}, 0, io.VerdictAccept,
+			[]ruleset.Action{ruleset.ActionRateLimit}, true},
+		// By the time of the packets, not that of the test
+		{"duration under", &ruleset.Quota{Duration: time.Hour}, []int{100}, 59 * time.Minute, io.VerdictAccept, nil, false},
+		{"duration exceeded", &ruleset.Quota{Duration: time.Hour}, []int{100}, time.Hour, io.VerdictDropStream,
+			[]ruleset.Action{ruleset.ActionBlock}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := &testLogger{}
+			s := streamBase[tcpVerdict]{
+				info:        ruleset.StreamInfo{Protocol: ruleset.ProtocolTCP, Counters: ruleset.StreamCounters{StartTime: start}},
+				logger:      logger,
+				lastVerdict: tcpVerdictAccept,
+			}
+			s.countPacket(false, 150, start)
+			s.setQuota(tc.quota)
+			for _, n := range tc.packets {
+				s.countPacket(false, n, start.Add(tc.at))
+				s.checkQuota()
+			}
+			if io.Verdict(s.lastVerdict) != tc.wantVerdict {
+				t.Errorf("lastVerdict = %v, want %v", s.lastVerdict, tc.wantVerdict)
+			}
+			var actions []ruleset.Action
+			for _, a := range logger.actions {
+				actions = append(actions, a.Action)
+			}
+			if !reflect.DeepEqual(actions, tc.wantActions) {
+				t.Errorf("actions = %v, want %v", actions, tc.wantActions)
+			}
+			if (s.limiter != nil) != tc.wantLimiter {
+				t.Errorf("limiter = %v, want limiter %v", s.limiter, tc.wantLimiter)
+			}
+			if exceeded := tc.wantActions != nil; (s.quota == nil) != exceeded {
+				t.Errorf("quota = %v, want exceeded %v", s.quota, exceeded)
+			}
+		})
+	}
+}
+
+// ruleHitsTestLogger ignores what the rules log.
+type ruleHitsTestLogger struct{}
+
+func (ruleHitsTestLogger) Log(ruleset.LogLevel, ruleset.StreamInfo, string)  {}
+func (ruleHitsTestLogger) DryRun(ruleset.StreamInfo, string, ruleset.Action) {}
+func (ruleHitsTestLogger) MatchError(ruleset.StreamInfo, string, error)      {}
+
+func TestStreamBase_RuleHits(t *testing.T) {
+	enforce := false
+	rs, err := ruleset.CompileExprRules([]ruleset.ExprRule{
+		{Name: "log", Log: true, Expr: `true`},
+		{Name: "dry-run", Action: "block", Enforce: &enforce, Expr: `true`},
+		{Name: "jump", Action: "jump", Jump: "web", Expr: `true`},
+		{Name: "block-https", Group: "web", Action: "block", Expr: `port.dst == 443`},
+		{Name: "allow", Action: "allow", Expr: `true`},
+	}, nil, nil, &ruleset.BuiltinConfig{Logger: ruleHitsTestLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 0)
+	// The destination ports of the evaluations of each stream
+	streams := [][]uint16{
+		{443, 443, 443}, // Re-evaluated, same rule
+		{443, 80, 443},  // Back to a rule that already had a hit
+		{80},
+	}
+	for i, ports := range streams {
+		s := streamBase[udpVerdict]{
+			info:   ruleset.StreamInfo{Protocol: ruleset.ProtocolUDP},
+			logger: &testLogger{},
+		}
+		for j, port := range ports {
+			s.countPacket(false, 100, start.Add(time.Duration(i*10+j)*time.Second))
+			s.info.DstPort = port
+			result := rs.Match(s.info)
+			s.setVerdict(result, result.Action, udpVerdictAccept)
+		}
+	}
+	hits := make(map[string]uint64)
+	var lastHit time.Time
+	for _, st := range rs.Stats() {
+		hits[st.Name] = st.Hits
+		if st.Name == "allow" {
+			lastHit = st.LastHit
+		}
+	}
+	want := map[string]uint64{"log": 0, "dry-run": 0, "jump": 0, "block-https": 2, "allow": 2}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v, want %v", hits, want)
+	}
+	if want := start.Add(20 * time.Second); !lastHit.Equal(want) {
+		t.Errorf("allow last hit = %v, want %v", lastHit, want)
+	}
+}
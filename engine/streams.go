@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+// StreamEntry is a snapshot of a stream being tracked by a worker.
+type StreamEntry struct {
+	WorkerID  int
+	Info      ruleset.StreamInfo
+	Verdict   io.Verdict // Verdict of the stream's latest packet
+	Mark      uint32     // User mark of the stream, 0 if none
+	Rule      string     // Name of the rule that issued the verdict, empty if no rule has matched (yet)
+	Analyzers []string   // Analyzers still inspecting the stream
+}
+
+// maxStreamActions is the number of actions kept per stream for StreamEnd,
+// later ones are not kept.
+const maxStreamActions = 16
+
+// StreamEndReason is why a stream has ended.
+type StreamEndReason int
+
+const (
+	// StreamEndClosed is for TCP streams that have been closed (FIN) or reset (RST),
+	// and SCTP associations that have been shut down or aborted.
+	StreamEndClosed StreamEndReason = iota
+	// StreamEndIdle is for streams without packets for longer than Config.StreamIdleTimeout.
+	StreamEndIdle
+	// StreamEndEvicted is for UDP, SCTP & ICMP streams removed to make room for new ones.
+	StreamEndEvicted
+)
+
+func (r StreamEndReason) String() string {
+	switch r {
+	case StreamEndClosed:
+		return "closed"
+	case StreamEndIdle:
+		return "idle"
+	case StreamEndEvicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+// StreamAction is an action the engine has issued for a stream.
+type StreamAction struct {
+	Time    time.Time
+	Action  ruleset.Action
+	Rule    string // Empty for the default verdict of streams no rule matched
+	NoMatch bool
+}
+
+// StreamEnd is the summary of a stream that has ended, for connection logs.
+type StreamEnd struct {
+	WorkerID int
+	Info     ruleset.StreamInfo
+	Reason   StreamEndReason
+	LastSeen time.Time      // Time of the stream's latest packet
+	Verdict  io.Verdict     // Verdict of the stream's latest packet
+	Actions  []StreamAction // In order, up to maxStreamActions
+}
+
+// addStreamAction appends an action to the actions of a stream, unless there are already too many.
+func addStreamAction(actions []StreamAction, t time.Time, action ruleset.Action, rule string, noMatch bool) []StreamAction {
+	if len(actions) >= maxStreamActions {
+		return actions
+	}
+	return append(actions, StreamAction{Time: t, Action: action, Rule: rule, NoMatch: noMatch})
+}
+
+// Streams returns a snapshot of the streams tracked by the workers. Each worker takes the snapshot
+// of its own streams between two packets, so this blocks until all workers have done so,
+// or the context is cancelled.
+func (e *engine) Streams(ctx context.Context) ([]StreamEntry, error) {
+	var entries []StreamEntry
+	for _, w := range e.workers {
+		ws, err := w.Streams(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ws...)
+	}
+	return entries, nil
+}
+
+// Streams returns a snapshot of the worker's streams, taken by its own goroutine.
+func (w *worker) Streams(ctx context.Context) ([]StreamEntry, error) {
+	result := make(chan []StreamEntry, 1)
+	select {
+	case w.queryChan <- func() { result <- w.streams() }:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case entries := <-result:
+		return entries, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// streams must only be called from the worker's goroutine.
+func (w *worker) streams() []StreamEntry {
+	entries := make([]StreamEntry, 0, len(w.tcpStreamFactory.Streams)+w.udpStreamManager.streams.Len()+w.sctpStreamManager.streams.Len()+w.icmpStreamManager.streams.Len())
+	for _, s := range w.tcpStreamFactory.Streams {
+		names := make([]string, len(s.activeEntries))
+		for i, entry := range s.activeEntries {
+			names[i] = entry.Name
+		}
+		entries = append(entries, StreamEntry{
+			WorkerID:  w.id,
+			Info:      copyStreamInfo(s.info),
+			Verdict:   io.Verdict(s.lastVerdict),
+			Mark:      s.lastMark,
+			Rule:      s.rule,
+			Analyzers: names,
+		})
+	}
+	for _, v := range w.udpStreamManager.streams.Values() {
+		s := v.Stream
+		names := make([]string, len(s.activeEntries))
+		for i, entry := range s.activeEntries {
+			names[i] = entry.Name
+		}
+		entries = append(entries, StreamEntry{
+			WorkerID:  w.id,
+			Info:      copyStreamInfo(s.info),
+			Verdict:   io.Verdict(s.lastVerdict),
+			Mark:      s.lastMark,
+			Rule:      s.rule,
+			Analyzers: names,
+		})
+	}
+	for _, s := range w.sctpStreamManager.streams.Values() {
+		names := make([]string, len(s.activeEntries))
+		for i, entry := range s.activeEntries {
+			names[i] = entry.Name
+		}
+		entries = append(entries, StreamEntry{
+			WorkerID:  w.id,
+			Info:      copyStreamInfo(s.info),
+			Verdict:   io.Verdict(s.lastVerdict),
+			Mark:      s.lastMark,
+			Rule:      s.rule,
+			Analyzers: names,
+		})
+	}
+	for _, s := range w.icmpStreamManager.streams.Values() {
+		names := make([]string, len(s.activeEntries))
+		for i, entry := range s.activeEntries {
+			names[i] = entry.Name
+		}
+		entries = append(entries, StreamEntry{
+			WorkerID:  w.id,
+			Info:      copyStreamInfo(s.info),
+			Verdict:   io.Verdict(s.lastVerdict),
+			Mark:      s.lastMark,
+			Rule:      s.rule,
+			Analyzers: names,
+		})
+	}
+	return entries
+}
+
+// copyStreamInfo copies a StreamInfo so that it can be used outside the worker's goroutine.
+// Analyzers never modify the values of their properties once reported, only the property maps
+// themselves, so copying those is enough.
+func copyStreamInfo(info ruleset.StreamInfo) ruleset.StreamInfo {
+	props := make(analyzer.CombinedPropMap, len(info.Props))
+	for name, m := range info.Props {
+		pm := make(analyzer.PropMap, len(m))
+		for k, v := range m {
+			pm[k] = v
+		}
+		props[name] = pm
+	}
+	info.Props = props
+	return info
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"encoding/binary"
+	"strconv"
+
+	"github.com/apernet/OpenGFW/analyzer"
+
+	"github.com/google/gopacket/layers"
+)
+
+// tcpOptionNames are the names of the TCP options in analyzer.TCPSYN.Options.
+var tcpOptionNames = map[layers.TCPOptionKind]string{
+	layers.TCPOptionKindEndList:       "eol",
+	layers.TCPOptionKindNop:           "nop",
+	layers.TCPOptionKindMSS:           "mss",
+	layers.TCPOptionKindWindowScale:   "ws",
+	layers.TCPOptionKindSACKPermitted: "sok",
+	layers.TCPOptionKindSACK:          "sack",
+	layers.TCPOptionKindTimestamps:    "ts",
+}
+
+// tcpSYN returns the characteristics of the SYN packet that opens a stream, nil if the packet isn't one.
+// data is the raw packet, starting with the IP header.
+func tcpSYN(data []byte, tcp *layers.TCP) *analyzer.TCPSYN {
+	if !tcp.SYN || tcp.ACK || len(data) < 8 {
+		return nil
+	}
+	syn := &analyzer.TCPSYN{
+		Window:      tcp.Window,
+		WindowScale: -1,
+	}
+	if data[0]>>4 == 4 {
+		syn.TTL = data[8]
+	} else {
+		syn.TTL = data[7] // Hop limit
+	}
+	for _, opt := range tcp.Options {
+		name, ok := tcpOptionNames[opt.OptionType]
+		if !ok {
+			name = "?" + strconv.Itoa(int(opt.OptionType))
+		}
+		syn.Options = append(syn.Options, name)
+		switch opt.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(opt.OptionData) == 2 {
+				syn.MSS = binary.BigEndian.Uint16(opt.OptionData)
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(opt.OptionData) == 1 {
+				syn.WindowScale = int(opt.OptionData[0])
+			}
+		}
+	}
+	return syn
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// synTestPacket returns a serialized IPv4 or IPv6 packet with the TCP layer, and the TCP layer decoded from it.
+func synTestPacket(t *testing.T, v6 bool, ttl uint8, tcp *layers.TCP) ([]byte, *layers.TCP) {
+	var ip gopacket.NetworkLayer
+	firstLayer := layers.LayerTypeIPv4
+	if v6 {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: ttl, NextHeader: layers.IPProtocolTCP,
+			SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+		ip, firstLayer = ip6, layers.LayerTypeIPv6
+	} else {
+		ip = &layers.IPv4{Version: 4, TTL: ttl, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+	}
+	tcp.SrcPort, tcp.DstPort = 40000, 443
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip.(gopacket.SerializableLayer), tcp); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), firstLayer, gopacket.Default)
+	decoded, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		t.Fatalf("no TCP layer in %v", packet)
+	}
+	return buf.Bytes(), decoded
+}
+
+func TestTCPSYN(t *testing.T) {
+	mss := layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}
+	sok := layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}
+	ts := layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)}
+	nop := layers.TCPOption{OptionType: layers.TCPOptionKindNop}
+	ws := layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}}
+	eol := layers.TCPOption{OptionType: layers.TCPOptionKindEndList}
+	unknown := layers.TCPOption{OptionType: 30, OptionLength: 4, OptionData: []byte{0, 0}}
+
+	testCases := []struct {
+		name string
+		v6   bool
+		ttl  uint8
+		tcp  layers.TCP
+		want *analyzer.TCPSYN
+	}{
+		{
+			name: "Linux",
+			ttl:  57,
+			tcp:  layers.TCP{SYN: true, Window: 64240, Options: []layers.TCPOption{mss, sok, ts, nop, ws}},
+			want: &analyzer.TCPSYN{TTL: 57, Window: 64240, MSS: 1460, WindowScale: 7,
+				Options: []string{"mss", "sok", "ts", "nop", "ws"}},
+		},
+		{
+			name: "IPv6 hop limit",
+			v6:   true,
+			ttl:  120,
+			tcp:  layers.TCP{SYN: true, Window: 64800, Options: []layers.TCPOption{mss, nop, ws, nop, nop, sok}},
+			want: &analyzer.TCPSYN{TTL: 120, Window: 64800, MSS: 1460, WindowScale: 7,
+				Options: []string{"mss", "nop", "ws", "nop", "nop", "sok"}},
+		},
+		{
+			name: "eol padding",
+			ttl:  64,
+			tcp:  layers.TCP{SYN: true, Window: 65535, Options: []layers.TCPOption{mss, nop, ws, nop, nop, ts, sok, eol}},
+			want: &analyzer.TCPSYN{TTL: 64, Window: 65535, MSS: 1460, WindowScale: 7,
+				Options: []string{"mss", "nop", "ws", "nop", "nop", "ts", "sok", "eol"}},
+		},
+		{
+			name: "no options",
+			ttl:  64,
+			tcp:  layers.TCP{SYN: true, Window: 1024},
+			want: &analyzer.TCPSYN{TTL: 64, Window: 1024, WindowScale: -1},
+		},
+		{
+			name: "unknown option",
+			ttl:  64,
+			tcp:  layers.TCP{SYN: true, Window: 1024, Options: []layers.TCPOption{mss, unknown}},
+			want: &analyzer.TCPSYN{TTL: 64, Window: 1024, MSS: 1460, WindowScale: -1, Options: []string{"mss", "?30"}},
+		},
+		{
+			name: "SYN-ACK",
+			ttl:  64,
+			tcp:  layers.TCP{SYN: true, ACK: true, Window: 65160, Options: []layers.TCPOption{mss}},
+		},
+		{
+			name: "not a SYN",
+			ttl:  64,
+			tcp:  layers.TCP{ACK: true, Window: 502},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, tcp := synTestPacket(t, tc.v6, tc.ttl, &tc.tcp)
+			if got := tcpSYN(data, tcp); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("tcpSYN() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,16 @@
 package engine
 
 import (
+	"bytes"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/modifier"
 	"github.com/apernet/OpenGFW/ruleset"
 
-	"github.com/bwmarrin/snowflake"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/reassembly"
@@ -16,18 +18,37 @@ import (
 
 // tcpVerdict is a subset of io.Verdict for TCP streams.
 // We don't allow modifying or dropping a single packet
-// for TCP streams for now, as it doesn't make much sense.
+// for TCP streams for now, as it doesn't make much sense,
+// except for rate limiting, tarpitting and resetting the server for TCP modifiers.
 type tcpVerdict io.Verdict
 
 const (
-	tcpVerdictAccept       = tcpVerdict(io.VerdictAccept)
-	tcpVerdictAcceptStream = tcpVerdict(io.VerdictAcceptStream)
-	tcpVerdictDropStream   = tcpVerdict(io.VerdictDropStream)
+	tcpVerdictAccept         = tcpVerdict(io.VerdictAccept)
+	tcpVerdictAcceptModify   = tcpVerdict(io.VerdictAcceptModify) // Only used to reset the server for TCP modifiers
+	tcpVerdictAcceptStream   = tcpVerdict(io.VerdictAcceptStream)
+	tcpVerdictDrop           = tcpVerdict(io.VerdictDrop) // Only used for rate limiting
+	tcpVerdictDropStream     = tcpVerdict(io.VerdictDropStream)
+	tcpVerdictDivertStream   = tcpVerdict(io.VerdictDivertStream)
+	tcpVerdictHoneypotStream = tcpVerdict(io.VerdictHoneypotStream)
 )
 
 type tcpContext struct {
 	*gopacket.PacketMetadata
 	Verdict tcpVerdict
+	Mark    uint32
+	Data    []byte   // Raw packet, starting with the IP header
+	IPv6Ext *ipv6Ext // Extension headers of the packet, nil if it has none
+	IO      string   // Name of the IO the packet came from
+	Packet  []byte   // Replacement packet, for tcpVerdictAcceptModify
+	Tarpit  *ruleset.TarpitEntry
+	Inject  func([]byte) error // nil if the IO can't inject packets
+	TCP     *layers.TCP
+	Rev     bool                        // Whether the packet is from the server
+	Payload []byte                      // Replacement payload, for tcpVerdictAcceptModify
+	Rewrite *tcpStreamRewrite           // Rewriter of the stream, applied to every packet
+	Delay   time.Duration               // How long to hold the packet, for delay modifiers
+	IPMod   modifier.IPModifierInstance // IP header modifier of the stream, applied to every packet
+	Trace   *PacketTrace                // nil if tracing is not enabled
 }
 
 func (ctx *tcpContext) GetCaptureInfo() gopacket.CaptureInfo {
@@ -35,34 +56,53 @@ func (ctx *tcpContext) GetCaptureInfo() gopacket.CaptureInfo {
 }
 
 type tcpStreamFactory struct {
-	WorkerID int
-	Logger   Logger
-	Node     *snowflake.Node
+	streamFactoryConfig
+	HTTPCapturer PacketSink
+	Evasion      *TCPEvasionPolicy
+	Asymmetric   *AsymmetricPolicy
 
 	RulesetMutex sync.RWMutex
 	Ruleset      ruleset.Ruleset
+
+	// Streams that haven't been closed yet. Only used by the worker's goroutine.
+	Streams map[int64]*tcpStream
 }
 
 func (f *tcpStreamFactory) New(ipFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	id := f.Node.Generate()
 	ipSrc, ipDst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
 	info := ruleset.StreamInfo{
-		ID:       id.Int64(),
-		Protocol: ruleset.ProtocolTCP,
-		SrcIP:    ipSrc,
-		DstIP:    ipDst,
-		SrcPort:  uint16(tcp.SrcPort),
-		DstPort:  uint16(tcp.DstPort),
-		Props:    make(analyzer.CombinedPropMap),
+		ID:           id.Int64(),
+		UUID:         StreamUUID(id.Int64()),
+		Protocol:     ruleset.ProtocolTCP,
+		SrcIP:        ipSrc,
+		DstIP:        ipDst,
+		SrcPort:      uint16(tcp.SrcPort),
+		DstPort:      uint16(tcp.DstPort),
+		InInterface:  interfaceName(ac.GetCaptureInfo().InterfaceIndex),
+		OutInterface: interfaceName(outInterfaceIndex(ac.GetCaptureInfo())),
+		Owner:        packetOwner(ac.GetCaptureInfo()),
+		IO:           ac.(*tcpContext).IO,
+		Props:        make(analyzer.CombinedPropMap),
+		Counters:     ruleset.StreamCounters{StartTime: time.Now()},
 	}
+	info.Direction = streamDirection(info.InInterface, info.OutInterface, f.External)
+	resumed, reversed := resumeStream(f.StateSync, &info)
 	f.Logger.TCPStreamNew(f.WorkerID, info)
+	f.Counters.tcpStreams.Add(1)
 	f.RulesetMutex.RLock()
 	rs := f.Ruleset
 	f.RulesetMutex.RUnlock()
-	ans := analyzersToTCPAnalyzers(rs.Analyzers(info))
+	degraded := f.Degraded.Load()
+	var ans []analyzer.TCPAnalyzer
+	if !resumed {
+		ans = degradedAnalyzers(analyzersToTCPAnalyzers(rs.Analyzers(info)), degraded)
+	}
 	// Create entries for each analyzer
 	entries := make([]*tcpStreamEntry, 0, len(ans))
+	syn := tcpSYN(ac.(*tcpContext).Data, tcp)
 	for _, a := range ans {
+		stats := f.AnalyzerStats.Get(a.Name())
 		entries = append(entries, &tcpStreamEntry{
 			Name: a.Name(),
 			Stream: a.NewTCP(analyzer.TCPInfo{
@@ -70,22 +110,30 @@ func (f *tcpStreamFactory) New(ipFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, a
 				DstIP:   ipDst,
 				SrcPort: uint16(tcp.SrcPort),
 				DstPort: uint16(tcp.DstPort),
+				SYN:     syn,
 			}, &analyzerLogger{
 				StreamID: id.Int64(),
 				Name:     a.Name(),
 				Logger:   f.Logger,
+				Ring:     f.Ring,
+				Stats:    stats,
 			}),
 			HasLimit: a.Limit() > 0,
 			Quota:    a.Limit(),
+			Run:      newAnalyzerRun(stats),
 		})
 	}
-	return &tcpStream{
-		info:          info,
-		virgin:        true,
-		logger:        f.Logger,
-		ruleset:       rs,
+	s := &tcpStream{
+		streamBase:    newStreamBase[tcpVerdict](&f.streamFactoryConfig, info, rs, f.HTTPCapturer),
+		stateSync:     f.StateSync,
+		reversed:      reversed,
 		activeEntries: entries,
+		streams:       f.Streams,
+		evasion:       f.Evasion,
+		asymmetric:    f.Asymmetric,
 	}
+	f.Streams[id.Int64()] = s
+	return s
 }
 
 func (f *tcpStreamFactory) UpdateRuleset(r ruleset.Ruleset) error {
@@ -96,13 +144,23 @@ func (f *tcpStreamFactory) UpdateRuleset(r ruleset.Ruleset) error {
 }
 
 type tcpStream struct {
-	info          ruleset.StreamInfo
-	virgin        bool // true if no packets have been processed
-	logger        Logger
-	ruleset       ruleset.Ruleset
+	streamBase[tcpVerdict]
+	stateSync     StateSync
+	state         *StreamState // Passed to stateSync, nil if not (yet) or not classified
+	stateDone     bool         // Whether the properties are final & have been passed to stateSync if classified
+	reversed      bool         // Whether the stream was resumed from the other instance the other way round
 	activeEntries []*tcpStreamEntry
 	doneEntries   []*tcpStreamEntry
-	lastVerdict   tcpVerdict
+	tarpit        *ruleset.TarpitEntry        // non-nil once a tarpit rule has matched
+	streamRewrite *tcpStreamRewrite           // non-nil once a TCP rewriter has matched
+	delayer       modifier.DelayerInstance    // non-nil once a delay modifier has matched
+	ipMod         modifier.IPModifierInstance // non-nil once an IP header modifier has matched
+	streams       map[int64]*tcpStream        // Open streams of the factory, to remove the stream from when closed
+	evasion       *TCPEvasionPolicy           // nil if not enabled
+	evasionState  tcpEvasion
+	asymmetric    *AsymmetricPolicy // nil if not enabled
+	oneWay        int               // Segments acknowledging data never seen from the other direction
+	finished      bool              // Whether a FIN or RST has been seen
 }
 
 type tcpStreamEntry struct {
@@ -110,65 +168,315 @@ type tcpStreamEntry struct {
 	Stream   analyzer.TCPStream
 	HasLimit bool
 	Quota    int
+	Run      analyzerRun
 }
 
 func (s *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	rev := (dir == reassembly.TCPDirServerToClient) != s.reversed
+	s.countPacket(rev, ci.Length, ci.Timestamp)
+	s.finished = s.finished || tcp.FIN || tcp.RST
+	ctx := ac.(*tcpContext)
+	addIPv6Ext(&s.info, ctx.IPv6Ext)
+	ctx.Trace.stream(s.info, s.traced)
+	ctx.Rev = rev
+	ctx.Rewrite = s.streamRewrite
+	ctx.IPMod = s.ipMod
+	if s.delayer != nil {
+		ctx.Delay = s.delayer.PacketDelay()
+	}
+	if err := s.capture.Packet(ci, ctx.Data); err != nil {
+		s.logger.CaptureError(s.info, err)
+	}
 	if len(s.activeEntries) > 0 || s.virgin {
+		if s.evasion != nil && !s.checkEvasion(tcp, dir, rev, ctx) {
+			return false
+		}
+		if s.asymmetric != nil && !s.info.Asymmetric && !s.checkAsymmetric(tcp, rev, ctx) {
+			return false
+		}
 		// Make sure every stream matches against the ruleset at least once,
 		// even if there are no activeEntries, as the ruleset may have built-in
 		// properties that need to be matched.
 		return true
 	} else {
-		ctx := ac.(*tcpContext)
-		ctx.Verdict = s.lastVerdict
+		s.checkQuota()
+		if s.limiter != nil {
+			ctx.Verdict = s.limitVerdict(ctx.Length)
+		} else {
+			ctx.Verdict = s.lastVerdict
+			ctx.Mark = s.lastMark
+		}
+		ctx.Tarpit = s.tarpit
 		return false
 	}
 }
 
 func (s *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
 	dir, start, end, skip := sg.Info()
-	rev := dir == reassembly.TCPDirServerToClient
+	rev := (dir == reassembly.TCPDirServerToClient) != s.reversed
 	avail, _ := sg.Lengths()
 	data := sg.Fetch(avail)
+	ctx := ac.(*tcpContext)
 	updated := false
 	for i := len(s.activeEntries) - 1; i >= 0; i-- {
 		// Important: reverse order so we can remove entries
 		entry := s.activeEntries[i]
+		ctx.Trace.analyzed()
+		stageStart := ctx.Trace.begin()
 		update, closeUpdate, done := s.feedEntry(entry, rev, start, end, skip, data)
+		ctx.Trace.end(TraceStageAnalyzer, entry.Name, stageStart)
 		up1 := processPropUpdate(s.info.Props, entry.Name, update)
 		up2 := processPropUpdate(s.info.Props, entry.Name, closeUpdate)
 		updated = updated || up1 || up2
+		entry.Run.Updated(up1 || up2)
 		if done {
+			entry.Run.Done()
 			s.activeEntries = append(s.activeEntries[:i], s.activeEntries[i+1:]...)
 			s.doneEntries = append(s.doneEntries, entry)
 		}
 	}
-	ctx := ac.(*tcpContext)
 	if updated || s.virgin {
 		s.virgin = false
 		s.logger.TCPStreamPropUpdate(s.info, false)
 		// Match properties against ruleset
+		stageStart := ctx.Trace.begin()
 		result := s.ruleset.Match(s.info)
+		ctx.Trace.end(TraceStageRuleset, result.RuleName, stageStart)
 		action := result.Action
+		if tcpMI, ok := result.ModInstance.(modifier.TCPModifierInstance); ok && action == ruleset.ActionModify {
+			s.setRule(result)
+			if err := s.modify(ctx, tcpMI, result.RuleName, rev, data); err != nil {
+				s.logger.ModifyError(s.info, err)
+			}
+			s.logAction(action, s.rule, false)
+			s.closeActiveEntries()
+		} else if di, ok := result.ModInstance.(modifier.DelayerInstance); ok && action == ruleset.ActionModify {
+			s.setRule(result)
+			s.delayer = di
+			s.lastVerdict = tcpVerdictAccept
+			ctx.Delay = di.PacketDelay()
+			s.logAction(action, s.rule, false)
+			s.closeActiveEntries()
+		} else if ipi, ok := result.ModInstance.(modifier.IPModifierInstance); ok && action == ruleset.ActionModify {
+			s.setRule(result)
+			s.ipMod = ipi
+			s.lastVerdict = tcpVerdictAccept
+			ctx.IPMod = ipi
+			s.logAction(action, s.rule, false)
+			s.closeActiveEntries()
+		} else if smi, ok := result.ModInstance.(modifier.TCPStreamModifierInstance); ok && action == ruleset.ActionModify {
+			s.setRule(result)
+			s.streamRewrite = newTCPStreamRewrite(smi.NewStream(modifier.StreamInfo{Rule: result.RuleName, Props: s.info.Props}))
+			s.lastVerdict = tcpVerdictAccept
+			ctx.Rewrite = s.streamRewrite
+			s.logAction(action, s.rule, false)
+			s.closeActiveEntries()
+		} else if tcpRI, ok := result.ModInstance.(modifier.TCPRewriterInstance); ok && action == ruleset.ActionModify {
+			s.setRule(result)
+			if err := s.rewrite(ctx, tcpRI, result.RuleName, rev, data); err != nil {
+				s.logger.ModifyError(s.info, err)
+			}
+			s.logAction(action, s.rule, false)
+			s.closeActiveEntries()
+		}
 		if action != ruleset.ActionMaybe && action != ruleset.ActionModify {
 			verdict := actionToTCPVerdict(action)
-			s.lastVerdict = verdict
+			s.setVerdict(result, action, verdict)
 			ctx.Verdict = verdict
-			s.logger.TCPStreamAction(s.info, action, false)
+			ctx.Mark = s.lastMark
+			if action == ruleset.ActionRateLimit {
+				s.limiter = result.RateLimiter
+				ctx.Verdict = s.limitVerdict(ctx.Length)
+			}
+			if action == ruleset.ActionTarpit {
+				s.tarpit = result.Tarpit
+				ctx.Tarpit = s.tarpit
+			}
+			if action == ruleset.ActionQuota {
+				s.setQuota(result.Quota)
+				if s.limiter != nil {
+					ctx.Verdict = s.limitVerdict(ctx.Length)
+				} else {
+					ctx.Verdict = s.lastVerdict
+				}
+			}
+			if action == ruleset.ActionCapture || action == ruleset.ActionMirror || action == ruleset.ActionCaptureHTTP {
+				if err := s.capture.Start(action); err != nil {
+					s.logger.CaptureError(s.info, err)
+				}
+			}
 			// Verdict issued, no need to process any more packets
 			s.closeActiveEntries()
 		}
 	}
-	if len(s.activeEntries) == 0 && ctx.Verdict == tcpVerdictAccept {
-		// All entries are done but no verdict issued, accept stream
+	if len(s.activeEntries) == 0 && ctx.Verdict == tcpVerdictAccept && s.limiter == nil && s.tarpit == nil && s.quota == nil && s.streamRewrite == nil && s.delayer == nil && s.ipMod == nil && !s.capture.Active() {
+		// All entries are done but no verdict issued, apply the default verdict
+		s.setDefaultVerdict()
+		ctx.Verdict = s.lastVerdict
+		ctx.Mark = s.lastMark
+	}
+	if s.stateSync != nil && !s.stateDone && len(s.activeEntries) == 0 {
+		s.stateDone = true
+		if s.state = newStreamState(s.info); s.state != nil {
+			s.stateSync.Classified(s.state)
+		}
+	}
+}
+
+// modify answers the client on behalf of the server with the response of a TCP modifier,
+// replaces the client's packet with a RST to the server, and blocks the stream.
+// The stream is blocked even if the client can't be answered.
+func (s *tcpStream) modify(ctx *tcpContext, mi modifier.TCPModifierInstance, rule string, rev bool, data []byte) error {
+	s.lastVerdict = tcpVerdictDropStream
+	ctx.Verdict = tcpVerdictDropStream
+	if rev {
+		return errNotClientPacket
+	}
+	if ctx.Inject == nil {
+		return errInjectNotSupported
+	}
+	payload, err := mi.Respond(modifier.StreamInfo{Rule: rule, Props: s.info.Props}, data)
+	if err != nil {
+		return err
+	}
+	toClient, toServer, err := tcpReply(ctx.Data, payload)
+	if err != nil {
+		return err
+	}
+	for _, p := range toClient {
+		if err := ctx.Inject(p); err != nil {
+			return err
+		}
+	}
+	ctx.Verdict = tcpVerdictAcceptModify
+	ctx.Packet = toServer
+	return nil
+}
+
+// rewrite replaces the payload of the client's packet with the one returned by a TCP rewriter.
+// The rest of the stream is then accepted packet by packet, to adjust their sequence numbers
+// if the size has changed. The stream is accepted unmodified if it can't be rewritten.
+func (s *tcpStream) rewrite(ctx *tcpContext, ri modifier.TCPRewriterInstance, rule string, rev bool, data []byte) error {
+	s.lastVerdict = tcpVerdictAcceptStream
+	ctx.Verdict = tcpVerdictAcceptStream
+	if rev {
+		return errNotClientPacket
+	}
+	if ctx.TCP == nil || !bytes.Equal(ctx.TCP.Payload, data) {
+		// The data to rewrite must be exactly the payload of this packet
+		return errRewriteSpansPackets
+	}
+	payload, err := ri.Rewrite(modifier.StreamInfo{Rule: rule, Props: s.info.Props}, data)
+	if err != nil {
+		return err
+	}
+	s.streamRewrite = newTCPStreamRewrite(&tcpOnceRewriter{first: payload})
+	s.lastVerdict = tcpVerdictAccept
+	ctx.Verdict = tcpVerdictAccept
+	ctx.Rewrite = s.streamRewrite
+	return nil
+}
+
+// checkAsymmetric applies the asymmetric routing policy to a segment, and returns whether the stream
+// must still be analyzed.
+func (s *tcpStream) checkAsymmetric(tcp *layers.TCP, rev bool, ctx *tcpContext) bool {
+	other := s.info.Counters.DstPackets
+	if rev {
+		other = s.info.Counters.SrcPackets
+	}
+	if other > 0 || !tcp.ACK || tcp.SYN {
+		return true
+	}
+	s.oneWay++
+	if s.oneWay < s.asymmetric.Packets {
+		return true
+	}
+	s.info.Asymmetric = true
+	src, dst := s.info.SrcIP, s.info.DstIP
+	if rev {
+		src, dst = dst, src
+	}
+	s.counters.anomalies.Add(1)
+	s.logger.PacketAnomaly(PacketAnomaly{
+		WorkerID: s.workerID,
+		StreamID: s.info.ID,
+		SrcIP:    src,
+		DstIP:    dst,
+		Reason:   "asymmetric routing",
+		Dropped:  s.asymmetric.Verdict == AsymmetricVerdictDrop,
+	})
+	action := ruleset.ActionAllow
+	switch s.asymmetric.Verdict {
+	case AsymmetricVerdictAccept:
 		s.lastVerdict = tcpVerdictAcceptStream
-		ctx.Verdict = tcpVerdictAcceptStream
-		s.logger.TCPStreamAction(s.info, ruleset.ActionAllow, true)
+		s.lastMark = qosMark(s.qos, s.info, 0)
+	case AsymmetricVerdictDrop:
+		s.lastVerdict = tcpVerdictDropStream
+		action = ruleset.ActionBlock
+	default:
+		return true
+	}
+	// Like the default verdicts, as the analyzers can't finish
+	s.closeActiveEntries()
+	s.virgin = false
+	ctx.Verdict = s.lastVerdict
+	ctx.Mark = s.lastMark
+	s.logAction(action, "", true)
+	return false
+}
+
+// checkEvasion applies the evasion policy to a segment, and returns whether it must still be analyzed.
+func (s *tcpStream) checkEvasion(tcp *layers.TCP, dir reassembly.TCPFlowDirection, rev bool, ctx *tcpContext) bool {
+	action, reason := s.evasionState.check(s.evasion, tcp, ctx.Data, dir)
+	if action == EvasionActionNone {
+		return true
+	}
+	src, dst := s.info.SrcIP, s.info.DstIP
+	if rev {
+		src, dst = dst, src
+	}
+	s.counters.anomalies.Add(1)
+	s.logger.PacketAnomaly(PacketAnomaly{
+		WorkerID: s.workerID,
+		StreamID: s.info.ID,
+		SrcIP:    src,
+		DstIP:    dst,
+		Reason:   reason,
+		Dropped:  action == EvasionActionDrop,
+	})
+	switch action {
+	case EvasionActionIgnore:
+		ctx.Verdict = tcpVerdictAccept
+		return false
+	case EvasionActionDrop:
+		ctx.Verdict = tcpVerdictDrop
+		return false
+	default:
+		return true
 	}
 }
 
 func (s *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
 	s.closeActiveEntries()
+	delete(s.streams, s.info.ID)
+	s.account.Flush(s.info)
+	s.counters.tcpEnded.Add(1)
+	if s.state != nil {
+		s.stateSync.Ended(s.state)
+	}
+	// Called without context for both closed & flushed streams, hence the flag
+	reason := StreamEndIdle
+	if s.finished {
+		reason = StreamEndClosed
+	}
+	s.logger.StreamEnd(StreamEnd{
+		WorkerID: s.workerID,
+		Info:     s.info,
+		Reason:   reason,
+		LastSeen: s.lastSeen,
+		Verdict:  io.Verdict(s.lastVerdict),
+		Actions:  s.actions,
+	})
 	return true
 }
 
@@ -176,9 +484,13 @@ func (s *tcpStream) closeActiveEntries() {
 	// Signal close to all active entries & move them to doneEntries
 	updated := false
 	for _, entry := range s.activeEntries {
+		start := time.Now()
 		update := entry.Stream.Close(false)
+		entry.Run.Fed(start, 0)
 		up := processPropUpdate(s.info.Props, entry.Name, update)
 		updated = updated || up
+		entry.Run.Updated(up)
+		entry.Run.Done()
 	}
 	if updated {
 		s.logger.TCPStreamPropUpdate(s.info, true)
@@ -188,8 +500,10 @@ func (s *tcpStream) closeActiveEntries() {
 }
 
 func (s *tcpStream) feedEntry(entry *tcpStreamEntry, rev, start, end bool, skip int, data []byte) (update *analyzer.PropUpdate, closeUpdate *analyzer.PropUpdate, done bool) {
+	runStart := time.Now()
 	if !entry.HasLimit {
 		update, done = entry.Stream.Feed(rev, start, end, skip, data)
+		entry.Run.Fed(runStart, len(data))
 	} else {
 		qData := data
 		if len(qData) > entry.Quota {
@@ -202,6 +516,7 @@ func (s *tcpStream) feedEntry(entry *tcpStreamEntry, rev, start, end bool, skip
 			closeUpdate = entry.Stream.Close(true)
 			done = true
 		}
+		entry.Run.Fed(runStart, len(qData))
 	}
 	return
 }
@@ -218,10 +533,17 @@ func analyzersToTCPAnalyzers(ans []analyzer.Analyzer) []analyzer.TCPAnalyzer {
 
 func actionToTCPVerdict(a ruleset.Action) tcpVerdict {
 	switch a {
-	case ruleset.ActionMaybe, ruleset.ActionAllow, ruleset.ActionModify:
+	case ruleset.ActionMaybe, ruleset.ActionAllow, ruleset.ActionModify, ruleset.ActionShape, ruleset.ActionMark:
 		return tcpVerdictAcceptStream
 	case ruleset.ActionBlock, ruleset.ActionDrop:
 		return tcpVerdictDropStream
+	case ruleset.ActionDivert:
+		return tcpVerdictDivertStream
+	case ruleset.ActionHoneypot:
+		return tcpVerdictHoneypotStream
+	case ruleset.ActionRateLimit, ruleset.ActionTarpit, ruleset.ActionCapture, ruleset.ActionMirror, ruleset.ActionCaptureHTTP, ruleset.ActionQuota:
+		// The stream must not be offloaded, as each packet is still handled individually
+		return tcpVerdictAccept
 	default:
 		// Should never happen
 		return tcpVerdictAcceptStream
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/apernet/OpenGFW/io"
+	"github.com/apernet/OpenGFW/ruleset"
+)
+
+// Tracer receives the processing timeline of every packet, for metrics & tracing.
+// It must be safe for concurrent use.
+type Tracer interface {
+	// SampleStream is called for every new stream, and returns whether the analyzer &
+	// ruleset runs of its packets should be timed (PacketTrace.Sampled).
+	SampleStream(info ruleset.StreamInfo) bool
+	// PacketDone is called once the verdict of a packet has been submitted.
+	// The trace must not be kept after it returns.
+	PacketDone(trace *PacketTrace)
+}
+
+// TraceStageKind is the kind of a processing stage of a packet.
+type TraceStageKind int
+
+const (
+	TraceStageAnalyzer TraceStageKind = iota
+	TraceStageRuleset
+)
+
+// TraceStage is the run of an analyzer, or the evaluation of the ruleset, for a packet.
+type TraceStage struct {
+	Kind  TraceStageKind
+	Name  string // Analyzer name, or the matched rule for TraceStageRuleset (empty if none)
+	Start time.Time
+	End   time.Time
+}
+
+// PacketTrace is the processing timeline of a packet.
+type PacketTrace struct {
+	WorkerID   int
+	StreamID   int64  // 0 if the packet doesn't belong to a stream (e.g. not TCP or UDP)
+	StreamUUID string // Empty if StreamID is 0
+	Protocol   ruleset.Protocol
+	Analyzed   bool         // Whether any analyzer has been run on the packet
+	Sampled    bool         // Whether Stages is filled in
+	Stages     []TraceStage // In order
+
+	Received     time.Time // Dispatched to the worker
+	Handled      time.Time // Picked up by the worker
+	Processed    time.Time // Verdict decided
+	VerdictStart time.Time // Verdict submission started, after the delay if the packet was delayed
+	Done         time.Time // Verdict submitted
+	Verdict      io.Verdict
+	Delay        time.Duration
+}
+
+// stream sets the stream of a trace. A nil *PacketTrace does nothing.
+func (t *PacketTrace) stream(info ruleset.StreamInfo, sampled bool) {
+	if t != nil {
+		t.StreamID = info.ID
+		t.StreamUUID = info.UUID
+		t.Protocol = info.Protocol
+		t.Sampled = sampled
+	}
+}
+
+// analyzed records that an analyzer has been run on the packet. A nil *PacketTrace does nothing.
+func (t *PacketTrace) analyzed() {
+	if t != nil {
+		t.Analyzed = true
+	}
+}
+
+// begin returns the start time of a stage, the zero time if the trace isn't sampled.
+func (t *PacketTrace) begin() time.Time {
+	if t == nil || !t.Sampled {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// end records a stage that began at start, if the trace is sampled.
+func (t *PacketTrace) end(kind TraceStageKind, name string, start time.Time) {
+	if t == nil || !t.Sampled {
+		return
+	}
+	t.Stages = append(t.Stages, TraceStage{Kind: kind, Name: name, Start: start, End: time.Now()})
+}
@@ -4,13 +4,13 @@ import (
 	"errors"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/io"
 	"github.com/apernet/OpenGFW/modifier"
 	"github.com/apernet/OpenGFW/ruleset"
 
-	"github.com/bwmarrin/snowflake"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -31,14 +31,22 @@ const (
 var errInvalidModifier = errors.New("invalid modifier")
 
 type udpContext struct {
+	*gopacket.PacketMetadata
 	Verdict udpVerdict
+	Mark    uint32
+	Data    []byte   // Raw packet, starting with the IP header
+	IPv6Ext *ipv6Ext // Extension headers of the packet, nil if it has none
+	IO      string   // Name of the IO the packet came from
 	Packet  []byte
+	Delay   time.Duration               // How long to hold the packet, for delay modifiers
+	IPMod   modifier.IPModifierInstance // IP header modifier of the stream, applied to every packet
+	Rev     bool                        // Whether the packet is from the server
+	Inject  func([]byte) error          // nil if the IO can't inject packets
+	Trace   *PacketTrace                // nil if tracing is not enabled
 }
 
 type udpStreamFactory struct {
-	WorkerID int
-	Logger   Logger
-	Node     *snowflake.Node
+	streamFactoryConfig
 
 	RulesetMutex sync.RWMutex
 	Ruleset      ruleset.Ruleset
@@ -48,22 +56,36 @@ func (f *udpStreamFactory) New(ipFlow, udpFlow gopacket.Flow, udp *layers.UDP, u
 	id := f.Node.Generate()
 	ipSrc, ipDst := net.IP(ipFlow.Src().Raw()), net.IP(ipFlow.Dst().Raw())
 	info := ruleset.StreamInfo{
-		ID:       id.Int64(),
-		Protocol: ruleset.ProtocolUDP,
-		SrcIP:    ipSrc,
-		DstIP:    ipDst,
-		SrcPort:  uint16(udp.SrcPort),
-		DstPort:  uint16(udp.DstPort),
-		Props:    make(analyzer.CombinedPropMap),
+		ID:           id.Int64(),
+		UUID:         StreamUUID(id.Int64()),
+		Protocol:     ruleset.ProtocolUDP,
+		SrcIP:        ipSrc,
+		DstIP:        ipDst,
+		SrcPort:      uint16(udp.SrcPort),
+		DstPort:      uint16(udp.DstPort),
+		InInterface:  interfaceName(uc.InterfaceIndex),
+		OutInterface: interfaceName(outInterfaceIndex(uc.CaptureInfo)),
+		Owner:        packetOwner(uc.CaptureInfo),
+		IO:           uc.IO,
+		Props:        make(analyzer.CombinedPropMap),
+		Counters:     ruleset.StreamCounters{StartTime: time.Now()},
 	}
+	info.Direction = streamDirection(info.InInterface, info.OutInterface, f.External)
+	resumed, reversed := resumeStream(f.StateSync, &info)
 	f.Logger.UDPStreamNew(f.WorkerID, info)
+	f.Counters.udpStreams.Add(1)
 	f.RulesetMutex.RLock()
 	rs := f.Ruleset
 	f.RulesetMutex.RUnlock()
-	ans := analyzersToUDPAnalyzers(rs.Analyzers(info))
+	degraded := f.Degraded.Load()
+	var ans []analyzer.UDPAnalyzer
+	if !resumed {
+		ans = degradedAnalyzers(analyzersToUDPAnalyzers(rs.Analyzers(info)), degraded)
+	}
 	// Create entries for each analyzer
 	entries := make([]*udpStreamEntry, 0, len(ans))
 	for _, a := range ans {
+		stats := f.AnalyzerStats.Get(a.Name())
 		entries = append(entries, &udpStreamEntry{
 			Name: a.Name(),
 			Stream: a.NewUDP(analyzer.UDPInfo{
@@ -75,16 +97,18 @@ func (f *udpStreamFactory) New(ipFlow, udpFlow gopacket.Flow, udp *layers.UDP, u
 				StreamID: id.Int64(),
 				Name:     a.Name(),
 				Logger:   f.Logger,
+				Ring:     f.Ring,
+				Stats:    stats,
 			}),
 			HasLimit: a.Limit() > 0,
 			Quota:    a.Limit(),
+			Run:      newAnalyzerRun(stats),
 		})
 	}
 	return &udpStream{
-		info:          info,
-		virgin:        true,
-		logger:        f.Logger,
-		ruleset:       rs,
+		streamBase:    newStreamBase[udpVerdict](&f.streamFactoryConfig, info, rs, nil),
+		stateSync:     f.StateSync,
+		reversed:      reversed,
 		activeEntries: entries,
 	}
 }
@@ -114,7 +138,9 @@ func (v *udpStreamValue) Match(ipFlow, udpFlow gopacket.Flow) (ok, rev bool) {
 }
 
 func newUDPStreamManager(factory *udpStreamFactory, maxStreams int) (*udpStreamManager, error) {
-	ss, err := lru.New[uint32, *udpStreamValue](maxStreams)
+	ss, err := lru.NewWithEvict[uint32, *udpStreamValue](maxStreams, func(_ uint32, v *udpStreamValue) {
+		v.Stream.Close(StreamEndEvicted)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -140,7 +166,7 @@ func (m *udpStreamManager) MatchWithContext(streamID uint32, ipFlow gopacket.Flo
 		ok, rev = value.Match(ipFlow, udp.TransportFlow())
 		if !ok {
 			// It's not - close the old stream & replace it with a new one
-			value.Stream.Close()
+			value.Stream.Close(StreamEndEvicted)
 			value = &udpStreamValue{
 				Stream:  m.factory.New(ipFlow, udp.TransportFlow(), udp, uc),
 				IPFlow:  ipFlow,
@@ -154,14 +180,28 @@ func (m *udpStreamManager) MatchWithContext(streamID uint32, ipFlow gopacket.Flo
 	}
 }
 
+// CloseIdle ends the streams whose latest packet is older than cutoff.
+func (m *udpStreamManager) CloseIdle(cutoff time.Time) {
+	for _, k := range m.streams.Keys() {
+		v, ok := m.streams.Peek(k)
+		if ok && v.Stream.lastSeen.Before(cutoff) {
+			v.Stream.Close(StreamEndIdle)
+			m.streams.Remove(k)
+		}
+	}
+}
+
 type udpStream struct {
-	info          ruleset.StreamInfo
-	virgin        bool // true if no packets have been processed
-	logger        Logger
-	ruleset       ruleset.Ruleset
+	streamBase[udpVerdict]
+	stateSync     StateSync
+	state         *StreamState // Passed to stateSync, nil if not (yet) or not classified
+	stateDone     bool         // Whether the properties are final & have been passed to stateSync if classified
+	reversed      bool         // Whether the stream was resumed from the other instance the other way round
 	activeEntries []*udpStreamEntry
 	doneEntries   []*udpStreamEntry
-	lastVerdict   udpVerdict
+	delayer       modifier.DelayerInstance    // non-nil once a delay modifier has matched
+	ipMod         modifier.IPModifierInstance // non-nil once an IP header modifier has matched
+	ended         bool                        // Whether StreamEnd has been logged
 }
 
 type udpStreamEntry struct {
@@ -169,30 +209,54 @@ type udpStreamEntry struct {
 	Stream   analyzer.UDPStream
 	HasLimit bool
 	Quota    int
+	Run      analyzerRun
 }
 
 func (s *udpStream) Accept(udp *layers.UDP, rev bool, uc *udpContext) bool {
+	rev = rev != s.reversed
+	uc.Trace.stream(s.info, s.traced)
+	s.countPacket(rev, uc.Length, uc.Timestamp)
+	addIPv6Ext(&s.info, uc.IPv6Ext)
+	if err := s.capture.Packet(uc.CaptureInfo, uc.Data); err != nil {
+		s.logger.CaptureError(s.info, err)
+	}
+	if s.delayer != nil {
+		uc.Delay = s.delayer.PacketDelay()
+	}
+	uc.IPMod = s.ipMod
+	uc.Rev = rev
 	if len(s.activeEntries) > 0 || s.virgin {
 		// Make sure every stream matches against the ruleset at least once,
 		// even if there are no activeEntries, as the ruleset may have built-in
 		// properties that need to be matched.
 		return true
+	}
+	s.checkQuota()
+	if s.limiter != nil {
+		uc.Verdict = s.limitVerdict(uc.Length)
 	} else {
 		uc.Verdict = s.lastVerdict
-		return false
+		uc.Mark = s.lastMark
 	}
+	return false
 }
 
 func (s *udpStream) Feed(udp *layers.UDP, rev bool, uc *udpContext) {
+	rev = rev != s.reversed
 	updated := false
 	for i := len(s.activeEntries) - 1; i >= 0; i-- {
 		// Important: reverse order so we can remove entries
 		entry := s.activeEntries[i]
+		uc.Trace.analyzed()
+		stageStart := uc.Trace.begin()
 		update, closeUpdate, done := s.feedEntry(entry, rev, udp.Payload)
+		uc.Trace.end(TraceStageAnalyzer, entry.Name, stageStart)
 		up1 := processPropUpdate(s.info.Props, entry.Name, update)
 		up2 := processPropUpdate(s.info.Props, entry.Name, closeUpdate)
 		updated = updated || up1 || up2
+		entry.Run.Updated(up1 || up2)
 		if done {
+			entry.Run.Done()
 			s.activeEntries = append(s.activeEntries[:i], s.activeEntries[i+1:]...)
 			s.doneEntries = append(s.doneEntries, entry)
 		}
@@ -201,12 +265,27 @@ func (s *udpStream) Feed(udp *layers.UDP, rev bool, uc *udpContext) {
 		s.virgin = false
 		s.logger.UDPStreamPropUpdate(s.info, false)
 		// Match properties against ruleset
+		stageStart := uc.Trace.begin()
 		result := s.ruleset.Match(s.info)
+		uc.Trace.end(TraceStageRuleset, result.RuleName, stageStart)
 		action := result.Action
+		rejected := false
 		if action == ruleset.ActionModify {
 			// Call the modifier instance
 			udpMI, ok := result.ModInstance.(modifier.UDPModifierInstance)
-			if !ok {
+			if rej, isRejecter := result.ModInstance.(modifier.UDPRejecterInstance); isRejecter {
+				// The stream is blocked even if the client can't be told
+				rejected = true
+				if err := s.reject(uc, rej, result.RuleName, rev); err != nil {
+					s.logger.ModifyError(s.info, err)
+				}
+			} else if di, isDelayer := result.ModInstance.(modifier.DelayerInstance); isDelayer {
+				s.delayer = di
+				uc.Delay = di.PacketDelay()
+			} else if ipi, isIP := result.ModInstance.(modifier.IPModifierInstance); isIP {
+				s.ipMod = ipi
+				uc.IPMod = ipi
+			} else if !ok {
 				// Not for UDP, fallback to maybe
 				s.logger.ModifyError(s.info, errInvalidModifier)
 				action = ruleset.ActionMaybe
@@ -222,33 +301,99 @@ func (s *udpStream) Feed(udp *layers.UDP, rev bool, uc *udpContext) {
 		}
 		if action != ruleset.ActionMaybe {
 			verdict, final := actionToUDPVerdict(action)
-			s.lastVerdict = verdict
+			if rejected {
+				verdict, final = udpVerdictDropStream, true
+			} else if action == ruleset.ActionModify && uc.Packet == nil {
+				// Nothing to replace the packet with (e.g. delay & IP header modifiers)
+				verdict = udpVerdictAccept
+			}
+			s.setVerdict(result, action, verdict)
 			uc.Verdict = verdict
-			s.logger.UDPStreamAction(s.info, action, false)
+			uc.Mark = s.lastMark
+			if action == ruleset.ActionRateLimit {
+				s.limiter = result.RateLimiter
+				uc.Verdict = s.limitVerdict(uc.Length)
+			}
+			if action == ruleset.ActionQuota {
+				s.setQuota(result.Quota)
+				if s.limiter != nil {
+					uc.Verdict = s.limitVerdict(uc.Length)
+				} else {
+					uc.Verdict = s.lastVerdict
+				}
+			}
+			if action == ruleset.ActionCapture || action == ruleset.ActionMirror {
+				if err := s.capture.Start(action); err != nil {
+					s.logger.CaptureError(s.info, err)
+				}
+			}
 			if final {
 				s.closeActiveEntries()
 			}
 		}
 	}
-	if len(s.activeEntries) == 0 && uc.Verdict == udpVerdictAccept {
-		// All entries are done but no verdict issued, accept stream
-		s.lastVerdict = udpVerdictAcceptStream
-		uc.Verdict = udpVerdictAcceptStream
-		s.logger.UDPStreamAction(s.info, ruleset.ActionAllow, true)
+	if len(s.activeEntries) == 0 && uc.Verdict == udpVerdictAccept && s.limiter == nil && s.quota == nil && s.delayer == nil && s.ipMod == nil && !s.capture.Active() {
+		// All entries are done but no verdict issued, apply the default verdict
+		s.setDefaultVerdict()
+		uc.Verdict = s.lastVerdict
+		uc.Mark = s.lastMark
+	}
+	if s.stateSync != nil && !s.stateDone && len(s.activeEntries) == 0 {
+		s.stateDone = true
+		if s.state = newStreamState(s.info); s.state != nil {
+			s.stateSync.Classified(s.state)
+		}
+	}
+}
+
+// reject sends the error packet of a UDP rejecter to the client.
+func (s *udpStream) reject(uc *udpContext, rej modifier.UDPRejecterInstance, rule string, rev bool) error {
+	if rev {
+		return errNotClientPacket
+	}
+	if uc.Inject == nil {
+		return errInjectNotSupported
+	}
+	p, err := rej.Reject(modifier.StreamInfo{Rule: rule, Props: s.info.Props}, uc.Data)
+	if err != nil {
+		return err
 	}
+	return uc.Inject(p)
 }
 
-func (s *udpStream) Close() {
+// Close ends the stream. It does nothing if the stream has already ended.
+func (s *udpStream) Close(reason StreamEndReason) {
+	if s.ended {
+		return
+	}
+	s.ended = true
 	s.closeActiveEntries()
+	s.account.Flush(s.info)
+	s.counters.udpEnded.Add(1)
+	if s.state != nil {
+		s.stateSync.Ended(s.state)
+	}
+	s.logger.StreamEnd(StreamEnd{
+		WorkerID: s.workerID,
+		Info:     s.info,
+		Reason:   reason,
+		LastSeen: s.lastSeen,
+		Verdict:  io.Verdict(s.lastVerdict),
+		Actions:  s.actions,
+	})
 }
 
 func (s *udpStream) closeActiveEntries() {
 	// Signal close to all active entries & move them to doneEntries
 	updated := false
 	for _, entry := range s.activeEntries {
+		start := time.Now()
 		update := entry.Stream.Close(false)
+		entry.Run.Fed(start, 0)
 		up := processPropUpdate(s.info.Props, entry.Name, update)
 		updated = updated || up
+		entry.Run.Updated(up)
+		entry.Run.Done()
 	}
 	if updated {
 		s.logger.UDPStreamPropUpdate(s.info, true)
@@ -258,6 +403,7 @@ func (s *udpStream) closeActiveEntries() {
 }
 
 func (s *udpStream) feedEntry(entry *udpStreamEntry, rev bool, data []byte) (update *analyzer.PropUpdate, closeUpdate *analyzer.PropUpdate, done bool) {
+	start := time.Now()
 	update, done = entry.Stream.Feed(rev, data)
 	if entry.HasLimit {
 		entry.Quota -= len(data)
@@ -267,6 +413,7 @@ func (s *udpStream) feedEntry(entry *udpStreamEntry, rev bool, data []byte) (upd
 			done = true
 		}
 	}
+	entry.Run.Fed(start, len(data))
 	return
 }
 
@@ -284,7 +431,7 @@ func actionToUDPVerdict(a ruleset.Action) (v udpVerdict, final bool) {
 	switch a {
 	case ruleset.ActionMaybe:
 		return udpVerdictAccept, false
-	case ruleset.ActionAllow:
+	case ruleset.ActionAllow, ruleset.ActionShape, ruleset.ActionMark:
 		return udpVerdictAcceptStream, true
 	case ruleset.ActionBlock:
 		return udpVerdictDropStream, true
@@ -292,6 +439,15 @@ func actionToUDPVerdict(a ruleset.Action) (v udpVerdict, final bool) {
 		return udpVerdictDrop, false
 	case ruleset.ActionModify:
 		return udpVerdictAcceptModify, false
+	case ruleset.ActionTarpit, ruleset.ActionDivert, ruleset.ActionHoneypot, ruleset.ActionCaptureHTTP:
+		// Not supported for UDP
+		return udpVerdictAccept, false
+	case ruleset.ActionRateLimit, ruleset.ActionQuota:
+		// The actual verdict of each packet is decided by the rate limiter or quota
+		return udpVerdictAccept, true
+	case ruleset.ActionCapture, ruleset.ActionMirror:
+		// Each packet must still go through the engine to be copied
+		return udpVerdictAccept, true
 	default:
 		// Should never happen
 		return udpVerdictAccept, false
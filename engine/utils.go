@@ -8,6 +8,8 @@ type analyzerLogger struct {
 	StreamID int64
 	Name     string
 	Logger   Logger
+	Ring     *packetRing
+	Stats    *analyzerCounters
 }
 
 func (l *analyzerLogger) Debugf(format string, args ...interface{}) {
@@ -20,6 +22,18 @@ func (l *analyzerLogger) Infof(format string, args ...interface{}) {
 
 func (l *analyzerLogger) Errorf(format string, args ...interface{}) {
 	l.Logger.AnalyzerErrorf(l.StreamID, l.Name, format, args...)
+	l.Stats.errors.Add(1)
+	l.Ring.AutoDump("analyzer error: " + l.Name)
+}
+
+// isClassified returns whether any analyzer has found properties for a stream.
+func isClassified(props analyzer.CombinedPropMap) bool {
+	for _, m := range props {
+		if len(m) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 func processPropUpdate(cpm analyzer.CombinedPropMap, name string, update *analyzer.PropUpdate) (updated bool) {
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// uuidPrefix is the random upper half of the stream UUIDs, drawn once per process,
+// as stream IDs are only unique within a process.
+var uuidPrefix = func() (p [8]byte) {
+	_, _ = rand.Read(p[:])
+	return
+}()
+
+// StreamUUID returns the UUID of a stream, which identifies it across all outputs (events, logs,
+// captures & traces) and instances. It's a version 8 UUID (RFC 9562) made of the process' random
+// prefix and the stream ID, the latter being unique within the process, so no per-stream randomness is needed.
+// The variant bits overwrite the 2 upper bits of the stream ID, which are 0 until 2045 (with the default snowflake epoch).
+func StreamUUID(id int64) string {
+	var u [16]byte
+	copy(u[:8], uuidPrefix[:])
+	binary.BigEndian.PutUint64(u[8:], uint64(id))
+	u[6] = u[6]&0x0f | 0x80 // Version 8
+	u[8] = u[8]&0x3f | 0x80 // Variant 10
+	var s [36]byte
+	hex.Encode(s[0:8], u[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], u[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], u[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], u[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], u[10:])
+	return string(s[:])
+}
@@ -2,6 +2,9 @@ package engine
 
 import (
 	"context"
+	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/apernet/OpenGFW/io"
 	"github.com/apernet/OpenGFW/ruleset"
@@ -17,18 +20,36 @@ const (
 	defaultTCPMaxBufferedPagesTotal         = 4096
 	defaultTCPMaxBufferedPagesPerConnection = 64
 	defaultUDPMaxStreams                    = 4096
+	defaultSCTPMaxStreams                   = 4096
+	defaultICMPMaxStreams                   = 4096
+	maxStreamFlushInterval                  = 10 * time.Second
 )
 
 type workerPacket struct {
 	StreamID   uint32
 	Packet     gopacket.Packet
-	SetVerdict func(io.Verdict, []byte) error
+	IO         string // Name of the IO the packet came from
+	SetVerdict func(io.Verdict, uint32, []byte) error
+	Inject     func([]byte) error // nil if the packet's IO can't inject packets
+	Received   time.Time          // Only set if tracing is enabled
 }
 
 type worker struct {
 	id         int
 	packetChan chan *workerPacket
+	queryChan  chan func() // Run by the worker's goroutine between packets
 	logger     Logger
+	tracer     Tracer
+	idsOnly    *atomic.Bool
+	ring       *packetRing // nil if not enabled
+	held       *heldPackets
+
+	analyzerStats *analyzerStatsSet // Shared by the TCP & UDP stream factories
+	counters      *workerCounters
+
+	idleTimeout time.Duration  // 0 = never
+	noOffload   bool           // Whether streams are never offloaded to the kernel, for accounting
+	ipv6Ext     *IPv6ExtPolicy // nil if IPv6 extension headers aren't limited
 
 	tcpStreamFactory *tcpStreamFactory
 	tcpStreamPool    *reassembly.StreamPool
@@ -37,6 +58,12 @@ type worker struct {
 	udpStreamFactory *udpStreamFactory
 	udpStreamManager *udpStreamManager
 
+	sctpStreamFactory *sctpStreamFactory
+	sctpStreamManager *sctpStreamManager
+
+	icmpStreamFactory *icmpStreamFactory
+	icmpStreamManager *icmpStreamManager
+
 	modSerializeBuffer gopacket.SerializeBuffer
 }
 
@@ -48,6 +75,28 @@ type workerConfig struct {
 	TCPMaxBufferedPagesTotal   int
 	TCPMaxBufferedPagesPerConn int
 	UDPMaxStreams              int
+	SCTPMaxStreams             int
+	ICMPMaxStreams             int
+	StreamIdleTimeout          time.Duration
+	UnmatchedVerdict           DefaultVerdict
+	UnclassifiedVerdict        DefaultVerdict
+	Capturer                   PacketSink
+	HTTPCapturer               PacketSink
+	Mirror                     PacketSink
+	CaptureLookback            int
+	Tracer                     Tracer
+	IDSOnly                    *atomic.Bool
+	Degraded                   *atomic.Pointer[Degradation]
+	StateSync                  StateSync
+	Accounting                 Accounting
+	QoS                        QoSMarker
+	IPv6Ext                    *IPv6ExtPolicy
+	TCPEvasion                 *TCPEvasionPolicy
+	External                   map[string]bool // External interfaces
+	Asymmetric                 *AsymmetricPolicy
+	PacketRing                 int
+	PacketRingDumper           PacketRingDumper
+	Held                       *heldPackets // Shared by all workers
 }
 
 func (c *workerConfig) fillDefaults() {
@@ -63,6 +112,21 @@ func (c *workerConfig) fillDefaults() {
 	if c.UDPMaxStreams <= 0 {
 		c.UDPMaxStreams = defaultUDPMaxStreams
 	}
+	if c.SCTPMaxStreams <= 0 {
+		c.SCTPMaxStreams = defaultSCTPMaxStreams
+	}
+	if c.ICMPMaxStreams <= 0 {
+		c.ICMPMaxStreams = defaultICMPMaxStreams
+	}
+	if c.IDSOnly == nil {
+		c.IDSOnly = &atomic.Bool{}
+	}
+	if c.Degraded == nil {
+		c.Degraded = &atomic.Pointer[Degradation]{}
+	}
+	if c.Held == nil {
+		c.Held = newHeldPackets(0, 0)
+	}
 }
 
 func newWorker(config workerConfig) (*worker, error) {
@@ -71,115 +135,424 @@ func newWorker(config workerConfig) (*worker, error) {
 	if err != nil {
 		return nil, err
 	}
+	ring := newPacketRing(config.ID, config.PacketRing, config.PacketRingDumper, config.Logger)
+	analyzerStats := newAnalyzerStatsSet()
+	counters := &workerCounters{}
+	sfConfig := streamFactoryConfig{
+		WorkerID:            config.ID,
+		Logger:              config.Logger,
+		Node:                sfNode,
+		External:            config.External,
+		UnmatchedVerdict:    config.UnmatchedVerdict,
+		UnclassifiedVerdict: config.UnclassifiedVerdict,
+		Capturer:            config.Capturer,
+		Mirror:              config.Mirror,
+		CaptureLookback:     config.CaptureLookback,
+		Tracer:              config.Tracer,
+		Ring:                ring,
+		AnalyzerStats:       analyzerStats,
+		Counters:            counters,
+		Degraded:            config.Degraded,
+		StateSync:           config.StateSync,
+		Accounting:          config.Accounting,
+		QoS:                 config.QoS,
+	}
 	tcpSF := &tcpStreamFactory{
-		WorkerID: config.ID,
-		Logger:   config.Logger,
-		Node:     sfNode,
-		Ruleset:  config.Ruleset,
+		streamFactoryConfig: sfConfig,
+		HTTPCapturer:        config.HTTPCapturer,
+		Evasion:             config.TCPEvasion,
+		Asymmetric:          config.Asymmetric,
+		Ruleset:             config.Ruleset,
+		Streams:             make(map[int64]*tcpStream),
 	}
 	tcpStreamPool := reassembly.NewStreamPool(tcpSF)
 	tcpAssembler := reassembly.NewAssembler(tcpStreamPool)
 	tcpAssembler.MaxBufferedPagesTotal = config.TCPMaxBufferedPagesTotal
 	tcpAssembler.MaxBufferedPagesPerConnection = config.TCPMaxBufferedPagesPerConn
 	udpSF := &udpStreamFactory{
-		WorkerID: config.ID,
-		Logger:   config.Logger,
-		Node:     sfNode,
-		Ruleset:  config.Ruleset,
+		streamFactoryConfig: sfConfig,
+		Ruleset:             config.Ruleset,
 	}
 	udpSM, err := newUDPStreamManager(udpSF, config.UDPMaxStreams)
 	if err != nil {
 		return nil, err
 	}
+	sctpSF := &sctpStreamFactory{
+		streamFactoryConfig: sfConfig,
+		Ruleset:             config.Ruleset,
+	}
+	sctpSM, err := newSCTPStreamManager(sctpSF, config.SCTPMaxStreams)
+	if err != nil {
+		return nil, err
+	}
+	icmpSF := &icmpStreamFactory{
+		streamFactoryConfig: sfConfig,
+		Ruleset:             config.Ruleset,
+	}
+	icmpSM, err := newICMPStreamManager(icmpSF, config.ICMPMaxStreams)
+	if err != nil {
+		return nil, err
+	}
 	return &worker{
 		id:                 config.ID,
 		packetChan:         make(chan *workerPacket, config.ChanSize),
+		queryChan:          make(chan func()),
 		logger:             config.Logger,
+		tracer:             config.Tracer,
+		idsOnly:            config.IDSOnly,
+		ring:               ring,
+		held:               config.Held,
+		analyzerStats:      analyzerStats,
+		counters:           counters,
+		idleTimeout:        config.StreamIdleTimeout,
+		noOffload:          config.Accounting != nil,
+		ipv6Ext:            config.IPv6Ext,
 		tcpStreamFactory:   tcpSF,
 		tcpStreamPool:      tcpStreamPool,
 		tcpAssembler:       tcpAssembler,
 		udpStreamFactory:   udpSF,
 		udpStreamManager:   udpSM,
+		sctpStreamFactory:  sctpSF,
+		sctpStreamManager:  sctpSM,
+		icmpStreamFactory:  icmpSF,
+		icmpStreamManager:  icmpSM,
 		modSerializeBuffer: gopacket.NewSerializeBuffer(),
 	}, nil
 }
 
 func (w *worker) Feed(p *workerPacket) {
-	w.packetChan <- p
+	select {
+	case w.packetChan <- p:
+	default:
+		w.counters.queueFull.Add(1)
+		w.packetChan <- p
+	}
 }
 
 func (w *worker) Run(ctx context.Context) {
 	w.logger.WorkerStart(w.id)
 	defer w.logger.WorkerStop(w.id)
+	if w.ring != nil {
+		defer w.ring.DumpOnPanic()
+	}
+	var flushChan <-chan time.Time // nil if streams never go idle
+	if w.idleTimeout > 0 {
+		interval := w.idleTimeout
+		if interval > maxStreamFlushInterval {
+			interval = maxStreamFlushInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		flushChan = ticker.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case f := <-w.queryChan:
+			f()
+		case now := <-flushChan:
+			w.closeIdleStreams(now.Add(-w.idleTimeout))
 		case wPkt := <-w.packetChan:
 			if wPkt == nil {
 				// Closed
 				return
 			}
-			v, b := w.handle(wPkt.StreamID, wPkt.Packet)
-			_ = wPkt.SetVerdict(v, b)
+			var trace *PacketTrace
+			if w.tracer != nil {
+				trace = &PacketTrace{WorkerID: w.id, Received: wPkt.Received, Handled: time.Now()}
+			}
+			w.ring.Packet(wPkt.Packet.Metadata().CaptureInfo, wPkt.Packet.Data())
+			idsOnly := w.idsOnly.Load()
+			if idsOnly {
+				wPkt.Inject = nil
+			}
+			v := w.handle(wPkt, trace)
+			if idsOnly {
+				v = passiveVerdict(v)
+			}
+			if w.noOffload && v.Verdict == io.VerdictAcceptStream {
+				v.Verdict = io.VerdictAccept
+			}
+			processed := time.Now()
+			w.counters.latency.Add(int64(processed.Sub(wPkt.Packet.Metadata().Timestamp)))
+			if trace != nil {
+				trace.Processed = processed
+			}
+			v = w.held.Verdict(wPkt.StreamID, v)
+			if v.Delay > 0 {
+				if v.Packet != nil {
+					// The serialize buffer will be reused by the next packet
+					v.Packet = append([]byte(nil), v.Packet...)
+				}
+				time.AfterFunc(v.Delay, func() {
+					w.setVerdict(wPkt, v, trace)
+					w.held.Release(wPkt.StreamID)
+				})
+			} else {
+				w.setVerdict(wPkt, v, trace)
+			}
 		}
 	}
 }
 
+// closeIdleStreams ends the streams whose latest packet is older than cutoff.
+func (w *worker) closeIdleStreams(cutoff time.Time) {
+	w.tcpAssembler.FlushCloseOlderThan(cutoff)
+	w.udpStreamManager.CloseIdle(cutoff)
+	w.sctpStreamManager.CloseIdle(cutoff)
+	w.icmpStreamManager.CloseIdle(cutoff)
+}
+
+// setVerdict submits the verdict of a packet, and reports its trace if tracing is enabled.
+func (w *worker) setVerdict(wPkt *workerPacket, v workerVerdict, trace *PacketTrace) {
+	w.counters.Verdict(v.Verdict)
+	if trace == nil {
+		_ = wPkt.SetVerdict(v.Verdict, v.Mark, v.Packet)
+		return
+	}
+	trace.Verdict = v.Verdict
+	trace.Delay = v.Delay
+	trace.VerdictStart = time.Now()
+	_ = wPkt.SetVerdict(v.Verdict, v.Mark, v.Packet)
+	trace.Done = time.Now()
+	w.tracer.PacketDone(trace)
+}
+
+// passiveVerdict turns a verdict into one that lets the packet through unchanged, for IDS-only mode.
+// Streams are still offloaded once they have a final verdict.
+func passiveVerdict(v workerVerdict) workerVerdict {
+	switch v.Verdict {
+	case io.VerdictAcceptStream, io.VerdictDropStream, io.VerdictDivertStream, io.VerdictHoneypotStream:
+		return workerVerdict{Verdict: io.VerdictAcceptStream}
+	default:
+		return workerVerdict{Verdict: io.VerdictAccept}
+	}
+}
+
 func (w *worker) UpdateRuleset(r ruleset.Ruleset) error {
 	if err := w.tcpStreamFactory.UpdateRuleset(r); err != nil {
 		return err
 	}
-	return w.udpStreamFactory.UpdateRuleset(r)
+	if err := w.udpStreamFactory.UpdateRuleset(r); err != nil {
+		return err
+	}
+	if err := w.sctpStreamFactory.UpdateRuleset(r); err != nil {
+		return err
+	}
+	return w.icmpStreamFactory.UpdateRuleset(r)
 }
 
-func (w *worker) handle(streamID uint32, p gopacket.Packet) (io.Verdict, []byte) {
+// workerVerdict is the result of handling a single packet.
+type workerVerdict struct {
+	Verdict io.Verdict
+	Mark    uint32        // User mark of the stream, 0 if none
+	Packet  []byte        // Modified packet, only for io.VerdictAcceptModify
+	Delay   time.Duration // How long to hold the packet before issuing the verdict
+	Tarpit  bool          // Whether the packet is held by a tarpit, dropped if it can't be held
+}
+
+func (w *worker) handle(wPkt *workerPacket, trace *PacketTrace) workerVerdict {
+	streamID, p := wPkt.StreamID, wPkt.Packet
+	// Extension headers are parsed once, for the policy, the upper-layer header & the stream
+	var ext *ipv6Ext
+	if e, ok := parseIPv6Ext(p.Data()); ok {
+		ext = &e
+		if w.ipv6Ext != nil && w.checkIPv6Ext(p.Data(), ext) {
+			return workerVerdict{Verdict: io.VerdictDrop}
+		}
+	}
 	netLayer, trLayer := p.NetworkLayer(), p.TransportLayer()
+	if netLayer != nil && trLayer == nil && p.ErrorLayer() != nil && ext != nil {
+		// Extension headers gopacket can't decode, e.g. IPv6 routing headers other than type 0
+		if upper, offset := decodeIPv6Upper(p.Data(), ext); upper != nil {
+			trLayer = upper
+		} else if offset > 0 {
+			return w.handleICMP(netLayer, p.Metadata(), true, p.Data()[offset:], p.Data(), ext, wPkt.IO, trace)
+		}
+	}
+	if netLayer != nil && trLayer == nil {
+		// ICMP isn't a transport layer to gopacket
+		if icmp, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			return w.handleICMP(netLayer, p.Metadata(), false, icmpMessage(icmp.Contents, icmp.Payload), p.Data(), ext, wPkt.IO, trace)
+		}
+		if icmp, ok := p.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			return w.handleICMP(netLayer, p.Metadata(), true, icmpMessage(icmp.Contents, icmp.Payload), p.Data(), ext, wPkt.IO, trace)
+		}
+	}
 	if netLayer == nil || trLayer == nil {
 		// Invalid packet
-		return io.VerdictAccept, nil
+		return workerVerdict{Verdict: io.VerdictAccept}
 	}
-	ipFlow := netLayer.NetworkFlow()
 	switch tr := trLayer.(type) {
 	case *layers.TCP:
-		return w.handleTCP(ipFlow, p.Metadata(), tr), nil
+		v, modPayload := w.handleTCP(netLayer, p.Metadata(), tr, p.Data(), ext, wPkt.IO, wPkt.Inject, trace)
+		if v.Verdict == io.VerdictAcceptModify && v.Packet == nil {
+			// TCP or IP header (e.g. window, sequence numbers, TTL) has been modified in place
+			if modPayload != nil {
+				tr.Payload = modPayload
+			}
+			_ = tr.SetNetworkLayerForChecksum(netLayer)
+			v.Packet = w.serializeModified(p)
+			if v.Packet == nil {
+				v.Verdict = io.VerdictAccept
+			}
+		}
+		return v
 	case *layers.UDP:
-		v, modPayload := w.handleUDP(streamID, ipFlow, tr)
-		if v == io.VerdictAcceptModify && modPayload != nil {
-			tr.Payload = modPayload
+		v, modPayload := w.handleUDP(streamID, netLayer, p.Metadata(), tr, p.Data(), ext, wPkt.IO, wPkt.Inject, trace)
+		if v.Verdict == io.VerdictAcceptModify {
+			// Payload and/or IP header modified
+			if modPayload != nil {
+				tr.Payload = modPayload
+			}
 			_ = tr.SetNetworkLayerForChecksum(netLayer)
-			_ = w.modSerializeBuffer.Clear()
-			err := gopacket.SerializePacket(w.modSerializeBuffer,
-				gopacket.SerializeOptions{
-					FixLengths:       true,
-					ComputeChecksums: true,
-				}, p)
-			if err != nil {
+			v.Packet = w.serializeModified(p)
+			if v.Packet == nil {
 				// Just accept without modification for now
-				return io.VerdictAccept, nil
+				v.Verdict = io.VerdictAccept
 			}
-			return v, w.modSerializeBuffer.Bytes()
 		}
-		return v, nil
+		return v
+	case *layers.SCTP:
+		return w.handleSCTP(netLayer, p.Metadata(), tr, p.Data(), ext, wPkt.IO, trace)
 	default:
 		// Unsupported protocol
-		return io.VerdictAccept, nil
+		return workerVerdict{Verdict: io.VerdictAccept}
+	}
+}
+
+// serializeModified serializes a packet whose layers have been modified, up to its transport layer
+// followed by the payload of that layer, as the layers decoded from the payload (e.g. DNS) still have
+// the original one. It returns nil if serialization fails.
+func (w *worker) serializeModified(p gopacket.Packet) []byte {
+	var sls []gopacket.SerializableLayer
+	for _, l := range p.Layers() {
+		sl, ok := l.(gopacket.SerializableLayer)
+		if !ok {
+			return nil
+		}
+		sls = append(sls, sl)
+		if tr, ok := l.(gopacket.TransportLayer); ok {
+			sls = append(sls, gopacket.Payload(tr.LayerPayload()))
+			break
+		}
+	}
+	_ = w.modSerializeBuffer.Clear()
+	err := gopacket.SerializeLayers(w.modSerializeBuffer,
+		gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		}, sls...)
+	if err != nil {
+		return nil
 	}
+	return w.modSerializeBuffer.Bytes()
 }
 
-func (w *worker) handleTCP(ipFlow gopacket.Flow, pMeta *gopacket.PacketMetadata, tcp *layers.TCP) io.Verdict {
+func (w *worker) handleTCP(netLayer gopacket.NetworkLayer, pMeta *gopacket.PacketMetadata, tcp *layers.TCP, data []byte, ext *ipv6Ext, ioName string, inject func([]byte) error, trace *PacketTrace) (workerVerdict, []byte) {
 	ctx := &tcpContext{
 		PacketMetadata: pMeta,
 		Verdict:        tcpVerdictAccept,
+		Data:           data,
+		IPv6Ext:        ext,
+		IO:             ioName,
+		Inject:         inject,
+		TCP:            tcp,
+		Trace:          trace,
 	}
-	w.tcpAssembler.AssembleWithContext(ipFlow, tcp, ctx)
-	return io.Verdict(ctx.Verdict)
+	w.tcpAssembler.AssembleWithContext(netLayer.NetworkFlow(), tcp, ctx)
+	v := workerVerdict{Verdict: io.Verdict(ctx.Verdict), Mark: ctx.Mark, Packet: ctx.Packet}
+	if ctx.Tarpit != nil {
+		v.Delay, v.Tarpit = ctx.Tarpit.Delay, ctx.Tarpit.Delay > 0
+		if ctx.Tarpit.Window > 0 && tcp.Window > ctx.Tarpit.Window {
+			tcp.Window = ctx.Tarpit.Window
+			v.Verdict = io.VerdictAcceptModify
+		}
+	}
+	v.Delay += ctx.Delay
+	modPayload := ctx.Payload
+	if ctx.Rewrite != nil && v.Verdict == io.VerdictAccept {
+		rv, payload, extra := ctx.Rewrite.process(tcp, ctx.Rev, inject != nil)
+		switch rv {
+		case tcpRewriteModified:
+			v.Verdict = io.VerdictAcceptModify
+			modPayload = payload
+		case tcpRewriteDrop:
+			v.Verdict = io.VerdictDrop
+		}
+		for _, seg := range extra {
+			if err := injectSegment(inject, netLayer, tcp, seg); err != nil {
+				break
+			}
+		}
+	}
+	if ctx.IPMod != nil && v.Packet == nil && (v.Verdict == io.VerdictAccept || v.Verdict == io.VerdictAcceptModify) &&
+		ctx.IPMod.ModifyIP(netLayer, ctx.Rev) {
+		v.Verdict = io.VerdictAcceptModify
+	}
+	return v, modPayload
 }
 
-func (w *worker) handleUDP(streamID uint32, ipFlow gopacket.Flow, udp *layers.UDP) (io.Verdict, []byte) {
+func (w *worker) handleUDP(streamID uint32, netLayer gopacket.NetworkLayer, pMeta *gopacket.PacketMetadata, udp *layers.UDP, data []byte, ext *ipv6Ext, ioName string, inject func([]byte) error, trace *PacketTrace) (workerVerdict, []byte) {
 	ctx := &udpContext{
-		Verdict: udpVerdictAccept,
+		PacketMetadata: pMeta,
+		Verdict:        udpVerdictAccept,
+		Data:           data,
+		IPv6Ext:        ext,
+		IO:             ioName,
+		Inject:         inject,
+		Trace:          trace,
+	}
+	w.udpStreamManager.MatchWithContext(streamID, netLayer.NetworkFlow(), udp, ctx)
+	v := workerVerdict{Verdict: io.Verdict(ctx.Verdict), Mark: ctx.Mark, Delay: ctx.Delay}
+	if ctx.IPMod != nil && (v.Verdict == io.VerdictAccept || v.Verdict == io.VerdictAcceptModify) &&
+		ctx.IPMod.ModifyIP(netLayer, ctx.Rev) {
+		v.Verdict = io.VerdictAcceptModify
+	}
+	return v, ctx.Packet
+}
+
+func (w *worker) handleSCTP(netLayer gopacket.NetworkLayer, pMeta *gopacket.PacketMetadata, sctp *layers.SCTP, data []byte, ext *ipv6Ext, ioName string, trace *PacketTrace) workerVerdict {
+	ctx := &sctpContext{
+		PacketMetadata: pMeta,
+		Verdict:        sctpVerdictAccept,
+		Data:           data,
+		IPv6Ext:        ext,
+		IO:             ioName,
+		Trace:          trace,
+	}
+	w.sctpStreamManager.MatchWithContext(netLayer.NetworkFlow(), sctp, ctx)
+	return workerVerdict{Verdict: io.Verdict(ctx.Verdict), Mark: ctx.Mark, Delay: ctx.Delay}
+}
+
+func (w *worker) handleICMP(netLayer gopacket.NetworkLayer, pMeta *gopacket.PacketMetadata, v6 bool, msg []byte, data []byte, ext *ipv6Ext, ioName string, trace *PacketTrace) workerVerdict {
+	ctx := &icmpContext{
+		PacketMetadata: pMeta,
+		Verdict:        icmpVerdictAccept,
+		Data:           data,
+		IPv6Ext:        ext,
+		IO:             ioName,
+		Trace:          trace,
+	}
+	flow := netLayer.NetworkFlow()
+	w.icmpStreamManager.MatchWithContext(net.IP(flow.Src().Raw()), net.IP(flow.Dst().Raw()), v6, msg, ctx)
+	return workerVerdict{Verdict: io.Verdict(ctx.Verdict), Mark: ctx.Mark, Delay: ctx.Delay}
+}
+
+// checkIPv6Ext applies the extension header policy to a packet, and returns whether it must be dropped.
+func (w *worker) checkIPv6Ext(data []byte, ext *ipv6Ext) bool {
+	reason := w.ipv6Ext.check(ext)
+	if reason == "" {
+		return false
 	}
-	w.udpStreamManager.MatchWithContext(streamID, ipFlow, udp, ctx)
-	return io.Verdict(ctx.Verdict), ctx.Packet
+	w.counters.anomalies.Add(1)
+	w.logger.PacketAnomaly(PacketAnomaly{
+		WorkerID: w.id,
+		SrcIP:    net.IP(data[8:24]),
+		DstIP:    net.IP(data[24:40]),
+		Reason:   reason,
+		Dropped:  !w.ipv6Ext.LogOnly,
+	})
+	return !w.ipv6Ext.LogOnly
 }
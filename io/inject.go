@@ -0,0 +1,67 @@
+package io
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// PacketInjector is implemented by packet IOs that can send packets of their own,
+// e.g. to answer a client on behalf of the server.
+type PacketInjector interface {
+	// InjectPacket sends an IP packet (starting with the IP header) to its destination.
+	InjectPacket(data []byte) error
+}
+
+var errInvalidInjectPacket = errors.New("invalid ip packet")
+
+// rawInjector sends IP packets through raw sockets, opened on first use.
+// The packets are sent with the given fwmark, so that they can be told apart
+// from the packets of the streams being processed.
+type rawInjector struct {
+	mark int
+
+	once     sync.Once
+	fd4, fd6 int
+	err      error
+}
+
+func newRawInjector(mark int) *rawInjector {
+	return &rawInjector{mark: mark, fd4: -1, fd6: -1}
+}
+
+func (r *rawInjector) open() {
+	r.fd4, r.err = r.socket(unix.AF_INET)
+	if r.err != nil {
+		return
+	}
+	r.fd6, r.err = r.socket(unix.AF_INET6)
+}
+
+func (r *rawInjector) InjectPacket(data []byte) error {
+	r.once.Do(r.open)
+	if r.err != nil {
+		return r.err
+	}
+	if len(data) >= 20 && data[0]>>4 == 4 {
+		addr := &unix.SockaddrInet4{}
+		copy(addr.Addr[:], data[16:20])
+		return unix.Sendto(r.fd4, data, 0, addr)
+	}
+	if len(data) >= 40 && data[0]>>4 == 6 {
+		addr := &unix.SockaddrInet6{}
+		copy(addr.Addr[:], data[24:40])
+		return unix.Sendto(r.fd6, data, 0, addr)
+	}
+	return errInvalidInjectPacket
+}
+
+func (r *rawInjector) Close() error {
+	for _, fd := range []int{r.fd4, r.fd6} {
+		if fd >= 0 {
+			_ = unix.Close(fd)
+		}
+	}
+	return nil
+}
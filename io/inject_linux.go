@@ -0,0 +1,16 @@
+package io
+
+import "golang.org/x/sys/unix"
+
+func (r *rawInjector) socket(family int) (int, error) {
+	// IPPROTO_RAW implies IP_HDRINCL/IPV6_HDRINCL
+	fd, err := unix.Socket(family, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_RAW)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, r.mark); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
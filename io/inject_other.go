@@ -0,0 +1,12 @@
+//go:build !linux
+
+package io
+
+import "errors"
+
+// Packets can't be told apart from those of the streams being processed without fwmarks.
+var errInjectUnsupported = errors.New("injecting packets is only supported on Linux")
+
+func (r *rawInjector) socket(family int) (int, error) {
+	return -1, errInjectUnsupported
+}
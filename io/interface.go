@@ -2,6 +2,7 @@ package io
 
 import (
 	"context"
+	"errors"
 )
 
 type Verdict int
@@ -17,8 +18,20 @@ const (
 	VerdictDrop
 	// VerdictDropStream drops the packet and blocks the stream.
 	VerdictDropStream
+	// VerdictDivertStream is like VerdictDropStream, but also makes new TCP connections
+	// from the same client to the same server & port be redirected to the divert port
+	// for a while, so that the client's next attempt goes there instead.
+	// Packet IOs that don't support diverting treat it as VerdictDropStream.
+	VerdictDivertStream
+	// VerdictHoneypotStream is like VerdictDivertStream, but the client's new TCP connections
+	// to the same server & port are DNATed to the honeypot instead of the divert port.
+	// Packet IOs that don't support it treat it as VerdictDropStream.
+	VerdictHoneypotStream
 )
 
+// MaxMark is the maximum user mark value supported by SetVerdictWithMark.
+const MaxMark = 0xFFFE
+
 // Packet represents an IP packet.
 type Packet interface {
 	// StreamID is the ID of the stream the packet belongs to.
@@ -27,6 +40,21 @@ type Packet interface {
 	Data() []byte
 }
 
+// InterfacePacket is implemented by packets that know the network interfaces they cross.
+type InterfacePacket interface {
+	// InterfaceIndex is the index of the input interface, 0 if unknown or locally generated.
+	InterfaceIndex() int
+	// OutInterfaceIndex is the index of the output interface, 0 if unknown or locally received.
+	OutInterfaceIndex() int
+}
+
+// OwnerPacket is implemented by packets that know the owner of their local socket.
+type OwnerPacket interface {
+	// Owner returns the UID & GID of the owner of the local socket the packet comes from or goes to,
+	// ok false if unknown or not local.
+	Owner() (uid, gid uint32, ok bool)
+}
+
 // PacketCallback is called for each packet received.
 // Return false to "unregister" and stop receiving packets.
 // It must be safe for concurrent use.
@@ -39,10 +67,33 @@ type PacketIO interface {
 	Register(context.Context, PacketCallback) error
 	// SetVerdict sets the verdict for a packet.
 	SetVerdict(Packet, Verdict, []byte) error
+	// SetVerdictWithMark is like SetVerdict, but also attaches a user mark to the
+	// packet's stream, for consumption by tc and policy routing.
+	// The mark is only meaningful for VerdictAcceptStream, and must be within MaxMark.
+	SetVerdictWithMark(Packet, Verdict, uint32) error
 	// Close closes the packet IO.
 	Close() error
 }
 
+// HealthChecker is implemented by packet IOs that can tell whether they are still working,
+// e.g. still attached to their queue, with their firewall rules in place.
+type HealthChecker interface {
+	// Health returns nil if the IO is healthy, or what's wrong with it.
+	Health() error
+}
+
+// RuleRemover is implemented by packet IOs that install firewall rules to get their packets.
+type RuleRemover interface {
+	// RemoveRules removes the firewall rules, so that no more packets are queued to the IO,
+	// while those already queued can still be received and given verdicts. Close removes them too,
+	// if they haven't been.
+	RemoveRules() error
+}
+
+// ErrEndOfInput is passed to the callback by packet IOs with finite input
+// (e.g. pcap files) once all packets have been read and given verdicts.
+var ErrEndOfInput = errors.New("end of input")
+
 type ErrInvalidPacket struct {
 	Err error
 }
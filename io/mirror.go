@@ -0,0 +1,131 @@
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	MirrorTypeInterface = "interface" // Ethernet frames sent out a local interface
+	MirrorTypeGRE       = "gre"       // GRE tunnel to a remote host
+	MirrorTypeVXLAN     = "vxlan"     // VXLAN tunnel to a remote host
+
+	defaultVXLANPort = "4789"
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+)
+
+var (
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	// vxlanSrcMAC is the source MAC of the inner frames of VXLAN mirrors, which have no real source.
+	vxlanSrcMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+)
+
+type PacketMirrorConfig struct {
+	Type      string
+	Interface string           // For MirrorTypeInterface
+	DstMAC    net.HardwareAddr // For MirrorTypeInterface & MirrorTypeVXLAN, default broadcast
+	Remote    string           // For MirrorTypeGRE (host) & MirrorTypeVXLAN (host[:port])
+	VNI       uint32           // For MirrorTypeVXLAN
+}
+
+// PacketMirror sends copies of raw IP packets to an interface or a tunnel endpoint,
+// for traffic analysis by an external box. It is safe for concurrent use.
+type PacketMirror struct {
+	config PacketMirrorConfig
+	srcMAC net.HardwareAddr
+	send   func(data []byte) error
+	close  func() error
+}
+
+func NewPacketMirror(config PacketMirrorConfig) (*PacketMirror, error) {
+	if config.DstMAC == nil {
+		config.DstMAC = broadcastMAC
+	}
+	m := &PacketMirror{config: config}
+	switch strings.ToLower(config.Type) {
+	case MirrorTypeInterface:
+		if err := m.openInterface(); err != nil {
+			return nil, err
+		}
+	case MirrorTypeGRE:
+		ip, err := net.ResolveIPAddr("ip", config.Remote)
+		if err != nil {
+			return nil, err
+		}
+		network := "ip4:gre"
+		if ip.IP.To4() == nil {
+			network = "ip6:gre"
+		}
+		conn, err := net.DialIP(network, nil, ip)
+		if err != nil {
+			return nil, err
+		}
+		m.send = func(data []byte) error {
+			// Basic GRE header without any optional fields
+			buf := make([]byte, 4+len(data))
+			binary.BigEndian.PutUint16(buf[2:], etherTypeOf(data))
+			copy(buf[4:], data)
+			_, err := conn.Write(buf)
+			return err
+		}
+		m.close = conn.Close
+	case MirrorTypeVXLAN:
+		remote := config.Remote
+		if _, _, err := net.SplitHostPort(remote); err != nil {
+			remote = net.JoinHostPort(remote, defaultVXLANPort)
+		}
+		conn, err := net.Dial("udp", remote)
+		if err != nil {
+			return nil, err
+		}
+		m.srcMAC = vxlanSrcMAC
+		var header [8]byte
+		header[0] = 0x08 // VNI present
+		binary.BigEndian.PutUint32(header[4:], config.VNI<<8)
+		m.send = func(data []byte) error {
+			_, err := conn.Write(m.ethernetFrame(header[:], data))
+			return err
+		}
+		m.close = conn.Close
+	default:
+		return nil, fmt.Errorf("unsupported mirror type %q", config.Type)
+	}
+	return m, nil
+}
+
+// ethernetFrame returns the packet in an Ethernet frame, after the given prefix.
+func (m *PacketMirror) ethernetFrame(prefix, data []byte) []byte {
+	buf := make([]byte, len(prefix)+14+len(data))
+	copy(buf, prefix)
+	eth := buf[len(prefix):]
+	copy(eth[0:6], m.config.DstMAC)
+	copy(eth[6:12], m.srcMAC)
+	binary.BigEndian.PutUint16(eth[12:], etherTypeOf(data))
+	copy(eth[14:], data)
+	return buf
+}
+
+// WritePacket mirrors a packet starting with the IP header.
+func (m *PacketMirror) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return m.send(data)
+}
+
+func (m *PacketMirror) Close() error {
+	return m.close()
+}
+
+func etherTypeOf(data []byte) uint16 {
+	if len(data) > 0 && data[0]>>4 == 6 {
+		return etherTypeIPv6
+	}
+	return etherTypeIPv4
+}
@@ -0,0 +1,28 @@
+package io
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// openInterface sets up the mirror to send Ethernet frames out its interface, through a packet socket.
+func (m *PacketMirror) openInterface() error {
+	iface, err := net.InterfaceByName(m.config.Interface)
+	if err != nil {
+		return err
+	}
+	// Protocol 0 means nothing is received on the socket
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	addr := &unix.SockaddrLinklayer{Ifindex: iface.Index, Halen: 6}
+	copy(addr.Addr[:], m.config.DstMAC)
+	m.srcMAC = iface.HardwareAddr
+	m.send = func(data []byte) error {
+		return unix.Sendto(fd, m.ethernetFrame(nil, data), 0, addr)
+	}
+	m.close = func() error { return unix.Close(fd) }
+	return nil
+}
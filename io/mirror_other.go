@@ -0,0 +1,11 @@
+//go:build !linux
+
+package io
+
+import "errors"
+
+var errMirrorInterfaceUnsupported = errors.New("mirroring to an interface is only supported on Linux")
+
+func (m *PacketMirror) openInterface() error {
+	return errMirrorInterfaceUnsupported
+}
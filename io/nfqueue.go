@@ -5,9 +5,12 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/florianl/go-nfqueue"
@@ -16,28 +19,86 @@ import (
 )
 
 const (
-	nfqueueNum              = 100
+	nfqueueDefaultNum       = 100
 	nfqueueMaxPacketLen     = 0xFFFF
 	nfqueueDefaultQueueSize = 128
 
 	nfqueueConnMarkAccept = 1001
 	nfqueueConnMarkDrop   = 1002
 
-	nftFamily = "inet"
-	nftTable  = "opengfw"
+	// nfqueueMarkInject is the packet mark of injected packets,
+	// which must not be queued again in local mode.
+	nfqueueMarkInject = 1003
+
+	// The lower 16 bits of the connmark are reserved for the verdict marks above,
+	// while user marks are stored in the upper 16 bits, and copied to the packet
+	// mark (fwmark) of the accepted stream's packets for tc/policy routing.
+	nfqueueConnMarkVerdictMask = 0x0000FFFF
+	nfqueueConnMarkUserMask    = 0xFFFF0000
+	nfqueueConnMarkUserShift   = 16
+
+	nftFamily       = "inet"
+	nftDefaultTable = "opengfw"
+
+	nftDivertSet4 = "divert4"
+	nftDivertSet6 = "divert6"
+
+	nftHoneypotSet4 = "honeypot4"
+	nftHoneypotSet6 = "honeypot6"
+
+	defaultDivertTimeout   = 1 * time.Minute
+	defaultHoneypotTimeout = 10 * time.Minute
 )
 
-func generateNftRules(local, rst bool) (*nftTableSpec, error) {
+// BypassMark is the packet mark (fwmark) of the packets OpenGFW sends on its own,
+// which are never queued in local mode.
+const BypassMark = nfqueueMarkInject
+
+// DivertConfig is the configuration for VerdictDivertStream.
+type DivertConfig struct {
+	Port    uint16        // Local port to redirect to, 0 = disabled
+	Timeout time.Duration // How long new connections of a diverted flow are redirected
+}
+
+// HoneypotConfig is the configuration for VerdictHoneypotStream.
+type HoneypotConfig struct {
+	Addr    net.IP        // Address to DNAT to, nil = disabled. Only the streams of its family are redirected
+	Port    uint16        // Port to DNAT to, 0 = the original one
+	Timeout time.Duration // How long new connections of a redirected flow are DNATed
+}
+
+// DSCPMark sets the DSCP of the packets of the accepted streams with a user mark,
+// for the QoS of the routers after this one.
+type DSCPMark struct {
+	Mark uint32 // 1 to MaxMark
+	DSCP uint8  // 0 to 63
+}
+
+// dscpConnMark returns the connmark of the streams accepted with a mark.
+func dscpConnMark(d DSCPMark) uint32 {
+	return nfqueueConnMarkAccept | d.Mark<<nfqueueConnMarkUserShift
+}
+
+func generateNftRules(tableName string, queueNum uint16, local, rst bool, divert DivertConfig, honeypot HoneypotConfig, dscp []DSCPMark) (*nftTableSpec, error) {
 	if local && rst {
 		return nil, errors.New("tcp rst is not supported in local mode")
 	}
+	if local && divert.Port != 0 {
+		return nil, errors.New("divert is not supported in local mode")
+	}
+	if local && honeypot.Addr != nil {
+		return nil, errors.New("honeypot is not supported in local mode")
+	}
 	table := &nftTableSpec{
 		Family: nftFamily,
-		Table:  nftTable,
+		Table:  tableName,
 	}
 	table.Defines = append(table.Defines, fmt.Sprintf("define ACCEPT_CTMARK=%d", nfqueueConnMarkAccept))
 	table.Defines = append(table.Defines, fmt.Sprintf("define DROP_CTMARK=%d", nfqueueConnMarkDrop))
-	table.Defines = append(table.Defines, fmt.Sprintf("define QUEUE_NUM=%d", nfqueueNum))
+	table.Defines = append(table.Defines, fmt.Sprintf("define QUEUE_NUM=%d", queueNum))
+	table.Defines = append(table.Defines, fmt.Sprintf("define VERDICT_MASK=0x%08x", nfqueueConnMarkVerdictMask))
+	table.Defines = append(table.Defines, fmt.Sprintf("define USER_MASK=0x%08x", uint32(nfqueueConnMarkUserMask)))
+	table.Defines = append(table.Defines, fmt.Sprintf("define INJECT_MARK=%d", nfqueueMarkInject))
 	if local {
 		table.Chains = []nftChainSpec{
 			{Chain: "INPUT", Header: "type filter hook input priority filter; policy accept;"},
@@ -50,17 +111,60 @@ func generateNftRules(local, rst bool) (*nftTableSpec, error) {
 	}
 	for i := range table.Chains {
 		c := &table.Chains[i]
-		c.Rules = append(c.Rules, "ct mark $ACCEPT_CTMARK counter accept")
+		if local {
+			c.Rules = append(c.Rules, "meta mark $INJECT_MARK counter accept")
+		}
+		for _, d := range dscp {
+			c.Rules = append(c.Rules, fmt.Sprintf("ct mark 0x%08x ip dscp set %d", dscpConnMark(d), d.DSCP))
+			c.Rules = append(c.Rules, fmt.Sprintf("ct mark 0x%08x ip6 dscp set %d", dscpConnMark(d), d.DSCP))
+		}
+		c.Rules = append(c.Rules, "ct mark and $VERDICT_MASK == $ACCEPT_CTMARK meta mark set ct mark and $USER_MASK counter accept")
 		if rst {
-			c.Rules = append(c.Rules, "ip protocol tcp ct mark $DROP_CTMARK counter reject with tcp reset")
+			c.Rules = append(c.Rules, "ip protocol tcp ct mark and $VERDICT_MASK == $DROP_CTMARK counter reject with tcp reset")
 		}
-		c.Rules = append(c.Rules, "ct mark $DROP_CTMARK counter drop")
+		c.Rules = append(c.Rules, "ct mark and $VERDICT_MASK == $DROP_CTMARK counter drop")
 		c.Rules = append(c.Rules, "counter queue num $QUEUE_NUM bypass")
 	}
+	if divert.Port != 0 {
+		// Client IP . server IP . server port, as the client port changes on every attempt
+		timeout := fmt.Sprintf("flags timeout; timeout %ds;", int(divert.Timeout.Seconds()))
+		table.Sets = []nftSetSpec{
+			{Set: nftDivertSet4, Spec: "type ipv4_addr . ipv4_addr . inet_service; " + timeout},
+			{Set: nftDivertSet6, Spec: "type ipv6_addr . ipv6_addr . inet_service; " + timeout},
+		}
+		table.Chains = append(table.Chains, nftChainSpec{
+			Chain:  "DIVERT",
+			Header: "type nat hook prerouting priority dstnat; policy accept;",
+			Rules: []string{
+				fmt.Sprintf("ip saddr . ip daddr . tcp dport @%s counter redirect to :%d", nftDivertSet4, divert.Port),
+				fmt.Sprintf("ip6 saddr . ip6 daddr . tcp dport @%s counter redirect to :%d", nftDivertSet6, divert.Port),
+			},
+		})
+	}
+	if honeypot.Addr != nil {
+		timeout := fmt.Sprintf("flags timeout; timeout %ds;", int(honeypot.Timeout.Seconds()))
+		// The DNATed connections are accepted without being queued, like accepted streams
+		var rule string
+		if ip4 := honeypot.Addr.To4(); ip4 != nil {
+			table.Sets = append(table.Sets, nftSetSpec{Set: nftHoneypotSet4, Spec: "type ipv4_addr . ipv4_addr . inet_service; " + timeout})
+			rule = fmt.Sprintf("ip saddr . ip daddr . tcp dport @%s ct mark set $ACCEPT_CTMARK counter dnat ip to %s", nftHoneypotSet4, ip4)
+		} else {
+			table.Sets = append(table.Sets, nftSetSpec{Set: nftHoneypotSet6, Spec: "type ipv6_addr . ipv6_addr . inet_service; " + timeout})
+			rule = fmt.Sprintf("ip6 saddr . ip6 daddr . tcp dport @%s ct mark set $ACCEPT_CTMARK counter dnat ip6 to [%s]", nftHoneypotSet6, honeypot.Addr)
+		}
+		if honeypot.Port != 0 {
+			rule += fmt.Sprintf(":%d", honeypot.Port)
+		}
+		table.Chains = append(table.Chains, nftChainSpec{
+			Chain:  "HONEYPOT",
+			Header: "type nat hook prerouting priority dstnat; policy accept;",
+			Rules:  []string{rule},
+		})
+	}
 	return table, nil
 }
 
-func generateIptRules(local, rst bool) ([]iptRule, error) {
+func generateIptRules(queueNum uint16, local, rst bool, dscp []DSCPMark) ([]iptRule, error) {
 	if local && rst {
 		return nil, errors.New("tcp rst is not supported in local mode")
 	}
@@ -70,28 +174,54 @@ func generateIptRules(local, rst bool) ([]iptRule, error) {
 	} else {
 		chains = []string{"FORWARD"}
 	}
-	rules := make([]iptRule, 0, 4*len(chains))
+	acceptMark := fmt.Sprintf("%d/0x%x", nfqueueConnMarkAccept, nfqueueConnMarkVerdictMask)
+	dropMark := fmt.Sprintf("%d/0x%x", nfqueueConnMarkDrop, nfqueueConnMarkVerdictMask)
+	userMask := fmt.Sprintf("0x%x", uint32(nfqueueConnMarkUserMask))
+	rules := make([]iptRule, 0, (6+len(dscp))*len(chains))
 	for _, chain := range chains {
-		rules = append(rules, iptRule{"filter", chain, []string{"-m", "connmark", "--mark", strconv.Itoa(nfqueueConnMarkAccept), "-j", "ACCEPT"}})
+		for _, d := range dscp {
+			// The DSCP target is only allowed in the mangle table
+			rules = append(rules, iptRule{"mangle", chain, []string{"-m", "connmark", "--mark", fmt.Sprintf("0x%x", dscpConnMark(d)), "-j", "DSCP", "--set-dscp", strconv.Itoa(int(d.DSCP))}})
+		}
+		if local {
+			rules = append(rules, iptRule{"filter", chain, []string{"-m", "mark", "--mark", strconv.Itoa(nfqueueMarkInject), "-j", "ACCEPT"}})
+		}
+		rules = append(rules, iptRule{"filter", chain, []string{"-m", "connmark", "--mark", acceptMark, "-j", "CONNMARK", "--restore-mark", "--nfmask", userMask, "--ctmask", userMask}})
+		rules = append(rules, iptRule{"filter", chain, []string{"-m", "connmark", "--mark", acceptMark, "-j", "ACCEPT"}})
 		if rst {
-			rules = append(rules, iptRule{"filter", chain, []string{"-p", "tcp", "-m", "connmark", "--mark", strconv.Itoa(nfqueueConnMarkDrop), "-j", "REJECT", "--reject-with", "tcp-reset"}})
+			rules = append(rules, iptRule{"filter", chain, []string{"-p", "tcp", "-m", "connmark", "--mark", dropMark, "-j", "REJECT", "--reject-with", "tcp-reset"}})
 		}
-		rules = append(rules, iptRule{"filter", chain, []string{"-m", "connmark", "--mark", strconv.Itoa(nfqueueConnMarkDrop), "-j", "DROP"}})
-		rules = append(rules, iptRule{"filter", chain, []string{"-j", "NFQUEUE", "--queue-num", strconv.Itoa(nfqueueNum), "--queue-bypass"}})
+		rules = append(rules, iptRule{"filter", chain, []string{"-m", "connmark", "--mark", dropMark, "-j", "DROP"}})
+		rules = append(rules, iptRule{"filter", chain, []string{"-j", "NFQUEUE", "--queue-num", strconv.Itoa(int(queueNum)), "--queue-bypass"}})
 	}
 
 	return rules, nil
 }
 
-var _ PacketIO = (*nfqueuePacketIO)(nil)
+var (
+	_ PacketIO       = (*nfqueuePacketIO)(nil)
+	_ PacketInjector = (*nfqueuePacketIO)(nil)
+	_ HealthChecker  = (*nfqueuePacketIO)(nil)
+	_ RuleRemover    = (*nfqueuePacketIO)(nil)
+)
 
-var errNotNFQueuePacket = errors.New("not an NFQueue packet")
+var (
+	errNotNFQueuePacket = errors.New("not an NFQueue packet")
+	errInvalidMark      = errors.New("invalid mark")
+	errNotRegistered    = errors.New("not attached to the queue")
+)
 
 type nfqueuePacketIO struct {
-	n     *nfqueue.Nfqueue
-	local bool
-	rst   bool
-	rSet  bool // whether the nftables/iptables rules have been set
+	n        *nfqueue.Nfqueue
+	queueNum uint16
+	table    string
+	local    bool
+	rst      bool
+	divert   DivertConfig
+	honeypot HoneypotConfig
+	dscp     []DSCPMark
+	rSet     atomic.Bool // whether the nftables/iptables rules have been set
+	inject   *rawInjector
 
 	// iptables not nil = use iptables instead of nftables
 	ipt4 *iptables.IPTables
@@ -99,20 +229,51 @@ type nfqueuePacketIO struct {
 }
 
 type NFQueuePacketIOConfig struct {
+	// QueueNum & Table must be different for every instance. Table is only used with nftables:
+	// with iptables, the rules of instances on the same chains (both local, or both not) conflict.
+	QueueNum    uint16 // Default 100
+	Table       string // Default "opengfw"
 	QueueSize   uint32
+	FailOpen    bool // Let packets through instead of dropping them when the queue is full
 	ReadBuffer  int
 	WriteBuffer int
 	Local       bool
 	RST         bool
+	Divert      DivertConfig
+	Honeypot    HoneypotConfig
+	DSCP        []DSCPMark
 }
 
 func NewNFQueuePacketIO(config NFQueuePacketIOConfig) (PacketIO, error) {
+	if config.QueueNum == 0 {
+		config.QueueNum = nfqueueDefaultNum
+	}
+	if config.Table == "" {
+		config.Table = nftDefaultTable
+	}
 	if config.QueueSize == 0 {
 		config.QueueSize = nfqueueDefaultQueueSize
 	}
+	for _, d := range config.DSCP {
+		if d.Mark == 0 || d.Mark > MaxMark || d.DSCP > 63 {
+			return nil, fmt.Errorf("invalid DSCP mark %d: %d", d.Mark, d.DSCP)
+		}
+	}
+	if config.Divert.Port != 0 && config.Divert.Timeout <= 0 {
+		config.Divert.Timeout = defaultDivertTimeout
+	}
+	if config.Honeypot.Addr != nil && config.Honeypot.Timeout <= 0 {
+		config.Honeypot.Timeout = defaultHoneypotTimeout
+	}
 	var ipt4, ipt6 *iptables.IPTables
 	var err error
 	if nftCheck() != nil {
+		if config.Divert.Port != 0 {
+			return nil, errors.New("divert requires nftables")
+		}
+		if config.Honeypot.Addr != nil {
+			return nil, errors.New("honeypot requires nftables")
+		}
 		// We prefer nftables, but if it's not available, fall back to iptables
 		ipt4, err = iptables.NewWithProtocol(iptables.ProtocolIPv4)
 		if err != nil {
@@ -123,12 +284,20 @@ func NewNFQueuePacketIO(config NFQueuePacketIOConfig) (PacketIO, error) {
 			return nil, err
 		}
 	}
+	flags := uint32(nfqueue.NfQaCfgFlagConntrack)
+	if config.Local {
+		// The owner of the local sockets, for the process attribution of the streams
+		flags |= nfqueue.NfQaCfgFlagUIDGid
+	}
+	if config.FailOpen {
+		flags |= nfqueue.NfQaCfgFlagFailOpen
+	}
 	n, err := nfqueue.Open(&nfqueue.Config{
-		NfQueue:      nfqueueNum,
+		NfQueue:      config.QueueNum,
 		MaxPacketLen: nfqueueMaxPacketLen,
 		MaxQueueLen:  config.QueueSize,
 		Copymode:     nfqueue.NfQnlCopyPacket,
-		Flags:        nfqueue.NfQaCfgFlagConntrack,
+		Flags:        flags,
 	})
 	if err != nil {
 		return nil, err
@@ -148,11 +317,17 @@ func NewNFQueuePacketIO(config NFQueuePacketIOConfig) (PacketIO, error) {
 		}
 	}
 	return &nfqueuePacketIO{
-		n:     n,
-		local: config.Local,
-		rst:   config.RST,
-		ipt4:  ipt4,
-		ipt6:  ipt6,
+		n:        n,
+		queueNum: config.QueueNum,
+		table:    config.Table,
+		local:    config.Local,
+		rst:      config.RST,
+		divert:   config.Divert,
+		honeypot: config.Honeypot,
+		dscp:     config.DSCP,
+		inject:   newRawInjector(nfqueueMarkInject),
+		ipt4:     ipt4,
+		ipt6:     ipt6,
 	}, nil
 }
 
@@ -170,6 +345,15 @@ func (n *nfqueuePacketIO) Register(ctx context.Context, cb PacketCallback) error
 				streamID: ctIDFromCtBytes(*a.Ct),
 				data:     *a.Payload,
 			}
+			if a.InDev != nil {
+				p.inDev = *a.InDev
+			}
+			if a.OutDev != nil {
+				p.outDev = *a.OutDev
+			}
+			if a.UID != nil && a.GID != nil {
+				p.uid, p.gid, p.owned = *a.UID, *a.GID, true
+			}
 			return okBoolToInt(cb(p, nil))
 		},
 		func(e error) int {
@@ -184,7 +368,7 @@ func (n *nfqueuePacketIO) Register(ctx context.Context, cb PacketCallback) error
 	if err != nil {
 		return err
 	}
-	if !n.rSet {
+	if !n.rSet.Load() {
 		if n.ipt4 != nil {
 			err = n.setupIpt(n.local, n.rst, false)
 		} else {
@@ -193,7 +377,26 @@ func (n *nfqueuePacketIO) Register(ctx context.Context, cb PacketCallback) error
 		if err != nil {
 			return err
 		}
-		n.rSet = true
+		n.rSet.Store(true)
+	}
+	return nil
+}
+
+// Health checks that the queue has been registered, and that the nftables/iptables rules
+// are still in place, as another firewall manager may have flushed them.
+func (n *nfqueuePacketIO) Health() error {
+	if !n.rSet.Load() {
+		return errNotRegistered
+	}
+	if n.ipt4 != nil {
+		rules, err := generateIptRules(n.queueNum, n.local, n.rst, n.dscp)
+		if err != nil {
+			return err
+		}
+		return iptsBatchCheck([]*iptables.IPTables{n.ipt4, n.ipt6}, rules)
+	}
+	if err := nftListTable(nftFamily, n.table); err != nil {
+		return fmt.Errorf("nftables table %s %s not found: %w", nftFamily, n.table, err)
 	}
 	return nil
 }
@@ -233,35 +436,82 @@ func (n *nfqueuePacketIO) SetVerdict(p Packet, v Verdict, newPacket []byte) erro
 		return n.n.SetVerdict(nP.id, nfqueue.NfDrop)
 	case VerdictDropStream:
 		return n.n.SetVerdictWithConnMark(nP.id, nfqueue.NfDrop, nfqueueConnMarkDrop)
+	case VerdictDivertStream:
+		if n.divert.Port != 0 {
+			if elem, set, ok := nftFlowElement(nP.data, nftDivertSet4, nftDivertSet6); ok {
+				// Don't hold up the worker, the client won't retry that fast anyway
+				go func() { _ = nftAddElement(nftFamily, n.table, set, elem) }()
+			}
+		}
+		return n.n.SetVerdictWithConnMark(nP.id, nfqueue.NfDrop, nfqueueConnMarkDrop)
+	case VerdictHoneypotStream:
+		if n.honeypot.Addr != nil {
+			// Only the set of the family of the honeypot exists
+			set4, set6 := nftHoneypotSet4, ""
+			if n.honeypot.Addr.To4() == nil {
+				set4, set6 = "", nftHoneypotSet6
+			}
+			if elem, set, ok := nftFlowElement(nP.data, set4, set6); ok {
+				go func() { _ = nftAddElement(nftFamily, n.table, set, elem) }()
+			}
+		}
+		return n.n.SetVerdictWithConnMark(nP.id, nfqueue.NfDrop, nfqueueConnMarkDrop)
 	default:
 		// Invalid verdict, ignore for now
 		return nil
 	}
 }
 
-func (n *nfqueuePacketIO) Close() error {
-	if n.rSet {
-		if n.ipt4 != nil {
-			_ = n.setupIpt(n.local, n.rst, true)
-		} else {
-			_ = n.setupNft(n.local, n.rst, true)
-		}
-		n.rSet = false
+func (n *nfqueuePacketIO) SetVerdictWithMark(p Packet, v Verdict, mark uint32) error {
+	if v != VerdictAcceptStream || mark == 0 {
+		return n.SetVerdict(p, v, nil)
+	}
+	nP, ok := p.(*nfqueuePacket)
+	if !ok {
+		return &ErrInvalidPacket{Err: errNotNFQueuePacket}
+	}
+	if mark > MaxMark {
+		return errInvalidMark
+	}
+	// The verdict in the lower 16 bits, the mark in the upper 16 bits, restored to the packet mark by the rules
+	ctMark := nfqueueConnMarkAccept | int(mark)<<nfqueueConnMarkUserShift
+	return n.n.SetVerdictWithConnMark(nP.id, nfqueue.NfAccept, ctMark)
+}
+
+func (n *nfqueuePacketIO) InjectPacket(data []byte) error {
+	return n.inject.InjectPacket(data)
+}
+
+// RemoveRules removes the nftables/iptables rules. The queue stays attached until Close,
+// so that another instance (e.g. when restarted by systemd) can't attach to it and install
+// its own rules before ours are gone.
+func (n *nfqueuePacketIO) RemoveRules() error {
+	if !n.rSet.CompareAndSwap(true, false) {
+		return nil
 	}
+	if n.ipt4 != nil {
+		return n.setupIpt(n.local, n.rst, true)
+	}
+	return n.setupNft(n.local, n.rst, true)
+}
+
+func (n *nfqueuePacketIO) Close() error {
+	_ = n.inject.Close()
+	_ = n.RemoveRules()
 	return n.n.Close()
 }
 
 func (n *nfqueuePacketIO) setupNft(local, rst, remove bool) error {
-	rules, err := generateNftRules(local, rst)
+	rules, err := generateNftRules(n.table, n.queueNum, local, rst, n.divert, n.honeypot, n.dscp)
 	if err != nil {
 		return err
 	}
 	rulesText := rules.String()
 	if remove {
-		err = nftDelete(nftFamily, nftTable)
+		err = nftDelete(nftFamily, n.table)
 	} else {
 		// Delete first to make sure no leftover rules
-		_ = nftDelete(nftFamily, nftTable)
+		_ = nftDelete(nftFamily, n.table)
 		err = nftAdd(rulesText)
 	}
 	if err != nil {
@@ -271,7 +521,7 @@ func (n *nfqueuePacketIO) setupNft(local, rst, remove bool) error {
 }
 
 func (n *nfqueuePacketIO) setupIpt(local, rst, remove bool) error {
-	rules, err := generateIptRules(local, rst)
+	rules, err := generateIptRules(n.queueNum, local, rst, n.dscp)
 	if err != nil {
 		return err
 	}
@@ -291,9 +541,18 @@ var _ Packet = (*nfqueuePacket)(nil)
 type nfqueuePacket struct {
 	id       uint32
 	streamID uint32
+	inDev    uint32
+	outDev   uint32
+	uid, gid uint32
+	owned    bool // Whether uid & gid are known
 	data     []byte
 }
 
+var (
+	_ InterfacePacket = (*nfqueuePacket)(nil)
+	_ OwnerPacket     = (*nfqueuePacket)(nil)
+)
+
 func (p *nfqueuePacket) StreamID() uint32 {
 	return p.streamID
 }
@@ -302,6 +561,18 @@ func (p *nfqueuePacket) Data() []byte {
 	return p.data
 }
 
+func (p *nfqueuePacket) InterfaceIndex() int {
+	return int(p.inDev)
+}
+
+func (p *nfqueuePacket) OutInterfaceIndex() int {
+	return int(p.outDev)
+}
+
+func (p *nfqueuePacket) Owner() (uid, gid uint32, ok bool) {
+	return p.uid, p.gid, p.owned
+}
+
 func okBoolToInt(ok bool) int {
 	if ok {
 		return 0
@@ -329,16 +600,58 @@ func nftDelete(family, table string) error {
 	return cmd.Run()
 }
 
+func nftListTable(family, table string) error {
+	cmd := exec.Command("nft", "list", "table", family, table)
+	return cmd.Run()
+}
+
+func nftAddElement(family, table, set, elem string) error {
+	cmd := exec.Command("nft", "add", "element", family, table, set, "{ "+elem+" }")
+	return cmd.Run()
+}
+
+// nftFlowElement returns the client . server . port set element for a TCP packet,
+// and the set it belongs to: set4 for IPv4, set6 for IPv6. ok is false if that set is empty.
+func nftFlowElement(data []byte, set4, set6 string) (elem, set string, ok bool) {
+	var src, dst net.IP
+	var tcp []byte
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		ihl := int(data[0]&0x0f) * 4
+		if data[9] != unix.IPPROTO_TCP || len(data) < ihl+4 {
+			return "", "", false
+		}
+		src, dst, tcp, set = net.IP(data[12:16]), net.IP(data[16:20]), data[ihl:], set4
+	case len(data) >= 40 && data[0]>>4 == 6:
+		// Extension headers are not supported
+		if data[6] != unix.IPPROTO_TCP || len(data) < 44 {
+			return "", "", false
+		}
+		src, dst, tcp, set = net.IP(data[8:24]), net.IP(data[24:40]), data[40:], set6
+	default:
+		return "", "", false
+	}
+	if set == "" {
+		return "", "", false
+	}
+	dstPort := binary.BigEndian.Uint16(tcp[2:4])
+	return fmt.Sprintf("%s . %s . %d", src, dst, dstPort), set, true
+}
+
 type nftTableSpec struct {
 	Defines       []string
 	Family, Table string
+	Sets          []nftSetSpec
 	Chains        []nftChainSpec
 }
 
 func (t *nftTableSpec) String() string {
-	chains := make([]string, 0, len(t.Chains))
+	items := make([]string, 0, len(t.Sets)+len(t.Chains))
+	for _, s := range t.Sets {
+		items = append(items, s.String())
+	}
 	for _, c := range t.Chains {
-		chains = append(chains, c.String())
+		items = append(items, c.String())
 	}
 
 	return fmt.Sprintf(`
@@ -347,7 +660,20 @@ func (t *nftTableSpec) String() string {
 table %s %s {
 %s
 }
-`, strings.Join(t.Defines, "\n"), t.Family, t.Table, strings.Join(chains, ""))
+`, strings.Join(t.Defines, "\n"), t.Family, t.Table, strings.Join(items, ""))
+}
+
+type nftSetSpec struct {
+	Set  string
+	Spec string
+}
+
+func (s *nftSetSpec) String() string {
+	return fmt.Sprintf(`
+  set %s {
+    %s
+  }
+`, s.Set, s.Spec)
 }
 
 type nftChainSpec struct {
@@ -394,6 +720,22 @@ func iptsBatchDeleteIfExists(ipts []*iptables.IPTables, rules []iptRule) error {
 	return nil
 }
 
+// iptsBatchCheck returns an error if any of the rules is missing.
+func iptsBatchCheck(ipts []*iptables.IPTables, rules []iptRule) error {
+	for _, r := range rules {
+		for _, ipt := range ipts {
+			ok, err := ipt.Exists(r.Table, r.Chain, r.RuleSpec...)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("iptables rule missing in %s/%s: %s", r.Table, r.Chain, strings.Join(r.RuleSpec, " "))
+			}
+		}
+	}
+	return nil
+}
+
 func ctIDFromCtBytes(ct []byte) uint32 {
 	ctAttrs, err := netlink.UnmarshalAttributes(ct)
 	if err != nil {
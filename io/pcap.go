@@ -0,0 +1,261 @@
+package io
+
+import (
+	"context"
+	"errors"
+	stdio "io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var _ PacketIO = (*pcapPacketIO)(nil)
+
+var errNotPcapPacket = errors.New("not a pcap packet")
+
+type pcapReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// pcapPacketIO is a PacketIO that reads packets from a pcap/pcapng file,
+// for offline testing and evaluation, or captures them live on an interface, as a passive sensor.
+// Verdicts have no effect, but like with NFQueue, streams that have been given a stream verdict
+// no longer have their packets passed to the callback (only for files: live, that would have to be
+// remembered forever, as streams never end for the IO).
+type pcapPacketIO struct {
+	f         *os.File
+	closeLive func() // Of the live capture
+	r         pcapReader
+	realtime  bool
+
+	wg            sync.WaitGroup // Packets pending verdicts
+	streamMutex   sync.Mutex
+	streamVerdict map[uint32]Verdict
+}
+
+type PcapPacketIOConfig struct {
+	PcapFile string
+	// Realtime replays packets with their original timing,
+	// instead of as fast as possible.
+	Realtime bool
+	// Packets are replayed instead of the file if set: raw IP packets, e.g. from LoadPcapPackets.
+	// For benchmarks, to keep reading the file out of the measurements.
+	Packets [][]byte
+	// Interface is captured live (in promiscuous mode) instead of reading the file if set,
+	// e.g. for a sensor on a mirror port. Packets longer than the MTU are truncated.
+	Interface string
+}
+
+func NewPcapPacketIO(config PcapPacketIOConfig) (PacketIO, error) {
+	if config.Interface != "" {
+		r, closeLive, err := openLiveCapture(config.Interface)
+		if err != nil {
+			return nil, err
+		}
+		return &pcapPacketIO{
+			r:         r,
+			closeLive: closeLive,
+		}, nil
+	}
+	if config.Packets != nil {
+		return &pcapPacketIO{
+			r:             &packetSliceReader{packets: config.Packets},
+			streamVerdict: make(map[uint32]Verdict),
+		}, nil
+	}
+	f, err := os.Open(config.PcapFile)
+	if err != nil {
+		return nil, err
+	}
+	var r pcapReader
+	r, err = pcapgo.NewReader(f)
+	if err != nil {
+		// Not pcap, try pcapng
+		if _, err := f.Seek(0, stdio.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		r, err = pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return &pcapPacketIO{
+		f:             f,
+		r:             r,
+		realtime:      config.Realtime,
+		streamVerdict: make(map[uint32]Verdict),
+	}, nil
+}
+
+func (p *pcapPacketIO) Register(ctx context.Context, cb PacketCallback) error {
+	go func() {
+		var lastTS time.Time
+		for {
+			if ctx.Err() != nil {
+				return
+			}
+			data, ci, err := p.r.ReadPacketData()
+			if err == stdio.EOF {
+				// Wait for all verdicts before signaling the end
+				p.wg.Wait()
+				cb(nil, ErrEndOfInput)
+				return
+			} else if err != nil {
+				cb(nil, err)
+				return
+			}
+			if p.realtime && !lastTS.IsZero() && ci.Timestamp.After(lastTS) {
+				time.Sleep(ci.Timestamp.Sub(lastTS))
+			}
+			lastTS = ci.Timestamp
+			pkt, ok := p.newPacket(data)
+			if !ok {
+				continue
+			}
+			if p.streamVerdict != nil {
+				p.streamMutex.Lock()
+				_, offloaded := p.streamVerdict[pkt.streamID]
+				p.streamMutex.Unlock()
+				if offloaded {
+					// Handled by "conntrack"
+					continue
+				}
+			}
+			p.wg.Add(1)
+			if !cb(pkt, nil) {
+				p.wg.Done()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// newPacket strips the link layer and computes a symmetric stream ID from the 5-tuple.
+func (p *pcapPacketIO) newPacket(data []byte) (*pcapPacket, bool) {
+	packet := gopacket.NewPacket(data, p.r.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	netLayer, trLayer := packet.NetworkLayer(), packet.TransportLayer()
+	if netLayer == nil {
+		return nil, false
+	}
+	// Skip everything before the network layer, and any link layer padding after it
+	offset := 0
+	for _, l := range packet.Layers() {
+		if l == netLayer {
+			break
+		}
+		offset += len(l.LayerContents())
+	}
+	end := offset + len(netLayer.LayerContents()) + len(netLayer.LayerPayload())
+	if end > len(data) {
+		return nil, false
+	}
+	streamID := uint32(netLayer.NetworkFlow().FastHash())
+	if trLayer != nil {
+		streamID = streamID*31 + uint32(trLayer.TransportFlow().FastHash())
+	} else if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		// Echo sessions by identifier, like conntrack
+		streamID = streamID*31 + uint32(icmp.Id)
+	} else if echo, ok := packet.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo); ok {
+		streamID = streamID*31 + uint32(echo.Identifier)
+	}
+	return &pcapPacket{
+		streamID: streamID,
+		data:     data[offset:end],
+	}, true
+}
+
+func (p *pcapPacketIO) SetVerdict(pkt Packet, v Verdict, newPacket []byte) error {
+	pP, ok := pkt.(*pcapPacket)
+	if !ok {
+		return &ErrInvalidPacket{Err: errNotPcapPacket}
+	}
+	if v == VerdictDivertStream || v == VerdictHoneypotStream {
+		v = VerdictDropStream
+	}
+	if (v == VerdictAcceptStream || v == VerdictDropStream) && p.streamVerdict != nil {
+		p.streamMutex.Lock()
+		p.streamVerdict[pP.streamID] = v
+		p.streamMutex.Unlock()
+	}
+	p.wg.Done()
+	return nil
+}
+
+func (p *pcapPacketIO) SetVerdictWithMark(pkt Packet, v Verdict, mark uint32) error {
+	return p.SetVerdict(pkt, v, nil)
+}
+
+func (p *pcapPacketIO) Close() error {
+	if p.closeLive != nil {
+		p.closeLive()
+	}
+	if p.f == nil {
+		return nil
+	}
+	return p.f.Close()
+}
+
+// LoadPcapPackets reads all the packets of a pcap/pcapng file, as raw IP packets.
+// Packets without a network layer are skipped.
+func LoadPcapPackets(file string) ([][]byte, error) {
+	pio, err := NewPcapPacketIO(PcapPacketIOConfig{PcapFile: file})
+	if err != nil {
+		return nil, err
+	}
+	p := pio.(*pcapPacketIO)
+	defer p.Close()
+	var packets [][]byte
+	for {
+		data, _, err := p.r.ReadPacketData()
+		if err == stdio.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if pkt, ok := p.newPacket(data); ok {
+			packets = append(packets, append([]byte(nil), pkt.data...))
+		}
+	}
+}
+
+// packetSliceReader is a pcapReader of raw IP packets in memory.
+type packetSliceReader struct {
+	packets [][]byte
+	next    int
+}
+
+func (r *packetSliceReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if r.next >= len(r.packets) {
+		return nil, gopacket.CaptureInfo{}, stdio.EOF
+	}
+	data := r.packets[r.next]
+	r.next++
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (r *packetSliceReader) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+var _ Packet = (*pcapPacket)(nil)
+
+type pcapPacket struct {
+	streamID uint32
+	data     []byte
+}
+
+func (p *pcapPacket) StreamID() uint32 {
+	return p.streamID
+}
+
+func (p *pcapPacket) Data() []byte {
+	return p.data
+}
@@ -0,0 +1,28 @@
+package io
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// openLiveCapture captures the packets of an interface in promiscuous mode, returning the reader and its closer.
+func openLiveCapture(iface string) (pcapReader, func(), error) {
+	h, err := pcapgo.NewEthernetHandle(iface)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := h.SetPromiscuous(true); err != nil {
+		h.Close()
+		return nil, nil, err
+	}
+	return ethernetReader{h}, h.Close, nil
+}
+
+// ethernetReader is a pcapReader of a live capture.
+type ethernetReader struct {
+	*pcapgo.EthernetHandle
+}
+
+func (r ethernetReader) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
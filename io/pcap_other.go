@@ -0,0 +1,11 @@
+//go:build !linux
+
+package io
+
+import "errors"
+
+var errLiveCaptureUnsupported = errors.New("live capture is only supported on Linux")
+
+func openLiveCapture(iface string) (pcapReader, func(), error) {
+	return nil, nil, errLiveCaptureUnsupported
+}
@@ -0,0 +1,106 @@
+package io
+
+import (
+	"encoding/binary"
+	stdio "io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng block types & options, see the specification (draft-ietf-opsawg-pcapng)
+const (
+	pcapngBlockSectionHeader   = 0x0a0d0d0a
+	pcapngBlockInterface       = 0x00000001
+	pcapngBlockEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngOptionEndOfOpt       = 0
+	pcapngOptionComment        = 1
+	pcapngMaxCommentLength     = 0xffff
+	pcapngSectionHeaderLength  = 28
+	pcapngInterfaceLength      = 20
+	pcapngEnhancedPacketLength = 32 // Without the data & options
+	pcapngOptionHeaderLength   = 4
+	pcapngEndOfOptLength       = 4
+	pcapngTimestampUnit        = 1000 // Nanoseconds, the default resolution is microseconds
+)
+
+// PacketComment, in the AncillaryData of the CaptureInfo of a packet, is written as the packet's comment
+// by the writers that support it (pcapng files).
+type PacketComment string
+
+// pcapngWriter writes a pcapng file with a single section & interface of raw IP packets,
+// and the PacketComment of each packet as its comment. gopacket's NgWriter can't write comments.
+type pcapngWriter struct {
+	w   stdio.Writer
+	buf []byte
+}
+
+func newPcapngWriter(w stdio.Writer) *pcapngWriter {
+	return &pcapngWriter{w: w}
+}
+
+// WriteFileHeader writes the section header and the interface description, and returns their size.
+func (w *pcapngWriter) WriteFileHeader(snapLen uint32) (int, error) {
+	b := w.buf[:0]
+	b = binary.LittleEndian.AppendUint32(b, pcapngBlockSectionHeader)
+	b = binary.LittleEndian.AppendUint32(b, pcapngSectionHeaderLength)
+	b = binary.LittleEndian.AppendUint32(b, pcapngByteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1)          // Major version
+	b = binary.LittleEndian.AppendUint16(b, 0)          // Minor version
+	b = binary.LittleEndian.AppendUint64(b, ^uint64(0)) // Section length, unspecified
+	b = binary.LittleEndian.AppendUint32(b, pcapngSectionHeaderLength)
+	b = binary.LittleEndian.AppendUint32(b, pcapngBlockInterface)
+	b = binary.LittleEndian.AppendUint32(b, pcapngInterfaceLength)
+	b = binary.LittleEndian.AppendUint16(b, uint16(layers.LinkTypeRaw))
+	b = binary.LittleEndian.AppendUint16(b, 0) // Reserved
+	b = binary.LittleEndian.AppendUint32(b, snapLen)
+	b = binary.LittleEndian.AppendUint32(b, pcapngInterfaceLength)
+	w.buf = b
+	return w.w.Write(b)
+}
+
+// WritePacket writes a packet as an enhanced packet block, and returns its size.
+func (w *pcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) (int, error) {
+	var comment string
+	for _, v := range ci.AncillaryData {
+		if c, ok := v.(PacketComment); ok {
+			comment = string(c)
+			break
+		}
+	}
+	if len(comment) > pcapngMaxCommentLength {
+		comment = comment[:pcapngMaxCommentLength]
+	}
+	length := pcapngEnhancedPacketLength + pcapngPad(len(data))
+	if comment != "" {
+		length += pcapngOptionHeaderLength + pcapngPad(len(comment)) + pcapngEndOfOptLength
+	}
+	ts := uint64(ci.Timestamp.UnixNano() / pcapngTimestampUnit)
+	b := w.buf[:0]
+	b = binary.LittleEndian.AppendUint32(b, pcapngBlockEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	b = binary.LittleEndian.AppendUint32(b, 0) // Interface ID
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ci.Length))
+	b = append(b, data...)
+	b = append(b, make([]byte, pcapngPad(len(data))-len(data))...)
+	if comment != "" {
+		b = binary.LittleEndian.AppendUint16(b, pcapngOptionComment)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(comment)))
+		b = append(b, comment...)
+		b = append(b, make([]byte, pcapngPad(len(comment))-len(comment))...)
+		b = binary.LittleEndian.AppendUint16(b, pcapngOptionEndOfOpt)
+		b = binary.LittleEndian.AppendUint16(b, 0)
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(length))
+	w.buf = b
+	return w.w.Write(b)
+}
+
+// pcapngPad returns n rounded up to a multiple of 4.
+func pcapngPad(n int) int {
+	return (n + 3) &^ 3
+}
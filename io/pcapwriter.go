@@ -0,0 +1,230 @@
+package io
+
+import (
+	"compress/gzip"
+	"fmt"
+	stdio "io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	defaultPcapWriterPrefix  = "opengfw"
+	defaultPcapWriterMaxSize = 100 * 1024 * 1024
+	pcapWriterSnapLen        = 65535
+)
+
+type PcapWriterConfig struct {
+	Dir      string
+	Prefix   string        // File name prefix, default "opengfw"
+	MaxSize  int64         // Size in bytes after which a new file is started, default 100 MiB
+	Interval time.Duration // How often a new file is started, 0 = only by size
+	MaxFiles int           // Number of files to keep, oldest ones are deleted. 0 = unlimited
+	MaxAge   time.Duration // How long files are kept. 0 = forever
+	Compress string        // Compression of finished files: "gzip", or "" for none
+	// Format is the file format: "pcap" (default), or "pcapng" which also has the PacketComment
+	// of each packet (e.g. the UUID of its stream).
+	Format string
+}
+
+// PcapWriter writes raw IP packets to a series of pcap (or pcapng) files, starting a new
+// file once the current one reaches the size limit or its interval has passed.
+// Finished files are compressed & pruned in the background. It is safe for concurrent use.
+type PcapWriter struct {
+	config PcapWriterConfig
+
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *pcapgo.Writer // nil for pcapng
+	ngWriter *pcapngWriter  // nil for pcap
+	size     int64
+	rotateAt time.Time // Zero if not rotated by time
+
+	cleanupMutex sync.Mutex // Serializes the compression & pruning of finished files
+	cleanupWG    sync.WaitGroup
+}
+
+func NewPcapWriter(config PcapWriterConfig) (*PcapWriter, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("pcap directory is required")
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultPcapWriterPrefix
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultPcapWriterMaxSize
+	}
+	if config.Interval < 0 || config.MaxFiles < 0 || config.MaxAge < 0 {
+		return nil, fmt.Errorf("rotation limits must not be negative")
+	}
+	if config.Compress != "" && config.Compress != "gzip" {
+		return nil, fmt.Errorf("unsupported compression %q", config.Compress)
+	}
+	switch config.Format {
+	case "":
+		config.Format = "pcap"
+	case "pcap", "pcapng":
+	default:
+		return nil, fmt.Errorf("unsupported format %q", config.Format)
+	}
+	if err := os.MkdirAll(config.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{config: config}, nil
+}
+
+// WritePacket writes a packet starting with the IP header.
+// A zero timestamp in ci is replaced with the current time.
+func (w *PcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if ci.Timestamp.IsZero() {
+		ci.Timestamp = time.Now()
+	}
+	if len(data) > pcapWriterSnapLen {
+		data = data[:pcapWriterSnapLen]
+	}
+	ci.CaptureLength = len(data)
+	if ci.Length < len(data) {
+		ci.Length = len(data)
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil || w.size+int64(16+len(data)) > w.config.MaxSize ||
+		(!w.rotateAt.IsZero() && !time.Now().Before(w.rotateAt)) {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if w.ngWriter != nil {
+		n, err := w.ngWriter.WritePacket(ci, data)
+		w.size += int64(n)
+		return err
+	}
+	if err := w.writer.WritePacket(ci, data); err != nil {
+		return err
+	}
+	w.size += int64(16 + len(data)) // Record header + data
+	return nil
+}
+
+// rotate closes the current file (if any), opens a new one,
+// and compresses the finished file & deletes the oldest ones over the limits in the background.
+func (w *PcapWriter) rotate() error {
+	var finished string
+	if w.file != nil {
+		finished = w.file.Name()
+		_ = w.file.Close()
+		w.file, w.writer, w.ngWriter = nil, nil, nil
+	}
+	name := filepath.Join(w.config.Dir, fmt.Sprintf("%s-%s.%s", w.config.Prefix, time.Now().Format("20060102-150405.000000"), w.config.Format))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if w.config.Format == "pcapng" {
+		ngWriter := newPcapngWriter(f)
+		n, err := ngWriter.WriteFileHeader(pcapWriterSnapLen)
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		w.file, w.ngWriter, w.size = f, ngWriter, int64(n)
+	} else {
+		writer := pcapgo.NewWriter(f)
+		if err := writer.WriteFileHeader(pcapWriterSnapLen, layers.LinkTypeRaw); err != nil {
+			_ = f.Close()
+			return err
+		}
+		w.file, w.writer, w.size = f, writer, 24 // File header
+	}
+	if w.config.Interval > 0 {
+		w.rotateAt = time.Now().Add(w.config.Interval)
+	}
+	w.cleanupWG.Add(1)
+	go func() {
+		defer w.cleanupWG.Done()
+		w.cleanup(finished)
+	}()
+	return nil
+}
+
+// cleanup compresses the finished file (if any), and deletes the oldest files over the limits,
+// the current one included.
+func (w *PcapWriter) cleanup(finished string) {
+	w.cleanupMutex.Lock()
+	defer w.cleanupMutex.Unlock()
+	if finished != "" && w.config.Compress == "gzip" {
+		_ = gzipFile(finished)
+	}
+	if w.config.MaxFiles <= 0 && w.config.MaxAge <= 0 {
+		return
+	}
+	pattern := filepath.Join(w.config.Dir, w.config.Prefix+"-*."+w.config.Format)
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	gzFiles, _ := filepath.Glob(pattern + ".gz")
+	files = append(files, gzFiles...)
+	// The timestamp format sorts chronologically
+	sort.Strings(files)
+	for i, name := range files {
+		if w.config.MaxFiles > 0 && len(files)-i > w.config.MaxFiles {
+			_ = os.Remove(name)
+			continue
+		}
+		if w.config.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > w.config.MaxAge {
+				_ = os.Remove(name)
+			}
+		}
+	}
+}
+
+func (w *PcapWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	defer w.cleanupWG.Wait()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file, w.writer, w.ngWriter = nil, nil, nil
+	return err
+}
+
+// gzipFile compresses a file to name.gz, and deletes it once done.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := name + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = stdio.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,84 @@
+package io
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	tcRootHandle   = "1:"
+	tcRootClassID  = "1:1"
+	tcDefaultMinor = 0xFFFF
+)
+
+var errNoShapingRate = errors.New("device rate must be set")
+
+// TCShapingClass is a bandwidth class programmed by SetupTCShaping.
+// Packets of streams accepted with the class's mark (see PacketIO.SetVerdictWithMark)
+// are assigned to it.
+type TCShapingClass struct {
+	Mark uint32
+	Rate string // tc rate, e.g. "10mbit"
+	Ceil string // tc rate, defaults to Rate
+}
+
+// TCShapingConfig is the configuration for SetupTCShaping.
+type TCShapingConfig struct {
+	Device  string
+	Rate    string // Total rate of the device, also used for unclassified traffic
+	Classes []TCShapingClass
+}
+
+// SetupTCShaping programs an HTB qdisc on the given device with one class per
+// shaping class, and fw filters matching the user marks set by the packet IO.
+// Any existing root qdisc on the device is replaced.
+func SetupTCShaping(config TCShapingConfig) error {
+	if config.Rate == "" {
+		return errNoShapingRate
+	}
+	cmds := [][]string{
+		{"qdisc", "replace", "dev", config.Device, "root", "handle", tcRootHandle, "htb", "default", strconv.FormatUint(tcDefaultMinor, 16)},
+		{"class", "replace", "dev", config.Device, "parent", tcRootHandle, "classid", tcRootClassID, "htb", "rate", config.Rate},
+		{"class", "replace", "dev", config.Device, "parent", tcRootClassID, "classid", tcClassID(tcDefaultMinor), "htb", "rate", config.Rate},
+	}
+	for _, c := range config.Classes {
+		if c.Mark == 0 || c.Mark > MaxMark {
+			return errInvalidMark
+		}
+		ceil := c.Ceil
+		if ceil == "" {
+			ceil = c.Rate
+		}
+		handle := fmt.Sprintf("0x%x/0x%x", c.Mark<<nfqueueConnMarkUserShift, uint32(nfqueueConnMarkUserMask))
+		cmds = append(cmds,
+			[]string{"class", "replace", "dev", config.Device, "parent", tcRootClassID, "classid", tcClassID(c.Mark), "htb", "rate", c.Rate, "ceil", ceil},
+			[]string{"filter", "replace", "dev", config.Device, "parent", tcRootHandle, "protocol", "all", "prio", "1", "handle", handle, "fw", "classid", tcClassID(c.Mark)},
+		)
+	}
+	for _, args := range cmds {
+		if err := tcRun(args...); err != nil {
+			_ = TeardownTCShaping(config.Device)
+			return err
+		}
+	}
+	return nil
+}
+
+// TeardownTCShaping removes the qdisc installed by SetupTCShaping.
+func TeardownTCShaping(device string) error {
+	return tcRun("qdisc", "del", "dev", device, "root")
+}
+
+func tcClassID(minor uint32) string {
+	return "1:" + strconv.FormatUint(uint64(minor), 16)
+}
+
+func tcRun(args ...string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %v: %w: %s", args, err, out)
+	}
+	return nil
+}
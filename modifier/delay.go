@@ -0,0 +1,103 @@
+package modifier
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var _ Modifier = (*DelayModifier)(nil)
+
+var errInvalidDistribution = errors.New("distribution must be fixed, uniform or normal")
+
+// DelayModifier delays the packets of matched streams (both TCP & UDP) by a random
+// duration, to degrade traffic or test applications under bad network conditions.
+type DelayModifier struct{}
+
+func (m *DelayModifier) Name() string {
+	return "delay"
+}
+
+func (m *DelayModifier) New(args map[string]interface{}) (Instance, error) {
+	i := &delayModifierInstance{}
+	var err error
+	if i.Delay, err = durationArg(args, "delay"); err != nil {
+		return nil, &ErrInvalidArgs{Err: err}
+	}
+	if i.Jitter, err = durationArg(args, "jitter"); err != nil {
+		return nil, &ErrInvalidArgs{Err: err}
+	}
+	if i.Max, err = durationArg(args, "max"); err != nil {
+		return nil, &ErrInvalidArgs{Err: err}
+	}
+	dist, _ := args["distribution"].(string)
+	switch strings.ToLower(dist) {
+	case "", "fixed":
+		i.Distribution = delayFixed
+	case "uniform":
+		i.Distribution = delayUniform
+	case "normal":
+		i.Distribution = delayNormal
+	default:
+		return nil, &ErrInvalidArgs{Err: errInvalidDistribution}
+	}
+	if i.Delay <= 0 && (i.Distribution == delayFixed || i.Jitter <= 0) {
+		return nil, &ErrInvalidArgs{Err: errors.New("delay must be positive")}
+	}
+	return i, nil
+}
+
+// durationArg parses an optional non-negative duration argument, e.g. "50ms".
+func durationArg(args map[string]interface{}, name string) (time.Duration, error) {
+	v, ok := args[name]
+	if !ok {
+		return 0, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, errors.New(name + " must be a duration string")
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New(name + " must not be negative")
+	}
+	return d, nil
+}
+
+type delayDistribution int
+
+const (
+	delayFixed   delayDistribution = iota // Always Delay
+	delayUniform                          // Delay ± Jitter
+	delayNormal                           // Mean Delay, standard deviation Jitter
+)
+
+var _ DelayerInstance = (*delayModifierInstance)(nil)
+
+type delayModifierInstance struct {
+	Distribution delayDistribution
+	Delay        time.Duration
+	Jitter       time.Duration
+	Max          time.Duration // 0 = no limit
+}
+
+func (i *delayModifierInstance) PacketDelay() time.Duration {
+	d := i.Delay
+	switch i.Distribution {
+	case delayUniform:
+		d += time.Duration((rand.Float64()*2 - 1) * float64(i.Jitter))
+	case delayNormal:
+		d += time.Duration(rand.NormFloat64() * float64(i.Jitter))
+	}
+	if d < 0 {
+		d = 0
+	}
+	if i.Max > 0 && d > i.Max {
+		d = i.Max
+	}
+	return d
+}
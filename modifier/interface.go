@@ -1,5 +1,13 @@
 package modifier
 
+import (
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+
+	"github.com/google/gopacket"
+)
+
 type Modifier interface {
 	// Name returns the name of the modifier.
 	Name() string
@@ -15,6 +23,75 @@ type UDPModifierInstance interface {
 	Process(data []byte) ([]byte, error)
 }
 
+// UDPRejecterInstance rejects a UDP stream with an error packet (e.g. ICMP) sent to the client.
+// The engine sends the packet to the client and blocks the stream.
+type UDPRejecterInstance interface {
+	Instance
+	// Reject takes the client's packet that made the rule match, starting with the IP header,
+	// and returns the IP packet to send to the client.
+	Reject(info StreamInfo, packet []byte) ([]byte, error)
+}
+
+// TCPModifierInstance answers the client of a TCP stream on behalf of the server.
+// The engine sends the response to the client, resets the server side and blocks the stream.
+type TCPModifierInstance interface {
+	Instance
+	// Respond takes the payload of the client's packet that made the rule match,
+	// and returns the payload to send to the client in response.
+	Respond(info StreamInfo, data []byte) ([]byte, error)
+}
+
+// TCPRewriterInstance rewrites the client's packet that made the rule match.
+// It's a simpler form of TCPStreamModifierInstance for one-off rewrites.
+type TCPRewriterInstance interface {
+	Instance
+	// Rewrite takes the payload of the client's packet that made the rule match,
+	// and returns the payload to send to the server instead.
+	Rewrite(info StreamInfo, data []byte) ([]byte, error)
+}
+
+// TCPStreamModifierInstance rewrites the data of TCP streams in both directions,
+// from the packet that made the rule match on.
+type TCPStreamModifierInstance interface {
+	Instance
+	// NewStream returns the rewriter of a matched stream.
+	NewStream(info StreamInfo) TCPStreamRewriter
+}
+
+// TCPStreamRewriter rewrites the data of a TCP stream. The engine takes care of the
+// sequence & ack numbers, retransmissions and re-segmentation. It's only used by one goroutine.
+type TCPStreamRewriter interface {
+	// Feed takes the next in-order data from the client (or the server if rev is true),
+	// and returns the data to send in its place. It can return less by holding some back
+	// until it has seen enough (e.g. a complete header), and more once it releases it.
+	// If flush is true (the sender has closed its side, or is waiting for its data to
+	// be acknowledged), it must return everything it has held back.
+	Feed(rev bool, data []byte, flush bool) []byte
+}
+
+// DelayerInstance delays the packets of a stream, both TCP & UDP.
+// The engine holds every packet of the stream from the match on.
+type DelayerInstance interface {
+	Instance
+	// PacketDelay returns how long to hold the next packet. It must be safe for concurrent use.
+	PacketDelay() time.Duration
+}
+
+// IPModifierInstance modifies the IP header of the packets of a stream, both TCP & UDP.
+type IPModifierInstance interface {
+	Instance
+	// ModifyIP modifies the IP header (*layers.IPv4 or *layers.IPv6) of a packet from the client,
+	// or the server if rev is true, in place. It returns whether it has modified anything.
+	// It must be safe for concurrent use.
+	ModifyIP(ip gopacket.NetworkLayer, rev bool) bool
+}
+
+// StreamInfo is what a modifier instance knows about the stream.
+type StreamInfo struct {
+	Rule  string // Name of the matched rule
+	Props analyzer.CombinedPropMap
+}
+
 type ErrInvalidPacket struct {
 	Err error
 }
@@ -0,0 +1,92 @@
+package modifier
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var _ Modifier = (*IPModifier)(nil)
+
+var (
+	errInvalidTTL       = errors.New("ttl must be between 1 and 255")
+	errInvalidDSCP      = errors.New("dscp must be between 0 and 63")
+	errInvalidDirection = errors.New("direction must be both, client or server")
+	errNothingToModify  = errors.New("at least one of ttl and dscp must be set")
+)
+
+// IPModifier rewrites the TTL (hop limit for IPv6) and DSCP of the packets of matched
+// streams (both TCP & UDP), for QoS tagging or TTL-based tricks.
+type IPModifier struct{}
+
+func (m *IPModifier) Name() string {
+	return "ip"
+}
+
+func (m *IPModifier) New(args map[string]interface{}) (Instance, error) {
+	i := &ipModifierInstance{DSCP: -1}
+	if ttl, ok := args["ttl"].(int); ok {
+		if ttl < 1 || ttl > 255 {
+			return nil, &ErrInvalidArgs{Err: errInvalidTTL}
+		}
+		i.TTL = uint8(ttl)
+	}
+	if dscp, ok := args["dscp"].(int); ok {
+		if dscp < 0 || dscp > 63 {
+			return nil, &ErrInvalidArgs{Err: errInvalidDSCP}
+		}
+		i.DSCP = dscp
+	}
+	if i.TTL == 0 && i.DSCP < 0 {
+		return nil, &ErrInvalidArgs{Err: errNothingToModify}
+	}
+	dir, _ := args["direction"].(string)
+	switch strings.ToLower(dir) {
+	case "", "both":
+		i.Client, i.Server = true, true
+	case "client":
+		i.Client = true
+	case "server":
+		i.Server = true
+	default:
+		return nil, &ErrInvalidArgs{Err: errInvalidDirection}
+	}
+	return i, nil
+}
+
+var _ IPModifierInstance = (*ipModifierInstance)(nil)
+
+type ipModifierInstance struct {
+	TTL    uint8 // 0 = unchanged
+	DSCP   int   // -1 = unchanged
+	Client bool  // Modify packets from the client
+	Server bool  // Modify packets from the server
+}
+
+func (i *ipModifierInstance) ModifyIP(ip gopacket.NetworkLayer, rev bool) bool {
+	if (rev && !i.Server) || (!rev && !i.Client) {
+		return false
+	}
+	switch ip := ip.(type) {
+	case *layers.IPv4:
+		if i.TTL != 0 {
+			ip.TTL = i.TTL
+		}
+		if i.DSCP >= 0 {
+			// Keep the ECN bits
+			ip.TOS = uint8(i.DSCP)<<2 | ip.TOS&0x03
+		}
+	case *layers.IPv6:
+		if i.TTL != 0 {
+			ip.HopLimit = i.TTL
+		}
+		if i.DSCP >= 0 {
+			ip.TrafficClass = uint8(i.DSCP)<<2 | ip.TrafficClass&0x03
+		}
+	default:
+		return false
+	}
+	return true
+}
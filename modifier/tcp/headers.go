@@ -0,0 +1,113 @@
+package tcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/apernet/OpenGFW/modifier"
+)
+
+var _ modifier.Modifier = (*HTTPHeadersModifier)(nil)
+
+var (
+	errIncompleteHTTPRequest = errors.New("http request headers are not in a single packet")
+	errInvalidHeader         = errors.New("invalid header")
+)
+
+// HTTPHeadersModifier strips and sets the headers of plaintext HTTP requests
+// on their way to the server.
+type HTTPHeadersModifier struct{}
+
+func (m *HTTPHeadersModifier) Name() string {
+	return "http_headers"
+}
+
+func (m *HTTPHeadersModifier) New(args map[string]interface{}) (modifier.Instance, error) {
+	i := &httpHeadersModifierInstance{
+		Remove: make(map[string]bool),
+	}
+	if remove, ok := args["remove"].([]interface{}); ok {
+		for _, v := range remove {
+			name, ok := v.(string)
+			if !ok || !validHeaderName(name) {
+				return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("%w name %v", errInvalidHeader, v)}
+			}
+			i.Remove[textproto.CanonicalMIMEHeaderKey(name)] = true
+		}
+	}
+	if set, ok := args["set"].(map[string]interface{}); ok {
+		for name, v := range set {
+			value, ok := v.(string)
+			if !ok || !validHeaderName(name) || strings.ContainsAny(value, "\r\n") {
+				return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("%w %q", errInvalidHeader, name)}
+			}
+			i.Set = append(i.Set, httpHeader{Name: textproto.CanonicalMIMEHeaderKey(name), Value: value})
+		}
+	}
+	sort.Slice(i.Set, func(a, b int) bool { return i.Set[a].Name < i.Set[b].Name })
+	if len(i.Remove) == 0 && len(i.Set) == 0 {
+		return nil, &modifier.ErrInvalidArgs{Err: errors.New("nothing to remove or set")}
+	}
+	return i, nil
+}
+
+func validHeaderName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n:")
+}
+
+var _ modifier.TCPRewriterInstance = (*httpHeadersModifierInstance)(nil)
+
+type httpHeader struct {
+	Name  string
+	Value string
+}
+
+type httpHeadersModifierInstance struct {
+	Remove map[string]bool
+	Set    []httpHeader // Replace the headers with the same name, or added if there's none
+}
+
+func (i *httpHeadersModifierInstance) Rewrite(info modifier.StreamInfo, data []byte) ([]byte, error) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, &modifier.ErrInvalidPacket{Err: errIncompleteHTTPRequest}
+	}
+	lines := bytes.Split(data[:end], []byte("\r\n"))
+	if !bytes.Contains(lines[0], []byte(" HTTP/1.")) {
+		return nil, &modifier.ErrInvalidPacket{Err: errNotHTTPRequest}
+	}
+	var out bytes.Buffer
+	out.Grow(len(data) + 64)
+	out.Write(lines[0])
+	out.WriteString("\r\n")
+	for _, line := range lines[1:] {
+		colon := bytes.IndexByte(line, ':')
+		if colon > 0 {
+			name := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[:colon])))
+			if i.Remove[name] || i.isSet(name) {
+				continue
+			}
+		}
+		out.Write(line)
+		out.WriteString("\r\n")
+	}
+	for _, h := range i.Set {
+		out.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	// Terminating empty line & whatever body is in the packet
+	out.Write(data[end+2:])
+	return out.Bytes(), nil
+}
+
+func (i *httpHeadersModifierInstance) isSet(name string) bool {
+	for _, h := range i.Set {
+		if h.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package tcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/modifier"
+)
+
+var _ modifier.Modifier = (*HTTPBlockPageModifier)(nil)
+
+var (
+	errInvalidStatus    = errors.New("status must be 403 or a 3xx redirect")
+	errMissingLocation  = errors.New("redirect status requires location")
+	errNotHTTPRequest   = errors.New("not an http request")
+	errTemplateConflict = errors.New("only one of template and templateFile can be set")
+)
+
+const httpDefaultBlockPage = `<!DOCTYPE html>
+<html>
+<head><title>Access denied</title></head>
+<body>
+<h1>Access denied</h1>
+<p>Access to {{.Host}}{{.Path}} has been blocked by network policy ({{.Rule}}).</p>
+{{if .Contact}}<p>If you believe this is a mistake, please contact {{.Contact}}.</p>{{end}}
+</body>
+</html>
+`
+
+// HTTPBlockPageModifier answers plaintext HTTP requests with a block page (or a redirect)
+// instead of silently dropping them.
+type HTTPBlockPageModifier struct{}
+
+func (m *HTTPBlockPageModifier) Name() string {
+	return "http_blockpage"
+}
+
+func (m *HTTPBlockPageModifier) New(args map[string]interface{}) (modifier.Instance, error) {
+	i := &httpBlockPageModifierInstance{
+		Status: http.StatusForbidden,
+	}
+	if status, ok := args["status"].(int); ok {
+		i.Status = status
+	}
+	if i.Status != http.StatusForbidden && (i.Status < 300 || i.Status > 399) {
+		return nil, &modifier.ErrInvalidArgs{Err: errInvalidStatus}
+	}
+	i.Location, _ = args["location"].(string)
+	if i.Status != http.StatusForbidden && i.Location == "" {
+		return nil, &modifier.ErrInvalidArgs{Err: errMissingLocation}
+	}
+	i.Contact, _ = args["contact"].(string)
+	text := httpDefaultBlockPage
+	tmpl, hasTmpl := args["template"].(string)
+	tmplFile, hasTmplFile := args["templateFile"].(string)
+	switch {
+	case hasTmpl && hasTmplFile:
+		return nil, &modifier.ErrInvalidArgs{Err: errTemplateConflict}
+	case hasTmpl:
+		text = tmpl
+	case hasTmplFile:
+		bs, err := os.ReadFile(tmplFile)
+		if err != nil {
+			return nil, &modifier.ErrInvalidArgs{Err: err}
+		}
+		text = string(bs)
+	}
+	var err error
+	i.Template, err = template.New("blockpage").Parse(text)
+	if err != nil {
+		return nil, &modifier.ErrInvalidArgs{Err: err}
+	}
+	return i, nil
+}
+
+var _ modifier.TCPModifierInstance = (*httpBlockPageModifierInstance)(nil)
+
+type httpBlockPageModifierInstance struct {
+	Status   int
+	Location string
+	Contact  string
+	Template *template.Template
+}
+
+// httpBlockPageData is the data available to block page templates.
+type httpBlockPageData struct {
+	Rule    string
+	Host    string
+	Path    string
+	Contact string
+}
+
+func (i *httpBlockPageModifierInstance) Respond(info modifier.StreamInfo, data []byte) ([]byte, error) {
+	req, ok := info.Props.Get("http", "req").(analyzer.PropMap)
+	if !ok {
+		return nil, &modifier.ErrInvalidPacket{Err: errNotHTTPRequest}
+	}
+	d := httpBlockPageData{
+		Rule:    info.Rule,
+		Contact: i.Contact,
+	}
+	d.Path, _ = req["path"].(string)
+	if headers, ok := req["headers"].(analyzer.PropMap); ok {
+		d.Host, _ = headers["host"].(string)
+	}
+	var body bytes.Buffer
+	if err := i.Template.Execute(&body, d); err != nil {
+		return nil, err
+	}
+	var resp bytes.Buffer
+	fmt.Fprintf(&resp, "HTTP/1.1 %d %s\r\n", i.Status, http.StatusText(i.Status))
+	if i.Location != "" {
+		fmt.Fprintf(&resp, "Location: %s\r\n", i.Location)
+	}
+	resp.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+	resp.WriteString("Content-Length: " + strconv.Itoa(body.Len()) + "\r\n")
+	resp.WriteString("Cache-Control: no-store\r\n")
+	resp.WriteString("Connection: close\r\n\r\n")
+	resp.Write(body.Bytes())
+	return resp.Bytes(), nil
+}
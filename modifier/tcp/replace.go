@@ -0,0 +1,116 @@
+package tcp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/apernet/OpenGFW/modifier"
+)
+
+var _ modifier.Modifier = (*ReplaceModifier)(nil)
+
+var errNoReplacements = errors.New("no replacements for either direction")
+
+// ReplaceModifier replaces strings in the data of TCP streams, in both directions
+// and across packet boundaries, e.g. to rewrite HTTP or SMTP content.
+type ReplaceModifier struct{}
+
+func (m *ReplaceModifier) Name() string {
+	return "tcp_replace"
+}
+
+func (m *ReplaceModifier) New(args map[string]interface{}) (modifier.Instance, error) {
+	i := &replaceModifierInstance{}
+	var err error
+	if i.Client, err = parseReplacements(args["client"]); err != nil {
+		return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("client: %w", err)}
+	}
+	if i.Server, err = parseReplacements(args["server"]); err != nil {
+		return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("server: %w", err)}
+	}
+	if len(i.Client) == 0 && len(i.Server) == 0 {
+		return nil, &modifier.ErrInvalidArgs{Err: errNoReplacements}
+	}
+	return i, nil
+}
+
+type replacement struct {
+	Find, Replace []byte
+}
+
+func parseReplacements(v interface{}) ([]replacement, error) {
+	list, _ := v.([]interface{})
+	rs := make([]replacement, 0, len(list))
+	for _, e := range list {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("replacements must be a list of find & replace")
+		}
+		find, _ := m["find"].(string)
+		replace, _ := m["replace"].(string)
+		if find == "" {
+			return nil, errors.New("find must not be empty")
+		}
+		rs = append(rs, replacement{Find: []byte(find), Replace: []byte(replace)})
+	}
+	return rs, nil
+}
+
+var _ modifier.TCPStreamModifierInstance = (*replaceModifierInstance)(nil)
+
+type replaceModifierInstance struct {
+	Client []replacement
+	Server []replacement
+}
+
+func (i *replaceModifierInstance) NewStream(info modifier.StreamInfo) modifier.TCPStreamRewriter {
+	return &replaceRewriter{rs: [2][]replacement{i.Client, i.Server}}
+}
+
+type replaceRewriter struct {
+	rs   [2][]replacement // Client to server, server to client
+	held [2][]byte
+}
+
+func (r *replaceRewriter) Feed(rev bool, data []byte, flush bool) []byte {
+	dir := 0
+	if rev {
+		dir = 1
+	}
+	rs := r.rs[dir]
+	if len(rs) == 0 {
+		return data
+	}
+	buf := append(r.held[dir], data...)
+	r.held[dir] = nil
+	if !flush {
+		// Hold back the end that could be the start of a match continuing in the next packet
+		if h := partialMatchLen(buf, rs); h > 0 {
+			r.held[dir] = append([]byte(nil), buf[len(buf)-h:]...)
+			buf = buf[:len(buf)-h]
+		}
+	}
+	for _, rp := range rs {
+		buf = bytes.ReplaceAll(buf, rp.Find, rp.Replace)
+	}
+	return buf
+}
+
+// partialMatchLen returns the length of the longest suffix of buf that is a proper prefix of a find string.
+func partialMatchLen(buf []byte, rs []replacement) int {
+	longest := 0
+	for _, rp := range rs {
+		n := len(rp.Find) - 1
+		if n > len(buf) {
+			n = len(buf)
+		}
+		for ; n > longest; n-- {
+			if bytes.HasPrefix(rp.Find, buf[len(buf)-n:]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
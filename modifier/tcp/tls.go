@@ -0,0 +1,67 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/modifier"
+)
+
+var _ modifier.Modifier = (*TLSAlertModifier)(nil)
+
+var errNotTLSClientHello = errors.New("not a tls client hello")
+
+const (
+	tlsRecordTypeAlert = 21
+	tlsAlertLevelFatal = 2
+)
+
+// tlsAlerts are the alert descriptions (RFC 8446 section 6) that make sense to
+// answer a ClientHello with.
+var tlsAlerts = map[string]byte{
+	"handshake_failure":     40,
+	"illegal_parameter":     47,
+	"access_denied":         49,
+	"protocol_version":      70,
+	"insufficient_security": 71,
+	"internal_error":        80,
+	"unrecognized_name":     112,
+}
+
+// TLSAlertModifier answers TLS ClientHellos with a fatal alert, so that clients
+// fail fast with a clear error instead of timing out.
+type TLSAlertModifier struct{}
+
+func (m *TLSAlertModifier) Name() string {
+	return "tls_alert"
+}
+
+func (m *TLSAlertModifier) New(args map[string]interface{}) (modifier.Instance, error) {
+	i := &tlsAlertModifierInstance{
+		Description: tlsAlerts["access_denied"],
+	}
+	if alert, ok := args["alert"].(string); ok {
+		d, ok := tlsAlerts[strings.ToLower(alert)]
+		if !ok {
+			return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("unsupported alert %q", alert)}
+		}
+		i.Description = d
+	}
+	return i, nil
+}
+
+var _ modifier.TCPModifierInstance = (*tlsAlertModifierInstance)(nil)
+
+type tlsAlertModifierInstance struct {
+	Description byte
+}
+
+func (i *tlsAlertModifierInstance) Respond(info modifier.StreamInfo, data []byte) ([]byte, error) {
+	if _, ok := info.Props.Get("tls", "req").(analyzer.PropMap); !ok {
+		return nil, &modifier.ErrInvalidPacket{Err: errNotTLSClientHello}
+	}
+	// Alert record, TLS 1.2 record version as used by TLS 1.3 too
+	return []byte{tlsRecordTypeAlert, 0x03, 0x03, 0x00, 0x02, tlsAlertLevelFatal, i.Description}, nil
+}
@@ -1,23 +1,37 @@
 package udp
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"strings"
 
+	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/modifier"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"gopkg.in/yaml.v3"
 )
 
-var _ modifier.Modifier = (*DNSModifier)(nil)
+var (
+	_ modifier.Modifier            = (*DNSModifier)(nil)
+	_ modifier.UDPModifierInstance = (*dnsModifierInstance)(nil)
+	_ modifier.TCPModifierInstance = (*dnsModifierInstance)(nil)
+)
 
 var (
 	errInvalidIP           = errors.New("invalid ip")
 	errNotValidDNSResponse = errors.New("not a valid dns response")
+	errNotValidDNSQuery    = errors.New("not a valid dns query")
 	errEmptyDNSQuestion    = errors.New("empty dns question")
+	errDomainsConflict     = errors.New("only one of domains and domainsFile can be set")
 )
 
+// DNSModifier forges DNS answers. For UDP, it rewrites the responses from the server.
+// For TCP, it answers the queries of the client itself.
 type DNSModifier struct{}
 
 func (m *DNSModifier) Name() string {
@@ -25,70 +39,249 @@ func (m *DNSModifier) Name() string {
 }
 
 func (m *DNSModifier) New(args map[string]interface{}) (modifier.Instance, error) {
-	i := &dnsModifierInstance{}
-	aStr, ok := args["a"].(string)
-	if ok {
-		a := net.ParseIP(aStr).To4()
-		if a == nil {
-			return nil, &modifier.ErrInvalidArgs{Err: errInvalidIP}
+	def, err := parseDNSForge(args, 0)
+	if err != nil {
+		return nil, &modifier.ErrInvalidArgs{Err: err}
+	}
+	i := &dnsModifierInstance{Default: def}
+	domains, hasDomains := args["domains"].(map[string]interface{})
+	domainsFile, hasDomainsFile := args["domainsFile"].(string)
+	switch {
+	case hasDomains && hasDomainsFile:
+		return nil, &modifier.ErrInvalidArgs{Err: errDomainsConflict}
+	case hasDomainsFile:
+		bs, err := os.ReadFile(domainsFile)
+		if err != nil {
+			return nil, &modifier.ErrInvalidArgs{Err: err}
+		}
+		if err := yaml.Unmarshal(bs, &domains); err != nil {
+			return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("invalid domains file: %w", err)}
 		}
-		i.A = a
 	}
-	aaaaStr, ok := args["aaaa"].(string)
-	if ok {
-		aaaa := net.ParseIP(aaaaStr).To16()
-		if aaaa == nil {
-			return nil, &modifier.ErrInvalidArgs{Err: errInvalidIP}
+	if len(domains) > 0 {
+		i.Domains = make(map[string]*dnsForge, len(domains))
+		for name, v := range domains {
+			entryArgs, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("domain %q: invalid entry", name)}
+			}
+			f, err := parseDNSForge(entryArgs, def.TTL)
+			if err != nil {
+				return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("domain %q: %w", name, err)}
+			}
+			i.Domains[normalizeDNSName(name)] = f
 		}
-		i.AAAA = aaaa
 	}
 	return i, nil
 }
 
-var _ modifier.UDPModifierInstance = (*dnsModifierInstance)(nil)
+// dnsForge is what to answer for a domain.
+type dnsForge struct {
+	A        []net.IP
+	AAAA     []net.IP
+	CNAME    []string // Chain of canonical names, the A & AAAA records are for the last one
+	TTL      uint32
+	NXDomain bool
+}
+
+func (f *dnsForge) empty() bool {
+	return len(f.A) == 0 && len(f.AAAA) == 0 && len(f.CNAME) == 0 && !f.NXDomain
+}
+
+func parseDNSForge(args map[string]interface{}, defTTL uint32) (*dnsForge, error) {
+	f := &dnsForge{TTL: defTTL}
+	for _, s := range stringOrList(args["a"]) {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, errInvalidIP
+		}
+		f.A = append(f.A, ip)
+	}
+	for _, s := range stringOrList(args["aaaa"]) {
+		ip := net.ParseIP(s).To16()
+		if ip == nil {
+			return nil, errInvalidIP
+		}
+		f.AAAA = append(f.AAAA, ip)
+	}
+	for _, s := range stringOrList(args["cname"]) {
+		f.CNAME = append(f.CNAME, strings.TrimSuffix(s, "."))
+	}
+	if ttl, ok := args["ttl"].(int); ok {
+		if ttl < 0 {
+			return nil, errors.New("ttl must not be negative")
+		}
+		f.TTL = uint32(ttl)
+	}
+	f.NXDomain, _ = args["nxdomain"].(bool)
+	if f.NXDomain && (len(f.A) > 0 || len(f.AAAA) > 0 || len(f.CNAME) > 0) {
+		return nil, errors.New("nxdomain can't have answers")
+	}
+	return f, nil
+}
+
+// stringOrList accepts both a single string and a list of strings.
+func stringOrList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	default:
+		return nil
+	}
+}
+
+func normalizeDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
 
 type dnsModifierInstance struct {
-	A    net.IP
-	AAAA net.IP
+	Default *dnsForge
+	Domains map[string]*dnsForge // Also apply to subdomains, the most specific one wins
 }
 
+func (i *dnsModifierInstance) lookup(name string) *dnsForge {
+	if len(i.Domains) > 0 {
+		name = normalizeDNSName(name)
+		for {
+			if f, ok := i.Domains[name]; ok {
+				return f
+			}
+			dot := strings.IndexByte(name, '.')
+			if dot < 0 {
+				break
+			}
+			name = name[dot+1:]
+		}
+	}
+	return i.Default
+}
+
+// forge replaces the answers of the response to its first question.
+// It returns false if there's nothing to forge for the question.
+func (i *dnsModifierInstance) forge(dns *layers.DNS) bool {
+	// In practice, most if not all DNS clients only send one question
+	// per packet, so we don't care about the rest for now.
+	q := dns.Questions[0]
+	f := i.lookup(string(q.Name))
+	if f.empty() {
+		return false
+	}
+	var answers []layers.DNSResourceRecord
+	if f.NXDomain {
+		dns.ResponseCode = layers.DNSResponseCodeNXDomain
+	} else {
+		dns.ResponseCode = layers.DNSResponseCodeNoErr
+		name := q.Name
+		for _, cname := range f.CNAME {
+			answers = append(answers, layers.DNSResourceRecord{
+				Name:  name,
+				Type:  layers.DNSTypeCNAME,
+				Class: layers.DNSClassIN,
+				TTL:   f.TTL,
+				CNAME: []byte(cname),
+			})
+			name = []byte(cname)
+		}
+		var ips []net.IP
+		switch q.Type {
+		case layers.DNSTypeA:
+			ips = f.A
+		case layers.DNSTypeAAAA:
+			ips = f.AAAA
+		}
+		for _, ip := range ips {
+			answers = append(answers, layers.DNSResourceRecord{
+				Name:  name,
+				Type:  q.Type,
+				Class: layers.DNSClassIN,
+				TTL:   f.TTL,
+				IP:    ip,
+			})
+		}
+		if len(answers) == 0 {
+			// Nothing to forge for this type, leave the response alone
+			return false
+		}
+	}
+	dns.Answers = answers
+	dns.Authorities = nil
+	// Keep only the EDNS OPT record, the rest belong to the real answers
+	var additionals []layers.DNSResourceRecord
+	for _, rr := range dns.Additionals {
+		if rr.Type == layers.DNSTypeOPT {
+			additionals = append(additionals, rr)
+		}
+	}
+	dns.Additionals = additionals
+	return true
+}
+
+// Process rewrites a DNS response from the server.
 func (i *dnsModifierInstance) Process(data []byte) ([]byte, error) {
 	dns := &layers.DNS{}
 	err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
 	if err != nil {
 		return nil, &modifier.ErrInvalidPacket{Err: err}
 	}
-	if !dns.QR || dns.ResponseCode != layers.DNSResponseCodeNoErr {
+	if !dns.QR {
 		return nil, &modifier.ErrInvalidPacket{Err: errNotValidDNSResponse}
 	}
 	if len(dns.Questions) == 0 {
 		return nil, &modifier.ErrInvalidPacket{Err: errEmptyDNSQuestion}
 	}
-	// In practice, most if not all DNS clients only send one question
-	// per packet, so we don't care about the rest for now.
-	q := dns.Questions[0]
-	switch q.Type {
-	case layers.DNSTypeA:
-		if i.A != nil {
-			dns.Answers = []layers.DNSResourceRecord{{
-				Name:  q.Name,
-				Type:  layers.DNSTypeA,
-				Class: layers.DNSClassIN,
-				IP:    i.A,
-			}}
-		}
-	case layers.DNSTypeAAAA:
-		if i.AAAA != nil {
-			dns.Answers = []layers.DNSResourceRecord{{
-				Name:  q.Name,
-				Type:  layers.DNSTypeAAAA,
-				Class: layers.DNSClassIN,
-				IP:    i.AAAA,
-			}}
-		}
+	if !i.forge(dns) && dns.ResponseCode != layers.DNSResponseCodeNoErr {
+		return nil, &modifier.ErrInvalidPacket{Err: errNotValidDNSResponse}
+	}
+	return serializeDNS(dns)
+}
+
+// Respond answers a DNS over TCP query from the client, echoing its ID and questions.
+func (i *dnsModifierInstance) Respond(info modifier.StreamInfo, data []byte) ([]byte, error) {
+	m, ok := info.Props["dns"]
+	if qr, _ := m["qr"].(bool); !ok || qr {
+		return nil, &modifier.ErrInvalidPacket{Err: errNotValidDNSQuery}
 	}
+	questions, _ := m["questions"].([]analyzer.PropMap)
+	if len(questions) == 0 {
+		return nil, &modifier.ErrInvalidPacket{Err: errEmptyDNSQuestion}
+	}
+	dns := &layers.DNS{QR: true, RA: true}
+	dns.ID, _ = m["id"].(uint16)
+	dns.OpCode, _ = m["opcode"].(layers.DNSOpCode)
+	dns.RD, _ = m["rd"].(bool)
+	for _, q := range questions {
+		name, _ := q["name"].(string)
+		qType, _ := q["type"].(layers.DNSType)
+		qClass, _ := q["class"].(layers.DNSClass)
+		dns.Questions = append(dns.Questions, layers.DNSQuestion{
+			Name:  []byte(name),
+			Type:  qType,
+			Class: qClass,
+		})
+	}
+	// An empty answer if there's nothing to forge, as the query never reaches the server
+	i.forge(dns)
+	msg, err := serializeDNS(dns)
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(resp, uint16(len(msg)))
+	copy(resp[2:], msg)
+	return resp, nil
+}
+
+func serializeDNS(dns *layers.DNS) ([]byte, error) {
 	buf := gopacket.NewSerializeBuffer() // Modifiers must be safe for concurrent use, so we can't reuse the buffer
-	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{
 		FixLengths:       true,
 		ComputeChecksums: true,
 	}, dns)
@@ -0,0 +1,468 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/modifier"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// dnsTestResponse returns a response of the real server to a question, with an answer,
+// an authority & 2 additional records, one of them being EDNS.
+func dnsTestResponse(t *testing.T, name string, qType layers.DNSType, rcode layers.DNSResponseCode) []byte {
+	dns := &layers.DNS{
+		ID:           0x1234,
+		QR:           true,
+		RD:           true,
+		RA:           true,
+		ResponseCode: rcode,
+		Questions:    []layers.DNSQuestion{{Name: []byte(name), Type: qType, Class: layers.DNSClassIN}},
+	}
+	if rcode == layers.DNSResponseCodeNoErr {
+		dns.Answers = []layers.DNSResourceRecord{
+			{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 3600, IP: net.IPv4(93, 184, 216, 34)},
+		}
+		dns.Authorities = []layers.DNSResourceRecord{
+			{Name: []byte("example.com"), Type: layers.DNSTypeNS, Class: layers.DNSClassIN, TTL: 3600, NS: []byte("ns.example.com")},
+		}
+		dns.Additionals = []layers.DNSResourceRecord{
+			{Name: []byte("ns.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 3600, IP: net.IPv4(192, 0, 2, 53)},
+		}
+	}
+	dns.Additionals = append(dns.Additionals, layers.DNSResourceRecord{Type: layers.DNSTypeOPT, Class: 1232})
+	data, err := serializeDNS(dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// dnsTestRecords returns the records of a section as strings, to compare them.
+func dnsTestRecords(rrs []layers.DNSResourceRecord) []string {
+	var ss []string
+	for _, rr := range rrs {
+		s := fmt.Sprintf("%s %v %d", rr.Name, rr.Type, rr.TTL)
+		switch rr.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			s += " " + rr.IP.String()
+		case layers.DNSTypeCNAME:
+			s += " " + string(rr.CNAME)
+		case layers.DNSTypeNS:
+			s += " " + string(rr.NS)
+		}
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func dnsTestInstance(t *testing.T, args map[string]interface{}) *dnsModifierInstance {
+	mi, err := (&DNSModifier{}).New(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mi.(*dnsModifierInstance)
+}
+
+func TestDNSModifier_New(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	testCases := []struct {
+		name    string
+		args    map[string]interface{}
+		wantErr string
+	}{
+		{"default", map[string]interface{}{"a": "10.0.0.1", "aaaa": "fd00::1"}, ""},
+		{"lists", map[string]interface{}{"a": []interface{}{"10.0.0.1", "10.0.0.2"}, "ttl": 60}, ""},
+		{"domains", map[string]interface{}{"domains": map[string]interface{}{"example.com": map[string]interface{}{"nxdomain": true}}}, ""},
+		{"domains file", map[string]interface{}{"domainsFile": write("domains.yaml", "example.com:\n  a: 10.0.0.1\n")}, ""},
+		{"invalid a", map[string]interface{}{"a": "fd00::1"}, "invalid ip"},
+		{"invalid aaaa", map[string]interface{}{"aaaa": "example.com"}, "invalid ip"},
+		{"negative ttl", map[string]interface{}{"a": "10.0.0.1", "ttl": -1}, "ttl must not be negative"},
+		{"nxdomain with answers", map[string]interface{}{"a": "10.0.0.1", "nxdomain": true}, "nxdomain can't have answers"},
+		{"invalid domain entry", map[string]interface{}{"domains": map[string]interface{}{"example.com": "10.0.0.1"}}, `domain "example.com": invalid entry`},
+		{"invalid domain ip", map[string]interface{}{"domains": map[string]interface{}{"example.com": map[string]interface{}{"a": "x"}}}, `domain "example.com": invalid ip`},
+		{"domains conflict", map[string]interface{}{"domains": map[string]interface{}{}, "domainsFile": "domains.yaml"}, "only one of domains and domainsFile"},
+		{"missing domains file", map[string]interface{}{"domainsFile": filepath.Join(dir, "missing.yaml")}, "no such file"},
+		{"invalid domains file", map[string]interface{}{"domainsFile": write("invalid.yaml", "[")}, "invalid domains file"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := (&DNSModifier{}).New(tc.args)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("New() error = %v", err)
+				}
+				return
+			}
+			var argsErr *modifier.ErrInvalidArgs
+			if !errors.As(err, &argsErr) || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("New() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSModifierInstance_Process(t *testing.T) {
+	mi := dnsTestInstance(t, map[string]interface{}{
+		"a":    "10.0.0.1",
+		"aaaa": "fd00::1",
+		"ttl":  300,
+		"domains": map[string]interface{}{
+			"cdn.example.com.": map[string]interface{}{
+				"cname": []interface{}{"edge.example.net.", "pop.example.net"},
+				"a":     []interface{}{"10.0.0.2", "10.0.0.3"},
+				"ttl":   60,
+			},
+			"Blocked.Example.COM": map[string]interface{}{"nxdomain": true},
+			"www.blocked.example.com": map[string]interface{}{
+				"a": "10.0.0.4",
+			},
+		},
+	})
+	onlyDomains := dnsTestInstance(t, map[string]interface{}{
+		"domains": map[string]interface{}{"example.com": map[string]interface{}{"a": "10.0.0.1"}},
+	})
+	testCases := []struct {
+		name            string
+		instance        *dnsModifierInstance
+		question        string
+		qType           layers.DNSType
+		rcode           layers.DNSResponseCode
+		wantRcode       layers.DNSResponseCode
+		wantAnswers     []string
+		wantAuthorities []string
+		wantAdditionals []string
+	}{
+		{
+			name:            "default A",
+			instance:        mi,
+			question:        "example.org",
+			qType:           layers.DNSTypeA,
+			wantAnswers:     []string{"example.org A 300 10.0.0.1"},
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:            "default AAAA",
+			instance:        mi,
+			question:        "example.org",
+			qType:           layers.DNSTypeAAAA,
+			wantAnswers:     []string{"example.org AAAA 300 fd00::1"},
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:     "CNAME chain",
+			instance: mi,
+			question: "cdn.example.com",
+			qType:    layers.DNSTypeA,
+			wantAnswers: []string{
+				"cdn.example.com CNAME 60 edge.example.net",
+				"edge.example.net CNAME 60 pop.example.net",
+				"pop.example.net A 60 10.0.0.2",
+				"pop.example.net A 60 10.0.0.3",
+			},
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:     "CNAME only for other types",
+			instance: mi,
+			question: "img.cdn.example.com",
+			qType:    layers.DNSTypeAAAA,
+			wantAnswers: []string{
+				"img.cdn.example.com CNAME 60 edge.example.net",
+				"edge.example.net CNAME 60 pop.example.net",
+			},
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:            "NXDOMAIN",
+			instance:        mi,
+			question:        "blocked.example.com",
+			qType:           layers.DNSTypeA,
+			wantRcode:       layers.DNSResponseCodeNXDomain,
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:            "NXDOMAIN of a subdomain",
+			instance:        mi,
+			question:        "mail.BLOCKED.example.com",
+			qType:           layers.DNSTypeA,
+			wantRcode:       layers.DNSResponseCodeNXDomain,
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:            "most specific domain, default TTL",
+			instance:        mi,
+			question:        "www.blocked.example.com",
+			qType:           layers.DNSTypeA,
+			wantAnswers:     []string{"www.blocked.example.com A 300 10.0.0.4"},
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:            "real error replaced",
+			instance:        mi,
+			question:        "example.org",
+			qType:           layers.DNSTypeA,
+			rcode:           layers.DNSResponseCodeServFail,
+			wantAnswers:     []string{"example.org A 300 10.0.0.1"},
+			wantAdditionals: []string{" OPT 0"},
+		},
+		{
+			name:            "other type left alone",
+			instance:        mi,
+			question:        "example.org",
+			qType:           layers.DNSTypeMX,
+			wantAnswers:     []string{"example.org A 3600 93.184.216.34"},
+			wantAuthorities: []string{"example.com NS 3600 ns.example.com"},
+			wantAdditionals: []string{"ns.example.com A 3600 192.0.2.53", " OPT 0"},
+		},
+		{
+			name:            "other domain left alone",
+			instance:        onlyDomains,
+			question:        "example.org",
+			qType:           layers.DNSTypeA,
+			wantAnswers:     []string{"example.org A 3600 93.184.216.34"},
+			wantAuthorities: []string{"example.com NS 3600 ns.example.com"},
+			wantAdditionals: []string{"ns.example.com A 3600 192.0.2.53", " OPT 0"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := tc.instance.Process(dnsTestResponse(t, tc.question, tc.qType, tc.rcode))
+			if err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+			dns := &layers.DNS{}
+			if err := dns.DecodeFromBytes(out, gopacket.NilDecodeFeedback); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if dns.ID != 0x1234 || !dns.QR || !dns.RD || !dns.RA {
+				t.Errorf("header = %#x, qr %v, rd %v, ra %v", dns.ID, dns.QR, dns.RD, dns.RA)
+			}
+			if len(dns.Questions) != 1 || string(dns.Questions[0].Name) != tc.question || dns.Questions[0].Type != tc.qType {
+				t.Errorf("questions = %+v", dns.Questions)
+			}
+			if dns.ResponseCode != tc.wantRcode {
+				t.Errorf("rcode = %v, want %v", dns.ResponseCode, tc.wantRcode)
+			}
+			if got := dnsTestRecords(dns.Answers); !reflect.DeepEqual(got, tc.wantAnswers) {
+				t.Errorf("answers = %q, want %q", got, tc.wantAnswers)
+			}
+			if got := dnsTestRecords(dns.Authorities); !reflect.DeepEqual(got, tc.wantAuthorities) {
+				t.Errorf("authorities = %q, want %q", got, tc.wantAuthorities)
+			}
+			if got := dnsTestRecords(dns.Additionals); !reflect.DeepEqual(got, tc.wantAdditionals) {
+				t.Errorf("additionals = %q, want %q", got, tc.wantAdditionals)
+			}
+		})
+	}
+}
+
+// dnsTestCompressed is a response of a real server, with its names compressed:
+// a CNAME from www.example.com to example.com, and an A record for example.com.
+var dnsTestCompressed = []byte{
+	0xab, 0xcd, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x00,
+	// Question: www.example.com A IN
+	0x03, 'w', 'w', 'w', 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+	0x00, 0x01, 0x00, 0x01,
+	// www.example.com (pointer to the question) CNAME example.com (pointer into the question)
+	0xc0, 0x0c, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x02, 0xc0, 0x10,
+	// example.com (pointer into the question) A 93.184.216.34
+	0xc0, 0x10, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10, 0x00, 0x04, 93, 184, 216, 34,
+}
+
+func TestDNSModifierInstance_Process_Compressed(t *testing.T) {
+	testCases := []struct {
+		name        string
+		instance    *dnsModifierInstance
+		wantAnswers []string
+	}{
+		{
+			name:        "forged",
+			instance:    dnsTestInstance(t, map[string]interface{}{"a": "10.0.0.1"}),
+			wantAnswers: []string{"www.example.com A 0 10.0.0.1"},
+		},
+		{
+			name: "left alone",
+			instance: dnsTestInstance(t, map[string]interface{}{
+				"domains": map[string]interface{}{"example.org": map[string]interface{}{"a": "10.0.0.1"}},
+			}),
+			wantAnswers: []string{
+				"www.example.com CNAME 3600 example.com",
+				"example.com A 3600 93.184.216.34",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := tc.instance.Process(dnsTestCompressed)
+			if err != nil {
+				t.Fatalf("Process() error = %v", err)
+			}
+			dns := &layers.DNS{}
+			if err := dns.DecodeFromBytes(out, gopacket.NilDecodeFeedback); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if dns.ID != 0xabcd || len(dns.Questions) != 1 || string(dns.Questions[0].Name) != "www.example.com" {
+				t.Errorf("id = %#x, questions = %+v", dns.ID, dns.Questions)
+			}
+			if got := dnsTestRecords(dns.Answers); !reflect.DeepEqual(got, tc.wantAnswers) {
+				t.Errorf("answers = %q, want %q", got, tc.wantAnswers)
+			}
+		})
+	}
+}
+
+func TestDNSModifierInstance_Process_Invalid(t *testing.T) {
+	mi := dnsTestInstance(t, map[string]interface{}{"a": "10.0.0.1"})
+	onlyDomains := dnsTestInstance(t, map[string]interface{}{
+		"domains": map[string]interface{}{"example.com": map[string]interface{}{"a": "10.0.0.1"}},
+	})
+	query, err := serializeDNS(&layers.DNS{
+		ID:        1,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noQuestion, err := serializeDNS(&layers.DNS{ID: 1, QR: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop := append([]byte(nil), dnsTestCompressed...)
+	loop[12] = 0xc0
+	loop[13] = 0x0c // The question name points to itself
+	forward := append([]byte(nil), dnsTestCompressed...)
+	forward[len(dnsTestCompressed)-16] = 0xff // The answer name points past the end
+	testCases := []struct {
+		name     string
+		instance *dnsModifierInstance
+		data     []byte
+		wantErr  error
+	}{
+		{"empty", mi, nil, nil},
+		{"garbage", mi, []byte("not a dns message"), nil},
+		{"truncated header", mi, dnsTestCompressed[:11], nil},
+		{"truncated question", mi, dnsTestCompressed[:20], nil},
+		{"truncated answer", mi, dnsTestCompressed[:len(dnsTestCompressed)-2], nil},
+		{"pointer loop", mi, loop, nil},
+		{"pointer past the end", mi, forward, nil},
+		{"query", mi, query, errNotValidDNSResponse},
+		{"no question", mi, noQuestion, errEmptyDNSQuestion},
+		{"real error left alone", onlyDomains, dnsTestResponse(t, "example.org", layers.DNSTypeA, layers.DNSResponseCodeServFail), errNotValidDNSResponse},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := tc.instance.Process(tc.data)
+			var packetErr *modifier.ErrInvalidPacket
+			if !errors.As(err, &packetErr) {
+				t.Fatalf("Process() = %x, %v, want an invalid packet error", out, err)
+			}
+			if tc.wantErr != nil && packetErr.Err != tc.wantErr {
+				t.Errorf("Process() error = %v, want %v", packetErr.Err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDNSModifierInstance_Process_Corrupt(t *testing.T) {
+	mi := dnsTestInstance(t, map[string]interface{}{"a": "10.0.0.1", "cname": "edge.example.net"})
+	for _, data := range [][]byte{dnsTestCompressed, dnsTestResponse(t, "example.com", layers.DNSTypeA, 0)} {
+		for i := range data {
+			_, _ = mi.Process(data[:i])
+			for _, x := range []byte{0xff, 0x01, 0x80} {
+				corrupt := append([]byte(nil), data...)
+				corrupt[i] ^= x
+				_, _ = mi.Process(corrupt)
+			}
+		}
+	}
+}
+
+func TestDNSModifierInstance_Respond(t *testing.T) {
+	mi := dnsTestInstance(t, map[string]interface{}{
+		"a":       "10.0.0.1",
+		"domains": map[string]interface{}{"blocked.example.com": map[string]interface{}{"nxdomain": true}},
+	})
+	query := func(name string, qType layers.DNSType) modifier.StreamInfo {
+		return modifier.StreamInfo{Props: analyzer.CombinedPropMap{"dns": analyzer.PropMap{
+			"id":     uint16(0x4242),
+			"qr":     false,
+			"opcode": layers.DNSOpCodeQuery,
+			"rd":     true,
+			"questions": []analyzer.PropMap{
+				{"name": name, "type": qType, "class": layers.DNSClassIN},
+			},
+		}}}
+	}
+	testCases := []struct {
+		name        string
+		info        modifier.StreamInfo
+		wantRcode   layers.DNSResponseCode
+		wantAnswers []string
+	}{
+		{"forged", query("example.com", layers.DNSTypeA), layers.DNSResponseCodeNoErr, []string{"example.com A 0 10.0.0.1"}},
+		{"NXDOMAIN", query("blocked.example.com", layers.DNSTypeA), layers.DNSResponseCodeNXDomain, nil},
+		{"nothing to forge", query("example.com", layers.DNSTypeTXT), layers.DNSResponseCodeNoErr, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := mi.Respond(tc.info, nil)
+			if err != nil {
+				t.Fatalf("Respond() error = %v", err)
+			}
+			if len(resp) < 2 || int(binary.BigEndian.Uint16(resp)) != len(resp)-2 {
+				t.Fatalf("invalid length prefix in %x", resp)
+			}
+			dns := &layers.DNS{}
+			if err := dns.DecodeFromBytes(resp[2:], gopacket.NilDecodeFeedback); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if dns.ID != 0x4242 || !dns.QR || !dns.RD || !dns.RA || len(dns.Questions) != 1 {
+				t.Errorf("header = %#x, qr %v, rd %v, ra %v, questions %+v", dns.ID, dns.QR, dns.RD, dns.RA, dns.Questions)
+			}
+			if dns.ResponseCode != tc.wantRcode {
+				t.Errorf("rcode = %v, want %v", dns.ResponseCode, tc.wantRcode)
+			}
+			if got := dnsTestRecords(dns.Answers); !reflect.DeepEqual(got, tc.wantAnswers) {
+				t.Errorf("answers = %q, want %q", got, tc.wantAnswers)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name    string
+		info    modifier.StreamInfo
+		wantErr error
+	}{
+		{"no dns props", modifier.StreamInfo{}, errNotValidDNSQuery},
+		{"response", modifier.StreamInfo{Props: analyzer.CombinedPropMap{"dns": analyzer.PropMap{"qr": true}}}, errNotValidDNSQuery},
+		{"no question", modifier.StreamInfo{Props: analyzer.CombinedPropMap{"dns": analyzer.PropMap{"qr": false}}}, errEmptyDNSQuestion},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := mi.Respond(tc.info, nil)
+			var packetErr *modifier.ErrInvalidPacket
+			if !errors.As(err, &packetErr) || packetErr.Err != tc.wantErr {
+				t.Errorf("Respond() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
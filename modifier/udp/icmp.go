@@ -0,0 +1,116 @@
+package udp
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/apernet/OpenGFW/modifier"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var _ modifier.Modifier = (*ICMPModifier)(nil)
+
+var (
+	errInvalidICMPCode = errors.New("code must be port, host, net or admin")
+	errNotIPPacket     = errors.New("not an ip packet")
+)
+
+const (
+	// Maximum size of the ICMP errors, as much of the original packet as fits is included.
+	// RFC 1812 4.3.2.3 for IPv4, RFC 4443 2.4 (minimum MTU) for IPv6.
+	icmpv4MaxSize = 576
+	icmpv6MaxSize = 1280
+	icmpTTL       = 64
+)
+
+// icmpCodes are the destination unreachable codes for ICMPv4 and ICMPv6.
+var icmpCodes = map[string][2]uint8{
+	"port":  {layers.ICMPv4CodePort, layers.ICMPv6CodePortUnreachable},
+	"host":  {layers.ICMPv4CodeHost, layers.ICMPv6CodeAddressUnreachable},
+	"net":   {layers.ICMPv4CodeNet, layers.ICMPv6CodeNoRouteToDst},
+	"admin": {layers.ICMPv4CodeCommAdminProhibited, layers.ICMPv6CodeAdminProhibited},
+}
+
+// ICMPModifier rejects UDP streams with an ICMP (or ICMPv6) destination unreachable
+// error sent to the client from userspace, for when kernel reject rules can't be used.
+type ICMPModifier struct{}
+
+func (m *ICMPModifier) Name() string {
+	return "icmp"
+}
+
+func (m *ICMPModifier) New(args map[string]interface{}) (modifier.Instance, error) {
+	code, _ := args["code"].(string)
+	if code == "" {
+		code = "port"
+	}
+	codes, ok := icmpCodes[strings.ToLower(code)]
+	if !ok {
+		return nil, &modifier.ErrInvalidArgs{Err: errInvalidICMPCode}
+	}
+	return &icmpModifierInstance{Code4: codes[0], Code6: codes[1]}, nil
+}
+
+var _ modifier.UDPRejecterInstance = (*icmpModifierInstance)(nil)
+
+type icmpModifierInstance struct {
+	Code4 uint8
+	Code6 uint8
+}
+
+func (i *icmpModifierInstance) Reject(info modifier.StreamInfo, packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, &modifier.ErrInvalidPacket{Err: errNotIPPacket}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	switch packet[0] >> 4 {
+	case 4:
+		orig := &layers.IPv4{}
+		if err := orig.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
+			return nil, &modifier.ErrInvalidPacket{Err: err}
+		}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      icmpTTL,
+			Protocol: layers.IPProtocolICMPv4,
+			SrcIP:    orig.DstIP,
+			DstIP:    orig.SrcIP,
+		}
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, i.Code4)}
+		// 20 bytes IP header + 8 bytes ICMP header
+		err := gopacket.SerializeLayers(buf, opts, ip, icmp, gopacket.Payload(truncate(packet, icmpv4MaxSize-28)))
+		return buf.Bytes(), err
+	case 6:
+		orig := &layers.IPv6{}
+		if err := orig.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
+			return nil, &modifier.ErrInvalidPacket{Err: err}
+		}
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   icmpTTL,
+			NextHeader: layers.IPProtocolICMPv6,
+			SrcIP:      orig.DstIP,
+			DstIP:      orig.SrcIP,
+		}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, i.Code6)}
+		if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+			return nil, err
+		}
+		// 40 bytes IP header + 4 bytes ICMP header + 4 unused bytes, which are part of the payload here
+		payload := append(make([]byte, 4), truncate(packet, icmpv6MaxSize-48)...)
+		err := gopacket.SerializeLayers(buf, opts, ip, icmp, gopacket.Payload(payload))
+		return buf.Bytes(), err
+	default:
+		return nil, &modifier.ErrInvalidPacket{Err: errNotIPPacket}
+	}
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
@@ -0,0 +1,303 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/apernet/OpenGFW/modifier"
+)
+
+var _ modifier.Modifier = (*RewriteModifier)(nil)
+
+var (
+	errNoRewriteOps  = errors.New("no rewrite operations")
+	errOutOfRange    = errors.New("offset out of range")
+	errUnknownOp     = errors.New("operation must have exactly one of set, insert, delete, regex, template and checksum")
+	errUnknownChksum = errors.New("unknown checksum type")
+)
+
+// RewriteModifier applies a list of config-driven operations to UDP payloads,
+// for simple protocol mangling that doesn't deserve its own modifier.
+type RewriteModifier struct{}
+
+func (m *RewriteModifier) Name() string {
+	return "rewrite"
+}
+
+func (m *RewriteModifier) New(args map[string]interface{}) (modifier.Instance, error) {
+	rawOps, _ := args["ops"].([]interface{})
+	if len(rawOps) == 0 {
+		return nil, &modifier.ErrInvalidArgs{Err: errNoRewriteOps}
+	}
+	i := &rewriteModifierInstance{}
+	for n, raw := range rawOps {
+		opArgs, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("op #%d: %w", n+1, errUnknownOp)}
+		}
+		op, err := newRewriteOp(opArgs)
+		if err != nil {
+			return nil, &modifier.ErrInvalidArgs{Err: fmt.Errorf("op #%d: %w", n+1, err)}
+		}
+		i.Ops = append(i.Ops, op)
+	}
+	return i, nil
+}
+
+var _ modifier.UDPModifierInstance = (*rewriteModifierInstance)(nil)
+
+type rewriteModifierInstance struct {
+	Ops []rewriteOp
+}
+
+func (i *rewriteModifierInstance) Process(data []byte) ([]byte, error) {
+	// Never modify the original data in place
+	out := append([]byte(nil), data...)
+	for n, op := range i.Ops {
+		var err error
+		out, err = op.Apply(out)
+		if err != nil {
+			return nil, &modifier.ErrInvalidPacket{Err: fmt.Errorf("op #%d: %w", n+1, err)}
+		}
+	}
+	return out, nil
+}
+
+type rewriteOp interface {
+	Apply(data []byte) ([]byte, error)
+}
+
+func newRewriteOp(args map[string]interface{}) (rewriteOp, error) {
+	var kinds []string
+	for _, k := range []string{"set", "insert", "delete", "regex", "template", "checksum"} {
+		if _, ok := args[k]; ok {
+			kinds = append(kinds, k)
+		}
+	}
+	if len(kinds) != 1 {
+		return nil, errUnknownOp
+	}
+	offset, _ := args["offset"].(int)
+	switch kinds[0] {
+	case "set", "insert":
+		bs, err := hexArg(args[kinds[0]])
+		if err != nil {
+			return nil, err
+		}
+		return &rewriteBytesOp{Offset: offset, Bytes: bs, Insert: kinds[0] == "insert"}, nil
+	case "delete":
+		n, ok := args["delete"].(int)
+		if !ok || n <= 0 {
+			return nil, errors.New("delete must be a positive length")
+		}
+		return &rewriteDeleteOp{Offset: offset, Length: n}, nil
+	case "regex":
+		pattern, _ := args["regex"].(string)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		replace, _ := args["replace"].(string)
+		return &rewriteRegexOp{Regex: re, Replace: []byte(replace)}, nil
+	case "template":
+		text, _ := args["template"].(string)
+		tmpl, err := template.New("rewrite").Funcs(rewriteTemplateFuncs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return &rewriteTemplateOp{Template: tmpl}, nil
+	default:
+		return newRewriteChecksumOp(args)
+	}
+}
+
+// hexArg decodes a hex string, which may contain spaces for readability.
+func hexArg(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("bytes must be a hex string")
+	}
+	return hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+}
+
+// resolveOffset turns a negative offset (from the end) into an absolute one, and checks its range.
+func resolveOffset(offset, length, size int) (int, error) {
+	if offset < 0 {
+		offset += size
+	}
+	if offset < 0 || offset+length > size {
+		return 0, errOutOfRange
+	}
+	return offset, nil
+}
+
+// rewriteBytesOp overwrites or inserts bytes at an offset.
+type rewriteBytesOp struct {
+	Offset int
+	Bytes  []byte
+	Insert bool
+}
+
+func (o *rewriteBytesOp) Apply(data []byte) ([]byte, error) {
+	if o.Insert {
+		off, err := resolveOffset(o.Offset, 0, len(data))
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, 0, len(data)+len(o.Bytes))
+		out = append(out, data[:off]...)
+		out = append(out, o.Bytes...)
+		return append(out, data[off:]...), nil
+	}
+	off, err := resolveOffset(o.Offset, len(o.Bytes), len(data))
+	if err != nil {
+		return nil, err
+	}
+	copy(data[off:], o.Bytes)
+	return data, nil
+}
+
+type rewriteDeleteOp struct {
+	Offset int
+	Length int
+}
+
+func (o *rewriteDeleteOp) Apply(data []byte) ([]byte, error) {
+	off, err := resolveOffset(o.Offset, o.Length, len(data))
+	if err != nil {
+		return nil, err
+	}
+	return append(data[:off], data[off+o.Length:]...), nil
+}
+
+// rewriteRegexOp replaces all matches of a regex, with $1 style expansion in the replacement.
+type rewriteRegexOp struct {
+	Regex   *regexp.Regexp
+	Replace []byte
+}
+
+func (o *rewriteRegexOp) Apply(data []byte) ([]byte, error) {
+	return o.Regex.ReplaceAll(data, o.Replace), nil
+}
+
+// rewriteTemplateOp replaces the whole payload with the output of a template.
+type rewriteTemplateOp struct {
+	Template *template.Template
+}
+
+// rewriteTemplateData is the data available to rewrite templates.
+type rewriteTemplateData struct {
+	Payload string
+	Len     int
+}
+
+var rewriteTemplateFuncs = template.FuncMap{
+	"hex": func(s string) (string, error) {
+		bs, err := hexArg(s)
+		return string(bs), err
+	},
+	"u8": func(v int) string { return string([]byte{byte(v)}) },
+	"u16": func(v int) string {
+		return string(binary.BigEndian.AppendUint16(nil, uint16(v)))
+	},
+	"u32": func(v int) string {
+		return string(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	},
+}
+
+func (o *rewriteTemplateOp) Apply(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := o.Template.Execute(&buf, rewriteTemplateData{Payload: string(data), Len: len(data)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rewriteChecksumOp recomputes a checksum over a range of the payload, and writes it
+// big-endian at an offset. The checksum field is zeroed first if it's in the range.
+type rewriteChecksumOp struct {
+	Offset int
+	From   int
+	To     int // 0 for the end of the payload, negative from the end
+	Type   string
+}
+
+var rewriteChecksumSizes = map[string]int{
+	"internet": 2, // RFC 1071, as used by IP, UDP & TCP
+	"crc32":    4,
+	"sum8":     1,
+	"xor8":     1,
+}
+
+func newRewriteChecksumOp(args map[string]interface{}) (rewriteOp, error) {
+	o := &rewriteChecksumOp{}
+	o.Type, _ = args["checksum"].(string)
+	if _, ok := rewriteChecksumSizes[o.Type]; !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownChksum, o.Type)
+	}
+	o.Offset, _ = args["offset"].(int)
+	o.From, _ = args["from"].(int)
+	o.To, _ = args["to"].(int)
+	return o, nil
+}
+
+func (o *rewriteChecksumOp) Apply(data []byte) ([]byte, error) {
+	size := rewriteChecksumSizes[o.Type]
+	off, err := resolveOffset(o.Offset, size, len(data))
+	if err != nil {
+		return nil, err
+	}
+	from, err := resolveOffset(o.From, 0, len(data))
+	if err != nil {
+		return nil, err
+	}
+	to := len(data)
+	if o.To != 0 {
+		if to, err = resolveOffset(o.To, 0, len(data)); err != nil {
+			return nil, err
+		}
+	}
+	if from > to {
+		return nil, errOutOfRange
+	}
+	for j := off; j < off+size; j++ {
+		data[j] = 0
+	}
+	b := data[from:to]
+	switch o.Type {
+	case "internet":
+		var sum uint32
+		for j := 0; j+1 < len(b); j += 2 {
+			sum += uint32(b[j])<<8 | uint32(b[j+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		binary.BigEndian.PutUint16(data[off:], ^uint16(sum))
+	case "crc32":
+		binary.BigEndian.PutUint32(data[off:], crc32.ChecksumIEEE(b))
+	case "sum8":
+		var sum byte
+		for _, c := range b {
+			sum += c
+		}
+		data[off] = sum
+	case "xor8":
+		var x byte
+		for _, c := range b {
+			x ^= c
+		}
+		data[off] = x
+	}
+	return data, nil
+}
@@ -0,0 +1,268 @@
+package builtins
+
+import (
+	"crypto/md5"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+// The confidence of each kind of evidence. Evidence of the same application adds up.
+const (
+	appConfidenceDomain    = 0.9
+	appConfidenceAnalyzer  = 0.9
+	appConfidenceUserAgent = 0.8
+	appConfidenceJA3       = 0.7
+	appConfidencePort      = 0.3
+)
+
+//go:embed apps.yaml
+var bundledApps []byte
+
+// AppEntry is an application and its evidence, see apps.yaml.
+type AppEntry struct {
+	Name       string   `yaml:"name"`
+	Domains    []string `yaml:"domains"`
+	UserAgents []string `yaml:"user_agents"`
+	JA3        []string `yaml:"ja3"`
+	Analyzers  []string `yaml:"analyzers"`
+	ML         []string `yaml:"ml"`
+	Ports      []string `yaml:"ports"`
+}
+
+type appPortRange struct {
+	Proto      string // Empty for both
+	Start, End uint16
+	App        int
+}
+
+type appUserAgent struct {
+	Substring string // Lowercase
+	App       int
+}
+
+type appAnalyzer struct {
+	Name, Prop string // Prop is empty for any property
+	App        int
+}
+
+// AppClassifier combines the properties of the analyzers of a stream into a single application label
+// with a confidence, from the bundled mapping of evidence to applications and an optional file.
+// It is safe for concurrent use once created.
+type AppClassifier struct {
+	names      []string
+	domains    map[string]int // To the index of the app
+	userAgents []appUserAgent
+	ja3        map[string]int
+	analyzers  []appAnalyzer
+	ml         map[string]int
+	ports      []appPortRange
+}
+
+// NewAppClassifier returns a classifier with the bundled applications, and those of the YAML file
+// if filename isn't empty, which replace the bundled ones of the same name.
+func NewAppClassifier(filename string) (*AppClassifier, error) {
+	var entries []AppEntry
+	if err := yaml.Unmarshal(bundledApps, &entries); err != nil {
+		return nil, fmt.Errorf("bundled apps: %w", err)
+	}
+	if filename != "" {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		var extra []AppEntry
+		if err := yaml.Unmarshal(data, &extra); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	next:
+		for _, e := range extra {
+			for i := range entries {
+				if entries[i].Name == e.Name {
+					entries[i] = e
+					continue next
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+	c := &AppClassifier{
+		domains: make(map[string]int),
+		ja3:     make(map[string]int),
+		ml:      make(map[string]int),
+	}
+	for i, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("app #%d has no name", i+1)
+		}
+		c.names = append(c.names, e.Name)
+		for _, d := range e.Domains {
+			c.domains[strings.Trim(strings.ToLower(d), ".")] = i
+		}
+		for _, ua := range e.UserAgents {
+			c.userAgents = append(c.userAgents, appUserAgent{Substring: strings.ToLower(ua), App: i})
+		}
+		for _, h := range e.JA3 {
+			c.ja3[strings.ToLower(h)] = i
+		}
+		for _, a := range e.Analyzers {
+			name, prop, _ := strings.Cut(a, ".")
+			c.analyzers = append(c.analyzers, appAnalyzer{Name: name, Prop: prop, App: i})
+		}
+		for _, l := range e.ML {
+			c.ml[strings.ToLower(l)] = i
+		}
+		for _, p := range e.Ports {
+			r, err := parseAppPortRange(p)
+			if err != nil {
+				return nil, fmt.Errorf("app %q: %w", e.Name, err)
+			}
+			r.App = i
+			c.ports = append(c.ports, r)
+		}
+	}
+	return c, nil
+}
+
+// parseAppPortRange parses a port or port range, optionally prefixed by tcp/ or udp/.
+func parseAppPortRange(s string) (appPortRange, error) {
+	var r appPortRange
+	if proto, ports, ok := strings.Cut(s, "/"); ok {
+		r.Proto, s = strings.ToLower(proto), ports
+	}
+	start, end, isRange := strings.Cut(s, "-")
+	if !isRange {
+		end = start
+	}
+	a, err1 := strconv.ParseUint(start, 10, 16)
+	b, err2 := strconv.ParseUint(end, 10, 16)
+	if err1 != nil || err2 != nil || a > b {
+		return r, fmt.Errorf("invalid port range %q", s)
+	}
+	r.Start, r.End = uint16(a), uint16(b)
+	return r, nil
+}
+
+// Analyzers returns the names of the analyzers whose properties are evidence.
+func (c *AppClassifier) Analyzers() []string {
+	names := []string{"tls", "quic", "http", "ml"}
+	for _, a := range c.analyzers {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+// Classify returns the most likely application of a stream and its confidence (0 to 1),
+// or "" and 0 if there's no evidence. proto is tcp or udp, port the server port.
+func (c *AppClassifier) Classify(props analyzer.CombinedPropMap, proto string, port uint16) (string, float64) {
+	// The probability that each piece of evidence is wrong, multiplied by app
+	doubt := make(map[int]float64)
+	add := func(app int, confidence float64) {
+		d, ok := doubt[app]
+		if !ok {
+			d = 1
+		}
+		doubt[app] = d * (1 - confidence)
+	}
+	for _, host := range []string{
+		propString(props, "tls", "req.sni"),
+		propString(props, "quic", "req.sni"),
+		propString(props, "http", "req.headers.host"),
+	} {
+		if app, ok := c.domain(host); ok {
+			add(app, appConfidenceDomain)
+		}
+	}
+	if ua := strings.ToLower(propString(props, "http", "req.headers.user-agent")); ua != "" {
+		for _, u := range c.userAgents {
+			if strings.Contains(ua, u.Substring) {
+				add(u.App, appConfidenceUserAgent)
+				break
+			}
+		}
+	}
+	if ja3 := propString(props, "tls", "req.ja3"); ja3 != "" && len(c.ja3) > 0 {
+		sum := md5.Sum([]byte(ja3))
+		if app, ok := c.ja3[hex.EncodeToString(sum[:])]; ok {
+			add(app, appConfidenceJA3)
+		}
+	}
+	for _, a := range c.analyzers {
+		m := props[a.Name]
+		if len(m) == 0 {
+			continue
+		}
+		if a.Prop == "" || propSet(m[a.Prop]) {
+			add(a.App, appConfidenceAnalyzer)
+		}
+	}
+	if label := propString(props, "ml", "label"); label != "" {
+		if app, ok := c.ml[strings.ToLower(label)]; ok {
+			confidence, _ := props["ml"]["confidence"].(float64)
+			add(app, confidence)
+		}
+	}
+	for _, r := range c.ports {
+		if (r.Proto == "" || r.Proto == proto) && port >= r.Start && port <= r.End {
+			add(r.App, appConfidencePort)
+			break
+		}
+	}
+	best, bestDoubt := -1, 1.0
+	for app, d := range doubt {
+		// The first app of the mapping wins ties, to be deterministic
+		if d < bestDoubt || (d == bestDoubt && app < best) {
+			best, bestDoubt = app, d
+		}
+	}
+	if best < 0 {
+		return "", 0
+	}
+	return c.names[best], 1 - bestDoubt
+}
+
+// domain returns the app of a domain or of its closest parent domain.
+func (c *AppClassifier) domain(host string) (int, bool) {
+	host = strings.Trim(strings.ToLower(host), ".")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		// HTTP host with port
+		host = h
+	}
+	for host != "" {
+		if app, ok := c.domains[host]; ok {
+			return app, true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return 0, false
+}
+
+// propString returns a string property, "" if there's none.
+func propString(props analyzer.CombinedPropMap, name, key string) string {
+	s, _ := props.Get(name, key).(string)
+	return s
+}
+
+// propSet returns whether a property is true or non-empty.
+func propSet(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case analyzer.PropMap:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
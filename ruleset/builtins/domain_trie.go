@@ -0,0 +1,141 @@
+package builtins
+
+import (
+	"strings"
+	"time"
+)
+
+// domainTrie is a trie of domain labels in reverse order ("com" -> "example" -> "www"),
+// matching a domain if it or any of its parent domains is in the trie.
+// Children are kept in maps, created only for the nodes that have some, so that
+// building a trie of millions of entries takes linear time. It is not safe for concurrent use.
+type domainTrie struct {
+	root domainNode
+	size int
+}
+
+type domainNode struct {
+	children map[string]*domainNode // nil if none
+	present  bool                   // Whether the domain ending at this node is an entry
+	expiry   time.Time              // Zero = never
+}
+
+func (n *domainNode) child(label string, create bool) *domainNode {
+	if c := n.children[label]; c != nil || !create {
+		return c
+	}
+	if n.children == nil {
+		n.children = make(map[string]*domainNode)
+	}
+	c := &domainNode{}
+	n.children[label] = c
+	return c
+}
+
+// Insert adds a normalized domain (lowercase, no leading/trailing dots).
+func (t *domainTrie) Insert(domain string, expiry time.Time) {
+	n := &t.root
+	for domain != "" {
+		var label string
+		label, domain = lastLabel(domain)
+		n = n.child(label, true)
+	}
+	if !n.present {
+		t.size++
+	}
+	n.present, n.expiry = true, expiry
+}
+
+// Delete removes a normalized domain, and returns whether it was present.
+// Empty nodes are left in place; they are reused if the domain is added again.
+func (t *domainTrie) Delete(domain string) bool {
+	n := &t.root
+	for domain != "" && n != nil {
+		var label string
+		label, domain = lastLabel(domain)
+		n = n.child(label, false)
+	}
+	if n == nil || !n.present {
+		return false
+	}
+	n.present, n.expiry = false, time.Time{}
+	t.size--
+	return true
+}
+
+// Expiry returns the expiry of a normalized domain, and whether it is an entry.
+func (t *domainTrie) Expiry(domain string) (time.Time, bool) {
+	n := &t.root
+	for domain != "" && n != nil {
+		var label string
+		label, domain = lastLabel(domain)
+		n = n.child(label, false)
+	}
+	if n == nil || !n.present {
+		return time.Time{}, false
+	}
+	return n.expiry, true
+}
+
+// Match returns whether the domain or any of its parent domains has an unexpired entry.
+func (t *domainTrie) Match(domain string, now time.Time) bool {
+	n := &t.root
+	for domain != "" {
+		var label string
+		label, domain = lastLabel(domain)
+		n = n.child(label, false)
+		if n == nil {
+			return false
+		}
+		if n.present && !expired(n.expiry, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk calls f for every entry, in no particular order. f may return false to delete the entry.
+func (t *domainTrie) Walk(f func(domain string, expiry time.Time) bool) {
+	var walk func(n *domainNode, suffix string)
+	walk = func(n *domainNode, suffix string) {
+		for label, c := range n.children {
+			domain := label
+			if suffix != "" {
+				domain += "." + suffix
+			}
+			if c.present && !f(domain, c.expiry) {
+				c.present, c.expiry = false, time.Time{}
+				t.size--
+			}
+			walk(c, domain)
+		}
+	}
+	walk(&t.root, "")
+}
+
+func (t *domainTrie) clone() *domainTrie {
+	var clone func(n *domainNode) *domainNode
+	clone = func(n *domainNode) *domainNode {
+		c := &domainNode{present: n.present, expiry: n.expiry}
+		if n.children != nil {
+			c.children = make(map[string]*domainNode, len(n.children))
+			for label, child := range n.children {
+				c.children[label] = clone(child)
+			}
+		}
+		return c
+	}
+	return &domainTrie{root: *clone(&t.root), size: t.size}
+}
+
+func (t *domainTrie) Len() int {
+	return t.size
+}
+
+func lastLabel(domain string) (label, rest string) {
+	i := strings.LastIndexByte(domain, '.')
+	if i < 0 {
+		return domain, ""
+	}
+	return domain[i+1:], domain[:i]
+}
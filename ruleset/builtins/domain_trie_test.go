@@ -0,0 +1,169 @@
+package builtins
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDomainTrie_Match(t *testing.T) {
+	trie := &domainTrie{}
+	for _, d := range []string{"example.com", "ads.example.org", "co.uk", "localhost"} {
+		trie.Insert(d, time.Time{})
+	}
+	testCases := map[string]bool{
+		"example.com":           true,
+		"www.example.com":       true, // Subdomain
+		"a.b.c.example.com":     true,
+		"badexample.com":        false, // Same suffix, not a subdomain
+		"example.com.evil.net":  false,
+		"com":                   false, // Parent
+		"example.org":           false,
+		"ads.example.org":       true,
+		"x.ads.example.org":     true,
+		"ads2.example.org":      false, // Sibling
+		"www.example.org":       false, // Sibling
+		"bbc.co.uk":             true,
+		"uk":                    false,
+		"localhost":             true,
+		"localhost.localdomain": false,
+		"":                      false,
+	}
+	for domain, want := range testCases {
+		if got := trie.Match(domain, time.Now()); got != want {
+			t.Errorf("Match(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestDomainTrie_Expiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	trie := &domainTrie{}
+	trie.Insert("example.com", now.Add(time.Minute))
+	trie.Insert("www.example.com", time.Time{})
+	testCases := []struct {
+		domain string
+		at     time.Duration
+		want   bool
+	}{
+		{"a.example.com", 0, true},
+		{"a.example.com", time.Minute, true},
+		{"a.example.com", time.Minute + time.Second, false},
+		{"example.com", time.Minute + time.Second, false},
+		{"a.www.example.com", time.Minute + time.Second, true}, // Own entry never expires
+	}
+	for _, tc := range testCases {
+		if got := trie.Match(tc.domain, now.Add(tc.at)); got != tc.want {
+			t.Errorf("Match(%q) at +%s = %v, want %v", tc.domain, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestDomainTrie_InsertDelete(t *testing.T) {
+	trie := &domainTrie{}
+	trie.Insert("b.example.com", time.Time{})
+	trie.Insert("example.com", time.Time{})
+	trie.Insert("a.example.com", time.Time{})
+	trie.Insert("example.com", time.Time{}) // Again
+	if n := trie.Len(); n != 3 {
+		t.Errorf("Len() = %d, want 3", n)
+	}
+	deletes := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"example.com", false}, // Already deleted
+		{"c.example.com", false},
+		{"com", false}, // Node without an entry
+		{"net", false},
+	}
+	for _, d := range deletes {
+		if got := trie.Delete(d.domain); got != d.want {
+			t.Errorf("Delete(%q) = %v, want %v", d.domain, got, d.want)
+		}
+	}
+	if n := trie.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	if trie.Match("example.com", time.Now()) || trie.Match("c.example.com", time.Now()) {
+		t.Error("Match() = true for the deleted parent domain")
+	}
+	if !trie.Match("x.a.example.com", time.Now()) {
+		t.Error("Match(x.a.example.com) = false after deleting the parent domain")
+	}
+	// Reusing the node left by the deletion
+	trie.Insert("example.com", time.Time{})
+	if !trie.Match("c.example.com", time.Now()) || trie.Len() != 3 {
+		t.Errorf("Match(c.example.com) = false or Len() = %d after adding again", trie.Len())
+	}
+}
+
+func TestDomainTrie_Walk(t *testing.T) {
+	trie := &domainTrie{}
+	expiry := time.Unix(1700000000, 0)
+	for _, d := range []string{"www.example.com", "example.com", "a.org", "z.example.com"} {
+		trie.Insert(d, time.Time{})
+	}
+	trie.Insert("old.example.com", expiry)
+
+	var got []string
+	trie.Walk(func(domain string, exp time.Time) bool {
+		got = append(got, domain)
+		return exp.IsZero() // Deletes old.example.com
+	})
+	sort.Strings(got)
+	want := []string{"a.org", "example.com", "old.example.com", "www.example.com", "z.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() visited %v, want %v", got, want)
+	}
+	if n := trie.Len(); n != 4 {
+		t.Errorf("Len() = %d after deleting in Walk, want 4", n)
+	}
+	if !trie.Match("old.example.com", expiry.Add(time.Hour)) {
+		// Through example.com
+		t.Error("Match(old.example.com) = false, want true")
+	}
+	got = nil
+	trie.Walk(func(domain string, exp time.Time) bool {
+		got = append(got, domain)
+		return true
+	})
+	sort.Strings(got)
+	want = []string{"a.org", "example.com", "www.example.com", "z.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() visited %v after the deletion, want %v", got, want)
+	}
+}
+
+func BenchmarkDomainTrie_Insert(b *testing.B) {
+	const n = 1000000
+	domains := make([]string, n)
+	for i := range domains {
+		// Random order, all under the same TLD like the lists in the wild
+		domains[i] = fmt.Sprintf("d%d.example%d.com", rand.Intn(n), i%1000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie := &domainTrie{}
+		for _, d := range domains {
+			trie.Insert(d, time.Time{})
+		}
+	}
+}
+
+func BenchmarkDomainTrie_Match(b *testing.B) {
+	const n = 1000000
+	trie := &domainTrie{}
+	for i := 0; i < n; i++ {
+		trie.Insert(fmt.Sprintf("d%d.com", i), time.Time{})
+	}
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Match(fmt.Sprintf("www.d%d.com", i%(2*n)), now)
+	}
+}
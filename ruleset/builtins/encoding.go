@@ -0,0 +1,88 @@
+package builtins
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Base64Decode decodes standard or URL-safe base64, with or without padding.
+// It returns an empty string if the input is not valid base64.
+func Base64Decode(s string) string {
+	s = strings.TrimRight(s, "=")
+	enc := base64.RawStdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.RawURLEncoding
+	}
+	bs, err := enc.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return string(bs)
+}
+
+// HexDecode returns an empty string if the input is not valid hex.
+func HexDecode(s string) string {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return ""
+	}
+	return string(bs)
+}
+
+// URLDecode decodes percent-encoding, and "+" as space.
+// It returns an empty string if the input has invalid escapes.
+func URLDecode(s string) string {
+	r, err := url.QueryUnescape(s)
+	if err != nil {
+		return ""
+	}
+	return r
+}
+
+// PunycodeDecode converts the "xn--" labels of a domain to Unicode.
+// It returns an empty string if the domain has invalid labels.
+func PunycodeDecode(s string) string {
+	r, err := idna.ToUnicode(s)
+	if err != nil {
+		return ""
+	}
+	return r
+}
+
+func MD5(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func SHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Entropy returns the Shannon entropy of the bytes of a string, in bits per byte (0-8).
+// Random-looking values such as DGA domains or encrypted payloads score high.
+func Entropy(s string) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var e float64
+	n := float64(len(s))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
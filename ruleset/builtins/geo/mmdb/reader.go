@@ -0,0 +1,344 @@
+// Package mmdb reads MaxMind DB files (GeoLite2, GeoIP2, DB-IP, IPinfo...), the format of most
+// IP geolocation & ASN databases. Only what's needed for lookups is implemented:
+// the metadata, the search tree, and the decoding of the data section into Go values.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+// metadataMarker precedes the metadata, at the end of the file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	metadataMaxSize = 128 * 1024
+	dataSeparator   = 16 // Zero bytes between the search tree and the data section
+	maxDepth        = 64 // Of nested maps, arrays & pointers, against malformed files
+)
+
+// Data section types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// uintSizes are the maximum sizes of the unsigned integer types.
+var uintSizes = map[uint]uint{typeUint16: 2, typeUint32: 4, typeUint64: 8}
+
+// ErrInvalid is returned (wrapped) for malformed files.
+var ErrInvalid = errors.New("invalid MaxMind DB")
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
+
+// Metadata describes a database.
+type Metadata struct {
+	DatabaseType string // e.g. GeoLite2-Country, GeoLite2-ASN
+	BuildEpoch   uint64 // Seconds since the epoch
+	IPVersion    uint   // 4 or 6 (which includes IPv4)
+	RecordSize   uint   // Bits, 24, 28 or 32
+	NodeCount    uint
+}
+
+// Reader looks up IPs in a database, fully loaded in memory.
+// It's safe for concurrent use.
+type Reader struct {
+	Metadata Metadata
+
+	tree      []byte
+	data      decoder
+	ipv4Start uint // Node of ::/96, where IPv4 lookups start in IPv6 databases
+}
+
+// Open reads a database file.
+func Open(filename string) (*Reader, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return New(bs)
+}
+
+// New parses a database. The buffer must not be modified afterwards.
+func New(bs []byte) (*Reader, error) {
+	start := len(bs) - metadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	i := bytes.LastIndex(bs[start:], metadataMarker)
+	if i < 0 {
+		return nil, invalid("metadata not found")
+	}
+	metaStart := start + i + len(metadataMarker)
+	v, _, err := decoder{bs[metaStart:]}.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, invalid("metadata isn't a map")
+	}
+	r := &Reader{}
+	r.Metadata.DatabaseType, _ = meta["database_type"].(string)
+	r.Metadata.BuildEpoch, _ = meta["build_epoch"].(uint64)
+	for key, p := range map[string]*uint{
+		"ip_version":  &r.Metadata.IPVersion,
+		"record_size": &r.Metadata.RecordSize,
+		"node_count":  &r.Metadata.NodeCount,
+	} {
+		n, ok := meta[key].(uint64)
+		if !ok {
+			return nil, invalid("missing %s in metadata", key)
+		}
+		if n > math.MaxUint32 {
+			return nil, invalid("invalid %s %d", key, n)
+		}
+		*p = uint(n)
+	}
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, invalid("unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, invalid("unsupported IP version %d", r.Metadata.IPVersion)
+	}
+	// Checked before multiplying, so that huge node counts can't overflow
+	nodeSize := r.Metadata.RecordSize / 4
+	if r.Metadata.NodeCount > uint(start+i)/nodeSize {
+		return nil, invalid("search tree larger than the file")
+	}
+	treeSize := nodeSize * r.Metadata.NodeCount
+	dataStart := treeSize + dataSeparator
+	if dataStart > uint(start+i) {
+		return nil, invalid("search tree larger than the file")
+	}
+	r.tree = bs[:treeSize]
+	r.data = decoder{bs[dataStart : start+i]}
+	if r.Metadata.IPVersion == 6 {
+		for j := 0; j < 96 && r.ipv4Start < r.Metadata.NodeCount; j++ {
+			r.ipv4Start = r.readNode(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Lookup returns the data of the network an IP is in, nil if none.
+// Maps are map[string]interface{}, arrays []interface{}, unsigned integers uint64 (*big.Int for
+// 128-bit ones), signed integers int64, and floats float32 or float64.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node = ip4, r.ipv4Start
+	} else if ip = ip.To16(); ip == nil {
+		return nil, errors.New("invalid IP")
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, nil
+	}
+	count := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < count; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+	switch {
+	case node == count:
+		return nil, nil
+	case node < count:
+		return nil, invalid("search tree deeper than the IP")
+	}
+	v, _, err := r.data.decode(node-count-dataSeparator, 0)
+	return v, err
+}
+
+// readNode returns the left (0) or right (1) record of a node.
+func (r *Reader) readNode(node, bit uint) uint {
+	b := r.tree
+	switch r.Metadata.RecordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// decoder decodes the values of a data section, to which pointers are relative.
+type decoder struct {
+	buf []byte
+}
+
+// decode returns the value at an offset, and the offset after it.
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, invalid("maximum depth exceeded")
+	}
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		ptr, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr, depth+1)
+		return v, next, err
+	}
+	switch typ {
+	case typeMap:
+		// Sizes are only hints, as malformed ones could make huge allocations
+		m := make(map[string]interface{}, min(size, uint(len(d.buf))))
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, invalid("map key isn't a string")
+			}
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, min(size, uint(len(d.buf))))
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	case typeBool:
+		if size > 1 {
+			return nil, 0, invalid("bool of size %d", size)
+		}
+		return size == 1, offset, nil
+	}
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, invalid("value past the end of the data section")
+	}
+	b, next := d.buf[offset:offset+size], offset+size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, invalid("double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, invalid("float of size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > uintSizes[typ] {
+			return nil, 0, invalid("integer of size %d", size)
+		}
+		return uintFromBytes(b), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, invalid("int32 of size %d", size)
+		}
+		return int64(int32(uintFromBytes(b))), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, invalid("uint128 of size %d", size)
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	default:
+		return nil, 0, invalid("unexpected type %d", typ)
+	}
+}
+
+// control decodes the control byte(s) of a value, and returns its type, size (payload for pointers),
+// and the offset of its data.
+func (d decoder) control(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, invalid("value past the end of the data section")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = uint(ctrl >> 5)
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, invalid("value past the end of the data section")
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size = uint(ctrl & 0x1f)
+	if typ == typePointer || size < 29 {
+		return typ, size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, 0, invalid("value past the end of the data section")
+	}
+	v := uint(uintFromBytes(d.buf[offset : offset+n]))
+	size = []uint{29, 285, 65821}[n-1] + v
+	return typ, size, offset + n, nil
+}
+
+// pointer decodes a pointer, and returns the offset it points to and the offset after it.
+func (d decoder) pointer(size, offset uint) (uint, uint, error) {
+	n := (size>>3)&3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, invalid("pointer past the end of the data section")
+	}
+	p := uint(uintFromBytes(d.buf[offset : offset+n]))
+	switch n {
+	case 1:
+		p |= (size & 7) << 8
+	case 2:
+		p = (p | (size&7)<<16) + 2048
+	case 3:
+		p = (p | (size&7)<<24) + 526336
+	}
+	return p, offset + n, nil
+}
+
+// uintFromBytes decodes a big-endian unsigned integer of up to 8 bytes.
+func uintFromBytes(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
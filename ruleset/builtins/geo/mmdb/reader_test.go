@@ -0,0 +1,480 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mmdbTestPointer is encoded as a pointer to an offset of the data section.
+type mmdbTestPointer uint
+
+// mmdbTestControl appends the control byte(s) of a value of a type & size.
+func mmdbTestControl(b []byte, typ, size uint) []byte {
+	var ext []byte
+	if typ >= 8 {
+		ext = []byte{byte(typ - 7)}
+		typ = typeExtended
+	}
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		size -= 285
+		extra = []byte{byte(size >> 8), byte(size)}
+		size = 30
+	default:
+		size -= 65821
+		extra = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+	b = append(b, byte(typ<<5|size))
+	return append(append(b, ext...), extra...)
+}
+
+// mmdbTestUint appends an unsigned integer of a type, in as few bytes as possible.
+func mmdbTestUint(b []byte, typ uint, v uint64) []byte {
+	var bs []byte
+	for ; v > 0; v >>= 8 {
+		bs = append([]byte{byte(v)}, bs...)
+	}
+	return append(mmdbTestControl(b, typ, uint(len(bs))), bs...)
+}
+
+// mmdbTestEncode appends the encoding of a value to a data section.
+func mmdbTestEncode(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case mmdbTestPointer:
+		p := uint(v)
+		switch {
+		case p < 2048:
+			return append(b, byte(typePointer<<5|p>>8), byte(p))
+		case p < 526336:
+			p -= 2048
+			return append(b, byte(typePointer<<5|1<<3|p>>16), byte(p>>8), byte(p))
+		default:
+			p -= 526336
+			return append(b, byte(typePointer<<5|2<<3|p>>24), byte(p>>16), byte(p>>8), byte(p))
+		}
+	case string:
+		return append(mmdbTestControl(b, typeString, uint(len(v))), v...)
+	case []byte:
+		return append(mmdbTestControl(b, typeBytes, uint(len(v))), v...)
+	case float64:
+		b = mmdbTestControl(b, typeDouble, 8)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case float32:
+		b = mmdbTestControl(b, typeFloat, 4)
+		return binary.BigEndian.AppendUint32(b, math.Float32bits(v))
+	case uint16:
+		return mmdbTestUint(b, typeUint16, uint64(v))
+	case uint32:
+		return mmdbTestUint(b, typeUint32, uint64(v))
+	case uint64:
+		return mmdbTestUint(b, typeUint64, v)
+	case int32:
+		b = mmdbTestControl(b, typeInt32, 4)
+		return binary.BigEndian.AppendUint32(b, uint32(v))
+	case *big.Int:
+		bs := v.Bytes()
+		return append(mmdbTestControl(b, typeUint128, uint(len(bs))), bs...)
+	case bool:
+		size := uint(0)
+		if v {
+			size = 1
+		}
+		return mmdbTestControl(b, typeBool, size)
+	case []interface{}:
+		b = mmdbTestControl(b, typeArray, uint(len(v)))
+		for _, e := range v {
+			b = mmdbTestEncode(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = mmdbTestControl(b, typeMap, uint(len(v)))
+		for _, k := range keys {
+			b = mmdbTestEncode(mmdbTestEncode(b, k), v[k])
+		}
+		return b
+	default:
+		panic("unsupported value")
+	}
+}
+
+// mmdbTestNetwork is a network of a database, with the offset of its data in the data section.
+type mmdbTestNetwork struct {
+	cidr   string
+	offset uint
+}
+
+// mmdbTestTree builds the search tree of networks, which mustn't overlap. Records are the index of
+// a node, -1 if empty, or -2 - the offset of the data.
+func mmdbTestTree(t *testing.T, ipVersion uint, networks []mmdbTestNetwork) [][2]int {
+	nodes := [][2]int{{-1, -1}}
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := []byte(ipNet.IP)
+		ones, _ := ipNet.Mask.Size()
+		if ipVersion == 6 && len(ip) == net.IPv4len {
+			// In ::/96
+			ip, ones = append(make([]byte, 12), ip...), ones+96
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			switch {
+			case i == ones-1:
+				nodes[node][bit] = -2 - int(n.offset)
+			case nodes[node][bit] >= 0:
+				node = nodes[node][bit]
+			default:
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+				node = len(nodes) - 1
+			}
+		}
+	}
+	return nodes
+}
+
+// mmdbTestFile returns a database of the search tree & data section, with the metadata.
+func mmdbTestFile(nodes [][2]int, recordSize uint, data []byte, meta map[string]interface{}) []byte {
+	count := len(nodes)
+	var b []byte
+	for _, n := range nodes {
+		var records [2]uint32
+		for k, r := range n {
+			switch {
+			case r == -1:
+				records[k] = uint32(count)
+			case r < 0:
+				records[k] = uint32(count + dataSeparator - 2 - r)
+			default:
+				records[k] = uint32(r)
+			}
+		}
+		switch recordSize {
+		case 24:
+			for _, r := range records {
+				b = append(b, byte(r>>16), byte(r>>8), byte(r))
+			}
+		case 28:
+			b = append(b, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[0]>>20&0xf0|records[1]>>24&0x0f),
+				byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		default:
+			b = binary.BigEndian.AppendUint32(b, records[0])
+			b = binary.BigEndian.AppendUint32(b, records[1])
+		}
+	}
+	b = append(b, make([]byte, dataSeparator)...)
+	b = append(b, data...)
+	b = append(b, metadataMarker...)
+	return mmdbTestEncode(b, meta)
+}
+
+func mmdbTestMetadata(ipVersion, recordSize uint, nodeCount int) map[string]interface{} {
+	return map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               "Test-Country",
+		"description":                 map[string]interface{}{"en": "Test database"},
+		"ip_version":                  uint16(ipVersion),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+	}
+}
+
+// mmdbTestDB returns a database of a few networks: 1.2.3.0/24 in CN, 10.0.0.0/8 private (a pointer to
+// the data of 192.168.0.0/16), and 2001:db8::/32 in JP, unless it's an IPv4 database.
+func mmdbTestDB(t *testing.T, ipVersion, recordSize uint) []byte {
+	var data []byte
+	cn := uint(len(data))
+	data = mmdbTestEncode(data, map[string]interface{}{"country": map[string]interface{}{"iso_code": "CN"}})
+	private := uint(len(data))
+	data = mmdbTestEncode(data, map[string]interface{}{"private": true})
+	privatePointer := uint(len(data))
+	data = mmdbTestEncode(data, mmdbTestPointer(private))
+	jp := uint(len(data))
+	data = mmdbTestEncode(data, map[string]interface{}{"country": map[string]interface{}{"iso_code": "JP"}})
+	networks := []mmdbTestNetwork{
+		{"1.2.3.0/24", cn},
+		{"10.0.0.0/8", privatePointer},
+		{"192.168.0.0/16", private},
+	}
+	if ipVersion == 6 {
+		networks = append(networks, mmdbTestNetwork{"2001:db8::/32", jp})
+	}
+	nodes := mmdbTestTree(t, ipVersion, networks)
+	return mmdbTestFile(nodes, recordSize, data, mmdbTestMetadata(ipVersion, recordSize, len(nodes)))
+}
+
+func TestNew_Metadata(t *testing.T) {
+	bs := mmdbTestDB(t, 6, 28)
+	r, err := New(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Metadata{
+		DatabaseType: "Test-Country",
+		BuildEpoch:   1700000000,
+		IPVersion:    6,
+		RecordSize:   28,
+		NodeCount:    uint(len(mmdbTestTree(t, 6, []mmdbTestNetwork{{"1.2.3.0/24", 0}, {"10.0.0.0/8", 0}, {"192.168.0.0/16", 0}, {"2001:db8::/32", 0}}))),
+	}
+	if r.Metadata != want {
+		t.Errorf("Metadata = %+v, want %+v", r.Metadata, want)
+	}
+}
+
+func TestReader_Lookup(t *testing.T) {
+	cn := map[string]interface{}{"country": map[string]interface{}{"iso_code": "CN"}}
+	jp := map[string]interface{}{"country": map[string]interface{}{"iso_code": "JP"}}
+	private := map[string]interface{}{"private": true}
+	lookups := []struct {
+		ip     string
+		want   interface{}
+		wantV4 interface{} // In the IPv4 database
+	}{
+		{"1.2.3.4", cn, cn},
+		{"1.2.3.255", cn, cn},
+		{"1.2.4.1", nil, nil},
+		{"10.20.30.40", private, private},
+		{"192.168.1.1", private, private},
+		{"8.8.8.8", nil, nil},
+		{"::ffff:1.2.3.4", cn, cn},
+		{"2001:db8::1", jp, nil},
+		{"2001:db9::1", nil, nil},
+		{"::1", nil, nil},
+	}
+	for _, ipVersion := range []uint{4, 6} {
+		for _, recordSize := range []uint{24, 28, 32} {
+			r, err := New(mmdbTestDB(t, ipVersion, recordSize))
+			if err != nil {
+				t.Fatalf("IPv%d, %d bits: %v", ipVersion, recordSize, err)
+			}
+			for _, l := range lookups {
+				want := l.want
+				if ipVersion == 4 {
+					want = l.wantV4
+				}
+				got, err := r.Lookup(net.ParseIP(l.ip))
+				if err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("IPv%d, %d bits: Lookup(%s) = %v, %v, want %v", ipVersion, recordSize, l.ip, got, err, want)
+				}
+			}
+		}
+	}
+}
+
+func TestReader_Lookup_Invalid(t *testing.T) {
+	r, err := New(mmdbTestDB(t, 6, 24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Lookup(net.IP{1, 2, 3}); err == nil {
+		t.Error("Lookup() of an invalid IP succeeded")
+	}
+
+	// A node pointing to itself
+	loop := mmdbTestFile([][2]int{{0, 0}}, 24, nil, mmdbTestMetadata(4, 24, 1))
+	if r, err = New(loop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Lookup(net.ParseIP("1.2.3.4")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Lookup() in a looping tree error = %v, want ErrInvalid", err)
+	}
+
+	// A record pointing past the data section
+	past := mmdbTestFile([][2]int{{-2 - 100, -1}}, 24, mmdbTestEncode(nil, "short"), mmdbTestMetadata(4, 24, 1))
+	if r, err = New(past); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Lookup(net.ParseIP("1.2.3.4")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Lookup() past the data section error = %v, want ErrInvalid", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	huge := strings.Repeat("y", 70000)
+	testCases := []struct {
+		name string
+		v    interface{}
+		want interface{}
+	}{
+		{"string", "Hello", "Hello"},
+		{"empty string", "", ""},
+		{"long string", long, long},
+		{"huge string", huge, huge},
+		{"bytes", []byte{1, 2, 3}, []byte{1, 2, 3}},
+		{"double", 42.5, 42.5},
+		{"float", float32(1.5), float32(1.5)},
+		{"uint16", uint16(0xbeef), uint64(0xbeef)},
+		{"uint16 zero", uint16(0), uint64(0)},
+		{"uint32", uint32(0xdeadbeef), uint64(0xdeadbeef)},
+		{"uint64", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"int32", int32(-42), int64(-42)},
+		{"uint128", new(big.Int).Lsh(big.NewInt(1), 100), new(big.Int).Lsh(big.NewInt(1), 100)},
+		{"bools", []interface{}{true, false}, []interface{}{true, false}},
+		{"nested", map[string]interface{}{
+			"names": map[string]interface{}{"en": "China", "fr": "Chine"},
+			"ids":   []interface{}{uint32(1), uint32(2)},
+		}, map[string]interface{}{
+			"names": map[string]interface{}{"en": "China", "fr": "Chine"},
+			"ids":   []interface{}{uint64(1), uint64(2)},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := mmdbTestEncode(nil, tc.v)
+			got, next, err := decoder{b}.decode(0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) || next != uint(len(b)) {
+				t.Errorf("decode() = %v, %d, want %v, %d", got, next, tc.want, len(b))
+			}
+		})
+	}
+}
+
+func TestDecoder_Pointers(t *testing.T) {
+	// Strings at offsets needing pointers of 1, 2 & 3 bytes, then the pointers to them
+	offsets := []uint{0, 3000, 600000}
+	var b []byte
+	for k, off := range offsets {
+		b = append(b, make([]byte, off-uint(len(b)))...)
+		b = mmdbTestEncode(b, string(rune('a'+k)))
+	}
+	for k, off := range offsets {
+		start := uint(len(b))
+		b = mmdbTestEncode(b, mmdbTestPointer(off))
+		got, next, err := decoder{b}.decode(start, 0)
+		if err != nil || got != string(rune('a'+k)) || next != uint(len(b)) {
+			t.Errorf("pointer to %d = %v, %d, %v, want %q, %d", off, got, next, err, string(rune('a'+k)), len(b))
+		}
+	}
+	// 4-byte pointers aren't biased, but need a data section of 128 MiB to be written by mmdbTestEncode
+	start := uint(len(b))
+	b = append(b, typePointer<<5|3<<3, 0, 0, 0x0b, 0xb8)
+	if got, _, err := (decoder{b}).decode(start, 0); err != nil || got != "b" {
+		t.Errorf("4-byte pointer to 3000 = %v, %v, want %q", got, err, "b")
+	}
+}
+
+func TestDecoder_Invalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"pointer loop", mmdbTestEncode(nil, mmdbTestPointer(0))},
+		{"truncated pointer", []byte{typePointer<<5 | 1<<3, 0}},
+		{"truncated string", mmdbTestEncode(nil, "Hello")[:3]},
+		{"truncated size", []byte{typeString<<5 | 30, 0}},
+		{"truncated extended type", []byte{0}},
+		{"truncated map", mmdbTestControl(nil, typeMap, 1)},
+		{"map key", append(mmdbTestControl(nil, typeMap, 1), mmdbTestEncode(mmdbTestEncode(nil, uint16(1)), "v")...)},
+		{"bool size", mmdbTestControl(nil, typeBool, 2)},
+		{"double size", append(mmdbTestControl(nil, typeDouble, 4), 0, 0, 0, 0)},
+		{"float size", append(mmdbTestControl(nil, typeFloat, 8), make([]byte, 8)...)},
+		{"uint16 size", append(mmdbTestControl(nil, typeUint16, 3), 1, 2, 3)},
+		{"int32 size", append(mmdbTestControl(nil, typeInt32, 5), make([]byte, 5)...)},
+		{"uint128 size", append(mmdbTestControl(nil, typeUint128, 17), make([]byte, 17)...)},
+		{"container", mmdbTestControl(nil, typeContainer, 0)},
+		{"end marker", mmdbTestControl(nil, typeEndMarker, 0)},
+		{"unknown type", []byte{0, 0xff}},
+		// Millions of elements announced, not there
+		{"huge map", mmdbTestControl(nil, typeMap, 1<<24)},
+		{"huge array", mmdbTestControl(nil, typeArray, 1<<24)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if v, _, err := (decoder{tc.data}).decode(0, 0); !errors.Is(err, ErrInvalid) {
+				t.Errorf("decode() = %v, %v, want ErrInvalid", v, err)
+			}
+		})
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	meta := func(f func(m map[string]interface{})) []byte {
+		m := mmdbTestMetadata(4, 24, 1)
+		f(m)
+		return mmdbTestFile([][2]int{{-1, -1}}, 24, nil, m)
+	}
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no metadata", make([]byte, 64)},
+		{"metadata not a map", append(append(make([]byte, 24), metadataMarker...), mmdbTestEncode(nil, "meta")...)},
+		{"truncated metadata", mmdbTestDB(t, 4, 24)[:len(mmdbTestDB(t, 4, 24))-5]},
+		{"no node count", meta(func(m map[string]interface{}) { delete(m, "node_count") })},
+		{"string record size", meta(func(m map[string]interface{}) { m["record_size"] = "24" })},
+		{"record size", meta(func(m map[string]interface{}) { m["record_size"] = uint16(20) })},
+		{"ip version", meta(func(m map[string]interface{}) { m["ip_version"] = uint16(5) })},
+		{"node count", meta(func(m map[string]interface{}) { m["node_count"] = uint32(1000) })},
+		{"huge node count", meta(func(m map[string]interface{}) { m["node_count"] = uint64(1) << 62 })},
+		// Overflowing the size of the tree on 32-bit platforms, if multiplied by the record size
+		{"max node count", meta(func(m map[string]interface{}) { m["node_count"] = uint32(math.MaxUint32) })},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if r, err := New(tc.data); !errors.Is(err, ErrInvalid) {
+				t.Errorf("New() = %v, %v, want ErrInvalid", r, err)
+			}
+		})
+	}
+}
+
+// TestNew_Corrupt checks truncated & corrupted databases are rejected, or looked up without panicking.
+func TestNew_Corrupt(t *testing.T) {
+	ips := []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1"), net.ParseIP("::")}
+	for _, recordSize := range []uint{24, 28, 32} {
+		db := mmdbTestDB(t, 6, recordSize)
+		var variants [][]byte
+		for k := range db {
+			variants = append(variants, db[:k])
+			for _, mask := range []byte{0xff, 0x01, 0x80} {
+				bs := append([]byte{}, db...)
+				bs[k] ^= mask
+				variants = append(variants, bs)
+			}
+		}
+		for _, bs := range variants {
+			r, err := New(bs)
+			if err != nil {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("New() error = %v, want ErrInvalid", err)
+				}
+				continue
+			}
+			for _, ip := range ips {
+				// Errors are fine, panics aren't
+				_, _ = r.Lookup(ip)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package builtins
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// List file formats supported by ParseList.
+const (
+	ListFormatPlain   = "plain"   // One entry per line, # for comments
+	ListFormatHosts   = "hosts"   // /etc/hosts style, e.g. "0.0.0.0 ads.example.com"
+	ListFormatAdblock = "adblock" // Adblock Plus domain rules, e.g. "||ads.example.com^"
+	ListFormatDnsmasq = "dnsmasq" // e.g. "address=/ads.example.com/0.0.0.0" or "server=/example.com/1.1.1.1"
+)
+
+// hostsIgnoredNames are names commonly found in hosts files that aren't blocking entries.
+var hostsIgnoredNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// ReadListFile reads the entries of a list file in the given format.
+// An empty format means ListFormatPlain.
+func ReadListFile(filename, format string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := ParseList(f, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return entries, nil
+}
+
+// ParseList parses the entries of a list in the given format.
+// Lines that are not applicable in the format (e.g. Adblock rules with paths or
+// exceptions) are skipped, as lists in the wild often contain a mix of rule types.
+func ParseList(r io.Reader, format string) ([]string, error) {
+	var parseLine func(line string) []string
+	switch strings.ToLower(format) {
+	case "", ListFormatPlain:
+		parseLine = parsePlainLine
+	case ListFormatHosts:
+		parseLine = parseHostsLine
+	case ListFormatAdblock:
+		parseLine = parseAdblockLine
+	case ListFormatDnsmasq:
+		parseLine = parseDnsmasqLine
+	default:
+		return nil, fmt.Errorf("unsupported list format %q", format)
+	}
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entries = append(entries, parseLine(strings.TrimSpace(scanner.Text()))...)
+	}
+	return entries, scanner.Err()
+}
+
+func parsePlainLine(line string) []string {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	return []string{line}
+}
+
+func parseHostsLine(line string) []string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil
+	}
+	var entries []string
+	for _, name := range fields[1:] {
+		if !hostsIgnoredNames[strings.ToLower(name)] {
+			entries = append(entries, name)
+		}
+	}
+	return entries
+}
+
+func parseAdblockLine(line string) []string {
+	// Only "||domain^" rules (optionally with the "$important" option) block whole domains
+	if !strings.HasPrefix(line, "||") {
+		return nil
+	}
+	line = line[2:]
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		if line[i+1:] != "important" {
+			return nil
+		}
+		line = line[:i]
+	}
+	line = strings.TrimSuffix(line, "^")
+	if line == "" || strings.ContainsAny(line, "/*^|:?=") {
+		return nil
+	}
+	return []string{line}
+}
+
+func parseDnsmasqLine(line string) []string {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return nil
+	}
+	switch key {
+	case "address", "server", "local":
+	default:
+		return nil
+	}
+	// /domain1/domain2/[target]
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil
+	}
+	var entries []string
+	for _, d := range parts[1 : len(parts)-1] {
+		if d != "" && d != "#" {
+			entries = append(entries, d)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,101 @@
+package builtins
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	testCases := []struct {
+		name   string
+		format string
+		input  string
+		want   []string
+	}{
+		{
+			name:   "plain",
+			format: ListFormatPlain,
+			input: `# Comment
+example.com
+  www.example.org  
+
+10.0.0.0/8
+`,
+			want: []string{"example.com", "www.example.org", "10.0.0.0/8"},
+		},
+		{
+			name:   "empty format",
+			format: "",
+			input:  "a\nb",
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "hosts",
+			format: ListFormatHosts,
+			input: `# Title
+127.0.0.1 localhost localhost.localdomain
+::1 ip6-localhost ip6-loopback
+255.255.255.255 broadcasthost
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com # Inline comment
+0.0.0.0	tracker.example.com	Tracker2.example.com
+::  ipv6.example.com
+ads3.example.com
+not-an-ip ads4.example.com
+`,
+			want: []string{"ads.example.com", "tracker.example.com", "Tracker2.example.com", "ipv6.example.com"},
+		},
+		{
+			name:   "adblock",
+			format: "Adblock",
+			input: `[Adblock Plus 2.0]
+! Comment
+||ads.example.com^
+||tracker.example.com^$important
+||nocaret.example.com
+||third.example.com^$third-party
+@@||allowed.example.com^
+||example.com/ads/*
+||*.wild.example.com^
+|https://example.com^
+example.net##.banner
+||port.example.com:8080^
+`,
+			want: []string{"ads.example.com", "tracker.example.com", "nocaret.example.com"},
+		},
+		{
+			name:   "dnsmasq",
+			format: ListFormatDnsmasq,
+			input: `# Comment
+address=/ads.example.com/0.0.0.0
+address=/a.example.com/b.example.com/::
+server=/corp.example.com/10.0.0.1
+local=/lan/
+address=/#/0.0.0.0
+address=/blocked.example.com/
+ipset=/set.example.com/myset
+address=ads.example.com/0.0.0.0
+cache-size=1000
+`,
+			want: []string{"ads.example.com", "a.example.com", "b.example.com", "corp.example.com", "lan", "blocked.example.com"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseList(strings.NewReader(tc.input), tc.format)
+			if err != nil {
+				t.Fatalf("ParseList() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseList() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseList_UnsupportedFormat(t *testing.T) {
+	if _, err := ParseList(strings.NewReader("a"), "csv"); err == nil {
+		t.Error("ParseList() error = nil, want an error")
+	}
+}
@@ -0,0 +1,128 @@
+package builtins
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+const (
+	// NAT64WellKnownPrefix is the prefix of RFC 6052, used by NAT64 gateways & DNS64 servers by default.
+	NAT64WellKnownPrefix = "64:ff9b::/96"
+
+	nat64DefaultMaxDomains = 65536
+)
+
+// NAT64 recognizes the IPv6 addresses that NAT64 gateways & DNS64 servers synthesize from IPv4 addresses
+// (RFC 6052 & 6147), and remembers the domains DNS64 servers answered them for.
+// It is safe for concurrent use.
+type NAT64 struct {
+	prefixes []*net.IPNet
+	domains  *lru.Cache[string, string] // Synthesized address (16 bytes) -> domain
+}
+
+// NewNAT64 returns a NAT64 with the given prefixes, the well-known one if there's none.
+// maxDomains is the number of synthesized addresses whose domain is remembered, default 65536.
+func NewNAT64(prefixes []string, maxDomains int) (*NAT64, error) {
+	if len(prefixes) == 0 {
+		prefixes = []string{NAT64WellKnownPrefix}
+	}
+	if maxDomains <= 0 {
+		maxDomains = nat64DefaultMaxDomains
+	}
+	n := &NAT64{}
+	for _, p := range prefixes {
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits != 8*net.IPv6len || ipNet.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid prefix %q, must be IPv6", p)
+		}
+		switch ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return nil, fmt.Errorf("invalid prefix %q, must be /32, /40, /48, /56, /64 or /96", p)
+		}
+		n.prefixes = append(n.prefixes, ipNet)
+	}
+	// Longest prefixes first, for overlapping ones
+	sort.SliceStable(n.prefixes, func(i, j int) bool {
+		a, _ := n.prefixes[i].Mask.Size()
+		b, _ := n.prefixes[j].Mask.Size()
+		return a > b
+	})
+	n.domains, _ = lru.New[string, string](maxDomains)
+	return n, nil
+}
+
+// IPv4 returns the IPv4 address embedded in a synthesized address and its prefix,
+// or nil if ip isn't in any of the prefixes.
+func (n *NAT64) IPv4(ip net.IP) (net.IP, *net.IPNet) {
+	if ip.To4() != nil {
+		return nil, nil
+	}
+	for _, p := range n.prefixes {
+		if !p.Contains(ip) {
+			continue
+		}
+		ones, _ := p.Mask.Size()
+		v4 := make(net.IP, 0, net.IPv4len)
+		for i := ones / 8; len(v4) < net.IPv4len; i++ {
+			if i == 8 {
+				// Bits 64 to 71 are reserved (the "u" octet)
+				continue
+			}
+			v4 = append(v4, ip[i])
+		}
+		return v4, p
+	}
+	return nil, nil
+}
+
+// LearnDNS remembers the domains of the synthesized addresses in the answers of a DNS response,
+// m being the properties of the dns analyzer. It can be called by several workers at once,
+// and with Domain, as the domains are kept in a locked cache.
+func (n *NAT64) LearnDNS(m analyzer.PropMap) {
+	if qr, _ := m["qr"].(bool); !qr {
+		return
+	}
+	answers, _ := m["answers"].([]analyzer.PropMap)
+	if len(answers) == 0 {
+		return
+	}
+	// The name asked for, rather than that of the answer, which can be the target of a CNAME
+	var domain string
+	if questions, _ := m["questions"].([]analyzer.PropMap); len(questions) > 0 {
+		domain, _ = questions[0]["name"].(string)
+	}
+	for _, rr := range answers {
+		aaaa, _ := rr["aaaa"].(string)
+		ip := net.ParseIP(aaaa)
+		if ip == nil {
+			continue
+		}
+		if v4, _ := n.IPv4(ip); v4 == nil {
+			continue
+		}
+		name := domain
+		if name == "" {
+			name, _ = rr["name"].(string)
+		}
+		if name = strings.TrimSuffix(strings.ToLower(name), "."); name != "" {
+			n.domains.Add(string(ip.To16()), name)
+		}
+	}
+}
+
+// Domain returns the domain a synthesized address was last answered for, "" if unknown.
+func (n *NAT64) Domain(ip net.IP) string {
+	domain, _ := n.domains.Get(string(ip.To16()))
+	return domain
+}
@@ -0,0 +1,82 @@
+package builtins
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+// nat64TestResponse returns the properties of a DNS response to a question for name,
+// with an AAAA record per address.
+func nat64TestResponse(name string, aaaa ...string) analyzer.PropMap {
+	answers := make([]analyzer.PropMap, len(aaaa))
+	for i, a := range aaaa {
+		answers[i] = analyzer.PropMap{"name": name, "type": 28, "aaaa": a}
+	}
+	return analyzer.PropMap{
+		"qr":        true,
+		"questions": []analyzer.PropMap{{"name": name, "type": 28}},
+		"answers":   answers,
+	}
+}
+
+func TestNAT64_LearnDNS(t *testing.T) {
+	query := nat64TestResponse("query.example.com", "64:ff9b::c000:201")
+	query["qr"] = false
+	cname := nat64TestResponse("alias.example.com", "64:ff9b::c000:202")
+	cname["answers"] = []analyzer.PropMap{
+		{"name": "alias.example.com", "type": 5, "cname": "target.example.net"},
+		{"name": "target.example.net", "type": 28, "aaaa": "64:ff9b::c000:202"},
+	}
+	testCases := []struct {
+		name string
+		m    analyzer.PropMap
+		ip   string
+		want string
+	}{
+		{"synthesized", nat64TestResponse("Example.COM.", "64:ff9b::5db8:d822"), "64:ff9b::5db8:d822", "example.com"},
+		{"not synthesized", nat64TestResponse("native.example.com", "2001:db8::1"), "2001:db8::1", ""},
+		{"query", query, "64:ff9b::c000:201", ""},
+		{"cname", cname, "64:ff9b::c000:202", "alias.example.com"},
+		{"no dns", nil, "64:ff9b::c000:203", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := NewNAT64(nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.LearnDNS(tc.m)
+			if got := n.Domain(net.ParseIP(tc.ip)); got != tc.want {
+				t.Errorf("Domain(%s) = %q, want %q", tc.ip, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNAT64_ConcurrentLearnDNS(t *testing.T) {
+	// For -race: workers learning & looking up domains at once
+	n, err := NewNAT64(nil, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				ip := fmt.Sprintf("64:ff9b::c000:%x", i%256)
+				n.LearnDNS(nat64TestResponse(fmt.Sprintf("d%d.w%d.com", i, w), ip))
+				n.Domain(net.ParseIP(ip))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if got := n.Domain(net.ParseIP("64:ff9b::c000:e7")); got == "" {
+		t.Errorf("Domain(64:ff9b::c000:e7) = %q, want a learned domain", got)
+	}
+}
@@ -0,0 +1,518 @@
+package builtins
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidEntry = errors.New("invalid entry")
+
+type SetType int
+
+const (
+	// SetTypeString matches values exactly.
+	SetTypeString SetType = iota
+	// SetTypeIP matches IP addresses against IPs and CIDRs.
+	SetTypeIP
+	// SetTypeDomain matches domains against entries and all their subdomains.
+	SetTypeDomain
+)
+
+func (t SetType) String() string {
+	switch t {
+	case SetTypeString:
+		return "string"
+	case SetTypeIP:
+		return "ip"
+	case SetTypeDomain:
+		return "domain"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseSetType parses a set type name. An empty name means SetTypeString.
+func ParseSetType(s string) (SetType, bool) {
+	switch strings.ToLower(s) {
+	case "string", "":
+		return SetTypeString, true
+	case "ip":
+		return SetTypeIP, true
+	case "domain":
+		return SetTypeDomain, true
+	default:
+		return 0, false
+	}
+}
+
+type ipPrefixKey struct {
+	Bits int
+	V6   bool
+}
+
+const (
+	// setInPlaceEntries is the number of entries up to which a change is made in place.
+	// Larger ones are made on a copy of the entries, swapped in once done.
+	setInPlaceEntries = 1024
+)
+
+// Set is a named set of entries that can be modified at runtime.
+// Entries can have an expiry time, after which they no longer match.
+// It is safe for concurrent use.
+type Set struct {
+	name string
+	typ  SetType
+
+	// writeMutex serializes the changes, so that large ones can be made on a copy
+	// of the data without blocking Contains, with mutex only held to swap it in.
+	writeMutex sync.Mutex
+	mutex      sync.RWMutex
+	data       *setData
+}
+
+// setData holds the entries of a set.
+type setData struct {
+	entries map[string]time.Time // Entry -> expiry (zero = never), for string sets
+	domains *domainTrie          // For domain sets
+	// For IP sets: prefix length -> masked IP -> expiry.
+	// Matching does one lookup per distinct prefix length in the set.
+	prefixes map[ipPrefixKey]map[string]time.Time
+	// Entries with an expiry, soonest first. They may have been removed or renewed since.
+	expiries setExpiryHeap
+}
+
+// setKey is a normalized entry: the masked IP & prefix for IP sets, the value itself otherwise.
+type setKey struct {
+	Value  string
+	Prefix ipPrefixKey
+}
+
+func NewSet(name string, typ SetType) *Set {
+	return &Set{name: name, typ: typ, data: newSetData()}
+}
+
+func newSetData() *setData {
+	return &setData{
+		entries:  make(map[string]time.Time),
+		domains:  &domainTrie{},
+		prefixes: make(map[ipPrefixKey]map[string]time.Time),
+	}
+}
+
+func (s *Set) Name() string {
+	return s.name
+}
+
+func (s *Set) Type() SetType {
+	return s.typ
+}
+
+// Add adds entries to the set. A ttl of zero means the entries never expire.
+// Adding an existing entry updates its expiry. Expired entries are purged as a side effect.
+// Either all entries are added, or none if any of them is invalid.
+func (s *Set) Add(entries []string, ttl time.Duration) error {
+	return s.add(entries, ttl, time.Now())
+}
+
+func (s *Set) add(entries []string, ttl time.Duration, now time.Time) error {
+	keys, err := s.keys(entries)
+	if err != nil {
+		return err
+	}
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = now.Add(ttl)
+	}
+	s.change(len(keys), func(d *setData) {
+		d.purge(s.typ, now)
+		for _, k := range keys {
+			d.insert(s.typ, k, expiry)
+		}
+	})
+	return nil
+}
+
+// Replace replaces all the entries of the set with entries, which never expire.
+// Either the set is replaced, or unchanged if any of the entries is invalid.
+func (s *Set) Replace(entries []string) error {
+	keys, err := s.keys(entries)
+	if err != nil {
+		return err
+	}
+	d := newSetData()
+	for _, k := range keys {
+		d.insert(s.typ, k, time.Time{})
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data = d
+	return nil
+}
+
+// Remove removes entries from the set, and returns the number of entries removed.
+// Either the entries are removed, or none if any of them is invalid.
+func (s *Set) Remove(entries []string) (int, error) {
+	return s.remove(entries, time.Now())
+}
+
+func (s *Set) remove(entries []string, now time.Time) (int, error) {
+	keys, err := s.keys(entries)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	s.change(len(keys), func(d *setData) {
+		d.purge(s.typ, now)
+		for _, k := range keys {
+			if d.delete(s.typ, k) {
+				n++
+			}
+		}
+	})
+	return n, nil
+}
+
+// change applies f to the data of the set, in place if it changes at most setInPlaceEntries
+// entries, or on a copy swapped in afterwards otherwise.
+func (s *Set) change(entries int, f func(d *setData)) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if entries <= setInPlaceEntries {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		f(s.data)
+		return
+	}
+	// Only changed with writeMutex held, so it can be read without mutex
+	d := s.data.clone()
+	f(d)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data = d
+}
+
+// keys returns the normalized entries, or an error if any of them is invalid.
+func (s *Set) keys(entries []string) ([]setKey, error) {
+	keys := make([]setKey, len(entries))
+	for i, e := range entries {
+		if s.typ == SetTypeIP {
+			n, err := parseIPEntry(e)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = setKey{Value: string(n.IP), Prefix: ipNetKey(n)}
+			continue
+		}
+		v, err := s.normalize(e)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = setKey{Value: v}
+	}
+	return keys, nil
+}
+
+// SetEntry is an entry of a set as returned by Set.List.
+type SetEntry struct {
+	Value  string    `json:"value"`
+	Expiry time.Time `json:"expiry,omitempty"` // Zero if the entry never expires
+}
+
+// List returns all unexpired entries, sorted by value.
+// Expired entries are purged as a side effect.
+func (s *Set) List() []SetEntry {
+	return s.list(time.Now())
+}
+
+func (s *Set) list(now time.Time) []SetEntry {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.mutex.Lock()
+	s.data.purge(s.typ, now)
+	s.mutex.Unlock()
+	// Only changed with writeMutex held
+	d := s.data
+	var list []SetEntry
+	switch s.typ {
+	case SetTypeIP:
+		for key, m := range d.prefixes {
+			for ip, exp := range m {
+				value := net.IP(ip).String()
+				if ones, bits := ipKeyMask(key).Size(); ones != bits {
+					value = (&net.IPNet{IP: net.IP(ip), Mask: ipKeyMask(key)}).String()
+				}
+				list = append(list, SetEntry{Value: value, Expiry: exp})
+			}
+		}
+	case SetTypeDomain:
+		d.domains.Walk(func(domain string, exp time.Time) bool {
+			list = append(list, SetEntry{Value: domain, Expiry: exp})
+			return true
+		})
+	default:
+		for k, exp := range d.entries {
+			list = append(list, SetEntry{Value: k, Expiry: exp})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Value < list[j].Value })
+	return list
+}
+
+// Contains returns whether the value matches any unexpired entry of the set.
+func (s *Set) Contains(value string) bool {
+	return s.contains(value, time.Now())
+}
+
+func (s *Set) contains(value string, now time.Time) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	d := s.data
+	switch s.typ {
+	case SetTypeIP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return false
+		}
+		v6 := true
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, v6 = ip4, false
+		}
+		for key, m := range d.prefixes {
+			if key.V6 != v6 {
+				continue
+			}
+			if exp, ok := m[string(ip.Mask(ipKeyMask(key)))]; ok && !expired(exp, now) {
+				return true
+			}
+		}
+		return false
+	case SetTypeDomain:
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			// HTTP Host header with port
+			value = host
+		}
+		return d.domains.Match(strings.TrimSuffix(strings.ToLower(value), "."), now)
+	default:
+		exp, ok := d.entries[value]
+		return ok && !expired(exp, now)
+	}
+}
+
+// Len returns the number of entries in the set, including expired ones not yet purged.
+func (s *Set) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	d := s.data
+	n := len(d.entries) + d.domains.Len()
+	for _, m := range d.prefixes {
+		n += len(m)
+	}
+	return n
+}
+
+func (d *setData) insert(typ SetType, k setKey, expiry time.Time) {
+	switch typ {
+	case SetTypeIP:
+		m := d.prefixes[k.Prefix]
+		if m == nil {
+			m = make(map[string]time.Time)
+			d.prefixes[k.Prefix] = m
+		}
+		m[k.Value] = expiry
+	case SetTypeDomain:
+		d.domains.Insert(k.Value, expiry)
+	default:
+		d.entries[k.Value] = expiry
+	}
+	if !expiry.IsZero() {
+		heap.Push(&d.expiries, setExpiry{Key: k, Expiry: expiry})
+	}
+}
+
+func (d *setData) delete(typ SetType, k setKey) bool {
+	switch typ {
+	case SetTypeIP:
+		m := d.prefixes[k.Prefix]
+		if _, ok := m[k.Value]; !ok {
+			return false
+		}
+		delete(m, k.Value)
+		if len(m) == 0 {
+			delete(d.prefixes, k.Prefix)
+		}
+		return true
+	case SetTypeDomain:
+		return d.domains.Delete(k.Value)
+	default:
+		if _, ok := d.entries[k.Value]; !ok {
+			return false
+		}
+		delete(d.entries, k.Value)
+		return true
+	}
+}
+
+func (d *setData) expiry(typ SetType, k setKey) (time.Time, bool) {
+	switch typ {
+	case SetTypeIP:
+		exp, ok := d.prefixes[k.Prefix][k.Value]
+		return exp, ok
+	case SetTypeDomain:
+		return d.domains.Expiry(k.Value)
+	default:
+		exp, ok := d.entries[k.Value]
+		return exp, ok
+	}
+}
+
+// purge deletes the entries that have expired.
+func (d *setData) purge(typ SetType, now time.Time) {
+	for len(d.expiries) > 0 && expired(d.expiries[0].Expiry, now) {
+		e := heap.Pop(&d.expiries).(setExpiry)
+		if exp, ok := d.expiry(typ, e.Key); ok && exp.Equal(e.Expiry) {
+			// Not renewed since
+			d.delete(typ, e.Key)
+		}
+	}
+}
+
+func (d *setData) clone() *setData {
+	c := &setData{
+		entries:  make(map[string]time.Time, len(d.entries)),
+		domains:  d.domains.clone(),
+		prefixes: make(map[ipPrefixKey]map[string]time.Time, len(d.prefixes)),
+		expiries: slices.Clone(d.expiries),
+	}
+	for k, exp := range d.entries {
+		c.entries[k] = exp
+	}
+	for key, m := range d.prefixes {
+		cm := make(map[string]time.Time, len(m))
+		for ip, exp := range m {
+			cm[ip] = exp
+		}
+		c.prefixes[key] = cm
+	}
+	return c
+}
+
+type setExpiry struct {
+	Key    setKey
+	Expiry time.Time
+}
+
+// setExpiryHeap is a min-heap of entry expiries, for container/heap.
+type setExpiryHeap []setExpiry
+
+func (h setExpiryHeap) Len() int           { return len(h) }
+func (h setExpiryHeap) Less(i, j int) bool { return h[i].Expiry.Before(h[j].Expiry) }
+func (h setExpiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *setExpiryHeap) Push(x any)        { *h = append(*h, x.(setExpiry)) }
+func (h *setExpiryHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (s *Set) normalize(e string) (string, error) {
+	if s.typ == SetTypeDomain {
+		d := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(e)), "*.")
+		d = strings.Trim(d, ".")
+		if d == "" {
+			return "", fmt.Errorf("%w %q", errInvalidEntry, e)
+		}
+		return d, nil
+	}
+	if e == "" {
+		return "", fmt.Errorf("%w %q", errInvalidEntry, e)
+	}
+	return e, nil
+}
+
+// parseIPEntry parses an IP or CIDR into a network with a 4-byte IP for IPv4.
+func parseIPEntry(e string) (*net.IPNet, error) {
+	e = strings.TrimSpace(e)
+	if strings.Contains(e, "/") {
+		_, ipNet, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q", errInvalidEntry, e)
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			ones, _ := ipNet.Mask.Size()
+			if len(ipNet.Mask) == net.IPv6len {
+				ones -= 96
+			}
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones, 32)}, nil
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(e)
+	if ip == nil {
+		return nil, fmt.Errorf("%w %q", errInvalidEntry, e)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func ipNetKey(n *net.IPNet) ipPrefixKey {
+	ones, bits := n.Mask.Size()
+	return ipPrefixKey{Bits: ones, V6: bits == 128}
+}
+
+func ipKeyMask(k ipPrefixKey) net.IPMask {
+	if k.V6 {
+		return net.CIDRMask(k.Bits, 128)
+	}
+	return net.CIDRMask(k.Bits, 32)
+}
+
+func expired(exp, now time.Time) bool {
+	return !exp.IsZero() && now.After(exp)
+}
+
+// SetStore is a collection of named sets. The collection itself is fixed
+// after creation, while the sets can be modified at any time.
+type SetStore struct {
+	sets map[string]*Set
+}
+
+func NewSetStore(sets ...*Set) *SetStore {
+	m := make(map[string]*Set, len(sets))
+	for _, s := range sets {
+		m[s.Name()] = s
+	}
+	return &SetStore{sets: m}
+}
+
+// Get returns the set with the given name, or nil if it doesn't exist.
+func (s *SetStore) Get(name string) *Set {
+	if s == nil {
+		return nil
+	}
+	return s.sets[name]
+}
+
+// Sets returns all sets, sorted by name.
+func (s *SetStore) Sets() []*Set {
+	if s == nil {
+		return nil
+	}
+	list := make([]*Set, 0, len(s.sets))
+	for _, set := range s.sets {
+		list = append(list, set)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
@@ -0,0 +1,410 @@
+package builtins
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSet(t *testing.T, typ SetType, entries ...string) *Set {
+	s := NewSet("test", typ)
+	if err := s.Add(entries, 0); err != nil {
+		t.Fatalf("Add(%v) error = %v", entries, err)
+	}
+	return s
+}
+
+func setValues(s *Set) []string {
+	var values []string
+	for _, e := range s.List() {
+		values = append(values, e.Value)
+	}
+	return values
+}
+
+func TestSet_Contains(t *testing.T) {
+	testCases := []struct {
+		name    string
+		typ     SetType
+		entries []string
+		values  map[string]bool
+	}{
+		{
+			name:    "string",
+			typ:     SetTypeString,
+			entries: []string{"alice", "Bob"},
+			values: map[string]bool{
+				"alice": true,
+				"Bob":   true,
+				"bob":   false, // Exact
+				"":      false,
+			},
+		},
+		{
+			name:    "ip",
+			typ:     SetTypeIP,
+			entries: []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32", "::ffff:172.16.0.0/108"},
+			values: map[string]bool{
+				"10.0.0.1":        true,
+				"10.0.0.2":        false,
+				"192.168.255.1":   true,
+				"192.169.0.1":     false,
+				"::ffff:10.0.0.1": true,
+				"2001:db8::1":     true,
+				"2001:db9::1":     false,
+				"172.16.3.4":      true, // IPv4-mapped CIDR
+				"172.32.0.1":      false,
+				"not an ip":       false,
+			},
+		},
+		{
+			name:    "domain",
+			typ:     SetTypeDomain,
+			entries: []string{"Example.com", "*.ads.net", "tracker.org."},
+			values: map[string]bool{
+				"example.com":          true,
+				"www.example.com":      true,
+				"WWW.EXAMPLE.COM.":     true,
+				"example.com:8080":     true, // Host header
+				"badexample.com":       false,
+				"com":                  false,
+				"ads.net":              true,
+				"x.y.ads.net":          true,
+				"tracker.org":          true,
+				"tracker.org.evil.com": false,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSet(t, tc.typ, tc.entries...)
+			for v, want := range tc.values {
+				if got := s.Contains(v); got != want {
+					t.Errorf("Contains(%q) = %v, want %v", v, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseIPEntry(t *testing.T) {
+	testCases := map[string]string{
+		"10.0.0.1":            "10.0.0.1/32",
+		" 10.0.0.1 ":          "10.0.0.1/32",
+		"10.1.2.3/8":          "10.0.0.0/8",
+		"::ffff:10.0.0.1":     "10.0.0.1/32",
+		"::ffff:10.1.2.3/104": "10.0.0.0/8",
+		"2001:db8::1":         "2001:db8::1/128",
+		"2001:db8:1:2::/32":   "2001:db8::/32",
+		"0.0.0.0/0":           "0.0.0.0/0",
+		"10.0.0.1/33":         "",
+		"10.0.0":              "",
+		"example.com":         "",
+		"":                    "",
+	}
+	for entry, want := range testCases {
+		n, err := parseIPEntry(entry)
+		if want == "" {
+			if !errors.Is(err, errInvalidEntry) {
+				t.Errorf("parseIPEntry(%q) error = %v, want %v", entry, err, errInvalidEntry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIPEntry(%q) error = %v", entry, err)
+			continue
+		}
+		if got := n.String(); got != want {
+			t.Errorf("parseIPEntry(%q) = %s, want %s", entry, got, want)
+		}
+		if n.IP.To4() != nil && len(n.IP) != 4 {
+			t.Errorf("parseIPEntry(%q) IP has %d bytes, want 4", entry, len(n.IP))
+		}
+	}
+}
+
+func TestSet_List(t *testing.T) {
+	testCases := []struct {
+		name    string
+		typ     SetType
+		entries []string
+		want    []string
+	}{
+		{"string", SetTypeString, []string{"b", "a", "b"}, []string{"a", "b"}},
+		{"ip", SetTypeIP, []string{"10.0.0.1", "10.1.2.3/8", "::ffff:10.0.0.1", "2001:db8::/32"}, []string{"10.0.0.0/8", "10.0.0.1", "2001:db8::/32"}},
+		{"domain", SetTypeDomain, []string{"www.example.com", "*.Example.com", "a.org"}, []string{"a.org", "example.com", "www.example.com"}},
+		{"empty", SetTypeString, nil, nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSet(t, tc.typ, tc.entries...)
+			if got := setValues(s); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSet_Add_Invalid(t *testing.T) {
+	testCases := []struct {
+		typ     SetType
+		entries []string
+	}{
+		{SetTypeString, []string{"c", ""}},
+		{SetTypeIP, []string{"10.0.0.3", "10.0.0.256"}},
+		{SetTypeDomain, []string{"c.com", "*."}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.typ.String(), func(t *testing.T) {
+			s := newTestSet(t, tc.typ)
+			if err := s.Add(tc.entries, 0); !errors.Is(err, errInvalidEntry) {
+				t.Errorf("Add(%v) error = %v, want %v", tc.entries, err, errInvalidEntry)
+			}
+			if n := s.Len(); n != 0 {
+				t.Errorf("Len() = %d after a failed Add, want 0", n)
+			}
+		})
+	}
+}
+
+func TestSet_Replace(t *testing.T) {
+	s := newTestSet(t, SetTypeDomain, "a.com", "b.com")
+	if err := s.Replace([]string{"b.com", "c.com"}); err != nil {
+		t.Fatalf("Replace() error = %v", err)
+	}
+	if got, want := setValues(s), []string{"b.com", "c.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+	if err := s.Replace([]string{"d.com", ""}); !errors.Is(err, errInvalidEntry) {
+		t.Errorf("Replace() error = %v, want %v", err, errInvalidEntry)
+	}
+	if got, want := setValues(s), []string{"b.com", "c.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v after a failed Replace, want %v", got, want)
+	}
+}
+
+func TestSet_Remove(t *testing.T) {
+	testCases := []struct {
+		name    string
+		typ     SetType
+		entries []string
+		remove  []string
+		wantN   int
+		wantErr bool
+		want    []string
+	}{
+		{
+			name:    "string",
+			typ:     SetTypeString,
+			entries: []string{"a", "b", "c"},
+			remove:  []string{"a", "c", "d"},
+			wantN:   2,
+			want:    []string{"b"},
+		},
+		{
+			name:    "ip",
+			typ:     SetTypeIP,
+			entries: []string{"10.0.0.1", "10.0.0.0/8", "2001:db8::1"},
+			remove:  []string{"::ffff:10.0.0.1", "10.1.0.0/8", "10.0.0.0/16"},
+			wantN:   2,
+			want:    []string{"2001:db8::1"},
+		},
+		{
+			name:    "domain",
+			typ:     SetTypeDomain,
+			entries: []string{"example.com", "www.example.com", "a.org"},
+			remove:  []string{"*.example.com", "b.org"},
+			wantN:   1,
+			want:    []string{"a.org", "www.example.com"},
+		},
+		{
+			name:    "invalid ip",
+			typ:     SetTypeIP,
+			entries: []string{"10.0.0.1", "10.0.0.2"},
+			remove:  []string{"10.0.0.1", "10.0.0.256"},
+			wantErr: true,
+			want:    []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:    "invalid domain",
+			typ:     SetTypeDomain,
+			entries: []string{"a.com", "b.com"},
+			remove:  []string{"a.com", "."},
+			wantErr: true,
+			want:    []string{"a.com", "b.com"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSet(t, tc.typ, tc.entries...)
+			n, err := s.Remove(tc.remove)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Remove(%v) error = %v, wantErr %v", tc.remove, err, tc.wantErr)
+			}
+			if n != tc.wantN {
+				t.Errorf("Remove(%v) = %d, want %d", tc.remove, n, tc.wantN)
+			}
+			if got := setValues(s); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("List() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSet_TTL(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	type step struct {
+		at      time.Duration // Since start
+		add     string        // Added with a TTL of a minute, if not empty
+		remove  string        // Removed, if not empty
+		value   string
+		want    bool
+		wantLen int // After the step
+	}
+	testCases := []struct {
+		name  string
+		typ   SetType
+		steps []step
+	}{
+		{
+			name: "string",
+			typ:  SetTypeString,
+			steps: []step{
+				{at: 0, add: "b", value: "b", want: true, wantLen: 2},
+				{at: time.Minute, value: "b", want: true, wantLen: 2},
+				{at: time.Minute + time.Second, value: "b", want: false, wantLen: 2}, // Not purged yet
+				{at: time.Minute + time.Second, add: "c", value: "a", want: true, wantLen: 2},
+				{at: 2 * time.Minute, add: "c", value: "c", want: true, wantLen: 2}, // Renewed
+				{at: 2*time.Minute + 30*time.Second, value: "c", want: true, wantLen: 2},
+				{at: 3*time.Minute + time.Second, add: "d", value: "c", want: false, wantLen: 2},
+			},
+		},
+		{
+			name: "ip",
+			typ:  SetTypeIP,
+			steps: []step{
+				{at: 0, add: "10.0.0.0/24", value: "10.0.0.2", want: true, wantLen: 2},
+				{at: time.Minute + time.Second, value: "10.0.0.2", want: false, wantLen: 2},
+				{at: time.Minute + time.Second, remove: "10.0.0.3", value: "a", want: false, wantLen: 1},
+			},
+		},
+		{
+			name: "domain",
+			typ:  SetTypeDomain,
+			steps: []step{
+				{at: 0, add: "b.com", value: "www.b.com", want: true, wantLen: 2},
+				{at: 30 * time.Second, remove: "b.com", value: "b.com", want: false, wantLen: 1},
+				{at: 40 * time.Second, add: "b.com", value: "b.com", want: true, wantLen: 2},
+				{at: time.Minute + 10*time.Second, add: "c.com", value: "b.com", want: true, wantLen: 3}, // The first expiry is outdated
+				{at: time.Minute + 41*time.Second, add: "d.com", value: "b.com", want: false, wantLen: 3},
+			},
+		},
+	}
+	entries := map[SetType]string{SetTypeString: "a", SetTypeIP: "10.0.0.1", SetTypeDomain: "a.com"}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestSet(t, tc.typ, entries[tc.typ]) // Never expires
+			for i, st := range tc.steps {
+				now := start.Add(st.at)
+				if st.add != "" {
+					if err := s.add([]string{st.add}, time.Minute, now); err != nil {
+						t.Fatalf("step %d: add() error = %v", i, err)
+					}
+				}
+				if st.remove != "" {
+					if _, err := s.remove([]string{st.remove}, now); err != nil {
+						t.Fatalf("step %d: remove() error = %v", i, err)
+					}
+				}
+				if got := s.contains(st.value, now); got != st.want {
+					t.Errorf("step %d: contains(%q) = %v, want %v", i, st.value, got, st.want)
+				}
+				if got := s.Len(); got != st.wantLen {
+					t.Errorf("step %d: Len() = %d, want %d", i, got, st.wantLen)
+				}
+				if !s.contains(entries[tc.typ], now) {
+					t.Errorf("step %d: contains(%q) = false, want true", i, entries[tc.typ])
+				}
+			}
+			// List purges too
+			end := start.Add(time.Hour)
+			if got, want := s.list(end), []SetEntry{{Value: entries[tc.typ]}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("list() = %v, want %v", got, want)
+			}
+			if got := s.Len(); got != 1 {
+				t.Errorf("Len() = %d after list(), want 1", got)
+			}
+		})
+	}
+}
+
+func TestSet_LargeChanges(t *testing.T) {
+	// Made on a copy, swapped in
+	for _, typ := range []SetType{SetTypeString, SetTypeIP, SetTypeDomain} {
+		t.Run(typ.String(), func(t *testing.T) {
+			entries := make([]string, 3*setInPlaceEntries)
+			for i := range entries {
+				switch typ {
+				case SetTypeIP:
+					entries[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+				default:
+					entries[i] = fmt.Sprintf("d%d.com", i)
+				}
+			}
+			s := newTestSet(t, typ, entries[0])
+			if err := s.Add(entries[1:], time.Hour); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			if n := s.Len(); n != len(entries) {
+				t.Errorf("Len() = %d, want %d", n, len(entries))
+			}
+			for _, e := range []string{entries[0], entries[len(entries)-1]} {
+				if !s.Contains(e) {
+					t.Errorf("Contains(%q) = false, want true", e)
+				}
+			}
+			n, err := s.Remove(entries[:2*setInPlaceEntries])
+			if err != nil || n != 2*setInPlaceEntries {
+				t.Errorf("Remove() = %d, %v, want %d", n, err, 2*setInPlaceEntries)
+			}
+			if n := s.Len(); n != setInPlaceEntries {
+				t.Errorf("Len() = %d after Remove(), want %d", n, setInPlaceEntries)
+			}
+			if s.Contains(entries[0]) {
+				t.Errorf("Contains(%q) = true after Remove(), want false", entries[0])
+			}
+			// The expiries were copied too
+			if list := s.list(time.Now().Add(2 * time.Hour)); len(list) != 0 {
+				t.Errorf("list() after the expiry has %d entries, want 0", len(list))
+			}
+		})
+	}
+}
+
+func TestSet_ConcurrentContains(t *testing.T) {
+	// For -race: lookups while large changes are made
+	s := NewSet("test", SetTypeDomain)
+	entries := make([]string, 2*setInPlaceEntries)
+	for i := range entries {
+		entries[i] = fmt.Sprintf("d%d.com", i)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			_ = s.Add(entries, time.Minute)
+			_, _ = s.Remove(entries[:setInPlaceEntries+1])
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			s.Contains("www.d1.com")
+			s.Len()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package builtins
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	weekdayShortNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	locationCache     sync.Map // string -> *time.Location
+
+	errInvalidClock = errors.New("time must be in HH:MM format")
+)
+
+// Weekday returns the current weekday ("sun" to "sat") in the given timezone.
+// An empty timezone means local time.
+func Weekday(tz string) (string, error) {
+	loc, err := LoadLocation(tz)
+	if err != nil {
+		return "", err
+	}
+	return weekdayShortNames[time.Now().In(loc).Weekday()], nil
+}
+
+// Hour returns the current hour (0-23) in the given timezone.
+// An empty timezone means local time.
+func Hour(tz string) (int, error) {
+	loc, err := LoadLocation(tz)
+	if err != nil {
+		return 0, err
+	}
+	return time.Now().In(loc).Hour(), nil
+}
+
+// TimeBetween returns whether the current time of day in the given timezone is
+// within [start, end), both in HH:MM format. Ranges crossing midnight are supported,
+// e.g. TimeBetween("22:00", "07:00", ""), and the same start & end means the whole day.
+func TimeBetween(start, end, tz string) (bool, error) {
+	s, err := ParseClock(start)
+	if err != nil {
+		return false, err
+	}
+	e, err := ParseClock(end)
+	if err != nil {
+		return false, err
+	}
+	loc, err := LoadLocation(tz)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().In(loc)
+	return ClockInRange(now.Hour()*60+now.Minute(), s, e), nil
+}
+
+// ClockInRange returns whether minute m is within [start, end),
+// with ranges where start > end wrapping around midnight, and start == end being the whole day.
+func ClockInRange(m, start, end int) bool {
+	if start == end {
+		return true
+	}
+	if start < end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+// ParseClock parses a time of day in HH:MM format, into minutes since midnight.
+func ParseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, errInvalidClock
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// LoadLocation returns the location of an IANA timezone name, local time if it's empty.
+func LoadLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	if loc, ok := locationCache.Load(tz); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+	locationCache.Store(tz, loc)
+	return loc, nil
+}
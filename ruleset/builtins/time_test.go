@@ -0,0 +1,80 @@
+package builtins
+
+import "testing"
+
+func TestClockInRange(t *testing.T) {
+	testCases := []struct {
+		name       string
+		m          int
+		start, end string
+		want       bool
+	}{
+		{"inside", 10 * 60, "09:00", "17:00", true},
+		{"start inclusive", 9 * 60, "09:00", "17:00", true},
+		{"end exclusive", 17 * 60, "09:00", "17:00", false},
+		{"before", 8*60 + 59, "09:00", "17:00", false},
+		{"overnight evening", 23 * 60, "22:00", "07:00", true},
+		{"overnight morning", 6*60 + 59, "22:00", "07:00", true},
+		{"overnight day", 12 * 60, "22:00", "07:00", false},
+		{"whole day", 0, "08:30", "08:30", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, err := ParseClock(tc.start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end, err := ParseClock(tc.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ClockInRange(tc.m, start, end); got != tc.want {
+				t.Errorf("ClockInRange(%d, %d, %d) = %v, want %v", tc.m, start, end, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	testCases := []struct {
+		s       string
+		want    int
+		wantErr bool
+	}{
+		{"00:00", 0, false},
+		{"09:30", 9*60 + 30, false},
+		{" 23:59 ", 23*60 + 59, false},
+		{"24:00", 0, true},
+		{"9:30", 9*60 + 30, false},
+		{"09:60", 0, true},
+		{"9am", 0, true},
+		{"", 0, true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseClock(tc.s)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseClock(%q) = %d, %v, want %d, error %v", tc.s, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestTimeFunctions_Invalid(t *testing.T) {
+	if _, err := TimeBetween("25:00", "07:00", ""); err != errInvalidClock {
+		t.Errorf("TimeBetween() error = %v, want %v", err, errInvalidClock)
+	}
+	if _, err := TimeBetween("09:00", "17:00", "Mars/Olympus_Mons"); err == nil {
+		t.Error("TimeBetween() error = nil for an unknown timezone")
+	}
+	if _, err := Weekday("Nowhere"); err == nil {
+		t.Error("Weekday() error = nil for an unknown timezone")
+	}
+	if _, err := Hour("Nowhere"); err == nil {
+		t.Error("Hour() error = nil for an unknown timezone")
+	}
+	if in, err := TimeBetween("00:00", "00:00", "UTC"); err != nil || !in {
+		t.Errorf("TimeBetween() = %v, %v for the whole day", in, err)
+	}
+	if h, err := Hour("UTC"); err != nil || h < 0 || h > 23 {
+		t.Errorf("Hour() = %d, %v", h, err)
+	}
+}
@@ -0,0 +1,138 @@
+package builtins
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// DefaultTrackerMaxKeys is the default number of counters a Tracker keeps
+// before evicting the least recently used ones.
+const DefaultTrackerMaxKeys = 65536
+
+var errInvalidWindow = errors.New("window must be a positive duration")
+
+type trackerKey struct {
+	Name   string
+	Key    string
+	Window time.Duration
+}
+
+// trackerEvent is an event recorded by a stream for a rule, at most once per window.
+type trackerEvent struct {
+	Key    trackerKey
+	Rule   string
+	Stream int64
+}
+
+// trackerEntry is a sliding window counter, approximated with the
+// counts of the current and the previous fixed windows.
+type trackerEntry struct {
+	Start    time.Time // Start of the current window
+	Current  float64
+	Previous float64
+}
+
+// Tracker is a store of named, keyed event counters over sliding time windows,
+// shared by all rules to implement cross-stream thresholds (e.g. "more than 5
+// blocked connections from this IP in the last 10 minutes").
+// It is safe for concurrent use.
+type Tracker struct {
+	mutex  sync.Mutex
+	cache  *lru.Cache[trackerKey, *trackerEntry]
+	events *lru.Cache[trackerEvent, time.Time] // When streams last recorded an event
+}
+
+func NewTracker(maxKeys int) (*Tracker, error) {
+	if maxKeys <= 0 {
+		maxKeys = DefaultTrackerMaxKeys
+	}
+	cache, err := lru.New[trackerKey, *trackerEntry](maxKeys)
+	if err != nil {
+		return nil, err
+	}
+	events, err := lru.New[trackerEvent, time.Time](maxKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{cache: cache, events: events}, nil
+}
+
+// Track records an event for key in the counter name, and returns the number
+// of events (including this one) within the window.
+func (t *Tracker) Track(key, name string, window time.Duration) int {
+	return t.count(key, name, window, true, time.Now())
+}
+
+// TrackStream is like Track, but records at most one event per stream & rule within the window,
+// as a rule is evaluated again whenever the properties of a stream change.
+func (t *Tracker) TrackStream(key, name string, window time.Duration, rule string, stream int64) int {
+	return t.trackStream(key, name, window, rule, stream, time.Now())
+}
+
+func (t *Tracker) trackStream(key, name string, window time.Duration, rule string, stream int64, now time.Time) int {
+	if window <= 0 {
+		return 0
+	}
+	ev := trackerEvent{Key: trackerKey{Name: name, Key: key, Window: window}, Rule: rule, Stream: stream}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	last, ok := t.events.Get(ev)
+	add := !ok || now.Sub(last) >= window
+	if add {
+		t.events.Add(ev, now)
+	}
+	return t.countLocked(ev.Key, now, add)
+}
+
+// Count is like Track, but only returns the number of events without recording one.
+func (t *Tracker) Count(key, name string, window time.Duration) int {
+	return t.count(key, name, window, false, time.Now())
+}
+
+func (t *Tracker) count(key, name string, window time.Duration, add bool, now time.Time) int {
+	if window <= 0 {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.countLocked(trackerKey{Name: name, Key: key, Window: window}, now, add)
+}
+
+func (t *Tracker) countLocked(k trackerKey, now time.Time, add bool) int {
+	window := k.Window
+	e, ok := t.cache.Get(k)
+	if !ok {
+		if !add {
+			return 0
+		}
+		e = &trackerEntry{Start: now}
+		t.cache.Add(k, e)
+	}
+	// Advance the windows
+	if elapsed := now.Sub(e.Start); elapsed >= 2*window {
+		e.Start, e.Current, e.Previous = now, 0, 0
+	} else if elapsed >= window {
+		e.Start, e.Current, e.Previous = e.Start.Add(window), 0, e.Current
+	}
+	if add {
+		e.Current++
+	}
+	weight := 1 - float64(now.Sub(e.Start))/float64(window)
+	return int(math.Round(e.Current + e.Previous*weight))
+}
+
+// ParseWindow parses a tracker window duration, e.g. "10m".
+func ParseWindow(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errInvalidWindow
+	}
+	return d, nil
+}
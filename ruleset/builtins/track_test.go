@@ -0,0 +1,131 @@
+package builtins
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTracker(t *testing.T, maxKeys int) *Tracker {
+	tr, err := NewTracker(maxKeys)
+	if err != nil {
+		t.Fatalf("NewTracker(%d) error = %v", maxKeys, err)
+	}
+	return tr
+}
+
+func TestTracker_Window(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	type step struct {
+		at    time.Duration
+		track bool // Track, or Count
+		want  int
+	}
+	testCases := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "within the window",
+			steps: []step{
+				{0, false, 0},
+				{0, true, 1},
+				{time.Minute, true, 2},
+				{2 * time.Minute, true, 3},
+				{2 * time.Minute, false, 3},
+			},
+		},
+		{
+			name: "sliding into the next window",
+			steps: []step{
+				{0, true, 1},
+				{0, true, 2},
+				{0, true, 3},
+				{0, true, 4},
+				{10 * time.Minute, false, 4},                // Previous window, weight 1
+				{15 * time.Minute, false, 2},                // Weight 0.5
+				{15 * time.Minute, true, 3},                 // 1 + 4 * 0.5
+				{20 * time.Minute, false, 1},                // Next window, the event of the last one with weight 1
+				{27*time.Minute + 30*time.Second, false, 0}, // 1 * 0.25, rounded
+			},
+		},
+		{
+			name: "idle for two windows",
+			steps: []step{
+				{0, true, 1},
+				{0, true, 2},
+				{20 * time.Minute, false, 0},
+				{20 * time.Minute, true, 1},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newTestTracker(t, 0)
+			for i, s := range tc.steps {
+				if got := tr.count("10.0.0.1", "hits", 10*time.Minute, s.track, start.Add(s.at)); got != s.want {
+					t.Fatalf("step %d: count(%v) = %d, want %d", i, s.track, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTracker_Keys(t *testing.T) {
+	tr := newTestTracker(t, 0)
+	tr.Track("10.0.0.1", "hits", time.Minute)
+	tr.Track("10.0.0.1", "hits", time.Minute)
+	testCases := []struct {
+		key, name string
+		window    time.Duration
+		want      int
+	}{
+		{"10.0.0.1", "hits", time.Minute, 2},
+		{"10.0.0.2", "hits", time.Minute, 0},
+		{"10.0.0.1", "misses", time.Minute, 0},
+		{"10.0.0.1", "hits", time.Hour, 0}, // A window of its own
+		{"10.0.0.1", "hits", 0, 0},
+	}
+	for _, tc := range testCases {
+		if got := tr.Count(tc.key, tc.name, tc.window); got != tc.want {
+			t.Errorf("Count(%q, %q, %s) = %d, want %d", tc.key, tc.name, tc.window, got, tc.want)
+		}
+	}
+}
+
+func TestTracker_Eviction(t *testing.T) {
+	tr := newTestTracker(t, 2)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		// a is the most recently used when c is added, so b is evicted
+		tr.Track(key, "hits", time.Minute)
+	}
+	want := map[string]int{"a": 2, "b": 0, "c": 1}
+	for key, n := range want {
+		if got := tr.Count(key, "hits", time.Minute); got != n {
+			t.Errorf("Count(%q) = %d, want %d", key, got, n)
+		}
+	}
+}
+
+func TestTracker_TrackStream(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tr := newTestTracker(t, 0)
+	testCases := []struct {
+		at     time.Duration
+		rule   string
+		stream int64
+		want   int
+	}{
+		{0, "r1", 1, 1},
+		{0, "r1", 1, 1}, // Evaluated again for the same stream
+		{time.Minute, "r1", 1, 1},
+		{time.Minute, "r1", 2, 2},
+		{time.Minute, "r2", 1, 3}, // Another rule counting the same
+		{time.Minute, "r2", 1, 3},
+		{11 * time.Minute, "r1", 1, 4}, // Recorded again after a window, 1 + 3 * 0.9
+	}
+	for i, tc := range testCases {
+		if got := tr.trackStream("10.0.0.1", "hits", 10*time.Minute, tc.rule, tc.stream, start.Add(tc.at)); got != tc.want {
+			t.Fatalf("step %d: trackStream(%s, %d) = %d, want %d", i, tc.rule, tc.stream, got, tc.want)
+		}
+	}
+}
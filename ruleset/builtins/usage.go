@@ -0,0 +1,276 @@
+package builtins
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUsageRetention is the default number of days a Usage keeps the counters of.
+const DefaultUsageRetention = 62
+
+// UsageRulePrefix is the prefix of the labels of the counters of per-client quota rules,
+// which aren't part of the traffic of the clients.
+const UsageRulePrefix = "rule:"
+
+const usageDayFormat = "2006-01-02"
+
+var errInvalidPeriod = errors.New("period must be day, week or month")
+
+// UsagePeriod is a calendar period usage is summed over, in local time.
+type UsagePeriod int
+
+const (
+	UsagePeriodDay UsagePeriod = iota
+	UsagePeriodWeek
+	UsagePeriodMonth
+)
+
+func (p UsagePeriod) String() string {
+	switch p {
+	case UsagePeriodDay:
+		return "day"
+	case UsagePeriodWeek:
+		return "week"
+	case UsagePeriodMonth:
+		return "month"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseUsagePeriod parses a usage period name: day, week (starting on Monday) or month.
+func ParseUsagePeriod(s string) (UsagePeriod, error) {
+	switch strings.ToLower(s) {
+	case "day":
+		return UsagePeriodDay, nil
+	case "week":
+		return UsagePeriodWeek, nil
+	case "month":
+		return UsagePeriodMonth, nil
+	default:
+		return 0, errInvalidPeriod
+	}
+}
+
+// start returns the first day of the period that contains the day.
+func (p UsagePeriod) start(day time.Time) time.Time {
+	switch p {
+	case UsagePeriodWeek:
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case UsagePeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+// usageDay is a day in local time, as the midnight UTC of its date, so that days are
+// 24 hours apart whatever the DST changes.
+func usageDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Usage is a store of byte counters per client (IP) and label (an application, or a quota rule),
+// kept per day to sum them over calendar periods, for accounting & quotas.
+// It can be saved & loaded, to keep the counters across restarts.
+// It is safe for concurrent use.
+type Usage struct {
+	retention int // Days
+
+	mutex   sync.Mutex
+	clients map[string]map[string]map[time.Time]uint64 // Client -> label -> day -> bytes
+	dirty   bool
+}
+
+// NewUsage creates a Usage keeping the counters of the latest retention days (including today).
+func NewUsage(retention int) *Usage {
+	if retention <= 0 {
+		retention = DefaultUsageRetention
+	}
+	return &Usage{
+		retention: retention,
+		clients:   make(map[string]map[string]map[time.Time]uint64),
+	}
+}
+
+// Add counts bytes for the label of a client.
+func (u *Usage) Add(client, label string, bytes uint64, now time.Time) {
+	if bytes == 0 {
+		return
+	}
+	day := usageDay(now)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	labels := u.clients[client]
+	if labels == nil {
+		labels = make(map[string]map[time.Time]uint64)
+		u.clients[client] = labels
+	}
+	days := labels[label]
+	if days == nil {
+		days = make(map[time.Time]uint64)
+		labels[label] = days
+	}
+	days[day] += bytes
+	u.dirty = true
+}
+
+// Used returns the bytes counted for the label of a client within the period that contains now.
+func (u *Usage) Used(client, label string, period UsagePeriod, now time.Time) uint64 {
+	day := usageDay(now)
+	start := period.start(day)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return sumDays(u.clients[client][label], start, day)
+}
+
+// Total returns the bytes counted for all the labels of a client (other than quota rules')
+// within the period that contains now.
+func (u *Usage) Total(client string, period UsagePeriod, now time.Time) uint64 {
+	day := usageDay(now)
+	start := period.start(day)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	var n uint64
+	for label, days := range u.clients[client] {
+		if !strings.HasPrefix(label, UsageRulePrefix) {
+			n += sumDays(days, start, day)
+		}
+	}
+	return n
+}
+
+func sumDays(days map[time.Time]uint64, start, end time.Time) uint64 {
+	var n uint64
+	for day, bytes := range days {
+		if !day.Before(start) && !day.After(end) {
+			n += bytes
+		}
+	}
+	return n
+}
+
+// UsageEntry is the usage of a label of a client over a period.
+type UsageEntry struct {
+	Client string `json:"client"`
+	Label  string `json:"label"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// Report returns the usage of every label of a client (or of every client if client is empty)
+// within the period that contains now, sorted by client & label.
+func (u *Usage) Report(client string, period UsagePeriod, now time.Time) []UsageEntry {
+	day := usageDay(now)
+	start := period.start(day)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	entries := []UsageEntry{}
+	for c, labels := range u.clients {
+		if client != "" && c != client {
+			continue
+		}
+		for label, days := range labels {
+			if n := sumDays(days, start, day); n > 0 {
+				entries = append(entries, UsageEntry{Client: c, Label: label, Bytes: n})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Client != entries[j].Client {
+			return entries[i].Client < entries[j].Client
+		}
+		return entries[i].Label < entries[j].Label
+	})
+	return entries
+}
+
+// Expire removes the counters of the days older than the retention.
+func (u *Usage) Expire(now time.Time) {
+	cutoff := usageDay(now).AddDate(0, 0, 1-u.retention)
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for client, labels := range u.clients {
+		for label, days := range labels {
+			for day := range days {
+				if day.Before(cutoff) {
+					delete(days, day)
+					u.dirty = true
+				}
+			}
+			if len(days) == 0 {
+				delete(labels, label)
+			}
+		}
+		if len(labels) == 0 {
+			delete(u.clients, client)
+		}
+	}
+}
+
+// Dirty returns whether the counters have changed since the latest Save.
+func (u *Usage) Dirty() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.dirty
+}
+
+// usageFile is the format of saved counters: client -> label -> day (YYYY-MM-DD) -> bytes.
+type usageFile map[string]map[string]map[string]uint64
+
+// Save writes the counters as JSON.
+func (u *Usage) Save(w io.Writer) error {
+	u.mutex.Lock()
+	f := make(usageFile, len(u.clients))
+	for client, labels := range u.clients {
+		fl := make(map[string]map[string]uint64, len(labels))
+		for label, days := range labels {
+			fd := make(map[string]uint64, len(days))
+			for day, bytes := range days {
+				fd[day.Format(usageDayFormat)] = bytes
+			}
+			fl[label] = fd
+		}
+		f[client] = fl
+	}
+	u.dirty = false
+	u.mutex.Unlock()
+	return json.NewEncoder(w).Encode(f)
+}
+
+// Load adds the counters saved by Save to the current ones.
+func (u *Usage) Load(r io.Reader) error {
+	var f usageFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return err
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for client, fl := range f {
+		labels := u.clients[client]
+		if labels == nil {
+			labels = make(map[string]map[time.Time]uint64)
+			u.clients[client] = labels
+		}
+		for label, fd := range fl {
+			days := labels[label]
+			if days == nil {
+				days = make(map[time.Time]uint64)
+				labels[label] = days
+			}
+			for s, bytes := range fd {
+				day, err := time.Parse(usageDayFormat, s)
+				if err != nil {
+					return err
+				}
+				days[day] += bytes
+			}
+		}
+	}
+	return nil
+}
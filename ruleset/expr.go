@@ -2,15 +2,18 @@ package ruleset
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/expr-lang/expr"
 	"github.com/expr-lang/expr/ast"
 	"github.com/expr-lang/expr/conf"
 	"github.com/expr-lang/expr/vm"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"gopkg.in/yaml.v3"
 
 	"github.com/apernet/OpenGFW/analyzer"
@@ -19,13 +22,36 @@ import (
 	"github.com/apernet/OpenGFW/ruleset/builtins/geo"
 )
 
+const (
+	// maxMark is the maximum mark of the mark action, the same as io.MaxMark.
+	maxMark = 0xFFFE
+
+	// nat64LearnedStreams is the number of streams whose DNS message NAT64 learned from is remembered.
+	nat64LearnedStreams = 16384
+)
+
 // ExprRule is the external representation of an expression rule.
 type ExprRule struct {
-	Name     string        `yaml:"name"`
-	Action   string        `yaml:"action"`
-	Log      bool          `yaml:"log"`
-	Modifier ModifierEntry `yaml:"modifier"`
-	Expr     string        `yaml:"expr"`
+	Name       string         `yaml:"name"`
+	Group      string         `yaml:"group"` // empty = main group, evaluated for every stream
+	Action     string         `yaml:"action"`
+	Jump       string         `yaml:"jump"` // group to evaluate, for the jump action
+	Log        bool           `yaml:"log"`
+	LogLevel   string         `yaml:"logLevel"`  // debug, info (default), warn or error
+	LogProps   *bool          `yaml:"logProps"`  // whether to log analyzer properties, default true
+	LogSample  float64        `yaml:"logSample"` // fraction of matches to log, 0 = all
+	Notify     bool           `yaml:"notify"`    // send matches to the webhook
+	Modifier   ModifierEntry  `yaml:"modifier"`
+	RateLimit  RateLimitEntry `yaml:"ratelimit"`
+	Class      string         `yaml:"class"`
+	Mark       uint32         `yaml:"mark"` // for the mark action, 1 to 65534, the packets get the fwmark mark << 16
+	Tarpit     TarpitEntry    `yaml:"tarpit"`
+	Quota      QuotaEntry     `yaml:"quota"`
+	Schedule   *ScheduleEntry `yaml:"schedule"`
+	ActiveFrom *time.Time     `yaml:"activeFrom"` // not evaluated before this time
+	Expires    *time.Time     `yaml:"expires"`    // not evaluated from this time on
+	Enforce    *bool          `yaml:"enforce"`    // false = dry run, only log the would-be action
+	Expr       string         `yaml:"expr"`
 }
 
 type ModifierEntry struct {
@@ -38,36 +64,135 @@ func ExprRulesFromYAML(file string) ([]ExprRule, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ExprRulesFromYAMLBytes(bs)
+}
+
+func ExprRulesFromYAMLBytes(bs []byte) ([]ExprRule, error) {
 	var rules []ExprRule
-	err = yaml.Unmarshal(bs, &rules)
+	err := yaml.Unmarshal(bs, &rules)
 	return rules, err
 }
 
+// ExprRulesFromURL fetches expression rules from a remote URL.
+// It also returns the digest of the fetched content, which can be used
+// to skip recompiling when the rules haven't changed.
+func ExprRulesFromURL(url string, config RemoteConfig) ([]ExprRule, [32]byte, error) {
+	bs, digest, err := FetchRemote(url, config)
+	if err != nil {
+		return nil, digest, err
+	}
+	rules, err := ExprRulesFromYAMLBytes(bs)
+	return rules, digest, err
+}
+
 // compiledExprRule is the internal, compiled representation of an expression rule.
 type compiledExprRule struct {
 	Name        string
 	Action      *Action // fallthrough if nil
+	Jump        string  // evaluate this group if matched, fallthrough if it doesn't match either
+	Return      bool    // stop evaluating the current group if matched
+	DryRun      bool    // fallthrough after reporting the action
 	Log         bool
+	LogLevel    LogLevel
+	LogProps    bool
+	LogSample   float64 // log all if 0
+	Notify      bool
 	ModInstance modifier.Instance
+	RateLimiter *RateLimiter
+	Mark        uint32
+	Tarpit      *TarpitEntry
+	Quota       *Quota
+	Schedule    *schedule // always active if nil
+	ActiveFrom  time.Time // zero if unset
+	Expires     time.Time // zero if unset
 	Program     *vm.Program
+	Stats       *RuleStats
+}
+
+// active returns whether the rule is within its lifetime and schedule.
+func (r *compiledExprRule) active(now time.Time) bool {
+	if !r.ActiveFrom.IsZero() && now.Before(r.ActiveFrom) {
+		return false
+	}
+	if r.expired(now) {
+		return false
+	}
+	return r.Schedule == nil || r.Schedule.Active(now)
+}
+
+func (r *compiledExprRule) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
 }
 
 var _ Ruleset = (*exprRuleset)(nil)
 
 type exprRuleset struct {
-	Rules      []compiledExprRule
+	Rules      []compiledExprRule            // All rules, in their original order
+	Groups     map[string][]compiledExprRule // Rules by group
 	Ans        []analyzer.Analyzer
 	Logger     Logger
+	Notifier   Notifier
 	GeoMatcher *geo.GeoMatcher
+	Workloads  WorkloadResolver
+	Containers ContainerResolver
+	Processes  ProcessResolver
+	NAT64      *builtins.NAT64
+	NAT64DNS   *lru.Cache[int64, analyzer.PropMap] // dns properties NAT64 last learned from, by stream ID
+	Apps       *builtins.AppClassifier             // Only if a rule uses app
 }
 
 func (r *exprRuleset) Analyzers(info StreamInfo) []analyzer.Analyzer {
 	return r.Ans
 }
 
-func (r *exprRuleset) Match(info StreamInfo) MatchResult {
-	env := streamInfoToExprEnv(info)
+func (r *exprRuleset) Stats() []RuleStatsSnapshot {
+	now := time.Now()
+	stats := make([]RuleStatsSnapshot, 0, len(r.Rules))
 	for _, rule := range r.Rules {
+		ss := rule.Stats.snapshot(rule.Name)
+		ss.Expired = rule.expired(now)
+		stats = append(stats, ss)
+	}
+	return stats
+}
+
+func (r *exprRuleset) Match(info StreamInfo) MatchResult {
+	now := time.Now()
+	if r.NAT64 != nil {
+		// For the streams to the addresses DNS64 answers synthesize
+		r.learnNAT64(info)
+	}
+	env := r.exprEnv(info, now)
+	if result, ok := r.matchGroup(r.Groups[""], info, env, now); ok {
+		return result
+	}
+	// No match
+	return MatchResult{
+		Action: ActionMaybe,
+	}
+}
+
+// learnNAT64 has NAT64 learn from the DNS message of a stream, unless it already has.
+// The dns analyzer replaces its properties with each message, so a new message is a different map.
+func (r *exprRuleset) learnNAT64(info StreamInfo) {
+	m := info.Props["dns"]
+	if m == nil {
+		return
+	}
+	if prev, ok := r.NAT64DNS.Get(info.ID); ok && reflect.ValueOf(prev).Pointer() == reflect.ValueOf(m).Pointer() {
+		return
+	}
+	r.NAT64DNS.Add(info.ID, m)
+	r.NAT64.LearnDNS(m)
+}
+
+// matchGroup evaluates the rules of a group in order, and returns the result of the
+// first rule with an action that matches, or false if none does or a return rule matches first.
+func (r *exprRuleset) matchGroup(rules []compiledExprRule, info StreamInfo, env map[string]interface{}, now time.Time) (MatchResult, bool) {
+	for _, rule := range rules {
+		if !rule.active(now) {
+			continue
+		}
 		v, err := vm.Run(rule.Program, env)
 		if err != nil {
 			// Log the error and continue to the next rule.
@@ -75,123 +200,407 @@ func (r *exprRuleset) Match(info StreamInfo) MatchResult {
 			continue
 		}
 		if vBool, ok := v.(bool); ok && vBool {
-			if rule.Log {
-				r.Logger.Log(info, rule.Name)
+			if rule.Log && (rule.LogSample == 0 || rand.Float64() < rule.LogSample) {
+				logInfo := info
+				if !rule.LogProps {
+					logInfo.Props = nil
+				}
+				r.Logger.Log(rule.LogLevel, logInfo, rule.Name)
 			}
-			if rule.Action != nil {
+			if rule.Notify {
+				r.Notifier.Notify(newNotifyEvent(&rule, info, now))
+			}
+			switch {
+			case rule.Jump != "":
+				if result, ok := r.matchGroup(r.Groups[rule.Jump], info, env, now); ok {
+					return result, true
+				}
+			case rule.Return:
+				return MatchResult{}, false
+			case rule.Action != nil && rule.DryRun:
+				r.Logger.DryRun(info, rule.Name, *rule.Action)
+			case rule.Action != nil:
 				return MatchResult{
 					Action:      *rule.Action,
+					RuleName:    rule.Name,
 					ModInstance: rule.ModInstance,
-				}
+					RateLimiter: rule.RateLimiter,
+					Mark:        rule.Mark,
+					Tarpit:      rule.Tarpit,
+					Quota:       rule.Quota,
+					Stats:       rule.Stats,
+				}, true
 			}
 		}
 	}
-	// No match
-	return MatchResult{
-		Action: ActionMaybe,
-	}
+	return MatchResult{}, false
 }
 
 // CompileExprRules compiles a list of expression rules into a ruleset.
 // It returns an error if any of the rules are invalid, or if any of the analyzers
 // used by the rules are unknown (not provided in the analyzer list).
 func CompileExprRules(rules []ExprRule, ans []analyzer.Analyzer, mods []modifier.Modifier, config *BuiltinConfig) (Ruleset, error) {
-	var compiledRules []compiledExprRule
-	fullAnMap := analyzersToMap(ans)
-	fullModMap := modifiersToMap(mods)
-	depAnMap := make(map[string]analyzer.Analyzer)
-	geoMatcher, err := geo.NewGeoMatcher(config.GeoSiteFilename, config.GeoIpFilename)
+	c, err := newExprRuleCompiler(ans, mods, config)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.compileUserFunctions(config.Functions); err != nil {
+		return nil, err
+	}
+	if _, err := checkRuleGroups(rules); err != nil {
+		return nil, err
+	}
+	var compiledRules []compiledExprRule
+	groups := make(map[string][]compiledExprRule)
+	depAnMap := make(map[string]analyzer.Analyzer)
 	// Compile all rules and build a map of analyzers that are used by the rules.
 	for _, rule := range rules {
-		if rule.Action == "" && !rule.Log {
-			return nil, fmt.Errorf("rule %q must have at least one of action or log", rule.Name)
-		}
-		var action *Action
-		if rule.Action != "" {
-			a, ok := actionStringToAction(rule.Action)
-			if !ok {
-				return nil, fmt.Errorf("rule %q has invalid action %q", rule.Name, rule.Action)
-			}
-			action = &a
-		}
-		visitor := &idVisitor{Variables: make(map[string]bool), Identifiers: make(map[string]bool)}
-		patcher := &idPatcher{}
-		program, err := expr.Compile(rule.Expr,
-			func(c *conf.Config) {
-				c.Strict = false
-				c.Expect = reflect.Bool
-				c.Visitors = append(c.Visitors, visitor, patcher)
-				registerBuiltinFunctions(c.Functions, geoMatcher)
-			},
-		)
+		cr, deps, err := c.Compile(rule)
 		if err != nil {
-			return nil, fmt.Errorf("rule %q has invalid expression: %w", rule.Name, err)
+			return nil, err
 		}
-		if patcher.Err != nil {
-			return nil, fmt.Errorf("rule %q failed to patch expression: %w", rule.Name, patcher.Err)
+		for _, a := range deps {
+			depAnMap[a.Name()] = a
 		}
-		for name := range visitor.Identifiers {
-			// Skip built-in analyzers & user-defined variables
-			if isBuiltInAnalyzer(name) || visitor.Variables[name] {
-				continue
-			}
-			// Check if it's one of the built-in functions, and if so,
-			// skip it as an analyzer & do initialization if necessary.
-			switch name {
-			case "geoip":
-				if err := geoMatcher.LoadGeoIP(); err != nil {
-					return nil, fmt.Errorf("rule %q failed to load geoip: %w", rule.Name, err)
-				}
-			case "geosite":
-				if err := geoMatcher.LoadGeoSite(); err != nil {
-					return nil, fmt.Errorf("rule %q failed to load geosite: %w", rule.Name, err)
-				}
-			case "cidr":
-				// No initialization needed for CIDR.
-			default:
-				a, ok := fullAnMap[name]
-				if !ok {
-					return nil, fmt.Errorf("rule %q uses unknown analyzer %q", rule.Name, name)
-				}
-				depAnMap[name] = a
-			}
+		compiledRules = append(compiledRules, *cr)
+		groups[rule.Group] = append(groups[rule.Group], *cr)
+	}
+	if config.NAT64 != nil {
+		// For the domains of the addresses synthesized by DNS64
+		if a, ok := c.fullAnMap["dns"]; ok {
+			depAnMap[a.Name()] = a
 		}
-		cr := compiledExprRule{
-			Name:    rule.Name,
-			Action:  action,
-			Log:     rule.Log,
-			Program: program,
+	}
+	if config.AppsAnalyzers {
+		deps, err := c.loadApps()
+		if err != nil {
+			return nil, err
 		}
-		if action != nil && *action == ActionModify {
-			mod, ok := fullModMap[rule.Modifier.Name]
-			if !ok {
-				return nil, fmt.Errorf("rule %q uses unknown modifier %q", rule.Name, rule.Modifier.Name)
-			}
-			modInst, err := mod.New(rule.Modifier.Args)
-			if err != nil {
-				return nil, fmt.Errorf("rule %q failed to create modifier instance: %w", rule.Name, err)
-			}
-			cr.ModInstance = modInst
+		for _, a := range deps {
+			depAnMap[a.Name()] = a
 		}
-		compiledRules = append(compiledRules, cr)
 	}
 	// Convert the analyzer map to a list.
 	var depAns []analyzer.Analyzer
 	for _, a := range depAnMap {
 		depAns = append(depAns, a)
 	}
-	return &exprRuleset{
+	rs := &exprRuleset{
 		Rules:      compiledRules,
+		Groups:     groups,
 		Ans:        depAns,
 		Logger:     config.Logger,
-		GeoMatcher: geoMatcher,
+		Notifier:   config.Notifier,
+		GeoMatcher: c.geoMatcher,
+		Workloads:  config.Workloads,
+		Containers: config.Containers,
+		Processes:  config.Processes,
+		NAT64:      config.NAT64,
+		Apps:       c.apps,
+	}
+	if config.NAT64 != nil {
+		rs.NAT64DNS, _ = lru.New[int64, analyzer.PropMap](nat64LearnedStreams)
+	}
+	return rs, nil
+}
+
+// unknownAnalyzerError is returned when a rule uses an analyzer that is not in the analyzer list.
+type unknownAnalyzerError struct {
+	Rule     string
+	Analyzer string
+}
+
+func (e *unknownAnalyzerError) Error() string {
+	return fmt.Sprintf("rule %q uses unknown analyzer %q", e.Rule, e.Analyzer)
+}
+
+// exprRuleCompiler compiles expression rules one by one,
+// sharing the built-in function state between them.
+type exprRuleCompiler struct {
+	config     *BuiltinConfig
+	fullAnMap  map[string]analyzer.Analyzer
+	fullModMap map[string]modifier.Modifier
+	geoMatcher *geo.GeoMatcher
+	tracker    *builtins.Tracker
+	usage      *builtins.Usage
+	userFuncs  map[string]*userFunction
+	noGeoLoad  bool                    // Don't load geo databases, for when the rules won't be run
+	apps       *builtins.AppClassifier // Loaded by the first rule using app
+}
+
+func newExprRuleCompiler(ans []analyzer.Analyzer, mods []modifier.Modifier, config *BuiltinConfig) (*exprRuleCompiler, error) {
+	geoMatcher, err := geo.NewGeoMatcher(config.GeoSiteFilename, config.GeoIpFilename)
+	if err != nil {
+		return nil, err
+	}
+	tracker := config.Tracker
+	if tracker == nil {
+		tracker, err = builtins.NewTracker(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	usage := config.Usage
+	if usage == nil {
+		usage = builtins.NewUsage(0)
+	}
+	return &exprRuleCompiler{
+		config:     config,
+		fullAnMap:  analyzersToMap(ans),
+		fullModMap: modifiersToMap(mods),
+		geoMatcher: geoMatcher,
+		tracker:    tracker,
+		usage:      usage,
+		userFuncs:  make(map[string]*userFunction),
 	}, nil
 }
 
-func registerBuiltinFunctions(funcMap map[string]*ast.Function, geoMatcher *geo.GeoMatcher) {
+// registerFunctions registers both built-in and user-defined functions.
+func (rc *exprRuleCompiler) registerFunctions(funcMap map[string]*ast.Function) {
+	registerBuiltinFunctions(funcMap, rc.geoMatcher, rc.tracker, rc.usage, rc.config.Sets)
+	for name, f := range rc.userFuncs {
+		funcMap[name] = f.ExprFunction()
+	}
+}
+
+func (rc *exprRuleCompiler) isBuiltinFunction(name string) bool {
+	switch name {
+	case "geoip", "geosite", "cidr", "weekday", "hour", "time_between", "track", "tracked", "usage", "in_set",
+		"base64_decode", "hex_decode", "url_decode", "punycode_decode", "md5", "sha256", "entropy":
+		return true
+	default:
+		return false
+	}
+}
+
+// loadBuiltinFunction does the initialization a built-in function needs, if any.
+func (rc *exprRuleCompiler) loadBuiltinFunction(name string) error {
+	if rc.noGeoLoad {
+		return nil
+	}
+	switch name {
+	case "geoip":
+		if err := rc.geoMatcher.LoadGeoIP(); err != nil {
+			return fmt.Errorf("failed to load geoip: %w", err)
+		}
+	case "geosite":
+		if err := rc.geoMatcher.LoadGeoSite(); err != nil {
+			return fmt.Errorf("failed to load geosite: %w", err)
+		}
+	}
+	return nil
+}
+
+// loadApps loads the app classifier if it isn't yet, and returns the analyzers it uses
+// among those available.
+func (rc *exprRuleCompiler) loadApps() ([]analyzer.Analyzer, error) {
+	if rc.apps == nil {
+		apps, err := builtins.NewAppClassifier(rc.config.AppsFilename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load apps: %w", err)
+		}
+		rc.apps = apps
+	}
+	var deps []analyzer.Analyzer
+	for _, name := range rc.apps.Analyzers() {
+		if a, ok := rc.fullAnMap[name]; ok {
+			deps = append(deps, a)
+		}
+	}
+	return deps, nil
+}
+
+// Compile compiles a single rule, and returns it along with the analyzers it uses.
+func (rc *exprRuleCompiler) Compile(rule ExprRule) (*compiledExprRule, []analyzer.Analyzer, error) {
+	config := rc.config
+	if rule.Action == "" && !rule.Log && !rule.Notify {
+		return nil, nil, fmt.Errorf("rule %q must have at least one of action, log or notify", rule.Name)
+	}
+	if rule.Notify && config.Notifier == nil {
+		return nil, nil, fmt.Errorf("rule %q uses notify, but no webhook is configured", rule.Name)
+	}
+	var action *Action
+	var jump string
+	var ret bool
+	switch strings.ToLower(rule.Action) {
+	case "":
+	case "jump":
+		if rule.Jump == "" {
+			return nil, nil, fmt.Errorf("rule %q must set the group to jump to", rule.Name)
+		}
+		jump = rule.Jump
+	case "return":
+		ret = true
+	default:
+		a, ok := actionStringToAction(rule.Action)
+		if !ok {
+			return nil, nil, fmt.Errorf("rule %q has invalid action %q", rule.Name, rule.Action)
+		}
+		action = &a
+	}
+	if rule.Jump != "" && jump == "" {
+		return nil, nil, fmt.Errorf("rule %q sets a jump group, but its action is not jump", rule.Name)
+	}
+	var deps []analyzer.Analyzer
+	visitor := &idVisitor{Variables: make(map[string]bool), Identifiers: make(map[string]bool)}
+	patcher := &idPatcher{Sets: config.Sets, Rule: rule.Name}
+	program, err := expr.Compile(rule.Expr,
+		func(c *conf.Config) {
+			c.Strict = false
+			c.Expect = reflect.Bool
+			c.Visitors = append(c.Visitors, visitor, patcher)
+			rc.registerFunctions(c.Functions)
+		},
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("rule %q has invalid expression: %w", rule.Name, err)
+	}
+	if patcher.Err != nil {
+		return nil, nil, fmt.Errorf("rule %q failed to patch expression: %w", rule.Name, patcher.Err)
+	}
+	for name := range visitor.Identifiers {
+		// Skip built-in analyzers & user-defined variables
+		if name == "k8s" && config.Workloads == nil {
+			return nil, nil, fmt.Errorf("rule %q uses k8s, but kubernetes is not configured", rule.Name)
+		}
+		if name == "container" && config.Containers == nil {
+			return nil, nil, fmt.Errorf("rule %q uses container, but docker is not configured", rule.Name)
+		}
+		if name == "process" && config.Processes == nil {
+			return nil, nil, fmt.Errorf("rule %q uses process, but local mode is not enabled", rule.Name)
+		}
+		if name == "nat64" && config.NAT64 == nil {
+			return nil, nil, fmt.Errorf("rule %q uses nat64, but nat64 is not configured", rule.Name)
+		}
+		if name == "app" || name == "app_confidence" {
+			appDeps, err := rc.loadApps()
+			if err != nil {
+				return nil, nil, fmt.Errorf("rule %q %w", rule.Name, err)
+			}
+			deps = append(deps, appDeps...)
+		}
+		if isBuiltInAnalyzer(name) || visitor.Variables[name] {
+			continue
+		}
+		// Check if it's one of the built-in or user-defined functions, and if so,
+		// skip it as an analyzer & do initialization if necessary.
+		switch {
+		case rc.isBuiltinFunction(name):
+			if err := rc.loadBuiltinFunction(name); err != nil {
+				return nil, nil, fmt.Errorf("rule %q %w", rule.Name, err)
+			}
+		case rc.userFuncs[name] != nil:
+			// Initialized when the function was compiled.
+		default:
+			a, ok := rc.fullAnMap[name]
+			if !ok {
+				return nil, nil, &unknownAnalyzerError{Rule: rule.Name, Analyzer: name}
+			}
+			deps = append(deps, a)
+		}
+	}
+	logLevel, ok := logLevelStringToLogLevel(rule.LogLevel)
+	if !ok {
+		return nil, nil, fmt.Errorf("rule %q has invalid log level %q", rule.Name, rule.LogLevel)
+	}
+	if rule.LogSample < 0 || rule.LogSample > 1 {
+		return nil, nil, fmt.Errorf("rule %q has invalid log sample rate %v", rule.Name, rule.LogSample)
+	}
+	cr := compiledExprRule{
+		Name:      rule.Name,
+		Action:    action,
+		Jump:      jump,
+		Return:    ret,
+		DryRun:    rule.Enforce != nil && !*rule.Enforce,
+		Log:       rule.Log,
+		LogLevel:  logLevel,
+		LogProps:  rule.LogProps == nil || *rule.LogProps,
+		LogSample: rule.LogSample,
+		Notify:    rule.Notify,
+		Program:   program,
+		Stats:     &RuleStats{},
+	}
+	if action != nil && *action == ActionModify {
+		mod, ok := rc.fullModMap[rule.Modifier.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("rule %q uses unknown modifier %q", rule.Name, rule.Modifier.Name)
+		}
+		modInst, err := mod.New(rule.Modifier.Args)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %q failed to create modifier instance: %w", rule.Name, err)
+		}
+		cr.ModInstance = modInst
+	}
+	if action != nil && *action == ActionRateLimit {
+		rl, err := newRateLimiter(rule.RateLimit)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %q has invalid rate limit: %w", rule.Name, err)
+		}
+		cr.RateLimiter = rl
+	}
+	if action != nil && *action == ActionShape {
+		mark, ok := config.ShapingClasses[rule.Class]
+		if !ok {
+			return nil, nil, fmt.Errorf("rule %q uses unknown shaping class %q", rule.Name, rule.Class)
+		}
+		cr.Mark = mark
+	}
+	if action != nil && *action == ActionMark {
+		if rule.Mark == 0 || rule.Mark > maxMark {
+			return nil, nil, fmt.Errorf("rule %q has invalid mark %d, must be between 1 and %d, as it is shifted to the upper 16 bits of the packet mark",
+				rule.Name, rule.Mark, maxMark)
+		}
+		cr.Mark = rule.Mark
+	}
+	if rule.Schedule != nil {
+		sched, err := compileSchedule(*rule.Schedule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %q has invalid schedule: %w", rule.Name, err)
+		}
+		cr.Schedule = sched
+	}
+	if rule.ActiveFrom != nil {
+		cr.ActiveFrom = *rule.ActiveFrom
+	}
+	if rule.Expires != nil {
+		if rule.ActiveFrom != nil && !rule.Expires.After(*rule.ActiveFrom) {
+			return nil, nil, fmt.Errorf("rule %q expires before it becomes active", rule.Name)
+		}
+		cr.Expires = *rule.Expires
+	}
+	if action != nil && *action == ActionTarpit {
+		if rule.Tarpit.Delay <= 0 && rule.Tarpit.Window == 0 {
+			return nil, nil, fmt.Errorf("rule %q must set at least one of tarpit delay or window", rule.Name)
+		}
+		tarpit := rule.Tarpit
+		cr.Tarpit = &tarpit
+	}
+	if action != nil && *action == ActionQuota {
+		q, err := newQuota(rule.Name, rule.Quota, rule.RateLimit, rc.usage)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %q has invalid quota: %w", rule.Name, err)
+		}
+		cr.Quota = q
+	}
+	if action != nil && *action == ActionCapture && !config.CaptureEnabled {
+		return nil, nil, fmt.Errorf("rule %q uses capture, but capture is not configured", rule.Name)
+	}
+	if action != nil && *action == ActionMirror && !config.MirrorEnabled {
+		return nil, nil, fmt.Errorf("rule %q uses mirror, but mirror is not configured", rule.Name)
+	}
+	if action != nil && *action == ActionDivert && !config.DivertEnabled {
+		return nil, nil, fmt.Errorf("rule %q uses divert, but divert is not configured", rule.Name)
+	}
+	if action != nil && *action == ActionCaptureHTTP && !config.CaptureHTTPEnabled {
+		return nil, nil, fmt.Errorf("rule %q uses capture-http, but har is not configured", rule.Name)
+	}
+	if action != nil && *action == ActionHoneypot && !config.HoneypotEnabled {
+		return nil, nil, fmt.Errorf("rule %q uses honeypot, but honeypot is not configured", rule.Name)
+	}
+	return &cr, deps, nil
+}
+
+func registerBuiltinFunctions(funcMap map[string]*ast.Function, geoMatcher *geo.GeoMatcher, tracker *builtins.Tracker, usage *builtins.Usage, sets *builtins.SetStore) {
 	funcMap["geoip"] = &ast.Function{
 		Name: "geoip",
 		Func: func(params ...any) (any, error) {
@@ -213,12 +622,173 @@ func registerBuiltinFunctions(funcMap map[string]*ast.Function, geoMatcher *geo.
 		},
 		Types: []reflect.Type{reflect.TypeOf((func(string, string) bool)(nil)), reflect.TypeOf(builtins.MatchCIDR)},
 	}
+	funcMap["weekday"] = &ast.Function{
+		Name: "weekday",
+		Func: func(params ...any) (any, error) {
+			wd, err := builtins.Weekday(optionalStringParam(params, 0))
+			return wd, err
+		},
+		Types: []reflect.Type{reflect.TypeOf((func() string)(nil)), reflect.TypeOf((func(string) string)(nil))},
+	}
+	funcMap["hour"] = &ast.Function{
+		Name: "hour",
+		Func: func(params ...any) (any, error) {
+			h, err := builtins.Hour(optionalStringParam(params, 0))
+			return h, err
+		},
+		Types: []reflect.Type{reflect.TypeOf((func() int)(nil)), reflect.TypeOf((func(string) int)(nil))},
+	}
+	funcMap["time_between"] = &ast.Function{
+		Name: "time_between",
+		Func: func(params ...any) (any, error) {
+			in, err := builtins.TimeBetween(params[0].(string), params[1].(string), optionalStringParam(params, 2))
+			return in, err
+		},
+		Types: []reflect.Type{reflect.TypeOf((func(string, string) bool)(nil)), reflect.TypeOf((func(string, string, string) bool)(nil))},
+	}
+	funcMap["track"] = &ast.Function{
+		Name: "track",
+		Func: func(params ...any) (any, error) {
+			if len(params) == 5 {
+				// The rule & stream, added by idPatcher
+				stream, _ := params[4].(int64)
+				return tracker.TrackStream(params[0].(string), params[1].(string), durationParam(params[2]),
+					params[3].(string), stream), nil
+			}
+			return tracker.Track(params[0].(string), params[1].(string), durationParam(params[2])), nil
+		},
+		Types: []reflect.Type{
+			reflect.TypeOf((func(string, string, string) int)(nil)), reflect.TypeOf(tracker.Track),
+			reflect.TypeOf((func(string, string, string, string, int64) int)(nil)), reflect.TypeOf(tracker.TrackStream),
+		},
+	}
+	funcMap["tracked"] = &ast.Function{
+		Name: "tracked",
+		Func: func(params ...any) (any, error) {
+			return tracker.Count(params[0].(string), params[1].(string), durationParam(params[2])), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf((func(string, string, string) int)(nil)), reflect.TypeOf(tracker.Count)},
+	}
+	funcMap["usage"] = &ast.Function{
+		Name: "usage",
+		Func: func(params ...any) (any, error) {
+			period, ok := params[1].(builtins.UsagePeriod)
+			if !ok {
+				// Period not known at compile time
+				var err error
+				if period, err = builtins.ParseUsagePeriod(params[1].(string)); err != nil {
+					return 0, nil
+				}
+			}
+			if app := optionalStringParam(params, 2); app != "" {
+				return int64(usage.Used(params[0].(string), app, period, time.Now())), nil
+			}
+			return int64(usage.Total(params[0].(string), period, time.Now())), nil
+		},
+		Types: []reflect.Type{
+			reflect.TypeOf((func(string, string) int64)(nil)),
+			reflect.TypeOf((func(string, string, string) int64)(nil)),
+			reflect.TypeOf((func(string, builtins.UsagePeriod) int64)(nil)),
+			reflect.TypeOf((func(string, builtins.UsagePeriod, string) int64)(nil)),
+		},
+	}
+	funcMap["in_set"] = &ast.Function{
+		Name: "in_set",
+		Func: func(params ...any) (any, error) {
+			set, ok := params[0].(*builtins.Set)
+			if !ok {
+				// Set name not known at compile time
+				name, _ := params[0].(string)
+				if set = sets.Get(name); set == nil {
+					return false, nil
+				}
+			}
+			return set.Contains(params[1].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf((func(string, string) bool)(nil)), reflect.TypeOf((func(*builtins.Set, string) bool)(nil))},
+	}
+	funcMap["base64_decode"] = &ast.Function{
+		Name: "base64_decode",
+		Func: func(params ...any) (any, error) {
+			return builtins.Base64Decode(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.Base64Decode)},
+	}
+	funcMap["hex_decode"] = &ast.Function{
+		Name: "hex_decode",
+		Func: func(params ...any) (any, error) {
+			return builtins.HexDecode(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.HexDecode)},
+	}
+	funcMap["url_decode"] = &ast.Function{
+		Name: "url_decode",
+		Func: func(params ...any) (any, error) {
+			return builtins.URLDecode(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.URLDecode)},
+	}
+	funcMap["punycode_decode"] = &ast.Function{
+		Name: "punycode_decode",
+		Func: func(params ...any) (any, error) {
+			return builtins.PunycodeDecode(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.PunycodeDecode)},
+	}
+	funcMap["md5"] = &ast.Function{
+		Name: "md5",
+		Func: func(params ...any) (any, error) {
+			return builtins.MD5(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.MD5)},
+	}
+	funcMap["sha256"] = &ast.Function{
+		Name: "sha256",
+		Func: func(params ...any) (any, error) {
+			return builtins.SHA256(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.SHA256)},
+	}
+	funcMap["entropy"] = &ast.Function{
+		Name: "entropy",
+		Func: func(params ...any) (any, error) {
+			return builtins.Entropy(params[0].(string)), nil
+		},
+		Types: []reflect.Type{reflect.TypeOf(builtins.Entropy)},
+	}
+}
+
+// durationParam converts a duration parameter that is either a time.Duration
+// (pre-parsed by idPatcher or from duration()) or a string to a time.Duration.
+// Invalid strings are treated as zero.
+func durationParam(p any) time.Duration {
+	switch v := p.(type) {
+	case time.Duration:
+		return v
+	case string:
+		d, _ := builtins.ParseWindow(v)
+		return d
+	default:
+		return 0
+	}
+}
+
+// optionalStringParam returns the i-th parameter as a string, or "" if absent.
+func optionalStringParam(params []any, i int) string {
+	if i >= len(params) {
+		return ""
+	}
+	s, _ := params[i].(string)
+	return s
 }
 
-func streamInfoToExprEnv(info StreamInfo) map[string]interface{} {
+func streamInfoToExprEnv(info StreamInfo, now time.Time) map[string]interface{} {
+	flow := countersToExprEnv(info.Counters, now)
+	flow["asymmetric"] = info.Asymmetric
 	m := map[string]interface{}{
 		"id":    info.ID,
 		"proto": info.Protocol.String(),
+		"io":    info.IO,
 		"ip": map[string]string{
 			"src": info.SrcIP.String(),
 			"dst": info.DstIP.String(),
@@ -227,6 +797,23 @@ func streamInfoToExprEnv(info StreamInfo) map[string]interface{} {
 			"src": info.SrcPort,
 			"dst": info.DstPort,
 		},
+		"iface": map[string]string{
+			"in":  info.InInterface,
+			"out": info.OutInterface,
+		},
+		"direction": string(info.Direction),
+		"flow":      flow,
+	}
+	if info.SrcIP.To4() == nil {
+		headers := info.IPv6Ext.Headers
+		if headers == nil {
+			headers = []string{}
+		}
+		m["ipv6"] = map[string]interface{}{
+			"ext":        headers,
+			"ext_max":    info.IPv6Ext.Max,
+			"fragmented": info.IPv6Ext.Fragmented,
+		}
 	}
 	for anName, anProps := range info.Props {
 		if len(anProps) != 0 {
@@ -237,9 +824,50 @@ func streamInfoToExprEnv(info StreamInfo) map[string]interface{} {
 	return m
 }
 
+// exprEnv returns the environment of the rules for a stream.
+func (r *exprRuleset) exprEnv(info StreamInfo, now time.Time) map[string]interface{} {
+	env := streamInfoToExprEnv(info, now)
+	if r.Workloads != nil {
+		env["k8s"] = workloadsToExprEnv(r.Workloads, info)
+	}
+	if r.Containers != nil {
+		env["container"] = containersToExprEnv(r.Containers, info)
+	}
+	if r.Processes != nil {
+		env["process"] = processToExprEnv(r.Processes, info)
+	}
+	if r.NAT64 != nil {
+		env["nat64"] = nat64ToExprEnv(r.NAT64, info, env)
+	}
+	if r.Apps != nil {
+		env["app"], env["app_confidence"] = r.Apps.Classify(info.Props, info.Protocol.String(), info.DstPort)
+	}
+	return env
+}
+
+func countersToExprEnv(c StreamCounters, now time.Time) map[string]interface{} {
+	var age float64
+	if !c.StartTime.IsZero() {
+		age = now.Sub(c.StartTime).Seconds()
+	}
+	return map[string]interface{}{
+		"age":     age,
+		"packets": c.SrcPackets + c.DstPackets,
+		"bytes":   c.Bytes(),
+		"src": map[string]uint64{
+			"packets": c.SrcPackets,
+			"bytes":   c.SrcBytes,
+		},
+		"dst": map[string]uint64{
+			"packets": c.DstPackets,
+			"bytes":   c.DstBytes,
+		},
+	}
+}
+
 func isBuiltInAnalyzer(name string) bool {
 	switch name {
-	case "id", "proto", "ip", "port":
+	case "id", "proto", "io", "ip", "ipv6", "port", "iface", "direction", "flow", "k8s", "container", "process", "nat64", "app", "app_confidence":
 		return true
 	default:
 		return false
@@ -256,11 +884,46 @@ func actionStringToAction(action string) (Action, bool) {
 		return ActionDrop, true
 	case "modify":
 		return ActionModify, true
+	case "ratelimit":
+		return ActionRateLimit, true
+	case "shape":
+		return ActionShape, true
+	case "tarpit":
+		return ActionTarpit, true
+	case "capture":
+		return ActionCapture, true
+	case "mirror":
+		return ActionMirror, true
+	case "divert":
+		return ActionDivert, true
+	case "mark":
+		return ActionMark, true
+	case "quota":
+		return ActionQuota, true
+	case "capture-http":
+		return ActionCaptureHTTP, true
+	case "honeypot":
+		return ActionHoneypot, true
 	default:
 		return ActionMaybe, false
 	}
 }
 
+func logLevelStringToLogLevel(level string) (LogLevel, bool) {
+	switch strings.ToLower(level) {
+	case "", "info":
+		return LogLevelInfo, true
+	case "debug":
+		return LogLevelDebug, true
+	case "warn":
+		return LogLevelWarn, true
+	case "error":
+		return LogLevelError, true
+	default:
+		return LogLevelInfo, false
+	}
+}
+
 // analyzersToMap converts a list of analyzers to a map of name -> analyzer.
 // This is for easier lookup when compiling rules.
 func analyzersToMap(ans []analyzer.Analyzer) map[string]analyzer.Analyzer {
@@ -299,7 +962,9 @@ func (v *idVisitor) Visit(node *ast.Node) {
 // idPatcher patches the AST during expr compilation, replacing certain values with
 // their internal representations for better runtime performance.
 type idPatcher struct {
-	Err error
+	Sets *builtins.SetStore
+	Rule string // Name of the rule, empty for functions
+	Err  error
 }
 
 func (p *idPatcher) Visit(node *ast.Node) {
@@ -322,6 +987,71 @@ func (p *idPatcher) Visit(node *ast.Node) {
 				return
 			}
 			callNode.Arguments[1] = &ast.ConstantNode{Value: cidr}
+		case "track", "tracked":
+			if len(callNode.Arguments) != 3 {
+				return
+			}
+			if callNode.Func.Name == "track" && p.Rule != "" {
+				// Record once per stream, see Tracker.TrackStream
+				callNode.Arguments = append(callNode.Arguments,
+					&ast.ConstantNode{Value: p.Rule}, &ast.IdentifierNode{Value: "id"})
+			}
+			windowStringNode, ok := callNode.Arguments[2].(*ast.StringNode)
+			if !ok {
+				return
+			}
+			window, err := builtins.ParseWindow(windowStringNode.Value)
+			if err != nil {
+				p.Err = err
+				return
+			}
+			callNode.Arguments[2] = &ast.ConstantNode{Value: window}
+		case "usage":
+			if len(callNode.Arguments) < 2 {
+				return
+			}
+			periodStringNode, ok := callNode.Arguments[1].(*ast.StringNode)
+			if !ok {
+				return
+			}
+			period, err := builtins.ParseUsagePeriod(periodStringNode.Value)
+			if err != nil {
+				p.Err = err
+				return
+			}
+			callNode.Arguments[1] = &ast.ConstantNode{Value: period}
+		case "weekday", "hour", "time_between":
+			// Only checked, the functions parse their arguments themselves as they may not be constants
+			for i, arg := range callNode.Arguments {
+				stringNode, ok := arg.(*ast.StringNode)
+				if !ok {
+					continue
+				}
+				var err error
+				if callNode.Func.Name == "time_between" && i < 2 {
+					_, err = builtins.ParseClock(stringNode.Value)
+				} else {
+					_, err = builtins.LoadLocation(stringNode.Value)
+				}
+				if err != nil {
+					p.Err = fmt.Errorf("%s: invalid argument %q: %w", callNode.Func.Name, stringNode.Value, err)
+					return
+				}
+			}
+		case "in_set":
+			if len(callNode.Arguments) != 2 {
+				return
+			}
+			setNameNode, ok := callNode.Arguments[0].(*ast.StringNode)
+			if !ok {
+				return
+			}
+			set := p.Sets.Get(setNameNode.Value)
+			if set == nil {
+				p.Err = fmt.Errorf("unknown set %q", setNameNode.Value)
+				return
+			}
+			callNode.Arguments[0] = &ast.ConstantNode{Value: set}
 		}
 	}
 }
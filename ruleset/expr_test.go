@@ -0,0 +1,142 @@
+package ruleset
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+)
+
+func TestCompileExprRules_TrackOncePerStream(t *testing.T) {
+	tracker, err := builtins.NewTracker(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CompileExprRules([]ExprRule{
+		{Name: "repeat", Action: "block", Expr: `track(string(ip.src), "hits", "10m") >= 2`},
+	}, nil, nil, &BuiltinConfig{Tracker: tracker})
+	if err != nil {
+		t.Fatalf("CompileExprRules() error = %v", err)
+	}
+	testCases := []struct {
+		stream int64
+		want   Action
+	}{
+		{1, ActionMaybe},
+		{1, ActionMaybe}, // Evaluated again, e.g. after new properties
+		{1, ActionMaybe},
+		{2, ActionBlock},
+		{2, ActionBlock},
+	}
+	for i, tc := range testCases {
+		info := StreamInfo{
+			ID:       tc.stream,
+			Protocol: ProtocolTCP,
+			SrcIP:    net.ParseIP("10.0.0.1"),
+			DstIP:    net.ParseIP("10.0.0.2"),
+			SrcPort:  40000,
+			DstPort:  443,
+		}
+		if got := rs.Match(info).Action; got != tc.want {
+			t.Errorf("Match() #%d of stream %d = %v, want %v", i, tc.stream, got, tc.want)
+		}
+	}
+	if got := tracker.Count("10.0.0.1", "hits", 10*time.Minute); got != 2 {
+		t.Errorf("Count() = %d, want 2", got)
+	}
+}
+
+func TestCompileExprRules_TimeArgs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		expr    string
+		wantErr string
+	}{
+		{"time_between", `time_between("22:00", "07:00")`, ""},
+		{"time_between timezone", `time_between("09:00", "17:00", "Europe/Paris")`, ""},
+		{"time_between dynamic", `time_between(string(ip.src), "07:00")`, ""},
+		{"weekday", `weekday() == "mon" && weekday("UTC") == "mon"`, ""},
+		{"hour", `hour("Asia/Tokyo") >= 9`, ""},
+		{"invalid start", `time_between("25:00", "07:00")`, `time_between: invalid argument "25:00": time must be in HH:MM format`},
+		{"invalid end", `time_between("09:00", "5pm")`, `time_between: invalid argument "5pm": time must be in HH:MM format`},
+		{"unknown timezone", `time_between("09:00", "17:00", "Mars/Olympus_Mons")`, `time_between: invalid argument "Mars/Olympus_Mons": unknown time zone`},
+		{"weekday unknown timezone", `weekday("Nowhere") == "mon"`, `weekday: invalid argument "Nowhere": unknown time zone`},
+		{"hour unknown timezone", `hour("UTC+8") > 1`, `hour: invalid argument "UTC+8": unknown time zone`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := CompileExprRules([]ExprRule{{Name: "test", Action: "block", Expr: tc.expr}}, nil, nil, &BuiltinConfig{})
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("CompileExprRules() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("CompileExprRules() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestExprRuleset_NAT64LearnsOncePerMessage(t *testing.T) {
+	nat64, err := builtins.NewNAT64(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CompileExprRules([]ExprRule{
+		{Name: "test", Action: "block", Expr: `nat64.domain == "blocked.com"`},
+	}, nil, nil, &BuiltinConfig{NAT64: nat64})
+	if err != nil {
+		t.Fatalf("CompileExprRules() error = %v", err)
+	}
+	ip := net.ParseIP("64:ff9b::5db8:d822")
+	response := func(name string) analyzer.PropMap {
+		return analyzer.PropMap{
+			"qr":        true,
+			"questions": []analyzer.PropMap{{"name": name, "type": 28}},
+			"answers":   []analyzer.PropMap{{"name": name, "type": 28, "aaaa": ip.String()}},
+		}
+	}
+	first := StreamInfo{ID: 1, Props: analyzer.CombinedPropMap{"dns": response("first.com")}}
+	second := StreamInfo{ID: 2, Props: analyzer.CombinedPropMap{"dns": response("second.com")}}
+	steps := []struct {
+		info StreamInfo
+		want string
+	}{
+		{first, "first.com"},
+		{second, "second.com"},
+		// Re-evaluated, with the same message
+		{first, "second.com"},
+		// A new message of the stream, with the same answer
+		{StreamInfo{ID: 1, Props: analyzer.CombinedPropMap{"dns": response("first.com")}}, "first.com"},
+	}
+	for i, step := range steps {
+		rs.Match(step.info)
+		if got := nat64.Domain(ip); got != step.want {
+			t.Errorf("step %d: Domain() = %q, want %q", i, got, step.want)
+		}
+	}
+}
+
+func TestCompileExprRules_Mark(t *testing.T) {
+	testCases := []struct {
+		mark    uint32
+		wantErr bool
+	}{
+		{1, false},
+		{0xFFFE, false},
+		{0, true},
+		{0xFFFF, true},
+		// Would overflow the 16 bits it is shifted into
+		{0x10000, true},
+		{0x30000, true},
+	}
+	for _, tc := range testCases {
+		_, err := CompileExprRules([]ExprRule{{Name: "test", Action: "mark", Mark: tc.mark, Expr: `true`}}, nil, nil, &BuiltinConfig{})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("CompileExprRules() with mark %#x error = %v, want error %v", tc.mark, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package ruleset
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/conf"
+	"github.com/expr-lang/expr/vm"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// FunctionEntry is the external representation of a user-defined function,
+// which rules (and functions defined after it) can call like a built-in function.
+// The body is an expression that can only access the parameters and built-in functions,
+// and can use "let" for multi-step logic.
+type FunctionEntry struct {
+	Name   string   `yaml:"name" mapstructure:"name"`
+	Params []string `yaml:"params" mapstructure:"params"`
+	// Returns is the return type: bool (default), int, float or string.
+	Returns string `yaml:"returns" mapstructure:"returns"`
+	// Cache, if positive, is the number of results to cache by arguments.
+	// Only useful for expensive functions called with a limited set of arguments.
+	Cache int    `yaml:"cache" mapstructure:"cache"`
+	Expr  string `yaml:"expr" mapstructure:"expr"`
+}
+
+var functionReturnTypes = map[string]reflect.Type{
+	"bool":   reflect.TypeOf(false),
+	"int":    reflect.TypeOf(0),
+	"float":  reflect.TypeOf(0.0),
+	"string": reflect.TypeOf(""),
+}
+
+var anyType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+type userFunction struct {
+	Entry      FunctionEntry
+	ReturnType reflect.Type
+	Program    *vm.Program
+	Cache      *lru.Cache[string, interface{}]
+}
+
+func (f *userFunction) Call(params ...interface{}) (interface{}, error) {
+	var key string
+	if f.Cache != nil {
+		key = fmt.Sprintf("%#v", params)
+		if v, ok := f.Cache.Get(key); ok {
+			return v, nil
+		}
+	}
+	env := make(map[string]interface{}, len(params))
+	for i, p := range params {
+		env[f.Entry.Params[i]] = p
+	}
+	v, err := vm.Run(f.Program, env)
+	if err != nil {
+		return nil, fmt.Errorf("function %q: %w", f.Entry.Name, err)
+	}
+	if v == nil || !reflect.TypeOf(v).ConvertibleTo(f.ReturnType) {
+		return nil, fmt.Errorf("function %q returned %T, expected %s", f.Entry.Name, v, f.ReturnType)
+	}
+	v = reflect.ValueOf(v).Convert(f.ReturnType).Interface()
+	if f.Cache != nil {
+		f.Cache.Add(key, v)
+	}
+	return v, nil
+}
+
+func (f *userFunction) ExprFunction() *ast.Function {
+	in := make([]reflect.Type, len(f.Entry.Params))
+	for i := range in {
+		in[i] = anyType
+	}
+	return &ast.Function{
+		Name:  f.Entry.Name,
+		Func:  f.Call,
+		Types: []reflect.Type{reflect.FuncOf(in, []reflect.Type{f.ReturnType}, false)},
+	}
+}
+
+// compileUserFunctions compiles the user-defined functions in order,
+// so that each can call the ones defined before it.
+func (rc *exprRuleCompiler) compileUserFunctions(entries []FunctionEntry) error {
+	for _, entry := range entries {
+		if entry.Name == "" {
+			return fmt.Errorf("function must have a name")
+		}
+		if rc.isBuiltinFunction(entry.Name) || isBuiltInAnalyzer(entry.Name) || rc.userFuncs[entry.Name] != nil {
+			return fmt.Errorf("function %q conflicts with an existing name", entry.Name)
+		}
+		if _, ok := rc.fullAnMap[entry.Name]; ok {
+			return fmt.Errorf("function %q conflicts with an analyzer", entry.Name)
+		}
+		retType, ok := functionReturnTypes[strings.ToLower(entry.Returns)]
+		if entry.Returns == "" {
+			retType, ok = functionReturnTypes["bool"], true
+		}
+		if !ok {
+			return fmt.Errorf("function %q has invalid return type %q", entry.Name, entry.Returns)
+		}
+		visitor := &idVisitor{Variables: make(map[string]bool), Identifiers: make(map[string]bool)}
+		patcher := &idPatcher{Sets: rc.config.Sets}
+		program, err := expr.Compile(entry.Expr,
+			func(c *conf.Config) {
+				c.Strict = false
+				c.Visitors = append(c.Visitors, visitor, patcher)
+				rc.registerFunctions(c.Functions)
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("function %q has invalid expression: %w", entry.Name, err)
+		}
+		if patcher.Err != nil {
+			return fmt.Errorf("function %q failed to patch expression: %w", entry.Name, patcher.Err)
+		}
+		for name := range visitor.Identifiers {
+			if rc.isBuiltinFunction(name) {
+				if err := rc.loadBuiltinFunction(name); err != nil {
+					return fmt.Errorf("function %q %w", entry.Name, err)
+				}
+			}
+		}
+		f := &userFunction{
+			Entry:      entry,
+			ReturnType: retType,
+			Program:    program,
+		}
+		if entry.Cache > 0 {
+			f.Cache, err = lru.New[string, interface{}](entry.Cache)
+			if err != nil {
+				return err
+			}
+		}
+		rc.userFuncs[entry.Name] = f
+	}
+	return nil
+}
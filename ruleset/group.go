@@ -0,0 +1,78 @@
+package ruleset
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkRuleGroups checks that every jump rule jumps to an existing group, and that
+// there are no loops between groups, which would make the evaluation recurse forever.
+// On error, it also returns the index of the offending rule.
+func checkRuleGroups(rules []ExprRule) (int, error) {
+	groups := make(map[string]bool)
+	for _, rule := range rules {
+		groups[rule.Group] = true
+	}
+	jumps := make(map[string][]int) // Group -> indexes of its jump rules
+	for i, rule := range rules {
+		if !strings.EqualFold(rule.Action, "jump") || rule.Jump == "" {
+			continue
+		}
+		if !groups[rule.Jump] {
+			return i, fmt.Errorf("rule %q jumps to unknown group %q", rule.Name, rule.Jump)
+		}
+		jumps[rule.Group] = append(jumps[rule.Group], i)
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(group string) (int, error)
+	visit = func(group string) (int, error) {
+		state[group] = visiting
+		for _, i := range jumps[group] {
+			target := rules[i].Jump
+			switch state[target] {
+			case visiting:
+				return i, fmt.Errorf("rule %q jumps to group %q, which leads back to group %q", rules[i].Name, target, group)
+			case 0:
+				if j, err := visit(target); err != nil {
+					return j, err
+				}
+			}
+		}
+		state[group] = visited
+		return -1, nil
+	}
+	// Follow the rule order, so that the same ruleset always reports the same rule
+	for _, rule := range rules {
+		if state[rule.Group] == 0 {
+			if i, err := visit(rule.Group); err != nil {
+				return i, err
+			}
+		}
+	}
+	return -1, nil
+}
+
+// unusedRuleGroups returns the groups (other than the main group) that no rule jumps to,
+// each with the index of its first rule.
+func unusedRuleGroups(rules []ExprRule) map[string]int {
+	used := make(map[string]bool)
+	for _, rule := range rules {
+		if strings.EqualFold(rule.Action, "jump") {
+			used[rule.Jump] = true
+		}
+	}
+	unused := make(map[string]int)
+	for i, rule := range rules {
+		if rule.Group == "" || used[rule.Group] {
+			continue
+		}
+		if _, ok := unused[rule.Group]; !ok {
+			unused[rule.Group] = i
+		}
+	}
+	return unused
+}
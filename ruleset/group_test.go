@@ -0,0 +1,163 @@
+package ruleset
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckRuleGroups(t *testing.T) {
+	testCases := []struct {
+		name      string
+		rules     []ExprRule
+		wantIndex int
+		wantErr   string // Substring, empty for no error
+	}{
+		{
+			name: "no groups",
+			rules: []ExprRule{
+				{Name: "a", Action: "block"},
+				{Name: "b", Action: "allow"},
+			},
+			wantIndex: -1,
+		},
+		{
+			name: "chain",
+			rules: []ExprRule{
+				{Name: "to-x", Action: "jump", Jump: "x"},
+				{Name: "x-to-y", Group: "x", Action: "JUMP", Jump: "y"},
+				{Name: "x-return", Group: "x", Action: "return"},
+				{Name: "y", Group: "y", Action: "block"},
+			},
+			wantIndex: -1,
+		},
+		{
+			name: "shared target",
+			rules: []ExprRule{
+				{Name: "to-x", Action: "jump", Jump: "x"},
+				{Name: "to-y", Action: "jump", Jump: "y"},
+				{Name: "x-to-y", Group: "x", Action: "jump", Jump: "y"},
+				{Name: "y", Group: "y", Action: "block"},
+			},
+			wantIndex: -1,
+		},
+		{
+			name: "unknown group",
+			rules: []ExprRule{
+				{Name: "a", Action: "block"},
+				{Name: "to-x", Action: "jump", Jump: "x"},
+			},
+			wantIndex: 1,
+			wantErr:   `rule "to-x" jumps to unknown group "x"`,
+		},
+		{
+			name: "self",
+			rules: []ExprRule{
+				{Name: "to-x", Action: "jump", Jump: "x"},
+				{Name: "x-to-x", Group: "x", Action: "jump", Jump: "x"},
+			},
+			wantIndex: 1,
+			wantErr:   `rule "x-to-x" jumps to group "x", which leads back to group "x"`,
+		},
+		{
+			name: "to the main group",
+			rules: []ExprRule{
+				{Name: "to-x", Action: "jump", Jump: "x"},
+				{Name: "x-to-main", Group: "x", Action: "jump"},
+			},
+			wantIndex: -1, // An empty jump is not a jump, rejected when compiling the rule
+		},
+		{
+			name: "indirect",
+			rules: []ExprRule{
+				{Name: "to-x", Action: "jump", Jump: "x"},
+				{Name: "x-to-y", Group: "x", Action: "jump", Jump: "y"},
+				{Name: "y-to-z", Group: "y", Action: "jump", Jump: "z"},
+				{Name: "z-to-x", Group: "z", Action: "jump", Jump: "x"},
+			},
+			wantIndex: 3,
+			wantErr:   `rule "z-to-x" jumps to group "x", which leads back to group "z"`,
+		},
+		{
+			name: "unreachable loop",
+			rules: []ExprRule{
+				{Name: "a", Action: "block"},
+				{Name: "x-to-y", Group: "x", Action: "jump", Jump: "y"},
+				{Name: "y-to-x", Group: "y", Action: "jump", Jump: "x"},
+			},
+			wantIndex: 2,
+			wantErr:   `rule "y-to-x" jumps to group "x", which leads back to group "y"`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			i, err := checkRuleGroups(tc.rules)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkRuleGroups() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("checkRuleGroups() error = %v, want %q", err, tc.wantErr)
+			}
+			if i != tc.wantIndex {
+				t.Errorf("checkRuleGroups() index = %d, want %d", i, tc.wantIndex)
+			}
+		})
+	}
+}
+
+func TestUnusedRuleGroups(t *testing.T) {
+	rules := []ExprRule{
+		{Name: "to-x", Action: "jump", Jump: "x"},
+		{Name: "x", Group: "x", Action: "block"},
+		{Name: "y1", Group: "y", Action: "block"},
+		{Name: "y2", Group: "y", Action: "allow"},
+		{Name: "main", Action: "allow"},
+	}
+	want := map[string]int{"y": 2}
+	if got := unusedRuleGroups(rules); !reflect.DeepEqual(got, want) {
+		t.Errorf("unusedRuleGroups() = %v, want %v", got, want)
+	}
+}
+
+func TestCompileExprRules_Groups(t *testing.T) {
+	rules := []ExprRule{
+		{Name: "to-web", Action: "jump", Jump: "web", Expr: `port.dst in [80, 443]`},
+		{Name: "default", Action: "allow", Expr: `true`},
+		{Name: "trusted", Group: "web", Action: "return", Expr: `string(ip.dst) == "10.0.0.1"`},
+		{Name: "block-https", Group: "web", Action: "block", Expr: `port.dst == 443`},
+	}
+	rs, err := CompileExprRules(rules, nil, nil, &BuiltinConfig{})
+	if err != nil {
+		t.Fatalf("CompileExprRules() error = %v", err)
+	}
+	testCases := []struct {
+		dstIP    string
+		dstPort  uint16
+		wantRule string
+	}{
+		{"10.0.0.2", 443, "block-https"},
+		{"10.0.0.1", 443, "default"}, // Returned before the block
+		{"10.0.0.2", 80, "default"},  // Nothing matched in the group
+		{"10.0.0.2", 22, "default"},
+	}
+	for _, tc := range testCases {
+		info := StreamInfo{
+			ID:       1,
+			Protocol: ProtocolTCP,
+			SrcIP:    net.ParseIP("192.168.0.2"),
+			DstIP:    net.ParseIP(tc.dstIP),
+			SrcPort:  40000,
+			DstPort:  tc.dstPort,
+		}
+		if got := rs.Match(info).RuleName; got != tc.wantRule {
+			t.Errorf("Match(%s:%d) rule = %q, want %q", tc.dstIP, tc.dstPort, got, tc.wantRule)
+		}
+	}
+
+	loop := append(rules, ExprRule{Name: "web-to-web", Group: "web", Action: "jump", Jump: "web", Expr: `true`})
+	if _, err := CompileExprRules(loop, nil, nil, &BuiltinConfig{}); err == nil {
+		t.Error("CompileExprRules() error = nil for a loop, want an error")
+	}
+}
@@ -2,10 +2,13 @@ package ruleset
 
 import (
 	"net"
+	"slices"
 	"strconv"
+	"time"
 
 	"github.com/apernet/OpenGFW/analyzer"
 	"github.com/apernet/OpenGFW/modifier"
+	"github.com/apernet/OpenGFW/ruleset/builtins"
 )
 
 type Action int
@@ -26,6 +29,42 @@ const (
 	// and the stream should be allowed to continue.
 	// Only valid for UDP streams. Equivalent to ActionMaybe for TCP streams.
 	ActionModify
+	// ActionRateLimit indicates that the stream should be allowed to continue,
+	// but packets exceeding the rate limit of the matched rule should be dropped.
+	ActionRateLimit
+	// ActionShape indicates that the stream should be allowed regardless of future changes,
+	// and assigned to the bandwidth class of the matched rule by marking it.
+	ActionShape
+	// ActionTarpit indicates that the stream should be allowed to continue, but slowed down
+	// by delaying its packets and/or clamping its TCP window, as configured in the matched rule.
+	// Only valid for TCP streams. Equivalent to ActionMaybe for UDP streams.
+	ActionTarpit
+	// ActionCapture indicates that the stream should be allowed to continue,
+	// and all its packets (including buffered earlier ones) written to the capture files.
+	ActionCapture
+	// ActionMirror is like ActionCapture, but sends the packets to the configured mirror
+	// (an interface or a GRE/VXLAN tunnel) instead.
+	ActionMirror
+	// ActionDivert indicates that the stream should be blocked, and the client's next
+	// connections to the same server & port redirected to the configured local port,
+	// e.g. for a transparent proxy. Only valid for TCP streams. Equivalent to ActionMaybe for UDP streams.
+	ActionDivert
+	// ActionMark indicates that the stream should be allowed regardless of future changes,
+	// and marked with the mark of the matched rule for policy routing & tc filters.
+	// The nfqueue IO keeps its verdict in the lower 16 bits of the conntrack mark, and the mark
+	// (1 to 65534) in the upper 16 bits, so the packets of the stream get the fwmark mark << 16.
+	ActionMark
+	// ActionQuota indicates that the stream should be allowed until it exceeds the byte and/or
+	// time limits of the matched rule, then dropped or rate limited.
+	ActionQuota
+	// ActionCaptureHTTP is like ActionCapture, but the packets are written to the configured
+	// HTTP capturer, which reconstructs the HTTP requests & responses of the stream.
+	// Only valid for TCP streams. Equivalent to ActionMaybe for UDP streams.
+	ActionCaptureHTTP
+	// ActionHoneypot is like ActionDivert, but the client's next connections to the same server & port
+	// are DNATed to the configured honeypot instead, e.g. to study scanners & brute-forcers.
+	// Only valid for TCP streams. Equivalent to ActionMaybe for UDP streams.
+	ActionHoneypot
 )
 
 func (a Action) String() string {
@@ -40,6 +79,26 @@ func (a Action) String() string {
 		return "drop"
 	case ActionModify:
 		return "modify"
+	case ActionRateLimit:
+		return "ratelimit"
+	case ActionShape:
+		return "shape"
+	case ActionTarpit:
+		return "tarpit"
+	case ActionCapture:
+		return "capture"
+	case ActionMirror:
+		return "mirror"
+	case ActionDivert:
+		return "divert"
+	case ActionMark:
+		return "mark"
+	case ActionQuota:
+		return "quota"
+	case ActionCaptureHTTP:
+		return "capture-http"
+	case ActionHoneypot:
+		return "honeypot"
 	default:
 		return "unknown"
 	}
@@ -53,6 +112,10 @@ func (p Protocol) String() string {
 		return "tcp"
 	case ProtocolUDP:
 		return "udp"
+	case ProtocolSCTP:
+		return "sctp"
+	case ProtocolICMP:
+		return "icmp"
 	default:
 		return "unknown"
 	}
@@ -61,27 +124,105 @@ func (p Protocol) String() string {
 const (
 	ProtocolTCP Protocol = iota
 	ProtocolUDP
+	ProtocolSCTP
+	ProtocolICMP // ICMPv4 & ICMPv6
+)
+
+// Direction is the direction of a stream relative to the outside, from the interfaces it crosses.
+type Direction string
+
+const (
+	DirectionUnknown  Direction = ""
+	DirectionInbound  Direction = "inbound"  // From an external interface, or to this host
+	DirectionOutbound Direction = "outbound" // To an external interface, or from this host
+	DirectionInternal Direction = "internal" // Between internal interfaces
+	DirectionTransit  Direction = "transit"  // Between external interfaces
 )
 
 type StreamInfo struct {
 	ID               int64
+	UUID             string // Unique across instances, to correlate the stream's events, logs, captures & traces
 	Protocol         Protocol
 	SrcIP, DstIP     net.IP
 	SrcPort, DstPort uint16
+	InInterface      string       // Interface the stream's first packet was received on, empty if unknown
+	OutInterface     string       // Interface the stream's first packet was sent on, empty if unknown
+	Owner            *SocketOwner // Of the local socket of the stream in local mode, nil if unknown
+	Direction        Direction
+	Asymmetric       bool   // Whether only one direction of the stream crosses the engine, see engine.AsymmetricPolicy
+	IO               string // Name of the IO instance the stream's first packet came from, empty if unnamed
 	Props            analyzer.CombinedPropMap
+	Counters         StreamCounters
+	IPv6Ext          IPv6Ext // Only for IPv6 streams
 }
 
+// SrcString returns the source address & port of the stream, without port for ICMP.
 func (i StreamInfo) SrcString() string {
+	if i.Protocol == ProtocolICMP {
+		return i.SrcIP.String()
+	}
 	return net.JoinHostPort(i.SrcIP.String(), strconv.Itoa(int(i.SrcPort)))
 }
 
+// DstString returns the destination address & port of the stream, without port for ICMP.
 func (i StreamInfo) DstString() string {
+	if i.Protocol == ProtocolICMP {
+		return i.DstIP.String()
+	}
 	return net.JoinHostPort(i.DstIP.String(), strconv.Itoa(int(i.DstPort)))
 }
 
+// IPv6Ext holds the extension headers the packets of an IPv6 stream had.
+type IPv6Ext struct {
+	Headers    []string // Names of the extension headers, in the order first seen
+	Max        int      // Most extension headers of a packet
+	Fragmented bool     // Whether a packet was a fragment
+}
+
+// Add adds the extension headers of a packet.
+func (e *IPv6Ext) Add(headers []string, fragment bool) {
+	for _, h := range headers {
+		if !slices.Contains(e.Headers, h) {
+			e.Headers = append(e.Headers, h)
+		}
+	}
+	e.Max = max(e.Max, len(headers))
+	e.Fragmented = e.Fragmented || fragment
+}
+
+// StreamCounters holds the traffic counters of a stream.
+// "Src" is the side that initiated the stream, "Dst" the other side.
+type StreamCounters struct {
+	StartTime              time.Time
+	SrcPackets, DstPackets uint64
+	SrcBytes, DstBytes     uint64
+}
+
+// Add counts a packet of the given size. rev is true for packets sent by Dst.
+func (c *StreamCounters) Add(rev bool, size int) {
+	if rev {
+		c.DstPackets++
+		c.DstBytes += uint64(size)
+	} else {
+		c.SrcPackets++
+		c.SrcBytes += uint64(size)
+	}
+}
+
+// Bytes returns the total number of bytes in both directions.
+func (c *StreamCounters) Bytes() uint64 {
+	return c.SrcBytes + c.DstBytes
+}
+
 type MatchResult struct {
 	Action      Action
+	RuleName    string // Name of the matched rule, empty if no match
 	ModInstance modifier.Instance
+	RateLimiter *RateLimiter // Only set for ActionRateLimit
+	Mark        uint32       // Only set for ActionShape & ActionMark
+	Tarpit      *TarpitEntry // Only set for ActionTarpit
+	Quota       *Quota       // Only set for ActionQuota
+	Stats       *RuleStats   // Statistics of the matched rule, nil if no match
 }
 
 type Ruleset interface {
@@ -91,16 +232,107 @@ type Ruleset interface {
 	// Match matches a stream against the ruleset and returns the result.
 	// It must be safe for concurrent use by multiple workers.
 	Match(StreamInfo) MatchResult
+	// Stats returns the statistics of each rule, in order.
+	// It must be safe for concurrent use.
+	Stats() []RuleStatsSnapshot
+}
+
+type LogLevel int
+
+const (
+	LogLevelInfo LogLevel = iota // Default
+	LogLevelDebug
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
 }
 
 // Logger is the logging interface for the ruleset.
 type Logger interface {
-	Log(info StreamInfo, name string)
+	// Log is called when a rule with logging enabled matches.
+	// info.Props is nil if the rule is configured to not log properties.
+	Log(level LogLevel, info StreamInfo, name string)
+	// DryRun is called when a rule that is not enforced matches,
+	// with the action it would have taken.
+	DryRun(info StreamInfo, name string, action Action)
 	MatchError(info StreamInfo, name string, err error)
 }
 
+// Notifier receives the events of rules with notify enabled.
+// Notify is called in the packet path, so it must not block.
+type Notifier interface {
+	Notify(ev NotifyEvent)
+}
+
+// TarpitEntry is the external representation of the parameters of a "tarpit" rule.
+type TarpitEntry struct {
+	// Delay is how long each packet of the stream is held before being forwarded.
+	Delay time.Duration `yaml:"delay"`
+	// Window, if non-zero, is the maximum TCP window advertised in either direction.
+	Window uint16 `yaml:"window"`
+}
+
 type BuiltinConfig struct {
 	Logger          Logger
 	GeoSiteFilename string
 	GeoIpFilename   string
+	// AppsFilename adds applications to the bundled ones of the app variable, optional.
+	AppsFilename string
+	// AppsAnalyzers runs the analyzers the app variable uses even if no rule uses it,
+	// e.g. for the streams to be classified by application for QoS.
+	AppsAnalyzers  bool
+	ShapingClasses map[string]uint32 // Class name -> mark
+	// Tracker is the counter store for track() and tracked().
+	// Pass the same one when recompiling to keep the counters across reloads.
+	// If nil, a new one is created.
+	Tracker *builtins.Tracker
+	// Usage is the store of the traffic counters of clients, for usage() and per client quotas.
+	// Pass the same one when recompiling to keep the counters across reloads.
+	// If nil, a new one is created.
+	Usage *builtins.Usage
+	// Sets are the named sets available to in_set(). They are referenced, not copied,
+	// so changes to them apply to compiled rulesets immediately.
+	Sets *builtins.SetStore
+	// Functions are the user-defined functions available to the rules.
+	Functions []FunctionEntry
+	// CaptureEnabled is whether the engine has somewhere to write captured streams to.
+	// If false, rules with the capture action are rejected.
+	CaptureEnabled bool
+	// MirrorEnabled is the same for the mirror action.
+	MirrorEnabled bool
+	// DivertEnabled is the same for the divert action.
+	DivertEnabled bool
+	// CaptureHTTPEnabled is the same for the capture-http action.
+	CaptureHTTPEnabled bool
+	// HoneypotEnabled is the same for the honeypot action.
+	HoneypotEnabled bool
+	// Notifier receives the events of rules with notify enabled.
+	// If nil, such rules are rejected.
+	Notifier Notifier
+	// Workloads maps the IPs of streams to Kubernetes workloads, for the k8s variable.
+	// If nil, rules using k8s are rejected.
+	Workloads WorkloadResolver
+	// Containers maps the IPs of streams to Docker containers, for the container variable.
+	// If nil, rules using container are rejected.
+	Containers ContainerResolver
+	// Processes finds the local processes owning the sockets of streams, for the process variable.
+	// If nil, rules using process are rejected.
+	Processes ProcessResolver
+	// NAT64 recognizes the addresses synthesized by NAT64/DNS64, for the nat64 variable
+	// and for ip.dst to be the IPv4 address they embed. If nil, rules using nat64 are rejected.
+	NAT64 *builtins.NAT64
 }
@@ -0,0 +1,271 @@
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/conf"
+	"github.com/expr-lang/expr/optimizer"
+	"github.com/expr-lang/expr/parser"
+
+	"github.com/apernet/OpenGFW/analyzer"
+	"github.com/apernet/OpenGFW/modifier"
+)
+
+const (
+	// lintMaxRegexInsts is the compiled size above which a regex is reported as expensive.
+	// Go regexes run in linear time, but large repetition counts (e.g. "(a|b){1000}")
+	// blow up the program size, and with it the time & memory of every match.
+	lintMaxRegexInsts = 2000
+	// lintMaxCost is the estimated cost above which a rule is reported as expensive.
+	lintMaxCost = 200
+)
+
+// Cost weights of expression nodes, roughly relative to a simple comparison.
+var lintFuncCosts = map[string]int{
+	"geoip":           20,
+	"geosite":         50,
+	"cidr":            3,
+	"in_set":          5,
+	"track":           10,
+	"tracked":         10,
+	"usage":           10,
+	"weekday":         3,
+	"hour":            3,
+	"time_between":    5,
+	"base64_decode":   3,
+	"hex_decode":      3,
+	"url_decode":      3,
+	"punycode_decode": 10,
+	"md5":             5,
+	"sha256":          5,
+	"entropy":         5,
+}
+
+type LintSeverity int
+
+const (
+	LintError LintSeverity = iota
+	LintWarning
+)
+
+func (s LintSeverity) String() string {
+	switch s {
+	case LintError:
+		return "error"
+	case LintWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+// LintIssue is a problem found in a rule by LintExprRules.
+type LintIssue struct {
+	Index    int // Index of the rule in the list
+	Rule     string
+	Severity LintSeverity
+	Message  string
+	Analyzer string // Set for uses of unknown or disabled analyzers, which CompileExprRules rejects
+}
+
+// LintRuleCost is the estimated relative evaluation cost of a rule.
+type LintRuleCost struct {
+	Index int
+	Rule  string
+	Cost  int
+}
+
+type LintResult struct {
+	Issues []LintIssue
+	Costs  []LintRuleCost
+}
+
+// HasErrors returns whether any of the issues is an error.
+func (r *LintResult) HasErrors() bool {
+	for _, i := range r.Issues {
+		if i.Severity == LintError {
+			return true
+		}
+	}
+	return false
+}
+
+// LintExprRules checks a list of expression rules for problems, without stopping at the
+// first one like CompileExprRules does. The analyzers given are considered to be the enabled
+// ones. Geo databases are not loaded.
+func LintExprRules(rules []ExprRule, ans []analyzer.Analyzer, mods []modifier.Modifier, config *BuiltinConfig) (*LintResult, error) {
+	c, err := newExprRuleCompiler(ans, mods, config)
+	if err != nil {
+		return nil, err
+	}
+	c.noGeoLoad = true
+	if err := c.compileUserFunctions(config.Functions); err != nil {
+		return nil, err
+	}
+	result := &LintResult{}
+	addIssue := func(i int, severity LintSeverity, format string, args ...interface{}) {
+		result.Issues = append(result.Issues, LintIssue{
+			Index:    i,
+			Rule:     rules[i].Name,
+			Severity: severity,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+	if i, err := checkRuleGroups(rules); err != nil {
+		addIssue(i, LintError, "%v", err)
+	}
+	unusedGroups := unusedRuleGroups(rules)
+	for i, rule := range rules {
+		if j, ok := unusedGroups[rule.Group]; ok && i == j {
+			addIssue(i, LintWarning, "no rule jumps to group %q, so its rules are never evaluated", rule.Group)
+		}
+	}
+	seenNames := make(map[string]int)
+	seenExprs := make(map[string]int)  // Group & normalized expression -> index of the first terminal rule with it
+	terminalAt := make(map[string]int) // Group -> index of the first terminal rule that always matches
+	for i, rule := range rules {
+		if rule.Name == "" {
+			addIssue(i, LintWarning, "rule has no name")
+		} else if j, ok := seenNames[rule.Name]; ok {
+			addIssue(i, LintWarning, "duplicate rule name, also used by rule #%d", j+1)
+		} else {
+			seenNames[rule.Name] = i
+		}
+		if _, _, err := c.Compile(rule); err != nil {
+			var uaErr *unknownAnalyzerError
+			if errors.As(err, &uaErr) {
+				addIssue(i, LintWarning, "uses analyzer %q which is unknown or not enabled, so the rule can never match", uaErr.Analyzer)
+				result.Issues[len(result.Issues)-1].Analyzer = uaErr.Analyzer
+			} else {
+				addIssue(i, LintError, "%v", err)
+				continue
+			}
+		}
+		tree, err := parser.Parse(rule.Expr)
+		if err != nil {
+			// Should have been caught by Compile
+			continue
+		}
+		// Unreachable rules
+		if j, ok := terminalAt[rule.Group]; ok {
+			addIssue(i, LintWarning, "unreachable, rule #%d (%s) before it always matches", j+1, rules[j].Name)
+		}
+		normExpr := rule.Group + "\x00" + strings.Join(strings.Fields(rule.Expr), " ")
+		if j, ok := seenExprs[normExpr]; ok {
+			addIssue(i, LintWarning, "unreachable, rule #%d (%s) before it has the same expression", j+1, rules[j].Name)
+		}
+		if lintIsTerminal(rule) {
+			if _, ok := seenExprs[normExpr]; !ok {
+				seenExprs[normExpr] = i
+			}
+			if _, ok := terminalAt[rule.Group]; !ok && lintAlwaysTrue(rule.Expr) {
+				terminalAt[rule.Group] = i
+			}
+		}
+		if rule.Expires != nil && !rule.Expires.After(time.Now()) {
+			addIssue(i, LintWarning, "expired at %s, so it never matches", rule.Expires.Format(time.RFC3339))
+		}
+		// Regexes & cost
+		v := &lintVisitor{}
+		ast.Walk(&tree.Node, v)
+		for _, msg := range v.Issues {
+			addIssue(i, LintWarning, "%s", msg)
+		}
+		result.Costs = append(result.Costs, LintRuleCost{Index: i, Rule: rule.Name, Cost: v.Cost})
+		if v.Cost > lintMaxCost {
+			addIssue(i, LintWarning, "expensive expression (estimated cost %d), consider moving cheaper conditions first or splitting the rule", v.Cost)
+		}
+	}
+	return result, nil
+}
+
+// lintIsTerminal returns whether a matching rule stops the evaluation of the rules after it.
+func lintIsTerminal(rule ExprRule) bool {
+	if rule.Action == "" || (rule.Enforce != nil && !*rule.Enforce) || rule.Schedule != nil || rule.ActiveFrom != nil || rule.Expires != nil {
+		return false
+	}
+	if strings.EqualFold(rule.Action, "return") {
+		return true
+	}
+	a, ok := actionStringToAction(rule.Action)
+	return ok && a != ActionMaybe
+}
+
+// lintAlwaysTrue returns whether the expression folds to the constant true.
+func lintAlwaysTrue(input string) (always bool) {
+	defer func() {
+		if recover() != nil {
+			always = false
+		}
+	}()
+	tree, err := parser.Parse(input)
+	if err != nil {
+		return false
+	}
+	if err := optimizer.Optimize(&tree.Node, conf.CreateNew()); err != nil {
+		return false
+	}
+	b, ok := tree.Node.(*ast.BoolNode)
+	return ok && b.Value
+}
+
+// lintVisitor estimates the cost of an expression and checks its regexes.
+type lintVisitor struct {
+	Cost   int
+	Issues []string
+}
+
+func (v *lintVisitor) Visit(node *ast.Node) {
+	v.Cost++
+	switch n := (*node).(type) {
+	case *ast.CallNode:
+		if id, ok := n.Callee.(*ast.IdentifierNode); ok {
+			v.Cost += lintFuncCosts[id.Value]
+		}
+	case *ast.BuiltinNode:
+		switch n.Name {
+		case "all", "none", "any", "one", "filter", "map", "count", "find", "findIndex", "findLast", "findLastIndex", "groupBy", "sortBy", "reduce":
+			// Closure evaluated for each element
+			v.Cost += 20
+		}
+	case *ast.BinaryNode:
+		switch n.Operator {
+		case "matches":
+			v.Cost += 30
+			v.checkRegex(n.Right)
+		case "contains", "startsWith", "endsWith":
+			v.Cost += 2
+		case "in":
+			if arr, ok := n.Right.(*ast.ArrayNode); ok {
+				v.Cost += len(arr.Nodes)
+			}
+		}
+	}
+}
+
+func (v *lintVisitor) checkRegex(node ast.Node) {
+	str, ok := node.(*ast.StringNode)
+	if !ok {
+		v.Cost += 100
+		v.Issues = append(v.Issues, "regex pattern is not a constant string, it will be compiled on every evaluation")
+		return
+	}
+	re, err := syntax.Parse(str.Value, syntax.Perl)
+	if err != nil {
+		// Reported by Compile
+		return
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return
+	}
+	v.Cost += len(prog.Inst) / 20
+	if len(prog.Inst) > lintMaxRegexInsts {
+		v.Issues = append(v.Issues, fmt.Sprintf("regex %q compiles to %d instructions, which makes every match slow", str.Value, len(prog.Inst)))
+	}
+}
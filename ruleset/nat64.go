@@ -0,0 +1,28 @@
+package ruleset
+
+import (
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+)
+
+// nat64ToExprEnv returns the nat64 variable of the rules: for the streams to an address synthesized
+// by NAT64/DNS64, its prefix, the address itself and the domain it was answered for. The fields are empty
+// for other streams. As rules are written against the real IPv4 destinations, ip.dst of env is replaced
+// with the embedded IPv4 address.
+func nat64ToExprEnv(n *builtins.NAT64, info StreamInfo, env map[string]interface{}) map[string]interface{} {
+	v4, prefix := n.IPv4(info.DstIP)
+	if v4 == nil {
+		return map[string]interface{}{
+			"prefix": "",
+			"dst":    "",
+			"domain": "",
+		}
+	}
+	if ip, ok := env["ip"].(map[string]string); ok {
+		ip["dst"] = v4.String()
+	}
+	return map[string]interface{}{
+		"prefix": prefix.String(),
+		"dst":    info.DstIP.String(),
+		"domain": n.Domain(info.DstIP),
+	}
+}
@@ -0,0 +1,44 @@
+package ruleset
+
+// SocketOwner is the owner of the local socket of a stream, as reported by the IO.
+type SocketOwner struct {
+	UID, GID uint32
+}
+
+// Process is the local process owning the socket of a stream.
+type Process struct {
+	PID      int    // 0 if unknown, e.g. if only the owner of the socket is
+	Name     string // Command name, as in /proc/<pid>/comm
+	Exe      string // Path of the executable, empty if unknown
+	UID, GID int    // -1 if unknown
+}
+
+// ProcessResolver finds the local processes owning the sockets of streams, see BuiltinConfig.Processes.
+type ProcessResolver interface {
+	// Process returns the process owning the local socket of the stream, or nil if it's unknown,
+	// e.g. for forwarded streams. It's called for every stream matched, so it must cache what's slow,
+	// and be safe for concurrent use.
+	Process(info StreamInfo) *Process
+}
+
+// processToExprEnv returns the process variable of the rules. The fields are empty, and the IDs -1,
+// for unknown processes.
+func processToExprEnv(r ProcessResolver, info StreamInfo) map[string]interface{} {
+	p := r.Process(info)
+	if p == nil {
+		return map[string]interface{}{
+			"pid":  0,
+			"name": "",
+			"exe":  "",
+			"uid":  -1,
+			"gid":  -1,
+		}
+	}
+	return map[string]interface{}{
+		"pid":  p.PID,
+		"name": p.Name,
+		"exe":  p.Exe,
+		"uid":  p.UID,
+		"gid":  p.GID,
+	}
+}
@@ -0,0 +1,97 @@
+package ruleset
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+)
+
+var (
+	errInvalidQuota       = errors.New("at least one of bytes or duration must be positive")
+	errInvalidClientQuota = errors.New("per client quota requires bytes")
+)
+
+// QuotaEntry is the external representation of the parameters of a "quota" rule.
+type QuotaEntry struct {
+	Bytes    uint64        `yaml:"bytes"`    // Total in both directions, 0 = unlimited
+	Duration time.Duration `yaml:"duration"` // Since the stream started, 0 = unlimited
+	Then     string        `yaml:"then"`     // "drop" (default) or "ratelimit", with the rule's ratelimit
+	Per      string        `yaml:"per"`      // "stream" (default) or "client": bytes shared by the streams of a source IP
+	Period   string        `yaml:"period"`   // With per client, the calendar period of the bytes: day (default), week or month
+}
+
+// Quota is the compiled form of a QuotaEntry.
+type Quota struct {
+	Bytes    uint64
+	Duration time.Duration
+	Limiter  *RateLimiter // Applied once the quota is exceeded, nil = drop the stream
+
+	// For per client quotas, where the bytes of the streams are counted, nil otherwise
+	Usage  *builtins.Usage
+	Label  string
+	Period builtins.UsagePeriod
+}
+
+func newQuota(name string, entry QuotaEntry, rateLimit RateLimitEntry, usage *builtins.Usage) (*Quota, error) {
+	if entry.Bytes == 0 && entry.Duration <= 0 {
+		return nil, errInvalidQuota
+	}
+	q := &Quota{
+		Bytes:    entry.Bytes,
+		Duration: entry.Duration,
+	}
+	switch strings.ToLower(entry.Per) {
+	case "", "stream":
+		if entry.Period != "" {
+			return nil, errors.New("period requires per client")
+		}
+	case "client":
+		if entry.Bytes == 0 {
+			return nil, errInvalidClientQuota
+		}
+		q.Usage, q.Label = usage, builtins.UsageRulePrefix+name
+		if entry.Period != "" {
+			p, err := builtins.ParseUsagePeriod(entry.Period)
+			if err != nil {
+				return nil, err
+			}
+			q.Period = p
+		}
+	default:
+		return nil, errors.New("invalid per " + strconv.Quote(entry.Per))
+	}
+	switch strings.ToLower(entry.Then) {
+	case "", "drop":
+	case "ratelimit":
+		l, err := newRateLimiter(rateLimit)
+		if err != nil {
+			return nil, err
+		}
+		q.Limiter = l
+	default:
+		return nil, errors.New("invalid then " + strconv.Quote(entry.Then))
+	}
+	return q, nil
+}
+
+// Count counts bytes of a stream towards a per client quota. It does nothing for per stream quotas.
+func (q *Quota) Count(info StreamInfo, bytes int, now time.Time) {
+	if q.Usage != nil {
+		q.Usage.Add(info.SrcIP.String(), q.Label, uint64(bytes), now)
+	}
+}
+
+// Exceeded returns whether the stream (or its client, for per client quotas) has used up the quota.
+func (q *Quota) Exceeded(info StreamInfo, now time.Time) bool {
+	used := info.Counters.Bytes()
+	if q.Usage != nil {
+		used = q.Usage.Used(info.SrcIP.String(), q.Label, q.Period, now)
+	}
+	if q.Bytes > 0 && used >= q.Bytes {
+		return true
+	}
+	return q.Duration > 0 && now.Sub(info.Counters.StartTime) >= q.Duration
+}
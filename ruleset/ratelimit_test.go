@@ -0,0 +1,153 @@
+package ruleset
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+func newTestRateLimiter(t *testing.T, entry RateLimitEntry) *RateLimiter {
+	l, err := newRateLimiter(entry)
+	if err != nil {
+		t.Fatalf("newRateLimiter(%+v) error = %v", entry, err)
+	}
+	return l
+}
+
+func TestRateLimiter_Invalid(t *testing.T) {
+	for _, entry := range []RateLimitEntry{
+		{},
+		{PPS: -1},
+		{PPS: 10, Key: "port"},
+	} {
+		if _, err := newRateLimiter(entry); err == nil {
+			t.Errorf("newRateLimiter(%+v) error = nil, want error", entry)
+		}
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	type step struct {
+		at   time.Duration
+		size int
+		want bool
+	}
+	testCases := []struct {
+		name  string
+		entry RateLimitEntry
+		steps []step
+	}{
+		{
+			name:  "pps burst then refill",
+			entry: RateLimitEntry{PPS: 2},
+			steps: []step{
+				{0, 100, true},
+				{0, 100, true},
+				{0, 100, false},
+				{250 * time.Millisecond, 100, false}, // Half a token
+				{500 * time.Millisecond, 100, true},
+				{500 * time.Millisecond, 100, false},
+				{time.Hour, 100, true}, // Capped at the burst
+				{time.Hour, 100, true},
+				{time.Hour, 100, false},
+				{time.Hour - time.Second, 100, false}, // Out of order, no refill
+			},
+		},
+		{
+			name:  "pps with larger burst",
+			entry: RateLimitEntry{PPS: 1, Burst: 3},
+			steps: []step{
+				{0, 1, true},
+				{0, 1, true},
+				{0, 1, true},
+				{0, 1, false},
+				{time.Second, 1, true},
+				{time.Second, 1, false},
+			},
+		},
+		{
+			name:  "bps",
+			entry: RateLimitEntry{BPS: 1000},
+			steps: []step{
+				{0, 600, true},
+				{0, 600, false},
+				{200 * time.Millisecond, 600, true},
+				{200 * time.Millisecond, 1, false},    // Empty
+				{1200 * time.Millisecond, 1500, true}, // Larger than the bucket, but it's full
+				{1200 * time.Millisecond, 1, false},
+			},
+		},
+		{
+			name:  "pps & bps",
+			entry: RateLimitEntry{PPS: 10, BPS: 1000},
+			steps: []step{
+				{0, 1000, true},
+				{0, 1, false}, // Bytes exhausted, packets left
+				{time.Second, 1, true},
+			},
+		},
+	}
+	info := StreamInfo{ID: 1, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("192.0.2.1")}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newTestRateLimiter(t, tc.entry)
+			for i, s := range tc.steps {
+				if got := l.Allow(info, s.size, start.Add(s.at)); got != s.want {
+					t.Fatalf("step %d: Allow(%d) = %v, want %v", i, s.size, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Keys(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	a1 := StreamInfo{ID: 1, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("192.0.2.1")}
+	a2 := StreamInfo{ID: 2, SrcIP: net.ParseIP("10.0.0.1"), DstIP: net.ParseIP("192.0.2.2")}
+	b1 := StreamInfo{ID: 3, SrcIP: net.ParseIP("10.0.0.2"), DstIP: net.ParseIP("192.0.2.1")}
+	testCases := []struct {
+		key  string
+		want [3]bool // Of a1, a2 & b1, one packet each after a1 used up its bucket
+	}{
+		{"stream", [3]bool{false, true, true}},
+		{"src", [3]bool{false, false, true}},
+		{"dst", [3]bool{false, true, false}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			l := newTestRateLimiter(t, RateLimitEntry{PPS: 1, Key: tc.key})
+			if !l.Allow(a1, 1, now) {
+				t.Fatal("first packet not allowed")
+			}
+			got := [3]bool{l.Allow(a1, 1, now), l.Allow(a2, 1, now), l.Allow(b1, 1, now)}
+			if got != tc.want {
+				t.Errorf("Allow() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Eviction(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(t, RateLimitEntry{PPS: 1, Key: "src"})
+	l.buckets, _ = lru.New[string, *tokenBucket](2)
+	a := StreamInfo{SrcIP: net.ParseIP("10.0.0.1")}
+	b := StreamInfo{SrcIP: net.ParseIP("10.0.0.2")}
+	c := StreamInfo{SrcIP: net.ParseIP("10.0.0.3")}
+	for _, info := range []StreamInfo{a, b, a, c} {
+		// a is the most recently used when c is added, so b is evicted
+		l.Allow(info, 1, now)
+	}
+	if l.Allow(a, 1, now) {
+		t.Error("a allowed, want its bucket kept empty")
+	}
+	if !l.Allow(b, 1, now) {
+		t.Error("b not allowed, want it evicted & starting with a full bucket")
+	}
+	if got := l.buckets.Len(); got != 2 {
+		t.Errorf("buckets = %d, want 2", got)
+	}
+}
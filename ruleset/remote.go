@@ -0,0 +1,134 @@
+package ruleset
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	remoteDefaultTimeout = 30 * time.Second
+	remoteMaxBodySize    = 64 << 20 // 64 MiB
+	remoteSignatureExt   = ".sig"
+)
+
+var (
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errInvalidSignature = errors.New("invalid signature")
+	errInvalidPublicKey = errors.New("invalid public key")
+	errInsecureRemote   = errors.New("http:// sources require an https:// checksum URL or a public key, use https:// otherwise")
+)
+
+// remoteTransport is the transport of the HTTP clients, nil for the default one (tests replace it).
+var remoteTransport http.RoundTripper
+
+// RemoteConfig controls how remote (HTTP/HTTPS) rule and list sources are
+// fetched and validated.
+type RemoteConfig struct {
+	// ChecksumURL, if set, points to a sha256sum-style file whose first
+	// field is the expected hex SHA-256 digest of the fetched content.
+	ChecksumURL string
+	// PublicKey, if set, is a base64-encoded ed25519 public key.
+	// The content must then be signed, with the signature (raw or base64)
+	// available at SignatureURL, or the source URL + ".sig" if empty.
+	PublicKey    string
+	SignatureURL string
+	// Timeout for each HTTP request. Zero means the default (30s).
+	Timeout time.Duration
+}
+
+// IsRemoteSource returns whether the given rule/list source refers to
+// a remote URL instead of a local file.
+func IsRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+// FetchRemote downloads the content at url, validating it against the checksum
+// and/or signature specified in config. It returns the content and its SHA-256 digest.
+// Plain HTTP URLs must have a signature or a checksum fetched over HTTPS, as nothing else protects
+// their content (a checksum fetched over plain HTTP can be replaced along with it).
+func FetchRemote(url string, config RemoteConfig) (data []byte, digest [32]byte, err error) {
+	if strings.HasPrefix(url, "http://") && config.PublicKey == "" && !strings.HasPrefix(config.ChecksumURL, "https://") {
+		return nil, digest, errInsecureRemote
+	}
+	client := &http.Client{Transport: remoteTransport, Timeout: config.Timeout}
+	if client.Timeout <= 0 {
+		client.Timeout = remoteDefaultTimeout
+	}
+	data, err = httpGet(client, url)
+	if err != nil {
+		return nil, digest, err
+	}
+	digest = sha256.Sum256(data)
+	if config.ChecksumURL != "" {
+		sumData, err := httpGet(client, config.ChecksumURL)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to fetch checksum: %w", err)
+		}
+		fields := strings.Fields(string(sumData))
+		if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(digest[:])) {
+			return nil, digest, errChecksumMismatch
+		}
+	}
+	if config.PublicKey != "" {
+		sigURL := config.SignatureURL
+		if sigURL == "" {
+			sigURL = url + remoteSignatureExt
+		}
+		sig, err := httpGet(client, sigURL)
+		if err != nil {
+			return nil, digest, fmt.Errorf("failed to fetch signature: %w", err)
+		}
+		if err := VerifySignature(data, sig, config.PublicKey); err != nil {
+			return nil, digest, err
+		}
+	}
+	return data, digest, nil
+}
+
+// VerifySignature checks the ed25519 signature (raw or base64) of data,
+// with publicKey base64-encoded as in RemoteConfig.
+func VerifySignature(data, sig []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errInvalidPublicKey
+	}
+	if len(sig) != ed25519.SignatureSize {
+		// Not raw, try base64
+		sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil {
+			return errInvalidSignature
+		}
+	}
+	if !ed25519.Verify(key, data, sig) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func httpGet(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, url)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > remoteMaxBodySize {
+		return nil, fmt.Errorf("response from %s exceeds %d bytes", url, remoteMaxBodySize)
+	}
+	return data, nil
+}
@@ -0,0 +1,72 @@
+package ruleset
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchRemote(t *testing.T) {
+	content := []byte("- name: block v2ex\n  action: block\n  expr: tls?.req?.sni == \"v2ex.com\"\n")
+	sum := sha256.Sum256(content)
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+	files := map[string][]byte{
+		"/rules.yaml":         content,
+		"/rules.yaml.sha256":  []byte(hex.EncodeToString(sum[:]) + "  rules.yaml\n"),
+		"/rules.yaml.sig":     ed25519.Sign(priv, content),
+		"/bad.sha256":         []byte("0000000000000000000000000000000000000000000000000000000000000000  rules.yaml\n"),
+		"/other.sig":          []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(otherPriv, content))),
+		"/rules.yaml.b64.sig": []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, content)) + "\n"),
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	remoteTransport = tlsSrv.Client().Transport
+	defer func() { remoteTransport = nil }()
+	publicKey := base64.StdEncoding.EncodeToString(pub)
+
+	testCases := []struct {
+		name    string
+		url     string
+		config  RemoteConfig
+		wantErr error // nil for success
+	}{
+		{"http no validation", srv.URL, RemoteConfig{}, errInsecureRemote},
+		{"https no validation", tlsSrv.URL, RemoteConfig{}, nil},
+		{"http checksum over https", srv.URL, RemoteConfig{ChecksumURL: tlsSrv.URL + "/rules.yaml.sha256"}, nil},
+		{"http checksum over http", srv.URL, RemoteConfig{ChecksumURL: srv.URL + "/rules.yaml.sha256"}, errInsecureRemote},
+		{"https checksum", tlsSrv.URL, RemoteConfig{ChecksumURL: tlsSrv.URL + "/rules.yaml.sha256"}, nil},
+		{"checksum mismatch", tlsSrv.URL, RemoteConfig{ChecksumURL: tlsSrv.URL + "/bad.sha256"}, errChecksumMismatch},
+		{"signature", srv.URL, RemoteConfig{PublicKey: publicKey}, nil},
+		{"signature with http checksum", srv.URL, RemoteConfig{ChecksumURL: srv.URL + "/rules.yaml.sha256", PublicKey: publicKey}, nil},
+		{"base64 signature", srv.URL, RemoteConfig{PublicKey: publicKey, SignatureURL: srv.URL + "/rules.yaml.b64.sig"}, nil},
+		{"bad signature", srv.URL, RemoteConfig{PublicKey: publicKey, SignatureURL: srv.URL + "/other.sig"}, errInvalidSignature},
+		{"bad public key", srv.URL, RemoteConfig{PublicKey: "bm90IGEga2V5"}, errInvalidPublicKey},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data, digest, err := FetchRemote(tc.url+"/rules.yaml", tc.config)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("FetchRemote() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && (string(data) != string(content) || digest != sum) {
+				t.Errorf("FetchRemote() = %q, %x, want %q, %x", data, digest, content, sum)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apernet/OpenGFW/ruleset/builtins"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleEntry is the external representation of a rule schedule.
+// A rule with a schedule is only evaluated while one of its ranges is active.
+type ScheduleEntry struct {
+	Timezone string               `yaml:"timezone"` // IANA name, empty = local time
+	Ranges   []ScheduleRangeEntry `yaml:"ranges"`
+}
+
+type ScheduleRangeEntry struct {
+	// Days the range starts on, e.g. ["mon", "tue"]. Empty means every day.
+	// A range that crosses midnight belongs to the day it starts on.
+	Days  []string `yaml:"days"`
+	Start string   `yaml:"start"` // HH:MM, inclusive
+	End   string   `yaml:"end"`   // HH:MM, exclusive, the same as Start for the whole day (24 hours from Start)
+}
+
+type schedule struct {
+	loc    *time.Location
+	ranges []scheduleRange
+}
+
+type scheduleRange struct {
+	days       [7]bool
+	start, end int // Minutes since midnight
+}
+
+func compileSchedule(entry ScheduleEntry) (*schedule, error) {
+	loc, err := builtins.LoadLocation(entry.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.Ranges) == 0 {
+		return nil, errors.New("schedule must have at least one range")
+	}
+	s := &schedule{loc: loc}
+	for _, r := range entry.Ranges {
+		var sr scheduleRange
+		if sr.start, err = builtins.ParseClock(r.Start); err != nil {
+			return nil, err
+		}
+		if sr.end, err = builtins.ParseClock(r.End); err != nil {
+			return nil, err
+		}
+		if len(r.Days) == 0 {
+			sr.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		for _, d := range r.Days {
+			wd, ok := weekdayNames[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", d)
+			}
+			sr.days[wd] = true
+		}
+		s.ranges = append(s.ranges, sr)
+	}
+	return s, nil
+}
+
+// Active returns whether any of the schedule's ranges contains t.
+func (s *schedule) Active(t time.Time) bool {
+	t = t.In(s.loc)
+	wd := t.Weekday()
+	m := t.Hour()*60 + t.Minute()
+	for _, r := range s.ranges {
+		if builtins.ClockInRange(m, r.start, r.end) {
+			day := wd
+			if r.start >= r.end && m < r.start {
+				// After midnight, the range started the day before
+				day = (wd + 6) % 7
+			}
+			if r.days[day] {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package ruleset
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	// 2024-06-03 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 6, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	testCases := []struct {
+		name  string
+		rng   ScheduleRangeEntry
+		times map[time.Time]bool
+	}{
+		{
+			name: "daytime",
+			rng:  ScheduleRangeEntry{Start: "09:00", End: "17:00"},
+			times: map[time.Time]bool{
+				at(3, "08:59"): false,
+				at(3, "09:00"): true,
+				at(3, "16:59"): true,
+				at(3, "17:00"): false,
+			},
+		},
+		{
+			name: "crossing midnight",
+			rng:  ScheduleRangeEntry{Days: []string{"mon"}, Start: "22:00", End: "07:00"},
+			times: map[time.Time]bool{
+				at(3, "06:00"): false, // Started on Sunday
+				at(3, "21:59"): false,
+				at(3, "22:00"): true,
+				at(3, "23:59"): true,
+				at(4, "00:00"): true, // Tuesday, but started on Monday
+				at(4, "06:59"): true,
+				at(4, "07:00"): false,
+				at(4, "22:00"): false,
+			},
+		},
+		{
+			name: "whole day",
+			rng:  ScheduleRangeEntry{Days: []string{"Mon"}, Start: "00:00", End: "00:00"},
+			times: map[time.Time]bool{
+				at(2, "23:59"): false,
+				at(3, "00:00"): true,
+				at(3, "12:00"): true,
+				at(3, "23:59"): true,
+				at(4, "00:00"): false,
+			},
+		},
+		{
+			name: "whole day from noon",
+			rng:  ScheduleRangeEntry{Days: []string{"mon"}, Start: "12:00", End: "12:00"},
+			times: map[time.Time]bool{
+				at(3, "11:59"): false,
+				at(3, "12:00"): true,
+				at(4, "11:59"): true,
+				at(4, "12:00"): false,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := compileSchedule(ScheduleEntry{Timezone: "UTC", Ranges: []ScheduleRangeEntry{tc.rng}})
+			if err != nil {
+				t.Fatalf("compileSchedule() error = %v", err)
+			}
+			for tm, want := range tc.times {
+				if got := s.Active(tm); got != want {
+					t.Errorf("Active(%s) = %v, want %v", tm.Format("Mon 15:04"), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleTimezone(t *testing.T) {
+	s, err := compileSchedule(ScheduleEntry{
+		Timezone: "Asia/Tokyo", // UTC+9, without DST
+		Ranges:   []ScheduleRangeEntry{{Days: []string{"tue"}, Start: "08:00", End: "09:00"}},
+	})
+	if err != nil {
+		t.Fatalf("compileSchedule() error = %v", err)
+	}
+	// Monday 23:30 UTC is Tuesday 08:30 in Tokyo
+	if tm := time.Date(2024, 6, 3, 23, 30, 0, 0, time.UTC); !s.Active(tm) {
+		t.Errorf("Active(%s) = false, want true", tm)
+	}
+}
+
+func TestCompileSchedule_Invalid(t *testing.T) {
+	for name, entry := range map[string]ScheduleEntry{
+		"no ranges":    {},
+		"bad start":    {Ranges: []ScheduleRangeEntry{{Start: "25:00", End: "07:00"}}},
+		"bad end":      {Ranges: []ScheduleRangeEntry{{Start: "22:00", End: "7pm"}}},
+		"bad day":      {Ranges: []ScheduleRangeEntry{{Days: []string{"funday"}, Start: "22:00", End: "07:00"}}},
+		"bad timezone": {Timezone: "Mars/Olympus", Ranges: []ScheduleRangeEntry{{Start: "22:00", End: "07:00"}}},
+	} {
+		if _, err := compileSchedule(entry); err == nil {
+			t.Errorf("%s: compileSchedule() error = nil, want error", name)
+		}
+	}
+}
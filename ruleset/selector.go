@@ -0,0 +1,104 @@
+package ruleset
+
+import (
+	"net"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+// RulesetSelector selects a ruleset for the streams of some clients.
+// A stream matches if its source IP is in one of the Subnets, it was received on
+// one of the Interfaces, and it came from one of the IOs. Any can be empty to match any.
+type RulesetSelector struct {
+	Name       string
+	Subnets    []*net.IPNet
+	Interfaces []string
+	IOs        []string
+	Ruleset    Ruleset
+}
+
+func (s *RulesetSelector) match(info StreamInfo) bool {
+	if len(s.Subnets) > 0 {
+		found := false
+		for _, n := range s.Subnets {
+			if n.Contains(info.SrcIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.Interfaces) > 0 {
+		found := false
+		for _, i := range s.Interfaces {
+			if i == info.InInterface {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(s.IOs) > 0 {
+		found := false
+		for _, name := range s.IOs {
+			if name == info.IO {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+var _ Ruleset = (*selectorRuleset)(nil)
+
+type selectorRuleset struct {
+	Default   Ruleset
+	Selectors []RulesetSelector
+}
+
+// NewSelectorRuleset returns a ruleset that hands each stream to the ruleset of the first
+// selector that matches it, or to the default ruleset if none does.
+func NewSelectorRuleset(def Ruleset, selectors []RulesetSelector) Ruleset {
+	return &selectorRuleset{
+		Default:   def,
+		Selectors: selectors,
+	}
+}
+
+func (r *selectorRuleset) selectRuleset(info StreamInfo) Ruleset {
+	for i := range r.Selectors {
+		if r.Selectors[i].match(info) {
+			return r.Selectors[i].Ruleset
+		}
+	}
+	return r.Default
+}
+
+func (r *selectorRuleset) Analyzers(info StreamInfo) []analyzer.Analyzer {
+	return r.selectRuleset(info).Analyzers(info)
+}
+
+func (r *selectorRuleset) Match(info StreamInfo) MatchResult {
+	return r.selectRuleset(info).Match(info)
+}
+
+// Stats returns the statistics of the default ruleset, followed by those of
+// the selected rulesets with their rule names prefixed by "<selector name>/".
+func (r *selectorRuleset) Stats() []RuleStatsSnapshot {
+	stats := r.Default.Stats()
+	for _, s := range r.Selectors {
+		for _, ss := range s.Ruleset.Stats() {
+			ss.Name = s.Name + "/" + ss.Name
+			stats = append(stats, ss)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,139 @@
+package ruleset
+
+import (
+	"time"
+
+	"github.com/expr-lang/expr/vm"
+)
+
+// Simulator is implemented by rulesets that can explain how they match a stream.
+type Simulator interface {
+	// Simulate matches a stream like Match, and reports every rule evaluated along the way.
+	// Unlike Match, it doesn't update the rule statistics, log, notify or report dry-run matches,
+	// but functions with side effects of their own (track) still record.
+	// It must be safe for concurrent use.
+	Simulate(StreamInfo) Simulation
+}
+
+// Simulation is the result of Simulate.
+type Simulation struct {
+	Selector string // Name of the selected ruleset, empty for the default one
+	Rules    []RuleEvaluation
+	Result   MatchResult
+}
+
+// RuleEvaluation is a rule evaluated by Simulate. Unlike Match, Simulate evaluates
+// all the rules of a group, including those after the one that decided the verdict.
+// The rules of a group follow the jump rule that matched it.
+type RuleEvaluation struct {
+	Name     string
+	Group    string // Empty for the main group
+	Inactive bool   // Outside its lifetime or schedule, not evaluated
+	Error    string // Error evaluating the expression
+	Matched  bool
+	Action   string // Action of the rule, empty for jump, return & log-only rules
+	DryRun   bool
+	Jump     string
+	Return   bool
+	Decisive bool // The first rule with an action that matched, which the result is from
+}
+
+var (
+	_ Simulator = (*exprRuleset)(nil)
+	_ Simulator = (*selectorRuleset)(nil)
+)
+
+func (r *exprRuleset) Simulate(info StreamInfo) Simulation {
+	now := time.Now()
+	s := &simulation{r: r, info: info, env: r.exprEnv(info, now), now: now}
+	result, ok := s.group("", false)
+	if !ok {
+		result = MatchResult{Action: ActionMaybe}
+	}
+	return Simulation{Rules: s.evals, Result: result}
+}
+
+func (r *selectorRuleset) Simulate(info StreamInfo) Simulation {
+	for i := range r.Selectors {
+		if r.Selectors[i].match(info) {
+			sim := Simulate(r.Selectors[i].Ruleset, info)
+			sim.Selector = r.Selectors[i].Name
+			return sim
+		}
+	}
+	return Simulate(r.Default, info)
+}
+
+// Simulate simulates rs if it's a Simulator, or only returns the result of Match otherwise.
+func Simulate(rs Ruleset, info StreamInfo) Simulation {
+	if s, ok := rs.(Simulator); ok {
+		return s.Simulate(info)
+	}
+	return Simulation{Result: rs.Match(info)}
+}
+
+type simulation struct {
+	r     *exprRuleset
+	info  StreamInfo
+	env   map[string]interface{}
+	now   time.Time
+	evals []RuleEvaluation
+}
+
+// group evaluates the rules of a group like matchGroup does, but all of them.
+// decided is whether the verdict was already decided before the group was jumped to.
+func (s *simulation) group(name string, decided bool) (MatchResult, bool) {
+	var result MatchResult
+	found, returned := false, false
+	for _, rule := range s.r.Groups[name] {
+		ev := RuleEvaluation{
+			Name:   rule.Name,
+			Group:  name,
+			DryRun: rule.DryRun,
+			Jump:   rule.Jump,
+			Return: rule.Return,
+		}
+		if rule.Action != nil && rule.Jump == "" {
+			ev.Action = rule.Action.String()
+		}
+		if !rule.active(s.now) {
+			ev.Inactive = true
+			s.evals = append(s.evals, ev)
+			continue
+		}
+		v, err := vm.Run(rule.Program, s.env)
+		if err != nil {
+			ev.Error = err.Error()
+			s.evals = append(s.evals, ev)
+			continue
+		}
+		ev.Matched, _ = v.(bool)
+		idx := len(s.evals)
+		s.evals = append(s.evals, ev)
+		if !ev.Matched {
+			continue
+		}
+		done := decided || found || returned
+		switch {
+		case rule.Jump != "":
+			if r, ok := s.group(rule.Jump, done); ok && !done {
+				result, found = r, true
+			}
+		case rule.Return:
+			returned = returned || !done
+		case rule.Action != nil && !rule.DryRun && !done:
+			result, found = MatchResult{
+				Action:      *rule.Action,
+				RuleName:    rule.Name,
+				ModInstance: rule.ModInstance,
+				RateLimiter: rule.RateLimiter,
+				Mark:        rule.Mark,
+				Tarpit:      rule.Tarpit,
+				Quota:       rule.Quota,
+				Stats:       rule.Stats,
+			}, true
+			s.evals[idx].Decisive = true
+		}
+	}
+	return result, found
+}
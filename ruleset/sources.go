@@ -0,0 +1,9 @@
+package ruleset
+
+import "embed"
+
+// Sources are the source files of the types of the rule files. Their doc comments are the descriptions
+// of the JSON Schema generated by "opengfw config-schema", which must not go out of sync with the types.
+//
+//go:embed expr.go functions.go interface.go quota.go ratelimit.go schedule.go
+var Sources embed.FS
@@ -0,0 +1,47 @@
+package ruleset
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RuleStats holds the runtime statistics of a rule.
+// It is safe for concurrent use.
+type RuleStats struct {
+	hits    atomic.Uint64
+	bytes   atomic.Uint64
+	lastHit atomic.Int64 // Unix nanoseconds, 0 if never hit
+}
+
+// Hit counts a stream on which the action of the rule took effect, at time t.
+func (s *RuleStats) Hit(t time.Time) {
+	s.hits.Add(1)
+	s.lastHit.Store(t.UnixNano())
+}
+
+// AddBytes adds to the number of bytes seen on streams that were
+// given a verdict by the rule.
+func (s *RuleStats) AddBytes(n int) {
+	s.bytes.Add(uint64(n))
+}
+
+func (s *RuleStats) snapshot(name string) RuleStatsSnapshot {
+	ss := RuleStatsSnapshot{
+		Name:  name,
+		Hits:  s.hits.Load(),
+		Bytes: s.bytes.Load(),
+	}
+	if t := s.lastHit.Load(); t != 0 {
+		ss.LastHit = time.Unix(0, t)
+	}
+	return ss
+}
+
+// RuleStatsSnapshot is a point-in-time copy of the statistics of a rule.
+type RuleStatsSnapshot struct {
+	Name    string    `json:"name"`
+	Hits    uint64    `json:"hits"`
+	Bytes   uint64    `json:"bytes"`
+	LastHit time.Time `json:"lastHit"` // Zero if never hit
+	Expired bool      `json:"expired,omitempty"`
+}
@@ -0,0 +1,241 @@
+package ruleset
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apernet/OpenGFW/analyzer"
+)
+
+const (
+	webhookDefaultTimeout    = 10 * time.Second
+	webhookDefaultRetryDelay = time.Second
+	webhookDefaultQueueSize  = 1024
+)
+
+var errWebhookQueueFull = errors.New("webhook queue full, event dropped")
+
+// NotifyEvent is sent to the notifier when a rule with notify enabled matches.
+// It is also the JSON body POSTed by Webhook.
+type NotifyEvent struct {
+	Time     time.Time                `json:"time"`
+	Rule     string                   `json:"rule"`
+	Action   string                   `json:"action,omitempty"` // empty if the rule has no action
+	DryRun   bool                     `json:"dryRun,omitempty"`
+	ID       int64                    `json:"id"`
+	UUID     string                   `json:"uuid"`
+	Protocol string                   `json:"proto"`
+	SrcIP    net.IP                   `json:"srcIP"`
+	SrcPort  uint16                   `json:"srcPort"`
+	DstIP    net.IP                   `json:"dstIP"`
+	DstPort  uint16                   `json:"dstPort"`
+	Props    analyzer.CombinedPropMap `json:"props,omitempty"`
+}
+
+func newNotifyEvent(rule *compiledExprRule, info StreamInfo, now time.Time) NotifyEvent {
+	ev := NotifyEvent{
+		Time:     now,
+		Rule:     rule.Name,
+		DryRun:   rule.DryRun,
+		ID:       info.ID,
+		UUID:     info.UUID,
+		Protocol: info.Protocol.String(),
+		SrcIP:    info.SrcIP,
+		SrcPort:  info.SrcPort,
+		DstIP:    info.DstIP,
+		DstPort:  info.DstPort,
+	}
+	if rule.Action != nil {
+		ev.Action = rule.Action.String()
+	}
+	if rule.LogProps {
+		ev.Props = info.Props
+	}
+	return ev
+}
+
+// WebhookConfig is the configuration of a Webhook.
+type WebhookConfig struct {
+	URL     string
+	Headers map[string]string
+	// Timeout for each HTTP request. Zero means the default (10s).
+	Timeout time.Duration
+	// Retries is the number of times a failed request is retried,
+	// waiting RetryDelay (default 1s) before the first retry and doubling it after each.
+	// Client errors (4xx other than 429) are not retried.
+	Retries    int
+	RetryDelay time.Duration
+	// RateLimit is the maximum number of events sent per second, 0 = unlimited.
+	// Events over the limit are dropped. Burst defaults to RateLimit (at least 1).
+	RateLimit float64
+	Burst     int
+	// QueueSize is the number of events waiting to be sent, after which new ones are dropped.
+	// Zero means the default (1024).
+	QueueSize int
+	// ErrorFunc, if set, is called with the errors of events that failed to be sent.
+	// The event's Props are not set, as they may have changed since.
+	ErrorFunc func(ev NotifyEvent, err error)
+}
+
+type webhookEvent struct {
+	Event NotifyEvent // Without Props
+	Body  []byte
+}
+
+// Webhook is a Notifier that POSTs the events as JSON to a URL in the background.
+type Webhook struct {
+	config WebhookConfig
+	client *http.Client
+	queue  chan webhookEvent
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mutex  sync.Mutex // Protects the token bucket
+	tokens float64
+	last   time.Time
+}
+
+func NewWebhook(config WebhookConfig) (*Webhook, error) {
+	if !IsRemoteSource(config.URL) {
+		return nil, fmt.Errorf("invalid webhook URL %q", config.URL)
+	}
+	if config.Retries < 0 || config.RateLimit < 0 || config.Burst < 0 || config.QueueSize < 0 {
+		return nil, errors.New("retries, rate limit, burst and queue size must not be negative")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = webhookDefaultTimeout
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = webhookDefaultRetryDelay
+	}
+	if config.Burst == 0 {
+		config.Burst = int(config.RateLimit)
+		if config.Burst < 1 {
+			config.Burst = 1
+		}
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = webhookDefaultQueueSize
+	}
+	w := &Webhook{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		queue:  make(chan webhookEvent, config.QueueSize),
+		done:   make(chan struct{}),
+		tokens: float64(config.Burst),
+		last:   time.Now(),
+	}
+	w.wg.Add(1)
+	go w.worker()
+	return w, nil
+}
+
+// Notify queues an event to be sent. It never blocks.
+func (w *Webhook) Notify(ev NotifyEvent) {
+	if !w.allow() {
+		return
+	}
+	// Marshal now, as the props are updated by the stream's analyzers
+	body, err := json.Marshal(ev)
+	ev.Props = nil
+	if err != nil {
+		w.reportError(ev, err)
+		return
+	}
+	select {
+	case w.queue <- webhookEvent{Event: ev, Body: body}:
+	default:
+		w.reportError(ev, errWebhookQueueFull)
+	}
+}
+
+// allow takes a token from the bucket if rate limiting is enabled.
+func (w *Webhook) allow() bool {
+	if w.config.RateLimit <= 0 {
+		return true
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := time.Now()
+	w.tokens += now.Sub(w.last).Seconds() * w.config.RateLimit
+	if w.tokens > float64(w.config.Burst) {
+		w.tokens = float64(w.config.Burst)
+	}
+	w.last = now
+	if w.tokens < 1 {
+		return false
+	}
+	w.tokens--
+	return true
+}
+
+func (w *Webhook) worker() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev := <-w.queue:
+			if err := w.send(ev.Body); err != nil {
+				w.reportError(ev.Event, err)
+			}
+		}
+	}
+}
+
+func (w *Webhook) send(body []byte) error {
+	delay := w.config.RetryDelay
+	for i := 0; ; i++ {
+		retry, err := w.post(body)
+		if err == nil || !retry || i >= w.config.Retries {
+			return err
+		}
+		select {
+		case <-w.done:
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends the body once, and returns whether it should be retried if it failed.
+func (w *Webhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func (w *Webhook) reportError(ev NotifyEvent, err error) {
+	if w.config.ErrorFunc != nil {
+		w.config.ErrorFunc(ev, err)
+	}
+}
+
+// Close stops sending events. Queued events that haven't been sent are discarded.
+func (w *Webhook) Close() error {
+	close(w.done)
+	w.wg.Wait()
+	return nil
+}
@@ -0,0 +1,102 @@
+package ruleset
+
+import (
+	"net"
+)
+
+// Workload is the Kubernetes object an IP address belongs to.
+type Workload struct {
+	Kind      string // Pod or Service
+	Namespace string
+	Name      string
+	Labels    map[string]string
+}
+
+// WorkloadResolver maps IP addresses to the workloads they belong to, see BuiltinConfig.Workloads.
+type WorkloadResolver interface {
+	// Workload returns the workload ip belongs to, or nil if it's unknown.
+	// It's called for every stream matched, so it must be fast, and safe for concurrent use.
+	Workload(ip net.IP) *Workload
+}
+
+// workloadsToExprEnv returns the k8s variable of the rules: the workload of the source of the stream,
+// with the same for the source and destination in src & dst. The fields are empty for unknown IPs.
+func workloadsToExprEnv(r WorkloadResolver, info StreamInfo) map[string]interface{} {
+	src, dst := workloadToExprEnv(r.Workload(info.SrcIP)), workloadToExprEnv(r.Workload(info.DstIP))
+	m := make(map[string]interface{}, len(src)+2)
+	for k, v := range src {
+		m[k] = v
+	}
+	m["src"] = src
+	m["dst"] = dst
+	return m
+}
+
+func workloadToExprEnv(w *Workload) map[string]interface{} {
+	if w == nil {
+		return map[string]interface{}{
+			"kind":      "",
+			"namespace": "",
+			"name":      "",
+			"labels":    map[string]string{},
+		}
+	}
+	labels := w.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return map[string]interface{}{
+		"kind":      w.Kind,
+		"namespace": w.Namespace,
+		"name":      w.Name,
+		"labels":    labels,
+	}
+}
+
+// Container is the Docker container an IP address belongs to.
+type Container struct {
+	ID     string
+	Name   string // Without the leading slash
+	Image  string
+	Labels map[string]string
+}
+
+// ContainerResolver maps IP addresses to the containers they belong to, see BuiltinConfig.Containers.
+type ContainerResolver interface {
+	// Container returns the container ip belongs to, or nil if it's unknown.
+	// It's called for every stream matched, so it must be fast, and safe for concurrent use.
+	Container(ip net.IP) *Container
+}
+
+// containersToExprEnv returns the container variable of the rules, like workloadsToExprEnv.
+func containersToExprEnv(r ContainerResolver, info StreamInfo) map[string]interface{} {
+	src, dst := containerToExprEnv(r.Container(info.SrcIP)), containerToExprEnv(r.Container(info.DstIP))
+	m := make(map[string]interface{}, len(src)+2)
+	for k, v := range src {
+		m[k] = v
+	}
+	m["src"] = src
+	m["dst"] = dst
+	return m
+}
+
+func containerToExprEnv(c *Container) map[string]interface{} {
+	if c == nil {
+		return map[string]interface{}{
+			"id":     "",
+			"name":   "",
+			"image":  "",
+			"labels": map[string]string{},
+		}
+	}
+	labels := c.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return map[string]interface{}{
+		"id":     c.ID,
+		"name":   c.Name,
+		"image":  c.Image,
+		"labels": labels,
+	}
+}
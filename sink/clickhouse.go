@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	chDefaultDatabase = "default"
+	chDefaultTable    = "opengfw_events"
+	chDefaultEngine   = "MergeTree ORDER BY tuple()"
+	// chRawColumn is the column with the whole event, so that nothing is lost
+	// for the fields that don't have a column.
+	chRawColumn = "raw"
+)
+
+var _ Sink = (*ClickHouse)(nil)
+
+// ClickHouseColumn is a column of the table of a ClickHouse sink. It's filled with the event field
+// of the same name, the dotted path for nested fields (e.g. "alert.signature").
+type ClickHouseColumn struct {
+	Name string
+	Type string // e.g. "LowCardinality(String)"
+}
+
+// ClickHouseConfig is the configuration of a ClickHouse sink.
+type ClickHouseConfig struct {
+	URL      string // HTTP interface, e.g. http://localhost:8123
+	Database string // Default "default"
+	Table    string // Default "opengfw_events"
+	Username string
+	Password string
+	TLS      *tls.Config
+	Timeout  time.Duration // For each request. Zero means the default (30s)
+	// Columns of the table, in addition to the "raw" column with the whole event (String).
+	// The table is created if it doesn't exist, and the missing columns are added if it does,
+	// before the first events are inserted.
+	Columns []ClickHouseColumn
+	// Engine of the table when it's created, e.g. "MergeTree ORDER BY timestamp".
+	// Default "MergeTree ORDER BY tuple()".
+	Engine string
+	Batch  BatchConfig
+}
+
+// ClickHouse is a sink that inserts the events into a ClickHouse table, over the HTTP interface
+// in the JSONEachRow format.
+type ClickHouse struct {
+	config  ClickHouseConfig
+	batcher *batcher
+	client  *httpClient
+	insert  string // URL of the insert query
+
+	schemaReady bool // Only used by the batcher's worker
+}
+
+func NewClickHouse(config ClickHouseConfig) (*ClickHouse, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", config.URL)
+	}
+	if config.Database == "" {
+		config.Database = chDefaultDatabase
+	}
+	if config.Table == "" {
+		config.Table = chDefaultTable
+	}
+	if config.Engine == "" {
+		config.Engine = chDefaultEngine
+	}
+	for _, c := range config.Columns {
+		if c.Name == "" || c.Type == "" || c.Name == chRawColumn {
+			return nil, fmt.Errorf("invalid column %q", c.Name)
+		}
+	}
+	if config.Username == "" && config.Password != "" {
+		return nil, errors.New("password without username")
+	}
+	c := &ClickHouse{
+		config: config,
+		client: newHTTPClient(config.Timeout, config.TLS),
+	}
+	if config.Username != "" {
+		c.client.headers["X-ClickHouse-User"] = config.Username
+		c.client.headers["X-ClickHouse-Key"] = config.Password
+	}
+	q := u.Query()
+	q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.tableName()))
+	q.Set("date_time_input_format", "best_effort")
+	q.Set("input_format_skip_unknown_fields", "1")
+	u.RawQuery = q.Encode()
+	c.insert = u.String()
+	b, err := newBatcher(config.Batch, c.flush)
+	if err != nil {
+		return nil, err
+	}
+	c.batcher = b
+	return c, nil
+}
+
+func (c *ClickHouse) Send(ev Event) {
+	c.batcher.Send(ev)
+}
+
+func (c *ClickHouse) Check() error {
+	return c.batcher.Check()
+}
+
+func (c *ClickHouse) Close() error {
+	c.batcher.Close()
+	return nil
+}
+
+func (c *ClickHouse) flush(events []Event) ([]Event, error) {
+	if !c.schemaReady {
+		if err := c.setupSchema(); err != nil {
+			return events, fmt.Errorf("failed to set up table: %w", err)
+		}
+		c.schemaReady = true
+	}
+	var body bytes.Buffer
+	for _, ev := range events {
+		row := map[string]interface{}{chRawColumn: string(ev.Data)}
+		if fields, err := flattenJSON(ev.Data); err == nil {
+			for _, col := range c.config.Columns {
+				if v, ok := fields[col.Name]; ok {
+					row[col.Name] = v
+				}
+			}
+		}
+		bs, err := json.Marshal(row)
+		if err != nil {
+			continue
+		}
+		body.Write(bs)
+		body.WriteByte('\n')
+	}
+	if _, err := c.client.do(http.MethodPost, c.insert, "", body.Bytes()); err != nil {
+		return events, err
+	}
+	return nil, nil
+}
+
+// setupSchema creates the table, or adds its missing columns.
+func (c *ClickHouse) setupSchema() error {
+	cols := make([]string, 0, len(c.config.Columns)+1)
+	for _, col := range c.config.Columns {
+		cols = append(cols, chQuoteIdent(col.Name)+" "+col.Type)
+	}
+	cols = append(cols, chQuoteIdent(chRawColumn)+" String")
+	create := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s) ENGINE = %s",
+		c.tableName(), strings.Join(cols, ", "), c.config.Engine)
+	if _, err := c.client.do(http.MethodPost, c.config.URL, "", []byte(create)); err != nil {
+		return err
+	}
+	adds := make([]string, len(cols))
+	for i, col := range cols {
+		adds[i] = "ADD COLUMN IF NOT EXISTS " + col
+	}
+	alter := fmt.Sprintf("ALTER TABLE %s %s", c.tableName(), strings.Join(adds, ", "))
+	_, err := c.client.do(http.MethodPost, c.config.URL, "", []byte(alter))
+	return err
+}
+
+func (c *ClickHouse) tableName() string {
+	return chQuoteIdent(c.config.Database) + "." + chQuoteIdent(c.config.Table)
+}
+
+func chQuoteIdent(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
@@ -0,0 +1,178 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	esDefaultIndex     = "opengfw-{date}"
+	esDateLayout       = "2006.01.02"
+	esTemplatePriority = 200
+)
+
+var _ Sink = (*Elasticsearch)(nil)
+
+// ElasticsearchConfig is the configuration of an Elasticsearch sink.
+type ElasticsearchConfig struct {
+	URL string // e.g. https://localhost:9200
+	// Index the events are written to. "{date}" is replaced by the date of the event (UTC, YYYY.MM.DD),
+	// for daily indices. Default "opengfw-{date}".
+	Index string
+	// Username & Password for basic auth, or APIKey (base64 encoded). Optional.
+	Username string
+	Password string
+	APIKey   string
+	TLS      *tls.Config
+	Timeout  time.Duration // For each request. Zero means the default (30s)
+	// Mappings of the index template installed for the index (with "{date}" replaced by "*"),
+	// before the first events are written. nil for none, then the mappings are dynamic.
+	Mappings map[string]interface{}
+	Batch    BatchConfig
+}
+
+// Elasticsearch is a sink that indexes the events with the bulk API.
+// Documents rejected because of the cluster's load (429) or errors of the node are retried,
+// the others (e.g. mapping conflicts) are dropped.
+type Elasticsearch struct {
+	config  ElasticsearchConfig
+	batcher *batcher
+	client  *httpClient
+
+	templateInstalled bool // Only used by the batcher's worker
+}
+
+func NewElasticsearch(config ElasticsearchConfig) (*Elasticsearch, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", config.URL)
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Index == "" {
+		config.Index = esDefaultIndex
+	}
+	if config.Index != strings.ToLower(config.Index) || strings.ContainsAny(config.Index, ` "*\/<>|,#?`) {
+		return nil, fmt.Errorf("invalid index %q", config.Index)
+	}
+	if config.APIKey != "" && config.Username != "" {
+		return nil, errors.New("only one of api key and username can be set")
+	}
+	e := &Elasticsearch{
+		config: config,
+		client: newHTTPClient(config.Timeout, config.TLS),
+	}
+	e.client.username, e.client.password = config.Username, config.Password
+	if config.APIKey != "" {
+		e.client.headers["Authorization"] = "ApiKey " + config.APIKey
+	}
+	e.templateInstalled = config.Mappings == nil
+	b, err := newBatcher(config.Batch, e.flush)
+	if err != nil {
+		return nil, err
+	}
+	e.batcher = b
+	return e, nil
+}
+
+func (e *Elasticsearch) Send(ev Event) {
+	e.batcher.Send(ev)
+}
+
+func (e *Elasticsearch) Check() error {
+	return e.batcher.Check()
+}
+
+func (e *Elasticsearch) Close() error {
+	e.batcher.Close()
+	return nil
+}
+
+func (e *Elasticsearch) flush(events []Event) ([]Event, error) {
+	if !e.templateInstalled {
+		if err := e.installTemplate(); err != nil {
+			return events, fmt.Errorf("failed to install index template: %w", err)
+		}
+		e.templateInstalled = true
+	}
+	var body bytes.Buffer
+	for _, ev := range events {
+		t := ev.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		index := strings.ReplaceAll(e.config.Index, "{date}", t.UTC().Format(esDateLayout))
+		action, _ := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": index}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(ev.Data)
+		body.WriteByte('\n')
+	}
+	respBody, err := e.client.do(http.MethodPost, e.config.URL+"/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return events, err
+	}
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return events, err
+	}
+	if !resp.Errors {
+		return nil, nil
+	}
+	var failed, rejected []Event
+	var firstErr string
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Status < 300 || i >= len(events) {
+				continue
+			}
+			if firstErr == "" {
+				firstErr = result.Error.Type + ": " + result.Error.Reason
+			}
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				failed = append(failed, events[i])
+			} else {
+				rejected = append(rejected, events[i])
+			}
+		}
+	}
+	err = fmt.Errorf("elasticsearch: %d documents failed, %d rejected (%s)", len(failed), len(rejected), firstErr)
+	if len(failed) == 0 {
+		return rejected, permanentError{Err: err}
+	}
+	return failed, err
+}
+
+func (e *Elasticsearch) installTemplate() error {
+	name := strings.Trim(strings.ReplaceAll(e.config.Index, "{date}", ""), "-_.")
+	if name == "" {
+		name = "opengfw"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": []string{strings.ReplaceAll(e.config.Index, "{date}", "*")},
+		"priority":       esTemplatePriority,
+		"template": map[string]interface{}{
+			"mappings": e.config.Mappings,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = e.client.do(http.MethodPut, e.config.URL+"/_index_template/"+url.PathEscape(name), "application/json", body)
+	return err
+}
@@ -0,0 +1,217 @@
+package sink
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileRotatedTimeFormat = "20060102-150405.000000"
+
+var _ Sink = (*File)(nil)
+
+// FileConfig is the configuration of a File sink.
+type FileConfig struct {
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated. 0 = never.
+	MaxSize int64
+	// Interval is how often the file is rotated, from when it's opened. 0 = never.
+	Interval time.Duration
+	// MaxFiles is the number of rotated files to keep, the oldest ones are deleted. 0 = unlimited.
+	MaxFiles int
+	// MaxAge is how long rotated files are kept. 0 = forever.
+	MaxAge time.Duration
+	// Compress is the compression of rotated files: "gzip", or "" for none.
+	Compress string
+}
+
+// File appends the events to a file as newline-delimited JSON.
+// Events are written synchronously, as appending to a file is cheap.
+//
+// With rotation enabled, the file is renamed with the time of the rotation appended
+// (e.g. eve.json.20240102-150405.000000), then compressed & pruned in the background,
+// and a new file is started under the original name.
+type File struct {
+	config FileConfig
+
+	mutex    sync.Mutex
+	file     *os.File
+	err      error     // Of the latest write
+	size     int64     // Of the current file
+	rotateAt time.Time // Zero if not rotated by time
+
+	cleanupMutex sync.Mutex // Serializes the compression & pruning of rotated files
+	cleanupWG    sync.WaitGroup
+}
+
+func NewFile(config FileConfig) (*File, error) {
+	if config.MaxSize < 0 || config.Interval < 0 || config.MaxFiles < 0 || config.MaxAge < 0 {
+		return nil, fmt.Errorf("rotation limits must not be negative")
+	}
+	switch config.Compress {
+	case "", "gzip":
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", config.Compress)
+	}
+	f := &File{config: config}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reopen reopens the file, for log rotation by an external tool.
+func (f *File) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.open()
+}
+
+// open (re)opens the file. The mutex must be held.
+func (f *File) open() error {
+	file, err := os.OpenFile(f.config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+	if f.file != nil {
+		_ = f.file.Close()
+	}
+	f.file, f.size = file, size
+	if f.config.Interval > 0 {
+		f.rotateAt = time.Now().Add(f.config.Interval)
+	}
+	return nil
+}
+
+func (f *File) Send(ev Event) {
+	line := make([]byte, len(ev.Data)+1)
+	copy(line, ev.Data)
+	line[len(ev.Data)] = '\n'
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.needsRotation(len(line)) {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the current file
+			f.err = err
+		}
+	}
+	var n int
+	n, f.err = f.file.Write(line)
+	f.size += int64(n)
+}
+
+// needsRotation returns whether the file must be rotated before writing n bytes. The mutex must be held.
+func (f *File) needsRotation(n int) bool {
+	if f.config.MaxSize > 0 && f.size > 0 && f.size+int64(n) > f.config.MaxSize {
+		return true
+	}
+	return !f.rotateAt.IsZero() && !time.Now().Before(f.rotateAt)
+}
+
+// rotate renames the current file and opens a new one. The mutex must be held.
+func (f *File) rotate() error {
+	rotated := f.config.Path + "." + time.Now().Format(fileRotatedTimeFormat)
+	if err := os.Rename(f.config.Path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.cleanupWG.Add(1)
+	go func() {
+		defer f.cleanupWG.Done()
+		f.cleanup(rotated)
+	}()
+	return nil
+}
+
+// cleanup compresses a rotated file, and deletes the rotated files over the limits.
+func (f *File) cleanup(rotated string) {
+	f.cleanupMutex.Lock()
+	defer f.cleanupMutex.Unlock()
+	if f.config.Compress == "gzip" {
+		_ = gzipFile(rotated)
+	}
+	if f.config.MaxFiles <= 0 && f.config.MaxAge <= 0 {
+		return
+	}
+	files, err := filepath.Glob(f.config.Path + ".*")
+	if err != nil {
+		return
+	}
+	rotatedFiles := files[:0]
+	for _, name := range files {
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, f.config.Path+"."), ".gz")
+		if _, err := time.Parse(fileRotatedTimeFormat, ts); err == nil {
+			rotatedFiles = append(rotatedFiles, name)
+		}
+	}
+	// The timestamp format sorts chronologically
+	sort.Strings(rotatedFiles)
+	for i, name := range rotatedFiles {
+		if f.config.MaxFiles > 0 && len(rotatedFiles)-i > f.config.MaxFiles {
+			_ = os.Remove(name)
+			continue
+		}
+		if f.config.MaxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.config.MaxAge {
+				_ = os.Remove(name)
+			}
+		}
+	}
+}
+
+// Check returns the error of the latest write, e.g. if the disk is full.
+func (f *File) Check() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+func (f *File) Close() error {
+	f.mutex.Lock()
+	err := f.file.Close()
+	f.mutex.Unlock()
+	f.cleanupWG.Wait()
+	return err
+}
+
+// gzipFile compresses a file to name.gz, and deletes it once done.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := name + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
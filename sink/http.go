@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	httpDefaultTimeout = 30 * time.Second
+	httpMaxErrorBody   = 512
+)
+
+// httpClient sends the requests of the HTTP based sinks.
+type httpClient struct {
+	client  *http.Client
+	headers map[string]string
+	// Basic auth, if username is set
+	username string
+	password string
+}
+
+func newHTTPClient(timeout time.Duration, tlsConfig *tls.Config) *httpClient {
+	if timeout <= 0 {
+		timeout = httpDefaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &httpClient{
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+		headers: make(map[string]string),
+	}
+}
+
+// do sends a request and returns the response body if the status is 2xx. Otherwise,
+// the error is a permanentError if retrying won't help (4xx other than 408 & 429).
+func (c *httpClient) do(method, url, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, permanentError{Err: err}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return respBody, nil
+	}
+	msg := strings.TrimSpace(string(respBody))
+	if len(msg) > httpMaxErrorBody {
+		msg = msg[:httpMaxErrorBody]
+	}
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, msg)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, permanentError{Err: err}
+	}
+	return nil, err
+}
@@ -0,0 +1,616 @@
+package sink
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	kafkaAPIProduce          = 0
+	kafkaAPIMetadata         = 3
+	kafkaAPISaslHandshake    = 17
+	kafkaAPISaslAuthenticate = 36
+
+	kafkaDefaultTimeout  = 10 * time.Second
+	kafkaDefaultClientID = "OpenGFW"
+	kafkaMetadataMaxAge  = 5 * time.Minute
+	kafkaMaxResponseSize = 16 * 1024 * 1024
+)
+
+// Kafka acks, the acknowledgements the partition leader waits for before answering.
+const (
+	KafkaAcksNone   int16 = 0  // Don't wait for any answer
+	KafkaAcksLeader int16 = 1  // Written by the leader
+	KafkaAcksAll    int16 = -1 // Written by all in-sync replicas
+)
+
+var (
+	_ Sink = (*Kafka)(nil)
+
+	kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errKafkaShortResponse = errors.New("kafka: short response")
+	errKafkaNoLeader      = errors.New("kafka: partition has no leader")
+)
+
+var kafkaErrorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	35: "UNSUPPORTED_VERSION",
+	58: "SASL_AUTHENTICATION_FAILED",
+}
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[int16(e)]; ok {
+		return "kafka: " + name
+	}
+	return "kafka: error code " + strconv.Itoa(int(e))
+}
+
+// KafkaConfig is the configuration of a Kafka sink.
+type KafkaConfig struct {
+	Brokers []string // Bootstrap brokers, host:port
+	Topic   string
+	Acks    int16 // KafkaAcksNone, KafkaAcksLeader or KafkaAcksAll
+	// Timeout for connecting, each request, and the acknowledgements of the replicas.
+	// Zero means the default (10s).
+	Timeout  time.Duration
+	ClientID string      // Default "OpenGFW"
+	TLS      *tls.Config // nil for plaintext
+	// Username & Password enable SASL/PLAIN authentication.
+	Username string
+	Password string
+	Batch    BatchConfig
+}
+
+// Kafka is a sink that produces the events to a Kafka topic, each as a record with the event's key.
+// Events with a key go to the partition chosen like the default partitioner of the Java client
+// (murmur2 of the key), so that they stay in order and consumers agree on it; the rest are spread
+// over the partitions. Only the Kafka protocol versions supported since Kafka 1.0 are used,
+// without compression, idempotence or transactions.
+type Kafka struct {
+	config  KafkaConfig
+	batcher *batcher
+
+	// Only used by the batcher's worker
+	brokers       map[int32]string // Node ID to address
+	leaders       []int32          // Leader of each partition, -1 if none
+	metadataTime  time.Time
+	conns         map[string]*kafkaConn // By address
+	next          int                   // Partition of the next event without a key
+	correlationID int32
+}
+
+func NewKafka(config KafkaConfig) (*Kafka, error) {
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, errors.New("brokers and topic are required")
+	}
+	switch config.Acks {
+	case KafkaAcksNone, KafkaAcksLeader, KafkaAcksAll:
+	default:
+		return nil, fmt.Errorf("invalid acks %d", config.Acks)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = kafkaDefaultTimeout
+	}
+	if config.ClientID == "" {
+		config.ClientID = kafkaDefaultClientID
+	}
+	k := &Kafka{
+		config: config,
+		conns:  make(map[string]*kafkaConn),
+	}
+	b, err := newBatcher(config.Batch, k.flush)
+	if err != nil {
+		return nil, err
+	}
+	k.batcher = b
+	return k, nil
+}
+
+func (k *Kafka) Send(ev Event) {
+	k.batcher.Send(ev)
+}
+
+func (k *Kafka) Check() error {
+	return k.batcher.Check()
+}
+
+func (k *Kafka) Close() error {
+	k.batcher.Close()
+	for addr, c := range k.conns {
+		_ = c.Close()
+		delete(k.conns, addr)
+	}
+	return nil
+}
+
+func (k *Kafka) flush(events []Event) ([]Event, error) {
+	if k.leaders == nil || time.Since(k.metadataTime) > kafkaMetadataMaxAge {
+		if err := k.refreshMetadata(); err != nil {
+			return events, err
+		}
+	}
+	byPartition := make(map[int32][]Event)
+	for _, ev := range events {
+		p := k.partition(ev.Key)
+		byPartition[p] = append(byPartition[p], ev)
+	}
+	byLeader := make(map[int32][]int32)
+	for p := range byPartition {
+		leader := k.leaders[p]
+		byLeader[leader] = append(byLeader[leader], p)
+	}
+	var failed []Event
+	var firstErr error
+	for leader, partitions := range byLeader {
+		var failedPartitions []int32
+		var err error
+		if addr, ok := k.brokers[leader]; ok {
+			failedPartitions, err = k.produce(addr, partitions, byPartition)
+		} else {
+			failedPartitions, err = partitions, errKafkaNoLeader
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for _, p := range failedPartitions {
+			failed = append(failed, byPartition[p]...)
+		}
+	}
+	if firstErr != nil {
+		// The leaders may have moved
+		k.leaders = nil
+	}
+	return failed, firstErr
+}
+
+// partition returns the partition of an event.
+func (k *Kafka) partition(key []byte) int32 {
+	n := len(k.leaders)
+	if key == nil {
+		k.next = (k.next + 1) % n
+		return int32(k.next)
+	}
+	return int32(int((murmur2(key) & 0x7fffffff)) % n)
+}
+
+func (k *Kafka) refreshMetadata() error {
+	var e kafkaEncoder
+	e.arrayLen(1)
+	e.string(k.config.Topic)
+	e.bool(true) // allow_auto_topic_creation
+	// Try the known brokers first, then the bootstrap ones
+	addrs := make([]string, 0, len(k.brokers)+len(k.config.Brokers))
+	for _, addr := range k.brokers {
+		addrs = append(addrs, addr)
+	}
+	addrs = append(addrs, k.config.Brokers...)
+	var err error
+	for _, addr := range addrs {
+		var resp []byte
+		resp, err = k.request(addr, kafkaAPIMetadata, 4, e.b, true)
+		if err != nil {
+			continue
+		}
+		err = k.parseMetadata(resp)
+		if err == nil {
+			k.metadataTime = time.Now()
+			return nil
+		}
+	}
+	return err
+}
+
+func (k *Kafka) parseMetadata(resp []byte) error {
+	d := kafkaDecoder{b: resp}
+	d.int32() // throttle_time_ms
+	brokers := make(map[int32]string)
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.nullableString() // cluster_id
+	d.int32()          // controller_id
+	var leaders []int32
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := d.int16()
+		name := d.string()
+		d.bool() // is_internal
+		if d.err == nil && name == k.config.Topic && code != 0 {
+			return kafkaError(code)
+		}
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			d.int16() // error_code
+			index := d.int32()
+			leader := d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			if d.err != nil || name != k.config.Topic || index < 0 {
+				continue
+			}
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, -1)
+			}
+			leaders[index] = leader
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(leaders) == 0 {
+		return kafkaError(3) // UNKNOWN_TOPIC_OR_PARTITION
+	}
+	k.brokers, k.leaders = brokers, leaders
+	return nil
+}
+
+// produce sends the events of some partitions to their leader,
+// and returns the partitions that failed.
+func (k *Kafka) produce(addr string, partitions []int32, events map[int32][]Event) ([]int32, error) {
+	var e kafkaEncoder
+	e.int16(-1) // transactional_id
+	e.int16(k.config.Acks)
+	e.int32(int32(k.config.Timeout / time.Millisecond))
+	e.arrayLen(1)
+	e.string(k.config.Topic)
+	e.arrayLen(len(partitions))
+	for _, p := range partitions {
+		e.int32(p)
+		e.bytes(kafkaRecordBatch(events[p]))
+	}
+	resp, err := k.request(addr, kafkaAPIProduce, 3, e.b, k.config.Acks != KafkaAcksNone)
+	if err != nil {
+		return partitions, err
+	}
+	if k.config.Acks == KafkaAcksNone {
+		return nil, nil
+	}
+	d := kafkaDecoder{b: resp}
+	var failed []int32
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // name
+		for j, m := 0, d.arrayLen(); j < m; j++ {
+			index := d.int32()
+			code := d.int16()
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+			if d.err == nil && code != 0 {
+				failed = append(failed, index)
+				if err == nil {
+					err = kafkaError(code)
+				}
+			}
+		}
+	}
+	if d.err != nil {
+		return partitions, d.err
+	}
+	return failed, err
+}
+
+// request sends a request to a broker and returns the body of its response,
+// or nil if no response is expected.
+func (k *Kafka) request(addr string, apiKey, version int16, body []byte, expectResponse bool) ([]byte, error) {
+	c, err := k.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	k.correlationID++
+	resp, err := c.request(apiKey, version, k.correlationID, body, expectResponse, k.config.Timeout)
+	if err != nil {
+		_ = c.Close()
+		delete(k.conns, addr)
+	}
+	return resp, err
+}
+
+func (k *Kafka) conn(addr string) (*kafkaConn, error) {
+	if c, ok := k.conns[addr]; ok {
+		return c, nil
+	}
+	nc, err := net.DialTimeout("tcp", addr, k.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if k.config.TLS != nil {
+		tc := tls.Client(nc, tlsConfigFor(k.config.TLS, addr))
+		_ = tc.SetDeadline(time.Now().Add(k.config.Timeout))
+		if err := tc.Handshake(); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	c := &kafkaConn{Conn: nc, r: bufio.NewReader(nc), clientID: k.config.ClientID}
+	if k.config.Username != "" {
+		k.correlationID += 2
+		if err := c.saslPlain(k.config.Username, k.config.Password, k.correlationID-1, k.config.Timeout); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	k.conns[addr] = c
+	return c, nil
+}
+
+type kafkaConn struct {
+	net.Conn
+	r        *bufio.Reader
+	clientID string
+}
+
+func (c *kafkaConn) request(apiKey, version int16, correlationID int32, body []byte, expectResponse bool, timeout time.Duration) ([]byte, error) {
+	var e kafkaEncoder
+	e.int32(0) // Size, set below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(correlationID)
+	e.string(c.clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	_ = c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(e.b); err != nil {
+		return nil, err
+	}
+	if !expectResponse {
+		return nil, nil
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, fmt.Errorf("kafka: invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != correlationID {
+		return nil, fmt.Errorf("kafka: unexpected correlation ID %d", id)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *kafkaConn) saslPlain(username, password string, correlationID int32, timeout time.Duration) error {
+	var e kafkaEncoder
+	e.string("PLAIN")
+	resp, err := c.request(kafkaAPISaslHandshake, 1, correlationID, e.b, true, timeout)
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{b: resp}
+	if code := d.int16(); d.err == nil && code != 0 {
+		return kafkaError(code)
+	}
+	e = kafkaEncoder{}
+	e.bytes([]byte("\x00" + username + "\x00" + password))
+	resp, err = c.request(kafkaAPISaslAuthenticate, 0, correlationID+1, e.b, true, timeout)
+	if err != nil {
+		return err
+	}
+	d = kafkaDecoder{b: resp}
+	code := d.int16()
+	msg := d.nullableString()
+	if d.err != nil {
+		return d.err
+	}
+	if code != 0 {
+		return fmt.Errorf("%w: %s", kafkaError(code), msg)
+	}
+	return nil
+}
+
+// kafkaRecordBatch encodes events as a record batch (magic 2), without compression.
+func kafkaRecordBatch(events []Event) []byte {
+	base, last := events[0].Time.UnixMilli(), events[0].Time.UnixMilli()
+	for _, ev := range events[1:] {
+		ts := ev.Time.UnixMilli()
+		if ts < base {
+			base = ts
+		}
+		if ts > last {
+			last = ts
+		}
+	}
+	var e kafkaEncoder
+	e.int16(0) // attributes
+	e.int32(int32(len(events) - 1))
+	e.int64(base)
+	e.int64(last)
+	e.int64(-1) // producer_id
+	e.int16(-1) // producer_epoch
+	e.int32(-1) // base_sequence
+	e.int32(int32(len(events)))
+	var rec []byte
+	for i, ev := range events {
+		rec = append(rec[:0], 0) // attributes
+		rec = binary.AppendVarint(rec, ev.Time.UnixMilli()-base)
+		rec = binary.AppendVarint(rec, int64(i))
+		if ev.Key == nil {
+			rec = binary.AppendVarint(rec, -1)
+		} else {
+			rec = binary.AppendVarint(rec, int64(len(ev.Key)))
+			rec = append(rec, ev.Key...)
+		}
+		rec = binary.AppendVarint(rec, int64(len(ev.Data)))
+		rec = append(rec, ev.Data...)
+		rec = binary.AppendVarint(rec, 0) // headers
+		e.b = binary.AppendVarint(e.b, int64(len(rec)))
+		e.b = append(e.b, rec...)
+	}
+	var h kafkaEncoder
+	h.int64(0)                           // base_offset
+	h.int32(int32(4 + 1 + 4 + len(e.b))) // batch_length
+	h.int32(-1)                          // partition_leader_epoch
+	h.b = append(h.b, 2)                 // magic
+	h.int32(int32(crc32.Checksum(e.b, kafkaCRCTable)))
+	return append(h.b, e.b...)
+}
+
+// murmur2 is the hash used by the default partitioner of the Kafka Java client.
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, uint16(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, uint32(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, uint64(v))
+}
+
+func (e *kafkaEncoder) bool(v bool) {
+	if v {
+		e.b = append(e.b, 1)
+	} else {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(bs []byte) {
+	e.int32(int32(len(bs)))
+	e.b = append(e.b, bs...)
+}
+
+func (e *kafkaEncoder) arrayLen(n int) {
+	e.int32(int32(n))
+}
+
+// kafkaDecoder reads the fields of a response. After an error, it returns zero values
+// and err is set.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		d.err = errKafkaShortResponse
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) bool() bool {
+	if b := d.take(1); b != nil {
+		return b[0] != 0
+	}
+	return false
+}
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *kafkaDecoder) int32Array() {
+	d.take(4 * d.arrayLen())
+}
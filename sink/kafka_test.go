@@ -0,0 +1,492 @@
+package sink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKafkaRequest is a request received by a testKafkaBroker.
+type testKafkaRequest struct {
+	APIKey, Version int16
+	ClientID        string
+	Body            []byte
+}
+
+// testKafkaBroker is a single Kafka broker, answering each request with the body returned by handle
+// (no response if nil). handle is called with the mutex held, so what it records can be read
+// after a call to Requests.
+type testKafkaBroker struct {
+	ln     net.Listener
+	handle func(req testKafkaRequest) []byte
+
+	mutex    sync.Mutex
+	requests []testKafkaRequest
+}
+
+func newTestKafkaBroker(t *testing.T, handle func(req testKafkaRequest) []byte) *testKafkaBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testKafkaBroker{ln: ln, handle: handle}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *testKafkaBroker) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return
+		}
+		d := kafkaDecoder{b: frame}
+		req := testKafkaRequest{APIKey: d.int16(), Version: d.int16()}
+		correlationID := d.int32()
+		req.ClientID = d.string()
+		req.Body = d.b
+		b.mutex.Lock()
+		b.requests = append(b.requests, req)
+		body := b.handle(req)
+		b.mutex.Unlock()
+		if body == nil {
+			continue
+		}
+		var e kafkaEncoder
+		e.int32(int32(4 + len(body)))
+		e.int32(correlationID)
+		e.b = append(e.b, body...)
+		if _, err := c.Write(e.b); err != nil {
+			return
+		}
+	}
+}
+
+// Requests returns the API keys of the requests received so far.
+func (b *testKafkaBroker) Requests() []int16 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var keys []int16
+	for _, req := range b.requests {
+		keys = append(keys, req.APIKey)
+	}
+	return keys
+}
+
+// metadata returns a metadata response (v4) with the broker leading all partitions of the topic,
+// or the error code of the topic.
+func (b *testKafkaBroker) metadata(topic string, partitions int, code int16) []byte {
+	host, port, _ := net.SplitHostPort(b.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	var e kafkaEncoder
+	e.int32(0) // throttle_time_ms
+	e.arrayLen(1)
+	e.int32(1)
+	e.string(host)
+	e.int32(int32(p))
+	e.int16(-1) // rack
+	e.int16(-1) // cluster_id
+	e.int32(1)  // controller_id
+	e.arrayLen(1)
+	e.int16(code)
+	e.string(topic)
+	e.bool(false)
+	e.arrayLen(partitions)
+	for i := 0; i < partitions; i++ {
+		e.int16(0)
+		e.int32(int32(i))
+		e.int32(1) // leader
+		e.arrayLen(1)
+		e.int32(1)
+		e.arrayLen(1)
+		e.int32(1)
+	}
+	return e.b
+}
+
+// testKafkaProduce is a decoded produce request (v3).
+type testKafkaProduce struct {
+	Acks    int16
+	Timeout int32
+	Topic   string
+	Batches map[int32][]testKafkaRecord
+}
+
+type testKafkaRecord struct {
+	Key  []byte
+	Data []byte
+	Time int64
+}
+
+func decodeTestKafkaProduce(t *testing.T, body []byte) testKafkaProduce {
+	d := kafkaDecoder{b: body}
+	if id := d.int16(); id != -1 {
+		t.Errorf("transactional_id length = %d, want -1", id)
+	}
+	p := testKafkaProduce{Acks: d.int16(), Timeout: d.int32(), Batches: make(map[int32][]testKafkaRecord)}
+	if n := d.arrayLen(); n != 1 {
+		t.Fatalf("topics = %d, want 1", n)
+	}
+	p.Topic = d.string()
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		index := d.int32()
+		batch := d.take(int(d.int32()))
+		p.Batches[index] = decodeTestKafkaRecordBatch(t, batch)
+	}
+	if d.err != nil || len(d.b) != 0 {
+		t.Fatalf("produce request error = %v, %d bytes left", d.err, len(d.b))
+	}
+	return p
+}
+
+// decodeTestKafkaRecordBatch decodes a record batch, checking its header & CRC.
+func decodeTestKafkaRecordBatch(t *testing.T, batch []byte) []testKafkaRecord {
+	d := kafkaDecoder{b: batch}
+	if offset := d.int64(); offset != 0 {
+		t.Errorf("base_offset = %d, want 0", offset)
+	}
+	if length := d.int32(); int(length) != len(d.b) {
+		t.Errorf("batch_length = %d, want %d", length, len(d.b))
+	}
+	d.int32() // partition_leader_epoch
+	if magic := d.take(1); magic == nil || magic[0] != 2 {
+		t.Errorf("magic = %v, want 2", magic)
+	}
+	crc := uint32(d.int32())
+	if want := crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)); crc != want {
+		t.Errorf("crc = %08x, want %08x", crc, want)
+	}
+	if attributes := d.int16(); attributes != 0 {
+		t.Errorf("attributes = %d, want 0", attributes)
+	}
+	lastOffsetDelta := d.int32()
+	base := d.int64()
+	maxTime := d.int64()
+	d.take(8 + 2 + 4) // producer_id, producer_epoch & base_sequence
+	count := int(d.int32())
+	if int(lastOffsetDelta) != count-1 {
+		t.Errorf("last_offset_delta = %d, want %d", lastOffsetDelta, count-1)
+	}
+	if d.err != nil {
+		t.Fatalf("record batch header error = %v", d.err)
+	}
+	var records []testKafkaRecord
+	r := d.b
+	varint := func() int64 {
+		v, n := binary.Varint(r)
+		if n <= 0 {
+			t.Fatalf("record %d: bad varint", len(records))
+		}
+		r = r[n:]
+		return v
+	}
+	bytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		v := r[:n]
+		r = r[n:]
+		return v
+	}
+	for i := 0; i < count; i++ {
+		length := varint()
+		rest := len(r) - int(length)
+		r = r[1:] // attributes
+		rec := testKafkaRecord{Time: base + varint()}
+		if delta := varint(); delta != int64(i) {
+			t.Errorf("record %d: offset_delta = %d", i, delta)
+		}
+		rec.Key = bytes()
+		rec.Data = bytes()
+		if headers := varint(); headers != 0 {
+			t.Errorf("record %d: headers = %d, want 0", i, headers)
+		}
+		if len(r) != rest {
+			t.Errorf("record %d: length = %d, want %d", i, length, int(length)+len(r)-rest)
+		}
+		if rec.Time > maxTime {
+			t.Errorf("record %d: time %d after max_timestamp %d", i, rec.Time, maxTime)
+		}
+		records = append(records, rec)
+	}
+	if len(r) != 0 {
+		t.Errorf("%d bytes after the records", len(r))
+	}
+	return records
+}
+
+// testKafkaProduceResponse returns a produce response (v3) with the error code of each partition.
+func testKafkaProduceResponse(topic string, codes map[int32]int16) []byte {
+	var e kafkaEncoder
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(codes))
+	for p, code := range codes {
+		e.int32(p)
+		e.int16(code)
+		e.int64(0)  // base_offset
+		e.int64(-1) // log_append_time_ms
+	}
+	e.int32(0) // throttle_time_ms
+	return e.b
+}
+
+func TestMurmur2(t *testing.T) {
+	// From the tests of the Kafka Java client
+	testCases := []struct {
+		data string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+	for _, tc := range testCases {
+		if got := int32(murmur2([]byte(tc.data))); got != tc.want {
+			t.Errorf("murmur2(%q) = %d, want %d", tc.data, got, tc.want)
+		}
+	}
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	start := time.UnixMilli(1700000000000)
+	testCases := []struct {
+		name   string
+		events []Event
+		want   []testKafkaRecord
+	}{
+		{
+			name:   "one",
+			events: []Event{{Key: []byte("k"), Time: start, Data: []byte(`{"a":1}`)}},
+			want:   []testKafkaRecord{{Key: []byte("k"), Data: []byte(`{"a":1}`), Time: start.UnixMilli()}},
+		},
+		{
+			name: "out of order & no key",
+			events: []Event{
+				{Time: start.Add(time.Second), Data: []byte("b")},
+				{Key: []byte("k"), Time: start, Data: []byte("a")},
+				{Time: start.Add(2 * time.Second), Data: make([]byte, 300)}, // Multi byte varint lengths
+			},
+			want: []testKafkaRecord{
+				{Data: []byte("b"), Time: start.UnixMilli() + 1000},
+				{Key: []byte("k"), Data: []byte("a"), Time: start.UnixMilli()},
+				{Data: make([]byte, 300), Time: start.UnixMilli() + 2000},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := decodeTestKafkaRecordBatch(t, kafkaRecordBatch(tc.events))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("records = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKafkaDecoder_Short(t *testing.T) {
+	d := kafkaDecoder{b: []byte{0, 5, 'a', 'b'}}
+	if s := d.string(); s != "" || !errors.Is(d.err, errKafkaShortResponse) {
+		t.Errorf("string() = %q, error = %v, want short response", s, d.err)
+	}
+	if v := d.int32(); v != 0 {
+		t.Errorf("int32() after an error = %d, want 0", v)
+	}
+	d = kafkaDecoder{b: []byte{0xff, 0xff, 0xff, 0xff}}
+	if n := d.arrayLen(); n != 0 || d.err != nil {
+		t.Errorf("arrayLen() of a null array = %d, error = %v", n, d.err)
+	}
+}
+
+func TestKafka_Flush(t *testing.T) {
+	const topic = "events"
+	start := time.UnixMilli(1700000000000)
+	events := []Event{
+		{Key: []byte("foobar"), Time: start, Data: []byte("1")},
+		{Key: []byte("foobar"), Time: start.Add(time.Millisecond), Data: []byte("2")},
+		{Key: []byte("a-little-bit-long-string"), Time: start, Data: []byte("3")},
+	}
+	testCases := []struct {
+		name       string
+		acks       int16
+		metadata   int16           // Error code of the topic
+		codes      map[int32]int16 // Error codes of the partitions
+		wantFailed []Event
+		wantErr    error
+		wantAPIs   []int16
+	}{
+		{
+			name:     "acks all",
+			acks:     KafkaAcksAll,
+			codes:    map[int32]int16{0: 0, 2: 0},
+			wantAPIs: []int16{kafkaAPIMetadata, kafkaAPIProduce},
+		},
+		{
+			name:     "acks none",
+			acks:     KafkaAcksNone,
+			wantAPIs: []int16{kafkaAPIMetadata, kafkaAPIProduce},
+		},
+		{
+			name:       "partition error",
+			acks:       KafkaAcksLeader,
+			codes:      map[int32]int16{0: 0, 2: 6},
+			wantFailed: events[2:],
+			wantErr:    kafkaError(6),
+			wantAPIs:   []int16{kafkaAPIMetadata, kafkaAPIProduce},
+		},
+		{
+			name:       "unknown topic",
+			acks:       KafkaAcksLeader,
+			metadata:   29,
+			wantFailed: events,
+			wantErr:    kafkaError(29),
+			wantAPIs:   []int16{kafkaAPIMetadata},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var broker *testKafkaBroker
+			var produce testKafkaProduce
+			broker = newTestKafkaBroker(t, func(req testKafkaRequest) []byte {
+				if req.ClientID != kafkaDefaultClientID {
+					t.Errorf("client ID = %q, want %q", req.ClientID, kafkaDefaultClientID)
+				}
+				switch req.APIKey {
+				case kafkaAPIMetadata:
+					return broker.metadata(topic, 3, tc.metadata)
+				case kafkaAPIProduce:
+					produce = decodeTestKafkaProduce(t, req.Body)
+					if tc.acks == KafkaAcksNone {
+						return nil
+					}
+					return testKafkaProduceResponse(topic, tc.codes)
+				}
+				t.Errorf("unexpected API key %d", req.APIKey)
+				return nil
+			})
+			k, err := NewKafka(KafkaConfig{Brokers: []string{broker.ln.Addr().String()}, Topic: topic, Acks: tc.acks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer k.Close()
+			failed, err := k.flush(events)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("flush() error = %v, want %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(failed, tc.wantFailed) {
+				t.Errorf("flush() failed = %v, want %v", failed, tc.wantFailed)
+			}
+			if tc.acks == KafkaAcksNone {
+				// Nothing to wait for, but the connection is kept: ask for metadata again to sync
+				k.leaders = nil
+				if err := k.refreshMetadata(); err != nil {
+					t.Fatal(err)
+				}
+				tc.wantAPIs = append(tc.wantAPIs, kafkaAPIMetadata)
+			}
+			if got := broker.Requests(); !reflect.DeepEqual(got, tc.wantAPIs) {
+				t.Fatalf("requests = %v, want %v", got, tc.wantAPIs)
+			}
+			if tc.metadata != 0 {
+				return
+			}
+			if produce.Acks != tc.acks || produce.Timeout != int32(kafkaDefaultTimeout/time.Millisecond) || produce.Topic != topic {
+				t.Errorf("produce = %d, %d, %q", produce.Acks, produce.Timeout, produce.Topic)
+			}
+			// By murmur2(key) & 0x7fffffff % 3, as in TestMurmur2
+			want := map[int32][]testKafkaRecord{
+				0: {
+					{Key: []byte("foobar"), Data: []byte("1"), Time: start.UnixMilli()},
+					{Key: []byte("foobar"), Data: []byte("2"), Time: start.UnixMilli() + 1},
+				},
+				2: {{Key: []byte("a-little-bit-long-string"), Data: []byte("3"), Time: start.UnixMilli()}},
+			}
+			if !reflect.DeepEqual(produce.Batches, want) {
+				t.Errorf("batches = %+v, want %+v", produce.Batches, want)
+			}
+		})
+	}
+}
+
+func TestKafka_SASL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		handshake int16
+		auth      int16
+		wantErr   error
+	}{
+		{"ok", 0, 0, nil},
+		{"unsupported mechanism", 33, 0, kafkaError(33)},
+		{"authentication failed", 0, 58, kafkaError(58)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			broker := newTestKafkaBroker(t, func(req testKafkaRequest) []byte {
+				var e kafkaEncoder
+				switch req.APIKey {
+				case kafkaAPISaslHandshake:
+					if d := (kafkaDecoder{b: req.Body}); d.string() != "PLAIN" {
+						t.Errorf("mechanism = %q, want PLAIN", req.Body)
+					}
+					e.int16(tc.handshake)
+					e.arrayLen(1)
+					e.string("PLAIN")
+				case kafkaAPISaslAuthenticate:
+					d := kafkaDecoder{b: req.Body}
+					if token := string(d.take(int(d.int32()))); token != "\x00user\x00pass" {
+						t.Errorf("token = %q", token)
+					}
+					e.int16(tc.auth)
+					if tc.auth != 0 {
+						e.string("bad credentials")
+					} else {
+						e.int16(-1)
+					}
+					e.bytes(nil) // auth_bytes
+				default:
+					t.Errorf("unexpected API key %d", req.APIKey)
+				}
+				return e.b
+			})
+			k, err := NewKafka(KafkaConfig{Brokers: []string{"unused:9092"}, Topic: "events", Username: "user", Password: "pass"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer k.Close()
+			_, err = k.conn(broker.ln.Addr().String())
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("conn() error = %v, want %v", err, tc.wantErr)
+			}
+			if got := len(k.conns); got != 0 && tc.wantErr != nil {
+				t.Errorf("conns = %d after a failed authentication, want 0", got)
+			}
+		})
+	}
+}
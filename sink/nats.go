@@ -0,0 +1,336 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natsDefaultTimeout    = 10 * time.Second
+	natsDefaultMaxPayload = 1024 * 1024
+	natsMaxLineSize       = 64 * 1024
+)
+
+var (
+	_ Sink = (*NATS)(nil)
+
+	errNATSNoServers     = errors.New("nats: no server available")
+	errNATSTimeout       = errors.New("nats: timeout waiting for the server")
+	errNATSPayloadTooBig = errors.New("nats: event larger than the server's max payload")
+)
+
+// NATSConfig is the configuration of a NATS sink.
+type NATSConfig struct {
+	Servers []string // host:port, tried in order
+	// Subject the events are published to. "{type}" is replaced by the event type,
+	// and "{key}" by the event key (with dots replaced by underscores).
+	Subject string
+	// Token, or Username & Password, to authenticate with. Optional.
+	Token    string
+	Username string
+	Password string
+	// TLS is the TLS config to connect with. If nil, TLS is still used with the default config
+	// when the server requires it.
+	TLS *tls.Config
+	// Timeout for connecting, and for the server to acknowledge a batch. Zero means the default (10s).
+	Timeout time.Duration
+	Batch   BatchConfig
+}
+
+// NATS is a sink that publishes the events to a NATS subject (core NATS, at most once on the
+// server's side). Each batch is followed by a PING, and only considered sent once the server
+// answers with a PONG, so that events aren't silently lost when the connection breaks.
+type NATS struct {
+	config  NATSConfig
+	batcher *batcher
+
+	// Only used by the batcher's worker
+	conn   *natsConn
+	server int // Index of the next server to connect to
+}
+
+func NewNATS(config NATSConfig) (*NATS, error) {
+	if len(config.Servers) == 0 || config.Subject == "" {
+		return nil, errors.New("servers and subject are required")
+	}
+	if strings.ContainsAny(config.Subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid subject %q", config.Subject)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = natsDefaultTimeout
+	}
+	n := &NATS{config: config}
+	b, err := newBatcher(config.Batch, n.flush)
+	if err != nil {
+		return nil, err
+	}
+	n.batcher = b
+	return n, nil
+}
+
+func (n *NATS) Send(ev Event) {
+	n.batcher.Send(ev)
+}
+
+func (n *NATS) Check() error {
+	return n.batcher.Check()
+}
+
+func (n *NATS) Close() error {
+	n.batcher.Close()
+	if n.conn != nil {
+		_ = n.conn.Close()
+		n.conn = nil
+	}
+	return nil
+}
+
+func (n *NATS) flush(events []Event) ([]Event, error) {
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return events, err
+		}
+	}
+	failed, err := n.conn.publish(events, n.subject, n.config.Timeout)
+	if err != nil && failed == nil {
+		_ = n.conn.Close()
+		n.conn = nil
+		return events, err
+	}
+	return failed, err
+}
+
+func (n *NATS) subject(ev Event) string {
+	s := strings.ReplaceAll(n.config.Subject, "{type}", ev.Type)
+	if strings.Contains(s, "{key}") {
+		key := "none"
+		if len(ev.Key) > 0 {
+			key = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_").Replace(string(ev.Key))
+		}
+		s = strings.ReplaceAll(s, "{key}", key)
+	}
+	return s
+}
+
+// connect connects to the next server that accepts the connection.
+func (n *NATS) connect() error {
+	err := errNATSNoServers
+	for range n.config.Servers {
+		addr := n.config.Servers[n.server]
+		n.server = (n.server + 1) % len(n.config.Servers)
+		var c *natsConn
+		c, err = dialNATS(addr, n.config)
+		if err == nil {
+			n.conn = c
+			return nil
+		}
+	}
+	return err
+}
+
+type natsInfo struct {
+	MaxPayload  int  `json:"max_payload"`
+	TLSRequired bool `json:"tls_required"`
+}
+
+type natsConnect struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	AuthToken   string `json:"auth_token,omitempty"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+}
+
+// natsConn is a connection to a NATS server. A background goroutine reads from it
+// to answer the server's PINGs and receive the PONGs & errors.
+type natsConn struct {
+	net.Conn
+	maxPayload int
+
+	wMutex sync.Mutex
+	w      *bufio.Writer
+
+	pongs chan struct{}
+	errs  chan error    // -ERR from the server
+	dead  chan struct{} // Closed when the reader exits
+	err   error         // Why the reader exited, set before dead is closed
+}
+
+func dialNATS(addr string, config NATSConfig) (*natsConn, error) {
+	nc, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = nc.SetDeadline(time.Now().Add(config.Timeout))
+	r := bufio.NewReaderSize(nc, natsMaxLineSize)
+	line, err := readNATSLine(r)
+	if err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	var info natsInfo
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		_ = nc.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q", line)
+	}
+	if info.MaxPayload <= 0 {
+		info.MaxPayload = natsDefaultMaxPayload
+	}
+	tlsConfig := config.TLS
+	if tlsConfig == nil && info.TLSRequired {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig != nil {
+		tc := tls.Client(nc, tlsConfigFor(tlsConfig, addr))
+		if err := tc.Handshake(); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+		nc = tc
+		r = bufio.NewReaderSize(nc, natsMaxLineSize)
+	}
+	connect, _ := json.Marshal(natsConnect{
+		TLSRequired: tlsConfig != nil,
+		Name:        "OpenGFW",
+		Lang:        "go",
+		Version:     "1.0.0",
+		Protocol:    1,
+		AuthToken:   config.Token,
+		User:        config.Username,
+		Pass:        config.Password,
+	})
+	w := bufio.NewWriter(nc)
+	_, _ = w.WriteString("CONNECT ")
+	_, _ = w.Write(connect)
+	_, _ = w.WriteString("\r\nPING\r\n")
+	if err := w.Flush(); err != nil {
+		_ = nc.Close()
+		return nil, err
+	}
+	// Wait for the PONG, or the error if the server rejected us
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			_ = nc.Close()
+			return nil, fmt.Errorf("nats: %s", strings.TrimSpace(line[4:]))
+		}
+	}
+	_ = nc.SetDeadline(time.Time{})
+	c := &natsConn{
+		Conn:       nc,
+		maxPayload: info.MaxPayload,
+		w:          w,
+		pongs:      make(chan struct{}, 1),
+		errs:       make(chan error, 1),
+		dead:       make(chan struct{}),
+	}
+	go c.reader(r)
+	return c, nil
+}
+
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+func (c *natsConn) reader(r *bufio.Reader) {
+	defer close(c.dead)
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		switch {
+		case line == "PING":
+			c.wMutex.Lock()
+			_, _ = c.w.WriteString("PONG\r\n")
+			err = c.w.Flush()
+			c.wMutex.Unlock()
+			if err != nil {
+				c.err = err
+				return
+			}
+		case line == "PONG":
+			select {
+			case c.pongs <- struct{}{}:
+			default:
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			select {
+			case c.errs <- fmt.Errorf("nats: %s", strings.TrimSpace(line[4:])):
+			default:
+			}
+		}
+	}
+}
+
+// publish publishes the events and waits for the server to acknowledge them.
+// If the connection is still usable after an error, it returns the events that failed
+// (the whole batch if the server reported an error, as there's no telling which event caused it),
+// otherwise nil.
+func (c *natsConn) publish(events []Event, subject func(Event) string, timeout time.Duration) ([]Event, error) {
+	var tooBig []Event
+	c.wMutex.Lock()
+	_ = c.SetWriteDeadline(time.Now().Add(timeout))
+	for _, ev := range events {
+		if len(ev.Data) > c.maxPayload {
+			tooBig = append(tooBig, ev)
+			continue
+		}
+		_, _ = c.w.WriteString("PUB ")
+		_, _ = c.w.WriteString(subject(ev))
+		_, _ = c.w.WriteString(" ")
+		_, _ = c.w.WriteString(strconv.Itoa(len(ev.Data)))
+		_, _ = c.w.WriteString("\r\n")
+		_, _ = c.w.Write(ev.Data)
+		_, _ = c.w.WriteString("\r\n")
+	}
+	_, _ = c.w.WriteString("PING\r\n")
+	err := c.w.Flush()
+	c.wMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-c.pongs:
+	case <-c.dead:
+		return nil, c.err
+	case <-time.After(timeout):
+		return nil, errNATSTimeout
+	}
+	select {
+	case err := <-c.errs:
+		// The server keeps the connection open after non-fatal errors, like a permissions violation
+		return events, permanentError{Err: err}
+	default:
+	}
+	if len(tooBig) > 0 {
+		return tooBig, permanentError{Err: errNATSPayloadTooBig}
+	}
+	return nil, nil
+}
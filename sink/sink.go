@@ -0,0 +1,290 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	batchDefaultSize       = 100
+	batchDefaultTimeout    = time.Second
+	batchDefaultQueueSize  = 10000
+	batchDefaultRetryDelay = time.Second
+)
+
+var errQueueFull = errors.New("queue full")
+
+// Event is an event to send to a sink.
+type Event struct {
+	Type string    // Event type, e.g. "alert" or "flow"
+	Key  []byte    // Partitioning key, events with the same key are kept in order. May be nil
+	Time time.Time // When the event happened
+	Data []byte    // Encoded event, JSON without a trailing newline
+}
+
+// Sink sends events to an external system (a file, a message bus, a database...).
+type Sink interface {
+	// Send queues an event to be sent. It must not keep the event's data past the call
+	// if it may be reused, and it only blocks if the sink is configured to apply backpressure.
+	Send(ev Event)
+	// Close flushes the queued events and releases the sink's resources.
+	Close() error
+}
+
+// Checker is implemented by sinks that can tell whether they are able to send events.
+type Checker interface {
+	// Check returns the error of the latest attempt to send events,
+	// nil if it succeeded or there hasn't been any yet.
+	Check() error
+}
+
+// BatchConfig is the configuration of the queue & batching of a sink.
+type BatchConfig struct {
+	// Size is the maximum number of events sent at once. Zero means the default (100).
+	Size int
+	// Timeout is how long an event may wait for its batch to fill up. Zero means the default (1s).
+	Timeout time.Duration
+	// QueueSize is the number of events waiting to be sent. Zero means the default (10000).
+	QueueSize int
+	// Block makes Send wait for room in the queue when it's full, which slows the engine down
+	// to the pace of the sink, instead of dropping the event.
+	Block bool
+	// Retries is the number of times a failed batch is retried,
+	// waiting RetryDelay (default 1s) before the first retry and doubling it after each.
+	Retries    int
+	RetryDelay time.Duration
+	// ErrorFunc, if set, is called with the errors of batches that failed to be sent,
+	// and when events are dropped because the queue is full.
+	ErrorFunc func(err error)
+}
+
+func (c *BatchConfig) check() error {
+	if c.Size < 0 || c.QueueSize < 0 || c.Retries < 0 {
+		return errors.New("batch size, queue size and retries must not be negative")
+	}
+	if c.Size == 0 {
+		c.Size = batchDefaultSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = batchDefaultTimeout
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = batchDefaultQueueSize
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = batchDefaultRetryDelay
+	}
+	return nil
+}
+
+// flushFunc sends a batch of events, and returns those that failed to be sent if it fails.
+// Failed events are retried, unless the error is a permanentError.
+type flushFunc func(events []Event) ([]Event, error)
+
+// permanentError is an error retrying won't fix, e.g. the events are rejected by the server.
+type permanentError struct {
+	Err error
+}
+
+func (e permanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.Err
+}
+
+// batcher queues events and sends them in batches from a background goroutine.
+type batcher struct {
+	config  BatchConfig
+	flush   flushFunc
+	queue   chan Event
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+	lastErr atomic.Pointer[error] // Of the latest batch, nil if it has been sent
+}
+
+func newBatcher(config BatchConfig, flush flushFunc) (*batcher, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	b := &batcher{
+		config: config,
+		flush:  flush,
+		queue:  make(chan Event, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.worker()
+	return b, nil
+}
+
+func (b *batcher) Send(ev Event) {
+	if b.config.Block {
+		select {
+		case b.queue <- ev:
+		case <-b.done:
+		}
+		return
+	}
+	select {
+	case b.queue <- ev:
+	default:
+		b.dropped.Add(1)
+	}
+}
+
+func (b *batcher) worker() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.config.Timeout)
+	defer ticker.Stop()
+	batch := make([]Event, 0, b.config.Size)
+	for {
+		select {
+		case <-b.done:
+			// Last attempt for what's left, without retries
+			for {
+				select {
+				case ev := <-b.queue:
+					batch = append(batch, ev)
+					if len(batch) >= b.config.Size {
+						b.send(batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			if len(batch) > 0 {
+				b.send(batch)
+			}
+			return
+		case ev := <-b.queue:
+			batch = append(batch, ev)
+			if len(batch) < b.config.Size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				b.reportDropped()
+				continue
+			}
+		}
+		b.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send sends a batch, retrying the events that failed.
+func (b *batcher) send(batch []Event) {
+	b.reportDropped()
+	delay := b.config.RetryDelay
+	for i := 0; ; i++ {
+		failed, err := b.flush(batch)
+		if err == nil {
+			b.lastErr.Store(nil)
+			return
+		}
+		b.lastErr.Store(&err)
+		if i >= b.config.Retries || errors.As(err, new(permanentError)) {
+			b.reportError(fmt.Errorf("%w, %d events dropped", err, len(failed)))
+			return
+		}
+		select {
+		case <-b.done:
+			b.reportError(fmt.Errorf("%w, %d events dropped", err, len(failed)))
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		batch = failed
+	}
+}
+
+func (b *batcher) reportDropped() {
+	if n := b.dropped.Swap(0); n > 0 {
+		b.reportError(fmt.Errorf("%w, %d events dropped", errQueueFull, n))
+	}
+}
+
+func (b *batcher) reportError(err error) {
+	if b.config.ErrorFunc != nil {
+		b.config.ErrorFunc(err)
+	}
+}
+
+// Check returns the error of the latest attempt to send a batch.
+func (b *batcher) Check() error {
+	if err := b.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Close stops the worker after a last attempt to send the queued events.
+func (b *batcher) Close() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+// tlsConfigFor returns the TLS config to connect to addr, with the server name set from it if empty.
+func tlsConfigFor(config *tls.Config, addr string) *tls.Config {
+	if config.ServerName != "" {
+		return config
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// flattenJSON returns the leaf values of a JSON object by their dotted path, e.g. "alert.signature",
+// or "dns.answers.0.rdata" for arrays. Numbers are json.Number.
+func flattenJSON(data []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	flattenValue(fields, "", v)
+	return fields, nil
+}
+
+func flattenValue(fields map[string]interface{}, path string, v interface{}) {
+	join := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			flattenValue(fields, join(k), e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenValue(fields, join(strconv.Itoa(i)), e)
+		}
+	case nil:
+	default:
+		if path != "" {
+			fields[path] = v
+		}
+	}
+}
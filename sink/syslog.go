@@ -0,0 +1,293 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syslogDefaultTimeout  = 10 * time.Second
+	syslogDefaultAppName  = "OpenGFW"
+	syslogTimeFormat      = "2006-01-02T15:04:05.000000Z07:00"
+	syslogMaxUDPSize      = 65507
+	syslogMaxParamNameLen = 32
+	// syslogSDID is the ID of the structured data element with the fields of the event.
+	// 32473 is the private enterprise number reserved for documentation (RFC 5612).
+	syslogSDID = "opengfw@32473"
+
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+)
+
+var (
+	_ Sink = (*Syslog)(nil)
+
+	errSyslogTooLarge = errors.New("syslog: message too large for UDP")
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"ntp":      12,
+	"security": 13,
+	"console":  14,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// ParseSyslogFacility returns the code of a syslog facility from its name (e.g. "local0").
+func ParseSyslogFacility(name string) (int, bool) {
+	f, ok := syslogFacilities[strings.ToLower(name)]
+	return f, ok
+}
+
+// SyslogConfig is the configuration of a Syslog sink.
+type SyslogConfig struct {
+	Network string // udp or tcp
+	Addr    string // host:port
+	// TLS is the TLS config to connect with (RFC 5425), only for tcp. nil for plaintext.
+	TLS *tls.Config
+	// NewlineFraming separates the messages over TCP with a newline instead of prefixing
+	// them with their length (octet counting, RFC 6587), for receivers that only support it.
+	NewlineFraming bool
+	Facility       int
+	Hostname       string        // Default os.Hostname()
+	AppName        string        // Default "OpenGFW"
+	Timeout        time.Duration // For connecting & writing. Zero means the default (10s)
+	Batch          BatchConfig
+}
+
+// Syslog is a sink that sends the events as RFC 5424 syslog messages. The message is the event's
+// JSON, its fields are also in a structured data element (flattened, e.g. "alert.signature"),
+// for receivers that index those. The MSGID is the event type, and alerts have the warning
+// severity, other events informational.
+type Syslog struct {
+	config  SyslogConfig
+	batcher *batcher
+	procID  string
+
+	conn net.Conn // Only used by the batcher's worker
+}
+
+func NewSyslog(config SyslogConfig) (*Syslog, error) {
+	switch config.Network {
+	case "udp":
+		if config.TLS != nil {
+			return nil, errors.New("tls is only supported over tcp")
+		}
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", config.Network)
+	}
+	if config.Addr == "" {
+		return nil, errors.New("addr is required")
+	}
+	if config.Facility < 0 || config.Facility > 23 {
+		return nil, fmt.Errorf("invalid facility %d", config.Facility)
+	}
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+	}
+	if config.AppName == "" {
+		config.AppName = syslogDefaultAppName
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = syslogDefaultTimeout
+	}
+	s := &Syslog{
+		config: config,
+		procID: strconv.Itoa(os.Getpid()),
+	}
+	b, err := newBatcher(config.Batch, s.flush)
+	if err != nil {
+		return nil, err
+	}
+	s.batcher = b
+	return s, nil
+}
+
+func (s *Syslog) Send(ev Event) {
+	s.batcher.Send(ev)
+}
+
+func (s *Syslog) Check() error {
+	return s.batcher.Check()
+}
+
+func (s *Syslog) Close() error {
+	s.batcher.Close()
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
+
+func (s *Syslog) flush(events []Event) ([]Event, error) {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return events, err
+		}
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	if s.config.Network == "udp" {
+		// One datagram per message. Errors (e.g. ICMP port unreachable from a previous
+		// datagram) are transient, so the connection is kept.
+		var tooLarge []Event
+		for i, ev := range events {
+			msg := s.message(ev)
+			if len(msg) > syslogMaxUDPSize {
+				tooLarge = append(tooLarge, ev)
+				continue
+			}
+			if _, err := s.conn.Write(msg); err != nil {
+				return events[i:], err
+			}
+		}
+		if len(tooLarge) > 0 {
+			return tooLarge, permanentError{Err: errSyslogTooLarge}
+		}
+		return nil, nil
+	}
+	w := bufio.NewWriter(s.conn)
+	for _, ev := range events {
+		msg := s.message(ev)
+		if s.config.NewlineFraming {
+			_, _ = w.Write(bytes.ReplaceAll(msg, []byte("\n"), []byte(" ")))
+			_ = w.WriteByte('\n')
+		} else {
+			_, _ = w.WriteString(strconv.Itoa(len(msg)))
+			_ = w.WriteByte(' ')
+			_, _ = w.Write(msg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return events, err
+	}
+	return nil, nil
+}
+
+func (s *Syslog) connect() error {
+	conn, err := net.DialTimeout(s.config.Network, s.config.Addr, s.config.Timeout)
+	if err != nil {
+		return err
+	}
+	if s.config.TLS != nil {
+		tc := tls.Client(conn, tlsConfigFor(s.config.TLS, s.config.Addr))
+		_ = tc.SetDeadline(time.Now().Add(s.config.Timeout))
+		if err := tc.Handshake(); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		_ = tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+	s.conn = conn
+	return nil
+}
+
+// message formats an event as an RFC 5424 message.
+func (s *Syslog) message(ev Event) []byte {
+	severity := syslogSeverityInfo
+	if ev.Type == "alert" {
+		severity = syslogSeverityWarning
+	}
+	ts := "-"
+	if !ev.Time.IsZero() {
+		ts = ev.Time.Format(syslogTimeFormat)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ",
+		s.config.Facility*8+severity, ts,
+		syslogHeaderField(s.config.Hostname, 255),
+		syslogHeaderField(s.config.AppName, 48),
+		syslogHeaderField(s.procID, 128),
+		syslogHeaderField(ev.Type, 32))
+	writeSyslogSD(&b, ev.Data)
+	b.WriteByte(' ')
+	b.Write(ev.Data)
+	return b.Bytes()
+}
+
+// syslogHeaderField returns a header field as printable ASCII without spaces,
+// or the nil value ("-") if it's empty.
+func syslogHeaderField(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// writeSyslogSD writes the structured data element with the flattened fields of a JSON object.
+func writeSyslogSD(b *bytes.Buffer, data []byte) {
+	fields, err := flattenJSON(data)
+	if err != nil {
+		b.WriteByte('-')
+		return
+	}
+	params := make(map[string]string, len(fields))
+	for name, v := range fields {
+		if name == "timestamp" || len(name) > syslogMaxParamNameLen || strings.ContainsAny(name, "= ]\"") {
+			// Already in the header, or not a valid PARAM-NAME
+			continue
+		}
+		params[name] = fmt.Sprint(v)
+	}
+	if len(params) == 0 {
+		b.WriteByte('-')
+		return
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("[" + syslogSDID)
+	for _, name := range names {
+		b.WriteString(" " + name + `="`)
+		for _, r := range params[name] {
+			if r == '"' || r == '\\' || r == ']' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+}